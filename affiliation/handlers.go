@@ -1713,4 +1713,800 @@ func Configure(api *operations.DevAnalyticsAffiliationAPI, service Service) {
 			return affiliation.NewGetAffiliationBothOK().WithXREQUESTID(requestID).WithPayload(result)
 		},
 	)
+	api.AffiliationPostAffiliationBatchHandler = affiliation.PostAffiliationBatchHandlerFunc(
+		func(params affiliation.PostAffiliationBatchParams) middleware.Responder {
+			log.Info("PostAffiliationBatchHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PostAffiliationBatchHandlerFunc: " + info)
+
+			result, err := service.PostAffiliationBatch(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PostAffiliationBatchHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PostAffiliationBatchHandlerFunc(ok): " + info)
+
+			return affiliation.NewPostAffiliationBatchOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetAffiliationTimelineHandler = affiliation.GetAffiliationTimelineHandlerFunc(
+		func(params affiliation.GetAffiliationTimelineParams) middleware.Responder {
+			log.Info("GetAffiliationTimelineHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetAffiliationTimelineHandlerFunc: " + info)
+
+			if service.IsProjectSkipped(params.ProjectSlug) {
+				log.Info("AffiliationGetAffiliationTimelineHandler: project " + params.ProjectSlug + " is disabled")
+				return affiliation.NewGetAffiliationTimelineNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.GetAffiliationTimeline(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetAffiliationTimelineHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetAffiliationTimelineHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetAffiliationTimelineOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetListAffiliationPoliciesHandler = affiliation.GetListAffiliationPoliciesHandlerFunc(
+		func(params affiliation.GetListAffiliationPoliciesParams) middleware.Responder {
+			log.Info("GetListAffiliationPoliciesHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetListAffiliationPoliciesHandlerFunc: " + info)
+
+			result, err := service.GetListAffiliationPolicies(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetListAffiliationPoliciesHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetListAffiliationPoliciesHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetListAffiliationPoliciesOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutAffiliationPolicyHandler = affiliation.PutAffiliationPolicyHandlerFunc(
+		func(params affiliation.PutAffiliationPolicyParams) middleware.Responder {
+			log.Info("PutAffiliationPolicyHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutAffiliationPolicyHandlerFunc: " + info)
+
+			result, err := service.PutAffiliationPolicy(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutAffiliationPolicyHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutAffiliationPolicyHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutAffiliationPolicyOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationDeleteAffiliationPolicyHandler = affiliation.DeleteAffiliationPolicyHandlerFunc(
+		func(params affiliation.DeleteAffiliationPolicyParams) middleware.Responder {
+			log.Info("DeleteAffiliationPolicyHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("DeleteAffiliationPolicyHandlerFunc: " + info)
+
+			result, err := service.DeleteAffiliationPolicy(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("DeleteAffiliationPolicyHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("DeleteAffiliationPolicyHandlerFunc(ok): " + info)
+
+			return affiliation.NewDeleteAffiliationPolicyOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetEmployerChangesHandler = affiliation.GetEmployerChangesHandlerFunc(
+		func(params affiliation.GetEmployerChangesParams) middleware.Responder {
+			log.Info("GetEmployerChangesHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetEmployerChangesHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationGetEmployerChangesHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewGetEmployerChangesNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.GetEmployerChanges(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetEmployerChangesHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetEmployerChangesHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetEmployerChangesOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetAffiliationCacheStatsHandler = affiliation.GetAffiliationCacheStatsHandlerFunc(
+		func(params affiliation.GetAffiliationCacheStatsParams) middleware.Responder {
+			log.Info("GetAffiliationCacheStatsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetAffiliationCacheStatsHandlerFunc: " + info)
+
+			result, err := service.GetAffiliationCacheStats(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetAffiliationCacheStatsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetAffiliationCacheStatsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetAffiliationCacheStatsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetEnrollmentConflictsHandler = affiliation.GetEnrollmentConflictsHandlerFunc(
+		func(params affiliation.GetEnrollmentConflictsParams) middleware.Responder {
+			log.Info("GetEnrollmentConflictsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetEnrollmentConflictsHandlerFunc: " + info)
+
+			result, err := service.GetEnrollmentConflicts(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetEnrollmentConflictsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetEnrollmentConflictsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetEnrollmentConflictsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutDetectEnrollmentConflictsHandler = affiliation.PutDetectEnrollmentConflictsHandlerFunc(
+		func(params affiliation.PutDetectEnrollmentConflictsParams) middleware.Responder {
+			log.Info("PutDetectEnrollmentConflictsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutDetectEnrollmentConflictsHandlerFunc: " + info)
+
+			result, err := service.PutDetectEnrollmentConflicts(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutDetectEnrollmentConflictsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutDetectEnrollmentConflictsHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutDetectEnrollmentConflictsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetAffiliationGapsHandler = affiliation.GetAffiliationGapsHandlerFunc(
+		func(params affiliation.GetAffiliationGapsParams) middleware.Responder {
+			log.Info("GetAffiliationGapsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetAffiliationGapsHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationGetAffiliationGapsHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewGetAffiliationGapsNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.GetAffiliationGaps(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetAffiliationGapsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetAffiliationGapsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetAffiliationGapsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPostImportEnrollmentsCSVHandler = affiliation.PostImportEnrollmentsCSVHandlerFunc(
+		func(params affiliation.PostImportEnrollmentsCSVParams) middleware.Responder {
+			log.Info("PostImportEnrollmentsCSVHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PostImportEnrollmentsCSVHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationPostImportEnrollmentsCSVHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewPostImportEnrollmentsCSVNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.PostImportEnrollmentsCSV(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PostImportEnrollmentsCSVHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PostImportEnrollmentsCSVHandlerFunc(ok): " + info)
+
+			return affiliation.NewPostImportEnrollmentsCSVOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetGitdmExportHandler = affiliation.GetGitdmExportHandlerFunc(
+		func(params affiliation.GetGitdmExportParams) middleware.Responder {
+			log.Info("GetGitdmExportHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetGitdmExportHandlerFunc: " + info)
+
+			result, err := service.GetGitdmExport(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetGitdmExportHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetGitdmExportHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetGitdmExportOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPostGitdmImportHandler = affiliation.PostGitdmImportHandlerFunc(
+		func(params affiliation.PostGitdmImportParams) middleware.Responder {
+			log.Info("PostGitdmImportHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PostGitdmImportHandlerFunc: " + info)
+
+			result, err := service.PostGitdmImport(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PostGitdmImportHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PostGitdmImportHandlerFunc(ok): " + info)
+
+			return affiliation.NewPostGitdmImportOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetEnrollmentVersionsHandler = affiliation.GetEnrollmentVersionsHandlerFunc(
+		func(params affiliation.GetEnrollmentVersionsParams) middleware.Responder {
+			log.Info("GetEnrollmentVersionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetEnrollmentVersionsHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationGetEnrollmentVersionsHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewGetEnrollmentVersionsNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.GetEnrollmentVersions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetEnrollmentVersionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetEnrollmentVersionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetEnrollmentVersionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutRestoreEnrollmentsHandler = affiliation.PutRestoreEnrollmentsHandlerFunc(
+		func(params affiliation.PutRestoreEnrollmentsParams) middleware.Responder {
+			log.Info("PutRestoreEnrollmentsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutRestoreEnrollmentsHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationPutRestoreEnrollmentsHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewPutRestoreEnrollmentsNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.PutRestoreEnrollments(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutRestoreEnrollmentsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutRestoreEnrollmentsHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutRestoreEnrollmentsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetMergeSuggestionsHandler = affiliation.GetMergeSuggestionsHandlerFunc(
+		func(params affiliation.GetMergeSuggestionsParams) middleware.Responder {
+			log.Info("GetMergeSuggestionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetMergeSuggestionsHandlerFunc: " + info)
+
+			result, err := service.GetMergeSuggestions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetMergeSuggestionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetMergeSuggestionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetMergeSuggestionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutDetectMergeSuggestionsHandler = affiliation.PutDetectMergeSuggestionsHandlerFunc(
+		func(params affiliation.PutDetectMergeSuggestionsParams) middleware.Responder {
+			log.Info("PutDetectMergeSuggestionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutDetectMergeSuggestionsHandlerFunc: " + info)
+
+			result, err := service.PutDetectMergeSuggestions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutDetectMergeSuggestionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutDetectMergeSuggestionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutDetectMergeSuggestionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutUnmergeUniqueIdentitiesHandler = affiliation.PutUnmergeUniqueIdentitiesHandlerFunc(
+		func(params affiliation.PutUnmergeUniqueIdentitiesParams) middleware.Responder {
+			log.Info("PutUnmergeUniqueIdentitiesHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutUnmergeUniqueIdentitiesHandlerFunc: " + info)
+
+			projectSlugs := params.ProjectSlugs
+			params.ProjectSlugs = service.SkipDisabledProjects(params.ProjectSlugs)
+			if len(params.ProjectSlugs) == 0 {
+				log.Info("AffiliationPutUnmergeUniqueIdentitiesHandler: all projects " + projectSlugs + " are disabled")
+				return affiliation.NewPutUnmergeUniqueIdentitiesNotAcceptable().WithPayload(nil)
+			}
+			result, err := service.PutUnmergeUniqueIdentities(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutUnmergeUniqueIdentitiesHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutUnmergeUniqueIdentitiesHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutUnmergeUniqueIdentitiesOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetProfileHistoryHandler = affiliation.GetProfileHistoryHandlerFunc(
+		func(params affiliation.GetProfileHistoryParams) middleware.Responder {
+			log.Info("GetProfileHistoryHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetProfileHistoryHandlerFunc: " + info)
+
+			result, err := service.GetProfileHistory(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetProfileHistoryHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetProfileHistoryHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetProfileHistoryOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetBotSuggestionsHandler = affiliation.GetBotSuggestionsHandlerFunc(
+		func(params affiliation.GetBotSuggestionsParams) middleware.Responder {
+			log.Info("GetBotSuggestionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetBotSuggestionsHandlerFunc: " + info)
+
+			result, err := service.GetBotSuggestions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetBotSuggestionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetBotSuggestionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetBotSuggestionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutDetectBotSuggestionsHandler = affiliation.PutDetectBotSuggestionsHandlerFunc(
+		func(params affiliation.PutDetectBotSuggestionsParams) middleware.Responder {
+			log.Info("PutDetectBotSuggestionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutDetectBotSuggestionsHandlerFunc: " + info)
+
+			result, err := service.PutDetectBotSuggestions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutDetectBotSuggestionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutDetectBotSuggestionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutDetectBotSuggestionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPostReviewBotSuggestionsHandler = affiliation.PostReviewBotSuggestionsHandlerFunc(
+		func(params affiliation.PostReviewBotSuggestionsParams) middleware.Responder {
+			log.Info("PostReviewBotSuggestionsHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PostReviewBotSuggestionsHandlerFunc: " + info)
+
+			result, err := service.PostReviewBotSuggestions(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PostReviewBotSuggestionsHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PostReviewBotSuggestionsHandlerFunc(ok): " + info)
+
+			return affiliation.NewPostReviewBotSuggestionsOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationDeleteForgetProfileHandler = affiliation.DeleteForgetProfileHandlerFunc(
+		func(params affiliation.DeleteForgetProfileParams) middleware.Responder {
+			log.Info("DeleteForgetProfileHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("DeleteForgetProfileHandlerFunc: " + info)
+
+			result, err := service.DeleteForgetProfile(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("DeleteForgetProfileHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("DeleteForgetProfileHandlerFunc(ok): " + info)
+
+			return affiliation.NewDeleteForgetProfileOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetErasureReceiptHandler = affiliation.GetErasureReceiptHandlerFunc(
+		func(params affiliation.GetErasureReceiptParams) middleware.Responder {
+			log.Info("GetErasureReceiptHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetErasureReceiptHandlerFunc: " + info)
+
+			result, err := service.GetErasureReceipt(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetErasureReceiptHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetErasureReceiptHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetErasureReceiptOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetDataExportHandler = affiliation.GetDataExportHandlerFunc(
+		func(params affiliation.GetDataExportParams) middleware.Responder {
+			log.Info("GetDataExportHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetDataExportHandlerFunc: " + info)
+
+			result, err := service.GetDataExport(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetDataExportHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetDataExportHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetDataExportOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationPutLockHandler = affiliation.PutLockHandlerFunc(
+		func(params affiliation.PutLockParams) middleware.Responder {
+			log.Info("PutLockHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("PutLockHandlerFunc: " + info)
+
+			result, err := service.PutLock(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("PutLockHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("PutLockHandlerFunc(ok): " + info)
+
+			return affiliation.NewPutLockOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationDeleteLockHandler = affiliation.DeleteLockHandlerFunc(
+		func(params affiliation.DeleteLockParams) middleware.Responder {
+			log.Info("DeleteLockHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("DeleteLockHandlerFunc: " + info)
+
+			result, err := service.DeleteLock(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("DeleteLockHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("DeleteLockHandlerFunc(ok): " + info)
+
+			return affiliation.NewDeleteLockOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
+	api.AffiliationGetLocksHandler = affiliation.GetLocksHandlerFunc(
+		func(params affiliation.GetLocksParams) middleware.Responder {
+			log.Info("GetLocksHandlerFunc")
+			ctx := params.HTTPRequest.Context()
+
+			var nilRequestID *string
+			requestID := log.GetRequestID(nilRequestID)
+			service.SetServiceRequestID(requestID)
+
+			info := requestInfo(params.HTTPRequest)
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+			}).Info("GetLocksHandlerFunc: " + info)
+
+			result, err := service.GetLocks(ctx, &params)
+			if err != nil {
+				return swagger.ErrorHandler("GetLocksHandlerFunc(error): "+info, err)
+			}
+
+			log.WithFields(logrus.Fields{
+				"X-REQUEST-ID": requestID,
+				"Payload":      logPayload(result),
+			}).Info("GetLocksHandlerFunc(ok): " + info)
+
+			return affiliation.NewGetLocksOK().WithXREQUESTID(requestID).WithPayload(result)
+		},
+	)
 }
@@ -43,6 +43,12 @@ var (
 	topContributorsCacheMtx = &sync.RWMutex{}
 	precacheMtx             = &sync.Mutex{}
 	precacheStop            bool
+	conflictsMtx            = &sync.Mutex{}
+	conflictsReport         = &models.EnrollmentConflictsOutput{Profiles: []*models.EnrollmentConflictsProfile{}}
+	suggestionsMtx          = &sync.Mutex{}
+	suggestionsReport       = &models.MergeSuggestionsOutput{Suggestions: []*models.MergeSuggestion{}}
+	botsMtx                 = &sync.Mutex{}
+	botsReport              = &models.BotSuggestionsOutput{Suggestions: []*models.BotSuggestion{}}
 )
 
 // Service - API interface
@@ -67,6 +73,13 @@ type Service interface {
 	GetProfile(context.Context, *affiliation.GetProfileParams) (*models.UniqueIdentityNestedDataOutput, error)
 	GetProfileByUsername(context.Context, *affiliation.GetProfileByUsernameParams) (*models.UniqueIdentitiesNestedDataOutput, error)
 	GetProfileNested(context.Context, *affiliation.GetProfileNestedParams) (*models.ProfileNestedRolls, error)
+	GetProfileHistory(context.Context, *affiliation.GetProfileHistoryParams) (*models.LineageOutput, error)
+	DeleteForgetProfile(context.Context, *affiliation.DeleteForgetProfileParams) (*models.ErasureReceipt, error)
+	GetErasureReceipt(context.Context, *affiliation.GetErasureReceiptParams) (*models.ErasureReceipt, error)
+	GetDataExport(context.Context, *affiliation.GetDataExportParams) (*models.DataExportOutput, error)
+	PutLock(context.Context, *affiliation.PutLockParams) (*models.Lock, error)
+	DeleteLock(context.Context, *affiliation.DeleteLockParams) (*models.Lock, error)
+	GetLocks(context.Context, *affiliation.GetLocksParams) (*models.LocksOutput, error)
 	PutEditProfile(context.Context, *affiliation.PutEditProfileParams) (*models.UniqueIdentityNestedDataOutput, error)
 	DeleteProfile(context.Context, *affiliation.DeleteProfileParams) (*models.TextStatusOutput, error)
 	PostUnarchiveProfile(context.Context, *affiliation.PostUnarchiveProfileParams) (*models.UniqueIdentityNestedDataOutput, error)
@@ -75,18 +88,26 @@ type Service interface {
 	PostAddIdentities(context.Context, *affiliation.PostAddIdentitiesParams) (*models.TextStatusOutput, error)
 	DeleteIdentity(context.Context, *affiliation.DeleteIdentityParams) (*models.TextStatusOutput, error)
 	GetProfileEnrollments(context.Context, *affiliation.GetProfileEnrollmentsParams) (*models.GetProfileEnrollmentsDataOutput, error)
+	GetEnrollmentVersions(context.Context, *affiliation.GetEnrollmentVersionsParams) (*models.EnrollmentVersionsOutput, error)
+	PutRestoreEnrollments(context.Context, *affiliation.PutRestoreEnrollmentsParams) (*models.EnrollmentsRestoreOutput, error)
 	GetAffiliationSingle(context.Context, *affiliation.GetAffiliationSingleParams) (*models.OrgOutput, error)
 	GetAffiliationMultiple(context.Context, *affiliation.GetAffiliationMultipleParams) (*models.OrgsOutput, error)
 	GetAffiliationBoth(context.Context, *affiliation.GetAffiliationBothParams) (*models.OrgAndOrgsOutput, error)
+	GetAffiliationTimeline(context.Context, *affiliation.GetAffiliationTimelineParams) (*models.AffiliationTimelineOutput, error)
+	GetEmployerChanges(context.Context, *affiliation.GetEmployerChangesParams) (*models.EmployerChangesOutput, error)
+	PostAffiliationBatch(context.Context, *affiliation.PostAffiliationBatchParams) (*models.AffiliationBatchOutput, error)
 	PostAddEnrollment(context.Context, *affiliation.PostAddEnrollmentParams) (*models.UniqueIdentityNestedDataOutputNoDates, error)
 	PutEditEnrollment(context.Context, *affiliation.PutEditEnrollmentParams) (*models.UniqueIdentityNestedDataOutput, error)
 	PutEditEnrollmentByID(context.Context, *affiliation.PutEditEnrollmentByIDParams) (*models.UniqueIdentityNestedDataOutput, error)
 	DeleteEnrollments(context.Context, *affiliation.DeleteEnrollmentsParams) (*models.UniqueIdentityNestedDataOutput, error)
 	DeleteEnrollment(context.Context, *affiliation.DeleteEnrollmentParams) (*models.UniqueIdentityNestedDataOutput, error)
 	PutMergeEnrollments(context.Context, *affiliation.PutMergeEnrollmentsParams) (*models.UniqueIdentityNestedDataOutput, error)
+	PostImportEnrollmentsCSV(context.Context, *affiliation.PostImportEnrollmentsCSVParams) (*models.EnrollmentsImportOutput, error)
 	PutMergeUniqueIdentities(context.Context, *affiliation.PutMergeUniqueIdentitiesParams) (*models.UniqueIdentityNestedDataOutput, error)
+	PutUnmergeUniqueIdentities(context.Context, *affiliation.PutUnmergeUniqueIdentitiesParams) (*models.UnmergeOutput, error)
 	PutMoveIdentity(context.Context, *affiliation.PutMoveIdentityParams) (*models.UniqueIdentityNestedDataOutput, error)
 	GetUnaffiliated(context.Context, *affiliation.GetUnaffiliatedParams) (*models.GetUnaffiliatedOutput, error)
+	GetAffiliationGaps(context.Context, *affiliation.GetAffiliationGapsParams) (*models.AffiliationGapsOutput, error)
 	FilterDataSources([]string, []string) []string
 	MakeDSInfo([]*models.DataSourceTypeFields, []string, []string) ([]*models.ConfiguredDataSourcesFields, string)
 	TopContributorsParams(*affiliation.GetTopContributorsParams, *affiliation.GetTopContributorsCSVParams) (int64, int64, int64, int64, string, string, string, string, []string)
@@ -94,7 +115,9 @@ type Service interface {
 	GetTopContributorsCSV(context.Context, *affiliation.GetTopContributorsCSVParams) (io.ReadCloser, error)
 	GetAllAffiliations(context.Context, *affiliation.GetAllAffiliationsParams) (*models.AllArrayOutput, error)
 	PostBulkUpdate(context.Context, *affiliation.PostBulkUpdateParams) (*models.TextStatusOutput, error)
-	PutMergeAll(context.Context, *affiliation.PutMergeAllParams) (*models.TextStatusOutput, error)
+	GetGitdmExport(context.Context, *affiliation.GetGitdmExportParams) (io.ReadCloser, error)
+	PostGitdmImport(context.Context, *affiliation.PostGitdmImportParams) (*models.GitdmImportOutput, error)
+	PutMergeAll(context.Context, *affiliation.PutMergeAllParams) (*models.MergeAllOutput, error)
 	PutSyncSfProfiles(context.Context, *affiliation.PutSyncSfProfilesParams) (*models.TextStatusOutput, error)
 	PutHideEmails(context.Context, *affiliation.PutHideEmailsParams) (*models.TextStatusOutput, error)
 	PutCacheTopContributors(context.Context, *affiliation.PutCacheTopContributorsParams) (*models.TextStatusOutput, error)
@@ -106,7 +129,19 @@ type Service interface {
 	PostAddSlugMapping(context.Context, *affiliation.PostAddSlugMappingParams) (*models.SlugMapping, error)
 	DeleteSlugMapping(context.Context, *affiliation.DeleteSlugMappingParams) (*models.TextStatusOutput, error)
 	PutEditSlugMapping(context.Context, *affiliation.PutEditSlugMappingParams) (*models.SlugMapping, error)
+	GetListAffiliationPolicies(context.Context, *affiliation.GetListAffiliationPoliciesParams) (*models.ListAffiliationPolicies, error)
+	GetAffiliationCacheStats(context.Context, *affiliation.GetAffiliationCacheStatsParams) (*models.AffiliationCacheStats, error)
+	GetEnrollmentConflicts(context.Context, *affiliation.GetEnrollmentConflictsParams) (*models.EnrollmentConflictsOutput, error)
+	PutDetectEnrollmentConflicts(context.Context, *affiliation.PutDetectEnrollmentConflictsParams) (*models.TextStatusOutput, error)
+	GetMergeSuggestions(context.Context, *affiliation.GetMergeSuggestionsParams) (*models.MergeSuggestionsOutput, error)
+	PutDetectMergeSuggestions(context.Context, *affiliation.PutDetectMergeSuggestionsParams) (*models.TextStatusOutput, error)
+	GetBotSuggestions(context.Context, *affiliation.GetBotSuggestionsParams) (*models.BotSuggestionsOutput, error)
+	PutDetectBotSuggestions(context.Context, *affiliation.PutDetectBotSuggestionsParams) (*models.TextStatusOutput, error)
+	PostReviewBotSuggestions(context.Context, *affiliation.PostReviewBotSuggestionsParams) (*models.BotSuggestionsReviewOutput, error)
+	PutAffiliationPolicy(context.Context, *affiliation.PutAffiliationPolicyParams) (*models.AffiliationPolicy, error)
+	DeleteAffiliationPolicy(context.Context, *affiliation.DeleteAffiliationPolicyParams) (*models.TextStatusOutput, error)
 	ClearPrecacheRunning()
+	StartEnrollmentConflictsDetector()
 	SetServiceRequestID(requestID string)
 	GetServiceRequestID() string
 
@@ -329,10 +364,43 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 	case *affiliation.GetProfileNestedParams:
 		auth = params.Authorization
 		apiName = "GetProfileNested"
+	case *affiliation.GetProfileHistoryParams:
+		auth = params.Authorization
+		apiName = "GetProfileHistory"
+		noUpdate = true
+	case *affiliation.DeleteForgetProfileParams:
+		auth = params.Authorization
+		apiName = "DeleteForgetProfile"
+	case *affiliation.GetErasureReceiptParams:
+		auth = params.Authorization
+		apiName = "GetErasureReceipt"
+		noUpdate = true
+	case *affiliation.GetDataExportParams:
+		auth = params.Authorization
+		apiName = "GetDataExport"
+		noUpdate = true
+	case *affiliation.PutLockParams:
+		auth = params.Authorization
+		apiName = "PutLock"
+	case *affiliation.DeleteLockParams:
+		auth = params.Authorization
+		apiName = "DeleteLock"
+	case *affiliation.GetLocksParams:
+		auth = params.Authorization
+		apiName = "GetLocks"
+		noUpdate = true
 	case *affiliation.GetProfileEnrollmentsParams:
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
 		apiName = "GetProfileEnrollments"
+	case *affiliation.GetEnrollmentVersionsParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "GetEnrollmentVersions"
+	case *affiliation.PutRestoreEnrollmentsParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "PutRestoreEnrollments"
 	case *affiliation.GetAffiliationSingleParams:
 		auth = params.Authorization
 		projectsStr = params.ProjectSlug
@@ -348,6 +416,21 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 		projectsStr = params.ProjectSlug
 		apiName = "GetAffiliationBoth"
 		noUpdate = true
+	case *affiliation.GetAffiliationTimelineParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlug
+		apiName = "GetAffiliationTimeline"
+		noUpdate = true
+	case *affiliation.GetEmployerChangesParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "GetEmployerChanges"
+		noUpdate = true
+	case *affiliation.PostAffiliationBatchParams:
+		auth = params.Authorization
+		projectsStr = affiliationBatchProjects(params.Body)
+		apiName = "PostAffiliationBatch"
+		noUpdate = true
 	case *affiliation.DeleteProfileParams:
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
@@ -404,6 +487,10 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
 		apiName = "PutMergeEnrollments"
+	case *affiliation.PostImportEnrollmentsCSVParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "PostImportEnrollmentsCSV"
 	case *affiliation.PutOrgDomainParams:
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
@@ -416,6 +503,10 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
 		apiName = "PutMergeUniqueIdentities"
+	case *affiliation.PutUnmergeUniqueIdentitiesParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "PutUnmergeUniqueIdentities"
 	case *affiliation.PutMoveIdentityParams:
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
@@ -424,6 +515,10 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 		auth = params.Authorization
 		projectsStr = params.ProjectSlugs
 		apiName = "GetUnaffiliated"
+	case *affiliation.GetAffiliationGapsParams:
+		auth = params.Authorization
+		projectsStr = params.ProjectSlugs
+		apiName = "GetAffiliationGaps"
 	case *affiliation.GetTopContributorsParams:
 		if params.Authorization != nil {
 			auth = *params.Authorization
@@ -463,6 +558,13 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 	case *affiliation.PostBulkUpdateParams:
 		auth = params.Authorization
 		apiName = "PostBulkUpdate"
+	case *affiliation.GetGitdmExportParams:
+		auth = params.Authorization
+		apiName = "GetGitdmExport"
+		noUpdate = true
+	case *affiliation.PostGitdmImportParams:
+		auth = params.Authorization
+		apiName = "PostGitdmImport"
 	case *affiliation.PostAddSlugMappingParams:
 		auth = params.Authorization
 		apiName = "PostAddSlugMapping"
@@ -472,6 +574,44 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 	case *affiliation.PutEditSlugMappingParams:
 		auth = params.Authorization
 		apiName = "PutEditSlugMapping"
+	case *affiliation.GetListAffiliationPoliciesParams:
+		auth = params.Authorization
+		apiName = "GetListAffiliationPolicies"
+		noUpdate = true
+	case *affiliation.GetAffiliationCacheStatsParams:
+		auth = params.Authorization
+		apiName = "GetAffiliationCacheStats"
+		noUpdate = true
+	case *affiliation.GetEnrollmentConflictsParams:
+		auth = params.Authorization
+		apiName = "GetEnrollmentConflicts"
+		noUpdate = true
+	case *affiliation.PutDetectEnrollmentConflictsParams:
+		auth = params.Authorization
+		apiName = "PutDetectEnrollmentConflicts"
+	case *affiliation.GetMergeSuggestionsParams:
+		auth = params.Authorization
+		apiName = "GetMergeSuggestions"
+		noUpdate = true
+	case *affiliation.PutDetectMergeSuggestionsParams:
+		auth = params.Authorization
+		apiName = "PutDetectMergeSuggestions"
+	case *affiliation.GetBotSuggestionsParams:
+		auth = params.Authorization
+		apiName = "GetBotSuggestions"
+		noUpdate = true
+	case *affiliation.PutDetectBotSuggestionsParams:
+		auth = params.Authorization
+		apiName = "PutDetectBotSuggestions"
+	case *affiliation.PostReviewBotSuggestionsParams:
+		auth = params.Authorization
+		apiName = "PostReviewBotSuggestions"
+	case *affiliation.PutAffiliationPolicyParams:
+		auth = params.Authorization
+		apiName = "PutAffiliationPolicy"
+	case *affiliation.DeleteAffiliationPolicyParams:
+		auth = params.Authorization
+		apiName = "DeleteAffiliationPolicy"
 	default:
 		err = errs.Wrap(errs.New(fmt.Errorf("unknown params type"), errs.ErrServerError), "checkTokenAndPermission")
 		return
@@ -481,6 +621,11 @@ func (s *service) checkTokenAndPermission(iParams interface{}) (apiName string,
 		err = errs.Wrap(errs.New(err, errs.ErrUnauthorized), apiName+": checkTokenAndPermission")
 		return
 	}
+	// Missing affiliation policies are not fatal, default 5-step algorithm is used then
+	e := s.shDB.GetAffiliationPolicies(noUpdate)
+	if e != nil {
+		log.Warn(fmt.Sprintf("checkTokenAndPermission: cannot load affiliation policies: %v\n", e))
+	}
 	projectsAry := strings.Split(projectsStr, ",")
 	for i := range projectsAry {
 		projectsAry[i] = strings.TrimSpace(strings.Replace(projectsAry[i], "/projects/", "", -1))
@@ -758,6 +903,10 @@ func (s *service) toNoDates(in *models.UniqueIdentityNestedDataOutput) (out *mod
 				OrganizationID: enrollment.OrganizationID,
 				Organization:   enrollment.Organization,
 				ProjectSlug:    enrollment.ProjectSlug,
+				Provenance:     enrollment.Provenance,
+				EvidenceURL:    enrollment.EvidenceURL,
+				EvidenceNotes:  enrollment.EvidenceNotes,
+				Confidence:     enrollment.Confidence,
 			},
 		)
 	}
@@ -1082,6 +1231,12 @@ func (s *service) PostAddIdentities(ctx context.Context, params *affiliation.Pos
 // end - optional query parameter: enrollment end date, 2100-01-01 if not set
 // role - optional query parameter: enrollment role, for example Contributor, Maintainer
 // merge - optional query parameter: if set it will merge enrollment dates for organization added
+// split - optional query parameter: if set, other organizations enrollments (with the same role) overlapping added one are truncated or split (originals are archived),
+//   so the added enrollment is exclusive for its dates range, changed enrollments are returned in "split", if any of them is locked 409 conflict is returned
+// provenance - optional query parameter: why this enrollment exists (manual, email_domain, company_roster, self_claim, gitdm, inferred), manual if not set
+// evidence_url - optional query parameter: URL of evidence supporting this enrollment
+// evidence_notes - optional query parameter: notes about evidence supporting this enrollment
+// confidence - optional query parameter: enrollment confidence 0-100, unknown if not set
 // is_project_specific - optional query parameter, if set - enrollment will be marked as {projectSlugs} specific (its "project_slug" column will be {projectSlugs}
 //   else enrollment will be global (its "project_slug" column will be set to null)
 //   you can only set is_project_specific when {projectSlugs} contain only one project
@@ -1187,9 +1342,23 @@ func (s *service) PostAddEnrollment(ctx context.Context, params *affiliation.Pos
 		}
 		enrollment.ProjectSlug = &projects[0]
 	}
+	if params.Provenance != nil {
+		enrollment.Provenance = params.Provenance
+	} else {
+		provenance := shared.ProvenanceManual
+		enrollment.Provenance = &provenance
+	}
+	enrollment.EvidenceURL = params.EvidenceURL
+	enrollment.EvidenceNotes = params.EvidenceNotes
+	enrollment.Confidence = params.Confidence
 	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	_, err = s.shDB.AddEnrollment(enrollment, false, false, nil)
+	var changes []*models.EnrollmentSplitChange
+	if params.Split != nil && *(params.Split) {
+		changes, err = s.shDB.AddEnrollmentSplit(enrollment)
+	} else {
+		_, err = s.shDB.AddEnrollment(enrollment, false, false, nil)
+	}
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
@@ -1215,6 +1384,8 @@ func (s *service) PostAddEnrollment(ctx context.Context, params *affiliation.Pos
 	s.UUDA2SF(uid)
 	s.shDB.SetIsLFX(uid)
 	uidnd = s.toNoDates(uid)
+	s.EnrollmentSplitChangesDA2SF(changes)
+	uidnd.Split = changes
 	return
 }
 
@@ -1235,6 +1406,7 @@ func (s *service) PostAddEnrollment(ctx context.Context, params *affiliation.Pos
 //   you can only set is_project_specific when {projectSlugs} contain only one project
 // new_is_project_specific - optional query parameter, if set - will update is_project_specific value
 //   you can only set new_is_project_specific when {projectSlugs} contain only one project
+// provenance, evidence_url, evidence_notes, confidence - optional query parameters: new enrollment provenance data, current values are kept if not set
 func (s *service) PutEditEnrollment(ctx context.Context, params *affiliation.PutEditEnrollmentParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
 	enrollment := &models.EnrollmentDataOutput{UUID: params.UUID}
 	organization := &models.OrganizationDataOutput{Name: params.OrgName}
@@ -1320,6 +1492,10 @@ func (s *service) PutEditEnrollment(ctx context.Context, params *affiliation.Put
 		return
 	}
 	enrollment.ID = rols[0].ID
+	enrollment.Provenance = rols[0].Provenance
+	enrollment.EvidenceURL = rols[0].EvidenceURL
+	enrollment.EvidenceNotes = rols[0].EvidenceNotes
+	enrollment.Confidence = rols[0].Confidence
 	if params.NewStart != nil {
 		enrollment.Start = *(params.NewStart)
 	} else {
@@ -1346,6 +1522,18 @@ func (s *service) PutEditEnrollment(ctx context.Context, params *affiliation.Put
 	} else {
 		enrollment.Role = shared.DefaultRole
 	}
+	if params.Provenance != nil {
+		enrollment.Provenance = params.Provenance
+	}
+	if params.EvidenceURL != nil {
+		enrollment.EvidenceURL = params.EvidenceURL
+	}
+	if params.EvidenceNotes != nil {
+		enrollment.EvidenceNotes = params.EvidenceNotes
+	}
+	if params.Confidence != nil {
+		enrollment.Confidence = params.Confidence
+	}
 	// defer func() { s.shDB.NotifySSAW() }()
 	_, err = s.shDB.EditEnrollment(enrollment, false, nil)
 	if err != nil {
@@ -1386,6 +1574,7 @@ func (s *service) PutEditEnrollment(ctx context.Context, params *affiliation.Put
 // merge - optional query parameter: if set it will merge enrollment dates for organization edited
 // new_is_project_specific - ooptional query parameter, if set - will update is_project_specific value
 //   you can only set new_is_project_specific when {projectSlugs} contain only one project
+// provenance, evidence_url, evidence_notes, confidence - optional query parameters: new enrollment provenance data, current values are kept if not set
 func (s *service) PutEditEnrollmentByID(ctx context.Context, params *affiliation.PutEditEnrollmentByIDParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
 	enrollment := &models.EnrollmentDataOutput{ID: params.EnrollmentID}
 	uid = &models.UniqueIdentityNestedDataOutput{}
@@ -1469,6 +1658,18 @@ func (s *service) PutEditEnrollmentByID(ctx context.Context, params *affiliation
 	} else {
 		enrollment.Role = shared.DefaultRole
 	}
+	if params.Provenance != nil {
+		enrollment.Provenance = params.Provenance
+	}
+	if params.EvidenceURL != nil {
+		enrollment.EvidenceURL = params.EvidenceURL
+	}
+	if params.EvidenceNotes != nil {
+		enrollment.EvidenceNotes = params.EvidenceNotes
+	}
+	if params.Confidence != nil {
+		enrollment.Confidence = params.Confidence
+	}
 	uuid := enrollment.UUID
 	// defer func() { s.shDB.NotifySSAW() }()
 	_, err = s.shDB.EditEnrollment(enrollment, false, nil)
@@ -1588,7 +1789,7 @@ func (s *service) DeleteEnrollments(ctx context.Context, params *affiliation.Del
 	}
 	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	err = s.shDB.WithdrawEnrollment(enrollment, true, nil)
+	err = s.shDB.WithdrawEnrollment(enrollment, true, true, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
@@ -1792,6 +1993,90 @@ func (s *service) PutMergeEnrollments(ctx context.Context, params *affiliation.P
 	return
 }
 
+// PostImportEnrollmentsCSV: API params:
+// /v1/affiliation/{projectSlugs}/import_enrollments_csv
+// {projectSlugs} - required path parameter: projects to import enrollments for ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// dry - optional query parameter: boolean, if set only returns per-row plan (create/merge/duplicate/conflict/unknown_profile/unknown_org/invalid), nothing is written
+// body - required CSV body: header row + one enrollment per row, columns: uuid, email, source, username, organization, start, end, project_slug, role
+//   profile is found by uuid, email or source+username, organization must exist, start/end default to 1900-01-01/2100-01-01
+//   project_slug (SFDC slug) must be one of {projectSlugs}, if empty - enrollment will be global (its "project_slug" column will be set to null)
+//   if dry is not set, all create/merge rows are added in a single transaction and then merged with existing enrollments, other rows are skipped
+func (s *service) PostImportEnrollmentsCSV(ctx context.Context, params *affiliation.PostImportEnrollmentsCSVParams) (out *models.EnrollmentsImportOutput, err error) {
+	dry := false
+	if params.Dry != nil {
+		dry = *params.Dry
+	}
+	out = &models.EnrollmentsImportOutput{Dry: dry}
+	log.Info(fmt.Sprintf("PostImportEnrollmentsCSV: dry:%v", dry))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PostImportEnrollmentsCSV(exit): dry:%v apiName:%s projects:%+v username:%s rows:%d applied:%d actions:%+v err:%v",
+				dry,
+				apiName,
+				projects,
+				username,
+				out.NRows,
+				out.NApplied,
+				out.Actions,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	if params.Body == nil {
+		err = errs.Wrap(errs.New(fmt.Errorf("missing CSV body"), errs.ErrBadRequest), apiName)
+		return
+	}
+	defer func() { _ = params.Body.Close() }()
+	var rows []*models.EnrollmentImportRow
+	rows, err = s.shDB.ParseEnrollmentsCSV(params.Body)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	allowed := make(map[string]struct{})
+	for _, project := range projects {
+		allowed[project] = struct{}{}
+	}
+	for _, row := range rows {
+		if row.Action != "" || row.ProjectSlug == "" {
+			continue
+		}
+		// SF -> DA
+		project := s.SF2DA(strings.TrimSpace(strings.Replace(row.ProjectSlug, "/projects/", "", -1)))
+		_, ok := allowed[project]
+		if !ok {
+			row.Action = shared.EnrollmentImportInvalid
+			row.Reason = fmt.Sprintf("project_slug '%s' is not one of '%s'", row.ProjectSlug, params.ProjectSlugs)
+			continue
+		}
+		row.ProjectSlug = project
+	}
+	// Do the actual API call
+	out.NApplied, err = s.shDB.ImportEnrollments(rows, dry)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	out.Actions = make(map[string]int64)
+	for _, row := range rows {
+		out.Actions[row.Action]++
+		if row.ProjectSlug != "" {
+			row.ProjectSlug = s.DA2SF(row.ProjectSlug)
+		}
+	}
+	out.Rows = rows
+	out.NRows = int64(len(rows))
+	out.User = username
+	out.Scope = s.AryDA2SF(projects)
+	return
+}
+
 // GetFindOrganizationByID: API params:
 // /v1/affiliation/{projectSlugs}/find_organization_by_id/{orgID}
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
@@ -2179,16 +2464,54 @@ func (s *service) DeleteMatchingBlacklist(ctx context.Context, params *affiliati
 }
 
 // GetListProfiles: API params:
-// /v1/affiliation/{projectSlugs}/list_profiles[?q=xyz][&rows=100][&page=2]
+// /v1/affiliation/{projectSlugs}/list_profiles[?q=xyz][&rows=100][&page=2][&source=github][&organization=CNCF][&organization_at=2020-01-01T00:00:00Z]
+//   [&country_code=PL][&is_bot=false][&has_enrollments=true][&project_slug=cncf/k8s][&last_modified_from=...][&last_modified_to=...][&last_modified_by=lgryglicki][&sort=-last_modified]
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
 // q - optional query parameter: if you specify that parameter only profiles where name, email, username or source like '%q%' will be returned
 // rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10 (setting to zero still limits results to 65535)
 // page - optional query parameter: if set, it will return rows from a given page, default 1
+// source - optional query parameter: only profiles having an identity from this source
+// organization - optional query parameter: only profiles enrolled to this organization at organization_at (default now)
+// country_code, is_bot - optional query parameters: only profiles with this country code/bot flag
+// has_enrollments - optional query parameter: only profiles with (true) or without (false) enrollments
+// project_slug - optional query parameter: only profiles having a project specific enrollment for this SFDC project slug
+// last_modified_from, last_modified_to, last_modified_by - optional query parameters: only profiles modified in [from, to) range/by this user
+// sort - optional query parameter: uuid, name, email, country_code or last_modified, "-" prefix means descending, default uuid
+// All filters are combined with q using and
 func (s *service) GetListProfiles(ctx context.Context, params *affiliation.GetListProfilesParams) (getListProfiles *models.GetListProfilesOutput, err error) {
 	q := ""
 	if params.Q != nil {
 		q = *params.Q
 	}
+	var filters *models.ProfileFilters
+	f := &models.ProfileFilters{
+		OrganizationAt:   params.OrganizationAt,
+		IsBot:            params.IsBot,
+		HasEnrollments:   params.HasEnrollments,
+		LastModifiedFrom: params.LastModifiedFrom,
+		LastModifiedTo:   params.LastModifiedTo,
+	}
+	if params.Source != nil {
+		f.Source = strings.TrimSpace(*params.Source)
+	}
+	if params.Organization != nil {
+		f.Organization = strings.TrimSpace(*params.Organization)
+	}
+	if params.CountryCode != nil {
+		f.CountryCode = strings.TrimSpace(*params.CountryCode)
+	}
+	if params.ProjectSlug != nil && strings.TrimSpace(*params.ProjectSlug) != "" {
+		f.ProjectSlug = s.SF2DA(strings.TrimSpace(strings.Replace(*params.ProjectSlug, "/projects/", "", -1)))
+	}
+	if params.LastModifiedBy != nil {
+		f.LastModifiedBy = strings.TrimSpace(*params.LastModifiedBy)
+	}
+	if params.Sort != nil {
+		f.Sort = *params.Sort
+	}
+	if *f != (models.ProfileFilters{}) {
+		filters = f
+	}
 	rows := int64(10)
 	if params.Rows != nil {
 		rows = *params.Rows
@@ -2204,7 +2527,7 @@ func (s *service) GetListProfiles(ctx context.Context, params *affiliation.GetLi
 		}
 	}
 	getListProfiles = &models.GetListProfilesOutput{}
-	log.Info(fmt.Sprintf("GetListProfiles: q:%s rows:%d page:%d", q, rows, page))
+	log.Info(fmt.Sprintf("GetListProfiles: q:%s filters:%+v rows:%d page:%d", q, filters, rows, page))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
@@ -2217,8 +2540,9 @@ func (s *service) GetListProfiles(ctx context.Context, params *affiliation.GetLi
 		}
 		log.Info(
 			fmt.Sprintf(
-				"GetListProfiles(exit): q:%s rows:%d page:%d apiName:%s projects:%+v username:%s getListProfiles:%s err:%v",
+				"GetListProfiles(exit): q:%s filters:%+v rows:%d page:%d apiName:%s projects:%+v username:%s getListProfiles:%s err:%v",
 				q,
+				filters,
 				rows,
 				page,
 				apiName,
@@ -2234,11 +2558,14 @@ func (s *service) GetListProfiles(ctx context.Context, params *affiliation.GetLi
 	}
 	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	getListProfiles, err = s.shDB.GetListProfiles(q, rows, page, projects)
+	getListProfiles, err = s.shDB.GetListProfiles(q, filters, rows, page, projects)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
+	if filters != nil && filters.ProjectSlug != "" {
+		getListProfiles.Filters.ProjectSlug = s.DA2SF(filters.ProjectSlug)
+	}
 	getListProfiles.User = username
 	getListProfiles.Scope = s.AryDA2SF(projects)
 	s.ListProfilesDA2SF(getListProfiles)
@@ -2293,6 +2620,7 @@ func (s *service) GetIdentityByUser(ctx context.Context, params *affiliation.Get
 // /v1/affiliation/{projectSlugs}/get_profile/{uuid}
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
 // {uuid} - required path parameter: UUID of the profile to get
+// as_of - optional query parameter: if set, returns profile as it was at this point in time (reconstructed from current and archived data), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
 func (s *service) GetProfile(ctx context.Context, params *affiliation.GetProfileParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
 	uuid := params.UUID
 	uid = &models.UniqueIdentityNestedDataOutput{}
@@ -2316,6 +2644,17 @@ func (s *service) GetProfile(ctx context.Context, params *affiliation.GetProfile
 		return
 	}
 	// Do the actual API call
+	asOf := s.asOfParam(params.AsOf)
+	if asOf != nil {
+		uid, err = s.shDB.GetUniqueIdentityNestedAsOf(uuid, *asOf, projects, true, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		s.shDB.SetIsLFX(uid)
+		s.UUDA2SF(uid)
+		return
+	}
 	var ary []*models.UniqueIdentityNestedDataOutput
 	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+uuid, 1, 1, false, projects, nil)
 	if err != nil {
@@ -2377,24 +2716,28 @@ func (s *service) GetProfileByUsername(ctx context.Context, params *affiliation.
 	return
 }
 
-// GetProfileNested: API params:
-// /v1/affiliation/get_profile/{uuid}
-// {uuid} - required path parameter: UUID of the profile to get
-func (s *service) GetProfileNested(ctx context.Context, params *affiliation.GetProfileNestedParams) (profile *models.ProfileNestedRolls, err error) {
+// GetProfileHistory: API params:
+// /v1/affiliation/history/{uuid}
+// {uuid} - required path parameter: UUID of the profile to get lineage for, can be an old UUID that no longer exists
+// Returns all merges, moves, unmerges and unarchives of the profile and profiles merged into it (oldest first),
+// the surviving UUID the profile was (transitively) merged into and UUIDs merged into it
+func (s *service) GetProfileHistory(ctx context.Context, params *affiliation.GetProfileHistoryParams) (lineage *models.LineageOutput, err error) {
 	uuid := params.UUID
-	uid := &models.UniqueIdentityNestedDataOutput{}
-	profile = &models.ProfileNestedRolls{}
-	log.Info(fmt.Sprintf("GetProfileNested: uuid:%s", uuid))
+	lineage = &models.LineageOutput{}
+	log.Info(fmt.Sprintf("GetProfileHistory: uuid:%s", uuid))
 	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetProfileNested(exit): uuid:%s apiName:%s username:%s profile:%v err:%v",
+				"GetProfileHistory(exit): uuid:%s apiName:%s projects:%+v username:%s survivor:%s ancestors:%d events:%d err:%v",
 				uuid,
 				apiName,
+				projects,
 				username,
-				s.ToLocalProfileNestedRolls(profile),
+				lineage.SurvivorUUID,
+				len(lineage.Ancestors),
+				len(lineage.Events),
 				err,
 			),
 		)
@@ -2403,105 +2746,89 @@ func (s *service) GetProfileNested(ctx context.Context, params *affiliation.GetP
 		return
 	}
 	// Do the actual API call
-	var ary []*models.UniqueIdentityNestedDataOutput
-	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+uuid, 1, 1, false, []string{"all-projects"}, nil)
+	lineage, err = s.shDB.GetLineage(uuid, nil)
 	if err != nil {
+		lineage = &models.LineageOutput{}
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	if len(ary) == 0 {
-		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", uuid), apiName)
+	return
+}
+
+// DeleteForgetProfile: API params:
+// /v1/affiliation/forget_profile/{uuid}
+// {uuid} - required path parameter: UUID of the profile to erase (GDPR right to be forgotten)
+// Anonymizes the profile, its identities and all archived profiles/identities of it and profiles merged into it, identities get random IDs,
+// suppresses their emails so add_identities and bulk_update don't recreate them and rewrites author fields in ES.
+// Returns erasure receipt (also available later via erasure_receipt API), ES failure doesn't revert DB changes,
+// it is recorded in the receipt's es_status and es_error instead
+func (s *service) DeleteForgetProfile(ctx context.Context, params *affiliation.DeleteForgetProfileParams) (receipt *models.ErasureReceipt, err error) {
+	uuid := params.UUID
+	receipt = &models.ErasureReceipt{}
+	log.Info(fmt.Sprintf("DeleteForgetProfile: uuid:%s", uuid))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"DeleteForgetProfile(exit): uuid:%s apiName:%s projects:%+v username:%s receipt:%+v err:%v",
+				uuid,
+				apiName,
+				projects,
+				username,
+				receipt,
+				err,
+			),
+		)
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' erased profile uuid '%s', erasure receipt id %d (API: '%s')", username, uuid, receipt.ID, apiName), username, apiName)
+		}
+	}()
+	if err != nil {
 		return
 	}
-	// username = "lukaszgryglicki"
-	userProjects, err := s.apiDB.GetUserProjects(username)
+	// Do the actual API call
+	var ids map[string]string
+	receipt, ids, err = s.shDB.ForgetProfile(uuid, nil)
 	if err != nil {
+		receipt = &models.ErasureReceipt{}
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	uid = ary[0]
-	s.shDB.SetIsLFX(uid)
-	globalRolls := []*models.EnrollmentNestedDataOutput{}
-	groupRolls := map[string][]*models.EnrollmentNestedDataOutput{}
-	projectRolls := map[string][]*models.EnrollmentNestedDataOutput{}
-	for _, rol := range uid.Enrollments {
-		if rol.ProjectSlug == nil {
-			globalRolls = append(globalRolls, rol)
-			continue
-		}
-		slug := *rol.ProjectSlug
-		if strings.HasSuffix(slug, "-f") {
-			_, ok := groupRolls[slug]
-			if !ok {
-				groupRolls[slug] = []*models.EnrollmentNestedDataOutput{rol}
-				continue
-			}
-			groupRolls[slug] = append(groupRolls[slug], rol)
-			continue
-		}
-		_, ok := projectRolls[slug]
-		if !ok {
-			projectRolls[slug] = []*models.EnrollmentNestedDataOutput{rol}
-			continue
-		}
-		projectRolls[slug] = append(projectRolls[slug], rol)
-	}
-	groups := []*models.ProfileNestedRollsEnrollmentsGroupsItems0{}
-	for group, rols := range groupRolls {
-		sort.Slice(rols, func(i, j int) bool {
-			return time.Time(rols[i].Start).Before(time.Time(rols[j].Start))
-		})
-		groups = append(groups, &models.ProfileNestedRollsEnrollmentsGroupsItems0{
-			Name:        group,
-			Enrollments: rols,
-			HasAccess:   s.checkAccess(group, userProjects),
-		})
-	}
-	projects := []*models.ProfileNestedRollsEnrollmentsProjectsItems0{}
-	for project, rols := range projectRolls {
-		sort.Slice(rols, func(i, j int) bool {
-			return time.Time(rols[i].Start).Before(time.Time(rols[j].Start))
-		})
-		projects = append(projects, &models.ProfileNestedRollsEnrollmentsProjectsItems0{
-			Name:        project,
-			Enrollments: rols,
-			HasAccess:   s.checkAccess(project, userProjects),
-		})
+	receipt.EsStatus = "ok"
+	receipt.EsIndices = shared.ErasureESIndices
+	receipt.EsNotCovered = shared.ErasureESNotCovered
+	e := s.es.AnonymizeAuthors(receipt.EsIndices, receipt.Uuids, ids, shdb.ErasedName)
+	if e != nil {
+		receipt.EsStatus = "failed"
+		receipt.EsError = e.Error()
 	}
-	profile.Identities = uid.Identities
-	profile.LastModified = uid.LastModified
-	profile.Profile = uid.Profile
-	profile.UUID = uid.UUID
-	profile.Enrollments = &models.ProfileNestedRollsEnrollments{
-		Global: &models.ProfileNestedRollsEnrollmentsGlobal{
-			Enrollments: globalRolls,
-		},
-		Groups:   groups,
-		Projects: projects,
+	err = s.shDB.SetErasureReceiptESStatus(receipt, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	s.ProfileNestedRollsDA2SF(profile)
 	return
 }
 
-// GetProfileEnrollments: API params:
-// /v1/affiliation/{projectSlugs}/enrollments/{uuid}
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// {uuid} - required path parameter: UUID of the profile to get enrollments
-func (s *service) GetProfileEnrollments(ctx context.Context, params *affiliation.GetProfileEnrollmentsParams) (output *models.GetProfileEnrollmentsDataOutput, err error) {
-	uuid := params.UUID
-	output = &models.GetProfileEnrollmentsDataOutput{}
-	log.Info(fmt.Sprintf("GetProfileEnrollments: uuid:%s", uuid))
+// GetErasureReceipt: API params:
+// /v1/affiliation/erasure_receipt/{receiptID}
+// {receiptID} - required path parameter: ID of the erasure receipt returned by forget_profile API
+func (s *service) GetErasureReceipt(ctx context.Context, params *affiliation.GetErasureReceiptParams) (receipt *models.ErasureReceipt, err error) {
+	id := params.ReceiptID
+	receipt = &models.ErasureReceipt{}
+	log.Info(fmt.Sprintf("GetErasureReceipt: id:%d", id))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetProfileEnrollments(exit): uuid:%s apiName:%s projects:%+v username:%s output:%v err:%v",
-				uuid,
+				"GetErasureReceipt(exit): id:%d apiName:%s projects:%+v username:%s receipt:%+v err:%v",
+				id,
 				apiName,
 				projects,
 				username,
-				output,
+				receipt,
 				err,
 			),
 		)
@@ -2510,139 +2837,210 @@ func (s *service) GetProfileEnrollments(ctx context.Context, params *affiliation
 		return
 	}
 	// Do the actual API call
-	var enrollments []*models.EnrollmentNestedDataOutput
-	enrollments, err = s.shDB.FindEnrollmentsNested([]string{"e.uuid"}, []interface{}{uuid}, []bool{false}, false, projects, nil)
+	receipt, err = s.shDB.GetErasureReceipt(id, nil)
 	if err != nil {
+		receipt = &models.ErasureReceipt{}
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	if len(enrollments) == 0 {
-		_, err = s.shDB.GetUniqueIdentity(uuid, true, nil)
-		if err != nil {
-			err = errs.Wrap(err, apiName)
-			return
-		}
-	}
-	output.UUID = uuid
-	output.User = username
-	output.Scope = s.AryDA2SF(projects)
-	output.Enrollments = enrollments
-	s.ProfileEnrollmentsDA2SF(output)
 	return
 }
 
-// PutOrgDomain: API params:
-// /v1/affiliation/{projectSlugs}/add_domain/{orgName}/{domain}[?overwrite=true][&is_top_domain=true][&skip_enrollments=true]
-// {orgName} - required path parameter:      organization to add domain to, must be URL encoded, for example 'The%20Microsoft%20company'
-// {domain} - required path parameter:       domain to be added, for example 'microsoft.com'
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// overwrite - optional query parameter:     if overwrite=true is set, all profiles found are force-updated/affiliated to the given organization
-//                                           if overwite is not set, API will not change any profiles which already have any affiliation(s)
-// is_top_domain - optional query parameter: if you specify is_top_domain=true it will set 'is_top_domain' DB column to true, else it will set false
-// skip_enrollments - optional query parameter: if skip_enrollments=true is set, no enrollments will be modified/added/removed/touched
-func (s *service) PutOrgDomain(ctx context.Context, params *affiliation.PutOrgDomainParams) (putOrgDomain *models.PutOrgDomainOutput, err error) {
-	org := params.OrgName
-	dom := params.Domain
-	overwrite := false
-	isTopDomain := false
-	skipEnrollments := false
-	if params.Overwrite != nil {
-		overwrite = *params.Overwrite
-	}
-	if params.IsTopDomain != nil {
-		isTopDomain = *params.IsTopDomain
-	}
-	if params.SkipEnrollments != nil {
-		skipEnrollments = *params.SkipEnrollments
-	}
-	log.Info(fmt.Sprintf("PutOrgDomain: org:%s dom:%s overwrite:%v isTopDomain:%v skipEnrollments:%v", org, dom, overwrite, isTopDomain, skipEnrollments))
+// GetDataExport: API params:
+// /v1/affiliation/data_export[?uuid=00029bc65f7fc5ba3dde20057770d3320ca51486][&email=john@doe.com]
+// uuid - optional query parameter: UUID of the person to export (old merged UUID exports the surviving one)
+// email - optional query parameter: email of the person to export, all profiles having this email are exported
+// One of uuid or email must be given (if both are given, uuid is used)
+// Returns GDPR data access bundle for each matching person: current profile with identities and enrollments,
+// archived versions, merge lineage, matching blacklist entries and API log entries mentioning that person
+func (s *service) GetDataExport(ctx context.Context, params *affiliation.GetDataExportParams) (export *models.DataExportOutput, err error) {
+	uuid := ""
+	if params.UUID != nil {
+		uuid = strings.TrimSpace(*params.UUID)
+	}
+	email := ""
+	if params.Email != nil {
+		email = strings.TrimSpace(*params.Email)
+	}
+	export = &models.DataExportOutput{UUID: uuid, Email: email, People: []*models.DataExportPerson{}}
+	// Email of the exported person is not logged, only its hash (as stored in suppressed_emails)
+	emailHash := ""
+	if email != "" {
+		emailHash = s.shDB.EmailHash(email)
+	}
+	log.Info(fmt.Sprintf("GetDataExport: uuid:%s emailHash:%s", uuid, emailHash))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"PutOrgDomain(exit): org:%s dom:%s overwrite:%v isTopDomain:%v skipEnrollments:%v apiName:%s projects:%+v username:%s putOrgDomain:%+v err:%v",
-				org,
-				dom,
-				overwrite,
-				isTopDomain,
-				skipEnrollments,
+				"GetDataExport(exit): uuid:%s emailHash:%s apiName:%s projects:%+v username:%s people:%d err:%v",
+				uuid,
+				emailHash,
 				apiName,
 				projects,
 				username,
-				putOrgDomain,
+				len(export.People),
 				err,
 			),
 		)
+		if err == nil {
+			exported := []string{}
+			for _, person := range export.People {
+				exported = append(exported, person.UUID)
+			}
+			s.esLog.Log(
+				fmt.Sprintf(
+					"User '%s' exported data of uuid '%s' email hash '%s', exported uuids: %s (API: '%s')",
+					username,
+					uuid,
+					emailHash,
+					strings.Join(exported, ","),
+					apiName,
+				),
+				username,
+				apiName,
+			)
+		}
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	putOrgDomain, err = s.shDB.PutOrgDomain(org, dom, overwrite, isTopDomain, skipEnrollments)
+	uuids := []string{}
+	if uuid != "" {
+		uuids = append(uuids, uuid)
+	} else if email != "" {
+		uuids, err = s.shDB.FindUUIDsByEmail(email, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		if len(uuids) == 0 {
+			err = errs.Wrap(errs.New(fmt.Errorf("no profiles with email hash '%s' found", emailHash), errs.ErrNotFound), apiName)
+			return
+		}
+	} else {
+		err = errs.Wrap(errs.New(fmt.Errorf("uuid or email must be given"), errs.ErrBadRequest), apiName)
+		return
+	}
+	exported := make(map[string]struct{})
+	for _, u := range uuids {
+		var person *models.DataExportPerson
+		person, err = s.shDB.ExportPersonData(u, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		// Multiple old uuids can export the same surviving profile
+		if _, ok := exported[person.UUID]; ok {
+			continue
+		}
+		exported[person.UUID] = struct{}{}
+		keys, values := s.shDB.DataExportTerms(person)
+		for _, value := range values {
+			if shared.EmailRegex.MatchString(value) {
+				keys = append(keys, value)
+			}
+		}
+		person.APILog, err = s.esLog.SearchAPILog(keys, shared.DataExportMaxAPILog)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		if person.Current != nil {
+			s.UUDA2SF(person.Current)
+			s.shDB.SetIsLFX(person.Current)
+		}
+		for _, ver := range person.EnrollmentVersions {
+			for _, rol := range ver.Enrollments {
+				if rol.ProjectSlug != nil {
+					project := s.DA2SF(*rol.ProjectSlug)
+					rol.ProjectSlug = &project
+				}
+			}
+		}
+		export.People = append(export.People, person)
+	}
+	export.User = username
+	export.GeneratedAt = strfmt.DateTime(time.Now())
+	return
+}
+
+// PutLock: API params:
+// /v1/affiliation/lock/{object}/{key}
+// {object} - required path parameter: profile, identity or enrollment
+// {key} - required path parameter: profile UUID, identity ID or enrollment ID
+// Locks given object (locked_by is set to the current user), locked objects are skipped by bulk_update, merge_all,
+// map_org_names, hide_emails, sync_sf_profiles and gitdm_import APIs
+func (s *service) PutLock(ctx context.Context, params *affiliation.PutLockParams) (lock *models.Lock, err error) {
+	lock = &models.Lock{}
+	log.Info(fmt.Sprintf("PutLock: object:%s key:%s", params.Object, params.Key))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutLock(exit): object:%s key:%s apiName:%s username:%s lock:%+v err:%v", params.Object, params.Key, apiName, username, lock, err))
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' locked %s '%s' (API: '%s')", username, params.Object, params.Key, apiName), username, apiName)
+		}
+	}()
+	if err != nil {
+		return
+	}
+	// Do the actual API call
+	lock, err = s.shDB.SetLock(params.Object, params.Key, username, nil)
 	if err != nil {
+		lock = &models.Lock{}
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	putOrgDomain.User = username
-	putOrgDomain.Scope = s.AryDA2SF(projects)
 	return
 }
 
-// DeleteOrgDomain: API params:
-// /v1/affiliation/{projectSlugs}/remove_domain/{orgName}/{domain}
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// {orgName} - required path parameter:      organization to remove domain from, must be URL encoded, for example 'The%20Microsoft%20company'
-// {domain} - required path parameter:       domain to be deleted, for example 'microsoft.com'
-func (s *service) DeleteOrgDomain(ctx context.Context, params *affiliation.DeleteOrgDomainParams) (status *models.TextStatusOutput, err error) {
-	org := params.OrgName
-	dom := params.Domain
-	log.Info(fmt.Sprintf("DeleteOrgDomain: org:%s dom:%s", org, dom))
+// DeleteLock: API params:
+// /v1/affiliation/lock/{object}/{key}
+// {object} - required path parameter: profile, identity or enrollment
+// {key} - required path parameter: profile UUID, identity ID or enrollment ID
+// Unlocks given object (also when it was locked by another user)
+func (s *service) DeleteLock(ctx context.Context, params *affiliation.DeleteLockParams) (lock *models.Lock, err error) {
+	lock = &models.Lock{}
+	log.Info(fmt.Sprintf("DeleteLock: object:%s key:%s", params.Object, params.Key))
 	// Check token and permission
-	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"DeleteOrgDomain(exit): org:%s dom:%s apiName:%s projects:%+v username:%s status:%+v err:%v",
-				org,
-				dom,
-				apiName,
-				projects,
-				username,
-				status,
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("DeleteLock(exit): object:%s key:%s apiName:%s username:%s lock:%+v err:%v", params.Object, params.Key, apiName, username, lock, err))
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' unlocked %s '%s' (API: '%s')", username, params.Object, params.Key, apiName), username, apiName)
+		}
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	status, err = s.shDB.DeleteOrgDomain(org, dom)
+	lock, err = s.shDB.SetLock(params.Object, params.Key, "", nil)
 	if err != nil {
+		lock = &models.Lock{}
 		err = errs.Wrap(err, apiName)
 		return
 	}
 	return
 }
 
-// GetListOrganizationsDomains: API params:
-// /v1/affiliation/{projectSlugs}/list_domains[?orgID=23456][&q=xyz][&rows=100][&page=2]
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// orgID - optional query parameter: organization ID to get domains, default is 0 it return data for all organizations then
-// q - optional query parameter: if you specify that parameter only domains like '%q%' will be returned
-// rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10  (setting to zero still limits results to 65535)
-// page - optional query parameter: if set, it will return rows from a given page, default 1
-func (s *service) GetListOrganizationsDomains(ctx context.Context, params *affiliation.GetListOrganizationsDomainsParams) (getListOrganizationsDomains *models.GetListOrganizationsDomainsOutput, err error) {
-	orgID := int64(0)
-	if params.OrgID != nil {
-		orgID = *params.OrgID
-	}
-	q := ""
-	if params.Q != nil {
-		q = *params.Q
+// GetLocks: API params:
+// /v1/affiliation/locks[?object=profile][&locked_by=lgryglicki][&page=2][&rows=50]
+// object - optional query parameter: profile, identity or enrollment, all locked objects are returned if not set
+// locked_by - optional query parameter: only objects locked by this user are returned
+// page - optional query parameter: page to return, 1 if not set
+// rows - optional query parameter: locks per page, 10 if not set, 0 means maximum page size 65535
+func (s *service) GetLocks(ctx context.Context, params *affiliation.GetLocksParams) (out *models.LocksOutput, err error) {
+	out = &models.LocksOutput{}
+	object := ""
+	if params.Object != nil {
+		object = *params.Object
+	}
+	lockedBy := ""
+	if params.LockedBy != nil {
+		lockedBy = *params.LockedBy
 	}
 	rows := int64(10)
 	if params.Rows != nil {
@@ -2658,269 +3056,279 @@ func (s *service) GetListOrganizationsDomains(ctx context.Context, params *affil
 			page = 1
 		}
 	}
-	getListOrganizationsDomains = &models.GetListOrganizationsDomainsOutput{}
-	log.Info(fmt.Sprintf("GetListOrganizationsDomains: orgID:%d q:%s rows:%d page:%d", orgID, q, rows, page))
+	log.Info(fmt.Sprintf("GetLocks: object:%s lockedBy:%s rows:%d page:%d", object, lockedBy, rows, page))
 	// Check token and permission
-	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		list := ""
-		nDoms := len(getListOrganizationsDomains.Domains)
-		if nDoms > shared.LogListMax {
-			list = fmt.Sprintf("%d", nDoms)
-		} else {
-			list = fmt.Sprintf("%+v", s.ToLocalDomains(getListOrganizationsDomains.Domains))
-		}
-		log.Info(
-			fmt.Sprintf(
-				"GetListOrganizationsDomains(exit): orgID:%d q:%s rows:%d page:%d apiName:%s projects:%+v username:%s getListOrganizationsDomains:%s err:%v",
-				orgID,
-				q,
-				rows,
-				page,
-				apiName,
-				projects,
-				username,
-				list,
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("GetLocks(exit): object:%s lockedBy:%s rows:%d page:%d apiName:%s username:%s locks:%d err:%v", object, lockedBy, rows, page, apiName, username, out.NLocks, err))
 	}()
 	if err != nil {
 		return
 	}
 	// Do the actual API call
-	getListOrganizationsDomains, err = s.shDB.GetListOrganizationsDomains(orgID, q, rows, page)
+	locks, nLocks, err := s.shDB.GetLocks(object, lockedBy, rows, page, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	getListOrganizationsDomains.User = username
-	getListOrganizationsDomains.Scope = s.AryDA2SF(projects)
+	out.User = username
+	out.Object = object
+	out.LockedBy = lockedBy
+	out.Locks = locks
+	out.NLocks = nLocks
+	out.NPages = (nLocks + rows - 1) / rows
+	out.Page = page
+	out.Rows = rows
 	return
 }
 
-// PutMergeUniqueIdentities: API
-// ===========================================================================
-// Merge two Profiles with fromUUID to toUUID and Merge Enrollments
-// Use this function to join fromUUID unique identity into toUUID
-// Identities and enrollments related to fromUUID will be assigned
-// to toUUID. In addition, fromUUID will be removed (archived in a special table)
-// Duplicated enrollments will be also removed from
-// the registry while overlapped enrollments will be merged.
-// This function also merges two profiles. When a field on toUUID
-// profile is empty, it will be updated with the value on the
-// profile of fromUUID. If any of the two unique identities was set
-// as a bot, the new profile will also be set as a bot.
-// When fromUUID and toUUID are equal, the action does not have any effect
-// ===========================================================================
-// NOTE: UUIDs used here refer to `profiles` and `profiles_archive` tables
-// ===========================================================================
-// /v1/affiliation/{projectSlugs}/merge_unique_identities/{fromUUID}/{toUUID}[?archive=false]:
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// {fromUUID} - required path parameter: uidentity/profile uuid to merge from, example "00029bc65f7fc5ba3dde20057770d3320ca51486"
-// {toUUID} - required path parameter: uidentity/profile uuid to merge into, example "00058697877808f6b4a8524ac6dcf39b544a0c87"
-// archive - optional query parameter: if archive=false it will not archive data to allow unmerge without data loss
-func (s *service) PutMergeUniqueIdentities(ctx context.Context, params *affiliation.PutMergeUniqueIdentitiesParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
-	fromUUID := params.FromUUID
-	toUUID := params.ToUUID
-	archive := true
-	if params.Archive != nil {
-		archive = *params.Archive
-	}
-	log.Info(fmt.Sprintf("PutMergeUniqueIdentities: fromUUID:%s toUUID:%s archive:%v", fromUUID, toUUID, archive))
+// GetProfileNested: API params:
+// /v1/affiliation/get_profile/{uuid}
+// {uuid} - required path parameter: UUID of the profile to get
+func (s *service) GetProfileNested(ctx context.Context, params *affiliation.GetProfileNestedParams) (profile *models.ProfileNestedRolls, err error) {
+	uuid := params.UUID
+	uid := &models.UniqueIdentityNestedDataOutput{}
+	profile = &models.ProfileNestedRolls{}
+	log.Info(fmt.Sprintf("GetProfileNested: uuid:%s", uuid))
 	// Check token and permission
-	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"PutMergeUniqueIdentities(exit): fromUUID:%s toUUID:%s apiName:%s projects:%+v username:%s uid:%+v err:%v",
-				fromUUID,
-				toUUID,
+				"GetProfileNested(exit): uuid:%s apiName:%s username:%s profile:%v err:%v",
+				uuid,
 				apiName,
-				projects,
 				username,
-				s.ToLocalNestedUniqueIdentity(uid),
+				s.ToLocalProfileNestedRolls(profile),
 				err,
 			),
 		)
-		if err == nil {
-			s.esLog.Log(fmt.Sprintf("User '%s' merged profile uuid '%s' into profile uuid '%s' (API: '%s', project slug: '%s')", username, fromUUID, toUUID, apiName, projects), username, apiName)
-		}
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	var tx *sql.Tx
-	tx, err = s.shDB.BeginTx()
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
-	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
-	}()
-	esUUID := ""
-	esIsBot := false
-	esUUID, esIsBot, err = s.shDB.MergeUniqueIdentities(fromUUID, toUUID, archive, tx)
+	var ary []*models.UniqueIdentityNestedDataOutput
+	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+uuid, 1, 1, false, []string{"all-projects"}, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	var ary []*models.UniqueIdentityNestedDataOutput
-	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+toUUID, 1, 1, false, projects, tx)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
+	if len(ary) == 0 {
+		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", uuid), apiName)
 		return
 	}
-	err = tx.Commit()
+	// username = "lukaszgryglicki"
+	userProjects, err := s.apiDB.GetUserProjects(username)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	// Set tx to nil, so deferred rollback will not happen
-	tx = nil
-	if len(ary) == 0 {
-		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", toUUID), apiName)
-		return
-	}
 	uid = ary[0]
-	s.UUDA2SF(uid)
-	if esUUID != "" {
-		go func() {
-			s.es.UpdateByQuery("sds-*,-*-raw", "author_bot", esIsBot, "author_uuid", esUUID, true)
-		}()
-	}
 	s.shDB.SetIsLFX(uid)
-	return
-}
-
-// PutMoveIdentity: API
-// ==================================================================================
-// Move Identity to New Profile | Unmerge Identities and Profiles
-// This function shifts the identity identified by 'fromID' to
-// the unique identity/profile 'toUUID'.
-// When 'toUUID' is the unique identity that is currently related
-// to 'fromID', the action does not have any effect.
-// In the case of 'fromID' and 'toUUID' have equal values and the
-// unique identity does not exist, a new unique identity will be
-// created and the identity will be moved to it (unmerged).
-// ==================================================================================
-// NOTE: fromID refers to `identities`.`id` while toUUID refers to `profiles`.`uuid`
-// ==================================================================================
-// /v1/affiliation/{projectSlugs}/move_identity/{fromID}/{toUUID}[?archive=false]:
-// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// {fromID} - required path parameter: identity id to move from, example "00029bc65f7fc5ba3dde20057770d3320ca51486"
-// {toUUID} - required path parameter: uidentity/profile uuid to move into, example "00058697877808f6b4a8524ac6dcf39b544a0c87"
-// archive - optional query parameter: if archive=false it will not attempt to restore data from archive
-func (s *service) PutMoveIdentity(ctx context.Context, params *affiliation.PutMoveIdentityParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
-	fromID := params.FromID
-	toUUID := params.ToUUID
-	archive := true
-	if params.Archive != nil {
-		archive = *params.Archive
+	globalRolls := []*models.EnrollmentNestedDataOutput{}
+	groupRolls := map[string][]*models.EnrollmentNestedDataOutput{}
+	projectRolls := map[string][]*models.EnrollmentNestedDataOutput{}
+	for _, rol := range uid.Enrollments {
+		if rol.ProjectSlug == nil {
+			globalRolls = append(globalRolls, rol)
+			continue
+		}
+		slug := *rol.ProjectSlug
+		if strings.HasSuffix(slug, "-f") {
+			_, ok := groupRolls[slug]
+			if !ok {
+				groupRolls[slug] = []*models.EnrollmentNestedDataOutput{rol}
+				continue
+			}
+			groupRolls[slug] = append(groupRolls[slug], rol)
+			continue
+		}
+		_, ok := projectRolls[slug]
+		if !ok {
+			projectRolls[slug] = []*models.EnrollmentNestedDataOutput{rol}
+			continue
+		}
+		projectRolls[slug] = append(projectRolls[slug], rol)
 	}
-	log.Info(fmt.Sprintf("PutMoveIdentity: fromID:%s toUUID:%s archive:%v", fromID, toUUID, archive))
+	groups := []*models.ProfileNestedRollsEnrollmentsGroupsItems0{}
+	for group, rols := range groupRolls {
+		sort.Slice(rols, func(i, j int) bool {
+			return time.Time(rols[i].Start).Before(time.Time(rols[j].Start))
+		})
+		groups = append(groups, &models.ProfileNestedRollsEnrollmentsGroupsItems0{
+			Name:        group,
+			Enrollments: rols,
+			HasAccess:   s.checkAccess(group, userProjects),
+		})
+	}
+	projects := []*models.ProfileNestedRollsEnrollmentsProjectsItems0{}
+	for project, rols := range projectRolls {
+		sort.Slice(rols, func(i, j int) bool {
+			return time.Time(rols[i].Start).Before(time.Time(rols[j].Start))
+		})
+		projects = append(projects, &models.ProfileNestedRollsEnrollmentsProjectsItems0{
+			Name:        project,
+			Enrollments: rols,
+			HasAccess:   s.checkAccess(project, userProjects),
+		})
+	}
+	profile.Identities = uid.Identities
+	profile.LastModified = uid.LastModified
+	profile.Profile = uid.Profile
+	profile.UUID = uid.UUID
+	profile.Enrollments = &models.ProfileNestedRollsEnrollments{
+		Global: &models.ProfileNestedRollsEnrollmentsGlobal{
+			Enrollments: globalRolls,
+		},
+		Groups:   groups,
+		Projects: projects,
+	}
+	s.ProfileNestedRollsDA2SF(profile)
+	return
+}
+
+// GetProfileEnrollments: API params:
+// /v1/affiliation/{projectSlugs}/enrollments/{uuid}
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// {uuid} - required path parameter: UUID of the profile to get enrollments
+// as_of - optional query parameter: if set, returns enrollments as they were at this point in time (reconstructed from current and archived enrollments), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+func (s *service) GetProfileEnrollments(ctx context.Context, params *affiliation.GetProfileEnrollmentsParams) (output *models.GetProfileEnrollmentsDataOutput, err error) {
+	uuid := params.UUID
+	output = &models.GetProfileEnrollmentsDataOutput{}
+	log.Info(fmt.Sprintf("GetProfileEnrollments: uuid:%s", uuid))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"PutMoveIdentity(exit): fromID:%s toUUID:%s apiName:%s projects:%+v username:%s uid:%+v err:%v",
-				fromID,
-				toUUID,
+				"GetProfileEnrollments(exit): uuid:%s apiName:%s projects:%+v username:%s output:%v err:%v",
+				uuid,
 				apiName,
 				projects,
 				username,
-				s.ToLocalNestedUniqueIdentity(uid),
+				output,
 				err,
 			),
 		)
-		if err == nil {
-			s.esLog.Log(fmt.Sprintf("User '%s' unmerged/moved identity id '%s' into profile uuid '%s' (API: '%s', project slug: '%s')", username, fromID, toUUID, apiName, projects), username, apiName)
-		}
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
 	// Do the actual API call
-	var tx *sql.Tx
-	tx, err = s.shDB.BeginTx()
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
+	var enrollments []*models.EnrollmentNestedDataOutput
+	asOf := s.asOfParam(params.AsOf)
+	if asOf != nil {
+		var uid *models.UniqueIdentityNestedDataOutput
+		uid, err = s.shDB.GetUniqueIdentityNestedAsOf(uuid, *asOf, projects, true, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		enrollments = uid.Enrollments
+	} else {
+		enrollments, err = s.shDB.FindEnrollmentsNested([]string{"e.uuid"}, []interface{}{uuid}, []bool{false}, false, projects, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
 	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
+	if len(enrollments) == 0 && asOf == nil {
+		_, err = s.shDB.GetUniqueIdentity(uuid, true, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
 		}
-	}()
-	err = s.shDB.MoveIdentity(fromID, toUUID, archive, tx)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
 	}
-	var ary []*models.UniqueIdentityNestedDataOutput
-	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+toUUID, 1, 1, false, projects, tx)
+	output.UUID = uuid
+	output.User = username
+	output.Scope = s.AryDA2SF(projects)
+	output.Enrollments = enrollments
+	s.ProfileEnrollmentsDA2SF(output)
+	return
+}
+
+// GetEnrollmentVersions: API params:
+// /v1/affiliation/{projectSlugs}/enrollment_versions/{uuid}[?enrollment_id=123]
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// {uuid} - required path parameter: UUID of the profile to list archived enrollments versions
+// enrollment_id - optional query parameter: if set, only this enrollment's archived versions are returned
+// Versions are grouped by archived_at (enrollments archived by the same operation), the most recent first, use archived_at to restore given version
+func (s *service) GetEnrollmentVersions(ctx context.Context, params *affiliation.GetEnrollmentVersionsParams) (output *models.EnrollmentVersionsOutput, err error) {
+	uuid := params.UUID
+	id := int64(0)
+	if params.EnrollmentID != nil {
+		id = *params.EnrollmentID
+	}
+	output = &models.EnrollmentVersionsOutput{}
+	log.Info(fmt.Sprintf("GetEnrollmentVersions: uuid:%s id:%d", uuid, id))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetEnrollmentVersions(exit): uuid:%s id:%d apiName:%s projects:%+v username:%s versions:%d err:%v",
+				uuid,
+				id,
+				apiName,
+				projects,
+				username,
+				len(output.Versions),
+				err,
+			),
+		)
+	}()
 	if err != nil {
-		err = errs.Wrap(err, apiName)
 		return
 	}
-	err = tx.Commit()
+	// Do the actual API call
+	output.Versions, err = s.shDB.GetEnrollmentVersions(uuid, id, projects, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	// Set tx to nil, so deferred rollback will not happen
-	tx = nil
-	if len(ary) == 0 {
-		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", toUUID), apiName)
-		return
-	}
-	uid = ary[0]
-	s.shDB.SetIsLFX(uid)
-	s.UUDA2SF(uid)
+	output.UUID = uuid
+	output.EnrollmentID = id
+	output.User = username
+	output.Scope = s.AryDA2SF(projects)
+	s.EnrollmentVersionsDA2SF(output)
 	return
 }
 
-// GetUnaffiliated: API params:
-// /v1/affiliation/{projectSlugs}/unaffiliated[?page=2][&[rows=50]
+// PutRestoreEnrollments: API params:
+// /v1/affiliation/{projectSlugs}/restore_enrollments/{uuid}?archived_at=2020-05-05T15:15:05.123456Z[&enrollment_id=123][&dry=true]
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10  (setting to zero still limits results to 65535)
-// page - optional query parameter: if set, it will return rows from a given page, default 1
-func (s *service) GetUnaffiliated(ctx context.Context, params *affiliation.GetUnaffiliatedParams) (getUnaffiliated *models.GetUnaffiliatedOutput, err error) {
-	rows := int64(10)
-	if params.Rows != nil {
-		rows = *params.Rows
-		if rows <= 0 {
-			rows = 0xffff
-		}
+// {uuid} - required path parameter: UUID of the profile to restore enrollments
+// archived_at - required query parameter: version to restore, exactly as returned by enrollment_versions API (urlencoded)
+// enrollment_id - optional query parameter: if set, only this enrollment is restored
+// dry - optional query parameter: if set, only returns what would be changed
+// Current enrollments being replaced are archived first, so restore can be undone by restoring them
+func (s *service) PutRestoreEnrollments(ctx context.Context, params *affiliation.PutRestoreEnrollmentsParams) (output *models.EnrollmentsRestoreOutput, err error) {
+	uuid := params.UUID
+	id := int64(0)
+	if params.EnrollmentID != nil {
+		id = *params.EnrollmentID
 	}
-	page := int64(1)
-	if params.Page != nil {
-		page = *params.Page
-		if page < 1 {
-			page = 1
-		}
+	dry := false
+	if params.Dry != nil {
+		dry = *params.Dry
 	}
-	getUnaffiliated = &models.GetUnaffiliatedOutput{}
-	log.Info(fmt.Sprintf("GetUnaffiliated: rows:%d page:%d", rows, page))
+	output = &models.EnrollmentsRestoreOutput{}
+	log.Info(fmt.Sprintf("PutRestoreEnrollments: uuid:%s archivedAt:%s id:%d dry:%v", uuid, params.ArchivedAt, id, dry))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetUnaffiliated(exit): rows:%d page:%d apiName:%s projects:%+v username:%s getUnaffiliated:%d err:%v",
-				rows,
-				page,
+				"PutRestoreEnrollments(exit): uuid:%s archivedAt:%s id:%d dry:%v apiName:%s projects:%+v username:%s changes:%d err:%v",
+				uuid,
+				params.ArchivedAt,
+				id,
+				dry,
 				apiName,
 				projects,
 				username,
-				len(getUnaffiliated.Unaffiliated),
+				len(output.Changes),
 				err,
 			),
 		)
@@ -2928,708 +3336,1813 @@ func (s *service) GetUnaffiliated(ctx context.Context, params *affiliation.GetUn
 	if err != nil {
 		return
 	}
-	// Do the actual API call
-	last := page * rows
-	more := (last + 5) * 3
-	prevN := int64(-1)
-	for {
-		getUnaffiliated, err = s.es.GetUnaffiliated(projects, more)
-		if err != nil {
-			err = errs.Wrap(err, apiName)
-			return
-		}
-		getUnaffiliated.Unaffiliated, err = s.shDB.CheckUnaffiliated(getUnaffiliated.Unaffiliated, projects, nil)
-		if err != nil {
-			getUnaffiliated.Unaffiliated = []*models.UnaffiliatedDataOutput{}
-			err = errs.Wrap(err, apiName)
-			return
-		}
-		n := int64(len(getUnaffiliated.Unaffiliated))
-		if prevN == n {
-			break
-		}
-		if n < last {
-			prevN = n
-			more *= 2
-			continue
-		}
-		break
-	}
-	n := int64(len(getUnaffiliated.Unaffiliated))
-	from := (page - 1) * rows
-	to := from + rows
-	if from > n {
-		from = n
-	}
-	if to > n {
-		to = n
-	}
-	if from == to {
-		getUnaffiliated.Unaffiliated = []*models.UnaffiliatedDataOutput{}
-		return
-	}
-	getUnaffiliated.Unaffiliated = getUnaffiliated.Unaffiliated[from:to]
-	getUnaffiliated.Page = page
-	getUnaffiliated.Rows = rows
-	getUnaffiliated.User = username
-	getUnaffiliated.Scope = s.AryDA2SF(projects)
-	return
-}
-
-func (s *service) FilterDataSources(dsIn, filter []string) (dsOut []string) {
-	// dsIn: ["git", "github/pull_request", "github/issue", "jira"]
-	// filter ["git", "github", "jira"] but can be ["github/issue"]
-	//defer func() {
-	//	fmt.Printf("FilterDataSources(%v, %v) -> %v\n", dsIn, filter, dsOut)
-	//}()
-	if len(filter) == 0 {
-		dsOut = dsIn
+	archivedAt, err := time.Parse(time.RFC3339Nano, params.ArchivedAt)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), apiName)
 		return
 	}
-	if filter[0] == "all" {
-		dsOut = dsIn
+	// Do the actual API call
+	output.Changes, err = s.shDB.RestoreEnrollments(uuid, archivedAt, id, projects, dry)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
 		return
 	}
-	m := make(map[string]struct{})
-	for _, f := range filter {
-		m[f] = struct{}{}
-	}
-	dsOut = []string{}
-	for _, ds := range dsIn {
-		dsa := strings.Split(ds, "/")
-		_, ok1 := m[ds]
-		_, ok2 := m[dsa[0]]
-		if ok1 || ok2 {
-			dsOut = append(dsOut, ds)
+	for _, change := range output.Changes {
+		switch change.Action {
+		case shared.EnrollmentRestoreAdd:
+			output.NAdded++
+		case shared.EnrollmentRestoreReplace:
+			output.NReplaced++
+		case shared.EnrollmentRestoreUnchanged:
+			output.NUnchanged++
+		case shared.EnrollmentRestoreConflict:
+			output.NConflicts++
 		}
 	}
+	output.UUID = uuid
+	output.ArchivedAt = archivedAt.UTC().Format(shared.ArchivedAtFormat)
+	output.Dry = dry
+	output.User = username
+	output.Scope = s.AryDA2SF(projects)
+	s.EnrollmentsRestoreDA2SF(output)
 	return
 }
 
-func (s *service) MakeDSInfo(actualArray []*models.DataSourceTypeFields, configuredArray, selectedArray []string) (result []*models.ConfiguredDataSourcesFields, warning string) {
-	actual := make(map[string]struct{})
-	for _, actualItem := range actualArray {
-		actual[actualItem.Name] = struct{}{}
-	}
-	selected := make(map[string]struct{})
-	for _, selectedItem := range selectedArray {
-		selected[selectedItem] = struct{}{}
-	}
-	missing := []string{}
-	fmt.Printf("actual=%+v\nconfigured=%+v\nselected=%+v\n", actual, configuredArray, selected)
-	for _, configured := range configuredArray {
-		item, ok := shared.DataSourcesFields[configured]
-		if !ok {
-			log.Info("Cannot find preconfigured data for data source " + configured)
-			continue
-		}
-		//item := &models.ConfiguredDataSourcesFields{}
-		_, sel := selected[configured]
-		item.FilterSelected = sel
-		if sel {
-			if configured == "bugzillarest" {
-				configured = "bugzilla"
-			}
-			_, present := actual[configured]
-			noData := !present
-			item.NoData = &noData
-			if noData {
-				missing = append(missing, item.Name)
-			}
-		} else {
-			item.NoData = nil
-		}
-		result = append(result, item)
-	}
-	sort.Slice(
-		result,
-		func(i, j int) bool {
-			ordI, _ := shared.DataSourceTypesSortOrder[result[i].Key]
-			ordJ, _ := shared.DataSourceTypesSortOrder[result[j].Key]
-			if ordI == 0 {
-				ordI = 1000
-			}
-			if ordJ == 0 {
-				ordJ = 1000
-			}
-			return ordI < ordJ
-		},
-	)
-	if len(missing) > 0 {
-		warning = fmt.Sprintf("The following data sources are missing data: %s", strings.Join(missing, ", "))
-	}
-	return
-}
-
-func (s *service) TopContributorsParams(params *affiliation.GetTopContributorsParams, paramsCSV *affiliation.GetTopContributorsCSVParams) (limit, offset, from, to int64, search, sortField, sortOrder, key string, dataSources []string) {
-	csvParams := false
-	if params == nil {
-		params = &affiliation.GetTopContributorsParams{
-			From:       paramsCSV.From,
-			To:         paramsCSV.To,
-			Limit:      paramsCSV.Limit,
-			Offset:     paramsCSV.Offset,
-			Search:     paramsCSV.Search,
-			SortField:  paramsCSV.SortField,
-			SortOrder:  paramsCSV.SortOrder,
-			DataSource: paramsCSV.DataSource,
-		}
-		csvParams = true
-	}
-	if params.From != nil {
-		from = *params.From
-	} else {
-		from = (time.Now().Add(-24 * 90 * time.Hour)).UnixNano() / 1.0e6
-	}
-	if params.To != nil {
-		to = *params.To
-	} else {
-		to = time.Now().UnixNano() / 1.0e6
-	}
-	limit = 10
-	if csvParams {
-		limit = 10000
-	}
-	if params.Limit != nil {
-		limit = *params.Limit
-		if limit < 1 {
-			limit = 1
-		}
-		if limit > 10000 {
-			limit = 10000
-		}
-	}
-	if params.Offset != nil {
-		offset = *params.Offset
-		if offset < 0 {
-			offset = 0
-		}
-	}
-	if params.Search != nil {
-		search = *params.Search
-		if !strings.HasPrefix(search, "re:") && !strings.Contains(search, "=re:") {
-			search = strings.ToLower(strings.TrimSpace(search))
-		}
+// PutOrgDomain: API params:
+// /v1/affiliation/{projectSlugs}/add_domain/{orgName}/{domain}[?overwrite=true][&is_top_domain=true][&skip_enrollments=true]
+// {orgName} - required path parameter:      organization to add domain to, must be URL encoded, for example 'The%20Microsoft%20company'
+// {domain} - required path parameter:       domain to be added, for example 'microsoft.com'
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// overwrite - optional query parameter:     if overwrite=true is set, all profiles found are force-updated/affiliated to the given organization
+//                                           if overwite is not set, API will not change any profiles which already have any affiliation(s)
+// is_top_domain - optional query parameter: if you specify is_top_domain=true it will set 'is_top_domain' DB column to true, else it will set false
+// skip_enrollments - optional query parameter: if skip_enrollments=true is set, no enrollments will be modified/added/removed/touched
+func (s *service) PutOrgDomain(ctx context.Context, params *affiliation.PutOrgDomainParams) (putOrgDomain *models.PutOrgDomainOutput, err error) {
+	org := params.OrgName
+	dom := params.Domain
+	overwrite := false
+	isTopDomain := false
+	skipEnrollments := false
+	if params.Overwrite != nil {
+		overwrite = *params.Overwrite
 	}
-	if params.SortField != nil {
-		sortField = strings.TrimSpace(*params.SortField)
+	if params.IsTopDomain != nil {
+		isTopDomain = *params.IsTopDomain
 	}
-	if params.SortOrder != nil {
-		sortOrder = strings.ToLower(strings.TrimSpace(*params.SortOrder))
+	if params.SkipEnrollments != nil {
+		skipEnrollments = *params.SkipEnrollments
 	}
-	var dss string
-	if params.DataSource != nil {
-		dss = *params.DataSource
-	} else {
-		// FIXME
-		// prod
-		dss = "git"
-		// test
-		// dss = "all"
+	log.Info(fmt.Sprintf("PutOrgDomain: org:%s dom:%s overwrite:%v isTopDomain:%v skipEnrollments:%v", org, dom, overwrite, isTopDomain, skipEnrollments))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PutOrgDomain(exit): org:%s dom:%s overwrite:%v isTopDomain:%v skipEnrollments:%v apiName:%s projects:%+v username:%s putOrgDomain:%+v err:%v",
+				org,
+				dom,
+				overwrite,
+				isTopDomain,
+				skipEnrollments,
+				apiName,
+				projects,
+				username,
+				putOrgDomain,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
 	}
-	dsa := strings.Split(dss, ",")
-	for _, ds := range dsa {
-		dataSources = append(dataSources, strings.ToLower(strings.TrimSpace(ds)))
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	putOrgDomain, err = s.shDB.PutOrgDomain(org, dom, overwrite, isTopDomain, skipEnrollments)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	sort.Strings(dataSources)
-	dss = strings.Join(dataSources, ",")
-	//fmt.Printf("dss=%s\n", dss)
-	key = fmt.Sprintf("%d:%d:%d:%d:%s:%s:%s:%s", limit, offset, s.RoundMSTime(from), s.RoundMSTime(to), search, sortField, sortOrder, dss)
+	putOrgDomain.User = username
+	putOrgDomain.Scope = s.AryDA2SF(projects)
 	return
 }
 
-// GetTopContributors: API params:
-// /v1/affiliation/{projectSlugs}/top_contributors?from=1552790984700&to=1552790984700][&limit=50][&offset=2][&search=john][&sort_field=gerrit_merged_changesets][&sort_order=desc]
+// DeleteOrgDomain: API params:
+// /v1/affiliation/{projectSlugs}/remove_domain/{orgName}/{domain}
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// from - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data from, default 90 days ago
-// to - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data to, default now
-// limit - optional query parameter: page size, default 10
-// offset - optional query parameter: offset in pages, specifying limit=10 and offset=2, you will get 20-30)
-// search - optional query parameter: for example john, it can be specified in multiple forms (must be urlencoded)
-//     empty - so search filter will be applied
-//     john - will search using like '.*john.*' no case sensitive regexp pattern on author_org_name, author_name and author_uuids columns
-//     all=john - will fetch list of all string type columns (per index pattern) and then search for '.*john.*' (case insensitive) on all of them
-//     all=john,pamela,..,josh - will search for multiple values on all columns
-//     col1,col2,...,colN=val1,val2,...,valM - will search for any of val1 - valM on all col1 - colN columns using N x M or conditions
-// sort_field - optional query parameter: sort field for example gerrit_merged_changesets, can be fetched from "data_source_types" object returned per given project slug
-//     if not specified API sorts contributors by count of documents related to their activity descending - so its most probable to get actual top contributors across all data sources defined for the project
-//     if defined it must be one of fields returned in data source types fields object (from "data_source_types" object + special author_uuid) in that case API fetches contributors by this field first
-//     and then once it has list of their UUIDs (after searching, sorting and paging) - it uses that list of UUIDs to get the remaining fields and finally merge results into one object.
-// sort_order - optional query parameter: sort order allowed desc or asc, default is desc
-//     when sorting asc (which is almost senseless) API only returns objects that have at least 1 document matching this sort criteria
-//     so for example sort by git commits asc, will start from contributors having at least one commit, not 0).
-func (s *service) GetTopContributors(ctx context.Context, params *affiliation.GetTopContributorsParams) (topContributors *models.TopContributorsFlatOutput, err error) {
-	limit, offset, from, to, search, sortField, sortOrder, key, dataSourcesFilter := s.TopContributorsParams(params, nil)
-	if to < from {
-		err = fmt.Errorf("to parameter (%d) must be higher or equal from (%d)", to, from)
-		return
-	}
-	topContributors = &models.TopContributorsFlatOutput{}
-	log.Info(fmt.Sprintf("GetTopContributors: from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v", from, to, limit, offset, search, sortField, sortOrder, dataSourcesFilter))
+// {orgName} - required path parameter:      organization to remove domain from, must be URL encoded, for example 'The%20Microsoft%20company'
+// {domain} - required path parameter:       domain to be deleted, for example 'microsoft.com'
+func (s *service) DeleteOrgDomain(ctx context.Context, params *affiliation.DeleteOrgDomainParams) (status *models.TextStatusOutput, err error) {
+	org := params.OrgName
+	dom := params.Domain
+	log.Info(fmt.Sprintf("DeleteOrgDomain: org:%s dom:%s", org, dom))
 	// Check token and permission
-	public := false
-	apiName, projects, username, e := s.checkTokenAndPermission(params)
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetTopContributors(exit): from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v apiName:%s projects:%+v username:%s topContributors:%d public:%v err:%v",
-				from,
-				to,
-				limit,
-				offset,
-				search,
-				sortField,
-				sortOrder,
-				dataSourcesFilter,
+				"DeleteOrgDomain(exit): org:%s dom:%s apiName:%s projects:%+v username:%s status:%+v err:%v",
+				org,
+				dom,
 				apiName,
 				projects,
 				username,
-				len(topContributors.Contributors),
-				public,
+				status,
 				err,
 			),
 		)
 	}()
-	if e != nil {
-		if len(projects) < 1 {
-			err = errs.Wrap(e, apiName)
-			return
-		}
-		public = true
-	}
-	if public {
-		key += ":pub"
-	}
-	var ok bool
-	topContributors, ok = s.getTopContributorsCache(key, projects)
-	if ok {
-		return
-	}
-	var (
-		configuredDataSourceTypes []string
-		dataSourceTypes           []string
-	)
-	configuredDataSourceTypes, err = s.apiDB.GetDataSourceTypes(projects)
 	if err != nil {
-		err = errs.Wrap(err, apiName)
 		return
 	}
-	dataSourceTypes = s.FilterDataSources(configuredDataSourceTypes, dataSourcesFilter)
-	// fmt.Printf("key=%s, dataSourcesFilter=%v, configuredDataSourceTypes=%v, dataSourceTypes=%v\n", key, dataSourcesFilter, configuredDataSourceTypes, dataSourceTypes)
-	topContributors, err = s.es.GetTopContributors(projects, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	status, err = s.shDB.DeleteOrgDomain(org, dom)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	if len(topContributors.Contributors) > 0 {
-		err = s.shDB.EnrichContributors(topContributors.Contributors, projects, to, nil)
-		if err != nil {
-			err = errs.Wrap(err, apiName)
-			return
+	return
+}
+
+// GetListOrganizationsDomains: API params:
+// /v1/affiliation/{projectSlugs}/list_domains[?orgID=23456][&q=xyz][&rows=100][&page=2]
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// orgID - optional query parameter: organization ID to get domains, default is 0 it return data for all organizations then
+// q - optional query parameter: if you specify that parameter only domains like '%q%' will be returned
+// rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10  (setting to zero still limits results to 65535)
+// page - optional query parameter: if set, it will return rows from a given page, default 1
+func (s *service) GetListOrganizationsDomains(ctx context.Context, params *affiliation.GetListOrganizationsDomainsParams) (getListOrganizationsDomains *models.GetListOrganizationsDomainsOutput, err error) {
+	orgID := int64(0)
+	if params.OrgID != nil {
+		orgID = *params.OrgID
+	}
+	q := ""
+	if params.Q != nil {
+		q = *params.Q
+	}
+	rows := int64(10)
+	if params.Rows != nil {
+		rows = *params.Rows
+		if rows <= 0 {
+			rows = 0xffff
 		}
 	}
-	if public {
-		for i := range topContributors.Contributors {
-			topContributors.Contributors[i].Email = ""
+	page := int64(1)
+	if params.Page != nil {
+		page = *params.Page
+		if page < 1 {
+			page = 1
 		}
 	}
-	topContributors.From = from
-	topContributors.To = to
-	topContributors.Limit = limit
-	topContributors.Offset = offset
-	topContributors.Search = search
-	topContributors.SortField = sortField
-	topContributors.SortOrder = sortOrder
-	topContributors.ConfiguredDataSources, topContributors.Warning = s.MakeDSInfo(topContributors.DataSourceTypes, configuredDataSourceTypes, dataSourceTypes)
-	topContributors.User = username
-	topContributors.Scope = s.AryDA2SF(projects)
-	topContributors.Public = public
-	s.setTopContributorsCache(key, projects, topContributors)
+	getListOrganizationsDomains = &models.GetListOrganizationsDomainsOutput{}
+	log.Info(fmt.Sprintf("GetListOrganizationsDomains: orgID:%d q:%s rows:%d page:%d", orgID, q, rows, page))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		list := ""
+		nDoms := len(getListOrganizationsDomains.Domains)
+		if nDoms > shared.LogListMax {
+			list = fmt.Sprintf("%d", nDoms)
+		} else {
+			list = fmt.Sprintf("%+v", s.ToLocalDomains(getListOrganizationsDomains.Domains))
+		}
+		log.Info(
+			fmt.Sprintf(
+				"GetListOrganizationsDomains(exit): orgID:%d q:%s rows:%d page:%d apiName:%s projects:%+v username:%s getListOrganizationsDomains:%s err:%v",
+				orgID,
+				q,
+				rows,
+				page,
+				apiName,
+				projects,
+				username,
+				list,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	// Do the actual API call
+	getListOrganizationsDomains, err = s.shDB.GetListOrganizationsDomains(orgID, q, rows, page)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	getListOrganizationsDomains.User = username
+	getListOrganizationsDomains.Scope = s.AryDA2SF(projects)
 	return
 }
 
-// GetTopContributorsCSV: API params:
-// /v1/affiliation/{projectSlugs}/top_contributors_csv?from=1552790984700&to=1552790984700][&limit=50][&offset=2][&search=john][&sort_field=gerrit_merged_changesets][&sort_order=desc]
+// PutMergeUniqueIdentities: API
+// ===========================================================================
+// Merge two Profiles with fromUUID to toUUID and Merge Enrollments
+// Use this function to join fromUUID unique identity into toUUID
+// Identities and enrollments related to fromUUID will be assigned
+// to toUUID. In addition, fromUUID will be removed (archived in a special table)
+// Duplicated enrollments will be also removed from
+// the registry while overlapped enrollments will be merged.
+// This function also merges two profiles. When a field on toUUID
+// profile is empty, it will be updated with the value on the
+// profile of fromUUID. If any of the two unique identities was set
+// as a bot, the new profile will also be set as a bot.
+// When fromUUID and toUUID are equal, the action does not have any effect
+// ===========================================================================
+// NOTE: UUIDs used here refer to `profiles` and `profiles_archive` tables
+// ===========================================================================
+// /v1/affiliation/{projectSlugs}/merge_unique_identities/{fromUUID}/{toUUID}[?archive=false]:
 // {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
-// from - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data from, default 90 days ago
-// to - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data to, default now
-// limit - optional query parameter: page size, default 10
-// offset - optional query parameter: offset in pages, specifying limit=10 and offset=2, you will get 20-30)
-// search - optional query parameter: for example john, it can be specified in multiple forms (must be urlencoded)
-//     empty - so search filter will be applied
-//     john - will search using like '.*john.*' no case sensitive regexp pattern on author_org_name, author_name and author_uuids columns
-//     all=john - will fetch list of all string type columns (per index pattern) and then search for '.*john.*' (case insensitive) on all of them
-//     all=john,pamela,..,josh - will search for multiple values on all columns
-//     col1,col2,...,colN=val1,val2,...,valM - will search for any of val1 - valM on all col1 - colN columns using N x M or conditions
-// sort_field - optional query parameter: sort field for example gerrit_merged_changesets, can be fetched from "data_source_types" object returned per given project slug
-//     if not specified API sorts contributors by count of documents related to their activity descending - so its most probable to get actual top contributors across all data sources defined for the project
-//     if defined it must be one of fields returned in data source types fields object (from "data_source_types" object + special author_uuid) in that case API fetches contributors by this field first
-//     and then once it has list of their UUIDs (after searching, sorting and paging) - it uses that list of UUIDs to get the remaining fields and finally merge results into one object.
-// sort_order - optional query parameter: sort order allowed desc or asc, default is desc
-//     when sorting asc (which is almost senseless) API only returns objects that have at least 1 document matching this sort criteria
-//     so for example sort by git commits asc, will start from contributors having at least one commit, not 0).
-func (s *service) GetTopContributorsCSV(ctx context.Context, params *affiliation.GetTopContributorsCSVParams) (f io.ReadCloser, err error) {
-	limit, offset, from, to, search, sortField, sortOrder, key, dataSourcesFilter := s.TopContributorsParams(nil, params)
-	if to < from {
-		err = fmt.Errorf("to parameter (%d) must be higher or equal from (%d)", to, from)
-		return
+// {fromUUID} - required path parameter: uidentity/profile uuid to merge from, example "00029bc65f7fc5ba3dde20057770d3320ca51486"
+// {toUUID} - required path parameter: uidentity/profile uuid to merge into, example "00058697877808f6b4a8524ac6dcf39b544a0c87"
+// archive - optional query parameter: if archive=false it will not archive data to allow unmerge without data loss
+func (s *service) PutMergeUniqueIdentities(ctx context.Context, params *affiliation.PutMergeUniqueIdentitiesParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
+	fromUUID := params.FromUUID
+	toUUID := params.ToUUID
+	archive := true
+	if params.Archive != nil {
+		archive = *params.Archive
 	}
-	topContributors := &models.TopContributorsFlatOutput{}
-	log.Info(fmt.Sprintf("GetTopContributorsCSV: from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v", from, to, limit, offset, search, sortField, sortOrder, dataSourcesFilter))
+	log.Info(fmt.Sprintf("PutMergeUniqueIdentities: fromUUID:%s toUUID:%s archive:%v", fromUUID, toUUID, archive))
 	// Check token and permission
-	public := false
-	apiName, projects, username, e := s.checkTokenAndPermission(params)
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetTopContributorsCSV(exit): from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v apiName:%s projects:%+v username:%s topContributors:%d public:%v err:%v",
-				from,
-				to,
-				limit,
-				offset,
-				search,
-				sortField,
-				sortOrder,
-				dataSourcesFilter,
+				"PutMergeUniqueIdentities(exit): fromUUID:%s toUUID:%s apiName:%s projects:%+v username:%s uid:%+v err:%v",
+				fromUUID,
+				toUUID,
 				apiName,
 				projects,
 				username,
-				len(topContributors.Contributors),
-				public,
+				s.ToLocalNestedUniqueIdentity(uid),
 				err,
 			),
 		)
-	}()
-	if e != nil {
-		if len(projects) < 1 {
-			err = errs.Wrap(e, apiName)
-			return
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' merged profile uuid '%s' into profile uuid '%s' (API: '%s', project slug: '%s')", username, fromUUID, toUUID, apiName, projects), username, apiName)
 		}
-		public = true
+	}()
+	if err != nil {
+		return
 	}
-	if public {
-		key += ":pub"
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	var tx *sql.Tx
+	tx, err = s.shDB.BeginTx()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	var ok bool
-	topContributors, ok = s.getTopContributorsCache(key, projects)
-	if !ok {
-		var (
-			configuredDataSourceTypes []string
-			dataSourceTypes           []string
-		)
-		configuredDataSourceTypes, err = s.apiDB.GetDataSourceTypes(projects)
-		if err != nil {
-			err = errs.Wrap(err, apiName)
-			return
-		}
-		dataSourceTypes = s.FilterDataSources(configuredDataSourceTypes, dataSourcesFilter)
-		topContributors, err = s.es.GetTopContributors(projects, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
-		if err != nil {
-			err = errs.Wrap(err, apiName)
-			return
-		}
-		if len(topContributors.Contributors) > 0 {
-			err = s.shDB.EnrichContributors(topContributors.Contributors, projects, to, nil)
-			if err != nil {
-				err = errs.Wrap(err, apiName)
-				return
-			}
-		}
-		if public {
-			for i := range topContributors.Contributors {
-				topContributors.Contributors[i].Email = ""
-			}
+	defer func() {
+		if tx != nil {
+			s.shDB.RollbackTx(tx)
 		}
-		topContributors.ConfiguredDataSources, topContributors.Warning = s.MakeDSInfo(topContributors.DataSourceTypes, configuredDataSourceTypes, dataSourceTypes)
-		s.setTopContributorsCache(key, projects, topContributors)
+	}()
+	esUUID := ""
+	esIsBot := false
+	esUUID, esIsBot, err = s.shDB.MergeUniqueIdentities(fromUUID, toUUID, archive, tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	m := make(map[string]string)
-	for _, item := range topContributors.ConfiguredDataSources {
-		if item.NoData == nil || (item.NoData != nil && *item.NoData) {
-			continue
-		}
-		for _, dt := range item.DataTypes {
-			// m[dt.Key] = dt.Name
-			m[dt.Key] = item.Name + ": " + dt.Name
-		}
+	var ary []*models.UniqueIdentityNestedDataOutput
+	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+toUUID, 1, 1, false, projects, tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	fmt.Printf("m: %+v\n", m)
-	hdr := []string{
-		// "UUID",
-		"Name",
-		"Organization",
+	err = s.shDB.CommitTx(tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
 	}
-	if !public {
-		hdr = append(hdr, "Email")
+	// Set tx to nil, so deferred rollback will not happen
+	tx = nil
+	if len(ary) == 0 {
+		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", toUUID), apiName)
+		return
 	}
-	// TOPCON
-	possibleHeader := []string{
-		"git_commits",
-		"git_lines_added",
-		"git_lines_changed",
-		"git_lines_removed",
-		"github_pull_request_prs_created",
-		"github_pull_request_prs_open",
-		"github_pull_request_prs_closed",
-		"github_pull_request_prs_merged",
-		"github_pull_request_prs_reviewed",
-		"github_pull_request_prs_approved",
-		"github_pull_request_prs_review_comments",
-		"github_pull_request_prs_comment_activity",
-		"gerrit_approvals",
-		"gerrit_changesets",
-		"gerrit_merged_changesets",
-		"gerrit_comments",
-		"jira_comments",
-		"jira_issues_assigned",
-		"jira_issues_created",
-		"jira_issues_closed",
-		"jira_average_issue_open_days",
-		"github_issue_average_time_open_days",
-		"github_issue_issues_created",
-		"github_issue_issues_assigned",
-		"github_issue_issues_closed",
-		"github_issue_issues_comments",
-		"bugzilla_issues_assigned",
-		"bugzilla_issues_created",
-		"bugzilla_issues_closed",
-		"bugzilla_average_issue_open_days",
-		"confluence_comments",
-		"confluence_blog_posts",
-		"confluence_pages_created",
-		"confluence_pages_edited",
-		"confluence_attachments",
-		"confluence_last_action_date",
-		"confluence_days_since_last_documentation",
+	uid = ary[0]
+	s.UUDA2SF(uid)
+	if esUUID != "" {
+		go func() {
+			s.es.UpdateByQuery("sds-*,-*-raw", "author_bot", esIsBot, "author_uuid", esUUID, true)
+		}()
 	}
-	for _, h := range possibleHeader {
-		name, ok := m[h]
-		if ok {
-			hdr = append(hdr, name)
+	s.shDB.SetIsLFX(uid)
+	return
+}
+
+// PutUnmergeUniqueIdentities: API
+// ===========================================================================
+// Unmerge fromUUID profile previously merged into toUUID profile
+// Uses the archive created by PutMergeUniqueIdentities (archive=true), the most
+// recent merge of fromUUID into toUUID is reverted:
+// fromUUID unique identity and profile are restored, its identities that are
+// still on toUUID are moved back, toUUID profile fields copied by the merge are
+// reverted and enrollments of organizations fromUUID was enrolled to are restored
+// on both profiles as they were before the merge. toUUID is archived first.
+// ES documents of moved identities get their author_uuid (and author_bot) updated
+// ===========================================================================
+// /v1/affiliation/{projectSlugs}/unmerge_unique_identities/{fromUUID}/{toUUID}:
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// {fromUUID} - required path parameter: uidentity/profile uuid that was merged, example "00029bc65f7fc5ba3dde20057770d3320ca51486"
+// {toUUID} - required path parameter: uidentity/profile uuid it was merged into, example "00058697877808f6b4a8524ac6dcf39b544a0c87"
+func (s *service) PutUnmergeUniqueIdentities(ctx context.Context, params *affiliation.PutUnmergeUniqueIdentitiesParams) (output *models.UnmergeOutput, err error) {
+	fromUUID := params.FromUUID
+	toUUID := params.ToUUID
+	output = &models.UnmergeOutput{}
+	log.Info(fmt.Sprintf("PutUnmergeUniqueIdentities: fromUUID:%s toUUID:%s", fromUUID, toUUID))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PutUnmergeUniqueIdentities(exit): fromUUID:%s toUUID:%s apiName:%s projects:%+v username:%s moved:%+v skipped:%+v err:%v",
+				fromUUID,
+				toUUID,
+				apiName,
+				projects,
+				username,
+				output.IdentitiesMoved,
+				output.IdentitiesSkipped,
+				err,
+			),
+		)
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' unmerged profile uuid '%s' from profile uuid '%s' (API: '%s', project slug: '%s')", username, fromUUID, toUUID, apiName, projects), username, apiName)
 		}
+	}()
+	if err != nil {
+		return
 	}
-	buffer := &bytes.Buffer{}
-	writer := csv.NewWriter(buffer)
-	err = writer.Write(hdr)
+	// Do the actual API call
+	var tx *sql.Tx
+	tx, err = s.shDB.BeginTx()
 	if err != nil {
-		err = errs.Wrap(fmt.Errorf("error writing CSV header row: %+v: %+v", hdr, err), apiName)
+		err = errs.Wrap(err, apiName)
 		return
 	}
-	for index, contributor := range topContributors.Contributors {
-		row := []string{
-			// contributor.UUID,
-			contributor.Name,
-			contributor.Organization,
-		}
-		if !public {
-			row = append(row, contributor.Email)
-		}
-		// TOPCON
-		_, ok := m["git_commits"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GitCommits, 10))
-		}
-		_, ok = m["git_lines_added"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GitLinesAdded, 10))
-		}
-		_, ok = m["git_lines_changed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GitLinesChanged, 10))
-		}
-		_, ok = m["git_lines_removed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GitLinesRemoved, 10))
-		}
-		_, ok = m["github_pull_request_prs_created"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsCreated, 10))
-		}
-		_, ok = m["github_pull_request_prs_open"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsOpen, 10))
+	defer func() {
+		if tx != nil {
+			s.shDB.RollbackTx(tx)
 		}
-		_, ok = m["github_pull_request_prs_closed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsClosed, 10))
+	}()
+	output, err = s.shDB.UnmergeUniqueIdentities(fromUUID, toUUID, tx)
+	if err != nil {
+		output = &models.UnmergeOutput{}
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	uids := []*models.UniqueIdentityNestedDataOutput{}
+	for _, uuid := range []string{fromUUID, toUUID} {
+		var ary []*models.UniqueIdentityNestedDataOutput
+		ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+uuid, 1, 1, false, projects, tx)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
 		}
-		_, ok = m["github_pull_request_prs_merged"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsMerged, 10))
+		if len(ary) == 0 {
+			err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", uuid), apiName)
+			return
 		}
-		_, ok = m["github_pull_request_prs_reviewed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsReviewed, 10))
+		uids = append(uids, ary[0])
+	}
+	err = s.shDB.CommitTx(tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	// Set tx to nil, so deferred rollback will not happen
+	tx = nil
+	output.From, output.To = uids[0], uids[1]
+	ids := output.IdentitiesMoved
+	fromIsBot := output.From.Profile != nil && output.From.Profile.IsBot != nil && *output.From.Profile.IsBot == 1
+	toIsBot := output.To.Profile != nil && output.To.Profile.IsBot != nil && *output.To.Profile.IsBot == 1
+	if len(ids) > 0 {
+		go func() {
+			for _, id := range ids {
+				s.es.UpdateByQuery("sds-*,-*-raw", "author_uuid", fromUUID, "author_id", id, true)
+			}
+			s.es.UpdateByQuery("sds-*,-*-raw", "author_bot", fromIsBot, "author_uuid", fromUUID, true)
+			if fromIsBot != toIsBot {
+				s.es.UpdateByQuery("sds-*,-*-raw", "author_bot", toIsBot, "author_uuid", toUUID, true)
+			}
+		}()
+	}
+	for _, uid := range uids {
+		s.UUDA2SF(uid)
+		s.shDB.SetIsLFX(uid)
+	}
+	output.User = username
+	output.Scope = s.AryDA2SF(projects)
+	return
+}
+
+// PutMoveIdentity: API
+// ==================================================================================
+// Move Identity to New Profile | Unmerge Identities and Profiles
+// This function shifts the identity identified by 'fromID' to
+// the unique identity/profile 'toUUID'.
+// When 'toUUID' is the unique identity that is currently related
+// to 'fromID', the action does not have any effect.
+// In the case of 'fromID' and 'toUUID' have equal values and the
+// unique identity does not exist, a new unique identity will be
+// created and the identity will be moved to it (unmerged).
+// ==================================================================================
+// NOTE: fromID refers to `identities`.`id` while toUUID refers to `profiles`.`uuid`
+// ==================================================================================
+// /v1/affiliation/{projectSlugs}/move_identity/{fromID}/{toUUID}[?archive=false]:
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// {fromID} - required path parameter: identity id to move from, example "00029bc65f7fc5ba3dde20057770d3320ca51486"
+// {toUUID} - required path parameter: uidentity/profile uuid to move into, example "00058697877808f6b4a8524ac6dcf39b544a0c87"
+// archive - optional query parameter: if archive=false it will not attempt to restore data from archive
+func (s *service) PutMoveIdentity(ctx context.Context, params *affiliation.PutMoveIdentityParams) (uid *models.UniqueIdentityNestedDataOutput, err error) {
+	fromID := params.FromID
+	toUUID := params.ToUUID
+	archive := true
+	if params.Archive != nil {
+		archive = *params.Archive
+	}
+	log.Info(fmt.Sprintf("PutMoveIdentity: fromID:%s toUUID:%s archive:%v", fromID, toUUID, archive))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PutMoveIdentity(exit): fromID:%s toUUID:%s apiName:%s projects:%+v username:%s uid:%+v err:%v",
+				fromID,
+				toUUID,
+				apiName,
+				projects,
+				username,
+				s.ToLocalNestedUniqueIdentity(uid),
+				err,
+			),
+		)
+		if err == nil {
+			s.esLog.Log(fmt.Sprintf("User '%s' unmerged/moved identity id '%s' into profile uuid '%s' (API: '%s', project slug: '%s')", username, fromID, toUUID, apiName, projects), username, apiName)
 		}
-		_, ok = m["github_pull_request_prs_approved"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsApproved, 10))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	var tx *sql.Tx
+	tx, err = s.shDB.BeginTx()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	defer func() {
+		if tx != nil {
+			s.shDB.RollbackTx(tx)
 		}
-		_, ok = m["github_pull_request_prs_review_comments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsReviewComments, 10))
+	}()
+	err = s.shDB.MoveIdentity(fromID, toUUID, archive, tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	var ary []*models.UniqueIdentityNestedDataOutput
+	ary, _, err = s.shDB.QueryUniqueIdentitiesNested("uuid="+toUUID, 1, 1, false, projects, tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	err = s.shDB.CommitTx(tx)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	// Set tx to nil, so deferred rollback will not happen
+	tx = nil
+	if len(ary) == 0 {
+		err = errs.Wrap(fmt.Errorf("Profile with UUID '%s' not found", toUUID), apiName)
+		return
+	}
+	uid = ary[0]
+	s.shDB.SetIsLFX(uid)
+	s.UUDA2SF(uid)
+	return
+}
+
+// GetUnaffiliated: API params:
+// /v1/affiliation/{projectSlugs}/unaffiliated[?page=2][&[rows=50]
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10  (setting to zero still limits results to 65535)
+// page - optional query parameter: if set, it will return rows from a given page, default 1
+func (s *service) GetUnaffiliated(ctx context.Context, params *affiliation.GetUnaffiliatedParams) (getUnaffiliated *models.GetUnaffiliatedOutput, err error) {
+	rows := int64(10)
+	if params.Rows != nil {
+		rows = *params.Rows
+		if rows <= 0 {
+			rows = 0xffff
 		}
-		_, ok = m["github_pull_request_prs_comment_activity"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsCommentActivity, 10))
+	}
+	page := int64(1)
+	if params.Page != nil {
+		page = *params.Page
+		if page < 1 {
+			page = 1
 		}
-		_, ok = m["gerrit_approvals"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GerritApprovals, 10))
-		}
-		_, ok = m["gerrit_changesets"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GerritChangesets, 10))
+	}
+	getUnaffiliated = &models.GetUnaffiliatedOutput{}
+	log.Info(fmt.Sprintf("GetUnaffiliated: rows:%d page:%d", rows, page))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetUnaffiliated(exit): rows:%d page:%d apiName:%s projects:%+v username:%s getUnaffiliated:%d err:%v",
+				rows,
+				page,
+				apiName,
+				projects,
+				username,
+				len(getUnaffiliated.Unaffiliated),
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	// Do the actual API call
+	last := page * rows
+	more := (last + 5) * 3
+	prevN := int64(-1)
+	for {
+		getUnaffiliated, err = s.es.GetUnaffiliated(projects, more)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
 		}
-		_, ok = m["gerrit_merged_changesets"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GerritMergedChangesets, 10))
+		getUnaffiliated.Unaffiliated, err = s.shDB.CheckUnaffiliated(getUnaffiliated.Unaffiliated, projects, nil)
+		if err != nil {
+			getUnaffiliated.Unaffiliated = []*models.UnaffiliatedDataOutput{}
+			err = errs.Wrap(err, apiName)
+			return
 		}
-		_, ok = m["gerrit_comments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GerritComments, 10))
+		n := int64(len(getUnaffiliated.Unaffiliated))
+		if prevN == n {
+			break
 		}
-		_, ok = m["jira_comments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.JiraComments, 10))
+		if n < last {
+			prevN = n
+			more *= 2
+			continue
 		}
-		_, ok = m["jira_issues_assigned"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.JiraIssuesAssigned, 10))
+		break
+	}
+	n := int64(len(getUnaffiliated.Unaffiliated))
+	from := (page - 1) * rows
+	to := from + rows
+	if from > n {
+		from = n
+	}
+	if to > n {
+		to = n
+	}
+	if from == to {
+		getUnaffiliated.Unaffiliated = []*models.UnaffiliatedDataOutput{}
+		return
+	}
+	getUnaffiliated.Unaffiliated = getUnaffiliated.Unaffiliated[from:to]
+	getUnaffiliated.Page = page
+	getUnaffiliated.Rows = rows
+	getUnaffiliated.User = username
+	getUnaffiliated.Scope = s.AryDA2SF(projects)
+	return
+}
+
+// GetAffiliationGaps: API params:
+// /v1/affiliation/{projectSlugs}/affiliation_gaps[?page=2][&rows=50][&top=1000]
+// {projectSlugs} - required path parameter: projects to get affiliation gaps ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// rows - optional query parameter: rows per page, if 0 no paging is used and page parameter is ignored, default 10  (setting to zero still limits results to 65535)
+// page - optional query parameter: if set, it will return rows from a given page, default 1
+// top - optional query parameter: number of the most active contributors of each project to check, default 1000 (at most shared.AffGapsMaxTop)
+// Returns contributors active (in ES) during periods that no enrollment covers, together with those periods,
+// highest estimated number of uncovered contributions first, so the highest impact gaps can be fixed first
+func (s *service) GetAffiliationGaps(ctx context.Context, params *affiliation.GetAffiliationGapsParams) (out *models.AffiliationGapsOutput, err error) {
+	rows := int64(10)
+	if params.Rows != nil {
+		rows = *params.Rows
+		if rows <= 0 {
+			rows = 0xffff
 		}
-		_, ok = m["jira_issues_created"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.JiraIssuesCreated, 10))
+	}
+	page := int64(1)
+	if params.Page != nil {
+		page = *params.Page
+		if page < 1 {
+			page = 1
 		}
-		_, ok = m["jira_issues_closed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.JiraIssuesClosed, 10))
+	}
+	top := int64(1000)
+	if params.Top != nil {
+		top = *params.Top
+	}
+	out = &models.AffiliationGapsOutput{}
+	log.Info(fmt.Sprintf("GetAffiliationGaps: rows:%d page:%d top:%d", rows, page, top))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetAffiliationGaps(exit): rows:%d page:%d top:%d apiName:%s projects:%+v username:%s profiles:%d err:%v",
+				rows,
+				page,
+				top,
+				apiName,
+				projects,
+				username,
+				len(out.Profiles),
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	if top <= 0 || top > shared.AffGapsMaxTop {
+		err = errs.Wrap(errs.New(fmt.Errorf("top must be from 1 to %d, got %d", shared.AffGapsMaxTop, top), errs.ErrBadRequest), apiName)
+		return
+	}
+	// Do the actual API call
+	profiles := []*models.AffiliationGapsProfile{}
+	for _, project := range projects {
+		var activity []*models.ContributorActivity
+		activity, err = s.es.GetContributorsActivity(project, top)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
 		}
-		_, ok = m["jira_average_issue_open_days"]
-		if ok {
-			row = append(row, strconv.FormatFloat(contributor.JiraAverageIssueOpenDays, 'f', -1, 64))
+		var projectProfiles []*models.AffiliationGapsProfile
+		projectProfiles, err = s.shDB.GetAffiliationGaps(project, activity, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
 		}
-		_, ok = m["github_issue_average_time_open_days"]
-		if ok {
-			row = append(row, strconv.FormatFloat(contributor.GithubIssueAverageTimeOpenDays, 'f', -1, 64))
+		profiles = append(profiles, projectProfiles...)
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].UncoveredContributions > profiles[j].UncoveredContributions
+	})
+	for _, profile := range profiles {
+		profile.ProjectSlug = s.DA2SF(profile.ProjectSlug)
+	}
+	n := int64(len(profiles))
+	from := (page - 1) * rows
+	to := from + rows
+	if from > n {
+		from = n
+	}
+	if to > n {
+		to = n
+	}
+	out.Profiles = profiles[from:to]
+	out.NProfiles = n
+	out.Page = page
+	out.Rows = rows
+	out.User = username
+	out.Scope = s.AryDA2SF(projects)
+	return
+}
+
+func (s *service) FilterDataSources(dsIn, filter []string) (dsOut []string) {
+	// dsIn: ["git", "github/pull_request", "github/issue", "jira"]
+	// filter ["git", "github", "jira"] but can be ["github/issue"]
+	//defer func() {
+	//	fmt.Printf("FilterDataSources(%v, %v) -> %v\n", dsIn, filter, dsOut)
+	//}()
+	if len(filter) == 0 {
+		dsOut = dsIn
+		return
+	}
+	if filter[0] == "all" {
+		dsOut = dsIn
+		return
+	}
+	m := make(map[string]struct{})
+	for _, f := range filter {
+		m[f] = struct{}{}
+	}
+	dsOut = []string{}
+	for _, ds := range dsIn {
+		dsa := strings.Split(ds, "/")
+		_, ok1 := m[ds]
+		_, ok2 := m[dsa[0]]
+		if ok1 || ok2 {
+			dsOut = append(dsOut, ds)
 		}
-		_, ok = m["github_issue_issues_created"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesCreated, 10))
+	}
+	return
+}
+
+func (s *service) MakeDSInfo(actualArray []*models.DataSourceTypeFields, configuredArray, selectedArray []string) (result []*models.ConfiguredDataSourcesFields, warning string) {
+	actual := make(map[string]struct{})
+	for _, actualItem := range actualArray {
+		actual[actualItem.Name] = struct{}{}
+	}
+	selected := make(map[string]struct{})
+	for _, selectedItem := range selectedArray {
+		selected[selectedItem] = struct{}{}
+	}
+	missing := []string{}
+	fmt.Printf("actual=%+v\nconfigured=%+v\nselected=%+v\n", actual, configuredArray, selected)
+	for _, configured := range configuredArray {
+		item, ok := shared.DataSourcesFields[configured]
+		if !ok {
+			log.Info("Cannot find preconfigured data for data source " + configured)
+			continue
 		}
-		_, ok = m["github_issue_issues_assigned"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesAssigned, 10))
+		//item := &models.ConfiguredDataSourcesFields{}
+		_, sel := selected[configured]
+		item.FilterSelected = sel
+		if sel {
+			if configured == "bugzillarest" {
+				configured = "bugzilla"
+			}
+			_, present := actual[configured]
+			noData := !present
+			item.NoData = &noData
+			if noData {
+				missing = append(missing, item.Name)
+			}
+		} else {
+			item.NoData = nil
 		}
-		_, ok = m["github_issue_issues_closed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesClosed, 10))
+		result = append(result, item)
+	}
+	sort.Slice(
+		result,
+		func(i, j int) bool {
+			ordI, _ := shared.DataSourceTypesSortOrder[result[i].Key]
+			ordJ, _ := shared.DataSourceTypesSortOrder[result[j].Key]
+			if ordI == 0 {
+				ordI = 1000
+			}
+			if ordJ == 0 {
+				ordJ = 1000
+			}
+			return ordI < ordJ
+		},
+	)
+	if len(missing) > 0 {
+		warning = fmt.Sprintf("The following data sources are missing data: %s", strings.Join(missing, ", "))
+	}
+	return
+}
+
+func (s *service) TopContributorsParams(params *affiliation.GetTopContributorsParams, paramsCSV *affiliation.GetTopContributorsCSVParams) (limit, offset, from, to int64, search, sortField, sortOrder, key string, dataSources []string) {
+	csvParams := false
+	if params == nil {
+		params = &affiliation.GetTopContributorsParams{
+			From:       paramsCSV.From,
+			To:         paramsCSV.To,
+			Limit:      paramsCSV.Limit,
+			Offset:     paramsCSV.Offset,
+			Search:     paramsCSV.Search,
+			SortField:  paramsCSV.SortField,
+			SortOrder:  paramsCSV.SortOrder,
+			DataSource: paramsCSV.DataSource,
 		}
-		_, ok = m["github_issue_issues_comments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesComments, 10))
-		}
-		_, ok = m["bugzilla_issues_assigned"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesAssigned, 10))
-		}
-		_, ok = m["bugzilla_issues_created"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesCreated, 10))
-		}
-		_, ok = m["bugzilla_issues_closed"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesClosed, 10))
-		}
-		_, ok = m["bugzilla_average_issue_open_days"]
-		if ok {
-			row = append(row, strconv.FormatFloat(contributor.BugzillaAverageIssueOpenDays, 'f', -1, 64))
-		}
-		_, ok = m["confluence_comments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.ConfluenceComments, 10))
-		}
-		_, ok = m["confluence_blog_posts"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.ConfluenceBlogPosts, 10))
-		}
-		_, ok = m["confluence_pages_created"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.ConfluencePagesCreated, 10))
+		csvParams = true
+	}
+	if params.From != nil {
+		from = *params.From
+	} else {
+		from = (time.Now().Add(-24 * 90 * time.Hour)).UnixNano() / 1.0e6
+	}
+	if params.To != nil {
+		to = *params.To
+	} else {
+		to = time.Now().UnixNano() / 1.0e6
+	}
+	limit = 10
+	if csvParams {
+		limit = 10000
+	}
+	if params.Limit != nil {
+		limit = *params.Limit
+		if limit < 1 {
+			limit = 1
 		}
-		_, ok = m["confluence_pages_edited"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.ConfluencePagesEdited, 10))
+		if limit > 10000 {
+			limit = 10000
 		}
-		_, ok = m["confluence_attachments"]
-		if ok {
-			row = append(row, strconv.FormatInt(contributor.ConfluenceAttachments, 10))
+	}
+	if params.Offset != nil {
+		offset = *params.Offset
+		if offset < 0 {
+			offset = 0
 		}
-		_, ok = m["confluence_last_action_date"]
-		if ok {
-			row = append(row, contributor.ConfluenceLastActionDate)
+	}
+	if params.Search != nil {
+		search = *params.Search
+		if !strings.HasPrefix(search, "re:") && !strings.Contains(search, "=re:") {
+			search = strings.ToLower(strings.TrimSpace(search))
 		}
-		_, ok = m["confluence_days_since_last_documentation"]
-		if ok {
-			row = append(row, strconv.FormatFloat(contributor.ConfluenceDaysSinceLastDocumentation, 'f', -1, 64))
+	}
+	if params.SortField != nil {
+		sortField = strings.TrimSpace(*params.SortField)
+	}
+	if params.SortOrder != nil {
+		sortOrder = strings.ToLower(strings.TrimSpace(*params.SortOrder))
+	}
+	var dss string
+	if params.DataSource != nil {
+		dss = *params.DataSource
+	} else {
+		// FIXME
+		// prod
+		dss = "git"
+		// test
+		// dss = "all"
+	}
+	dsa := strings.Split(dss, ",")
+	for _, ds := range dsa {
+		dataSources = append(dataSources, strings.ToLower(strings.TrimSpace(ds)))
+	}
+	sort.Strings(dataSources)
+	dss = strings.Join(dataSources, ",")
+	//fmt.Printf("dss=%s\n", dss)
+	key = fmt.Sprintf("%d:%d:%d:%d:%s:%s:%s:%s", limit, offset, s.RoundMSTime(from), s.RoundMSTime(to), search, sortField, sortOrder, dss)
+	return
+}
+
+// GetTopContributors: API params:
+// /v1/affiliation/{projectSlugs}/top_contributors?from=1552790984700&to=1552790984700][&limit=50][&offset=2][&search=john][&sort_field=gerrit_merged_changesets][&sort_order=desc]
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// from - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data from, default 90 days ago
+// to - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data to, default now
+// limit - optional query parameter: page size, default 10
+// offset - optional query parameter: offset in pages, specifying limit=10 and offset=2, you will get 20-30)
+// search - optional query parameter: for example john, it can be specified in multiple forms (must be urlencoded)
+//     empty - so search filter will be applied
+//     john - will search using like '.*john.*' no case sensitive regexp pattern on author_org_name, author_name and author_uuids columns
+//     all=john - will fetch list of all string type columns (per index pattern) and then search for '.*john.*' (case insensitive) on all of them
+//     all=john,pamela,..,josh - will search for multiple values on all columns
+//     col1,col2,...,colN=val1,val2,...,valM - will search for any of val1 - valM on all col1 - colN columns using N x M or conditions
+// sort_field - optional query parameter: sort field for example gerrit_merged_changesets, can be fetched from "data_source_types" object returned per given project slug
+//     if not specified API sorts contributors by count of documents related to their activity descending - so its most probable to get actual top contributors across all data sources defined for the project
+//     if defined it must be one of fields returned in data source types fields object (from "data_source_types" object + special author_uuid) in that case API fetches contributors by this field first
+//     and then once it has list of their UUIDs (after searching, sorting and paging) - it uses that list of UUIDs to get the remaining fields and finally merge results into one object.
+// sort_order - optional query parameter: sort order allowed desc or asc, default is desc
+//     when sorting asc (which is almost senseless) API only returns objects that have at least 1 document matching this sort criteria
+//     so for example sort by git commits asc, will start from contributors having at least one commit, not 0).
+// role - optional query parameter: if set, contributors organizations are resolved using only enrollments with this role, for example Maintainer
+func (s *service) GetTopContributors(ctx context.Context, params *affiliation.GetTopContributorsParams) (topContributors *models.TopContributorsFlatOutput, err error) {
+	limit, offset, from, to, search, sortField, sortOrder, key, dataSourcesFilter := s.TopContributorsParams(params, nil)
+	if to < from {
+		err = fmt.Errorf("to parameter (%d) must be higher or equal from (%d)", to, from)
+		return
+	}
+	topContributors = &models.TopContributorsFlatOutput{}
+	log.Info(fmt.Sprintf("GetTopContributors: from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v", from, to, limit, offset, search, sortField, sortOrder, dataSourcesFilter))
+	// Check token and permission
+	public := false
+	apiName, projects, username, e := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetTopContributors(exit): from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v apiName:%s projects:%+v username:%s topContributors:%d public:%v err:%v",
+				from,
+				to,
+				limit,
+				offset,
+				search,
+				sortField,
+				sortOrder,
+				dataSourcesFilter,
+				apiName,
+				projects,
+				username,
+				len(topContributors.Contributors),
+				public,
+				err,
+			),
+		)
+	}()
+	if e != nil {
+		if len(projects) < 1 {
+			err = errs.Wrap(e, apiName)
+			return
 		}
-		err = writer.Write(row)
+		public = true
+	}
+	role, err := s.roleParam(params.Role)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	if role != "" {
+		key += ":" + role
+	}
+	if public {
+		key += ":pub"
+	}
+	var ok bool
+	topContributors, ok = s.getTopContributorsCache(key, projects)
+	if ok {
+		return
+	}
+	var (
+		configuredDataSourceTypes []string
+		dataSourceTypes           []string
+	)
+	configuredDataSourceTypes, err = s.apiDB.GetDataSourceTypes(projects)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	dataSourceTypes = s.FilterDataSources(configuredDataSourceTypes, dataSourcesFilter)
+	// fmt.Printf("key=%s, dataSourcesFilter=%v, configuredDataSourceTypes=%v, dataSourceTypes=%v\n", key, dataSourcesFilter, configuredDataSourceTypes, dataSourceTypes)
+	topContributors, err = s.es.GetTopContributors(projects, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	if len(topContributors.Contributors) > 0 {
+		err = s.shDB.EnrichContributors(topContributors.Contributors, projects, role, to, nil)
 		if err != nil {
-			err = errs.Wrap(fmt.Errorf("error writing #%d/%+v row: %+v", index+1, row, err), apiName)
+			err = errs.Wrap(err, apiName)
 			return
 		}
 	}
-	writer.Flush()
-	f = ioutil.NopCloser(bytes.NewReader(buffer.Bytes()))
+	if public {
+		for i := range topContributors.Contributors {
+			topContributors.Contributors[i].Email = ""
+		}
+	}
+	topContributors.From = from
+	topContributors.To = to
+	topContributors.Limit = limit
+	topContributors.Offset = offset
+	topContributors.Search = search
+	topContributors.SortField = sortField
+	topContributors.SortOrder = sortOrder
+	topContributors.ConfiguredDataSources, topContributors.Warning = s.MakeDSInfo(topContributors.DataSourceTypes, configuredDataSourceTypes, dataSourceTypes)
+	topContributors.User = username
+	topContributors.Scope = s.AryDA2SF(projects)
+	topContributors.Public = public
+	s.setTopContributorsCache(key, projects, topContributors)
+	return
+}
+
+// GetTopContributorsCSV: API params:
+// /v1/affiliation/{projectSlugs}/top_contributors_csv?from=1552790984700&to=1552790984700][&limit=50][&offset=2][&search=john][&sort_field=gerrit_merged_changesets][&sort_order=desc]
+// {projectSlugs} - required path parameter: projects to get organizations ("," separated list of project slugs URL encoded, each can be prefixed with "/projects/", each one is a SFDC slug)
+// from - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data from, default 90 days ago
+// to - optional query parameter - milliseconds since 1970, for example 1552790984700, filter data to, default now
+// limit - optional query parameter: page size, default 10
+// offset - optional query parameter: offset in pages, specifying limit=10 and offset=2, you will get 20-30)
+// search - optional query parameter: for example john, it can be specified in multiple forms (must be urlencoded)
+//     empty - so search filter will be applied
+//     john - will search using like '.*john.*' no case sensitive regexp pattern on author_org_name, author_name and author_uuids columns
+//     all=john - will fetch list of all string type columns (per index pattern) and then search for '.*john.*' (case insensitive) on all of them
+//     all=john,pamela,..,josh - will search for multiple values on all columns
+//     col1,col2,...,colN=val1,val2,...,valM - will search for any of val1 - valM on all col1 - colN columns using N x M or conditions
+// sort_field - optional query parameter: sort field for example gerrit_merged_changesets, can be fetched from "data_source_types" object returned per given project slug
+//     if not specified API sorts contributors by count of documents related to their activity descending - so its most probable to get actual top contributors across all data sources defined for the project
+//     if defined it must be one of fields returned in data source types fields object (from "data_source_types" object + special author_uuid) in that case API fetches contributors by this field first
+//     and then once it has list of their UUIDs (after searching, sorting and paging) - it uses that list of UUIDs to get the remaining fields and finally merge results into one object.
+// sort_order - optional query parameter: sort order allowed desc or asc, default is desc
+//     when sorting asc (which is almost senseless) API only returns objects that have at least 1 document matching this sort criteria
+//     so for example sort by git commits asc, will start from contributors having at least one commit, not 0).
+// role - optional query parameter: if set, contributors organizations are resolved using only enrollments with this role, for example Maintainer
+func (s *service) GetTopContributorsCSV(ctx context.Context, params *affiliation.GetTopContributorsCSVParams) (f io.ReadCloser, err error) {
+	limit, offset, from, to, search, sortField, sortOrder, key, dataSourcesFilter := s.TopContributorsParams(nil, params)
+	if to < from {
+		err = fmt.Errorf("to parameter (%d) must be higher or equal from (%d)", to, from)
+		return
+	}
+	topContributors := &models.TopContributorsFlatOutput{}
+	log.Info(fmt.Sprintf("GetTopContributorsCSV: from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v", from, to, limit, offset, search, sortField, sortOrder, dataSourcesFilter))
+	// Check token and permission
+	public := false
+	apiName, projects, username, e := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetTopContributorsCSV(exit): from:%d to:%d limit:%d offset:%d search:%s sortField:%s sortOrder:%s dataSourcesFilter:%v apiName:%s projects:%+v username:%s topContributors:%d public:%v err:%v",
+				from,
+				to,
+				limit,
+				offset,
+				search,
+				sortField,
+				sortOrder,
+				dataSourcesFilter,
+				apiName,
+				projects,
+				username,
+				len(topContributors.Contributors),
+				public,
+				err,
+			),
+		)
+	}()
+	if e != nil {
+		if len(projects) < 1 {
+			err = errs.Wrap(e, apiName)
+			return
+		}
+		public = true
+	}
+	role, err := s.roleParam(params.Role)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	if role != "" {
+		key += ":" + role
+	}
+	if public {
+		key += ":pub"
+	}
+	var ok bool
+	topContributors, ok = s.getTopContributorsCache(key, projects)
+	if !ok {
+		var (
+			configuredDataSourceTypes []string
+			dataSourceTypes           []string
+		)
+		configuredDataSourceTypes, err = s.apiDB.GetDataSourceTypes(projects)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		dataSourceTypes = s.FilterDataSources(configuredDataSourceTypes, dataSourcesFilter)
+		topContributors, err = s.es.GetTopContributors(projects, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		if len(topContributors.Contributors) > 0 {
+			err = s.shDB.EnrichContributors(topContributors.Contributors, projects, role, to, nil)
+			if err != nil {
+				err = errs.Wrap(err, apiName)
+				return
+			}
+		}
+		if public {
+			for i := range topContributors.Contributors {
+				topContributors.Contributors[i].Email = ""
+			}
+		}
+		topContributors.ConfiguredDataSources, topContributors.Warning = s.MakeDSInfo(topContributors.DataSourceTypes, configuredDataSourceTypes, dataSourceTypes)
+		s.setTopContributorsCache(key, projects, topContributors)
+	}
+	m := make(map[string]string)
+	for _, item := range topContributors.ConfiguredDataSources {
+		if item.NoData == nil || (item.NoData != nil && *item.NoData) {
+			continue
+		}
+		for _, dt := range item.DataTypes {
+			// m[dt.Key] = dt.Name
+			m[dt.Key] = item.Name + ": " + dt.Name
+		}
+	}
+	fmt.Printf("m: %+v\n", m)
+	hdr := []string{
+		// "UUID",
+		"Name",
+		"Organization",
+	}
+	if !public {
+		hdr = append(hdr, "Email")
+	}
+	// TOPCON
+	possibleHeader := []string{
+		"git_commits",
+		"git_lines_added",
+		"git_lines_changed",
+		"git_lines_removed",
+		"github_pull_request_prs_created",
+		"github_pull_request_prs_open",
+		"github_pull_request_prs_closed",
+		"github_pull_request_prs_merged",
+		"github_pull_request_prs_reviewed",
+		"github_pull_request_prs_approved",
+		"github_pull_request_prs_review_comments",
+		"github_pull_request_prs_comment_activity",
+		"gerrit_approvals",
+		"gerrit_changesets",
+		"gerrit_merged_changesets",
+		"gerrit_comments",
+		"jira_comments",
+		"jira_issues_assigned",
+		"jira_issues_created",
+		"jira_issues_closed",
+		"jira_average_issue_open_days",
+		"github_issue_average_time_open_days",
+		"github_issue_issues_created",
+		"github_issue_issues_assigned",
+		"github_issue_issues_closed",
+		"github_issue_issues_comments",
+		"bugzilla_issues_assigned",
+		"bugzilla_issues_created",
+		"bugzilla_issues_closed",
+		"bugzilla_average_issue_open_days",
+		"confluence_comments",
+		"confluence_blog_posts",
+		"confluence_pages_created",
+		"confluence_pages_edited",
+		"confluence_attachments",
+		"confluence_last_action_date",
+		"confluence_days_since_last_documentation",
+	}
+	for _, h := range possibleHeader {
+		name, ok := m[h]
+		if ok {
+			hdr = append(hdr, name)
+		}
+	}
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	err = writer.Write(hdr)
+	if err != nil {
+		err = errs.Wrap(fmt.Errorf("error writing CSV header row: %+v: %+v", hdr, err), apiName)
+		return
+	}
+	for index, contributor := range topContributors.Contributors {
+		row := []string{
+			// contributor.UUID,
+			contributor.Name,
+			contributor.Organization,
+		}
+		if !public {
+			row = append(row, contributor.Email)
+		}
+		// TOPCON
+		_, ok := m["git_commits"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GitCommits, 10))
+		}
+		_, ok = m["git_lines_added"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GitLinesAdded, 10))
+		}
+		_, ok = m["git_lines_changed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GitLinesChanged, 10))
+		}
+		_, ok = m["git_lines_removed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GitLinesRemoved, 10))
+		}
+		_, ok = m["github_pull_request_prs_created"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsCreated, 10))
+		}
+		_, ok = m["github_pull_request_prs_open"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsOpen, 10))
+		}
+		_, ok = m["github_pull_request_prs_closed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsClosed, 10))
+		}
+		_, ok = m["github_pull_request_prs_merged"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsMerged, 10))
+		}
+		_, ok = m["github_pull_request_prs_reviewed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsReviewed, 10))
+		}
+		_, ok = m["github_pull_request_prs_approved"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsApproved, 10))
+		}
+		_, ok = m["github_pull_request_prs_review_comments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsReviewComments, 10))
+		}
+		_, ok = m["github_pull_request_prs_comment_activity"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubPullRequestPrsCommentActivity, 10))
+		}
+		_, ok = m["gerrit_approvals"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GerritApprovals, 10))
+		}
+		_, ok = m["gerrit_changesets"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GerritChangesets, 10))
+		}
+		_, ok = m["gerrit_merged_changesets"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GerritMergedChangesets, 10))
+		}
+		_, ok = m["gerrit_comments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GerritComments, 10))
+		}
+		_, ok = m["jira_comments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.JiraComments, 10))
+		}
+		_, ok = m["jira_issues_assigned"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.JiraIssuesAssigned, 10))
+		}
+		_, ok = m["jira_issues_created"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.JiraIssuesCreated, 10))
+		}
+		_, ok = m["jira_issues_closed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.JiraIssuesClosed, 10))
+		}
+		_, ok = m["jira_average_issue_open_days"]
+		if ok {
+			row = append(row, strconv.FormatFloat(contributor.JiraAverageIssueOpenDays, 'f', -1, 64))
+		}
+		_, ok = m["github_issue_average_time_open_days"]
+		if ok {
+			row = append(row, strconv.FormatFloat(contributor.GithubIssueAverageTimeOpenDays, 'f', -1, 64))
+		}
+		_, ok = m["github_issue_issues_created"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesCreated, 10))
+		}
+		_, ok = m["github_issue_issues_assigned"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesAssigned, 10))
+		}
+		_, ok = m["github_issue_issues_closed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesClosed, 10))
+		}
+		_, ok = m["github_issue_issues_comments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.GithubIssueIssuesComments, 10))
+		}
+		_, ok = m["bugzilla_issues_assigned"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesAssigned, 10))
+		}
+		_, ok = m["bugzilla_issues_created"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesCreated, 10))
+		}
+		_, ok = m["bugzilla_issues_closed"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.BugzillaIssuesClosed, 10))
+		}
+		_, ok = m["bugzilla_average_issue_open_days"]
+		if ok {
+			row = append(row, strconv.FormatFloat(contributor.BugzillaAverageIssueOpenDays, 'f', -1, 64))
+		}
+		_, ok = m["confluence_comments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.ConfluenceComments, 10))
+		}
+		_, ok = m["confluence_blog_posts"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.ConfluenceBlogPosts, 10))
+		}
+		_, ok = m["confluence_pages_created"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.ConfluencePagesCreated, 10))
+		}
+		_, ok = m["confluence_pages_edited"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.ConfluencePagesEdited, 10))
+		}
+		_, ok = m["confluence_attachments"]
+		if ok {
+			row = append(row, strconv.FormatInt(contributor.ConfluenceAttachments, 10))
+		}
+		_, ok = m["confluence_last_action_date"]
+		if ok {
+			row = append(row, contributor.ConfluenceLastActionDate)
+		}
+		_, ok = m["confluence_days_since_last_documentation"]
+		if ok {
+			row = append(row, strconv.FormatFloat(contributor.ConfluenceDaysSinceLastDocumentation, 'f', -1, 64))
+		}
+		err = writer.Write(row)
+		if err != nil {
+			err = errs.Wrap(fmt.Errorf("error writing #%d/%+v row: %+v", index+1, row, err), apiName)
+			return
+		}
+	}
+	writer.Flush()
+	f = ioutil.NopCloser(bytes.NewReader(buffer.Bytes()))
+	return
+}
+
+// GetAllAffiliations: API params:
+// /v1/affiliation/all
+func (s *service) GetAllAffiliations(ctx context.Context, params *affiliation.GetAllAffiliationsParams) (all *models.AllArrayOutput, err error) {
+	all = &models.AllArrayOutput{}
+	log.Info("GetAllAffiliations")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("GetAllAffiliations(exit): apiName:%s username:%s all:%d err:%v", apiName, username, len(all.Profiles), err))
+	}()
+	if err != nil {
+		return
+	}
+	s.shDBGitdm.SetLFID(username)
+	all, err = s.shDBGitdm.GetAllAffiliations()
+	if err != nil {
+		return
+	}
+	// DA->SF
+	s.AllDA2SF(all)
+	return
+}
+
+// PostBulkUpdate: API params:
+// /v1/affiliation/bulk_update
+// update - required body YAML parameter - list of profiles to add and/or remove
+func (s *service) PostBulkUpdate(ctx context.Context, params *affiliation.PostBulkUpdateParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	nAdded := 0
+	nDeleted := 0
+	nUpdated := 0
+	log.Info(fmt.Sprintf("PostBulkUpdate: add:%d del:%d", len(params.Body.Add), len(params.Body.Del)))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PostBulkUpdate(exit): add:%d del:%d apiName:%s username:%s added:%d deleted:%d updated:%d status:%s err:%v",
+				len(params.Body.Add),
+				len(params.Body.Del),
+				apiName,
+				username,
+				nAdded,
+				nDeleted,
+				nUpdated,
+				status.Text,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	// SF->DA
+	s.AllSF2DA(params.Body.Add)
+	s.AllSF2DA(params.Body.Del)
+	s.shDBGitdm.SetLFID(username)
+	var skipped []string
+	nAdded, nDeleted, nUpdated, skipped, err = s.shDBGitdm.BulkUpdate(params.Body.Add, params.Body.Del)
+	if err != nil {
+		return
+	}
+	status.Text = fmt.Sprintf("Requested: Add: %d, Delete:%d, Done: Added: %d, Deleted: %d, Updated: %d", len(params.Body.Add), len(params.Body.Del), nAdded, nDeleted, nUpdated)
+	if len(skipped) > 0 {
+		status.Text += fmt.Sprintf(", Skipped locked profiles: %s", strings.Join(skipped, ","))
+	}
+	return
+}
+
+// GetGitdmExport: API params:
+// /v1/affiliation/gitdm_export
+// format - required query parameter: gitdm file format to generate:
+//   developers_affiliations - "login: email!domain, ..." lines followed by "<tab>Company until YYYY-MM-DD" lines
+//   github_users - github_users.json, one entry per login and email, "Company < YYYY-MM-DD, Company" affiliation string
+// only profiles having github identity are exported, only global contributor enrollments can be represented in gitdm formats
+func (s *service) GetGitdmExport(ctx context.Context, params *affiliation.GetGitdmExportParams) (f io.ReadCloser, err error) {
+	log.Info(fmt.Sprintf("GetGitdmExport: format:%s", params.Format))
+	nProfiles := 0
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("GetGitdmExport(exit): format:%s apiName:%s username:%s profiles:%d err:%v", params.Format, apiName, username, nProfiles, err))
+	}()
+	if err != nil {
+		return
+	}
+	s.shDBGitdm.SetLFID(username)
+	var all *models.AllArrayOutput
+	all, err = s.shDBGitdm.GetAllAffiliations()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	nProfiles = len(all.Profiles)
+	var data []byte
+	switch params.Format {
+	case shared.GitdmDevelopersAffiliations:
+		data = s.shDBGitdm.GitdmDevelopersAffiliations(all.Profiles)
+	case shared.GitdmGithubUsers:
+		data, err = s.shDBGitdm.GitdmGithubUsers(all.Profiles)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+	default:
+		err = errs.Wrap(errs.New(fmt.Errorf("unknown gitdm format '%s'", params.Format), errs.ErrBadRequest), apiName)
+		return
+	}
+	f = ioutil.NopCloser(bytes.NewReader(data))
+	return
+}
+
+// PostGitdmImport: API params:
+// /v1/affiliation/gitdm_import
+// format - required query parameter: gitdm file format of the body: developers_affiliations or github_users
+// dry - optional query parameter: boolean, if set only returns what would be added/updated, nothing is written
+// body - required: developers_affiliations*.txt contents (multiple files can be concatenated) or github_users.json contents
+//   profiles are found by github login or any of their emails, new profiles are added, existing ones get missing identities added
+//   and their global contributor enrollments replaced with gitdm ones, profiles matching multiple UUIDs or using unknown organizations are skipped
+//   locked profiles and profiles whose global contributor enrollments to be replaced are locked are skipped too (reported as conflicts)
+func (s *service) PostGitdmImport(ctx context.Context, params *affiliation.PostGitdmImportParams) (out *models.GitdmImportOutput, err error) {
+	dry := false
+	if params.Dry != nil {
+		dry = *params.Dry
+	}
+	out = &models.GitdmImportOutput{Dry: dry}
+	log.Info(fmt.Sprintf("PostGitdmImport: format:%s dry:%v", params.Format, dry))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PostGitdmImport(exit): format:%s dry:%v apiName:%s username:%s profiles:%d added:%d updated:%d unchanged:%d conflicts:%d err:%v",
+				params.Format,
+				dry,
+				apiName,
+				username,
+				out.NProfiles,
+				out.NAdded,
+				out.NUpdated,
+				out.NUnchanged,
+				out.NConflicts,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	if params.Body == nil {
+		err = errs.Wrap(errs.New(fmt.Errorf("missing gitdm body"), errs.ErrBadRequest), apiName)
+		return
+	}
+	defer func() { _ = params.Body.Close() }()
+	var profs []*models.AllOutput
+	switch params.Format {
+	case shared.GitdmDevelopersAffiliations:
+		profs, err = s.shDBGitdm.ParseGitdmDevelopersAffiliations(params.Body)
+	case shared.GitdmGithubUsers:
+		profs, err = s.shDBGitdm.ParseGitdmGithubUsers(params.Body)
+	default:
+		err = errs.New(fmt.Errorf("unknown gitdm format '%s'", params.Format), errs.ErrBadRequest)
+	}
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	// Do the actual API call
+	s.shDBGitdm.SetLFID(username)
+	out, err = s.shDBGitdm.ImportGitdm(profs, dry)
+	if err != nil {
+		out = &models.GitdmImportOutput{Dry: dry}
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	out.User = username
+	out.Format = params.Format
+	return
+}
+
+// PutSyncSfProfiles: API
+// ===========================================================================
+// maintain SF profiles identities with LFX dentity type and make them primary if email match
+// ===========================================================================
+// /v1/affiliation/sync_sf_profiles
+func (s *service) PutSyncSfProfiles(ctx context.Context, params *affiliation.PutSyncSfProfilesParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutSyncSfProfiles")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutSyncSfProfiles(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+	}()
+	if err != nil {
+		return
+	}
+	stat := ""
+	var sfUsers *models.UserDataArray
+	sfUsers, err = s.usersvc.GetListAll()
+	if err != nil {
+		err = errs.Wrap(err, apiName+":GetListAll")
+		return
+	}
+	allIdentities := map[[3]string]struct{}{}
+	for _, us := range sfUsers.Users {
+		if us.Email == "" || us.Name == "" || us.Username == "" {
+			continue
+		}
+		allIdentities[[3]string{us.Email, us.Name, us.Username}] = struct{}{}
+	}
+	stat, err = s.shDB.SyncSfProfiles(allIdentities)
+	if err != nil {
+		err = errs.Wrap(err, apiName+":SyncSfProfiles")
+		return
+	}
+	status.Text = stat
+	return
+}
+
+// PutMergeAll: API
+// ===========================================================================
+// Find any identities with the same email belonging to different profiles
+// Then merge such profiles
+// ===========================================================================
+// /v1/affiliation/merge_all:
+// debug - optional query parameter: integer debug level, 0 if not specified
+// dry - optional query parameter: boolean, dry-mode setting, in dry mode merge clusters that would be merged are returned
+//   (for each table: normalized email and name key, profiles with their identities and enrollments and the profile that would survive)
+func (s *service) PutMergeAll(ctx context.Context, params *affiliation.PutMergeAllParams) (status *models.MergeAllOutput, err error) {
+	status = &models.MergeAllOutput{}
+	debug := 0
+	dry := false
+	if params.Debug != nil {
+		debug = int(*params.Debug)
+	}
+	if params.Dry != nil {
+		dry = *params.Dry
+	}
+	log.Info(fmt.Sprintf("PutMergeAll: debug:%d dry:%v", debug, dry))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutMergeAll(exit): debug:%d dry:%v apiName:%s username:%s status:%s err:%v", debug, dry, apiName, username, status.Text, err))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	stat := ""
+	var reports []*models.MergeAllTableReport
+	stat, reports, err = s.shDB.MergeAll(debug, dry, username, s.esLog)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	status.Text = stat
+	status.Dry = dry
+	status.Tables = reports
+	return
+}
+
+// PutHideEmails: API
+// ===========================================================================
+// For all non-email columns on profiles and identities, if emails value is found
+// name@doman - remove '@domain' part and leave only 'name'
+// ===========================================================================
+// /v1/affiliation/hide_emails:
+func (s *service) PutHideEmails(ctx context.Context, params *affiliation.PutHideEmailsParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutHideEmails")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutHideEmails(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	stat := ""
+	stat, err = s.shDB.HideEmails()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	status.Text = stat
+	return
+}
+
+// PutMapOrgNames: API
+// ===========================================================================
+// common incorrect company names to correct ones using definitions from map_org_names.yaml
+// example: from: Orange Business Services --> to: Orange S.A.
+// 'from' is a regexp while 'to' is a final (correct) organization name.
+// ===========================================================================
+// /v1/affiliation/map_org_names:
+func (s *service) PutMapOrgNames(ctx context.Context, params *affiliation.PutMapOrgNamesParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutMapOrgNames")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutMapOrgNames(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	stat := ""
+	stat, err = s.shDB.MapOrgNames()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	status.Text = stat
+	return
+}
+
+// PutDetAffRange: API
+// ===========================================================================
+// For all profiles that have a single company affiliation (in a given project or global)
+// detect time range when ES has contributions and use that range to set start/end dates (if not already set)
+// ===========================================================================
+// /v1/affiliation/det_aff_range:
+func (s *service) PutDetAffRange(ctx context.Context, params *affiliation.PutDetAffRangeParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutDetAffRange")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutDetAffRange(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	projects := []string{}
+	projects, err = s.apiDB.GetAllProjects()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	var uuidsProjs map[string][]string
+	st1 := ""
+	uuidsProjs, st1, err = s.es.GetUUIDsProjects(projects)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	st2 := ""
+	st2, err = s.shDB.UpdateProjectSlugs(uuidsProjs)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	subjects := []*models.EnrollmentProjectRange{}
+	subjects, err = s.shDB.GetDetAffRangeSubjects()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	st3 := ""
+	updates := []*models.EnrollmentProjectRange{}
+	updates, st3, err = s.es.DetAffRange(subjects)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	st4 := ""
+	st4, err = s.shDB.UpdateAffRange(updates)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	status.Text = fmt.Sprintf(
+		"Projects status: %s, Project slugs update(%d): %s, Subjects: %d, Detected Ranges: %s, Update status: %s",
+		st1,
+		len(uuidsProjs),
+		st2,
+		len(subjects),
+		st3,
+		st4,
+	)
+	return
+}
+
+// GetListProjects: API
+// ===========================================================================
+// list projects given user has affiliations management access to
+// user is determind from auth token.
+// ===========================================================================
+// /v1/affiliation/list_projects:
+func (s *service) GetListProjects(ctx context.Context, params *affiliation.GetListProjectsParams) (projects *models.ListProjectsOutput, err error) {
+	projects = &models.ListProjectsOutput{}
+	log.Info("GetListProjects")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("GetListProjects(exit): apiName:%s username:%s projetcs:%+v err:%v", apiName, username, projects, err))
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	// Do the actual API call
+	projects, err = s.apiDB.GetListProjects(username)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	s.ListProjectsDA2SF(projects)
+	projects.User = username
 	return
 }
 
-// GetAllAffiliations: API params:
-// /v1/affiliation/all
-func (s *service) GetAllAffiliations(ctx context.Context, params *affiliation.GetAllAffiliationsParams) (all *models.AllArrayOutput, err error) {
-	all = &models.AllArrayOutput{}
-	log.Info("GetAllAffiliations")
-	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
+// GetListSlugMappings: API:
+// /v1/affiliation/list_slug_mappings
+func (s *service) GetListSlugMappings(ctx context.Context, params *affiliation.GetListSlugMappingsParams) (mappings *models.ListSlugMappings, err error) {
+	mappings = &models.ListSlugMappings{}
+	apiName := "GetListSlugMappings"
+	log.Info(apiName)
 	defer func() {
-		log.Info(fmt.Sprintf("GetAllAffiliations(exit): apiName:%s username:%s all:%d err:%v", apiName, username, len(all.Profiles), err))
+		log.Info(fmt.Sprintf("GetListSlugMappings(exit): apiName:%s mappings:%+v err:%v", apiName, mappings, err))
 	}()
+	mappings, err = s.shDB.GetListSlugMappings()
 	if err != nil {
+		err = errs.Wrap(err, apiName)
 		return
 	}
-	s.shDBGitdm.SetLFID(username)
-	all, err = s.shDBGitdm.GetAllAffiliations()
+	return
+}
+
+// GetSlugMapping: API params:
+// /v1/affiliation/get_slug_mapping
+// All params are optional, but at least one must be set
+// da_name - DA name
+// sf_name - SF name
+// sf_id - SF ID
+func (s *service) GetSlugMapping(ctx context.Context, params *affiliation.GetSlugMappingParams) (mapping *models.SlugMapping, err error) {
+	mapping = &models.SlugMapping{}
+	apiName := "GetSlugMapping"
+	log.Info(apiName)
+	defer func() {
+		log.Info(fmt.Sprintf("GetSlugMapping(exit): apiName:%s mapping:%+v err:%v", apiName, mapping, err))
+	}()
 	if err != nil {
 		return
 	}
-	// DA->SF
-	s.AllDA2SF(all)
+	var ary []*models.SlugMapping
+	cols := []string{}
+	vals := []interface{}{}
+	if params.DaName != nil && *params.DaName != "" {
+		cols = append(cols, "da_name")
+		vals = append(vals, *params.DaName)
+	}
+	if params.SfName != nil && *params.SfName != "" {
+		cols = append(cols, "sf_name")
+		vals = append(vals, *params.SfName)
+	}
+	if params.SfID != nil && *params.SfID != "" {
+		cols = append(cols, "sf_id")
+		vals = append(vals, *params.SfID)
+	}
+	if len(cols) == 0 {
+		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	mapping = ary[0]
 	return
 }
 
-// PostBulkUpdate: API params:
-// /v1/affiliation/bulk_update
-// update - required body YAML parameter - list of profiles to add and/or remove
-func (s *service) PostBulkUpdate(ctx context.Context, params *affiliation.PostBulkUpdateParams) (status *models.TextStatusOutput, err error) {
-	status = &models.TextStatusOutput{}
-	nAdded := 0
-	nDeleted := 0
-	nUpdated := 0
-	log.Info(fmt.Sprintf("PostBulkUpdate: add:%d del:%d", len(params.Body.Add), len(params.Body.Del)))
+// PostAddSlugMapping: API params:
+// /v1/affiliation/add_slug_mapping
+// All parameters are required:
+// da_name - DA name
+// sf_name - SF name
+// sf_id - SF ID
+func (s *service) PostAddSlugMapping(ctx context.Context, params *affiliation.PostAddSlugMappingParams) (mapping *models.SlugMapping, err error) {
+	mapping = &models.SlugMapping{}
+	daName := params.DaName
+	sfName := params.SfName
+	sfID := params.SfID
+	log.Info(fmt.Sprintf("PostAddSlugMapping: daName:%s sfName:%s sfID:%s", daName, sfName, sfID))
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"PostBulkUpdate(exit): add:%d del:%d apiName:%s username:%s added:%d deleted:%d updated:%d status:%s err:%v",
-				len(params.Body.Add),
-				len(params.Body.Del),
+				"PostAddSlugMapping(exit): aName:%s sfName:%s sfID:%s apiName:%s username:%s mapping:%+v err:%v",
+				daName,
+				sfName,
+				sfID,
 				apiName,
 				username,
-				nAdded,
-				nDeleted,
-				nUpdated,
-				status.Text,
+				mapping,
 				err,
 			),
 		)
@@ -3637,699 +5150,1184 @@ func (s *service) PostBulkUpdate(ctx context.Context, params *affiliation.PostBu
 	if err != nil {
 		return
 	}
-	// SF->DA
-	s.AllSF2DA(params.Body.Add)
-	s.AllSF2DA(params.Body.Del)
-	s.shDBGitdm.SetLFID(username)
-	nAdded, nDeleted, nUpdated, err = s.shDBGitdm.BulkUpdate(params.Body.Add, params.Body.Del)
+	if daName == "" || sfName == "" || sfID == "" {
+		err = fmt.Errorf("you need to provide all 'da_name', 'sf_name' and 'sf_id' values")
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	mapping, err = s.shDB.AddSlugMapping(
+		&models.SlugMapping{
+			DaName: daName,
+			SfName: sfName,
+			SfID:   sfID,
+		},
+		nil,
+	)
 	if err != nil {
+		err = errs.Wrap(err, apiName)
 		return
 	}
-	status.Text = fmt.Sprintf("Requested: Add: %d, Delete:%d, Done: Added: %d, Deleted: %d, Updated: %d", len(params.Body.Add), len(params.Body.Del), nAdded, nDeleted, nUpdated)
 	return
 }
 
-// PutSyncSfProfiles: API
-// ===========================================================================
-// maintain SF profiles identities with LFX dentity type and make them primary if email match
-// ===========================================================================
-// /v1/affiliation/sync_sf_profiles
-func (s *service) PutSyncSfProfiles(ctx context.Context, params *affiliation.PutSyncSfProfilesParams) (status *models.TextStatusOutput, err error) {
+// DeleteSlugMapping: API params:
+// /v1/affiliation/delete_slug_mapping
+// All params are optional, but at least one must be set
+// da_name - DA name
+// sf_name - SF name
+// sf_id - SF ID
+func (s *service) DeleteSlugMapping(ctx context.Context, params *affiliation.DeleteSlugMappingParams) (status *models.TextStatusOutput, err error) {
 	status = &models.TextStatusOutput{}
-	log.Info("PutSyncSfProfiles")
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
+	log.Info("DeleteSlugMapping")
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteSlugMapping(exit): apiName:%s username:%s status:%+v err:%v", apiName, username, status, err))
+	}()
+	if err != nil {
+		return
+	}
+	var ary []*models.SlugMapping
+	cols := []string{}
+	vals := []interface{}{}
+	if params.DaName != nil && *params.DaName != "" {
+		cols = append(cols, "da_name")
+		vals = append(vals, *params.DaName)
+	}
+	if params.SfName != nil && *params.SfName != "" {
+		cols = append(cols, "sf_name")
+		vals = append(vals, *params.SfName)
+	}
+	if params.SfID != nil && *params.SfID != "" {
+		cols = append(cols, "sf_id")
+		vals = append(vals, *params.SfID)
+	}
+	if len(cols) == 0 {
+		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	sfID := ary[0].SfID
+	status, err = s.shDB.DeleteSlugMapping(sfID)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	return
+}
+
+// PutEditSlugMapping: API params:
+// /v1/affiliation/edit_slug_mapping
+// All parameters are optional, but at least 1 need to be defined to find a mapping
+// da_name - DA name
+// sf_name - SF name
+// sf_id - SF ID
+// All new_* parameters are to set new values,you should set at least one of them otherwise no changes will be made
+// new_da_name - DA name
+// new_sf_name - SF name
+// new_sf_id - SF ID
+func (s *service) PutEditSlugMapping(ctx context.Context, params *affiliation.PutEditSlugMappingParams) (mapping *models.SlugMapping, err error) {
+	mapping = &models.SlugMapping{}
+	log.Info("PutEditSlugMapping")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PutEditSlugMapping(exit): apiName:%s username:%s mapping:%+v err:%v",
+				apiName,
+				username,
+				mapping,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	// defer func() { s.shDB.NotifySSAW() }()
+	var ary []*models.SlugMapping
+	cols := []string{}
+	vals := []interface{}{}
+	if params.DaName != nil && *params.DaName != "" {
+		cols = append(cols, "da_name")
+		vals = append(vals, *params.DaName)
+	}
+	if params.SfName != nil && *params.SfName != "" {
+		cols = append(cols, "sf_name")
+		vals = append(vals, *params.SfName)
+	}
+	if params.SfID != nil && *params.SfID != "" {
+		cols = append(cols, "sf_id")
+		vals = append(vals, *params.SfID)
+	}
+	if len(cols) == 0 {
+		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	mapping = ary[0]
+	key := &models.SlugMapping{
+		DaName: mapping.DaName,
+		SfName: mapping.SfName,
+		SfID:   mapping.SfID,
+	}
+	if params.NewDaName != nil && *params.NewDaName != "" {
+		mapping.DaName = *params.NewDaName
+	}
+	if params.NewSfName != nil && *params.NewSfName != "" {
+		mapping.SfName = *params.NewSfName
+	}
+	if params.NewSfID != nil && *params.NewSfID != "" {
+		mapping.SfID = *params.NewSfID
+	}
+	mapping, err = s.shDB.EditSlugMapping(key, mapping, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	return
+}
+
+func (s *service) precacheTopContributors() {
+	log.Warn("precacheTopContributors: started")
+	precacheDtStart := time.Now()
 	defer func() {
-		log.Info(fmt.Sprintf("PutSyncSfProfiles(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+		precacheMtx.Lock()
+		s.clearPrecacheRunning()
+		precacheMtx.Unlock()
+		precacheDtEnd := time.Now()
+		log.Warn(fmt.Sprintf("precacheTopContributors: finished in %v", precacheDtEnd.Sub(precacheDtStart)))
 	}()
+	projects, err := s.apiDB.GetAllProjects()
 	if err != nil {
+		log.Warn(fmt.Sprintf("precacheTopContributors: error: %+v", err))
 		return
 	}
-	stat := ""
-	var sfUsers *models.UserDataArray
-	sfUsers, err = s.usersvc.GetListAll()
-	if err != nil {
-		err = errs.Wrap(err, apiName+":GetListAll")
-		return
+	sort.Strings(projects)
+
+	// Invalidate current cache (delete expired keys)
+	topContributorsCacheMtx.Lock()
+	s.es.TopContributorsCacheDeleteExpired()
+	precacheStop = false
+	topContributorsCacheMtx.Unlock()
+
+	// Worker func - precache a single project
+	precacheProject := func(ch chan struct{}, project string) {
+		defer func() {
+			if ch != nil {
+				ch <- struct{}{}
+			}
+		}()
+		log.Info("precacheTopContributors: " + project)
+		// this month, this year, month to date, year to date, last 7 days, last 30 days, last 60 days, last 90 days, last 6 months, last 1 year, last 2 years, last 5 years
+		now := time.Now()
+		ranges := [][2]time.Time{
+			{s.MonthStart(now), now},     // current month
+			{s.YearStart(now), now},      // current year
+			{now.AddDate(0, 0, -7), now}, // last 7 days
+			// {now.AddDate(0, 0, -10), now}, // last 10 days
+			{now.AddDate(0, 0, -30), now}, // last 30 days
+			{now.AddDate(0, 0, -60), now}, // last 60 days
+			{now.AddDate(0, 0, -90), now}, // last 90 days
+			{now.AddDate(0, -1, 0), now},  // last month
+			// {now.AddDate(0, -3, 0), now},  // last quarter
+			{now.AddDate(0, -6, 0), now}, // last 6 months
+			{now.AddDate(-1, 0, 0), now}, // last year
+			{now.AddDate(-2, 0, 0), now}, // last 2 years
+			{now.AddDate(-5, 0, 0), now}, // last 5 years
+			// {now.AddDate(-10, 0, 0), now}, // last decade
+		}
+		for _, rng := range ranges {
+			topContributorsCacheMtx.Lock()
+			stop := precacheStop
+			topContributorsCacheMtx.Unlock()
+			if stop {
+				log.Warn("precacheTopContributors: stopping due to stop request")
+				return
+			}
+			from := s.RoundMSTime(rng[0].UnixNano() / 1e6)
+			to := s.RoundMSTime(rng[1].UnixNano() / 1e6)
+			uFrom := time.Unix(0, from*1e6)
+			uTo := time.Unix(0, to*1e6)
+			log.Info(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v)", project, from, to, uFrom, uTo))
+			limit := int64(100)
+			offset := int64(0)
+			search := ""
+			sortField := ""
+			sortOrder := ""
+			key := fmt.Sprintf("%d:%d:%d:%d:%s:%s:%s", limit, offset, from, to, search, sortField, sortOrder)
+			keyPub := key + ":pub"
+			projs := []string{project}
+			topContributors, ok := s.getTopContributorsCache(key, []string{project})
+			topContributorsPub, okPub := s.getTopContributorsCache(keyPub, projs)
+			if ok && okPub {
+				log.Info(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) (already cached)", project, from, to, uFrom, uTo))
+				// fmt.Printf("%s: %s: %v %v %d %d\n", project, key, ok, okPub, len(topContributors.Contributors), len(topContributorsPub.Contributors))
+				fmt.Printf("%s: %v - %v: already cached\n", project, uFrom, uTo)
+				continue
+			}
+			dtF := time.Now()
+			fmt.Printf("%s: %v - %v: calculating\n", project, uFrom, uTo)
+			if !ok {
+				var dataSourceTypes []string
+				dataSourceTypes, err = s.apiDB.GetDataSourceTypes(projs)
+				if err != nil {
+					log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) GetDataSourceTypes error: %+v", project, from, to, uFrom, uTo, err))
+					continue
+				}
+				topContributors, err = s.es.GetTopContributors(projs, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
+				if err != nil {
+					log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) GetTopContributors error: %+v", project, from, to, uFrom, uTo, err))
+					continue
+				}
+				if len(topContributors.Contributors) > 0 {
+					err = s.shDB.EnrichContributors(topContributors.Contributors, projs, "", to, nil)
+					if err != nil {
+						log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) EnrichContributors error: %+v", project, from, to, uFrom, uTo, err))
+						continue
+					}
+				}
+				topContributors.From = from
+				topContributors.To = to
+				topContributors.Limit = limit
+				topContributors.Offset = offset
+				topContributors.Search = search
+				topContributors.SortField = sortField
+				topContributors.SortOrder = sortOrder
+				topContributors.User = "precache"
+				topContributors.Scope = s.AryDA2SF(projs)
+				topContributors.Public = false
+				s.setTopContributorsCacheMult(key, projs, topContributors, int64(100), int64(10))
+			}
+			if !okPub {
+				pub := *topContributors
+				pub.Contributors = []*models.ContributorFlatStats{}
+				for _, contributor := range topContributors.Contributors {
+					contributorPub := *contributor
+					contributorPub.Email = ""
+					pub.Contributors = append(pub.Contributors, &contributorPub)
+				}
+				pub.Public = true
+				topContributorsPub = &pub
+				s.setTopContributorsCacheMult(keyPub, projs, topContributorsPub, int64(100), int64(10))
+			}
+			dtT := time.Now()
+			// fmt.Printf("%s: %s: %v %v %d %d\n", project, key, ok, okPub, len(topContributors.Contributors), len(topContributorsPub.Contributors))
+			fmt.Printf("%s: %v - %v: calculated in %v\n", project, uFrom, uTo, dtT.Sub(dtF))
+		}
 	}
-	allIdentities := map[[3]string]struct{}{}
-	for _, us := range sfUsers.Users {
-		if us.Email == "" || us.Name == "" || us.Username == "" {
-			continue
+
+	// Iterate for all projects
+	thrN := 6
+	ch := make(chan struct{})
+	nThreads := 0
+	for _, project := range projects {
+		go precacheProject(ch, project)
+		nThreads++
+		if nThreads == thrN {
+			<-ch
+			nThreads--
 		}
-		allIdentities[[3]string{us.Email, us.Name, us.Username}] = struct{}{}
 	}
-	stat, err = s.shDB.SyncSfProfiles(allIdentities)
-	if err != nil {
-		err = errs.Wrap(err, apiName+":SyncSfProfiles")
-		return
+	for nThreads > 0 {
+		<-ch
+		nThreads--
 	}
-	status.Text = stat
-	return
 }
 
-// PutMergeAll: API
+// PutCacheTopContributors: API
 // ===========================================================================
-// Find any identities with the same email belonging to different profiles
-// Then merge such profiles
+// Precalculate top_contributors API for all currently defined projects for a few predefined data ranges
 // ===========================================================================
-// /v1/affiliation/merge_all:
-// debug - optional query parameter: integer debug level, 0 if not specified
-// dry - optional query parameter: boolean, dry-mode setting
-func (s *service) PutMergeAll(ctx context.Context, params *affiliation.PutMergeAllParams) (status *models.TextStatusOutput, err error) {
+// /v1/affiliation/cache_top_contributors:
+func (s *service) PutCacheTopContributors(ctx context.Context, params *affiliation.PutCacheTopContributorsParams) (status *models.TextStatusOutput, err error) {
 	status = &models.TextStatusOutput{}
-	debug := 0
-	dry := false
-	if params.Debug != nil {
-		debug = int(*params.Debug)
-	}
-	if params.Dry != nil {
-		dry = *params.Dry
+	log.Info("PutCacheTopContributors")
+	if 1 == 1 {
+		status.Text = "PutCacheTopContributors: disabled forever"
+		return
 	}
-	log.Info(fmt.Sprintf("PutMergeAll: debug:%d dry:%v", debug, dry))
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("PutMergeAll(exit): debug:%d dry:%v apiName:%s username:%s status:%s err:%v", debug, dry, apiName, username, status.Text, err))
+		log.Info(fmt.Sprintf("PutCacheTopContributors(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	// Do the actual API call
-	stat := ""
-	stat, err = s.shDB.MergeAll(debug, dry, username, s.esLog)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
+	precacheMtx.Lock()
+	if s.isPrecacheRunning() {
+		precacheMtx.Unlock()
+		status.Text = "Another precaching in progress - only one precaching can run at a time, try again later"
+		err = errs.Wrap(fmt.Errorf(status.Text), apiName)
 		return
 	}
-	status.Text = stat
+	s.setPrecacheRunning()
+	precacheMtx.Unlock()
+	status.Text = "Spawned a new precaching process"
+	go s.precacheTopContributors()
 	return
 }
 
-// PutHideEmails: API
-// ===========================================================================
-// For all non-email columns on profiles and identities, if emails value is found
-// name@doman - remove '@domain' part and leave only 'name'
-// ===========================================================================
-// /v1/affiliation/hide_emails:
-func (s *service) PutHideEmails(ctx context.Context, params *affiliation.PutHideEmailsParams) (status *models.TextStatusOutput, err error) {
-	status = &models.TextStatusOutput{}
-	log.Info("PutHideEmails")
+// GetAffiliationSingle: API params:
+// /v1/affiliation/{projectSlug}/single/{uuid}/{dt}:
+// {projectSlug} - required path parameter: project_slug to search affiliation
+// {uuid} - required path parameter: UUID of the profile to get affiliation
+// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// explain - optional query parameter: if set, returns which step of the 5-step algorithm matched and which enrollments were used or rejected
+// role - optional query parameter: if set, only enrollments with this role are used, for example Maintainer (default is to use enrollments of all roles)
+// as_of - optional query parameter: if set, enrollments as they were at this point in time are used (reconstructed from current and archived enrollments), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+func (s *service) GetAffiliationSingle(ctx context.Context, params *affiliation.GetAffiliationSingleParams) (org *models.OrgOutput, err error) {
+	projectSlug := params.ProjectSlug
+	uuid := params.UUID
+	dt := time.Time(params.Dt)
+	org = &models.OrgOutput{}
+	log.Info(fmt.Sprintf("GetAffiliationSingle: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
 	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("PutHideEmails(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+		log.Info(
+			fmt.Sprintf(
+				"GetAffiliationSingle(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s org:%v err:%v",
+				projectSlug,
+				uuid,
+				dt,
+				apiName,
+				projects,
+				username,
+				org,
+				err,
+			),
+		)
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	// Do the actual API call
-	stat := ""
-	stat, err = s.shDB.HideEmails()
+	projectSlug = projects[0]
+	role, err := s.roleParam(params.Role)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	status.Text = stat
-	return
-}
-
-// PutMapOrgNames: API
-// ===========================================================================
-// common incorrect company names to correct ones using definitions from map_org_names.yaml
-// example: from: Orange Business Services --> to: Orange S.A.
-// 'from' is a regexp while 'to' is a final (correct) organization name.
-// ===========================================================================
-// /v1/affiliation/map_org_names:
-func (s *service) PutMapOrgNames(ctx context.Context, params *affiliation.PutMapOrgNamesParams) (status *models.TextStatusOutput, err error) {
-	status = &models.TextStatusOutput{}
-	log.Info("PutMapOrgNames")
-	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
-	defer func() {
-		log.Info(fmt.Sprintf("PutMapOrgNames(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
-	}()
-	if err != nil {
+	asOf := s.asOfParam(params.AsOf)
+	var orgs []string
+	if params.Explain == nil || !*params.Explain {
+		if asOf == nil {
+			org.Org, org.Inferred = s.shDB.GetAffiliationsSingle(projectSlug, uuid, role, dt, nil)
+			return
+		}
+		orgs, org.Inferred, err = s.shDB.GetAffiliationsAsOf(projectSlug, uuid, role, dt, *asOf, true, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		org.Org = "Unknown"
+		if len(orgs) > 0 {
+			org.Org = orgs[0]
+		}
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	// Do the actual API call
-	stat := ""
-	stat, err = s.shDB.MapOrgNames()
+	orgs, org.Explain, err = s.shDB.GetAffiliationsExplain(projectSlug, uuid, role, dt, asOf, true, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	status.Text = stat
+	org.Org = "Unknown"
+	if len(orgs) > 0 {
+		org.Org = orgs[0]
+	}
+	org.Inferred = org.Explain.Inferred
+	s.AffExplainDA2SF(org.Explain)
 	return
 }
 
-// PutDetAffRange: API
-// ===========================================================================
-// For all profiles that have a single company affiliation (in a given project or global)
-// detect time range when ES has contributions and use that range to set start/end dates (if not already set)
-// ===========================================================================
-// /v1/affiliation/det_aff_range:
-func (s *service) PutDetAffRange(ctx context.Context, params *affiliation.PutDetAffRangeParams) (status *models.TextStatusOutput, err error) {
-	status = &models.TextStatusOutput{}
-	log.Info("PutDetAffRange")
+// GetAffiliationMultiple: API params:
+// /v1/affiliation/{projectSlug}/multiple/{uuid}/{dt}:
+// {projectSlug} - required path parameter: project_slug to search affiliation
+// {uuid} - required path parameter: UUID of the profile to get affiliation
+// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// explain - optional query parameter: if set, returns which step of the 5-step algorithm matched and which enrollments were used or rejected
+// role - optional query parameter: if set, only enrollments with this role are used, for example Maintainer (default is to use enrollments of all roles)
+// as_of - optional query parameter: if set, enrollments as they were at this point in time are used (reconstructed from current and archived enrollments), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+func (s *service) GetAffiliationMultiple(ctx context.Context, params *affiliation.GetAffiliationMultipleParams) (orgs *models.OrgsOutput, err error) {
+	projectSlug := params.ProjectSlug
+	uuid := params.UUID
+	dt := time.Time(params.Dt)
+	orgs = &models.OrgsOutput{}
+	log.Info(fmt.Sprintf("GetAffiliationMultiple: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
 	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("PutDetAffRange(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+		log.Info(
+			fmt.Sprintf(
+				"GetAffiliationMultiple(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s orgs:%v err:%v",
+				projectSlug,
+				uuid,
+				dt,
+				apiName,
+				projects,
+				username,
+				orgs,
+				err,
+			),
+		)
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	projects := []string{}
-	projects, err = s.apiDB.GetAllProjects()
+	projectSlug = projects[0]
+	role, err := s.roleParam(params.Role)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	var uuidsProjs map[string][]string
-	st1 := ""
-	uuidsProjs, st1, err = s.es.GetUUIDsProjects(projects)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
+	asOf := s.asOfParam(params.AsOf)
+	if params.Explain == nil || !*params.Explain {
+		if asOf == nil {
+			orgs.Orgs, orgs.Inferred = s.shDB.GetAffiliationsMulti(projectSlug, uuid, role, dt, nil)
+			return
+		}
+		orgs.Orgs, orgs.Inferred, err = s.shDB.GetAffiliationsAsOf(projectSlug, uuid, role, dt, *asOf, false, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		if len(orgs.Orgs) == 0 {
+			orgs.Orgs = []string{"Unknown"}
+		}
 		return
 	}
-	st2 := ""
-	st2, err = s.shDB.UpdateProjectSlugs(uuidsProjs)
+	orgs.Orgs, orgs.Explain, err = s.shDB.GetAffiliationsExplain(projectSlug, uuid, role, dt, asOf, false, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	subjects := []*models.EnrollmentProjectRange{}
-	subjects, err = s.shDB.GetDetAffRangeSubjects()
+	if len(orgs.Orgs) == 0 {
+		orgs.Orgs = []string{"Unknown"}
+	}
+	orgs.Inferred = orgs.Explain.Inferred
+	s.AffExplainDA2SF(orgs.Explain)
+	return
+}
+
+// GetAffiliationBoth: API params:
+// /v1/affiliation/{projectSlug}/both/{uuid}/{dt}:
+// {projectSlug} - required path parameter: project_slug to search affiliation
+// {uuid} - required path parameter: UUID of the profile to get affiliation
+// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// explain - optional query parameter: if set, returns which step of the 5-step algorithm matched and which enrollments were used or rejected
+// role - optional query parameter: if set, only enrollments with this role are used, for example Maintainer (default is to use enrollments of all roles)
+// as_of - optional query parameter: if set, enrollments as they were at this point in time are used (reconstructed from current and archived enrollments), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+func (s *service) GetAffiliationBoth(ctx context.Context, params *affiliation.GetAffiliationBothParams) (out *models.OrgAndOrgsOutput, err error) {
+	projectSlug := params.ProjectSlug
+	uuid := params.UUID
+	dt := time.Time(params.Dt)
+	out = &models.OrgAndOrgsOutput{}
+	log.Info(fmt.Sprintf("GetAffiliationBoth: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
+	// Check token and permission
+	apiName, projects, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetAffiliationBoth(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s out:%v err:%v",
+				projectSlug,
+				uuid,
+				dt,
+				apiName,
+				projects,
+				username,
+				out,
+				err,
+			),
+		)
+	}()
 	if err != nil {
-		err = errs.Wrap(err, apiName)
 		return
 	}
-	st3 := ""
-	updates := []*models.EnrollmentProjectRange{}
-	updates, st3, err = s.es.DetAffRange(subjects)
+	projectSlug = projects[0]
+	role, err := s.roleParam(params.Role)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	st4 := ""
-	st4, err = s.shDB.UpdateAffRange(updates)
+	asOf := s.asOfParam(params.AsOf)
+	if params.Explain == nil || !*params.Explain {
+		if asOf == nil {
+			out.Org, _ = s.shDB.GetAffiliationsSingle(projectSlug, uuid, role, dt, nil)
+			out.Orgs, out.Inferred = s.shDB.GetAffiliationsMulti(projectSlug, uuid, role, dt, nil)
+			return
+		}
+		// Single mode always returns the first (most recent) organization found in multiple mode
+		out.Orgs, out.Inferred, err = s.shDB.GetAffiliationsAsOf(projectSlug, uuid, role, dt, *asOf, false, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		if len(out.Orgs) == 0 {
+			out.Orgs = []string{"Unknown"}
+		}
+		out.Org = out.Orgs[0]
+		return
+	}
+	// Single mode always returns the first (most recent) organization found in multiple mode
+	out.Orgs, out.Explain, err = s.shDB.GetAffiliationsExplain(projectSlug, uuid, role, dt, asOf, false, nil)
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	status.Text = fmt.Sprintf(
-		"Projects status: %s, Project slugs update(%d): %s, Subjects: %d, Detected Ranges: %s, Update status: %s",
-		st1,
-		len(uuidsProjs),
-		st2,
-		len(subjects),
-		st3,
-		st4,
-	)
+	if len(out.Orgs) == 0 {
+		out.Orgs = []string{"Unknown"}
+	}
+	out.Org = out.Orgs[0]
+	out.Inferred = out.Explain.Inferred
+	s.AffExplainDA2SF(out.Explain)
 	return
 }
 
-// GetListProjects: API
-// ===========================================================================
-// list projects given user has affiliations management access to
-// user is determind from auth token.
-// ===========================================================================
-// /v1/affiliation/list_projects:
-func (s *service) GetListProjects(ctx context.Context, params *affiliation.GetListProjectsParams) (projects *models.ListProjectsOutput, err error) {
-	projects = &models.ListProjectsOutput{}
-	log.Info("GetListProjects")
+// GetListAffiliationPolicies: API params:
+// /v1/affiliation/list_affiliation_policies
+// Returns all per-foundation affiliation policies (enabled steps of the 5-step algorithm in order they are tried)
+// Foundations without their own policy use "default" policy, if there is no "default" policy all 5 steps are used
+func (s *service) GetListAffiliationPolicies(ctx context.Context, params *affiliation.GetListAffiliationPoliciesParams) (policies *models.ListAffiliationPolicies, err error) {
+	policies = &models.ListAffiliationPolicies{}
+	log.Info("GetListAffiliationPolicies")
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("GetListProjects(exit): apiName:%s username:%s projetcs:%+v err:%v", apiName, username, projects, err))
+		log.Info(fmt.Sprintf("GetListAffiliationPolicies(exit): apiName:%s username:%s policies:%+v err:%v", apiName, username, policies, err))
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	// Do the actual API call
-	projects, err = s.apiDB.GetListProjects(username)
+	policies, err = s.shDB.GetListAffiliationPolicies()
 	if err != nil {
 		err = errs.Wrap(err, apiName)
 		return
 	}
-	s.ListProjectsDA2SF(projects)
-	projects.User = username
 	return
 }
 
-// GetListSlugMappings: API:
-// /v1/affiliation/list_slug_mappings
-func (s *service) GetListSlugMappings(ctx context.Context, params *affiliation.GetListSlugMappingsParams) (mappings *models.ListSlugMappings, err error) {
-	mappings = &models.ListSlugMappings{}
-	apiName := "GetListSlugMappings"
-	log.Info(apiName)
+// GetAffiliationCacheStats: API params:
+// /v1/affiliation/affiliation_cache_stats
+// Returns in-process affiliation resolution cache size and hit/miss/invalidation/eviction counters (since API start)
+// Cache is used by single, multi and both APIs, it is invalidated whenever enrollments of a given profile are modified
+func (s *service) GetAffiliationCacheStats(ctx context.Context, params *affiliation.GetAffiliationCacheStatsParams) (stats *models.AffiliationCacheStats, err error) {
+	stats = &models.AffiliationCacheStats{}
+	log.Info("GetAffiliationCacheStats")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("GetListSlugMappings(exit): apiName:%s mappings:%+v err:%v", apiName, mappings, err))
+		log.Info(fmt.Sprintf("GetAffiliationCacheStats(exit): apiName:%s username:%s stats:%+v err:%v", apiName, username, stats, err))
 	}()
-	mappings, err = s.shDB.GetListSlugMappings()
 	if err != nil {
-		err = errs.Wrap(err, apiName)
 		return
 	}
+	stats = s.shDB.GetAffiliationCacheStats()
 	return
 }
 
-// GetSlugMapping: API params:
-// /v1/affiliation/get_slug_mapping
-// All params are optional, but at least one must be set
-// da_name - DA name
-// sf_name - SF name
-// sf_id - SF ID
-func (s *service) GetSlugMapping(ctx context.Context, params *affiliation.GetSlugMappingParams) (mapping *models.SlugMapping, err error) {
-	mapping = &models.SlugMapping{}
-	apiName := "GetSlugMapping"
-	log.Info(apiName)
+// GetEnrollmentConflicts: API params:
+// /v1/affiliation/enrollment_conflicts
+// kind - optional query parameter: if set, only conflicts of this kind are returned: invalid_range, out_of_range, duplicate, overlap, mergeable
+// Returns the most recent report generated by the enrollment conflicts detection job (see PutDetectEnrollmentConflicts)
+func (s *service) GetEnrollmentConflicts(ctx context.Context, params *affiliation.GetEnrollmentConflictsParams) (out *models.EnrollmentConflictsOutput, err error) {
+	out = &models.EnrollmentConflictsOutput{}
+	kind := ""
+	if params.Kind != nil {
+		kind = strings.TrimSpace(*params.Kind)
+	}
+	log.Info(fmt.Sprintf("GetEnrollmentConflicts: kind:%s", kind))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("GetSlugMapping(exit): apiName:%s mapping:%+v err:%v", apiName, mapping, err))
+		log.Info(fmt.Sprintf("GetEnrollmentConflicts(exit): kind:%s apiName:%s username:%s profiles:%d conflicts:%d err:%v", kind, apiName, username, out.NProfiles, out.NConflicts, err))
 	}()
 	if err != nil {
 		return
 	}
-	var ary []*models.SlugMapping
-	cols := []string{}
-	vals := []interface{}{}
-	if params.DaName != nil && *params.DaName != "" {
-		cols = append(cols, "da_name")
-		vals = append(vals, *params.DaName)
-	}
-	if params.SfName != nil && *params.SfName != "" {
-		cols = append(cols, "sf_name")
-		vals = append(vals, *params.SfName)
+	if kind != "" {
+		found := false
+		for _, k := range shared.EnrollmentConflictKinds {
+			if k == kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err = errs.Wrap(errs.New(fmt.Errorf("unknown conflict kind '%s', allowed: %s", kind, strings.Join(shared.EnrollmentConflictKinds, ", ")), errs.ErrBadRequest), apiName)
+			return
+		}
 	}
-	if params.SfID != nil && *params.SfID != "" {
-		cols = append(cols, "sf_id")
-		vals = append(vals, *params.SfID)
+	conflictsMtx.Lock()
+	report := *conflictsReport
+	conflictsMtx.Unlock()
+	out = &report
+	out.Kind = kind
+	if kind == "" {
+		return
+	}
+	out.Profiles = []*models.EnrollmentConflictsProfile{}
+	out.NConflicts = 0
+	for _, profile := range report.Profiles {
+		conflicts := []*models.EnrollmentConflict{}
+		for _, conflict := range profile.Conflicts {
+			if conflict.Kind == kind {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+		if len(conflicts) > 0 {
+			out.Profiles = append(out.Profiles, &models.EnrollmentConflictsProfile{UUID: profile.UUID, Conflicts: conflicts})
+			out.NConflicts += int64(len(conflicts))
+		}
 	}
-	if len(cols) == 0 {
-		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
-		err = errs.Wrap(err, apiName)
+	out.NProfiles = int64(len(out.Profiles))
+	return
+}
+
+// PutDetectEnrollmentConflicts: API
+// ===========================================================================
+// Spawn a background job that scans all enrollments and generates a new enrollment conflicts report
+// ===========================================================================
+// /v1/affiliation/enrollment_conflicts:
+// Only one detection job can run at a time, the report can be fetched using GetEnrollmentConflicts
+// It also runs periodically if DA_AFF_API_CONFLICTS_INTERVAL is set (see StartEnrollmentConflictsDetector)
+func (s *service) PutDetectEnrollmentConflicts(ctx context.Context, params *affiliation.PutDetectEnrollmentConflictsParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutDetectEnrollmentConflicts")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PutDetectEnrollmentConflicts(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+	}()
+	if err != nil {
 		return
 	}
-	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
+	if !s.startDetectEnrollmentConflicts() {
+		status.Text = "Another enrollment conflicts detection in progress - only one can run at a time, try again later"
+		err = errs.Wrap(fmt.Errorf(status.Text), apiName)
 		return
 	}
-	mapping = ary[0]
+	status.Text = "Spawned a new enrollment conflicts detection process"
 	return
 }
 
-// PostAddSlugMapping: API params:
-// /v1/affiliation/add_slug_mapping
-// All parameters are required:
-// da_name - DA name
-// sf_name - SF name
-// sf_id - SF ID
-func (s *service) PostAddSlugMapping(ctx context.Context, params *affiliation.PostAddSlugMappingParams) (mapping *models.SlugMapping, err error) {
-	mapping = &models.SlugMapping{}
-	daName := params.DaName
-	sfName := params.SfName
-	sfID := params.SfID
-	log.Info(fmt.Sprintf("PostAddSlugMapping: daName:%s sfName:%s sfID:%s", daName, sfName, sfID))
-	// Check token and permission
-	apiName, _, username, err := s.checkTokenAndPermission(params)
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"PostAddSlugMapping(exit): aName:%s sfName:%s sfID:%s apiName:%s username:%s mapping:%+v err:%v",
-				daName,
-				sfName,
-				sfID,
-				apiName,
-				username,
-				mapping,
-				err,
-			),
-		)
+// StartEnrollmentConflictsDetector - runs enrollment conflicts detection in background every shared.GEnrollmentConflictsInterval (if set)
+func (s *service) StartEnrollmentConflictsDetector() {
+	interval := shared.GEnrollmentConflictsInterval
+	if interval <= 0 {
+		return
+	}
+	log.Info(fmt.Sprintf("StartEnrollmentConflictsDetector: interval:%v", interval))
+	go func() {
+		for {
+			if !s.startDetectEnrollmentConflicts() {
+				log.Info("StartEnrollmentConflictsDetector: detection already in progress, skipping")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// startDetectEnrollmentConflicts - spawns enrollment conflicts detection unless it is already running
+func (s *service) startDetectEnrollmentConflicts() bool {
+	conflictsMtx.Lock()
+	if conflictsReport.Running {
+		conflictsMtx.Unlock()
+		return false
+	}
+	startedAt := strfmt.DateTime(time.Now())
+	conflictsReport.Running = true
+	conflictsReport.StartedAt = &startedAt
+	conflictsMtx.Unlock()
+	go s.detectEnrollmentConflicts()
+	return true
+}
+
+// detectEnrollmentConflicts - scans all enrollments and replaces the most recent enrollment conflicts report
+func (s *service) detectEnrollmentConflicts() {
+	profiles, err := s.shDB.DetectEnrollmentConflicts(nil)
+	conflictsMtx.Lock()
+	defer conflictsMtx.Unlock()
+	conflictsReport.Running = false
+	if err != nil {
+		log.Warn(fmt.Sprintf("detectEnrollmentConflicts: %+v", err))
+		conflictsReport.Error = err.Error()
+		return
+	}
+	generatedAt := strfmt.DateTime(time.Now())
+	nConflicts := 0
+	for _, profile := range profiles {
+		nConflicts += len(profile.Conflicts)
+	}
+	conflictsReport = &models.EnrollmentConflictsOutput{
+		StartedAt:   conflictsReport.StartedAt,
+		GeneratedAt: &generatedAt,
+		NProfiles:   int64(len(profiles)),
+		NConflicts:  int64(nConflicts),
+		Profiles:    profiles,
+	}
+	log.Info(fmt.Sprintf("detectEnrollmentConflicts: profiles:%d conflicts:%d", len(profiles), nConflicts))
+}
+
+// GetMergeSuggestions: API params:
+// /v1/affiliation/merge_suggestions
+// min_score - optional query parameter: only suggestions with at least this score (0-1) are returned, 0.5 if not set
+// page - optional query parameter: page to return, 1 if not set
+// rows - optional query parameter: suggestions per page, 10 if not set, 0 means maximum page size 65535
+// Returns the most recent report generated by the merge suggestions detection job (see PutDetectMergeSuggestions)
+// Suggested profiles can be merged using PutMergeUniqueIdentities
+func (s *service) GetMergeSuggestions(ctx context.Context, params *affiliation.GetMergeSuggestionsParams) (out *models.MergeSuggestionsOutput, err error) {
+	out = &models.MergeSuggestionsOutput{}
+	minScore := shared.MergeSuggestionMinScore
+	if params.MinScore != nil {
+		minScore = *params.MinScore
+	}
+	rows := int64(10)
+	if params.Rows != nil {
+		rows = *params.Rows
+		if rows <= 0 {
+			rows = 0xffff
+		}
+	}
+	page := int64(1)
+	if params.Page != nil {
+		page = *params.Page
+		if page < 1 {
+			page = 1
+		}
+	}
+	log.Info(fmt.Sprintf("GetMergeSuggestions: minScore:%f rows:%d page:%d", minScore, rows, page))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("GetMergeSuggestions(exit): minScore:%f rows:%d page:%d apiName:%s username:%s suggestions:%d err:%v", minScore, rows, page, apiName, username, out.NSuggestions, err))
 	}()
 	if err != nil {
 		return
 	}
-	if daName == "" || sfName == "" || sfID == "" {
-		err = fmt.Errorf("you need to provide all 'da_name', 'sf_name' and 'sf_id' values")
-		err = errs.Wrap(err, apiName)
+	if minScore < 0.0 || minScore > 1.0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("min_score must be from 0-1 range, got %f", minScore), errs.ErrBadRequest), apiName)
 		return
 	}
-	mapping, err = s.shDB.AddSlugMapping(
-		&models.SlugMapping{
-			DaName: daName,
-			SfName: sfName,
-			SfID:   sfID,
-		},
-		nil,
-	)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
+	suggestionsMtx.Lock()
+	report := *suggestionsReport
+	suggestionsMtx.Unlock()
+	// Suggestions are sorted by score descending
+	suggestions := report.Suggestions
+	n := sort.Search(len(suggestions), func(i int) bool { return suggestions[i].Score < minScore })
+	out = &report
+	out.MinScore = minScore
+	out.NSuggestions = int64(n)
+	out.NPages = (out.NSuggestions + rows - 1) / rows
+	out.Page = page
+	out.Rows = rows
+	from := (page - 1) * rows
+	if from > out.NSuggestions {
+		from = out.NSuggestions
+	}
+	to := from + rows
+	if to > out.NSuggestions {
+		to = out.NSuggestions
 	}
+	out.Suggestions = suggestions[from:to]
 	return
 }
 
-// DeleteSlugMapping: API params:
-// /v1/affiliation/delete_slug_mapping
-// All params are optional, but at least one must be set
-// da_name - DA name
-// sf_name - SF name
-// sf_id - SF ID
-func (s *service) DeleteSlugMapping(ctx context.Context, params *affiliation.DeleteSlugMappingParams) (status *models.TextStatusOutput, err error) {
+// PutDetectMergeSuggestions: API
+// ===========================================================================
+// Spawn a background job that finds profiles likely to be the same person and generates a new merge suggestions report
+// ===========================================================================
+// /v1/affiliation/merge_suggestions:
+// Only one detection job can run at a time, the report can be fetched using GetMergeSuggestions
+func (s *service) PutDetectMergeSuggestions(ctx context.Context, params *affiliation.PutDetectMergeSuggestionsParams) (status *models.TextStatusOutput, err error) {
 	status = &models.TextStatusOutput{}
+	log.Info("PutDetectMergeSuggestions")
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
-	log.Info("DeleteSlugMapping")
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteSlugMapping(exit): apiName:%s username:%s status:%+v err:%v", apiName, username, status, err))
+		log.Info(fmt.Sprintf("PutDetectMergeSuggestions(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
 	}()
 	if err != nil {
 		return
 	}
-	var ary []*models.SlugMapping
-	cols := []string{}
-	vals := []interface{}{}
-	if params.DaName != nil && *params.DaName != "" {
-		cols = append(cols, "da_name")
-		vals = append(vals, *params.DaName)
-	}
-	if params.SfName != nil && *params.SfName != "" {
-		cols = append(cols, "sf_name")
-		vals = append(vals, *params.SfName)
-	}
-	if params.SfID != nil && *params.SfID != "" {
-		cols = append(cols, "sf_id")
-		vals = append(vals, *params.SfID)
-	}
-	if len(cols) == 0 {
-		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
-		err = errs.Wrap(err, apiName)
+	suggestionsMtx.Lock()
+	if suggestionsReport.Running {
+		suggestionsMtx.Unlock()
+		status.Text = "Another merge suggestions detection in progress - only one can run at a time, try again later"
+		err = errs.Wrap(fmt.Errorf(status.Text), apiName)
 		return
 	}
-	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
+	startedAt := strfmt.DateTime(time.Now())
+	suggestionsReport.Running = true
+	suggestionsReport.StartedAt = &startedAt
+	suggestionsMtx.Unlock()
+	go s.detectMergeSuggestions()
+	status.Text = "Spawned a new merge suggestions detection process"
+	return
+}
+
+// detectMergeSuggestions - scores candidate profile pairs and replaces the most recent merge suggestions report
+func (s *service) detectMergeSuggestions() {
+	suggestions, err := s.shDB.DetectMergeSuggestions(nil)
+	suggestionsMtx.Lock()
+	defer suggestionsMtx.Unlock()
+	suggestionsReport.Running = false
 	if err != nil {
-		err = errs.Wrap(err, apiName)
+		log.Warn(fmt.Sprintf("detectMergeSuggestions: %+v", err))
+		suggestionsReport.Error = err.Error()
 		return
 	}
-	sfID := ary[0].SfID
-	status, err = s.shDB.DeleteSlugMapping(sfID)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
+	generatedAt := strfmt.DateTime(time.Now())
+	suggestionsReport = &models.MergeSuggestionsOutput{
+		StartedAt:    suggestionsReport.StartedAt,
+		GeneratedAt:  &generatedAt,
+		NSuggestions: int64(len(suggestions)),
+		Suggestions:  suggestions,
 	}
-	return
+	log.Info(fmt.Sprintf("detectMergeSuggestions: suggestions:%d", len(suggestions)))
 }
 
-// PutEditSlugMapping: API params:
-// /v1/affiliation/edit_slug_mapping
-// All parameters are optional, but at least 1 need to be defined to find a mapping
-// da_name - DA name
-// sf_name - SF name
-// sf_id - SF ID
-// All new_* parameters are to set new values,you should set at least one of them otherwise no changes will be made
-// new_da_name - DA name
-// new_sf_name - SF name
-// new_sf_id - SF ID
-func (s *service) PutEditSlugMapping(ctx context.Context, params *affiliation.PutEditSlugMappingParams) (mapping *models.SlugMapping, err error) {
-	mapping = &models.SlugMapping{}
-	log.Info("PutEditSlugMapping")
+// GetBotSuggestions: API params:
+// /v1/affiliation/bot_suggestions
+// min_score - optional query parameter: only suggestions with at least this score (0-1) are returned, 0.5 if not set
+// page - optional query parameter: page to return, 1 if not set
+// rows - optional query parameter: suggestions per page, 10 if not set, 0 means maximum page size 65535
+// Returns the most recent report generated by the bot suggestions detection job (see PutDetectBotSuggestions)
+// Suggestions can be accepted or rejected using PostReviewBotSuggestions
+func (s *service) GetBotSuggestions(ctx context.Context, params *affiliation.GetBotSuggestionsParams) (out *models.BotSuggestionsOutput, err error) {
+	out = &models.BotSuggestionsOutput{}
+	minScore := shared.BotSuggestionMinScore
+	if params.MinScore != nil {
+		minScore = *params.MinScore
+	}
+	rows := int64(10)
+	if params.Rows != nil {
+		rows = *params.Rows
+		if rows <= 0 {
+			rows = 0xffff
+		}
+	}
+	page := int64(1)
+	if params.Page != nil {
+		page = *params.Page
+		if page < 1 {
+			page = 1
+		}
+	}
+	log.Info(fmt.Sprintf("GetBotSuggestions: minScore:%f rows:%d page:%d", minScore, rows, page))
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"PutEditSlugMapping(exit): apiName:%s username:%s mapping:%+v err:%v",
-				apiName,
-				username,
-				mapping,
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("GetBotSuggestions(exit): minScore:%f rows:%d page:%d apiName:%s username:%s suggestions:%d err:%v", minScore, rows, page, apiName, username, out.NSuggestions, err))
 	}()
 	if err != nil {
 		return
 	}
-	// defer func() { s.shDB.NotifySSAW() }()
-	var ary []*models.SlugMapping
-	cols := []string{}
-	vals := []interface{}{}
-	if params.DaName != nil && *params.DaName != "" {
-		cols = append(cols, "da_name")
-		vals = append(vals, *params.DaName)
-	}
-	if params.SfName != nil && *params.SfName != "" {
-		cols = append(cols, "sf_name")
-		vals = append(vals, *params.SfName)
-	}
-	if params.SfID != nil && *params.SfID != "" {
-		cols = append(cols, "sf_id")
-		vals = append(vals, *params.SfID)
-	}
-	if len(cols) == 0 {
-		err = fmt.Errorf("you need to provide at least one of 'da_name', 'sf_name', 'sf_id'")
-		err = errs.Wrap(err, apiName)
-		return
-	}
-	ary, err = s.shDB.FindSlugMappings(cols, vals, true, nil)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
+	if minScore < 0.0 || minScore > 1.0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("min_score must be from 0-1 range, got %f", minScore), errs.ErrBadRequest), apiName)
 		return
 	}
-	mapping = ary[0]
-	key := &models.SlugMapping{
-		DaName: mapping.DaName,
-		SfName: mapping.SfName,
-		SfID:   mapping.SfID,
-	}
-	if params.NewDaName != nil && *params.NewDaName != "" {
-		mapping.DaName = *params.NewDaName
-	}
-	if params.NewSfName != nil && *params.NewSfName != "" {
-		mapping.SfName = *params.NewSfName
-	}
-	if params.NewSfID != nil && *params.NewSfID != "" {
-		mapping.SfID = *params.NewSfID
+	botsMtx.Lock()
+	report := *botsReport
+	botsMtx.Unlock()
+	// Suggestions are sorted by score descending
+	suggestions := report.Suggestions
+	n := sort.Search(len(suggestions), func(i int) bool { return suggestions[i].Score < minScore })
+	out = &report
+	out.MinScore = minScore
+	out.NSuggestions = int64(n)
+	out.NPages = (out.NSuggestions + rows - 1) / rows
+	out.Page = page
+	out.Rows = rows
+	from := (page - 1) * rows
+	if from > out.NSuggestions {
+		from = out.NSuggestions
 	}
-	mapping, err = s.shDB.EditSlugMapping(key, mapping, nil)
-	if err != nil {
-		err = errs.Wrap(err, apiName)
-		return
+	to := from + rows
+	if to > out.NSuggestions {
+		to = out.NSuggestions
 	}
+	out.Suggestions = suggestions[from:to]
 	return
 }
 
-func (s *service) precacheTopContributors() {
-	log.Warn("precacheTopContributors: started")
-	precacheDtStart := time.Now()
+// PutDetectBotSuggestions: API
+// ===========================================================================
+// Spawn a background job that finds profiles that are likely bots and generates a new bot suggestions report
+// ===========================================================================
+// /v1/affiliation/bot_suggestions:
+// Only one detection job can run at a time, the report can be fetched using GetBotSuggestions
+func (s *service) PutDetectBotSuggestions(ctx context.Context, params *affiliation.PutDetectBotSuggestionsParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	log.Info("PutDetectBotSuggestions")
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		precacheMtx.Lock()
-		s.clearPrecacheRunning()
-		precacheMtx.Unlock()
-		precacheDtEnd := time.Now()
-		log.Warn(fmt.Sprintf("precacheTopContributors: finished in %v", precacheDtEnd.Sub(precacheDtStart)))
+		log.Info(fmt.Sprintf("PutDetectBotSuggestions(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
 	}()
-	projects, err := s.apiDB.GetAllProjects()
 	if err != nil {
-		log.Warn(fmt.Sprintf("precacheTopContributors: error: %+v", err))
 		return
 	}
-	sort.Strings(projects)
-
-	// Invalidate current cache (delete expired keys)
-	topContributorsCacheMtx.Lock()
-	s.es.TopContributorsCacheDeleteExpired()
-	precacheStop = false
-	topContributorsCacheMtx.Unlock()
-
-	// Worker func - precache a single project
-	precacheProject := func(ch chan struct{}, project string) {
-		defer func() {
-			if ch != nil {
-				ch <- struct{}{}
-			}
-		}()
-		log.Info("precacheTopContributors: " + project)
-		// this month, this year, month to date, year to date, last 7 days, last 30 days, last 60 days, last 90 days, last 6 months, last 1 year, last 2 years, last 5 years
-		now := time.Now()
-		ranges := [][2]time.Time{
-			{s.MonthStart(now), now},     // current month
-			{s.YearStart(now), now},      // current year
-			{now.AddDate(0, 0, -7), now}, // last 7 days
-			// {now.AddDate(0, 0, -10), now}, // last 10 days
-			{now.AddDate(0, 0, -30), now}, // last 30 days
-			{now.AddDate(0, 0, -60), now}, // last 60 days
-			{now.AddDate(0, 0, -90), now}, // last 90 days
-			{now.AddDate(0, -1, 0), now},  // last month
-			// {now.AddDate(0, -3, 0), now},  // last quarter
-			{now.AddDate(0, -6, 0), now}, // last 6 months
-			{now.AddDate(-1, 0, 0), now}, // last year
-			{now.AddDate(-2, 0, 0), now}, // last 2 years
-			{now.AddDate(-5, 0, 0), now}, // last 5 years
-			// {now.AddDate(-10, 0, 0), now}, // last decade
-		}
-		for _, rng := range ranges {
-			topContributorsCacheMtx.Lock()
-			stop := precacheStop
-			topContributorsCacheMtx.Unlock()
-			if stop {
-				log.Warn("precacheTopContributors: stopping due to stop request")
-				return
-			}
-			from := s.RoundMSTime(rng[0].UnixNano() / 1e6)
-			to := s.RoundMSTime(rng[1].UnixNano() / 1e6)
-			uFrom := time.Unix(0, from*1e6)
-			uTo := time.Unix(0, to*1e6)
-			log.Info(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v)", project, from, to, uFrom, uTo))
-			limit := int64(100)
-			offset := int64(0)
-			search := ""
-			sortField := ""
-			sortOrder := ""
-			key := fmt.Sprintf("%d:%d:%d:%d:%s:%s:%s", limit, offset, from, to, search, sortField, sortOrder)
-			keyPub := key + ":pub"
-			projs := []string{project}
-			topContributors, ok := s.getTopContributorsCache(key, []string{project})
-			topContributorsPub, okPub := s.getTopContributorsCache(keyPub, projs)
-			if ok && okPub {
-				log.Info(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) (already cached)", project, from, to, uFrom, uTo))
-				// fmt.Printf("%s: %s: %v %v %d %d\n", project, key, ok, okPub, len(topContributors.Contributors), len(topContributorsPub.Contributors))
-				fmt.Printf("%s: %v - %v: already cached\n", project, uFrom, uTo)
-				continue
-			}
-			dtF := time.Now()
-			fmt.Printf("%s: %v - %v: calculating\n", project, uFrom, uTo)
-			if !ok {
-				var dataSourceTypes []string
-				dataSourceTypes, err = s.apiDB.GetDataSourceTypes(projs)
-				if err != nil {
-					log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) GetDataSourceTypes error: %+v", project, from, to, uFrom, uTo, err))
-					continue
-				}
-				topContributors, err = s.es.GetTopContributors(projs, dataSourceTypes, from, to, limit, offset, search, sortField, sortOrder)
-				if err != nil {
-					log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) GetTopContributors error: %+v", project, from, to, uFrom, uTo, err))
-					continue
-				}
-				if len(topContributors.Contributors) > 0 {
-					err = s.shDB.EnrichContributors(topContributors.Contributors, projs, to, nil)
-					if err != nil {
-						log.Warn(fmt.Sprintf("precacheTopContributors: %s: %v - %v (%v - %v) EnrichContributors error: %+v", project, from, to, uFrom, uTo, err))
-						continue
-					}
-				}
-				topContributors.From = from
-				topContributors.To = to
-				topContributors.Limit = limit
-				topContributors.Offset = offset
-				topContributors.Search = search
-				topContributors.SortField = sortField
-				topContributors.SortOrder = sortOrder
-				topContributors.User = "precache"
-				topContributors.Scope = s.AryDA2SF(projs)
-				topContributors.Public = false
-				s.setTopContributorsCacheMult(key, projs, topContributors, int64(100), int64(10))
+	botsMtx.Lock()
+	if botsReport.Running {
+		botsMtx.Unlock()
+		status.Text = "Another bot suggestions detection in progress - only one can run at a time, try again later"
+		err = errs.Wrap(fmt.Errorf(status.Text), apiName)
+		return
+	}
+	startedAt := strfmt.DateTime(time.Now())
+	botsReport.Running = true
+	botsReport.StartedAt = &startedAt
+	botsMtx.Unlock()
+	go s.detectBotSuggestions()
+	status.Text = "Spawned a new bot suggestions detection process"
+	return
+}
+
+// detectBotSuggestions - scores candidate profiles (the most active ES authors and profiles with bot-like names and emails)
+// and replaces the most recent bot suggestions report
+func (s *service) detectBotSuggestions() {
+	var suggestions []*models.BotSuggestion
+	err := func() (err error) {
+		activity, err := s.es.GetAuthorsActivity(nil, shared.BotSuggestionTopAuthors)
+		if err != nil {
+			return
+		}
+		uuids := []string{}
+		for uuid := range activity {
+			uuids = append(uuids, uuid)
+		}
+		candidates, err := s.shDB.BotCandidates(uuids, nil)
+		if err != nil {
+			return
+		}
+		missing := []string{}
+		for _, candidate := range candidates {
+			if _, ok := activity[candidate.UUID]; !ok {
+				missing = append(missing, candidate.UUID)
 			}
-			if !okPub {
-				pub := *topContributors
-				pub.Contributors = []*models.ContributorFlatStats{}
-				for _, contributor := range topContributors.Contributors {
-					contributorPub := *contributor
-					contributorPub.Email = ""
-					pub.Contributors = append(pub.Contributors, &contributorPub)
-				}
-				pub.Public = true
-				topContributorsPub = &pub
-				s.setTopContributorsCacheMult(keyPub, projs, topContributorsPub, int64(100), int64(10))
+		}
+		packSize := 500
+		for from := 0; from < len(missing); from += packSize {
+			to := from + packSize
+			if to > len(missing) {
+				to = len(missing)
+			}
+			var pack map[string]*models.BotActivity
+			pack, err = s.es.GetAuthorsActivity(missing[from:to], 0)
+			if err != nil {
+				return
+			}
+			for uuid, act := range pack {
+				activity[uuid] = act
 			}
-			dtT := time.Now()
-			// fmt.Printf("%s: %s: %v %v %d %d\n", project, key, ok, okPub, len(topContributors.Contributors), len(topContributorsPub.Contributors))
-			fmt.Printf("%s: %v - %v: calculated in %v\n", project, uFrom, uTo, dtT.Sub(dtF))
 		}
+		suggestions = []*models.BotSuggestion{}
+		for _, candidate := range candidates {
+			candidate.Activity = activity[candidate.UUID]
+			s.shDB.BotScore(candidate)
+			if len(candidate.Reasons) == 0 {
+				continue
+			}
+			suggestions = append(suggestions, candidate)
+		}
+		sort.SliceStable(suggestions, func(i, j int) bool {
+			return suggestions[i].Score > suggestions[j].Score
+		})
+		return
+	}()
+	botsMtx.Lock()
+	defer botsMtx.Unlock()
+	botsReport.Running = false
+	if err != nil {
+		log.Warn(fmt.Sprintf("detectBotSuggestions: %+v", err))
+		botsReport.Error = err.Error()
+		return
 	}
+	generatedAt := strfmt.DateTime(time.Now())
+	botsReport = &models.BotSuggestionsOutput{
+		StartedAt:    botsReport.StartedAt,
+		GeneratedAt:  &generatedAt,
+		NSuggestions: int64(len(suggestions)),
+		Suggestions:  suggestions,
+	}
+	log.Info(fmt.Sprintf("detectBotSuggestions: suggestions:%d", len(suggestions)))
+}
 
-	// Iterate for all projects
-	thrN := 6
-	ch := make(chan struct{})
-	nThreads := 0
-	for _, project := range projects {
-		go precacheProject(ch, project)
-		nThreads++
-		if nThreads == thrN {
-			<-ch
-			nThreads--
+// PostReviewBotSuggestions: API params:
+// /v1/affiliation/bot_suggestions/review
+// body: {"accept": ["uuid1", ...], "reject": ["uuid2", ...]}
+// Accepted profiles are flagged as bots (is_bot = 1) and ES author_bot is updated for them, rejected ones are marked as
+// reviewed non-bots, reviewed profiles are removed from the current report and are not suggested by the next detection jobs
+func (s *service) PostReviewBotSuggestions(ctx context.Context, params *affiliation.PostReviewBotSuggestionsParams) (result *models.BotSuggestionsReviewOutput, err error) {
+	result = &models.BotSuggestionsReviewOutput{}
+	review := params.Body
+	log.Info(fmt.Sprintf("PostReviewBotSuggestions: review:%+v", review))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(fmt.Sprintf("PostReviewBotSuggestions(exit): review:%+v apiName:%s username:%s result:%+v err:%v", review, apiName, username, result, err))
+		if err == nil {
+			s.esLog.Log(
+				fmt.Sprintf(
+					"User '%s' reviewed bot suggestions: accepted %+v, rejected %+v (API: '%s')",
+					username,
+					result.Accepted,
+					result.Rejected,
+					apiName,
+				),
+				username,
+				apiName,
+			)
 		}
+	}()
+	if err != nil {
+		return
 	}
-	for nThreads > 0 {
-		<-ch
-		nThreads--
+	if review == nil {
+		err = errs.Wrap(errs.New(fmt.Errorf("review body is required"), errs.ErrBadRequest), apiName)
+		return
+	}
+	result, err = s.shDB.ReviewBotSuggestions(review, nil)
+	if err != nil {
+		result = &models.BotSuggestionsReviewOutput{}
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	accepted := result.Accepted
+	if len(accepted) > 0 {
+		go func() {
+			for _, uuid := range accepted {
+				s.es.UpdateByQuery("sds-*,-*-raw", "author_bot", true, "author_uuid", uuid, true)
+			}
+		}()
+	}
+	reviewed := make(map[string]struct{})
+	for _, uuid := range append(append([]string{}, result.Accepted...), result.Rejected...) {
+		reviewed[uuid] = struct{}{}
 	}
+	botsMtx.Lock()
+	suggestions := []*models.BotSuggestion{}
+	for _, suggestion := range botsReport.Suggestions {
+		if _, ok := reviewed[suggestion.UUID]; !ok {
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	botsReport.Suggestions = suggestions
+	botsReport.NSuggestions = int64(len(suggestions))
+	botsMtx.Unlock()
+	return
 }
 
-// PutCacheTopContributors: API
-// ===========================================================================
-// Precalculate top_contributors API for all currently defined projects for a few predefined data ranges
-// ===========================================================================
-// /v1/affiliation/cache_top_contributors:
-func (s *service) PutCacheTopContributors(ctx context.Context, params *affiliation.PutCacheTopContributorsParams) (status *models.TextStatusOutput, err error) {
-	status = &models.TextStatusOutput{}
-	log.Info("PutCacheTopContributors")
-	if 1 == 1 {
-		status.Text = "PutCacheTopContributors: disabled forever"
+// PutAffiliationPolicy: API params:
+// /v1/affiliation/affiliation_policy
+// foundation - required query parameter: foundation, for example "cncf" (applies to cncf/* and cncf-f project slugs) or "default"
+// steps - required query parameter: comma separated steps of the 5-step algorithm to use, in order they should be tried,
+//   numbers or names, for example "1,2,3" or "project,foundation-f,global" - use project specific or global enrollments only, never borrow
+//   steps: 1 - project, 2 - foundation-f, 3 - global, 4 - foundation, 5 - any
+func (s *service) PutAffiliationPolicy(ctx context.Context, params *affiliation.PutAffiliationPolicyParams) (policy *models.AffiliationPolicy, err error) {
+	policy = &models.AffiliationPolicy{}
+	foundation := params.Foundation
+	steps := params.Steps
+	log.Info(fmt.Sprintf("PutAffiliationPolicy: foundation:%s steps:%s", foundation, steps))
+	// Check token and permission
+	apiName, _, username, err := s.checkTokenAndPermission(params)
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"PutAffiliationPolicy(exit): foundation:%s steps:%s apiName:%s username:%s policy:%+v err:%v",
+				foundation,
+				steps,
+				apiName,
+				username,
+				policy,
+				err,
+			),
+		)
+	}()
+	if err != nil {
+		return
+	}
+	policy, err = s.shDB.SetAffiliationPolicy(foundation, steps, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
 		return
 	}
+	return
+}
+
+// DeleteAffiliationPolicy: API params:
+// /v1/affiliation/affiliation_policy
+// foundation - required query parameter: foundation to delete policy for, it will use "default" policy after that
+func (s *service) DeleteAffiliationPolicy(ctx context.Context, params *affiliation.DeleteAffiliationPolicyParams) (status *models.TextStatusOutput, err error) {
+	status = &models.TextStatusOutput{}
+	foundation := params.Foundation
+	log.Info(fmt.Sprintf("DeleteAffiliationPolicy: foundation:%s", foundation))
 	// Check token and permission
 	apiName, _, username, err := s.checkTokenAndPermission(params)
 	defer func() {
-		log.Info(fmt.Sprintf("PutCacheTopContributors(exit): apiName:%s username:%s status:%s err:%v", apiName, username, status.Text, err))
+		log.Info(fmt.Sprintf("DeleteAffiliationPolicy(exit): foundation:%s apiName:%s username:%s status:%+v err:%v", foundation, apiName, username, status, err))
 	}()
 	if err != nil {
 		return
 	}
-	precacheMtx.Lock()
-	if s.isPrecacheRunning() {
-		precacheMtx.Unlock()
-		status.Text = "Another precaching in progress - only one precaching can run at a time, try again later"
-		err = errs.Wrap(fmt.Errorf(status.Text), apiName)
+	err = s.shDB.DropAffiliationPolicy(foundation, true, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
 		return
 	}
-	s.setPrecacheRunning()
-	precacheMtx.Unlock()
-	status.Text = "Spawned a new precaching process"
-	go s.precacheTopContributors()
+	status.Text = "Deleted affiliation policy for foundation '" + foundation + "'"
 	return
 }
 
-// GetAffiliationSingle: API params:
-// /v1/affiliation/{projectSlug}/single/{uuid}/{dt}:
+// GetAffiliationTimeline: API params:
+// /v1/affiliation/{projectSlug}/timeline/{uuid}:
 // {projectSlug} - required path parameter: project_slug to search affiliation
-// {uuid} - required path parameter: UUID of the profile to get affiliation
-// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
-func (s *service) GetAffiliationSingle(ctx context.Context, params *affiliation.GetAffiliationSingleParams) (org *models.OrgOutput, err error) {
+// {uuid} - required path parameter: UUID of the profile to get affiliation timeline
+// start - optional query parameter: timeline start date (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// end - optional query parameter: timeline end date (default is 2100-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// role - optional query parameter: if set, only enrollments with this role are used, for example Maintainer (default is to use enrollments of all roles)
+// as_of - optional query parameter: if set, enrollments as they were at this point in time are used (reconstructed from current and archived enrollments), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// Returns [start, end) date ranges with single org and multiple orgs resolved by the 5-step algorithm
+// and the step each range came from, for example: [2015-01-01, 2018-03-01) Intel, [2018-03-01, 2100-01-01) Red Hat
+func (s *service) GetAffiliationTimeline(ctx context.Context, params *affiliation.GetAffiliationTimelineParams) (out *models.AffiliationTimelineOutput, err error) {
 	projectSlug := params.ProjectSlug
 	uuid := params.UUID
-	dt := time.Time(params.Dt)
-	org = &models.OrgOutput{}
-	log.Info(fmt.Sprintf("GetAffiliationSingle: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
+	from := shared.MinPeriodDate
+	if params.Start != nil {
+		from = time.Time(*params.Start)
+	}
+	to := shared.MaxPeriodDate
+	if params.End != nil {
+		to = time.Time(*params.End)
+	}
+	out = &models.AffiliationTimelineOutput{}
+	log.Info(fmt.Sprintf("GetAffiliationTimeline: projectSlug:%s uuid:%s from:%v to:%v", projectSlug, uuid, from, to))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetAffiliationSingle(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s org:%v err:%v",
+				"GetAffiliationTimeline(exit): projectSlug:%s uuid:%s from:%v to:%v apiName:%s projects:%+v username:%s out:%d err:%v",
 				projectSlug,
 				uuid,
-				dt,
+				from,
+				to,
 				apiName,
 				projects,
 				username,
-				org,
+				len(out.Segments),
 				err,
 			),
 		)
@@ -4337,35 +6335,50 @@ func (s *service) GetAffiliationSingle(ctx context.Context, params *affiliation.
 	if err != nil {
 		return
 	}
-	projectSlug = projects[0]
-	org.Org = s.shDB.GetAffiliationsSingle(projectSlug, uuid, dt, nil)
+	role, err := s.roleParam(params.Role)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	out.UUID = uuid
+	out.ProjectSlug = params.ProjectSlug
+	out.Role = role
+	out.Start = strfmt.DateTime(from)
+	out.End = strfmt.DateTime(to)
+	out.Segments, err = s.shDB.GetAffiliationTimeline(projects[0], uuid, role, from, to, s.asOfParam(params.AsOf), nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
 	return
 }
 
-// GetAffiliationMultiple: API params:
-// /v1/affiliation/{projectSlug}/multiple/{uuid}/{dt}:
-// {projectSlug} - required path parameter: project_slug to search affiliation
-// {uuid} - required path parameter: UUID of the profile to get affiliation
-// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
-func (s *service) GetAffiliationMultiple(ctx context.Context, params *affiliation.GetAffiliationMultipleParams) (orgs *models.OrgsOutput, err error) {
-	projectSlug := params.ProjectSlug
-	uuid := params.UUID
-	dt := time.Time(params.Dt)
-	orgs = &models.OrgsOutput{}
-	log.Info(fmt.Sprintf("GetAffiliationMultiple: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
+// GetEmployerChanges: API params:
+// /v1/affiliation/{projectSlugs}/employer_changes:
+// {projectSlugs} - required path parameter: projects to check (at least one), for example "lfn/onap,cncf/prometheus" (must be urlencoded)
+// t1 - required query parameter: first date, must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// t2 - required query parameter: second date, must be in format 2015-05-05T15:15[:05Z] (urlencoded)
+// role - optional query parameter: if set, only enrollments with this role are used, for example Maintainer (default is to use enrollments of all roles)
+// Returns every profile whose affiliation resolved by the 5-step algorithm (the same as in GetAffiliationBoth) differs between t1 and t2
+// for any of given projects, with old and new organization(s) and enrollment IDs that were used to resolve them
+// Only profiles contributing to given projects are checked (and only for projects they contribute to)
+func (s *service) GetEmployerChanges(ctx context.Context, params *affiliation.GetEmployerChangesParams) (out *models.EmployerChangesOutput, err error) {
+	t1 := time.Time(params.T1)
+	t2 := time.Time(params.T2)
+	out = &models.EmployerChangesOutput{}
+	log.Info(fmt.Sprintf("GetEmployerChanges: t1:%v t2:%v", t1, t2))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetAffiliationMultiple(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s orgs:%v err:%v",
-				projectSlug,
-				uuid,
-				dt,
+				"GetEmployerChanges(exit): t1:%v t2:%v apiName:%s projects:%+v username:%s out:%d err:%v",
+				t1,
+				t2,
 				apiName,
 				projects,
 				username,
-				orgs,
+				len(out.Changes),
 				err,
 			),
 		)
@@ -4373,35 +6386,100 @@ func (s *service) GetAffiliationMultiple(ctx context.Context, params *affiliatio
 	if err != nil {
 		return
 	}
-	projectSlug = projects[0]
-	orgs.Orgs = s.shDB.GetAffiliationsMulti(projectSlug, uuid, dt, nil)
+	role, err := s.roleParam(params.Role)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	var uuidsProjs map[string][]string
+	uuidsProjs, _, err = s.es.GetUUIDsProjects(projects)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	out.ProjectSlugs = []string{}
+	for _, project := range projects {
+		out.ProjectSlugs = append(out.ProjectSlugs, s.DA2SF(project))
+	}
+	out.Role = role
+	out.T1 = params.T1
+	out.T2 = params.T2
+	out.Changes, err = s.shDB.GetEmployerChanges(uuidsProjs, role, t1, t2, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	for _, change := range out.Changes {
+		change.ProjectSlug = s.DA2SF(change.ProjectSlug)
+	}
 	return
 }
 
-// GetAffiliationBoth: API params:
-// /v1/affiliation/{projectSlug}/both/{uuid}/{dt}:
-// {projectSlug} - required path parameter: project_slug to search affiliation
-// {uuid} - required path parameter: UUID of the profile to get affiliation
-// {dt} - required path parameter: Date of affiliation (default is 1900-01-01), must be in format 2015-05-05T15:15[:05Z] (urlencoded)
-func (s *service) GetAffiliationBoth(ctx context.Context, params *affiliation.GetAffiliationBothParams) (out *models.OrgAndOrgsOutput, err error) {
-	projectSlug := params.ProjectSlug
-	uuid := params.UUID
-	dt := time.Time(params.Dt)
-	out = &models.OrgAndOrgsOutput{}
-	log.Info(fmt.Sprintf("GetAffiliationBoth: projectSlug:%s uuid:%s dt:%v", projectSlug, uuid, dt))
+// roleParam - returns normalized enrollment role from an optional API query parameter (empty means any role)
+func (s *service) roleParam(role *string) (string, error) {
+	if role == nil {
+		return "", nil
+	}
+	return s.NormalizeRole(*role)
+}
+
+// asOfParam - returns point in time from an optional API query parameter (nil means current state)
+func (s *service) asOfParam(asOf *strfmt.DateTime) *time.Time {
+	if asOf == nil {
+		return nil
+	}
+	tm := time.Time(*asOf)
+	return &tm
+}
+
+// affiliationBatchProjects - returns all distinct project slugs used in batch affiliation items (comma separated)
+func affiliationBatchProjects(body *models.AffiliationBatchInput) string {
+	if body == nil {
+		return ""
+	}
+	seen := map[string]struct{}{}
+	projects := []string{}
+	for _, item := range body.Items {
+		if item == nil || item.ProjectSlug == nil {
+			continue
+		}
+		_, ok := seen[*item.ProjectSlug]
+		if ok {
+			continue
+		}
+		seen[*item.ProjectSlug] = struct{}{}
+		projects = append(projects, *item.ProjectSlug)
+	}
+	return strings.Join(projects, ",")
+}
+
+// PostAffiliationBatch: API params:
+// /v1/affiliation/batch
+// body: JSON object {"items": [{"uuid": "...", "dt": "2015-05-05T15:15:05Z", "project_slug": "...", "role": "..."}, ...]}
+// role is optional, if set only enrollments with this role are used for a given item
+// At most shared.AffBatchMaxItems items can be requested at once
+// Returns single org and multiple orgs for each item, in the same order as requested
+// Enrollments for all UUIDs are fetched using set-based queries and then resolved using the same 5-step algorithm
+// (including domain step fallback) as /v1/affiliation/{projectSlug}/both/{uuid}/{dt}, so results are identical to calling that API for each item
+// Items for disabled projects or projects current user is not allowed to see are returned with "error" set
+func (s *service) PostAffiliationBatch(ctx context.Context, params *affiliation.PostAffiliationBatchParams) (out *models.AffiliationBatchOutput, err error) {
+	out = &models.AffiliationBatchOutput{Items: []*models.AffiliationBatchResult{}}
+	n := 0
+	if params.Body != nil {
+		n = len(params.Body.Items)
+	}
+	log.Info(fmt.Sprintf("PostAffiliationBatch: items:%d", n))
 	// Check token and permission
 	apiName, projects, username, err := s.checkTokenAndPermission(params)
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"GetAffiliationBoth(exit): projectSlug:%s uuid:%s dt:%v apiName:%s projects:%+v username:%s out:%v err:%v",
-				projectSlug,
-				uuid,
-				dt,
+				"PostAffiliationBatch(exit): items:%d apiName:%s projects:%+v username:%s out:%d err:%v",
+				n,
 				apiName,
 				projects,
 				username,
-				out,
+				len(out.Items),
 				err,
 			),
 		)
@@ -4409,8 +6487,112 @@ func (s *service) GetAffiliationBoth(ctx context.Context, params *affiliation.Ge
 	if err != nil {
 		return
 	}
-	projectSlug = projects[0]
-	out.Org = s.shDB.GetAffiliationsSingle(projectSlug, uuid, dt, nil)
-	out.Orgs = s.shDB.GetAffiliationsMulti(projectSlug, uuid, dt, nil)
+	if n == 0 {
+		return
+	}
+	err = s.CheckAffiliationBatchSize(n)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	skipped, err := s.shDB.GetSkippedProjects()
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	allowed := make(map[string]struct{})
+	for _, project := range projects {
+		allowed[project] = struct{}{}
+	}
+	// SF -> DA, the same way checkTokenAndPermission does
+	daSlugs := make([]string, n)
+	uuids := []string{}
+	seenUUIDs := make(map[string]struct{})
+	from := shared.MaxPeriodDate
+	to := shared.MinPeriodDate
+	for i, item := range params.Body.Items {
+		// Swagger doesn't validate null array elements
+		if item == nil {
+			out.Items = append(out.Items, &models.AffiliationBatchResult{Error: fmt.Sprintf("item %d is null", i)})
+			continue
+		}
+		pSlug := *item.ProjectSlug
+		res := &models.AffiliationBatchResult{UUID: *item.UUID, Dt: *item.Dt, ProjectSlug: pSlug}
+		out.Items = append(out.Items, res)
+		role, e := s.NormalizeRole(item.Role)
+		if e != nil {
+			res.Error = e.Error()
+			continue
+		}
+		res.Role = role
+		_, disabled := skipped[pSlug]
+		if disabled {
+			res.Error = "project " + pSlug + " is disabled"
+			continue
+		}
+		daSlug := strings.TrimSpace(strings.Replace(pSlug, "/projects/", "", -1))
+		if daSlug != "" && daSlug != "all-projects" && daSlug != "no-projects" {
+			daSlug = s.SF2DA(daSlug)
+		}
+		_, ok := allowed[daSlug]
+		if !ok {
+			res.Error = fmt.Sprintf("user '%s' is not allowed to manage identities in '%s'", username, pSlug)
+			continue
+		}
+		daSlugs[i] = daSlug
+		_, ok = seenUUIDs[res.UUID]
+		if !ok {
+			seenUUIDs[res.UUID] = struct{}{}
+			uuids = append(uuids, res.UUID)
+		}
+		dt := time.Time(res.Dt)
+		if dt.Before(from) {
+			from = dt
+		}
+		if dt.After(to) {
+			to = dt
+		}
+	}
+	if len(uuids) == 0 {
+		return
+	}
+	rols, err := s.shDB.GetAffiliationCandidatesMulti(uuids, from, to, nil)
+	if err != nil {
+		err = errs.Wrap(err, apiName)
+		return
+	}
+	infer := s.shDB.ResolveAffiliationBatch(out.Items, daSlugs, rols)
+	var (
+		emails     map[string][]string
+		orgDomains []*models.DomainDataOutput
+	)
+	if len(infer) > 0 {
+		// Domain step needs emails and domains_organizations entries, they are fetched once for all unresolved profiles
+		inferUUIDs := []string{}
+		seenUUIDs = make(map[string]struct{})
+		for _, i := range infer {
+			uuid := out.Items[i].UUID
+			_, ok := seenUUIDs[uuid]
+			if !ok {
+				seenUUIDs[uuid] = struct{}{}
+				inferUUIDs = append(inferUUIDs, uuid)
+			}
+		}
+		emails, err = s.shDB.GetAffiliationEmailsMulti(inferUUIDs, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+		allEmails := []string{}
+		for _, uuid := range inferUUIDs {
+			allEmails = append(allEmails, emails[uuid]...)
+		}
+		orgDomains, err = s.shDB.GetDomainsOrganizations(allEmails, nil)
+		if err != nil {
+			err = errs.Wrap(err, apiName)
+			return
+		}
+	}
+	s.shDB.InferAffiliationBatch(out.Items, infer, emails, orgDomains)
 	return
 }
@@ -42,10 +42,15 @@ type Service interface {
 	// External methods
 	GetUnaffiliated([]string, int64) (*models.GetUnaffiliatedOutput, error)
 	AggsUnaffiliated(string, int64) ([]*models.UnaffiliatedDataOutput, error)
+	GetContributorsActivity(string, int64) ([]*models.ContributorActivity, error)
+	GetAuthorsActivity([]string, int64) (map[string]*models.BotActivity, error)
 	ContributorsCount(string, string) (int64, error)
 	GetTopContributors([]string, []string, int64, int64, int64, int64, string, string, string) (*models.TopContributorsFlatOutput, error)
 	UpdateByQuery(string, string, interface{}, string, interface{}, bool) error
+	AnonymizeAuthors(string, []string, map[string]string, string) error
+	SearchAPILog([]string, int) ([]*models.APILogEntry, error)
 	DetAffRange([]*models.EnrollmentProjectRange) ([]*models.EnrollmentProjectRange, string, error)
+	GetActivityRanges([]*models.EnrollmentProjectRange) ([]*models.EnrollmentProjectRange, string, error)
 	GetUUIDsProjects([]string) (map[string][]string, string, error)
 	// ES Cache methods
 	TopContributorsCacheGet(string) (*TopContributorsCacheEntry, bool)
@@ -91,6 +96,48 @@ type aggsUnaffiliatedResult struct {
 	} `json:"aggregations"`
 }
 
+type aggsContributorsActivityResult struct {
+	Aggregations struct {
+		Contributors struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int64  `json:"doc_count"`
+				Months   struct {
+					Buckets []struct {
+						Key      int64 `json:"key"`
+						DocCount int64 `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"months"`
+			} `json:"buckets"`
+		} `json:"contributors"`
+	} `json:"aggregations"`
+}
+
+type aggsAuthorsActivityResult struct {
+	Aggregations struct {
+		Authors struct {
+			Buckets []struct {
+				Key      string `json:"key"`
+				DocCount int64  `json:"doc_count"`
+				Days     struct {
+					Value int64 `json:"value"`
+				} `json:"days"`
+				TopDay struct {
+					Buckets []struct {
+						DocCount int64 `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"top_day"`
+				Hours struct {
+					Buckets []struct {
+						Key      float64 `json:"key"`
+						DocCount int64   `json:"doc_count"`
+					} `json:"buckets"`
+				} `json:"hours"`
+			} `json:"buckets"`
+		} `json:"authors"`
+	} `json:"aggregations"`
+}
+
 // ssLogPayload - ES log single document
 type esLogPayload struct {
 	Msg  string    `json:"msg"`
@@ -140,6 +187,79 @@ func (s *service) Log(msg, user, api string) error {
 	return nil
 }
 
+// SearchAPILog - returns up to size API log entries (from affiliations-api-log index) mentioning any of given terms, the most recent first
+func (s *service) SearchAPILog(terms []string, size int) (entries []*models.APILogEntry, err error) {
+	log.Info(fmt.Sprintf("SearchAPILog: terms:%d size:%d", len(terms), size))
+	entries = []*models.APILogEntry{}
+	defer func() {
+		log.Info(fmt.Sprintf("SearchAPILog(exit): terms:%d size:%d entries:%d err:%v", len(terms), size, len(entries), err))
+	}()
+	if len(terms) == 0 {
+		return
+	}
+	should := []interface{}{}
+	for _, term := range terms {
+		should = append(should, map[string]interface{}{"match_phrase": map[string]interface{}{"msg": term}})
+	}
+	data := map[string]interface{}{
+		"size": size,
+		"sort": []interface{}{map[string]interface{}{"dt": map[string]interface{}{"order": "desc"}}},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should":               should,
+				"minimum_should_match": 1,
+			},
+		},
+	}
+	payloadBytes, err := jsoniter.Marshal(data)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "SearchAPILog")
+		return
+	}
+	payloadBody := bytes.NewReader(payloadBytes)
+	var res *esapi.Response
+	res, err = s.search("affiliations-api-log", payloadBody)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.request")
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		var e map[string]interface{}
+		if err = jsoniter.NewDecoder(res.Body).Decode(&e); err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result.decode")
+			return
+		}
+		err = fmt.Errorf("[%s] %s: %s", res.Status(), e["error"].(map[string]interface{})["type"], e["error"].(map[string]interface{})["reason"])
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result")
+		return
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source esLogPayload `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err = jsoniter.NewDecoder(res.Body).Decode(&result); err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.hits.decode")
+		return
+	}
+	for _, hit := range result.Hits.Hits {
+		entries = append(
+			entries,
+			&models.APILogEntry{
+				Dt:   strfmt.DateTime(hit.Source.Dt),
+				Env:  hit.Source.Env,
+				User: hit.Source.User,
+				API:  hit.Source.API,
+				Msg:  hit.Source.Msg,
+			},
+		)
+	}
+	return
+}
+
 func (s *service) TopContributorsCacheGet(key string) (entry *TopContributorsCacheEntry, ok bool) {
 	data := `{"query":{"term":{"k.keyword":{"value": "` + s.JSONEscape(key) + `"}}}}`
 	payloadBytes := []byte(data)
@@ -508,10 +628,22 @@ func (s *service) GetUUIDsProjects(projects []string) (uuidsProjects map[string]
 	return
 }
 
+// DetAffRange - detects enrollments' start/end dates from subjects' first/last activity (only for dates far enough in the past)
 func (s *service) DetAffRange(inSubjects []*models.EnrollmentProjectRange) (outSubjects []*models.EnrollmentProjectRange, status string, err error) {
-	log.Info(fmt.Sprintf("DetAffRange: in:%d", len(inSubjects)))
+	return s.detAffRange(inSubjects, false)
+}
+
+// GetActivityRanges - returns subjects' (uuid and project) first and last activity, using the same ES queries as DetAffRange
+func (s *service) GetActivityRanges(inSubjects []*models.EnrollmentProjectRange) (outSubjects []*models.EnrollmentProjectRange, status string, err error) {
+	return s.detAffRange(inSubjects, true)
+}
+
+// detAffRange - gets first/last activity of subjects, if raw is set they are returned as they are,
+// otherwise they are only returned when enrollment start/end can be set from them (see DetAffRange)
+func (s *service) detAffRange(inSubjects []*models.EnrollmentProjectRange, raw bool) (outSubjects []*models.EnrollmentProjectRange, status string, err error) {
+	log.Info(fmt.Sprintf("DetAffRange: in:%d raw:%v", len(inSubjects), raw))
 	defer func() {
-		log.Info(fmt.Sprintf("DetAffRange(exit): in:%d out:%d status:%s err:%v", len(inSubjects), len(outSubjects), status, err))
+		log.Info(fmt.Sprintf("DetAffRange(exit): in:%d raw:%v out:%d status:%s err:%v", len(inSubjects), raw, len(outSubjects), status, err))
 	}()
 	packSize := 1000
 	type rangeResult struct {
@@ -662,6 +794,30 @@ func (s *service) DetAffRange(inSubjects []*models.EnrollmentProjectRange) (outS
 			}
 			r.uuid = subject.UUID
 			r.project = subject.ProjectSlug
+			if raw {
+				// row[1] and row[3] are min dates, row[2] and row[4] are max dates
+				for k, col := range row[1:5] {
+					if col == "" {
+						continue
+					}
+					dt, err := s.TimeParseAny(col)
+					if err != nil {
+						r.err = err
+						break
+					}
+					if k%2 == 0 {
+						if !r.setStart || dt.Before(time.Time(r.start)) {
+							r.start = strfmt.DateTime(dt)
+							r.setStart = true
+						}
+					} else if !r.setEnd || dt.After(time.Time(r.end)) {
+						r.end = strfmt.DateTime(dt)
+						r.setEnd = true
+					}
+				}
+				res = append(res, r)
+				continue
+			}
 			if row[1] != "" && row[3] != "" && time.Time(subject.Start) == shared.MinPeriodDate {
 				start1, err := s.TimeParseAny(row[1])
 				if err != nil {
@@ -1002,6 +1158,161 @@ func (s *service) AggsUnaffiliated(indexPattern string, topN int64) (unaffiliate
 	return
 }
 
+// GetContributorsActivity - returns first and last activity and monthly contributions of topN most active contributors of a given project
+// First and last activity are taken from GetActivityRanges (the same as used by DetAffRange), topN must be from 1 to shared.AffGapsMaxTop
+func (s *service) GetContributorsActivity(projectSlug string, topN int64) (activity []*models.ContributorActivity, err error) {
+	log.Info(fmt.Sprintf("GetContributorsActivity: projectSlug:%s topN:%d", projectSlug, topN))
+	pattern := s.projectSlugsToIndexPattern([]string{projectSlug})
+	defer func() {
+		log.Info(fmt.Sprintf("GetContributorsActivity(exit): projectSlug:%s topN:%d pattern:%s activity:%d err:%v", projectSlug, topN, pattern, len(activity), err))
+	}()
+	if topN <= 0 || topN > shared.AffGapsMaxTop {
+		err = errs.Wrap(errs.New(fmt.Errorf("number of contributors must be from 1 to %d, got %d", shared.AffGapsMaxTop, topN), errs.ErrBadRequest), "GetContributorsActivity")
+		return
+	}
+	data := `{"size":0,"aggs":{"contributors":{"terms":{"field":"author_uuid","size":` + fmt.Sprintf("%d", topN) + `},"aggs":{` +
+		`"months":{"date_histogram":{"field":"grimoire_creation_date","calendar_interval":"month","min_doc_count":1}}}}}}`
+	payloadBytes := []byte(data)
+	payloadBody := bytes.NewReader(payloadBytes)
+	var res *esapi.Response
+	res, err = s.search(pattern, payloadBody)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.request")
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		var e map[string]interface{}
+		if err = jsoniter.NewDecoder(res.Body).Decode(&e); err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result.decode")
+			return
+		}
+		err = fmt.Errorf("[%s] %s: %s", res.Status(), e["error"].(map[string]interface{})["type"], e["error"].(map[string]interface{})["reason"])
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result")
+		return
+	}
+	var result aggsContributorsActivityResult
+	if err = jsoniter.NewDecoder(res.Body).Decode(&result); err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.aggs.decode")
+		return
+	}
+	msToTime := func(ms int64) strfmt.DateTime {
+		return strfmt.DateTime(time.Unix(0, ms*1e6).UTC())
+	}
+	subjects := []*models.EnrollmentProjectRange{}
+	for _, bucket := range result.Aggregations.Contributors.Buckets {
+		if bucket.Key == "" {
+			continue
+		}
+		subjects = append(subjects, &models.EnrollmentProjectRange{UUID: bucket.Key, ProjectSlug: &projectSlug})
+	}
+	if len(subjects) == 0 {
+		return
+	}
+	ranges, _, err := s.GetActivityRanges(subjects)
+	if err != nil {
+		return
+	}
+	ranged := make(map[string]*models.EnrollmentProjectRange)
+	for _, rng := range ranges {
+		ranged[rng.UUID] = rng
+	}
+	for _, bucket := range result.Aggregations.Contributors.Buckets {
+		rng, ok := ranged[bucket.Key]
+		if !ok || time.Time(rng.Start).IsZero() || time.Time(rng.End).IsZero() {
+			continue
+		}
+		contributor := &models.ContributorActivity{
+			UUID:          bucket.Key,
+			Contributions: bucket.DocCount,
+			First:         rng.Start,
+			Last:          rng.End,
+		}
+		for _, month := range bucket.Months.Buckets {
+			contributor.Months = append(contributor.Months, &models.ActivityBucket{Start: msToTime(month.Key), Contributions: month.DocCount})
+		}
+		activity = append(activity, contributor)
+	}
+	return
+}
+
+// GetAuthorsActivity - returns activity patterns (daily and hourly cadence) of given authors or of topN most active authors
+// when uuids are not given, all data sources ("sds-*,-*-raw") are used, authors already flagged as bots are skipped
+func (s *service) GetAuthorsActivity(uuids []string, topN int64) (activity map[string]*models.BotActivity, err error) {
+	log.Info(fmt.Sprintf("GetAuthorsActivity: uuids:%d topN:%d", len(uuids), topN))
+	activity = make(map[string]*models.BotActivity)
+	defer func() {
+		log.Info(fmt.Sprintf("GetAuthorsActivity(exit): uuids:%d topN:%d activity:%d err:%v", len(uuids), topN, len(activity), err))
+	}()
+	query := `{"bool":{"must_not":[{"term":{"author_bot":true}}]}}`
+	if len(uuids) > 0 {
+		var terms []byte
+		terms, err = jsoniter.Marshal(uuids)
+		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetAuthorsActivity")
+			return
+		}
+		query = `{"bool":{"must_not":[{"term":{"author_bot":true}}],"filter":[{"terms":{"author_uuid":` + string(terms) + `}}]}}`
+		topN = int64(len(uuids))
+	}
+	if topN <= 0 {
+		topN = 2147483647
+	}
+	day := `doc['grimoire_creation_date'].value.toInstant().toEpochMilli() / 86400000L`
+	hour := `doc['grimoire_creation_date'].value.getHour()`
+	data := `{"size":0,"query":` + query + `,"aggs":{"authors":{"terms":{"field":"author_uuid","size":` + fmt.Sprintf("%d", topN) + `},"aggs":{` +
+		`"days":{"cardinality":{"script":{"source":"` + day + `"}}},` +
+		`"top_day":{"terms":{"script":{"source":"` + day + `"},"size":1}},` +
+		`"hours":{"terms":{"script":{"source":"` + hour + `"},"value_type":"long","size":24}}}}}}`
+	payloadBytes := []byte(data)
+	payloadBody := bytes.NewReader(payloadBytes)
+	var res *esapi.Response
+	res, err = s.search("sds-*,-*-raw", payloadBody)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.request")
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		var e map[string]interface{}
+		if err = jsoniter.NewDecoder(res.Body).Decode(&e); err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result.decode")
+			return
+		}
+		err = fmt.Errorf("[%s] %s: %s", res.Status(), e["error"].(map[string]interface{})["type"], e["error"].(map[string]interface{})["reason"])
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.result")
+		return
+	}
+	var result aggsAuthorsActivityResult
+	if err = jsoniter.NewDecoder(res.Body).Decode(&result); err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ES.search.aggs.decode")
+		return
+	}
+	for _, bucket := range result.Aggregations.Authors.Buckets {
+		if bucket.Key == "" {
+			continue
+		}
+		act := &models.BotActivity{
+			Contributions: bucket.DocCount,
+			ActiveDays:    bucket.Days.Value,
+			ActiveHours:   int64(len(bucket.Hours.Buckets)),
+		}
+		if len(bucket.TopDay.Buckets) > 0 {
+			act.MaxDaily = bucket.TopDay.Buckets[0].DocCount
+		}
+		var hours [24]int64
+		for _, hb := range bucket.Hours.Buckets {
+			h := int(hb.Key)
+			if h >= 0 && h < 24 {
+				hours[h] = hb.DocCount
+			}
+		}
+		act.QuietShare = math.Round(s.QuietShare(hours, 8)*100.0) / 100.0
+		activity[bucket.Key] = act
+	}
+	return
+}
+
 // ContributorsCount - returns the number of distinct author_uuids in a given index pattern
 func (s *service) ContributorsCount(indexPattern, cond string) (cnt int64, err error) {
 	log.Info(fmt.Sprintf("ContributorsCount: indexPattern:%s cond:%s", indexPattern, cond))
@@ -2557,6 +2868,90 @@ func (s *service) UpdateByQuery(indexPattern, updateField string, updateTo inter
 	return
 }
 
+// AnonymizeAuthors - for every role (author, committer, assignee, reporter, ...) whose <role>_uuid is one of given uuids or <role>_id
+// is one of given identity ids, sets <role>_name to name and clears other role's personal data fields (when present), waits for the update to finish
+// ids maps old identity ids to new ones, matching <role>_id fields are re-keyed to the new ids (the same way as in DB)
+func (s *service) AnonymizeAuthors(indexPattern string, uuids []string, ids map[string]string, name string) (err error) {
+	log.Info(fmt.Sprintf("AnonymizeAuthors: indexPattern:%s uuids:%+v ids:%d name:%s", indexPattern, uuids, len(ids), name))
+	defer func() {
+		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AnonymizeAuthors")
+		}
+		log.Info(fmt.Sprintf("AnonymizeAuthors(exit): indexPattern:%s uuids:%+v ids:%d name:%s err:%v", indexPattern, uuids, len(ids), name, err))
+	}()
+	// Role fields differ between data sources, so all *_uuid and *_id fields are checked
+	should := []interface{}{}
+	for _, uuid := range uuids {
+		should = append(should, map[string]interface{}{"multi_match": map[string]interface{}{"query": uuid, "fields": []string{"*_uuid"}, "lenient": true}})
+	}
+	for id := range ids {
+		should = append(should, map[string]interface{}{"multi_match": map[string]interface{}{"query": id, "fields": []string{"*_id"}, "lenient": true}})
+	}
+	if len(should) == 0 {
+		return
+	}
+	if uuids == nil {
+		uuids = []string{}
+	}
+	if ids == nil {
+		ids = map[string]string{}
+	}
+	data := map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": "for (k in new ArrayList(ctx._source.keySet())) { String role = null; " +
+				"if (k.endsWith('_uuid') && params.uuids.contains(ctx._source[k])) { role = k.substring(0, k.length() - 5) } " +
+				"else if (k.endsWith('_id') && params.ids.containsKey(ctx._source[k])) { role = k.substring(0, k.length() - 3); ctx._source[k] = params.ids[ctx._source[k]] } " +
+				"if (role == null) { continue } " +
+				"if (ctx._source.containsKey(role + '_name')) { ctx._source[role + '_name'] = params.name } " +
+				"for (f in params.fields) { if (ctx._source.containsKey(role + f)) { ctx._source[role + f] = null } } }",
+			"lang": "painless",
+			"params": map[string]interface{}{
+				"name":   name,
+				"uuids":  uuids,
+				"ids":    ids,
+				"fields": []string{"_user_name", "_username", "_email", "_login"},
+			},
+		},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should":               should,
+				"minimum_should_match": 1,
+			},
+		},
+	}
+	payloadBytes, err := jsoniter.Marshal(data)
+	if err != nil {
+		return
+	}
+	payloadBody := bytes.NewReader(payloadBytes)
+	method := "POST"
+	url := fmt.Sprintf("%s/%s/_update_by_query?conflicts=proceed&refresh=true&timeout=20m", s.url, indexPattern)
+	req, err := http.NewRequest(method, os.ExpandEnv(url), payloadBody)
+	if err != nil {
+		err = fmt.Errorf("new request error: %+v for %s url: %s", err, method, url)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("do request error: %+v for %s url: %s", err, method, url)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != 200 {
+		body, err2 := ioutil.ReadAll(resp.Body)
+		if err2 != nil {
+			err = fmt.Errorf("ReadAll request error: %+v for %s url: %s", err2, method, url)
+			return
+		}
+		err = fmt.Errorf("Method:%s url:%s status:%d\n%s", method, url, resp.StatusCode, body)
+		return
+	}
+	return
+}
+
 func (s *service) search(index string, query io.Reader) (res *esapi.Response, err error) {
 	return s.client.Search(
 		s.client.Search.WithIndex(index),
@@ -36,7 +36,9 @@ func configureAPI(api *operations.DevAnalyticsAffiliationAPI) http.Handler {
 	// Example:
 	// api.Logger = log.Printf
 
+	api.CsvConsumer = runtime.CSVConsumer()
 	api.JSONConsumer = runtime.JSONConsumer()
+	api.TxtConsumer = runtime.TextConsumer()
 	api.YamlConsumer = yamlpc.YAMLConsumer()
 
 	api.BinProducer = runtime.ByteStreamProducer()
@@ -218,11 +218,20 @@ func initUser() *userservice.Client {
 
 func setupEnv() {
 	shared.GSQLOut = os.Getenv("DA_AFF_API_SQL_OUT") != ""
+	shared.GEnrollmentHistory = os.Getenv("ENROLLMENT_HISTORY") != ""
 	shared.GSyncURL = os.Getenv("SYNC_URL")
 	shared.GRedacted[shared.GSyncURL] = struct{}{}
 	if shared.GSyncURL == "" {
 		log.Fatal("setupEnv:", fmt.Errorf("SYNC_URL environment variable must be set"))
 	}
+	conflictsInterval := os.Getenv("DA_AFF_API_CONFLICTS_INTERVAL")
+	if conflictsInterval != "" {
+		interval, err := time.ParseDuration(conflictsInterval)
+		if err != nil {
+			log.Fatal("setupEnv:", fmt.Errorf("DA_AFF_API_CONFLICTS_INTERVAL must be a duration, for example 24h: %v", err))
+		}
+		shared.GEnrollmentConflictsInterval = interval
+	}
 }
 
 func main() {
@@ -271,6 +280,9 @@ func main() {
 	// When redeploying this needs to be cleared
 	affiliationService.ClearPrecacheRunning()
 
+	// Periodically detect enrollment conflicts (only if DA_AFF_API_CONFLICTS_INTERVAL is set)
+	affiliationService.StartEnrollmentConflictsDetector()
+
 	if err := cmd.Start(api, *portFlag); err != nil {
 		logrus.Panicln(err)
 	}
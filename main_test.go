@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-openapi/strfmt"
 
+	"github.com/LF-Engineering/dev-analytics-affiliation/gen/models"
 	"github.com/LF-Engineering/dev-analytics-affiliation/shared"
 	"github.com/LF-Engineering/dev-analytics-affiliation/shdb"
 )
@@ -203,7 +205,7 @@ func TestMergeDateRanges(t *testing.T) {
 			},
 		},
 	}
-	s := shdb.New(nil, "api-test")
+	s := shdb.New(nil, nil, "api-test")
 	for index, test := range testCases {
 		expected := test.expected
 		expectedErr := test.expectedErr
@@ -223,3 +225,1727 @@ func TestMergeDateRanges(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveAffiliations(t *testing.T) {
+	date := func(y int, m time.Month, d int) strfmt.DateTime {
+		return strfmt.DateTime(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	slug := func(s string) *string {
+		return &s
+	}
+	rols := []*models.AffiliationCandidate{
+		{ID: 1, Organization: "Intel", Start: date(1900, 1, 1), End: date(2018, 3, 1)},
+		{ID: 2, Organization: "Red Hat", Start: date(2018, 3, 1), End: date(2100, 1, 1)},
+		{ID: 3, Organization: "CNCF", ProjectSlug: slug("cncf/prometheus"), Start: date(2016, 1, 1), End: date(2017, 1, 1)},
+		{ID: 4, Organization: "Google", ProjectSlug: slug("cncf-f"), Start: date(2019, 1, 1), End: date(2020, 1, 1)},
+		{ID: 5, Organization: "Microsoft", ProjectSlug: slug("cncf/kubernetes"), Start: date(2019, 6, 1), End: date(2019, 7, 1)},
+		{ID: 6, Organization: "VMware", ProjectSlug: slug("lfn/onap"), Start: date(2021, 1, 1), End: date(2022, 1, 1)},
+		{ID: 7, Organization: "Cisco", ProjectSlug: slug("CNCF/Prometheus"), Start: date(2016, 6, 1), End: date(2017, 1, 1)},
+	}
+	var testCases = []struct {
+		name     string
+		pSlug    string
+		dt       strfmt.DateTime
+		single   bool
+		expected []string
+		step     int64
+	}{
+		{name: "project multi", pSlug: "cncf/prometheus", dt: date(2016, 7, 1), expected: []string{"Cisco", "CNCF"}, step: 1},
+		{name: "project single", pSlug: "cncf/prometheus", dt: date(2016, 7, 1), single: true, expected: []string{"Cisco"}, step: 1},
+		{name: "project before other", pSlug: "cncf/prometheus", dt: date(2016, 2, 1), expected: []string{"CNCF"}, step: 1},
+		{name: "foundation-f", pSlug: "cncf/prometheus", dt: date(2019, 6, 15), expected: []string{"Google"}, step: 2},
+		{name: "global", pSlug: "cncf/prometheus", dt: date(2015, 1, 1), expected: []string{"Intel"}, step: 3},
+		{name: "global boundary", pSlug: "cncf/prometheus", dt: date(2018, 3, 1), expected: []string{"Red Hat"}, step: 3},
+		{name: "global no project", pSlug: "", dt: date(2016, 7, 1), expected: []string{"Intel"}, step: 3},
+		{name: "empty project", pSlug: "(empty)", dt: date(2021, 6, 1), expected: []string{"Red Hat"}, step: 3},
+		{name: "same foundation", pSlug: "cncf/envoy", dt: date(1800, 1, 1), step: 0},
+		{name: "nothing", pSlug: "lfn/onap", dt: date(2101, 1, 1), step: 0},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got, expl := s.ResolveAffiliations(test.pSlug, time.Time(test.dt), test.single, true, rols)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("test number %d (%s), expected %v, got %v", index+1, test.name, test.expected, got)
+		}
+		if expl.Step != test.step {
+			t.Errorf("test number %d (%s), expected step %d, got %d", index+1, test.name, test.step, expl.Step)
+		}
+		if len(expl.Matched)+len(expl.Rejected) != len(rols) {
+			t.Errorf("test number %d (%s), expected %d candidates, got %d matched and %d rejected", index+1, test.name, len(rols), len(expl.Matched), len(expl.Rejected))
+		}
+		got, expl = s.ResolveAffiliations(test.pSlug, time.Time(test.dt), test.single, false, rols)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") || expl != nil {
+			t.Errorf("test number %d (%s), expected %v without explanation, got %v (%+v)", index+1, test.name, test.expected, got, expl)
+		}
+	}
+	// Same foundation (step 4) and anything else (step 5)
+	rols = []*models.AffiliationCandidate{
+		{ID: 1, Organization: "VMware", ProjectSlug: slug("lfn/onap"), Start: date(2015, 1, 1), End: date(2020, 1, 1)},
+		{ID: 2, Organization: "Microsoft", ProjectSlug: slug("cncf/kubernetes"), Start: date(2015, 1, 1), End: date(2020, 1, 1)},
+	}
+	got, expl := s.ResolveAffiliations("cncf/envoy", time.Time(date(2016, 1, 1)), true, true, rols)
+	if len(got) != 1 || got[0] != "Microsoft" || expl.Step != 4 || len(expl.Matched) != 1 || expl.Rejected[0].Step != 5 {
+		t.Errorf("same foundation: got %v, explanation %+v", got, expl)
+	}
+	got, expl = s.ResolveAffiliations("hyperledger/besu", time.Time(date(2016, 1, 1)), false, true, rols)
+	if strings.Join(got, ",") != "Microsoft,VMware" || expl.Step != 5 || expl.StepName != "any" {
+		t.Errorf("anything else: got %v, explanation %+v", got, expl)
+	}
+	// Role filter: project specific Maintainer enrollment must not shadow global Contributor one
+	rols = []*models.AffiliationCandidate{
+		{ID: 1, Organization: "Intel", Role: "Contributor", Start: date(1900, 1, 1), End: date(2100, 1, 1)},
+		{ID: 2, Organization: "CNCF", Role: "Maintainer", ProjectSlug: slug("cncf/envoy"), Start: date(1900, 1, 1), End: date(2100, 1, 1)},
+	}
+	for _, role := range []string{"", "Contributor", "contributor", "Maintainer", "Other"} {
+		expected := map[string]string{"": "CNCF", "Contributor": "Intel", "contributor": "Intel", "Maintainer": "CNCF", "Other": ""}[role]
+		got, _ = s.ResolveAffiliations("cncf/envoy", time.Time(date(2016, 1, 1)), true, false, s.FilterAffiliationCandidates(rols, role))
+		if strings.Join(got, ",") != expected {
+			t.Errorf("role '%s': expected %s, got %v", role, expected, got)
+		}
+	}
+	// Confidence: more confident overlapping enrollment wins over more recent one, unknown confidence is the lowest
+	confidence := func(c int64) *int64 {
+		return &c
+	}
+	rols = []*models.AffiliationCandidate{
+		{ID: 1, Organization: "Intel", Confidence: confidence(90), Start: date(1900, 1, 1), End: date(2100, 1, 1)},
+		{ID: 2, Organization: "Red Hat", Confidence: confidence(40), Start: date(2015, 1, 1), End: date(2100, 1, 1)},
+		{ID: 3, Organization: "Google", Start: date(2015, 1, 1), End: date(2100, 1, 1)},
+		{ID: 4, Organization: "CNCF", ProjectSlug: slug("cncf/envoy"), Confidence: confidence(10), Start: date(2017, 1, 1), End: date(2100, 1, 1)},
+	}
+	for _, test := range []struct {
+		pSlug    string
+		dt       strfmt.DateTime
+		single   bool
+		expected string
+	}{
+		{pSlug: "cncf/prometheus", dt: date(2016, 1, 1), single: true, expected: "Intel"},
+		{pSlug: "cncf/prometheus", dt: date(2016, 1, 1), expected: "Intel,Red Hat,Google"},
+		{pSlug: "cncf/prometheus", dt: date(2014, 1, 1), single: true, expected: "Intel"},
+		{pSlug: "cncf/envoy", dt: date(2018, 1, 1), single: true, expected: "CNCF"},
+	} {
+		got, expl = s.ResolveAffiliations(test.pSlug, time.Time(test.dt), test.single, true, rols)
+		if strings.Join(got, ",") != test.expected {
+			t.Errorf("confidence %s %v single:%v: expected %s, got %v (%+v)", test.pSlug, test.dt, test.single, test.expected, got, expl)
+		}
+	}
+}
+
+func TestAffiliationBatch(t *testing.T) {
+	date := func(y int, m time.Month, d int) strfmt.DateTime {
+		return strfmt.DateTime(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	slug := func(s string) *string {
+		return &s
+	}
+	shared.GAffPolicyMtx.Lock()
+	shared.GAffPolicies = map[string][]int{
+		"lfn": {shared.AffStepProject, shared.AffStepGlobal, shared.AffStepDomain},
+	}
+	shared.GAffPolicyMtx.Unlock()
+	defer func() {
+		shared.GAffPolicyMtx.Lock()
+		shared.GAffPolicies = nil
+		shared.GAffPolicyMtx.Unlock()
+	}()
+	rols := map[string][]*models.AffiliationCandidate{
+		"u1": {
+			{ID: 1, Organization: "Intel", Role: "Contributor", Start: date(1900, 1, 1), End: date(2018, 3, 1)},
+			{ID: 2, Organization: "CNCF", Role: "Contributor", ProjectSlug: slug("cncf/prometheus"), Start: date(2016, 1, 1), End: date(2017, 1, 1)},
+			{ID: 3, Organization: "Cisco", Role: "Contributor", ProjectSlug: slug("cncf/prometheus"), Start: date(2016, 6, 1), End: date(2017, 1, 1)},
+		},
+		"u2": {
+			{ID: 4, Organization: "Google", Role: "Contributor", Start: date(1900, 1, 1), End: date(2100, 1, 1)},
+			{ID: 5, Organization: "VMware", Role: "Maintainer", ProjectSlug: slug("cncf/envoy"), Start: date(2019, 1, 1), End: date(2100, 1, 1)},
+		},
+	}
+	emails := map[string][]string{
+		"u3": {"john@gmail.com", "john@linux.intel.com"},
+	}
+	orgDomains := []*models.DomainDataOutput{
+		{Name: "intel.com", OrganizationName: "Intel", IsTopDomain: true},
+	}
+	items := []*models.AffiliationBatchResult{
+		{UUID: "u1", ProjectSlug: "cncf/prometheus", Dt: date(2016, 7, 1)},
+		{UUID: "u1", ProjectSlug: "cncf/envoy", Dt: date(2016, 7, 1)},
+		{UUID: "u2", ProjectSlug: "cncf/envoy", Dt: date(2020, 1, 1)},
+		{UUID: "u2", ProjectSlug: "cncf/envoy", Dt: date(2018, 1, 1), Role: "Maintainer"},
+		{UUID: "u2", ProjectSlug: "cncf/envoy", Dt: date(2020, 1, 1), Role: "Contributor"},
+		{UUID: "u2", ProjectSlug: "lfn/onap", Dt: date(2020, 1, 1), Role: "Maintainer"},
+		{UUID: "u3", ProjectSlug: "cncf/envoy", Dt: date(2020, 1, 1)},
+		{UUID: "u3", ProjectSlug: "lfn/onap", Dt: date(2020, 1, 1)},
+		{UUID: "u3", ProjectSlug: "lfn/onap", Dt: date(2020, 1, 1), Role: "Contributor"},
+		{UUID: "u1", ProjectSlug: "odpi/egeria", Dt: date(2020, 1, 1), Error: "project odpi/egeria is disabled"},
+	}
+	expected := []string{
+		"Cisco:Cisco,CNCF:false",
+		"Intel:Intel:false",
+		"VMware:VMware:false",
+		"Unknown:Unknown:false",
+		"Google:Google:false",
+		"Unknown:Unknown:false",
+		"Unknown:Unknown:false",
+		"Intel:Intel:true",
+		"Unknown:Unknown:false",
+		"::false",
+	}
+	daSlugs := []string{}
+	for _, item := range items {
+		daSlugs = append(daSlugs, item.ProjectSlug)
+	}
+	s := shdb.New(nil, nil, "api-test")
+	infer := s.ResolveAffiliationBatch(items, daSlugs, rols)
+	if fmt.Sprintf("%v", infer) != "[7]" {
+		t.Errorf("expected only item 8 to use domain step, got %v", infer)
+	}
+	s.InferAffiliationBatch(items, infer, emails, orgDomains)
+	for index, item := range items {
+		got := fmt.Sprintf("%s:%s:%v", item.Org, strings.Join(item.Orgs, ","), item.Inferred)
+		if got != expected[index] {
+			t.Errorf("test number %d (%s %s %s), expected %s, got %s", index+1, item.UUID, item.ProjectSlug, item.Role, expected[index], got)
+		}
+		if item.Error != "" {
+			continue
+		}
+		// Single call path: the same candidates resolved separately in single and multi mode
+		urols := s.FilterAffiliationCandidates(rols[item.UUID], item.Role)
+		single, _ := s.ResolveAffiliations(item.ProjectSlug, time.Time(item.Dt), true, false, urols)
+		multi, _ := s.ResolveAffiliations(item.ProjectSlug, time.Time(item.Dt), false, false, urols)
+		inferred := false
+		if len(multi) == 0 && s.AffiliationDomainStep(item.ProjectSlug, item.Role) {
+			single, _ = s.InferAffiliationsFromEmails(emails[item.UUID], orgDomains, true)
+			multi, _ = s.InferAffiliationsFromEmails(emails[item.UUID], orgDomains, false)
+			inferred = len(multi) > 0
+		}
+		if len(single) == 0 {
+			single = []string{"Unknown"}
+		}
+		if len(multi) == 0 {
+			multi = []string{"Unknown"}
+		}
+		if item.Org != single[0] || strings.Join(item.Orgs, ",") != strings.Join(multi, ",") || item.Inferred != inferred {
+			t.Errorf("test number %d (%s %s %s), batch result %s differs from single call %s:%v:%v", index+1, item.UUID, item.ProjectSlug, item.Role, got, single[0], multi, inferred)
+		}
+	}
+	ss := &shared.ServiceStruct{}
+	if err := ss.CheckAffiliationBatchSize(shared.AffBatchMaxItems); err != nil {
+		t.Errorf("expected %d items to be accepted, got %v", shared.AffBatchMaxItems, err)
+	}
+	if err := ss.CheckAffiliationBatchSize(shared.AffBatchMaxItems + 1); err == nil || !strings.Contains(err.Error(), "too many items") {
+		t.Errorf("expected %d items to be rejected, got %v", shared.AffBatchMaxItems+1, err)
+	}
+}
+
+func TestAffiliationTimeline(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	slug := func(s string) *string {
+		return &s
+	}
+	rols := []*models.AffiliationCandidate{
+		{ID: 1, Organization: "Intel", Start: strfmt.DateTime(date(2015, 1, 1)), End: strfmt.DateTime(date(2018, 3, 1))},
+		{ID: 2, Organization: "Red Hat", Start: strfmt.DateTime(date(2018, 3, 1)), End: strfmt.DateTime(date(2100, 1, 1))},
+		{ID: 3, Organization: "Google", ProjectSlug: slug("cncf/prometheus"), Start: strfmt.DateTime(date(2016, 1, 1)), End: strfmt.DateTime(date(2016, 1, 15))},
+		{ID: 4, Organization: "Red Hat", ProjectSlug: slug("lfn/onap"), Start: strfmt.DateTime(date(2018, 1, 1)), End: strfmt.DateTime(date(2019, 1, 1))},
+	}
+	var testCases = []struct {
+		name     string
+		pSlug    string
+		from     time.Time
+		to       time.Time
+		expected string
+	}{
+		{
+			name:     "full range",
+			pSlug:    "cncf/prometheus",
+			from:     date(1900, 1, 1),
+			to:       date(2100, 1, 1),
+			expected: "1900-01-01:2015-01-01:Unknown:0,2015-01-01:2016-01-01:Intel:3,2016-01-01:2016-01-15:Google:1,2016-01-15:2018-03-01:Intel:3,2018-03-01:2100-01-01:Red Hat:3",
+		},
+		{
+			name:     "narrow range",
+			pSlug:    "cncf/prometheus",
+			from:     date(2016, 1, 10),
+			to:       date(2017, 1, 1),
+			expected: "2016-01-10:2016-01-15:Google:1,2016-01-15:2017-01-01:Intel:3",
+		},
+		{
+			name:     "merged segments",
+			pSlug:    "lfn/onap",
+			from:     date(2017, 1, 1),
+			to:       date(2020, 1, 1),
+			expected: "2017-01-01:2018-01-01:Intel:3,2018-01-01:2019-01-01:Red Hat:1,2019-01-01:2020-01-01:Red Hat:3",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		segments := s.AffiliationTimeline(test.pSlug, test.from, test.to, rols)
+		got := []string{}
+		for _, segment := range segments {
+			got = append(
+				got,
+				fmt.Sprintf(
+					"%s:%s:%s:%d",
+					time.Time(segment.Start).Format(shared.DateFormat),
+					time.Time(segment.End).Format(shared.DateFormat),
+					strings.Join(segment.Orgs, "+"),
+					segment.Step,
+				),
+			)
+		}
+		if strings.Join(got, ",") != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, strings.Join(got, ","))
+		}
+	}
+	// Domain step: segments that no enrollment covers get organizations inferred from email domains
+	orgDomains := []*models.DomainDataOutput{
+		{Name: "intel.com", OrganizationName: "Intel", IsTopDomain: true},
+		{Name: "cncf.io", OrganizationName: "CNCF"},
+	}
+	segments := s.AffiliationTimeline("cncf/prometheus", date(2014, 1, 1), date(2016, 1, 1), rols)
+	s.InferAffiliationTimeline(segments, []string{"john@gmail.com", "john@cncf.io", "john@linux.intel.com"}, orgDomains)
+	got := []string{}
+	for _, segment := range segments {
+		got = append(got, fmt.Sprintf("%s:%s:%d:%v", segment.Org, strings.Join(segment.Orgs, "+"), segment.Step, segment.Inferred))
+	}
+	if strings.Join(got, ",") != "CNCF:CNCF+Intel:6:true,Intel:Intel:3:false" {
+		t.Errorf("domain step: expected inferred CNCF+Intel then Intel, got %s", strings.Join(got, ","))
+	}
+	segments = s.AffiliationTimeline("cncf/prometheus", date(2014, 1, 1), date(2016, 1, 1), rols)
+	s.InferAffiliationTimeline(segments, []string{"john@gmail.com"}, orgDomains)
+	if segments[0].Step != shared.AffStepNone || segments[0].Inferred || segments[0].Org != "Unknown" {
+		t.Errorf("domain step: expected Unknown when no domain matches, got %+v", segments[0])
+	}
+}
+
+func TestEmployerChanges(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	slug := func(s string) *string {
+		return &s
+	}
+	rols := map[string][]*models.AffiliationCandidate{
+		"u1": {
+			{ID: 1, Organization: "Intel", Role: "Contributor", Start: strfmt.DateTime(date(1900, 1, 1)), End: strfmt.DateTime(date(2020, 2, 1))},
+			{ID: 2, Organization: "Red Hat", Role: "Contributor", Start: strfmt.DateTime(date(2020, 2, 1)), End: strfmt.DateTime(date(2100, 1, 1))},
+		},
+		"u2": {
+			{ID: 3, Organization: "Google", Role: "Contributor", Start: strfmt.DateTime(date(1900, 1, 1)), End: strfmt.DateTime(date(2100, 1, 1))},
+			{ID: 4, Organization: "VMware", Role: "Maintainer", ProjectSlug: slug("lfn/onap"), Start: strfmt.DateTime(date(2020, 3, 1)), End: strfmt.DateTime(date(2100, 1, 1))},
+		},
+		"u3": {
+			{ID: 5, Organization: "Cisco", Role: "Contributor", Start: strfmt.DateTime(date(2020, 3, 1)), End: strfmt.DateTime(date(2100, 1, 1))},
+		},
+	}
+	var testCases = []struct {
+		name          string
+		projects      []string
+		uuidsProjects map[string][]string
+		role          string
+		expected      string
+	}{
+		{
+			name:     "all roles",
+			projects: []string{"cncf/prometheus", "lfn/onap"},
+			expected: "u1:cncf/prometheus:Intel[1]->Red Hat[2],u1:lfn/onap:Intel[1]->Red Hat[2],u2:lfn/onap:Google[3]->VMware[4],u3:cncf/prometheus:Unknown[]->Cisco[5],u3:lfn/onap:Unknown[]->Cisco[5]",
+		},
+		{
+			name:     "contributors only",
+			projects: []string{"lfn/onap"},
+			role:     "Contributor",
+			expected: "u1:lfn/onap:Intel[1]->Red Hat[2],u3:lfn/onap:Unknown[]->Cisco[5]",
+		},
+		{
+			name:     "maintainers only",
+			projects: []string{"lfn/onap"},
+			role:     "Maintainer",
+			expected: "u2:lfn/onap:Unknown[]->VMware[4]",
+		},
+		{
+			name:          "only profiles' own projects",
+			projects:      []string{"cncf/prometheus", "lfn/onap"},
+			uuidsProjects: map[string][]string{"u1": {"lfn/onap"}, "u3": nil},
+			expected:      "u1:lfn/onap:Intel[1]->Red Hat[2],u2:lfn/onap:Google[3]->VMware[4]",
+		},
+		{
+			name: "no projects",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		uuidsProjects := make(map[string][]string)
+		for uuid := range rols {
+			uuidsProjects[uuid] = test.projects
+		}
+		for uuid, projects := range test.uuidsProjects {
+			uuidsProjects[uuid] = projects
+		}
+		changes := s.EmployerChanges(uuidsProjects, test.role, date(2020, 1, 1), date(2020, 4, 1), rols, nil, nil)
+		got := []string{}
+		for _, change := range changes {
+			got = append(
+				got,
+				fmt.Sprintf(
+					"%s:%s:%s%v->%s%v",
+					change.UUID,
+					change.ProjectSlug,
+					change.OldOrg,
+					change.OldEnrollmentIds,
+					change.NewOrg,
+					change.NewEnrollmentIds,
+				),
+			)
+		}
+		if strings.Join(got, ",") != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, strings.Join(got, ","))
+		}
+	}
+	// Domain step: profile without enrollment on t1 is not reported when inferred organization is the same as the new one
+	shared.GAffPolicyMtx.Lock()
+	shared.GAffPolicies = map[string][]int{
+		"lfn": {shared.AffStepProject, shared.AffStepGlobal, shared.AffStepDomain},
+	}
+	shared.GAffPolicyMtx.Unlock()
+	defer func() {
+		shared.GAffPolicyMtx.Lock()
+		shared.GAffPolicies = nil
+		shared.GAffPolicyMtx.Unlock()
+	}()
+	uuidsProjects := map[string][]string{"u1": {"lfn/onap"}, "u3": {"cncf/prometheus", "lfn/onap"}}
+	emails := map[string][]string{"u1": {"john@intel.com"}, "u3": {"jane@cisco.com"}}
+	orgDomains := []*models.DomainDataOutput{
+		{Name: "cisco.com", OrganizationName: "Cisco"},
+		{Name: "intel.com", OrganizationName: "Intel"},
+	}
+	changes := s.EmployerChanges(uuidsProjects, "", date(2020, 1, 1), date(2020, 4, 1), rols, emails, orgDomains)
+	got := []string{}
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s:%s:%s:%v->%s:%v", change.UUID, change.ProjectSlug, change.OldOrg, change.OldInferred, change.NewOrg, change.NewInferred))
+	}
+	if strings.Join(got, ",") != "u1:lfn/onap:Intel:false->Red Hat:false,u3:cncf/prometheus:Unknown:false->Cisco:false" {
+		t.Errorf("domain step: got %s", strings.Join(got, ","))
+	}
+	changes = s.EmployerChanges(map[string][]string{"u3": {"lfn/onap"}}, "", date(2020, 1, 1), date(2020, 4, 1), rols, map[string][]string{"u3": {"jane@intel.com"}}, orgDomains)
+	if len(changes) != 1 || changes[0].OldOrg != "Intel" || !changes[0].OldInferred || len(changes[0].OldEnrollmentIds) != 0 || changes[0].NewOrg != "Cisco" || changes[0].NewInferred {
+		t.Errorf("domain step: expected inferred Intel -> Cisco, got %+v", changes)
+	}
+}
+
+func TestAffiliationPolicy(t *testing.T) {
+	date := func(y int, m time.Month, d int) strfmt.DateTime {
+		return strfmt.DateTime(time.Date(y, m, d, 0, 0, 0, 0, time.UTC))
+	}
+	slug := func(s string) *string {
+		return &s
+	}
+	s := shdb.New(nil, nil, "api-test")
+	var parseCases = []struct {
+		steps    string
+		expected []int
+		err      bool
+	}{
+		{steps: "1,2,3", expected: []int{1, 2, 3}},
+		{steps: " project , Global,foundation-f", expected: []int{1, 3, 2}},
+		{steps: "3,1,", expected: []int{3, 1}},
+		{steps: "", err: true},
+		{steps: "1,1", err: true},
+		{steps: "1,2,3,domain", expected: []int{1, 2, 3, 6}},
+		{steps: "6,1", err: true},
+		{steps: "7", err: true},
+		{steps: "project,unknown", err: true},
+	}
+	for index, test := range parseCases {
+		got, err := s.ParseAffiliationPolicySteps(test.steps)
+		if (err != nil) != test.err || fmt.Sprintf("%v", got) != fmt.Sprintf("%v", test.expected) && !test.err {
+			t.Errorf("test number %d (%s), expected %v (error %v), got %v (%v)", index+1, test.steps, test.expected, test.err, got, err)
+		}
+	}
+	shared.GAffPolicyMtx.Lock()
+	shared.GAffPolicies = map[string][]int{
+		"cncf":    {shared.AffStepProject, shared.AffStepGlobal},
+		"lfn":     {shared.AffStepGlobal, shared.AffStepProject},
+		"default": {shared.AffStepProject, shared.AffStepFoundationF, shared.AffStepGlobal, shared.AffStepFoundation},
+	}
+	shared.GAffPolicyMtx.Unlock()
+	defer func() {
+		shared.GAffPolicyMtx.Lock()
+		shared.GAffPolicies = nil
+		shared.GAffPolicyMtx.Unlock()
+	}()
+	rols := []*models.AffiliationCandidate{
+		{ID: 1, Organization: "Intel", Start: date(2015, 1, 1), End: date(2016, 1, 1)},
+		{ID: 2, Organization: "Google", ProjectSlug: slug("cncf/kubernetes"), Start: date(2015, 1, 1), End: date(2017, 1, 1)},
+		{ID: 3, Organization: "VMware", ProjectSlug: slug("lfn/onap"), Start: date(2015, 1, 1), End: date(2017, 1, 1)},
+		{ID: 4, Organization: "Red Hat", ProjectSlug: slug("hyperledger/besu"), Start: date(2015, 1, 1), End: date(2017, 1, 1)},
+	}
+	var testCases = []struct {
+		name     string
+		pSlug    string
+		dt       strfmt.DateTime
+		expected []string
+		step     int64
+	}{
+		{name: "project first", pSlug: "cncf/kubernetes", dt: date(2015, 6, 1), expected: []string{"Google"}, step: 1},
+		{name: "never borrow", pSlug: "cncf/prometheus", dt: date(2016, 6, 1), step: 0},
+		{name: "global first", pSlug: "lfn/onap", dt: date(2015, 6, 1), expected: []string{"Intel"}, step: 3},
+		{name: "project when no global", pSlug: "lfn/onap", dt: date(2016, 6, 1), expected: []string{"VMware"}, step: 1},
+		{name: "default same foundation", pSlug: "hyperledger/fabric", dt: date(2016, 6, 1), expected: []string{"Red Hat"}, step: 4},
+		{name: "default never any", pSlug: "odpi/egeria", dt: date(2016, 6, 1), step: 0},
+	}
+	for index, test := range testCases {
+		got, expl := s.ResolveAffiliations(test.pSlug, time.Time(test.dt), false, true, rols)
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") || expl.Step != test.step {
+			t.Errorf("test number %d (%s), expected %v step %d, got %v step %d", index+1, test.name, test.expected, test.step, got, expl.Step)
+		}
+		if len(expl.Matched)+len(expl.Rejected) != len(rols) {
+			t.Errorf("test number %d (%s), expected %d candidates, got %d matched and %d rejected", index+1, test.name, len(rols), len(expl.Matched), len(expl.Rejected))
+		}
+	}
+}
+
+func TestAffiliationCache(t *testing.T) {
+	shared.GAffCacheMtx.Lock()
+	shared.GAffCache = map[string]map[string]*shared.AffCacheEntry{
+		"u1": {
+			"k1": {Orgs: []string{"Intel"}, Tm: time.Now()},
+			"k2": {Orgs: []string{"Intel", "CNCF"}, Tm: time.Now()},
+		},
+		"u2": {
+			"k1": {Orgs: []string{"Google"}, Tm: time.Now()},
+		},
+	}
+	shared.GAffCacheN = 3
+	shared.GAffCacheHits, shared.GAffCacheMisses, shared.GAffCacheInvalidations, shared.GAffCacheEvictions = 3, 1, 0, 0
+	shared.GAffCacheMtx.Unlock()
+	defer func() {
+		shared.GAffCacheMtx.Lock()
+		shared.GAffCache = map[string]map[string]*shared.AffCacheEntry{}
+		shared.GAffCacheN = 0
+		shared.GAffCacheHits, shared.GAffCacheMisses, shared.GAffCacheInvalidations, shared.GAffCacheEvictions = 0, 0, 0, 0
+		shared.GAffCacheMtx.Unlock()
+	}()
+	s := shdb.New(nil, nil, "api-test")
+	stats := s.GetAffiliationCacheStats()
+	if stats.Entries != 3 || stats.Uuids != 2 || stats.HitRatio != 0.75 {
+		t.Errorf("expected 3 entries for 2 uuids and 0.75 hit ratio, got %+v", stats)
+	}
+	s.InvalidateAffiliationCache("u1", "u3")
+	stats = s.GetAffiliationCacheStats()
+	if stats.Entries != 1 || stats.Uuids != 1 || stats.Invalidations != 2 {
+		t.Errorf("expected 1 entry and 2 invalidations after invalidating u1, got %+v", stats)
+	}
+	s.InvalidateAffiliationCache()
+	stats = s.GetAffiliationCacheStats()
+	if stats.Entries != 0 || stats.Uuids != 0 || stats.Invalidations != 3 {
+		t.Errorf("expected empty cache and 3 invalidations after dropping entire cache, got %+v", stats)
+	}
+}
+
+func TestInferAffiliationsFromDomains(t *testing.T) {
+	orgDomains := []*models.DomainDataOutput{
+		{Name: "intel.com", OrganizationName: "Intel", IsTopDomain: true},
+		{Name: "redhat.com", OrganizationName: "Red Hat"},
+		{Name: "cloud.google.com", OrganizationName: "Google Cloud"},
+		{Name: "google.com", OrganizationName: "Google", IsTopDomain: true},
+	}
+	var testCases = []struct {
+		name     string
+		domains  []string
+		single   bool
+		expected string
+		used     string
+	}{
+		{name: "exact", domains: []string{"intel.com"}, expected: "Intel", used: "intel.com"},
+		{name: "top domain", domains: []string{"linux.intel.com"}, expected: "Intel", used: "intel.com"},
+		{name: "not top domain", domains: []string{"people.redhat.com"}},
+		{name: "exact wins", domains: []string{"cloud.google.com"}, expected: "Google Cloud", used: "cloud.google.com"},
+		{name: "longest top domain", domains: []string{"x.cloud.google.com"}, expected: "Google", used: "google.com"},
+		{name: "multi", domains: []string{"redhat.com", "gmail.com", "Linux.Intel.com"}, expected: "Red Hat,Intel", used: "redhat.com,intel.com"},
+		{name: "single", domains: []string{"redhat.com", "intel.com"}, single: true, expected: "Red Hat", used: "redhat.com"},
+		{name: "unknown", domains: []string{"gmail.com", "com"}},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		orgs, used := s.InferAffiliationsFromDomains(test.domains, orgDomains, test.single)
+		if strings.Join(orgs, ",") != test.expected || strings.Join(used, ",") != test.used {
+			t.Errorf("test number %d (%s), expected %s (%s), got %v (%v)", index+1, test.name, test.expected, test.used, orgs, used)
+		}
+	}
+}
+
+func TestAsOfEnrollments(t *testing.T) {
+	tm := func(y int) *time.Time {
+		dt := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+		return &dt
+	}
+	ver := func(id int64, uuid string, start int, created, archived *time.Time) *shared.AsOfEnrollment {
+		return &shared.AsOfEnrollment{
+			EnrollmentDataOutput: &models.EnrollmentDataOutput{ID: id, UUID: uuid, Start: strfmt.DateTime(*tm(start)), End: strfmt.DateTime(shared.MaxPeriodDate)},
+			CreatedAt:            created,
+			ArchivedAt:           archived,
+		}
+	}
+	asOf := *tm(2020)
+	var testCases = []struct {
+		name     string
+		versions []*shared.AsOfEnrollment
+		expected string
+	}{
+		{name: "empty"},
+		{name: "current only", versions: []*shared.AsOfEnrollment{ver(2, "u1", 2018, tm(2019), nil), ver(1, "u1", 2015, nil, nil)}, expected: "1:2015,2:2018"},
+		{name: "added after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2015, tm(2019), nil), ver(2, "u1", 2010, tm(2021), nil)}, expected: "1:2015"},
+		{name: "deleted after as of", versions: []*shared.AsOfEnrollment{ver(2, "u1", 2018, tm(2019), nil), ver(1, "u1", 2015, tm(2016), tm(2021))}, expected: "1:2015,2:2018"},
+		{name: "deleted before as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2015, tm(2016), tm(2019))}},
+		{name: "edited after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2017, tm(2016), nil), ver(1, "u1", 2012, tm(2016), tm(2022)), ver(1, "u1", 2015, tm(2016), tm(2021))}, expected: "1:2015"},
+		{name: "edited before as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2017, tm(2016), nil), ver(1, "u1", 2015, tm(2016), tm(2019))}, expected: "1:2017"},
+		{name: "created and edited after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2017, tm(2021), nil), ver(1, "u1", 2015, tm(2021), tm(2022))}},
+		{name: "moved from other uuid after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2015, tm(2016), nil), ver(1, "u2", 2015, tm(2016), tm(2021))}},
+		{name: "moved to other uuid after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2015, tm(2016), tm(2021))}, expected: "1:2015"},
+		{name: "restored after as of", versions: []*shared.AsOfEnrollment{ver(1, "u1", 2015, tm(2021), nil), ver(1, "u1", 2015, tm(2016), tm(2019))}},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := []string{}
+		for _, enrollment := range s.AsOfEnrollments("u1", asOf, test.versions) {
+			got = append(got, fmt.Sprintf("%d:%d", enrollment.ID, time.Time(enrollment.Start).Year()))
+		}
+		res := strings.Join(got, ",")
+		if res != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, res)
+		}
+	}
+}
+
+func TestEnrollmentConflicts(t *testing.T) {
+	proj := "cncf/k8s"
+	enr := func(id, orgID int64, start, end string, projectSlug *string, role string) *models.EnrollmentNestedDataOutput {
+		st, _ := time.Parse("2006-01-02", start)
+		en, _ := time.Parse("2006-01-02", end)
+		return &models.EnrollmentNestedDataOutput{
+			ID:             id,
+			OrganizationID: orgID,
+			Organization:   &models.OrganizationDataOutput{ID: orgID, Name: fmt.Sprintf("Org%d", orgID)},
+			Start:          strfmt.DateTime(st),
+			End:            strfmt.DateTime(en),
+			ProjectSlug:    projectSlug,
+			Role:           role,
+		}
+	}
+	var testCases = []struct {
+		name        string
+		enrollments []*models.EnrollmentNestedDataOutput
+		expected    string
+	}{
+		{name: "empty"},
+		{
+			name:        "no conflicts",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "1900-01-01", "2015-01-01", nil, "Contributor"), enr(2, 2, "2015-01-01", "2100-01-01", nil, "Contributor")},
+		},
+		{
+			name:        "different roles and projects do not overlap",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil, "Contributor"), enr(2, 2, "2012-01-01", "2016-01-01", nil, "Maintainer"), enr(3, 3, "2012-01-01", "2016-01-01", &proj, "Contributor")},
+		},
+		{
+			name:        "invalid ranges",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2010-01-01", nil, "Contributor"), enr(2, 1, "2012-01-01", "2011-01-01", nil, "Contributor")},
+			expected:    "invalid_range:1:2010-01-01-2010-01-01,invalid_range:2:2012-01-01-2011-01-01",
+		},
+		{
+			name:        "out of range",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "1800-01-01", "2015-01-01", nil, "Contributor")},
+			expected:    "out_of_range:1:1800-01-01-2015-01-01",
+		},
+		{
+			name:        "duplicates",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(3, 1, "2010-01-01", "2015-01-01", nil, "Contributor"), enr(1, 1, "2010-01-01", "2015-01-01", nil, "Contributor"), enr(2, 1, "2010-01-01", "2015-01-01", &proj, "Contributor")},
+			expected:    "duplicate:1,3:2010-01-01-2015-01-01",
+		},
+		{
+			name:        "overlap",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil, "Contributor"), enr(2, 2, "2014-01-01", "2100-01-01", nil, "Contributor")},
+			expected:    "overlap:1,2:2014-01-01-2015-01-01",
+		},
+		{
+			name:        "overlap inside",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", &proj, "Contributor"), enr(2, 2, "2011-01-01", "2012-01-01", &proj, "Contributor")},
+			expected:    "overlap:1,2:2011-01-01-2012-01-01",
+		},
+		{
+			name:        "mergeable",
+			enrollments: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2012-01-01", nil, "Contributor"), enr(2, 1, "2012-01-01", "2014-01-01", nil, "Contributor"), enr(3, 1, "2013-01-01", "2015-01-01", nil, "Contributor"), enr(4, 1, "2017-01-01", "2018-01-01", nil, "Contributor")},
+			expected:    "mergeable:1,2,3:2010-01-01-2015-01-01",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := []string{}
+		for _, conflict := range s.EnrollmentConflicts(test.enrollments) {
+			ids := []string{}
+			for _, id := range conflict.EnrollmentIds {
+				ids = append(ids, fmt.Sprintf("%d", id))
+			}
+			got = append(got, fmt.Sprintf("%s:%s:%s-%s", conflict.Kind, strings.Join(ids, ","), time.Time(conflict.Start).Format(shared.DateFormat), time.Time(conflict.End).Format(shared.DateFormat)))
+		}
+		res := strings.Join(got, ",")
+		if res != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, res)
+		}
+	}
+}
+
+func TestAffiliationGaps(t *testing.T) {
+	dt := func(s string) strfmt.DateTime {
+		d, _ := time.Parse("2006-01-02", s)
+		return strfmt.DateTime(d)
+	}
+	activity := &models.ContributorActivity{
+		UUID:          "u1",
+		Contributions: 40,
+		First:         dt("2020-01-01"),
+		Last:          dt("2020-04-29"),
+		Months: []*models.ActivityBucket{
+			{Start: dt("2020-01-01"), Contributions: 10},
+			{Start: dt("2020-02-01"), Contributions: 10},
+			{Start: dt("2020-03-01"), Contributions: 10},
+			{Start: dt("2020-04-01"), Contributions: 10},
+		},
+	}
+	var testCases = []struct {
+		name      string
+		rols      []*models.AffiliationCandidate
+		expected  string
+		uncovered float64
+	}{
+		{name: "no enrollments", expected: "2020-01-01-2020-04-30:40", uncovered: 40},
+		{
+			name:     "fully covered",
+			rols:     []*models.AffiliationCandidate{{ID: 1, Organization: "Intel", Start: dt("1900-01-01"), End: dt("2100-01-01")}},
+			expected: "",
+		},
+		{
+			name:      "partially covered",
+			rols:      []*models.AffiliationCandidate{{ID: 1, Organization: "Intel", Start: dt("2020-02-01"), End: dt("2020-04-01")}},
+			expected:  "2020-01-01-2020-02-01:10,2020-04-01-2020-04-30:10",
+			uncovered: 20,
+		},
+		{
+			name:     "other project covers via step 5",
+			rols:     []*models.AffiliationCandidate{{ID: 1, Organization: "Intel", ProjectSlug: &[]string{"lfn/onap"}[0], Start: dt("1900-01-01"), End: dt("2100-01-01")}},
+			expected: "",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		gaps, uncovered := s.AffiliationGaps("cncf/k8s", activity, test.rols)
+		got := []string{}
+		for _, gap := range gaps {
+			got = append(got, fmt.Sprintf("%s-%s:%v", time.Time(gap.Start).Format(shared.DateFormat), time.Time(gap.End).Format(shared.DateFormat), gap.Contributions))
+		}
+		res := strings.Join(got, ",")
+		if res != test.expected || uncovered != test.uncovered {
+			t.Errorf("test number %d (%s), expected %s (%v), got %s (%v)", index+1, test.name, test.expected, test.uncovered, res, uncovered)
+		}
+	}
+}
+
+func TestParseEnrollmentsCSV(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		csv      string
+		expected string
+		err      bool
+	}{
+		{name: "empty", csv: "", err: true},
+		{name: "missing organization column", csv: "email,start\nx@y.com,2010-01-01\n", err: true},
+		{name: "missing identity column", csv: "organization,start\nIntel,2010-01-01\n", err: true},
+		{name: "header only", csv: "email,organization\n"},
+		{
+			name:     "defaults",
+			csv:      "Email, Organization\njohn@intel.com,Intel\n",
+			expected: "2:john@intel.com::Intel:1900-01-01-2100-01-01::Contributor:",
+		},
+		{
+			name:     "all columns any order",
+			csv:      "role,project_slug,end,start,org,username,source,email,uuid\nmaintainer,cncf/k8s,2015-06,2010,Intel,jdoe,github,,u1\n",
+			expected: "2:u1:github/jdoe:Intel:2010-01-01-2015-06-01:cncf/k8s:Maintainer:",
+		},
+		{
+			name: "invalid rows",
+			csv:  "email,username,organization,start,end,role\n,,Intel,,,\nx@y.com,,,,,\nx@y.com,,Intel,bad,,\nx@y.com,,Intel,,2010-13-01,\nx@y.com,,Intel,,,Boss\n,jdoe,Intel\n",
+			expected: "2:::Intel:1900-01-01-2100-01-01::Contributor:invalid," +
+				"3:x@y.com:::1900-01-01-2100-01-01::Contributor:invalid," +
+				"4:x@y.com::Intel:1900-01-01-2100-01-01::Contributor:invalid," +
+				"5:x@y.com::Intel:1900-01-01-2100-01-01::Contributor:invalid," +
+				"6:x@y.com::Intel:1900-01-01-2100-01-01::Contributor:invalid," +
+				"7::/jdoe:Intel:1900-01-01-2100-01-01::Contributor:",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		rows, err := s.ParseEnrollmentsCSV(strings.NewReader(test.csv))
+		if (err != nil) != test.err {
+			t.Errorf("test number %d (%s), expected error %v, got %v", index+1, test.name, test.err, err)
+			continue
+		}
+		got := []string{}
+		for _, row := range rows {
+			uuid := row.UUID
+			if uuid == "" {
+				uuid = row.Email
+			}
+			user := ""
+			if row.Username != "" {
+				user = row.Source + "/" + row.Username
+			}
+			got = append(
+				got,
+				fmt.Sprintf(
+					"%d:%s:%s:%s:%s-%s:%s:%s:%s",
+					row.Row,
+					uuid,
+					user,
+					row.Organization,
+					time.Time(row.Start).Format(shared.DateFormat),
+					time.Time(row.End).Format(shared.DateFormat),
+					row.ProjectSlug,
+					row.Role,
+					row.Action,
+				),
+			)
+		}
+		res := strings.Join(got, ",")
+		if res != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, res)
+		}
+	}
+}
+
+func TestEnrollmentImportAction(t *testing.T) {
+	proj := "cncf/k8s"
+	enr := func(orgID int64, start, end string, projectSlug *string, role string) *models.EnrollmentDataOutput {
+		st, _ := time.Parse("2006-01-02", start)
+		en, _ := time.Parse("2006-01-02", end)
+		return &models.EnrollmentDataOutput{
+			UUID:           "u1",
+			OrganizationID: orgID,
+			Start:          strfmt.DateTime(st),
+			End:            strfmt.DateTime(en),
+			ProjectSlug:    projectSlug,
+			Role:           role,
+		}
+	}
+	var testCases = []struct {
+		name        string
+		enrollment  *models.EnrollmentDataOutput
+		enrollments []*models.EnrollmentDataOutput
+		expected    string
+	}{
+		{name: "no enrollments", enrollment: enr(1, "2010-01-01", "2015-01-01", nil, "Contributor"), expected: "create"},
+		{
+			name:        "disjoint",
+			enrollment:  enr(1, "2010-01-01", "2015-01-01", nil, "Contributor"),
+			enrollments: []*models.EnrollmentDataOutput{enr(1, "2016-01-01", "2017-01-01", nil, "Contributor"), enr(2, "2015-01-01", "2016-01-01", nil, "Contributor")},
+			expected:    "create",
+		},
+		{
+			name:        "duplicate",
+			enrollment:  enr(1, "2010-01-01", "2015-01-01", &proj, "Contributor"),
+			enrollments: []*models.EnrollmentDataOutput{enr(2, "2012-01-01", "2013-01-01", &proj, "Contributor"), enr(1, "2010-01-01", "2015-01-01", &proj, "Contributor")},
+			expected:    "duplicate",
+		},
+		{
+			name:        "adjacent same org",
+			enrollment:  enr(1, "2010-01-01", "2015-01-01", nil, "Contributor"),
+			enrollments: []*models.EnrollmentDataOutput{enr(1, "2015-01-01", "2100-01-01", nil, "Contributor")},
+			expected:    "merge",
+		},
+		{
+			name:        "overlapping other org",
+			enrollment:  enr(1, "2010-01-01", "2015-01-01", nil, "Contributor"),
+			enrollments: []*models.EnrollmentDataOutput{enr(1, "2014-01-01", "2016-01-01", nil, "Contributor"), enr(2, "2014-06-01", "2100-01-01", nil, "Contributor")},
+			expected:    "conflict",
+		},
+		{
+			name:        "other project and role ignored",
+			enrollment:  enr(1, "2010-01-01", "2015-01-01", nil, "Contributor"),
+			enrollments: []*models.EnrollmentDataOutput{enr(2, "1900-01-01", "2100-01-01", &proj, "Contributor"), enr(2, "1900-01-01", "2100-01-01", nil, "Maintainer"), enr(1, "2010-01-01", "2015-01-01", &proj, "Contributor")},
+			expected:    "create",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got, _ := s.EnrollmentImportAction(test.enrollment, test.enrollments)
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestEnrollmentRestoreChanges(t *testing.T) {
+	proj := "cncf/k8s"
+	roster := "company_roster"
+	enr := func(id, orgID int64, start, end string, projectSlug *string) *models.EnrollmentNestedDataOutput {
+		st, _ := time.Parse("2006-01-02", start)
+		en, _ := time.Parse("2006-01-02", end)
+		return &models.EnrollmentNestedDataOutput{
+			ID:             id,
+			UUID:           "u1",
+			OrganizationID: orgID,
+			Start:          strfmt.DateTime(st),
+			End:            strfmt.DateTime(en),
+			ProjectSlug:    projectSlug,
+			Role:           "Contributor",
+		}
+	}
+	withProvenance := func(rol *models.EnrollmentNestedDataOutput) *models.EnrollmentNestedDataOutput {
+		rol.Provenance = &roster
+		return rol
+	}
+	upper := "CNCF/K8S"
+	var testCases = []struct {
+		name     string
+		archived []*models.EnrollmentNestedDataOutput
+		current  []*models.EnrollmentNestedDataOutput
+		locked   map[int64]string
+		expected string
+	}{
+		{name: "deleted", archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)}, expected: "add:"},
+		{
+			name:     "unchanged",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", &proj)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", &upper)},
+			expected: "unchanged:",
+		},
+		{
+			name:     "edited",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{withProvenance(enr(1, 2, "2010-01-01", "2016-01-01", nil))},
+			expected: "replace:organization,end,provenance",
+		},
+		{
+			name:     "conflict",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(2, 1, "2010-01-01", "2015-01-01", nil)},
+			expected: "conflict:",
+		},
+		{
+			name:     "swapped enrollments are not conflicts",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil), enr(2, 2, "2015-01-01", "2100-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(1, 2, "2015-01-01", "2100-01-01", nil), enr(2, 1, "2010-01-01", "2015-01-01", nil)},
+			expected: "replace:organization,start,end;replace:organization,start,end",
+		},
+		{
+			name:     "locked edited",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2016-01-01", nil)},
+			locked:   map[int64]string{1: "curator"},
+			expected: "conflict:end",
+		},
+		{
+			name:     "locked unchanged",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil)},
+			locked:   map[int64]string{1: "curator"},
+			expected: "unchanged:",
+		},
+		{
+			name:     "swapped locked enrollment",
+			archived: []*models.EnrollmentNestedDataOutput{enr(1, 1, "2010-01-01", "2015-01-01", nil), enr(2, 2, "2015-01-01", "2100-01-01", nil)},
+			current:  []*models.EnrollmentNestedDataOutput{enr(1, 2, "2015-01-01", "2100-01-01", nil), enr(2, 1, "2010-01-01", "2015-01-01", nil)},
+			locked:   map[int64]string{2: "curator"},
+			expected: "conflict:;conflict:organization,start,end",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := []string{}
+		for _, change := range s.EnrollmentRestoreChanges(test.archived, test.current, test.locked) {
+			got = append(got, change.Action+":"+strings.Join(change.Fields, ","))
+		}
+		if strings.Join(got, ";") != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, strings.Join(got, ";"))
+		}
+	}
+}
+
+func TestEnrollmentSplitChanges(t *testing.T) {
+	proj := "cncf/k8s"
+	enr := func(id, orgID int64, start, end string, projectSlug *string) *models.EnrollmentDataOutput {
+		st, _ := time.Parse("2006-01-02", start)
+		en, _ := time.Parse("2006-01-02", end)
+		return &models.EnrollmentDataOutput{
+			ID:             id,
+			UUID:           "u1",
+			OrganizationID: orgID,
+			Start:          strfmt.DateTime(st),
+			End:            strfmt.DateTime(en),
+			ProjectSlug:    projectSlug,
+			Role:           "Contributor",
+		}
+	}
+	maintainer := func(rol *models.EnrollmentDataOutput) *models.EnrollmentDataOutput {
+		rol.Role = "Maintainer"
+		return rol
+	}
+	upper := "CNCF/K8S"
+	var testCases = []struct {
+		name       string
+		enrollment *models.EnrollmentDataOutput
+		current    []*models.EnrollmentDataOutput
+		locked     map[int64]string
+		expected   string
+	}{
+		{name: "no enrollments", enrollment: enr(0, 1, "2019-06-01", "2100-01-01", nil), expected: ""},
+		{
+			name:       "truncate end",
+			enrollment: enr(0, 1, "2019-06-01", "2100-01-01", nil),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "1900-01-01", "2100-01-01", nil)},
+			expected:   "1:truncate:1900-01-01..2019-06-01",
+		},
+		{
+			name:       "truncate start",
+			enrollment: enr(0, 1, "1900-01-01", "2015-01-01", nil),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", nil)},
+			expected:   "1:truncate:2015-01-01..2020-01-01",
+		},
+		{
+			name:       "split",
+			enrollment: enr(0, 1, "2012-01-01", "2014-01-01", &proj),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", &upper)},
+			expected:   "1:split:2010-01-01..2012-01-01,2014-01-01..2020-01-01",
+		},
+		{
+			name:       "delete",
+			enrollment: enr(0, 1, "2010-01-01", "2020-01-01", nil),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", nil), enr(2, 3, "2012-01-01", "2013-01-01", nil)},
+			expected:   "1:delete:;2:delete:",
+		},
+		{
+			name:       "same organization, other project, adjacent and disjoint are not changed",
+			enrollment: enr(0, 1, "2010-01-01", "2020-01-01", nil),
+			current: []*models.EnrollmentDataOutput{
+				enr(1, 1, "2000-01-01", "2015-01-01", nil),
+				enr(2, 2, "2000-01-01", "2015-01-01", &proj),
+				enr(3, 2, "2000-01-01", "2010-01-01", nil),
+				enr(4, 2, "2020-01-01", "2100-01-01", nil),
+			},
+			expected: "",
+		},
+		{
+			name:       "other role is not changed",
+			enrollment: maintainer(enr(0, 1, "2012-01-01", "2014-01-01", nil)),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", nil), maintainer(enr(2, 3, "2010-01-01", "2013-01-01", nil))},
+			expected:   "2:truncate:2010-01-01..2012-01-01",
+		},
+		{
+			name:       "locked overlapping enrollment is a conflict",
+			enrollment: enr(0, 1, "2012-01-01", "2014-01-01", nil),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", nil), enr(2, 3, "2013-01-01", "2100-01-01", nil)},
+			locked:     map[int64]string{2: "lgryglicki"},
+			expected:   "error:enrollment 2 (organization 3, 2013-01-01 - 2100-01-01) overlapping added one is locked by lgryglicki",
+		},
+		{
+			name:       "locked enrollment not overlapping is not a conflict",
+			enrollment: enr(0, 1, "2012-01-01", "2014-01-01", nil),
+			current:    []*models.EnrollmentDataOutput{enr(1, 2, "2010-01-01", "2020-01-01", nil), enr(2, 3, "2014-01-01", "2100-01-01", nil)},
+			locked:     map[int64]string{2: "lgryglicki"},
+			expected:   "1:split:2010-01-01..2012-01-01,2014-01-01..2020-01-01",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := []string{}
+		changes, err := s.EnrollmentSplitChanges(test.enrollment, test.current, test.locked)
+		if err != nil {
+			if !strings.HasPrefix(test.expected, "error:") || !strings.Contains(err.Error(), strings.TrimPrefix(test.expected, "error:")) || changes != nil {
+				t.Errorf("test number %d (%s), expected %s, got error %v, changes %+v", index+1, test.name, test.expected, err, changes)
+			}
+			continue
+		}
+		for _, change := range changes {
+			pieces := []string{}
+			for _, piece := range change.Pieces {
+				if piece.OrganizationID != change.Original.OrganizationID || piece.ID != 0 {
+					t.Errorf("test number %d (%s), piece %+v doesn't match original %+v", index+1, test.name, piece, change.Original)
+				}
+				pieces = append(pieces, time.Time(piece.Start).Format("2006-01-02")+".."+time.Time(piece.End).Format("2006-01-02"))
+			}
+			got = append(got, fmt.Sprintf("%d:%s:%s", change.Original.ID, change.Action, strings.Join(pieces, ",")))
+		}
+		if strings.Join(got, ";") != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, strings.Join(got, ";"))
+		}
+	}
+}
+
+func TestMergeCluster(t *testing.T) {
+	prof := func(uuid, name string) *models.MergeClusterProfile {
+		return &models.MergeClusterProfile{UUID: uuid, Profile: &models.ProfileDataOutput{UUID: uuid, Name: &name}}
+	}
+	locked := func(uuid, name string) *models.MergeClusterProfile {
+		p := prof(uuid, name)
+		p.LockedBy = "lgryglicki"
+		return p
+	}
+	var testCases = []struct {
+		name     string
+		key      string
+		survivor string
+		profiles []*models.MergeClusterProfile
+		expected string
+	}{
+		{
+			name:     "survivor first",
+			key:      "johndoe@examplecom@@@johndoe",
+			survivor: "b",
+			profiles: []*models.MergeClusterProfile{prof("c", "John Doe"), prof("b", "John Doe"), prof("a", "John Doe")},
+			expected: "johndoe@examplecom|johndoe|b,a,c|",
+		},
+		{
+			name:     "missing name skipped",
+			key:      "johndoe@examplecom@@@johndoe",
+			survivor: "a",
+			profiles: []*models.MergeClusterProfile{prof("a", "John Doe"), prof("b", "b-MISSING-NAME"), prof("c", "John Doe")},
+			expected: "johndoe@examplecom|johndoe|a,b,c|b",
+		},
+		{
+			name:     "redacted survivor skips all",
+			key:      "johndoe@examplecom@@@johndoe",
+			survivor: "c",
+			profiles: []*models.MergeClusterProfile{prof("a", "John Doe"), prof("b", "John Doe"), prof("c", "c-REDACTED-EMAIL")},
+			expected: "johndoe@examplecom|johndoe|c,a,b|a,b",
+		},
+		{
+			name:     "locked profile skipped",
+			key:      "johndoe@examplecom@@@johndoe",
+			survivor: "a",
+			profiles: []*models.MergeClusterProfile{prof("a", "John Doe"), locked("b", "John Doe"), prof("c", "John Doe")},
+			expected: "johndoe@examplecom|johndoe|a,b,c|b",
+		},
+		{
+			name:     "locked survivor skips all",
+			key:      "johndoe@examplecom@@@johndoe",
+			survivor: "b",
+			profiles: []*models.MergeClusterProfile{prof("a", "John Doe"), locked("b", "John Doe"), prof("c", "John Doe")},
+			expected: "johndoe@examplecom|johndoe|b,a,c|a,c",
+		},
+		{
+			name:     "no profile and no name",
+			key:      "johndoe@examplecom",
+			survivor: "a",
+			profiles: []*models.MergeClusterProfile{{UUID: "b"}, {UUID: "a"}},
+			expected: "johndoe@examplecom||a,b|",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		cluster := s.MergeCluster(test.key, test.survivor, test.profiles)
+		got := strings.Join([]string{cluster.Email, cluster.Name, strings.Join(cluster.Uuids, ","), strings.Join(cluster.Skipped, ",")}, "|")
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestJaroWinkler(t *testing.T) {
+	var testCases = []struct {
+		a        string
+		b        string
+		expected string
+	}{
+		{a: "", b: "", expected: "1.000"},
+		{a: "abc", b: "", expected: "0.000"},
+		{a: "abc", b: "xyz", expected: "0.000"},
+		{a: "lukasz", b: "lukasz", expected: "1.000"},
+		{a: "martha", b: "marhta", expected: "0.961"},
+		{a: "dwayne", b: "duane", expected: "0.840"},
+		{a: "dixon", b: "dicksonx", expected: "0.813"},
+	}
+	s := &shared.ServiceStruct{}
+	for index, test := range testCases {
+		got := fmt.Sprintf("%.3f", s.JaroWinkler(test.a, test.b))
+		if got != test.expected {
+			t.Errorf("test number %d (%s, %s), expected %s, got %s", index+1, test.a, test.b, test.expected, got)
+		}
+		// Similarity is symmetric
+		got = fmt.Sprintf("%.3f", s.JaroWinkler(test.b, test.a))
+		if got != test.expected {
+			t.Errorf("test number %d (%s, %s), expected reversed %s, got %s", index+1, test.a, test.b, test.expected, got)
+		}
+	}
+}
+
+func TestMergeSuggestionScore(t *testing.T) {
+	str := func(s string) *string {
+		return &s
+	}
+	identity := func(source, name, email, username string) *models.IdentityDataOutput {
+		return &models.IdentityDataOutput{Source: source, Name: str(name), Email: str(email), Username: str(username)}
+	}
+	prof := func(name string, orgs []string, identities ...*models.IdentityDataOutput) *models.MergeSuggestionProfile {
+		return &models.MergeSuggestionProfile{Name: str(name), Identities: identities, Organizations: orgs}
+	}
+	var testCases = []struct {
+		name     string
+		a        *models.MergeSuggestionProfile
+		b        *models.MergeSuggestionProfile
+		expected string
+	}{
+		{name: "nothing in common", a: prof("Alice Smith", nil), b: prof("Bob Jones", nil), expected: "0.00:"},
+		{
+			name:     "same email",
+			a:        prof("Alice Smith", nil, identity("git", "Alice Smith", "Alice@a.com", "")),
+			b:        prof("A. S.", nil, identity("gerrit", "a s", "alice@a.com ", "")),
+			expected: "0.90:same email 'alice@a.com'",
+		},
+		{
+			name:     "transliterated name and organization",
+			a:        prof("Łukasz Gryglicki", []string{"CNCF", "Intel"}),
+			b:        prof("Lukasz Gryglicki", []string{"CNCF"}),
+			expected: "0.56:same name 'lukasz gryglicki';shared organizations: CNCF",
+		},
+		{
+			name:     "username across sources, local part and reversed name",
+			a:        prof("Gryglicki Lukasz", nil, identity("github", "", "lgryglicki@cncf.io", "LGryglicki")),
+			b:        prof("Lukasz Gryglicki", nil, identity("git", "", "lgryglicki@o2.pl", "lgryglicki")),
+			expected: "0.87:same username 'lgryglicki' (git, github);same email local part 'lgryglicki';same name 'gryglicki lukasz'",
+		},
+		{
+			name:     "similar names",
+			a:        prof("Jonathan Smith", nil),
+			b:        prof("Jonathon Smith", nil),
+			expected: "0.44:similar names 'jonathan smith' and 'jonathon smith' (0.97)",
+		},
+		{
+			name:     "missing names are ignored",
+			a:        prof("x-MISSING-NAME", nil),
+			b:        prof("x-MISSING-NAME", nil),
+			expected: "0.00:",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		score, reasons := s.MergeSuggestionScore(test.a, test.b)
+		got := fmt.Sprintf("%.2f:%s", score, strings.Join(reasons, ";"))
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestUnmergeProfile(t *testing.T) {
+	str := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+	bot := func(b int64) *int64 {
+		return &b
+	}
+	prof := func(name, email, cc string, isBot *int64) *models.ProfileDataOutput {
+		return &models.ProfileDataOutput{Name: str(name), Email: str(email), CountryCode: str(cc), IsBot: isBot}
+	}
+	dump := func(p *models.ProfileDataOutput) string {
+		s := func(v *string) string {
+			if v == nil {
+				return "-"
+			}
+			return *v
+		}
+		b := "-"
+		if p.IsBot != nil {
+			b = fmt.Sprintf("%d", *p.IsBot)
+		}
+		return fmt.Sprintf("%s,%s,%s,%s", s(p.Name), s(p.Email), s(p.CountryCode), b)
+	}
+	var testCases = []struct {
+		name         string
+		to           *models.ProfileDataOutput
+		archivedTo   *models.ProfileDataOutput
+		archivedFrom *models.ProfileDataOutput
+		expected     string
+	}{
+		{
+			name:         "nothing copied by merge",
+			to:           prof("Lukasz", "lg@cncf.io", "PL", bot(0)),
+			archivedTo:   prof("Lukasz", "lg@cncf.io", "PL", bot(0)),
+			archivedFrom: prof("Lukasz G", "lg@o2.pl", "US", bot(0)),
+			expected:     "Lukasz,lg@cncf.io,PL,0:",
+		},
+		{
+			name:         "all fields copied by merge",
+			to:           prof("Lukasz G", "lg@o2.pl", "US", bot(1)),
+			archivedTo:   prof("", "", "", nil),
+			archivedFrom: prof("Lukasz G", "lg@o2.pl", "US", bot(1)),
+			expected:     "-,-,-,0:name,email,country_code,is_bot",
+		},
+		{
+			name:         "field edited after merge is kept",
+			to:           prof("Lukasz Gryglicki", "lg@o2.pl", "PL", bot(1)),
+			archivedTo:   prof("", "", "PL", bot(1)),
+			archivedFrom: prof("Lukasz G", "lg@o2.pl", "US", bot(1)),
+			expected:     "Lukasz Gryglicki,-,PL,1:email",
+		},
+		{
+			name:         "empty from value is not copied",
+			to:           prof("", "", "", nil),
+			archivedTo:   prof("", "", "", nil),
+			archivedFrom: prof("", "", "", bot(1)),
+			expected:     "-,-,-,-:",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		fields := s.UnmergeProfile(test.to, test.archivedTo, test.archivedFrom)
+		got := dump(test.to) + ":" + strings.Join(fields, ",")
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestResolveLineage(t *testing.T) {
+	ev := func(action, from, to string) *models.LineageEvent {
+		return &models.LineageEvent{Action: action, FromUUID: from, ToUUID: to}
+	}
+	var testCases = []struct {
+		name     string
+		uuid     string
+		events   []*models.LineageEvent
+		expected string
+	}{
+		{
+			name:     "no lineage",
+			uuid:     "a",
+			events:   []*models.LineageEvent{},
+			expected: "a:",
+		},
+		{
+			name:     "old uuid merged",
+			uuid:     "a",
+			events:   []*models.LineageEvent{ev("merge", "a", "b")},
+			expected: "b:",
+		},
+		{
+			name:     "survivor ancestors",
+			uuid:     "b",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("merge", "c", "b")},
+			expected: "b:a,c",
+		},
+		{
+			name:     "transitive merges",
+			uuid:     "b",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("merge", "b", "c"), ev("merge", "d", "a")},
+			expected: "c:a,d",
+		},
+		{
+			name:     "old uuid merged transitively",
+			uuid:     "a",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("merge", "b", "c")},
+			expected: "c:",
+		},
+		{
+			name:     "unmerged",
+			uuid:     "a",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("unmerge", "a", "b")},
+			expected: "a:",
+		},
+		{
+			name:     "unarchived",
+			uuid:     "b",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("unarchive", "a", "b"), ev("merge", "c", "b")},
+			expected: "b:c",
+		},
+		{
+			name:     "identity moved to merged uuid recreates it",
+			uuid:     "a",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("move", "b", "a")},
+			expected: "a:",
+		},
+		{
+			name:     "merged back and forth",
+			uuid:     "a",
+			events:   []*models.LineageEvent{ev("merge", "a", "b"), ev("move", "b", "a"), ev("merge", "b", "a")},
+			expected: "a:b",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		survivor, ancestors := s.ResolveLineage(test.uuid, test.events)
+		got := survivor + ":" + strings.Join(ancestors, ",")
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestQuietShare(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		hours    [24]int64
+		expected string
+	}{
+		{name: "no activity", expected: "0.00"},
+		{name: "uniform", hours: [24]int64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, expected: "0.33"},
+		{name: "office hours", hours: [24]int64{0, 0, 0, 0, 0, 0, 0, 1, 5, 9, 9, 8, 4, 8, 9, 9, 7, 3, 1, 0, 0, 0, 0, 0}, expected: "0.00"},
+		{name: "night owl across midnight", hours: [24]int64{6, 4, 2, 1, 0, 0, 0, 0, 0, 0, 0, 1, 2, 2, 3, 3, 3, 4, 4, 5, 5, 6, 7, 8}, expected: "0.02"},
+		{name: "mostly uniform", hours: [24]int64{2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3}, expected: "0.25"},
+	}
+	s := &shared.ServiceStruct{}
+	for index, test := range testCases {
+		got := fmt.Sprintf("%.2f", s.QuietShare(test.hours, 8))
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestBotScore(t *testing.T) {
+	str := func(s string) *string {
+		return &s
+	}
+	identity := func(source, name, email, username string) *models.IdentityDataOutput {
+		return &models.IdentityDataOutput{Source: source, Name: str(name), Email: str(email), Username: str(username)}
+	}
+	var testCases = []struct {
+		name       string
+		suggestion *models.BotSuggestion
+		expected   string
+	}{
+		{
+			name:       "person",
+			suggestion: &models.BotSuggestion{Name: str("Lukasz Gryglicki"), Email: str("lukaszgryglicki@o2.pl"), Identities: []*models.IdentityDataOutput{identity("github", "Lukasz Gryglicki", "", "lukaszgryglicki")}},
+			expected:   "0.00:",
+		},
+		{
+			name:       "name ending with bot",
+			suggestion: &models.BotSuggestion{Name: str("Jan Talbot")},
+			expected:   "0.40:name ending with 'bot' 'jan talbot'",
+		},
+		{
+			name:       "known bot",
+			suggestion: &models.BotSuggestion{Identities: []*models.IdentityDataOutput{identity("github", "", "49699333+dependabot[bot]@users.noreply.github.com", "dependabot[bot]")}},
+			expected:   "1.00:known bot 'dependabot[bot]';bot name 'dependabot[bot]';automation keyword 'dependabot'",
+		},
+		{
+			name:       "ci robot",
+			suggestion: &models.BotSuggestion{Name: str("acme-ci-robot")},
+			expected:   "0.94:bot name 'acme-ci-robot';automation keyword 'ci'",
+		},
+		{
+			name:       "noreply email",
+			suggestion: &models.BotSuggestion{Email: str("no-reply@acme.com")},
+			expected:   "0.50:noreply email 'no-reply'",
+		},
+		{
+			name:       "github noreply email of a person",
+			suggestion: &models.BotSuggestion{Email: str("1234+lukaszgryglicki@users.noreply.github.com")},
+			expected:   "0.00:",
+		},
+		{
+			name: "activity",
+			suggestion: &models.BotSuggestion{
+				Name:     str("Release Manager"),
+				Activity: &models.BotActivity{Contributions: 40000, ActiveDays: 900, MaxDaily: 450, ActiveHours: 24, QuietShare: 0.3},
+			},
+			expected: "0.82:24/7 cadence (30% of contributions in the quietest 8 hours);burst of 450 contributions in a single day;44 contributions per active day",
+		},
+		{
+			name: "busy person",
+			suggestion: &models.BotSuggestion{
+				Name:     str("Busy Person"),
+				Activity: &models.BotActivity{Contributions: 9000, ActiveDays: 1500, MaxDaily: 120, ActiveHours: 24, QuietShare: 0.03},
+			},
+			expected: "0.00:",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		s.BotScore(test.suggestion)
+		got := fmt.Sprintf("%.2f:%s", test.suggestion.Score, strings.Join(test.suggestion.Reasons, ";"))
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestProfileFiltersWhere(t *testing.T) {
+	yes := true
+	no := false
+	from := strfmt.DateTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	to := strfmt.DateTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	var testCases = []struct {
+		name    string
+		filters *models.ProfileFilters
+		cond    string
+		nArgs   int
+		order   string
+		err     bool
+	}{
+		{name: "no filters", order: "u.uuid"},
+		{name: "empty filters", filters: &models.ProfileFilters{}, order: "u.uuid"},
+		{
+			name:    "source and country",
+			filters: &models.ProfileFilters{Source: "github", CountryCode: "pl"},
+			cond:    " and exists (select 1 from identities fi where fi.uuid = u.uuid and fi.source = ?) and p.country_code = ?",
+			nArgs:   2,
+			order:   "u.uuid",
+		},
+		{
+			name:    "organization",
+			filters: &models.ProfileFilters{Organization: "CNCF", OrganizationAt: &from},
+			cond:    " and exists (select 1 from enrollments fe, organizations fo where fe.organization_id = fo.id and fe.uuid = u.uuid and lower(fo.name) = lower(?) and fe.start <= ? and fe.end > ?)",
+			nArgs:   3,
+			order:   "u.uuid",
+		},
+		{
+			name:    "bot without enrollments",
+			filters: &models.ProfileFilters{IsBot: &yes, HasEnrollments: &no},
+			cond:    " and coalesce(p.is_bot, 0) = ? and not exists (select 1 from enrollments fe where fe.uuid = u.uuid)",
+			nArgs:   1,
+			order:   "u.uuid",
+		},
+		{
+			name:    "project enrollments",
+			filters: &models.ProfileFilters{HasEnrollments: &yes, ProjectSlug: "cncf/k8s"},
+			cond:    " and exists (select 1 from enrollments fe where fe.uuid = u.uuid) and exists (select 1 from enrollments fe where fe.uuid = u.uuid and fe.project_slug = ?)",
+			nArgs:   1,
+			order:   "u.uuid",
+		},
+		{
+			name:    "last modified range and user sorted",
+			filters: &models.ProfileFilters{LastModifiedFrom: &from, LastModifiedTo: &to, LastModifiedBy: "lgryglicki", Sort: "-last_modified"},
+			cond:    " and u.last_modified >= ? and u.last_modified < ? and (u.last_modified_by = ? or p.last_modified_by = ?)",
+			nArgs:   4,
+			order:   "max(u.last_modified) desc, u.uuid",
+		},
+		{name: "sort by name", filters: &models.ProfileFilters{Sort: "name"}, order: "max(p.name), u.uuid"},
+		{name: "sort by uuid descending", filters: &models.ProfileFilters{Sort: "-uuid"}, order: "u.uuid desc"},
+		{name: "unknown sort", filters: &models.ProfileFilters{Sort: "is_bot"}, err: true},
+		{name: "empty range", filters: &models.ProfileFilters{LastModifiedFrom: &to, LastModifiedTo: &from}, err: true},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		cond, args, order, err := s.ProfileFiltersWhere(test.filters)
+		if test.err {
+			if err == nil {
+				t.Errorf("test number %d (%s), expected error, got nil", index+1, test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test number %d (%s), unexpected error %v", index+1, test.name, err)
+			continue
+		}
+		if cond != test.cond || len(args) != test.nArgs || order != test.order {
+			t.Errorf("test number %d (%s), expected (%s, %d, %s), got (%s, %d, %s)", index+1, test.name, test.cond, test.nArgs, test.order, cond, len(args), order)
+		}
+	}
+}
+
+func TestEmailHash(t *testing.T) {
+	var testCases = []struct {
+		email    string
+		expected string
+	}{
+		{email: "john.doe@example.com", expected: "836f82db99121b3481011f16b49dfa5fbc714a0d1b1b9f784a1ebbbf5b39577f"},
+		{email: "John.Doe@Example.COM", expected: "836f82db99121b3481011f16b49dfa5fbc714a0d1b1b9f784a1ebbbf5b39577f"},
+		{email: "  john.doe@example.com\t", expected: "836f82db99121b3481011f16b49dfa5fbc714a0d1b1b9f784a1ebbbf5b39577f"},
+		{email: "", expected: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := s.EmailHash(test.email)
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.email, test.expected, got)
+		}
+	}
+}
+
+func TestDataExportTerms(t *testing.T) {
+	str := func(s string) *string {
+		return &s
+	}
+	var testCases = []struct {
+		name   string
+		person *models.DataExportPerson
+		keys   string
+		values string
+	}{
+		{
+			name:   "uuid only",
+			person: &models.DataExportPerson{UUID: "u1"},
+			keys:   "u1",
+		},
+		{
+			name: "current profile and identities",
+			person: &models.DataExportPerson{
+				UUID: "u1",
+				Current: &models.UniqueIdentityNestedDataOutput{
+					Profile: &models.ProfileDataOutput{Name: str("John Doe"), Email: str("john@doe.com")},
+					Identities: []*models.IdentityDataOutput{
+						{ID: "i1", Name: str("John Doe"), Email: str(" john@doe.com "), Username: str("jdoe")},
+						{ID: "i2", Username: str("jdoe")},
+					},
+				},
+			},
+			keys:   "u1,i1,i2",
+			values: "john@doe.com,John Doe,jdoe",
+		},
+		{
+			name: "merged uuids and archived versions",
+			person: &models.DataExportPerson{
+				UUID:    "u1",
+				Lineage: &models.LineageOutput{Ancestors: []string{"u2", "u1"}},
+				ProfileVersions: []*models.ProfileVersion{
+					{
+						Profile:    &models.ProfileDataOutput{Name: str("Johnny"), Email: str("")},
+						Identities: []*models.IdentityDataOutput{{ID: "i3", Email: str("johnny@doe.com")}},
+					},
+				},
+			},
+			keys:   "u1,u2,i3",
+			values: "Johnny,johnny@doe.com",
+		},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		keys, values := s.DataExportTerms(test.person)
+		gotKeys := strings.Join(keys, ",")
+		gotValues := strings.Join(values, ",")
+		if gotKeys != test.keys || gotValues != test.values {
+			t.Errorf("test number %d (%s), expected (%s; %s), got (%s; %s)", index+1, test.name, test.keys, test.values, gotKeys, gotValues)
+		}
+	}
+}
+
+func TestSoundex(t *testing.T) {
+	var testCases = []struct {
+		word     string
+		expected string
+	}{
+		{word: "", expected: ""},
+		{word: "123", expected: ""},
+		{word: "Robert", expected: "R163"},
+		{word: "Rupert", expected: "R163"},
+		{word: "Ashcraft", expected: "A261"},
+		{word: "Tymczak", expected: "T522"},
+		{word: "Pfister", expected: "P236"},
+		{word: "Jon", expected: "J500"},
+		{word: "John", expected: "J500"},
+		{word: "Łukasz", expected: "L220"},
+	}
+	s := &shared.ServiceStruct{}
+	for index, test := range testCases {
+		got := s.Soundex(test.word)
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.word, test.expected, got)
+		}
+	}
+}
+
+func TestMergeSuggestionNameKeys(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		expected string
+	}{
+		{name: "Łukasz Nowak", expected: "lukasz nowak;~L220 N200"},
+		{name: "Nowak, Lukasz", expected: "lukasz nowak;~L220 N200"},
+		{name: "Jon Smith", expected: "jon smith;~J500 S530"},
+		{name: "John Smith", expected: "john smith;~J500 S530"},
+		{name: "lukasz", expected: ""},
+		{name: "Erased User", expected: ""},
+		{name: "lgryglicki-MISSING-NAME", expected: ""},
+		{name: "Łukasz-Nowak", expected: "lukasz nowak;~L220 N200"},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		got := strings.Join(s.MergeSuggestionNameKeys(test.name), ";")
+		if got != test.expected {
+			t.Errorf("test number %d (%s), expected %s, got %s", index+1, test.name, test.expected, got)
+		}
+	}
+}
+
+func TestGitdmRoundTrip(t *testing.T) {
+	header := "# Generated by dev-analytics-affiliation, format: 'login: email!domain, ...' followed by '<tab>Company until YYYY-MM-DD' lines\n"
+	var testCases = []struct {
+		name     string
+		format   string
+		input    string
+		expected string
+		err      bool
+	}{
+		{name: "empty", format: shared.GitdmDevelopersAffiliations, expected: header},
+		{
+			name:     "developers affiliations",
+			format:   shared.GitdmDevelopersAffiliations,
+			input:    header + "alice: alice!a.com, alice!b.com\n\tIntel until 2015-01-01\n\tCNCF\nBob:\n\tNotFound\n",
+			expected: header + "alice: alice!a.com, alice!b.com\n\tIntel until 2015-01-01\n\tCNCF\nBob:\n\tNotFound\n",
+		},
+		{
+			name:     "developers affiliations normalized",
+			format:   shared.GitdmDevelopersAffiliations,
+			input:    "# comment\n\nzed: z!z.com,z!a.com\n  (Unknown) until 2012-02\n  Intel until 2014-01-01 \n\tNotFound until 2016-01-01\n\tCNCF until 2017-01-01\nalice: alice!a.com\n\tIntel\n",
+			expected: header + "alice: alice!a.com\n\tIntel\nzed: z!a.com, z!z.com\n\tNotFound until 2012-02-01\n\tIntel until 2014-01-01\n\tNotFound until 2016-01-01\n\tCNCF until 2017-01-01\n",
+		},
+		{name: "company without login", format: shared.GitdmDevelopersAffiliations, input: "\tIntel\n", err: true},
+		{name: "missing colon", format: shared.GitdmDevelopersAffiliations, input: "alice alice!a.com\n", err: true},
+		{name: "duplicate login", format: shared.GitdmDevelopersAffiliations, input: "alice: a!a.com\nalice: b!b.com\n", err: true},
+		{name: "bad date", format: shared.GitdmDevelopersAffiliations, input: "alice: a!a.com\n\tIntel until yesterday\n", err: true},
+		{
+			name:     "github users",
+			format:   shared.GitdmGithubUsers,
+			input:    `[{"login":"alice","email":"alice!b.com","affiliation":"Intel < 2015-01-01, CNCF","name":"Alice","country_id":"pl"},{"login":"alice","email":"alice!a.com","affiliation":"","commits":12},{"login":"bob","email":"bob!b.com","affiliation":"NotFound"}]`,
+			expected: "[\n  {\n    \"login\": \"alice\",\n    \"email\": \"alice!a.com\",\n    \"affiliation\": \"Intel < 2015-01-01, CNCF\",\n    \"name\": \"Alice\",\n    \"country_id\": \"pl\"\n  },\n  {\n    \"login\": \"alice\",\n    \"email\": \"alice!b.com\",\n    \"affiliation\": \"Intel < 2015-01-01, CNCF\",\n    \"name\": \"Alice\",\n    \"country_id\": \"pl\"\n  },\n  {\n    \"login\": \"bob\",\n    \"email\": \"bob!b.com\",\n    \"affiliation\": \"NotFound\"\n  }\n]\n",
+		},
+		{name: "github users not an array", format: shared.GitdmGithubUsers, input: `{"login":"alice"}`, err: true},
+	}
+	s := shdb.New(nil, nil, "api-test")
+	for index, test := range testCases {
+		var (
+			profs []*models.AllOutput
+			err   error
+		)
+		if test.format == shared.GitdmDevelopersAffiliations {
+			profs, err = s.ParseGitdmDevelopersAffiliations(strings.NewReader(test.input))
+		} else {
+			profs, err = s.ParseGitdmGithubUsers(strings.NewReader(test.input))
+		}
+		if (err != nil) != test.err {
+			t.Errorf("test number %d (%s), expected error %v, got %v", index+1, test.name, test.err, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		var data []byte
+		if test.format == shared.GitdmDevelopersAffiliations {
+			data = s.GitdmDevelopersAffiliations(profs)
+		} else {
+			data, err = s.GitdmGithubUsers(profs)
+			if err != nil {
+				t.Errorf("test number %d (%s), unexpected error %v", index+1, test.name, err)
+				continue
+			}
+		}
+		if string(data) != test.expected {
+			t.Errorf("test number %d (%s), expected:\n%s\ngot:\n%s", index+1, test.name, test.expected, string(data))
+			continue
+		}
+		// Output must parse back into exactly the same output
+		if test.format == shared.GitdmDevelopersAffiliations {
+			profs, _ = s.ParseGitdmDevelopersAffiliations(strings.NewReader(string(data)))
+			data = s.GitdmDevelopersAffiliations(profs)
+		} else {
+			profs, _ = s.ParseGitdmGithubUsers(strings.NewReader(string(data)))
+			data, _ = s.GitdmGithubUsers(profs)
+		}
+		if string(data) != test.expected {
+			t.Errorf("test number %d (%s), round trip expected:\n%s\ngot:\n%s", index+1, test.name, test.expected, string(data))
+		}
+	}
+}
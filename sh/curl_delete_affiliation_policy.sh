@@ -0,0 +1,16 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify foundation as a 1st arg, for example cncf or default"
+  exit 3
+fi
+foundation=$(rawurlencode "${1}")
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}"
+fi
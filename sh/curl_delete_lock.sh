@@ -0,0 +1,23 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify object type (profile, identity or enrollment) as a 1st arg"
+  exit 1
+fi
+if [ -z "$2" ]
+then
+  echo "$0: please specify profile UUID, identity ID or enrollment ID as a 2nd arg"
+  exit 2
+fi
+object=$(rawurlencode "${1}")
+key=$(rawurlencode "${2}")
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/lock/${object}/${key}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/lock/${object}/${key}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XDELETE "${API_URL}/v1/affiliation/lock/${object}/${key}"
+fi
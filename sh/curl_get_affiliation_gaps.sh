@@ -0,0 +1,17 @@
+#!/bin/bash
+. ./sh/shared.sh
+rows=$(rawurlencode "${2}")
+page=$(rawurlencode "${3}")
+extra=''
+if [ ! -z "${top}" ]
+then
+  extra="&top=$(rawurlencode "${top}")"
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/affiliation_gaps?rows=${rows}&page=${page}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/affiliation_gaps?rows=${rows}&page=${page}${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/affiliation_gaps?rows=${rows}&page=${page}${extra}"
+fi
@@ -12,11 +12,25 @@ then
 fi
 uuid=$(rawurlencode "${2}")
 dt=$(rawurlencode "${3}")
+extra=''
+for prop in explain role as_of
+do
+  if [ ! -z "${!prop}" ]
+  then
+    encoded=$(rawurlencode "${!prop}")
+    if [ -z "$extra" ]
+    then
+      extra="?$prop=${encoded}"
+    else
+      extra="${extra}&$prop=${encoded}"
+    fi
+  fi
+done
 
 if [ ! -z "$DEBUG" ]
 then
-  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}"
-  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}"
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}${extra}"
 else
-  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}"
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/single/${uuid}/${dt}${extra}"
 fi
@@ -0,0 +1,29 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify UUID as a 2nd arg"
+  exit 2
+fi
+uuid=$(rawurlencode "${2}")
+for prop in start end role as_of
+do
+  if [ ! -z "${!prop}" ]
+  then
+    encoded=$(rawurlencode "${!prop}")
+    if [ -z "$extra" ]
+    then
+      extra="?$prop=${encoded}"
+    else
+      extra="${extra}&$prop=${encoded}"
+    fi
+  fi
+done
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/timeline/${uuid}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/timeline/${uuid}${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/timeline/${uuid}${extra}"
+fi
@@ -0,0 +1,22 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify profile UUID or email as a 1st arg"
+  exit 2
+fi
+if [[ "$1" == *"@"* ]]
+then
+  arg="email=$(rawurlencode "${1}")"
+else
+  arg="uuid=$(rawurlencode "${1}")"
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/data_export?${arg}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/data_export?${arg}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/data_export?${arg}"
+fi
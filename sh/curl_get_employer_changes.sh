@@ -0,0 +1,27 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify t1 as a 2nd arg (format 2015-05-05T15:15[:05Z])"
+  exit 2
+fi
+if [ -z "$3" ]
+then
+  echo "$0: please specify t2 as a 3rd arg (format 2015-05-05T15:15[:05Z])"
+  exit 3
+fi
+t1=$(rawurlencode "${2}")
+t2=$(rawurlencode "${3}")
+extra=''
+if [ ! -z "$role" ]
+then
+  extra="&role=$(rawurlencode "${role}")"
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/employer_changes?t1=${t1}&t2=${t2}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/employer_changes?t1=${t1}&t2=${t2}${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/employer_changes?t1=${t1}&t2=${t2}${extra}"
+fi
@@ -0,0 +1,15 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+extra=''
+if [ ! -z "${kind}" ]
+then
+  extra="?kind=$(rawurlencode "${kind}")"
+fi
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/enrollment_conflicts${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/enrollment_conflicts${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/enrollment_conflicts${extra}"
+fi
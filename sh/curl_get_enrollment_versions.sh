@@ -0,0 +1,21 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify profile UUID as a 2nd arg"
+  exit 2
+fi
+uuid=$(rawurlencode "${2}")
+extra=''
+if [ ! -z "${enrollment_id}" ]
+then
+  extra="?enrollment_id=$(rawurlencode "${enrollment_id}")"
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/enrollment_versions/${uuid}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/enrollment_versions/${uuid}${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/enrollment_versions/${uuid}${extra}"
+fi
@@ -0,0 +1,16 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify gitdm format as a 1st arg: developers_affiliations, github_users"
+  exit 1
+fi
+format=$(rawurlencode "${1}")
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/octet-stream' -XGET "${API_URL}/v1/affiliation/gitdm_export?format=${format}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/octet-stream' -XGET "${API_URL}/v1/affiliation/gitdm_export?format=${format}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/octet-stream' -XGET "${API_URL}/v1/affiliation/gitdm_export?format=${format}"
+fi
@@ -3,11 +3,19 @@
 q=$(rawurlencode "${2}")
 rows=$(rawurlencode "${3}")
 page=$(rawurlencode "${4}")
+extra=''
+for f in source organization organization_at country_code is_bot has_enrollments project_slug last_modified_from last_modified_to last_modified_by sort
+do
+  if [ ! -z "${!f}" ]
+  then
+    extra="${extra}&${f}=$(rawurlencode "${!f}")"
+  fi
+done
 
 if [ ! -z "$DEBUG" ]
 then
-  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}"
-  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}"
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}${extra}"
 else
-  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}"
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/list_profiles?q=${q}&rows=${rows}&page=${page}${extra}"
 fi
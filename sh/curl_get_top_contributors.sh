@@ -41,22 +41,26 @@ if [ ! -z "$9" ]
 then
   dataSource=$(rawurlencode "${9}")
 fi
+if [ ! -z "$role" ]
+then
+  role=$(rawurlencode "${role}")
+fi
 
 if [ -z "${JWT_TOKEN}" ]
 then
   if [ ! -z "$DEBUG" ]
   then
-    echo curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
-    curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
+    echo curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
+    curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
   else
-    curl -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
+    curl -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
   fi
 else
   if [ ! -z "$DEBUG" ]
   then
-    echo curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
-    curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
+    echo curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
+    curl -i -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
   else
-    curl -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}"
+    curl -s -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XGET "${API_URL}/v1/affiliation/${project}/top_contributors?from=${from}&to=${to}&limit=${limit}&offset=${offset}&search=${search}&sort_field=${sortField}&sort_order=${sortOrder}&data_source=${dataSource}&role=${role}"
   fi
 fi
@@ -14,7 +14,7 @@ uuid=$(rawurlencode "${2}")
 orgName=$(rawurlencode "${3}")
 extra=''
 
-for prop in start end merge is_project_specific role
+for prop in start end merge split is_project_specific role provenance evidence_url evidence_notes confidence
 do
   if [ ! -z "${!prop}" ]
   then
@@ -0,0 +1,16 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+payload="${1}"
+if [ -z "$payload" ]
+then
+  payload='sh/example_affiliation_batch.json'
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/json' -H 'Content-Type: application/json' -XPOST "${API_URL}/v1/affiliation/batch" -d "@${payload}"
+  curl -i -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/batch" -d "@${payload}"
+else
+  curl -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/batch" -d "@${payload}"
+fi
@@ -0,0 +1,31 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify gitdm format as a 1st arg: developers_affiliations, github_users"
+  exit 1
+fi
+if [ -z "$2" ]
+then
+  echo "$0: please specify gitdm file as a 2nd arg"
+  exit 2
+fi
+format=$(rawurlencode "${1}")
+ct='text/plain'
+if [ "$1" = "github_users" ]
+then
+  ct='application/json'
+fi
+extra=''
+if [ ! -z "$dry" ]
+then
+  extra="&dry=$(rawurlencode "${dry}")"
+fi
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/json' -H "Content-Type: ${ct}" -XPOST "${API_URL}/v1/affiliation/gitdm_import?format=${format}${extra}" --data-binary "@${2}"
+  curl -i -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H "Content-Type: ${ct}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/gitdm_import?format=${format}${extra}" --data-binary "@${2}"
+else
+  curl -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H "Content-Type: ${ct}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/gitdm_import?format=${format}${extra}" --data-binary "@${2}"
+fi
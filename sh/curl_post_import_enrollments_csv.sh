@@ -0,0 +1,20 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify CSV file as a 2nd arg"
+  exit 2
+fi
+extra=''
+if [ ! -z "$dry" ]
+then
+  extra="?dry=$(rawurlencode "${dry}")"
+fi
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/json' -H 'Content-Type: text/csv' -XPOST "${API_URL}/v1/affiliation/${project}/import_enrollments_csv${extra}" --data-binary "@${2}"
+  curl -i -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: text/csv' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/${project}/import_enrollments_csv${extra}" --data-binary "@${2}"
+else
+  curl -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: text/csv' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/${project}/import_enrollments_csv${extra}" --data-binary "@${2}"
+fi
@@ -0,0 +1,29 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+# accept and reject are comma separated lists of profile UUIDs
+if [ -z "${accept}${reject}" ]
+then
+  echo "$0: please specify accept='uuid1,uuid2' and/or reject='uuid3,uuid4' env variables"
+  exit 1
+fi
+payload='{"accept":['
+if [ ! -z "$accept" ]
+then
+  payload="${payload}\"${accept//,/\",\"}\""
+fi
+payload="${payload}],\"reject\":["
+if [ ! -z "$reject" ]
+then
+  payload="${payload}\"${reject//,/\",\"}\""
+fi
+payload="${payload}]}"
+
+if [ ! -z "$DEBUG" ]
+then
+  echo "$payload"
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -H 'Accept: application/json' -H 'Content-Type: application/json' -XPOST "${API_URL}/v1/affiliation/bot_suggestions/review" -d "${payload}"
+  curl -i -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/bot_suggestions/review" -d "${payload}"
+else
+  curl -s -H 'Accept: application/json' -H "Origin: ${ORIGIN}" -H 'Content-Type: application/json' -H "Authorization: Bearer ${JWT_TOKEN}" -XPOST "${API_URL}/v1/affiliation/bot_suggestions/review" -d "${payload}"
+fi
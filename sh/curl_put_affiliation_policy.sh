@@ -0,0 +1,22 @@
+#!/bin/bash
+export SKIP_PROJECT=1
+. ./sh/shared.sh
+if [ -z "$1" ]
+then
+  echo "$0: please specify foundation as a 1st arg, for example cncf or default"
+  exit 3
+fi
+if [ -z "$2" ]
+then
+  echo "$0: please specify steps as a 2nd arg, for example 1,2,3 or project,foundation-f,global"
+  exit 4
+fi
+foundation=$(rawurlencode "${1}")
+steps=$(rawurlencode "${2}")
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}&steps=${steps}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}&steps=${steps}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/affiliation_policy?foundation=${foundation}&steps=${steps}"
+fi
@@ -0,0 +1,30 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify profile UUID as a 2nd arg"
+  exit 2
+fi
+if [ -z "$3" ]
+then
+  echo "$0: please specify archived_at (as returned by curl_get_enrollment_versions.sh) as a 3rd arg"
+  exit 3
+fi
+uuid=$(rawurlencode "${2}")
+extra="?archived_at=$(rawurlencode "${3}")"
+
+for prop in enrollment_id dry
+do
+  if [ ! -z "${!prop}" ]
+  then
+    extra="${extra}&$prop=$(rawurlencode "${!prop}")"
+  fi
+done
+
+if [ ! -z "$DEBUG" ]
+then
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/restore_enrollments/${uuid}${extra}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/restore_enrollments/${uuid}${extra}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/restore_enrollments/${uuid}${extra}"
+fi
@@ -0,0 +1,23 @@
+#!/bin/bash
+. ./sh/shared.sh
+if [ -z "$2" ]
+then
+  echo "$0: please specify from uidentity uuid (the one that was merged) as a 2nd arg"
+  exit 3
+fi
+if [ -z "$3" ]
+then
+  echo "$0: please specify to uidentity uuid (the one it was merged into) as a 3rd arg"
+  exit 4
+fi
+from_uuid=$(rawurlencode "${2}")
+to_uuid=$(rawurlencode "${3}")
+
+if [ ! -z "$DEBUG" ]
+then
+  echo "$project $from_uuid $to_uuid"
+  echo curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/unmerge_unique_identities/${from_uuid}/${to_uuid}"
+  curl -i -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/unmerge_unique_identities/${from_uuid}/${to_uuid}"
+else
+  curl -s -H "Origin: ${ORIGIN}" -H "Authorization: Bearer ${JWT_TOKEN}" -XPUT "${API_URL}/v1/affiliation/${project}/unmerge_unique_identities/${from_uuid}/${to_uuid}"
+fi
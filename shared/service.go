@@ -44,6 +44,109 @@ const (
 	CacheTimeResolution = 10800000 // 3 hours 10,800,000 ms
 	// ESCacheTTL - used by ES query
 	ESCacheTTL = "now-3h"
+	// AffStepNone - no step of the 5-step affiliation algorithm matched
+	AffStepNone = 0
+	// AffStepProject - enrollment for the exact project slug
+	AffStepProject = 1
+	// AffStepFoundationF - enrollment for the foundation-f project slug (for example cncf/* --> cncf-f)
+	AffStepFoundationF = 2
+	// AffStepGlobal - global enrollment (project_slug is null)
+	AffStepGlobal = 3
+	// AffStepFoundation - enrollment for any project from the same foundation (for example cncf/%)
+	AffStepFoundation = 4
+	// AffStepAny - any enrollment
+	AffStepAny = 5
+	// AffStepDomain - organization inferred from profile/identities email domains using domains_organizations (optional, must be the last step)
+	// It is only used by single/multi/both/batch affiliation APIs when no enrollment matched
+	AffStepDomain = 6
+	// AffPolicyDefault - foundation name used for the default affiliation policy (applies to all foundations without their own policy)
+	AffPolicyDefault = "default"
+	// AffBatchPackSize - maximum number of UUIDs used in a single enrollments query by the batch affiliation API
+	AffBatchPackSize = 1000
+	// AffBatchMaxItems - maximum number of items accepted in a single batch affiliation API request
+	AffBatchMaxItems = 10000
+	// ErasureESIndices - ES indices whose author (and other roles) fields are anonymized by GDPR erasure
+	ErasureESIndices = "sds-*,-*-raw"
+	// ErasureESNotCovered - ES indices not anonymized by GDPR erasure: raw indices keep original upstream documents
+	// (they have no enriched role fields), this is reported on erasure receipts
+	ErasureESNotCovered = "sds-*-raw"
+	// AffGapsMaxTop - maximum number of the most active contributors (per project) checked by the affiliation gaps API
+	AffGapsMaxTop = 10000
+	// AffCacheMaxEntries - maximum number of resolved affiliations kept in the in-process affiliation cache
+	AffCacheMaxEntries = 200000
+	// EnrollmentConflictInvalidRange - enrollment with zero-length or inverted date range
+	EnrollmentConflictInvalidRange = "invalid_range"
+	// EnrollmentConflictOutOfRange - enrollment starting before MinPeriodDate or ending after MaxPeriodDate
+	EnrollmentConflictOutOfRange = "out_of_range"
+	// EnrollmentConflictDuplicate - identical global enrollments that DedupEnrollments would collapse
+	EnrollmentConflictDuplicate = "duplicate"
+	// EnrollmentConflictOverlap - overlapping enrollments of different organizations for the same project and role
+	EnrollmentConflictOverlap = "overlap"
+	// EnrollmentConflictMergeable - overlapping or adjacent enrollments of the same organization for the same project and role
+	EnrollmentConflictMergeable = "mergeable"
+	// EnrollmentImportCreate - CSV import row will add a new enrollment
+	EnrollmentImportCreate = "create"
+	// EnrollmentImportMerge - CSV import row overlaps or is adjacent to the same organization enrollment and will be merged with it
+	EnrollmentImportMerge = "merge"
+	// EnrollmentImportDuplicate - CSV import row is identical to an existing (or earlier row's) enrollment, nothing to do
+	EnrollmentImportDuplicate = "duplicate"
+	// EnrollmentImportConflict - CSV import row overlaps a different organization enrollment or matches more than one profile, skipped
+	EnrollmentImportConflict = "conflict"
+	// EnrollmentImportUnknownProfile - CSV import row doesn't match any profile, skipped
+	EnrollmentImportUnknownProfile = "unknown_profile"
+	// EnrollmentImportUnknownOrg - CSV import row organization doesn't exist, skipped
+	EnrollmentImportUnknownOrg = "unknown_org"
+	// EnrollmentImportInvalid - CSV import row cannot be parsed or fails enrollment validation, skipped
+	EnrollmentImportInvalid = "invalid"
+	// GitdmDevelopersAffiliations - gitdm developers_affiliations*.txt format ("login: email!domain, ..." followed by "\tCompany until YYYY-MM-DD" lines)
+	GitdmDevelopersAffiliations = "developers_affiliations"
+	// GitdmGithubUsers - gitdm github_users.json format (one entry per login and email, "Company < YYYY-MM-DD, Company" affiliation string)
+	GitdmGithubUsers = "github_users"
+	// GitdmNotFound - gitdm company name used for periods without any affiliation
+	GitdmNotFound = "NotFound"
+	// ProvenanceManual - enrollment curated manually
+	ProvenanceManual = "manual"
+	// ProvenanceEmailDomain - enrollment derived from email domain (domains_organizations)
+	ProvenanceEmailDomain = "email_domain"
+	// ProvenanceCompanyRoster - enrollment imported from a company provided roster
+	ProvenanceCompanyRoster = "company_roster"
+	// ProvenanceSelfClaim - enrollment claimed by the contributor
+	ProvenanceSelfClaim = "self_claim"
+	// ProvenanceGitdm - enrollment imported from gitdm files
+	ProvenanceGitdm = "gitdm"
+	// ProvenanceInferred - enrollment inferred by the 5-step affiliation algorithm or other heuristics
+	ProvenanceInferred = "inferred"
+	// MaxConfidence - maximum enrollment confidence, confidence is 0-100, null means unknown
+	MaxConfidence = 100
+	// EnrollmentRestoreAdd - archived enrollment no longer exists and will be added back
+	EnrollmentRestoreAdd = "add"
+	// EnrollmentRestoreReplace - current enrollment differs from the archived one, it will be archived and replaced
+	EnrollmentRestoreReplace = "replace"
+	// EnrollmentRestoreUnchanged - current enrollment is the same as the archived one
+	EnrollmentRestoreUnchanged = "unchanged"
+	// EnrollmentRestoreConflict - another current enrollment has the same organization, dates and project (unique key), skipped
+	EnrollmentRestoreConflict = "conflict"
+	// EnrollmentSplitTruncate - enrollment overlapping the added one was shortened
+	EnrollmentSplitTruncate = "truncate"
+	// EnrollmentSplitSplit - enrollment overlapping the added one was split into two around it
+	EnrollmentSplitSplit = "split"
+	// EnrollmentSplitDelete - enrollment was fully covered by the added one and was removed
+	EnrollmentSplitDelete = "delete"
+	// MergeSuggestionMinScore - default minimum merge suggestion score returned by merge suggestions API
+	MergeSuggestionMinScore = 0.5
+	// MergeSuggestionMaxBlock - candidate profiles sharing the same email local part, username or name are only paired when
+	// there are at most this many of them (common values like "admin" or "John Smith" are skipped), this also keeps
+	// group_concat of their uuids within MySQL default group_concat_max_len (1024)
+	MergeSuggestionMaxBlock = 20
+	// BotSuggestionMinScore - default minimum bot suggestion score returned by bot suggestions API
+	BotSuggestionMinScore = 0.5
+	// BotSuggestionTopAuthors - bot suggestions detection checks activity patterns of this many most active ES authors
+	// (together with profiles matching bot names and emails)
+	BotSuggestionTopAuthors = 1000
+	// DataExportMaxAPILog - maximum number of API log entries returned for a single person by data export API
+	DataExportMaxAPILog = 10000
+	// ArchivedAtFormat - archive date format, archived_at has microsecond precision, so it can be used to select an archive version
+	ArchivedAtFormat = "2006-01-02T15:04:05.000000Z07:00"
 )
 
 var (
@@ -61,12 +164,47 @@ var (
 	GDA2SF map[string]string
 	// GSF2DA - map SF name to DA name
 	GSF2DA map[string]string
+	// GAffPolicyMtx - mutex protecting GAffPolicies
+	GAffPolicyMtx = &sync.Mutex{}
+	// GAffPolicies - map foundation to enabled steps of the 5-step affiliation algorithm (in order)
+	GAffPolicies map[string][]int
+	// GAffCacheMtx - mutex protecting GAffCache, GAffCachePending, GAffCacheN and affiliation cache counters
+	GAffCacheMtx = &sync.Mutex{}
+	// GAffCache - resolved affiliations cache: uuid -> project/role/mode/day/policy key -> cached orgs
+	GAffCache = map[string]map[string]*AffCacheEntry{}
+	// GAffCachePending - uuids whose cached affiliations were invalidated within a not yet finished transaction ("" means entire cache)
+	GAffCachePending = map[*sql.Tx]map[string]struct{}{}
+	// GAffCacheN - number of entries in GAffCache (sum of all uuids' entries)
+	GAffCacheN int
+	// GAffCacheHits - number of affiliation cache hits
+	GAffCacheHits int64
+	// GAffCacheMisses - number of affiliation cache misses
+	GAffCacheMisses int64
+	// GAffCacheInvalidations - number of affiliation cache entries dropped because profile's data was changed
+	GAffCacheInvalidations int64
+	// GAffCacheEvictions - number of affiliation cache entries dropped because cache was full or entry was expired
+	GAffCacheEvictions int64
+	// GEnrollmentConflictsInterval - if set, enrollment conflicts detection job runs in background with this interval
+	GEnrollmentConflictsInterval time.Duration
+	// GEnrollmentHistory - if set, every enrollment change is archived with creation time, so enrollments can be reconstructed as of any time
+	// (needs sql/add_enrollment_timestamps.sql applied), as_of is not supported when it is not set
+	GEnrollmentHistory bool
 	// MinPeriodDate - default start data for enrollments
 	MinPeriodDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
 	// MaxPeriodDate - default end date for enrollments
 	MaxPeriodDate = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
 	// Roles - all currently defined roles
 	Roles = []string{"Contributor", "Maintainer"}
+	// Provenances - all allowed enrollment provenances
+	Provenances = []string{ProvenanceManual, ProvenanceEmailDomain, ProvenanceCompanyRoster, ProvenanceSelfClaim, ProvenanceGitdm, ProvenanceInferred}
+	// AffStepNames - 5-step affiliation algorithm step names, indexed by step number
+	AffStepNames = []string{"none", "project", "foundation-f", "global", "foundation", "any", "domain"}
+	// AffDefaultSteps - steps of the 5-step affiliation algorithm used when there is no policy defined
+	AffDefaultSteps = []int{AffStepProject, AffStepFoundationF, AffStepGlobal, AffStepFoundation, AffStepAny}
+	// EnrollmentConflictKinds - all enrollment conflict kinds reported by enrollment conflicts detection
+	EnrollmentConflictKinds = []string{EnrollmentConflictInvalidRange, EnrollmentConflictOutOfRange, EnrollmentConflictDuplicate, EnrollmentConflictOverlap, EnrollmentConflictMergeable}
+	// AffCacheTTL - affiliation cache TTL (15 minutes), enrollments can also be modified by other API instances
+	AffCacheTTL = time.Duration(15) * time.Minute
 	// TopContributorsCacheTTL - top contributors cache TTL (3 hours)
 	TopContributorsCacheTTL = time.Duration(3) * time.Hour
 	// TopContributorsDataSources - defined data sources
@@ -229,8 +367,12 @@ type ServiceInterface interface {
 	RoundMSTime(int64) int64
 	JSONEscape(string) string
 	StripUnicode(string) string
+	JaroWinkler(string, string) float64
+	QuietShare([24]int64, int) float64
 	ToCaseInsensitiveRegexp(string) string
 	SpecialUnescape(string) string
+	NormalizeRole(string) (string, error)
+	CheckAffiliationBatchSize(int) error
 	SanitizeShortProfile(*models.AllOutput, bool)
 	SanitizeShortIdentity(*models.IdentityShortOutput, bool)
 	SanitizeShortEnrollment(*models.EnrollmentShortOutput, bool)
@@ -246,6 +388,7 @@ type ServiceInterface interface {
 	ListProjectsDA2SF(*models.ListProjectsOutput)
 	AllDA2SF(*models.AllArrayOutput)
 	AllSF2DA([]*models.AllOutput)
+	AffExplainDA2SF(*models.AffiliationExplainOutput)
 	ProfileNestedRollsDA2SF(*models.ProfileNestedRolls)
 }
 
@@ -253,6 +396,21 @@ type ServiceInterface interface {
 type ServiceStruct struct {
 }
 
+// AffCacheEntry - resolved affiliation cache entry
+type AffCacheEntry struct {
+	Orgs     []string
+	Inferred bool
+	Tm       time.Time
+}
+
+// AsOfEnrollment - enrollment version used to reconstruct enrollments as they were at some point in time
+// ArchivedAt is nil for the current version, CreatedAt is nil for enrollments created before creation time was tracked
+type AsOfEnrollment struct {
+	*models.EnrollmentDataOutput
+	CreatedAt  *time.Time
+	ArchivedAt *time.Time
+}
+
 // LocalProfile - to display data inside pointers
 type LocalProfile struct {
 	*models.ProfileDataOutput
@@ -294,6 +452,19 @@ func (e *LocalEnrollmentShortOutput) SortKey() (key string) {
 	if e.ProjectSlug != nil {
 		key += *(e.ProjectSlug)
 	}
+	// Provenance data is only added when present, so keys of enrollments without it don't change
+	if e.Provenance != nil {
+		key += ":" + *(e.Provenance)
+	}
+	if e.Confidence != nil {
+		key += fmt.Sprintf(":%d", *(e.Confidence))
+	}
+	if e.EvidenceURL != nil {
+		key += ":" + *(e.EvidenceURL)
+	}
+	if e.EvidenceNotes != nil {
+		key += ":" + *(e.EvidenceNotes)
+	}
 	return
 }
 
@@ -1040,6 +1211,28 @@ func (s *ServiceStruct) ToCaseInsensitiveRegexp(str string) (ret string) {
 	return ret + ".*'"
 }
 
+// NormalizeRole - returns role as defined in Roles (case insensitive match), empty role is returned as is (means any role)
+func (s *ServiceStruct) NormalizeRole(role string) (string, error) {
+	role = strings.TrimSpace(role)
+	if role == "" {
+		return role, nil
+	}
+	for _, r := range Roles {
+		if strings.EqualFold(role, r) {
+			return r, nil
+		}
+	}
+	return "", errs.Wrap(errs.New(fmt.Errorf("incorrect role '%s', allowed: %+v", role, Roles), errs.ErrBadRequest), "NormalizeRole")
+}
+
+// CheckAffiliationBatchSize - checks if a given number of affiliation batch items can be requested at once (see AffBatchMaxItems)
+func (s *ServiceStruct) CheckAffiliationBatchSize(n int) error {
+	if n > AffBatchMaxItems {
+		return errs.Wrap(errs.New(fmt.Errorf("too many items: %d, at most %d items can be requested at once", n, AffBatchMaxItems), errs.ErrBadRequest), "CheckAffiliationBatchSize")
+	}
+	return nil
+}
+
 // StripUnicode - strip special characters and remove non-ascii chars ł->l, ą->a etc.
 func (s *ServiceStruct) StripUnicode(str string) string {
 	isNonASCII := func(r rune) bool {
@@ -1059,6 +1252,128 @@ func (s *ServiceStruct) StripUnicode(str string) string {
 	return str
 }
 
+// JaroWinkler - returns Jaro-Winkler similarity of two strings (0 - nothing in common, 1 - the same strings)
+func (s *ServiceStruct) JaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	la, lb := len(ra), len(rb)
+	if la == 0 && lb == 0 {
+		return 1.0
+	}
+	if la == 0 || lb == 0 {
+		return 0.0
+	}
+	window := la
+	if lb > window {
+		window = lb
+	}
+	window = window/2 - 1
+	if window < 0 {
+		window = 0
+	}
+	ma, mb := make([]bool, la), make([]bool, lb)
+	matches := 0
+	for i := range ra {
+		from, to := i-window, i+window+1
+		if from < 0 {
+			from = 0
+		}
+		if to > lb {
+			to = lb
+		}
+		for j := from; j < to; j++ {
+			if mb[j] || ra[i] != rb[j] {
+				continue
+			}
+			ma[i], mb[j] = true, true
+			matches++
+			break
+		}
+	}
+	if matches == 0 {
+		return 0.0
+	}
+	transpositions, j := 0, 0
+	for i := range ra {
+		if !ma[i] {
+			continue
+		}
+		for !mb[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(la) + m/float64(lb) + (m-float64(transpositions)/2.0)/m) / 3.0
+	prefix := 0
+	for i := 0; i < la && i < lb && i < 4 && ra[i] == rb[i]; i++ {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1.0-jaro)
+}
+
+// Soundex - returns American Soundex code of a given word (for example Robert and Rupert -> R163), non-letters are ignored
+// Word is transliterated first (see StripUnicode), returns empty string if there are no letters
+func (s *ServiceStruct) Soundex(str string) string {
+	codes := "01230120022455012623010202"
+	code := []byte{}
+	var last byte
+	for _, r := range s.StripUnicode(strings.ToLower(str)) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		c := codes[r-'a']
+		if len(code) == 0 {
+			code = append(code, byte(r-'a'+'A'))
+			last = c
+			continue
+		}
+		// h and w don't separate letters with the same code, vowels do
+		if r == 'h' || r == 'w' {
+			continue
+		}
+		if c != '0' && c != last {
+			code = append(code, c)
+			if len(code) == 4 {
+				break
+			}
+		}
+		last = c
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// QuietShare - returns share of contributions made in the least active window of given hours of day (circular, 0-23)
+// People usually have a gap of several hours without any activity (close to 0), bots active around the clock are close to window/24
+func (s *ServiceStruct) QuietShare(hours [24]int64, window int) float64 {
+	total := int64(0)
+	for _, cnt := range hours {
+		total += cnt
+	}
+	if total == 0 || window <= 0 {
+		return 0.0
+	}
+	quiet := total
+	for start := 0; start < 24; start++ {
+		cnt := int64(0)
+		for i := 0; i < window; i++ {
+			cnt += hours[(start+i)%24]
+		}
+		if cnt < quiet {
+			quiet = cnt
+		}
+	}
+	return float64(quiet) / float64(total)
+}
+
 // JSONEscape - escape string for JSON to avoid injections
 func (s *ServiceStruct) JSONEscape(str string) string {
 	b, _ := json.Marshal(str)
@@ -1309,6 +1624,50 @@ func (s *ServiceStruct) ProfileEnrollmentsDA2SF(data *models.GetProfileEnrollmen
 	}
 }
 
+// EnrollmentVersionsDA2SF - map DA name to SF name
+func (s *ServiceStruct) EnrollmentVersionsDA2SF(data *models.EnrollmentVersionsOutput) {
+	for _, version := range data.Versions {
+		for i, rol := range version.Enrollments {
+			if rol.ProjectSlug != nil {
+				project := s.DA2SF(*rol.ProjectSlug)
+				version.Enrollments[i].ProjectSlug = &project
+			}
+		}
+	}
+}
+
+// EnrollmentsRestoreDA2SF - map DA name to SF name
+func (s *ServiceStruct) EnrollmentsRestoreDA2SF(data *models.EnrollmentsRestoreOutput) {
+	// current and restored enrollments can be shared between changes, so each one is mapped only once
+	seen := make(map[*models.EnrollmentNestedDataOutput]struct{})
+	for _, change := range data.Changes {
+		for _, rol := range []*models.EnrollmentNestedDataOutput{change.Current, change.Restored} {
+			if rol == nil || rol.ProjectSlug == nil {
+				continue
+			}
+			if _, ok := seen[rol]; ok {
+				continue
+			}
+			seen[rol] = struct{}{}
+			project := s.DA2SF(*rol.ProjectSlug)
+			rol.ProjectSlug = &project
+		}
+	}
+}
+
+// EnrollmentSplitChangesDA2SF - map DA name to SF name
+func (s *ServiceStruct) EnrollmentSplitChangesDA2SF(changes []*models.EnrollmentSplitChange) {
+	for _, change := range changes {
+		for _, rol := range append([]*models.EnrollmentDataOutput{change.Original}, change.Pieces...) {
+			if rol == nil || rol.ProjectSlug == nil {
+				continue
+			}
+			project := s.DA2SF(*rol.ProjectSlug)
+			rol.ProjectSlug = &project
+		}
+	}
+}
+
 // ListProjectsDA2SF - map DA name to SF name
 func (s *ServiceStruct) ListProjectsDA2SF(data *models.ListProjectsOutput) {
 	for i := range data.Projects {
@@ -1339,3 +1698,19 @@ func (s *ServiceStruct) AllSF2DA(data []*models.AllOutput) {
 		}
 	}
 }
+
+// AffExplainDA2SF - map DA name to SF name
+func (s *ServiceStruct) AffExplainDA2SF(data *models.AffiliationExplainOutput) {
+	if data == nil {
+		return
+	}
+	data.ProjectSlug = s.DA2SF(data.ProjectSlug)
+	for _, rols := range [][]*models.AffiliationCandidate{data.Matched, data.Rejected} {
+		for i, rol := range rols {
+			if rol.ProjectSlug != nil {
+				project := s.DA2SF(*rol.ProjectSlug)
+				rols[i].ProjectSlug = &project
+			}
+		}
+	}
+}
@@ -1,18 +1,28 @@
 package shdb
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 
 	"golang.org/x/text/transform"
@@ -75,6 +85,8 @@ type Service interface {
 	UnarchiveUniqueIdentity(string, bool, *time.Time, *sql.Tx) error
 	DeleteUniqueIdentityArchive(string, bool, bool, *time.Time, *sql.Tx) error
 	QueryUniqueIdentitiesNested(string, int64, int64, bool, []string, *sql.Tx) ([]*models.UniqueIdentityNestedDataOutput, int64, error)
+	SearchUniqueIdentitiesNested(string, *models.ProfileFilters, int64, int64, bool, []string, *sql.Tx) ([]*models.UniqueIdentityNestedDataOutput, int64, error)
+	ProfileFiltersWhere(*models.ProfileFilters) (string, []interface{}, string, error)
 	// Enrollment
 	GetEnrollment(int64, bool, *sql.Tx) (*models.EnrollmentDataOutput, error)
 	FindEnrollments([]string, []interface{}, []bool, bool, *sql.Tx) ([]*models.EnrollmentDataOutput, error)
@@ -85,6 +97,11 @@ type Service interface {
 	UnarchiveEnrollment(int64, bool, *time.Time, *sql.Tx) error
 	DeleteEnrollmentArchive(int64, bool, bool, *time.Time, *sql.Tx) error
 	ValidateEnrollment(*models.EnrollmentDataOutput, bool) error
+	GetEnrollmentVersions(string, int64, []string, *sql.Tx) ([]*models.EnrollmentVersion, error)
+	EnrollmentRestoreChanges([]*models.EnrollmentNestedDataOutput, []*models.EnrollmentNestedDataOutput, map[int64]string) []*models.EnrollmentRestoreChange
+	RestoreEnrollments(string, time.Time, int64, []string, bool) ([]*models.EnrollmentRestoreChange, error)
+	EnrollmentSplitChanges(*models.EnrollmentDataOutput, []*models.EnrollmentDataOutput, map[int64]string) ([]*models.EnrollmentSplitChange, error)
+	AddEnrollmentSplit(*models.EnrollmentDataOutput) ([]*models.EnrollmentSplitChange, error)
 	// Organization
 	FindOrganizations([]string, []interface{}, bool, *sql.Tx) ([]*models.OrganizationDataOutput, error)
 	QueryOrganizationsNested(string, int64, int64, *sql.Tx) ([]*models.OrganizationNestedDataOutput, int64, error)
@@ -113,17 +130,59 @@ type Service interface {
 	DropSlugMapping(string, bool, *sql.Tx) error
 	EditSlugMapping(*models.SlugMapping, *models.SlugMapping, *sql.Tx) (*models.SlugMapping, error)
 	// Affiliations (5-step algorithm)
-	GetAffiliations(string, string, time.Time, bool, *sql.Tx) []string
-	GetAffiliationsSingle(string, string, time.Time, *sql.Tx) string
-	GetAffiliationsMulti(string, string, time.Time, *sql.Tx) []string
+	GetAffiliations(string, string, string, time.Time, bool, *sql.Tx) ([]string, bool)
+	GetAffiliationsSingle(string, string, string, time.Time, *sql.Tx) (string, bool)
+	GetAffiliationsMulti(string, string, string, time.Time, *sql.Tx) ([]string, bool)
+	InferAffiliationsFromDomains([]string, []*models.DomainDataOutput, bool) ([]string, []string)
+	GetAffiliationsAsOf(string, string, string, time.Time, time.Time, bool, *sql.Tx) ([]string, bool, error)
+	GetAffiliationsExplain(string, string, string, time.Time, *time.Time, bool, *sql.Tx) ([]string, *models.AffiliationExplainOutput, error)
+	ResolveAffiliations(string, time.Time, bool, bool, []*models.AffiliationCandidate) ([]string, *models.AffiliationExplainOutput)
+	AffiliationDomainStep(string, string) bool
+	GetAffiliationEmailsMulti([]string, *sql.Tx) (map[string][]string, error)
+	GetDomainsOrganizations([]string, *sql.Tx) ([]*models.DomainDataOutput, error)
+	InferAffiliationsFromEmails([]string, []*models.DomainDataOutput, bool) ([]string, []string)
+	ResolveAffiliationBatch([]*models.AffiliationBatchResult, []string, map[string][]*models.AffiliationCandidate) []int
+	InferAffiliationBatch([]*models.AffiliationBatchResult, []int, map[string][]string, []*models.DomainDataOutput)
+	FilterAffiliationCandidates([]*models.AffiliationCandidate, string) []*models.AffiliationCandidate
+	GetAffiliationCandidatesMulti([]string, time.Time, time.Time, *sql.Tx) (map[string][]*models.AffiliationCandidate, error)
+	GetAffiliationTimeline(string, string, string, time.Time, time.Time, *time.Time, *sql.Tx) ([]*models.AffiliationTimelineSegment, error)
+	AffiliationTimeline(string, time.Time, time.Time, []*models.AffiliationCandidate) []*models.AffiliationTimelineSegment
+	InferAffiliationTimeline([]*models.AffiliationTimelineSegment, []string, []*models.DomainDataOutput)
+	GetAffiliationGaps(string, []*models.ContributorActivity, *sql.Tx) ([]*models.AffiliationGapsProfile, error)
+	AffiliationGaps(string, *models.ContributorActivity, []*models.AffiliationCandidate) ([]*models.AffiliationGap, float64)
+	GetEmployerChanges(map[string][]string, string, time.Time, time.Time, *sql.Tx) ([]*models.EmployerChange, error)
+	InvalidateAffiliationCache(...string)
+	GetAffiliationCacheStats() *models.AffiliationCacheStats
+	EmployerChanges(map[string][]string, string, time.Time, time.Time, map[string][]*models.AffiliationCandidate, map[string][]string, []*models.DomainDataOutput) []*models.EmployerChange
+	DetectEnrollmentConflicts(*sql.Tx) ([]*models.EnrollmentConflictsProfile, error)
+	DetectMergeSuggestions(*sql.Tx) ([]*models.MergeSuggestion, error)
+	BotScore(*models.BotSuggestion)
+	BotCandidates([]string, *sql.Tx) ([]*models.BotSuggestion, error)
+	ReviewBotSuggestions(*models.BotSuggestionsReviewInput, *sql.Tx) (*models.BotSuggestionsReviewOutput, error)
+	MergeSuggestionScore(*models.MergeSuggestionProfile, *models.MergeSuggestionProfile) (float64, []string)
+	MergeSuggestionNameKeys(string) []string
+	EnrollmentConflicts([]*models.EnrollmentNestedDataOutput) []*models.EnrollmentConflict
+	ParseEnrollmentsCSV(io.Reader) ([]*models.EnrollmentImportRow, error)
+	EnrollmentImportAction(*models.EnrollmentDataOutput, []*models.EnrollmentDataOutput) (string, string)
+	ImportEnrollments([]*models.EnrollmentImportRow, bool) (int64, error)
+	// Affiliation policies
+	GetAffiliationPolicies(bool) error
+	AffiliationPolicySteps(string) []int
+	ParseAffiliationPolicySteps(string) ([]int, error)
+	GetListAffiliationPolicies() (*models.ListAffiliationPolicies, error)
+	SetAffiliationPolicy(string, string, *sql.Tx) (*models.AffiliationPolicy, error)
+	DropAffiliationPolicy(string, bool, *sql.Tx) error
 	// Other
 	SetIsLFX(*models.UniqueIdentityNestedDataOutput)
 	SyncSfProfiles(map[[3]string]struct{}) (string, error)
-	MakeLFXIdentityPrimary(chan []interface{}, string) (int, error)
+	MakeLFXIdentityPrimary(chan []interface{}, string) (int, int, error)
 	MoveIdentityToUniqueIdentity(*models.IdentityDataOutput, *models.UniqueIdentityDataOutput, bool, *sql.Tx) error
 	GetArchiveUniqueIdentityEnrollments(string, time.Time, bool, *sql.Tx) ([]*models.EnrollmentDataOutput, error)
 	GetArchiveUniqueIdentityIdentities(string, time.Time, bool, *sql.Tx) ([]*models.IdentityDataOutput, error)
 	GetUniqueIdentityEnrollments(string, bool, *sql.Tx) ([]*models.EnrollmentDataOutput, error)
+	GetUniqueIdentityNestedAsOf(string, time.Time, []string, bool, *sql.Tx) (*models.UniqueIdentityNestedDataOutput, error)
+	MergeAsOfIdentities([]*models.IdentityDataOutput, []*models.IdentityDataOutput) []*models.IdentityDataOutput
+	AsOfEnrollments(string, time.Time, []*shared.AsOfEnrollment) []*models.EnrollmentDataOutput
 	GetUniqueIdentityIdentities(string, bool, *sql.Tx) ([]*models.IdentityDataOutput, error)
 	MoveEnrollmentToUniqueIdentity(*models.EnrollmentDataOutput, *models.UniqueIdentityDataOutput, *sql.Tx) error
 	MergeEnrollments(*models.UniqueIdentityDataOutput, *models.OrganizationDataOutput, *string, bool, bool, *sql.Tx) error
@@ -134,12 +193,14 @@ type Service interface {
 	SetProfileEmptyDataFromIdentities(string, []*models.IdentityDataOutput, *sql.Tx) error
 	Unarchive(string, string) (bool, error)
 	CheckUnaffiliated([]*models.UnaffiliatedDataOutput, []string, *sql.Tx) ([]*models.UnaffiliatedDataOutput, error)
-	EnrichContributors([]*models.ContributorFlatStats, []string, int64, *sql.Tx) error
+	EnrichContributors([]*models.ContributorFlatStats, []string, string, int64, *sql.Tx) error
 	GetDetAffRangeSubjects() ([]*models.EnrollmentProjectRange, error)
 	UpdateAffRange([]*models.EnrollmentProjectRange) (string, error)
 	UpdateProjectSlugs(map[string][]string) (string, error)
 	DedupEnrollments() error
 	BeginTx() (*sql.Tx, error)
+	CommitTx(*sql.Tx) error
+	RollbackTx(*sql.Tx) error
 	SetLFID(string)
 	// SSAW related
 	// NotifySSAW()
@@ -155,18 +216,39 @@ type Service interface {
 	UnarchiveProfileNested(string, []string) (*models.UniqueIdentityNestedDataOutput, error)
 	GetListOrganizations(string, int64, int64) (*models.GetListOrganizationsOutput, error)
 	GetListOrganizationsDomains(int64, string, int64, int64) (*models.GetListOrganizationsDomainsOutput, error)
-	GetListProfiles(string, int64, int64, []string) (*models.GetListProfilesOutput, error)
+	GetListProfiles(string, *models.ProfileFilters, int64, int64, []string) (*models.GetListProfilesOutput, error)
 	AddNestedUniqueIdentity(string) (*models.UniqueIdentityNestedDataOutput, error)
 	AddNestedIdentity(*models.IdentityDataOutput) (*models.UniqueIdentityNestedDataOutput, error)
 	AddIdentities([]*models.IdentityDataOutput) (string, error)
 	FindEnrollmentsNested([]string, []interface{}, []bool, bool, []string, *sql.Tx) ([]*models.EnrollmentNestedDataOutput, error)
-	WithdrawEnrollment(*models.EnrollmentDataOutput, bool, *sql.Tx) error
+	WithdrawEnrollment(*models.EnrollmentDataOutput, bool, bool, *sql.Tx) error
 	PutOrgDomain(string, string, bool, bool, bool) (*models.PutOrgDomainOutput, error)
 	MergeUniqueIdentities(string, string, bool, *sql.Tx) (string, bool, error)
+	UnmergeUniqueIdentities(string, string, *sql.Tx) (*models.UnmergeOutput, error)
+	UnmergeProfile(*models.ProfileDataOutput, *models.ProfileDataOutput, *models.ProfileDataOutput) []string
 	MoveIdentity(string, string, bool, *sql.Tx) error
+	GetLineage(string, *sql.Tx) (*models.LineageOutput, error)
+	EmailHash(string) string
+	ForgetProfile(string, *sql.Tx) (*models.ErasureReceipt, map[string]string, error)
+	GetErasureReceipt(int64, *sql.Tx) (*models.ErasureReceipt, error)
+	SetErasureReceiptESStatus(*models.ErasureReceipt, *sql.Tx) error
+	FindUUIDsByEmail(string, *sql.Tx) ([]string, error)
+	DataExportTerms(*models.DataExportPerson) ([]string, []string)
+	ExportPersonData(string, *sql.Tx) (*models.DataExportPerson, error)
+	GetLock(string, string, *sql.Tx) (*models.Lock, error)
+	SetLock(string, string, string, *sql.Tx) (*models.Lock, error)
+	GetLocks(string, string, int64, int64, *sql.Tx) ([]*models.Lock, int64, error)
+	LockedProfiles([]string, *sql.Tx) (map[string]string, error)
+	ResolveLineage(string, []*models.LineageEvent) (string, []string)
 	GetAllAffiliations() (*models.AllArrayOutput, error)
-	BulkUpdate([]*models.AllOutput, []*models.AllOutput) (int, int, int, error)
-	MergeAll(int, bool, string, elastic.Service) (string, error)
+	ParseGitdmDevelopersAffiliations(io.Reader) ([]*models.AllOutput, error)
+	ParseGitdmGithubUsers(io.Reader) ([]*models.AllOutput, error)
+	GitdmDevelopersAffiliations([]*models.AllOutput) []byte
+	GitdmGithubUsers([]*models.AllOutput) ([]byte, error)
+	ImportGitdm([]*models.AllOutput, bool) (*models.GitdmImportOutput, error)
+	BulkUpdate([]*models.AllOutput, []*models.AllOutput) (int, int, int, []string, error)
+	MergeAll(int, bool, string, elastic.Service) (string, []*models.MergeAllTableReport, error)
+	MergeCluster(string, string, []*models.MergeClusterProfile) *models.MergeCluster
 	HideEmails() (string, error)
 	MapOrgNames() (string, error)
 }
@@ -175,6 +257,10 @@ type allMappings struct {
 	Mappings [][2]string `yaml:"mappings"`
 }
 
+type allKnownBots struct {
+	Bots []string `yaml:"bots"`
+}
+
 type service struct {
 	shared.ServiceStruct
 	db               *sqlx.DB
@@ -183,6 +269,8 @@ type service struct {
 	mtx              *sync.RWMutex
 	orgNamesMappings allMappings
 	mappingsLoaded   bool
+	knownBots        map[string]struct{}
+	knownBotsLoaded  bool
 	lfid             string
 }
 
@@ -200,8 +288,61 @@ func New(db, rodb *sqlx.DB, origin string) Service {
 const (
 	DateTimeFormat  = "%Y-%m-%dT%H:%i:%s.%fZ"
 	MapOrgNamesFile = "map_org_names.yaml"
+	KnownBotsFile   = "known_bots.yaml"
+)
+
+// Lineage actions and origins stored in uidentities_lineage table (see sql/add_lineage.sql)
+const (
+	LineageMerge            = "merge"
+	LineageMove             = "move"
+	LineageUnmerge          = "unmerge"
+	LineageUnarchive        = "unarchive"
+	LineageOriginAPI        = "api"
+	LineageOriginMergeAll   = "merge_all"
+	LineageOriginLFXPrimary = "lfx_primary"
+	LineageOriginSFSync     = "sf_sync"
+	LineageMaxUUIDs         = 1000
+)
+
+// ErasedName - name set on profiles, identities (also archived) and ES documents of persons erased using ForgetProfile
+const ErasedName = "Erased User"
+
+// Lockable objects, see SetLock
+const (
+	LockProfile    = "profile"
+	LockIdentity   = "identity"
+	LockEnrollment = "enrollment"
 )
 
+// lockDef - lock data select (object, key, uuid, locked_by, description), key column and locked by expression of a lockable object
+type lockDef struct {
+	sel    string
+	key    string
+	locked string
+}
+
+// lockDefs - profile is locked when its uidentities or profiles row is locked, SetLock locks/unlocks both
+var lockDefs = map[string]lockDef{
+	LockProfile: {
+		sel: "select 'profile', u.uuid, u.uuid, coalesce(nullif(trim(u.locked_by), ''), trim(p.locked_by), ''), coalesce(p.name, p.email, '') " +
+			"from uidentities u left join profiles p on p.uuid = u.uuid",
+		key:    "u.uuid",
+		locked: "coalesce(nullif(trim(u.locked_by), ''), trim(p.locked_by), '')",
+	},
+	LockIdentity: {
+		sel:    "select 'identity', i.id, coalesce(i.uuid, ''), trim(coalesce(i.locked_by, '')), concat(i.source, ': ', coalesce(i.username, i.email, i.name, '')) from identities i",
+		key:    "i.id",
+		locked: "trim(coalesce(i.locked_by, ''))",
+	},
+	LockEnrollment: {
+		sel: "select 'enrollment', cast(e.id as char), e.uuid, trim(coalesce(e.locked_by, '')), " +
+			"concat(o.name, ' ', date_format(e.start, '%Y-%m-%d'), ' - ', date_format(e.end, '%Y-%m-%d')) " +
+			"from enrollments e join organizations o on o.id = e.organization_id",
+		key:    "e.id",
+		locked: "trim(coalesce(e.locked_by, ''))",
+	},
+}
+
 // SetLFID - set Linux Foundation user ID, for example "lgryglicki"
 func (s *service) SetLFID(lfid string) {
 	s.lfid = lfid
@@ -212,6 +353,20 @@ func (s *service) BeginTx() (*sql.Tx, error) {
 	return s.db.Begin()
 }
 
+// CommitTx - commit transaction, then drop cached affiliations that were invalidated within it
+func (s *service) CommitTx(tx *sql.Tx) (err error) {
+	err = tx.Commit()
+	s.flushAffiliationCacheTx(tx)
+	return
+}
+
+// RollbackTx - rollback transaction, then drop cached affiliations that were invalidated (or resolved from its data) within it
+func (s *service) RollbackTx(tx *sql.Tx) (err error) {
+	err = tx.Rollback()
+	s.flushAffiliationCacheTx(tx)
+	return
+}
+
 // SetIsLFX - set is_lfx flag depending on primary identity being source=lfx
 func (s *service) SetIsLFX(u *models.UniqueIdentityNestedDataOutput) {
 	if u.Profile == nil {
@@ -230,10 +385,11 @@ func (s *service) SetIsLFX(u *models.UniqueIdentityNestedDataOutput) {
 }
 
 // MakeLFXIdentityPrimary - make a given email's identity a main profile's identity for identities with the same email address
-func (s *service) MakeLFXIdentityPrimary(ch chan []interface{}, email string) (merged int, err error) {
+// locked profiles are not merged (nothing is merged when LFX profile is locked), their number is returned in skipped
+func (s *service) MakeLFXIdentityPrimary(ch chan []interface{}, email string) (merged, skipped int, err error) {
 	defer func() {
 		if ch != nil {
-			ch <- []interface{}{merged, err}
+			ch <- []interface{}{merged, skipped, err}
 		}
 	}()
 	var (
@@ -279,9 +435,29 @@ func (s *service) MakeLFXIdentityPrimary(ch chan []interface{}, email string) (m
 		return
 	}
 	delete(uuids, puuid)
+	if len(uuids) == 0 {
+		//fmt.Printf("Nothing to do for %s email, uuid %s\n", email, puuid)
+		return
+	}
+	ary := []string{puuid}
+	for uuid := range uuids {
+		ary = append(ary, uuid)
+	}
+	locked, err := s.LockedProfiles(ary, nil)
+	if err != nil {
+		return
+	}
+	if locked[puuid] != "" {
+		skipped = len(uuids)
+		fmt.Printf("Email %s LFX profile %s is locked by %s, not merging %d uuids\n", email, puuid, locked[puuid], skipped)
+		return
+	}
+	for uuid := range locked {
+		delete(uuids, uuid)
+		skipped++
+	}
 	nUUIDs := len(uuids)
 	if nUUIDs == 0 {
-		//fmt.Printf("Nothing to do for %s email, uuid %s\n", email, puuid)
 		return
 	}
 	//fmt.Printf("For email %s need to merge %d uuids into %s\n", email, nUUIDs, puuid)
@@ -291,17 +467,17 @@ func (s *service) MakeLFXIdentityPrimary(ch chan []interface{}, email string) (m
 	}
 	defer func() {
 		if tx != nil {
-			tx.Rollback()
+			s.RollbackTx(tx)
 		}
 	}()
 	for uuid := range uuids {
-		_, _, err = s.MergeUniqueIdentities(uuid, puuid, true, tx)
+		_, _, err = s.mergeUniqueIdentities(uuid, puuid, true, LineageOriginLFXPrimary, tx)
 		if err != nil {
 			return
 		}
 	}
 	merged = nUUIDs
-	err = tx.Commit()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
@@ -447,6 +623,44 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		// We don't even have that email in SF
 		drop[ident] = struct{}{}
 	}
+	// LFX identities that are locked or belong to locked profiles are not updated nor dropped
+	rows, err = s.Query(
+		s.rodb,
+		nil,
+		"select coalesce(i.email, ''), coalesce(i.name, ''), coalesce(i.username, '') from identities i "+
+			"left join uidentities u on u.uuid = i.uuid left join profiles p on p.uuid = i.uuid where i.source = ? and "+
+			"(trim(coalesce(i.locked_by, '')) != '' or trim(coalesce(u.locked_by, '')) != '' or trim(coalesce(p.locked_by, '')) != '')",
+		lfxStr,
+	)
+	if err != nil {
+		return
+	}
+	locked := []string{}
+	for rows.Next() {
+		err = rows.Scan(&daKey[0], &daKey[1], &daKey[2])
+		if err != nil {
+			return
+		}
+		_, okU := update[daKey[0]]
+		_, okD := drop[daKey]
+		if okU || okD {
+			delete(update, daKey[0])
+			delete(drop, daKey)
+			locked = append(locked, daKey[0])
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if len(locked) > 0 {
+		sort.Strings(locked)
+		stat += fmt.Sprintf("%d locked identities skipped: %s\n", len(locked), strings.Join(locked, ", "))
+	}
 	stat += fmt.Sprintf("%d identities to update, %d missing, %d should be dropped\n", len(update), len(missing), len(drop))
 	thrN := s.GetThreadsNum()
 	var (
@@ -471,7 +685,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		_, err = s.Exec(s.db, tx, "insert into uidentities(uuid,last_modified,last_modified_by) values(?,now(),?)", uuid, s.lfid)
@@ -486,7 +700,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		if err != nil {
 			return
 		}
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -565,7 +779,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		_, err = s.Exec(s.db, tx, "update uidentities set last_modified = now(), last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')", s.lfid, uuid)
@@ -580,7 +794,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		if err != nil {
 			return
 		}
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -694,7 +908,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		now := time.Now()
@@ -728,12 +942,12 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 				return
 			}
 			// Unmerge it from the LFX profile (new profile with uuid=oid will be created)
-			err = s.MoveIdentity(oid, oid, true, tx)
+			err = s.moveIdentity(oid, oid, true, LineageOriginSFSync, tx)
 			if err != nil {
 				return
 			}
 			// Merge the current profile to just unmerged one (uuid->oid)
-			_, _, err = s.MergeUniqueIdentities(uuid, oid, true, tx)
+			_, _, err = s.mergeUniqueIdentities(uuid, oid, true, LineageOriginSFSync, tx)
 			if err != nil {
 				return
 			}
@@ -743,7 +957,7 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 				return
 			}
 		}
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -780,13 +994,14 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 			}
 		}
 	}
-	nIdents, nProfiles, merged := 0, 0, 0
+	nIdents, nProfiles, nSkipped, merged, skipped := 0, 0, 0, 0, 0
 	nThreads = 0
-	updateStats := func(merged int) {
+	updateStats := func(merged, skipped int) {
 		if merged > 0 {
 			nIdents += merged
 			nProfiles++
 		}
+		nSkipped += skipped
 	}
 	emails := []string{}
 	for email := range sfEmails {
@@ -801,38 +1016,35 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 			if nThreads == thrN {
 				i := <-ich
 				nThreads--
-				e := i[1]
+				e := i[2]
 				if e != nil {
 					errs = append(errs, e.(error))
 				} else {
-					updateStats(i[0].(int))
+					updateStats(i[0].(int), i[1].(int))
 				}
 			}
 		}
 		for nThreads > 0 {
 			i := <-ich
 			nThreads--
-			e := i[1]
+			e := i[2]
 			if e != nil {
 				errs = append(errs, e.(error))
 			} else {
-				updateStats(i[0].(int))
+				updateStats(i[0].(int), i[1].(int))
 			}
 		}
 	} else {
 		for _, email := range emails {
-			merged, e = s.MakeLFXIdentityPrimary(nil, email)
+			merged, skipped, e = s.MakeLFXIdentityPrimary(nil, email)
 			if e != nil {
 				errs = append(errs, e)
 			} else {
-				if merged > 0 {
-					nIdents += merged
-					nProfiles++
-				}
+				updateStats(merged, skipped)
 			}
 		}
 	}
-	stat += fmt.Sprintf("Merged %d identities, %d profiles\n", nIdents, nProfiles)
+	stat += fmt.Sprintf("Merged %d identities, %d profiles, skipped %d locked profiles\n", nIdents, nProfiles, nSkipped)
 	nErrs := len(errs)
 	if nErrs > 0 {
 		errStr := ""
@@ -845,8 +1057,10 @@ func (s *service) SyncSfProfiles(sfIdents map[[3]string]struct{}) (stat string,
 }
 
 // GetAffiliationsSingle - returns org name (or Unknown) for given uuid and date
-func (s *service) GetAffiliationsSingle(pSlug, uuid string, dt time.Time, tx *sql.Tx) (org string) {
-	orgs := s.GetAffiliations(pSlug, uuid, dt, true, tx)
+// If role is set, only enrollments with that role are used
+// inferred is set when org was inferred from email domains (no enrollment matched)
+func (s *service) GetAffiliationsSingle(pSlug, uuid, role string, dt time.Time, tx *sql.Tx) (org string, inferred bool) {
+	orgs, inferred := s.GetAffiliations(pSlug, uuid, role, dt, true, tx)
 	if len(orgs) == 0 {
 		org = "Unknown"
 		return
@@ -858,8 +1072,8 @@ func (s *service) GetAffiliationsSingle(pSlug, uuid string, dt time.Time, tx *sq
 // GetAffiliationsMulti - returns org name(s) for given uuid and name
 // Returns 1 or more organizations (all that matches the current date)
 // If none matches it returns array [Unknown]
-func (s *service) GetAffiliationsMulti(pSlug, uuid string, dt time.Time, tx *sql.Tx) (orgs []string) {
-	orgs = s.GetAffiliations(pSlug, uuid, dt, false, tx)
+func (s *service) GetAffiliationsMulti(pSlug, uuid, role string, dt time.Time, tx *sql.Tx) (orgs []string, inferred bool) {
+	orgs, inferred = s.GetAffiliations(pSlug, uuid, role, dt, false, tx)
 	if len(orgs) == 0 {
 		orgs = append(orgs, "Unknown")
 	}
@@ -868,705 +1082,762 @@ func (s *service) GetAffiliationsMulti(pSlug, uuid string, dt time.Time, tx *sql
 
 // GetAffiliations - returns enrollments for a given uuid in a given date, possibly multiple
 // 2021-07-29 note: starting from now 5-step algorithm will stop adding any enrollments
-func (s *service) GetAffiliations(pSlug, uuid string, dt time.Time, single bool, tx *sql.Tx) (orgs []string) {
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+// If role is set (for example Maintainer), only enrollments with that role are used, otherwise enrollments of all roles are used
+// If affiliation policy enables domain step and no enrollment matched, organizations are inferred from email domains and inferred is set
+func (s *service) GetAffiliations(pSlug, uuid, role string, dt time.Time, single bool, tx *sql.Tx) (orgs []string, inferred bool) {
+	orgs, inferred, _, _ = s.getAffiliations(pSlug, uuid, role, dt, nil, single, false, tx)
+	return
+}
+
+// GetAffiliationsAsOf - same as GetAffiliations, but uses enrollments (and emails) as they were at asOf, see GetUniqueIdentityNestedAsOf
+func (s *service) GetAffiliationsAsOf(pSlug, uuid, role string, dt, asOf time.Time, single bool, tx *sql.Tx) (orgs []string, inferred bool, err error) {
+	orgs, inferred, _, err = s.getAffiliations(pSlug, uuid, role, dt, &asOf, single, false, tx)
+	return
+}
+
+// GetAffiliationsExplain - same as GetAffiliations, but also returns which step matched and which enrollments were used or rejected
+// If asOf is set, enrollments as they were at asOf are used
+func (s *service) GetAffiliationsExplain(pSlug, uuid, role string, dt time.Time, asOf *time.Time, single bool, tx *sql.Tx) (orgs []string, explain *models.AffiliationExplainOutput, err error) {
+	orgs, _, explain, err = s.getAffiliations(pSlug, uuid, role, dt, asOf, single, true, tx)
+	return
+}
+
+func (s *service) getAffiliations(pSlug, uuid, role string, dt time.Time, asOf *time.Time, single, explain bool, tx *sql.Tx) (orgs []string, inferred bool, expl *models.AffiliationExplainOutput, err error) {
+	if pSlug == "(empty)" {
+		pSlug = ""
+	}
+	// Warning when running for foundation-f project slug.
+	if strings.HasSuffix(pSlug, "-f") && !strings.Contains(pSlug, "/") {
+		log.Warn(fmt.Sprintf("running on foundation-f level detected: project slug is %s, uuid %s, single %v, dt %v\n", pSlug, uuid, single, dt))
+	}
+	steps := s.AffiliationPolicySteps(pSlug)
+	// Cache is only used outside of transactions, because they can see uncommitted enrollments
+	// and only for the current state of enrollments
+	cache := !explain && tx == nil && asOf == nil
+	key := ""
+	if cache {
+		key = affCacheKey(pSlug, role, dt, single, steps)
+		var ok bool
+		orgs, inferred, ok = affCacheGet(uuid, key)
+		if ok {
+			return
+		}
+	}
+	// When explaining we also need enrollments not covering dt, so they can be reported as rejected
+	// When caching we need them to check if result is the same for the entire day
+	var (
+		rols   []*models.AffiliationCandidate
+		emails []string
+	)
+	if asOf != nil {
+		rols, emails, err = s.getAffiliationCandidatesAsOf(uuid, role, *asOf, tx)
+	} else {
+		rols, err = s.getAffiliationCandidates(uuid, role, dt, !explain && !cache, tx)
+	}
+	if err != nil {
+		return
+	}
+	orgs, inferred, expl, err = s.resolveAffiliations(pSlug, uuid, role, dt, single, explain, rols, emails, tx)
+	if err != nil {
+		return
+	}
+	if cache && affCacheable(dt, rols) {
+		affCacheSet(uuid, key, orgs, inferred)
 	}
+	return
+}
+
+// AffiliationDomainStep - checks if domain step fallback can be used for a given project slug and role
+// Domain step is a fallback, it is not used when filtering by role, because domains have no roles
+func (s *service) AffiliationDomainStep(pSlug, role string) bool {
 	if pSlug == "(empty)" {
 		pSlug = ""
 	}
-	// Step 1: Try project slug first
-	// in single mode, if multiple companies are found, return the most recent
-	// in multiple mode this can return many different companies and this is ok
-	if pSlug != "" {
-		// Warning when running for foundation-f project slug.
-		if strings.HasSuffix(pSlug, "-f") && !strings.Contains(pSlug, "/") {
-			log.Warn(fmt.Sprintf("running on foundation-f level detected: project slug is %s, uuid %s, single %v, dt %v\n", pSlug, uuid, single, dt))
+	steps := s.AffiliationPolicySteps(pSlug)
+	return role == "" && steps[len(steps)-1] == shared.AffStepDomain
+}
+
+// resolveAffiliations - applies 5-step algorithm on given enrollments candidates, then domain step fallback (if enabled)
+// if emails are nil, current profile and identities emails are used by the domain step
+func (s *service) resolveAffiliations(pSlug, uuid, role string, dt time.Time, single, explain bool, rols []*models.AffiliationCandidate, emails []string, tx *sql.Tx) (orgs []string, inferred bool, expl *models.AffiliationExplainOutput, err error) {
+	orgs, expl = s.ResolveAffiliations(pSlug, dt, single, explain, rols)
+	if expl != nil {
+		expl.UUID = uuid
+		expl.Role = role
+	}
+	if len(orgs) == 0 && s.AffiliationDomainStep(pSlug, role) {
+		var domains []string
+		orgs, domains, err = s.inferAffiliations(uuid, emails, single, tx)
+		if err != nil {
+			return
+		}
+		inferred = len(orgs) > 0
+		if expl != nil && inferred {
+			expl.Step = shared.AffStepDomain
+			expl.StepName = shared.AffStepNames[shared.AffStepDomain]
+			expl.Inferred = true
+			expl.InferredDomains = domains
+		}
+	}
+	return
+}
+
+// inferAffiliations - infers organization(s) from given uuid's profile and identities email domains
+// if emails are nil, current profile and identities emails are used
+// returns organizations found and domains_organizations domains that were used
+func (s *service) inferAffiliations(uuid string, emails []string, single bool, tx *sql.Tx) (orgs, domains []string, err error) {
+	if emails == nil {
+		var uuidsEmails map[string][]string
+		uuidsEmails, err = s.GetAffiliationEmailsMulti([]string{uuid}, tx)
+		if err != nil {
+			return
+		}
+		emails = uuidsEmails[uuid]
+	}
+	orgDomains, err := s.GetDomainsOrganizations(emails, tx)
+	if err != nil {
+		return
+	}
+	orgs, domains = s.InferAffiliationsFromEmails(emails, orgDomains, single)
+	return
+}
+
+// GetAffiliationEmailsMulti - returns current profile and identities emails for many uuids at once (grouped by uuid)
+// They are used by the domain step, UUIDs are queried in packs of shared.AffBatchPackSize
+func (s *service) GetAffiliationEmailsMulti(uuids []string, tx *sql.Tx) (emails map[string][]string, err error) {
+	emails = make(map[string][]string)
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	n := len(uuids)
+	for i := 0; i < n; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > n {
+			j = n
+		}
+		in := ""
+		args := []interface{}{}
+		for _, uuid := range uuids[i:j] {
+			in += "?,"
+			args = append(args, uuid)
 		}
-		rows := s.QueryToStringArray(
+		in = in[0 : len(in)-1]
+		args = append(args, args...)
+		var rows *sql.Rows
+		rows, err = s.Query(
 			sdb,
 			tx,
-			"select distinct o.name from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and e.project_slug = ? and e.start <= ? and e.end > ? order by e.id desc",
-			uuid,
-			pSlug,
-			dt,
-			dt,
+			"select uuid, email from profiles where email is not null and uuid in ("+in+") union "+
+				"select uuid, email from identities where email is not null and uuid in ("+in+")",
+			args...,
 		)
-		if single {
-			if len(rows) > 0 {
-				orgs = []string{rows[0]}
+		if err != nil {
+			return
+		}
+		uuid, email := "", ""
+		for rows.Next() {
+			err = rows.Scan(&uuid, &email)
+			if err != nil {
 				return
 			}
-		} else {
-			orgs = append(orgs, rows...)
-		}
-	}
-	// Step 2: Try foundation-f (for example cncf/* --> cncf-f)
-	// in single mode, if multiple companies are found, return the most recent
-	// in multiple mode this can return many different companies and this is ok
-	if pSlug != "" && len(orgs) == 0 {
-		ary := strings.Split(pSlug, "/")
-		if len(ary) > 0 {
-			slugF := ary[0] + "-f"
-			rows, _ := s.QueryToStringIntArrays(
-				sdb,
-				tx,
-				"select o.name, max(e.id) from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and e.project_slug = ? and e.start <= ? and e.end > ? group by o.name order by e.id desc",
-				uuid,
-				slugF,
-				dt,
-				dt,
-			)
-			if single {
-				if len(rows) > 0 {
-					orgs = []string{rows[0]}
-					// 2021-07-29: do not insert rolls from 5-step algorithm.
-					//_, _ = s.Exec(
-					//	sdb,
-					//	tx,
-					//	"insert ignore into enrollments(start, end, uuid, organization_id, project_slug, role, last_modified_by) select start, end, uuid, organization_id, ?, ?, ? from enrollments where id = ?",
-					//	pSlug,
-					//	"Contributor",
-					//	s.lfid,
-					//	ids[0],
-					//)
-					return
-				}
-			} else {
-				orgs = append(orgs, rows...)
+			emails[uuid] = append(emails[uuid], email)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetDomainsOrganizations - returns domains_organizations entries that can be used to infer organizations of given emails
+// (all emails' domains and their parent domains), domains are queried in packs of shared.AffBatchPackSize
+func (s *service) GetDomainsOrganizations(emails []string, tx *sql.Tx) (orgDomains []*models.DomainDataOutput, err error) {
+	orgDomains = []*models.DomainDataOutput{}
+	doms := []string{}
+	seen := make(map[string]struct{})
+	for _, emailDomain := range affEmailDomains(emails) {
+		for _, dom := range affDomainSuffixes(emailDomain) {
+			_, ok := seen[dom]
+			if ok {
+				continue
 			}
+			seen[dom] = struct{}{}
+			doms = append(doms, dom)
 		}
 	}
-	// Step 3: try global second, only if no project specific were found
-	// in single mode, if multiple companies are found, return the most recent
-	// in multiple mode this can return many different companies and this is ok
-	if len(orgs) == 0 {
-		rows := s.QueryToStringArray(
-			sdb,
-			tx,
-			"select distinct o.name from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and e.project_slug is null and e.start <= ? and e.end > ? order by e.id desc",
-			uuid,
-			dt,
-			dt,
-		)
-		if single {
-			if len(rows) > 0 {
-				orgs = []string{rows[0]}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	n := len(doms)
+	for i := 0; i < n; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > n {
+			j = n
+		}
+		sel := "select o.name, do.domain, do.is_top_domain from domains_organizations do, organizations o where do.organization_id = o.id and do.domain in ("
+		args := []interface{}{}
+		for _, dom := range doms[i:j] {
+			sel += "?,"
+			args = append(args, dom)
+		}
+		sel = sel[0:len(sel)-1] + ") order by o.name"
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, sel, args...)
+		if err != nil {
+			return
+		}
+		var isTopDomain *bool
+		for rows.Next() {
+			orgDomain := &models.DomainDataOutput{}
+			err = rows.Scan(&orgDomain.OrganizationName, &orgDomain.Name, &isTopDomain)
+			if err != nil {
 				return
 			}
-		} else {
-			orgs = append(orgs, rows...)
-		}
-	}
-	// Step 4: try anything from the same foundation, only if nothing is found so far
-	// in single mode, if multiple companies are found, return the most recent
-	// in multiple mode this can return many different companies and this is ok
-	if pSlug != "" && len(orgs) == 0 {
-		ary := strings.Split(pSlug, "/")
-		if len(ary) > 0 {
-			slugLike := ary[0] + "/%"
-			rows, _ := s.QueryToStringIntArrays(
-				sdb,
-				tx,
-				"select o.name, max(e.id) from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and e.project_slug like ? and e.start <= ? and e.end > ? group by o.name order by e.id desc",
-				uuid,
-				slugLike,
-				dt,
-				dt,
-			)
-			if single {
-				if len(rows) > 0 {
-					orgs = []string{rows[0]}
-					// 2021-07-29: do not insert rolls from 5-step algorithm.
-					//_, _ = s.Exec(
-					//	sdb,
-					//	tx,
-					//	"insert ignore into enrollments(start, end, uuid, organization_id, project_slug, role, last_modified_by) select start, end, uuid, organization_id, ?, ?, ? from enrollments where id = ?",
-					//	pSlug,
-					//	"Contributor",
-					//	s.lfid,
-					//	ids[0],
-					//)
-					return
-				}
-			} else {
-				orgs = append(orgs, rows...)
+			if isTopDomain != nil {
+				orgDomain.IsTopDomain = *isTopDomain
 			}
+			orgDomains = append(orgDomains, orgDomain)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
 		}
 	}
-	// Step 5: try anything else, only if nothing is found so far
-	// in single mode, if multiple companies are found, return the most recent
-	// in multiple mode this can return many different companies and this is ok
-	if len(orgs) == 0 {
-		rows, _ := s.QueryToStringIntArrays(
-			sdb,
-			tx,
-			"select o.name, max(e.id) from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ? and e.start <= ? and e.end > ? group by o.name order by e.id desc",
-			uuid,
-			dt,
-			dt,
-		)
-		if single {
-			if len(rows) > 0 {
-				ary := strings.Split(pSlug, "/")
-				if len(ary) > 0 {
-					orgs = []string{rows[0]}
-					// 2021-07-29: do not insert rolls from 5-step algorithm.
-					//if pSlug != "" {
-					//	  _, _ = s.Exec(
-					//	  sdb,
-					//	  tx,
-					//	  "insert ignore into enrollments(start, end, uuid, organization_id, project_slug, role, last_modified_by) select start, end, uuid, organization_id, ?, ?, ? from enrollments where id = ?",
-					//	  pSlug,
-					//	  "Contributor",
-					//	  s.lfid,
-					//	  ids[0],
-					//	)
-					//}
+	return
+}
+
+// InferAffiliationsFromEmails - returns organizations of given emails' domains using domains_organizations entries, see InferAffiliationsFromDomains
+// Entries can be fetched once for many profiles (see GetAffiliationEmailsMulti and GetDomainsOrganizations), so no database query is needed here
+func (s *service) InferAffiliationsFromEmails(emails []string, orgDomains []*models.DomainDataOutput, single bool) (orgs, domains []string) {
+	return s.InferAffiliationsFromDomains(affEmailDomains(emails), orgDomains, single)
+}
+
+// InferAffiliationsFromDomains - returns organizations of given email domains (in order) using domains_organizations entries
+// Exact domain match is used first, if there is none - the longest parent domain marked as top domain is used,
+// for example linux.intel.com maps to intel.com organization only if intel.com has is_top_domain set
+// Returns organizations found and domains_organizations domains that were used
+func (s *service) InferAffiliationsFromDomains(emailDomains []string, orgDomains []*models.DomainDataOutput, single bool) (orgs, domains []string) {
+	byDomain := make(map[string][]*models.DomainDataOutput)
+	for _, orgDomain := range orgDomains {
+		dom := strings.ToLower(strings.TrimSpace(orgDomain.Name))
+		byDomain[dom] = append(byDomain[dom], orgDomain)
+	}
+	seenOrg := make(map[string]struct{})
+	seenDomain := make(map[string]struct{})
+	for _, emailDomain := range emailDomains {
+		for i, dom := range affDomainSuffixes(strings.ToLower(emailDomain)) {
+			found := false
+			for _, orgDomain := range byDomain[dom] {
+				if i > 0 && !orgDomain.IsTopDomain {
+					continue
+				}
+				found = true
+				_, ok := seenDomain[dom]
+				if !ok {
+					seenDomain[dom] = struct{}{}
+					domains = append(domains, dom)
+				}
+				_, ok = seenOrg[orgDomain.OrganizationName]
+				if ok {
+					continue
+				}
+				seenOrg[orgDomain.OrganizationName] = struct{}{}
+				orgs = append(orgs, orgDomain.OrganizationName)
+				if single {
+					return
 				}
-				return
 			}
-		} else {
-			orgs = append(orgs, rows...)
+			if found {
+				break
+			}
 		}
 	}
 	return
 }
 
-func (s *service) GetCountry(countryCode string, tx *sql.Tx) (countryData *models.CountryDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetCountry: countryCode:%s tx:%v", countryCode, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("GetCountry(exit): countryCode:%s tx:%v countryData:%+v err:%v", countryCode, tx != nil, countryData, err))
-	}()
+// affEmailDomains - returns distinct lower case domains of given emails, in order
+func affEmailDomains(emails []string) (domains []string) {
+	seen := make(map[string]struct{})
+	for _, email := range emails {
+		i := strings.LastIndex(email, "@")
+		if i < 0 {
+			continue
+		}
+		dom := strings.ToLower(strings.TrimSpace(email[i+1:]))
+		if dom == "" {
+			continue
+		}
+		_, ok := seen[dom]
+		if ok {
+			continue
+		}
+		seen[dom] = struct{}{}
+		domains = append(domains, dom)
+	}
+	return
+}
+
+// affDomainSuffixes - returns a given domain and all its parent domains having at least 2 labels
+// for example linux.intel.com -> [linux.intel.com intel.com]
+func affDomainSuffixes(domain string) (suffixes []string) {
+	suffixes = []string{domain}
+	for {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+		if !strings.Contains(domain, ".") {
+			break
+		}
+		suffixes = append(suffixes, domain)
+	}
+	return
+}
+
+// getAffiliationCandidates - returns given uuid's enrollments (optionally only those covering dt or having a given role), most recent first
+// Callers must sort them using affSortByID before resolving, so more confident enrollments are preferred
+func (s *service) getAffiliationCandidates(uuid, role string, dt time.Time, onlyActive bool, tx *sql.Tx) (rols []*models.AffiliationCandidate, err error) {
 	sdb := s.rodb
 	if tx != nil {
 		sdb = s.db
 	}
-	countryData = &models.CountryDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select code, name, alpha3 from countries where code = ? limit 1",
-		countryCode,
-	)
+	sel := "select e.id, o.name, e.project_slug, e.role, e.start, e.end, e.provenance, e.confidence from enrollments e, organizations o where e.organization_id = o.id and e.uuid = ?"
+	args := []interface{}{uuid}
+	if role != "" {
+		sel += " and e.role = ?"
+		args = append(args, role)
+	}
+	if onlyActive {
+		sel += " and e.start <= ? and e.end > ?"
+		args = append(args, dt, dt)
+	}
+	sel += " order by e.id desc"
+	rows, err := s.Query(sdb, tx, sel, args...)
 	if err != nil {
 		return
 	}
-	fetched := false
 	for rows.Next() {
-		err = rows.Scan(
-			&countryData.Code,
-			&countryData.Name,
-			&countryData.Alpha3,
-		)
+		rol := &models.AffiliationCandidate{}
+		err = rows.Scan(&rol.ID, &rol.Organization, &rol.ProjectSlug, &rol.Role, &rol.Start, &rol.End, &rol.Provenance, &rol.Confidence)
 		if err != nil {
 			return
 		}
-		fetched = true
+		rols = append(rols, rol)
 	}
 	err = rows.Err()
 	if err != nil {
 		return
 	}
 	err = rows.Close()
-	if err != nil {
-		return
-	}
-	if !fetched {
-		err = fmt.Errorf("cannot find country by code '%s'", countryCode)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetCountry")
-		return
-	}
 	return
 }
 
-func (s *service) MergeDateRanges(dates [][]strfmt.DateTime) (mergedDates [][]strfmt.DateTime, err error) {
-	log.Info(fmt.Sprintf("MergeDateRanges: dates:%+v", dates))
-	defer func() {
-		log.Info(fmt.Sprintf("MergeDateRanges(exit): dates:%+v mergedDates:%+v err:%v", dates, mergedDates, err))
-	}()
-	if len(dates) == 0 {
+// getAffiliationCandidatesAsOf - returns given uuid's enrollments as they were at asOf (optionally only those having a given role), most recent first
+// also returns profile and identities emails as they were at asOf, so they can be used to infer affiliations
+func (s *service) getAffiliationCandidatesAsOf(uuid, role string, asOf time.Time, tx *sql.Tx) (rols []*models.AffiliationCandidate, emails []string, err error) {
+	uid, err := s.GetUniqueIdentityNestedAsOf(uuid, asOf, nil, false, tx)
+	if err != nil || uid == nil {
 		return
 	}
-	sortedDates := [][]strfmt.DateTime{}
-	for index, pair := range dates {
-		if len(pair) != 2 {
-			err = fmt.Errorf("datetime start-end pair number #%d doesn't have exactly 2 elements: %+v", index, pair)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
-			return
-		}
-		newPair := []strfmt.DateTime{}
-		if time.Time(pair[0]).Before(time.Time(pair[1])) {
-			newPair = append(newPair, pair[0])
-			newPair = append(newPair, pair[1])
-		} else {
-			newPair = append(newPair, pair[1])
-			newPair = append(newPair, pair[0])
-		}
-		sortedDates = append(sortedDates, newPair)
+	emails = []string{}
+	if uid.Profile != nil && uid.Profile.Email != nil {
+		emails = append(emails, *uid.Profile.Email)
 	}
-	sort.SliceStable(sortedDates, func(i, j int) bool {
-		idx := 0
-		if sortedDates[i][0] == sortedDates[j][0] {
-			idx = 1
+	for _, identity := range uid.Identities {
+		if identity.Email != nil {
+			emails = append(emails, *identity.Email)
 		}
-		return time.Time(sortedDates[i][idx]).Before(time.Time(sortedDates[j][idx]))
-	})
-	saved := []strfmt.DateTime{sortedDates[0][0], sortedDates[0][1]}
-	minRange, maxRange := false, false
-	for _, data := range sortedDates {
-		st := data[0]
-		en := data[1]
-		if time.Time(st).Before(shared.MinPeriodDate) || time.Time(st).After(shared.MaxPeriodDate) {
-			err = fmt.Errorf("start date %v must be between %v and %v", st, shared.MinPeriodDate, shared.MaxPeriodDate)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
-			return
+	}
+	for _, enrollment := range uid.Enrollments {
+		if role != "" && enrollment.Role != role {
+			continue
 		}
-		if time.Time(en).Before(shared.MinPeriodDate) || time.Time(en).After(shared.MaxPeriodDate) {
-			err = fmt.Errorf("end date %v must be between %v and %v", en, shared.MinPeriodDate, shared.MaxPeriodDate)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
-			return
+		rols = append(
+			rols,
+			&models.AffiliationCandidate{
+				ID:           enrollment.ID,
+				Organization: enrollment.Organization.Name,
+				ProjectSlug:  enrollment.ProjectSlug,
+				Role:         enrollment.Role,
+				Start:        enrollment.Start,
+				End:          enrollment.End,
+				Provenance:   enrollment.Provenance,
+				Confidence:   enrollment.Confidence,
+			},
+		)
+	}
+	rols = affSortByID(rols)
+	return
+}
+
+// ResolveAffiliationBatch - resolves multiple orgs of affiliation batch items using enrollments candidates fetched for all of them at once
+// daSlugs are items' project slugs (DA), items having error set are skipped. Returns indices of items that no enrollment matched
+// and whose project's affiliation policy enables domain step, they should be passed to InferAffiliationBatch
+func (s *service) ResolveAffiliationBatch(items []*models.AffiliationBatchResult, daSlugs []string, rols map[string][]*models.AffiliationCandidate) (infer []int) {
+	for i, item := range items {
+		if item.Error != "" {
+			continue
 		}
-		// st <= saved[1]
-		if !time.Time(st).After(time.Time(saved[1])) {
-			// saved[0] == MIN_PERIOD_DATE
-			if !time.Time(saved[0]).After(shared.MinPeriodDate) {
-				saved[0] = st
-				minRange = true
-			}
-			// if MAX_PERIOD_DATE in (en, saved[1]):
-			if !time.Time(saved[1]).Before(shared.MaxPeriodDate) || !time.Time(en).Before(shared.MaxPeriodDate) {
-				// if saved1 > en
-				if time.Time(saved[1]).After(time.Time(en)) {
-					saved[1] = en
-				}
-				maxRange = true
-			} else {
-				// if saved1 < en
-				if time.Time(saved[1]).Before(time.Time(en)) {
-					saved[1] = en
-				}
-			}
-		} else {
-			// st > saved[1]
-			mergedDates = append(mergedDates, []strfmt.DateTime{saved[0], saved[1]})
-			saved[0] = st
-			saved[1] = en
+		urols := s.FilterAffiliationCandidates(rols[item.UUID], item.Role)
+		item.Orgs, _ = s.ResolveAffiliations(daSlugs[i], time.Time(item.Dt), false, false, urols)
+		if len(item.Orgs) == 0 && s.AffiliationDomainStep(daSlugs[i], item.Role) {
+			infer = append(infer, i)
 		}
 	}
-	mergedDates = append(mergedDates, saved)
-	if minRange {
-		mergedDates[0][0] = strfmt.DateTime(shared.MinPeriodDate)
-	}
-	if maxRange {
-		mergedDates[len(mergedDates)-1][1] = strfmt.DateTime(shared.MaxPeriodDate)
-	}
 	return
 }
 
-func (s *service) MergeEnrollments(uniqueIdentity *models.UniqueIdentityDataOutput, organization *models.OrganizationDataOutput, projectSlug *string, allProjectSlugs, noMergeFatal bool, tx *sql.Tx) (err error) {
-	pSlug := ""
-	if projectSlug != nil {
-		pSlug = *projectSlug
+// InferAffiliationBatch - infers organizations of batch items with given indices (see ResolveAffiliationBatch) from their emails' domains
+// Then sets single org of all items: it is the first of multiple orgs, because both modes use the same order, or Unknown
+func (s *service) InferAffiliationBatch(items []*models.AffiliationBatchResult, infer []int, emails map[string][]string, orgDomains []*models.DomainDataOutput) {
+	for _, i := range infer {
+		item := items[i]
+		item.Orgs, _ = s.InferAffiliationsFromEmails(emails[item.UUID], orgDomains, false)
+		item.Inferred = len(item.Orgs) > 0
 	}
-	log.Info(fmt.Sprintf("MergeEnrollments: uniqueIdentity:%+v organization:%+v projectSlug:%v allProjectSlugs:%v noMergeFatal:%v tx:%v", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pSlug, allProjectSlugs, noMergeFatal, tx != nil))
+	for _, item := range items {
+		if item.Error != "" {
+			continue
+		}
+		if len(item.Orgs) == 0 {
+			item.Orgs = []string{"Unknown"}
+		}
+		item.Org = item.Orgs[0]
+	}
+}
+
+// GetAffiliationCandidatesMulti - returns enrollments for many uuids at once (grouped by uuid, most recent first)
+// Only enrollments overlapping [from, to] date range are returned, so they can be used to resolve affiliations
+// on any date from that range. UUIDs are queried in packs of shared.AffBatchPackSize.
+func (s *service) GetAffiliationCandidatesMulti(uuids []string, from, to time.Time, tx *sql.Tx) (rols map[string][]*models.AffiliationCandidate, err error) {
+	n := len(uuids)
+	log.Info(fmt.Sprintf("GetAffiliationCandidatesMulti: uuids:%d from:%v to:%v tx:%v", n, from, to, tx != nil))
+	rols = make(map[string][]*models.AffiliationCandidate)
 	defer func() {
-		log.Info(fmt.Sprintf("MergeEnrollments(exit): uniqueIdentity:%+v organization:%+v projectSlug:%v allProjectSlugs:%v noMergeFatal:%v tx:%v err:%v", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pSlug, allProjectSlugs, noMergeFatal, tx != nil, err))
+		log.Info(fmt.Sprintf("GetAffiliationCandidatesMulti(exit): uuids:%d from:%v to:%v tx:%v found:%d err:%v", n, from, to, tx != nil, len(rols), err))
 	}()
-	projectSlugs := make(map[*string]struct{})
-	projectSlugsInf := make(map[string]struct{})
-	if allProjectSlugs {
-		var rols []*models.EnrollmentDataOutput
-		rols, err = s.FindEnrollments([]string{"uuid", "organization_id"}, []interface{}{uniqueIdentity.UUID, organization.ID}, []bool{false, false}, false, tx)
-		if err != nil {
-			return
-		}
-		for _, rol := range rols {
-			projectSlugs[rol.ProjectSlug] = struct{}{}
-			ps := rol.ProjectSlug
-			if ps == nil {
-				projectSlugsInf["(null)"] = struct{}{}
-			} else {
-				projectSlugsInf[*ps] = struct{}{}
-			}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	for i := 0; i < n; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > n {
+			j = n
 		}
-	} else {
-		projectSlugs[projectSlug] = struct{}{}
-		if projectSlug == nil {
-			projectSlugsInf["(null)"] = struct{}{}
-		} else {
-			projectSlugsInf[*projectSlug] = struct{}{}
+		sel := "select e.uuid, e.id, o.name, e.project_slug, e.role, e.start, e.end, e.provenance, e.confidence from enrollments e, organizations o " +
+			"where e.organization_id = o.id and e.start <= ? and e.end > ? and e.uuid in ("
+		args := []interface{}{to, from}
+		for _, uuid := range uuids[i:j] {
+			sel += "?,"
+			args = append(args, uuid)
 		}
-	}
-	log.Info(fmt.Sprintf("Merging projects %+v organization %+v uniqueIdentity %+v", projectSlugsInf, organization, s.ToLocalUniqueIdentity(uniqueIdentity)))
-	for slug := range projectSlugs {
-		pS := ""
-		if slug != nil {
-			pS = *slug
+		sel = sel[0:len(sel)-1] + ") order by e.id desc"
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, sel, args...)
+		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetAffiliationCandidatesMulti")
+			return
 		}
-		merged := 0
-		for _, role := range shared.Roles {
-			var disjoint []*models.EnrollmentDataOutput
-			disjoint, err = s.FindEnrollments([]string{"uuid", "organization_id", "project_slug", "role"}, []interface{}{uniqueIdentity.UUID, organization.ID, slug, role}, []bool{false, false, false, false}, false, tx)
-			if err != nil {
-				return
-			}
-			if len(disjoint) == 0 {
-				continue
-			}
-			dates := [][]strfmt.DateTime{}
-			for _, rol := range disjoint {
-				dates = append(dates, []strfmt.DateTime{rol.Start, rol.End})
-			}
-			var mergedDates [][]strfmt.DateTime
-			mergedDates, err = s.MergeDateRanges(dates)
+		uuid := ""
+		for rows.Next() {
+			rol := &models.AffiliationCandidate{}
+			err = rows.Scan(&uuid, &rol.ID, &rol.Organization, &rol.ProjectSlug, &rol.Role, &rol.Start, &rol.End, &rol.Provenance, &rol.Confidence)
 			if err != nil {
 				return
 			}
-			for _, data := range mergedDates {
-				st := data[0]
-				en := data[1]
-				isDup := func(x *models.EnrollmentDataOutput, st, en strfmt.DateTime) bool {
-					return x.Start == st && x.End == en
-				}
-				filtered := []*models.EnrollmentDataOutput{}
-				for _, rol := range disjoint {
-					if !isDup(rol, st, en) {
-						filtered = append(filtered, rol)
-					}
-				}
-				if len(filtered) != len(disjoint) {
-					disjoint = filtered
-					continue
-				}
-				newEnrollment := &models.EnrollmentDataOutput{UUID: uniqueIdentity.UUID, OrganizationID: organization.ID, Start: st, End: en, ProjectSlug: slug, Role: role}
-				_, err = s.AddEnrollment(newEnrollment, false, false, tx)
-				if err != nil {
-					return
-				}
-			}
-			for _, rol := range disjoint {
-				err = s.DeleteEnrollment(rol.ID, false, true, nil, tx)
-				if err != nil {
-					return
-				}
-			}
-			merged++
+			rols[uuid] = append(rols[uuid], rol)
 		}
-		if merged == 0 && noMergeFatal {
-			err = fmt.Errorf("merge enrollments unique identity '%+v' organization '%+v' projectSlug %v allProjectSlugs %v found no enrollments", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pS, allProjectSlugs)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeEnrollments")
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
 			return
 		}
 	}
 	return
 }
 
-func (s *service) MoveEnrollmentToUniqueIdentity(enrollment *models.EnrollmentDataOutput, uniqueIdentity *models.UniqueIdentityDataOutput, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("MoveEnrollmentToUniqueIdentity: enrollment:%+v uniqueIdentity:%+v tx:%v", enrollment, s.ToLocalUniqueIdentity(uniqueIdentity), tx != nil))
+// ResolveAffiliations - applies 5-step algorithm on a given profile's enrollments
+// Step 1: Try project slug first
+// Step 2: Try foundation-f (for example cncf/* --> cncf-f)
+// Step 3: try global second, only if no project specific were found
+// Step 4: try anything from the same foundation, only if nothing is found so far
+// Step 5: try anything else, only if nothing is found so far
+// First step that finds anything wins, in single mode the most confident (then the most recent) company is returned,
+// in multiple mode this can return many different companies and this is ok
+// If explain is set, it also returns which step matched and why other enrollments were rejected
+func (s *service) ResolveAffiliations(pSlug string, dt time.Time, single, explain bool, rols []*models.AffiliationCandidate) (orgs []string, expl *models.AffiliationExplainOutput) {
+	if pSlug == "(empty)" {
+		pSlug = ""
+	}
+	sorted := affSortByID(rols)
+	steps := s.AffiliationPolicySteps(pSlug)
+	orgs, step := affResolve(pSlug, dt, single, sorted, steps)
+	if !explain {
+		return
+	}
+	rank := make(map[int]int)
+	policy := []int64{}
+	for i, st := range steps {
+		rank[st] = i
+		policy = append(policy, int64(st))
+	}
+	expl = &models.AffiliationExplainOutput{
+		ProjectSlug: pSlug,
+		Dt:          strfmt.DateTime(dt),
+		Single:      single,
+		Step:        int64(step),
+		StepName:    shared.AffStepNames[step],
+		Policy:      policy,
+		Matched:     []*models.AffiliationCandidate{},
+		Rejected:    []*models.AffiliationCandidate{},
+	}
+	for _, rol := range sorted {
+		cand := *rol
+		cand.Step = int64(affFirstStep(pSlug, rol.ProjectSlug, steps))
+		switch {
+		case !affActive(rol, dt):
+			cand.Reason = fmt.Sprintf(
+				"date range %s - %s does not include %s",
+				time.Time(rol.Start).Format(time.RFC3339),
+				time.Time(rol.End).Format(time.RFC3339),
+				dt.Format(time.RFC3339),
+			)
+		case cand.Step == shared.AffStepNone:
+			cand.Reason = fmt.Sprintf("no step enabled by affiliation policy %v matches project slug", steps)
+		case rank[int(cand.Step)] > rank[step]:
+			cand.Reason = fmt.Sprintf("lower priority than step %d (%s)", step, shared.AffStepNames[step])
+		case single && rol.Organization != orgs[0]:
+			cand.Reason = fmt.Sprintf("single mode returns the most confident and recent organization only (%s)", orgs[0])
+		default:
+			cand.Reason = fmt.Sprintf("matched step %d (%s)", step, shared.AffStepNames[step])
+			expl.Matched = append(expl.Matched, &cand)
+			continue
+		}
+		expl.Rejected = append(expl.Rejected, &cand)
+	}
+	return
+}
+
+// GetAffiliationTimeline - returns piecewise timeline of resolved affiliations for a given uuid in [from, to) date range
+// If role is set, only enrollments with that role are used
+// If affiliation policy enables domain step, segments that no enrollment matched use organizations inferred from email domains
+// If asOf is set, enrollments as they were at asOf are used
+func (s *service) GetAffiliationTimeline(pSlug, uuid, role string, from, to time.Time, asOf *time.Time, tx *sql.Tx) (segments []*models.AffiliationTimelineSegment, err error) {
+	log.Info(fmt.Sprintf("GetAffiliationTimeline: pSlug:%s uuid:%s role:%s from:%v to:%v asOf:%v tx:%v", pSlug, uuid, role, from, to, asOf, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("MoveEnrollmentToUniqueIdentity(exit): enrollment:%+v uniqueIdentity:%+v tx:%v err:%v", enrollment, s.ToLocalUniqueIdentity(uniqueIdentity), tx != nil, err))
+		log.Info(fmt.Sprintf("GetAffiliationTimeline(exit): pSlug:%s uuid:%s role:%s from:%v to:%v asOf:%v tx:%v segments:%d err:%v", pSlug, uuid, role, from, to, asOf, tx != nil, len(segments), err))
 	}()
-	if enrollment.UUID == uniqueIdentity.UUID {
+	if !from.Before(to) {
+		err = errs.Wrap(errs.New(fmt.Errorf("start date %v must be before end date %v", from, to), errs.ErrBadRequest), "GetAffiliationTimeline")
 		return
 	}
-	oldUniqueIdentity, err := s.GetUniqueIdentity(enrollment.UUID, true, tx)
-	if err != nil {
-		return
+	var (
+		rols   []*models.AffiliationCandidate
+		emails []string
+	)
+	if asOf != nil {
+		rols, emails, err = s.getAffiliationCandidatesAsOf(uuid, role, *asOf, tx)
+	} else {
+		rols, err = s.getAffiliationCandidates(uuid, role, from, false, tx)
 	}
-	enrollment.UUID = uniqueIdentity.UUID
-	enrollment, err = s.EditEnrollment(enrollment, true, tx)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetAffiliationTimeline")
 		return
 	}
-	affected, err := s.TouchUniqueIdentity(oldUniqueIdentity.UUID, tx)
-	if err != nil {
+	segments = s.AffiliationTimeline(pSlug, from, to, rols)
+	if !s.AffiliationDomainStep(pSlug, role) {
 		return
 	}
-	if affected != 1 {
-		err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(oldUniqueIdentity), affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveEnrollmentToUniqueIdentity")
-		return
+	uncovered := false
+	for _, segment := range segments {
+		if segment.Step == shared.AffStepNone {
+			uncovered = true
+			break
+		}
 	}
-	affected, err = s.TouchUniqueIdentity(uniqueIdentity.UUID, tx)
-	if err != nil {
+	if !uncovered {
 		return
 	}
-	if affected != 1 {
-		err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(uniqueIdentity), affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveEnrollmentToUniqueIdentity")
+	// The same domain step fallback as used by GetAffiliations
+	if asOf == nil {
+		var uuidsEmails map[string][]string
+		uuidsEmails, err = s.GetAffiliationEmailsMulti([]string{uuid}, tx)
+		if err != nil {
+			return
+		}
+		emails = uuidsEmails[uuid]
+	}
+	orgDomains, err := s.GetDomainsOrganizations(emails, tx)
+	if err != nil {
 		return
 	}
+	s.InferAffiliationTimeline(segments, emails, orgDomains)
 	return
 }
 
-func (s *service) MoveIdentityToUniqueIdentity(identity *models.IdentityDataOutput, uniqueIdentity *models.UniqueIdentityDataOutput, unarchive bool, tx *sql.Tx) (err error) {
-	log.Info(
-		fmt.Sprintf(
-			"MoveIdentityToUniqueIdentity: identity:%+v uniqueIdentity:%+v unarchive:%v tx:%v",
-			s.ToLocalIdentity(identity),
-			s.ToLocalUniqueIdentity(uniqueIdentity),
-			unarchive,
-			tx != nil,
-		),
-	)
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"MoveIdentityToUniqueIdentity(exit): identity:%+v uniqueIdentity:%+v unarchive:%v tx:%v err:%v",
-				s.ToLocalIdentity(identity),
-				s.ToLocalUniqueIdentity(uniqueIdentity),
-				unarchive,
-				tx != nil,
-				err,
-			),
-		)
-	}()
-	if identity.UUID != nil && (*(identity.UUID) == uniqueIdentity.UUID) {
-		return
+// AffiliationTimeline - returns piecewise timeline of resolved affiliations in [from, to) date range
+// Resolved affiliation can only change when some enrollment starts or ends, so the 5-step algorithm
+// is applied at each such date, and consecutive segments with the same result are merged
+func (s *service) AffiliationTimeline(pSlug string, from, to time.Time, rols []*models.AffiliationCandidate) (segments []*models.AffiliationTimelineSegment) {
+	if pSlug == "(empty)" {
+		pSlug = ""
 	}
-	var oldUniqueIdentity *models.UniqueIdentityDataOutput
-	if identity.UUID != nil {
-		oldUniqueIdentity, err = s.GetUniqueIdentity(*(identity.UUID), true, tx)
-		if err != nil {
-			return
+	segments = []*models.AffiliationTimelineSegment{}
+	sorted := affSortByID(rols)
+	steps := s.AffiliationPolicySteps(pSlug)
+	points := []time.Time{from, to}
+	for _, rol := range sorted {
+		for _, dt := range []time.Time{time.Time(rol.Start), time.Time(rol.End)} {
+			if dt.After(from) && dt.Before(to) {
+				points = append(points, dt)
+			}
 		}
 	}
-	identity.UUID = &uniqueIdentity.UUID
-	identity.LastModified = s.Now()
-	identity, err = s.EditIdentity(identity, true, tx)
-	if err != nil {
-		return
-	}
-	if oldUniqueIdentity != nil {
-		affected := int64(0)
-		affected, err = s.TouchUniqueIdentity(oldUniqueIdentity.UUID, tx)
-		if err != nil {
-			return
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Before(points[j])
+	})
+	var last *models.AffiliationTimelineSegment
+	for i := 0; i < len(points)-1; i++ {
+		if points[i].Equal(points[i+1]) {
+			continue
 		}
-		if affected != 1 {
-			err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(oldUniqueIdentity), affected)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentityToUniqueIdentity")
-			return
+		orgs, step := affResolve(pSlug, points[i], false, sorted, steps)
+		if len(orgs) == 0 {
+			orgs = []string{"Unknown"}
 		}
-		affected, err = s.TouchUniqueIdentity(uniqueIdentity.UUID, tx)
-		if err != nil {
-			return
+		if last != nil && int(last.Step) == step && affSameOrgs(last.Orgs, orgs) {
+			last.End = strfmt.DateTime(points[i+1])
+			continue
 		}
-		if affected != 1 {
-			err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(uniqueIdentity), affected)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentityToUniqueIdentity")
-			return
+		last = &models.AffiliationTimelineSegment{
+			Start:    strfmt.DateTime(points[i]),
+			End:      strfmt.DateTime(points[i+1]),
+			Org:      orgs[0],
+			Orgs:     orgs,
+			Step:     int64(step),
+			StepName: shared.AffStepNames[step],
 		}
+		segments = append(segments, last)
 	}
 	return
 }
 
-func (s *service) AddMatchingBlacklist(inMatchingBlacklist *models.MatchingBlacklistOutput, refresh bool, tx *sql.Tx) (matchingBlacklist *models.MatchingBlacklistOutput, err error) {
-	log.Info(fmt.Sprintf("AddMatchingBlacklist: inMatchingBlacklist:%+v refresh:%v tx:%v", inMatchingBlacklist, refresh, tx != nil))
-	matchingBlacklist = inMatchingBlacklist
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"AddMatchingBlacklist(exit): inMatchingBlacklist:%+v refresh:%v tx:%v matchingBlacklist:%+v err:%v",
-				inMatchingBlacklist,
-				refresh,
-				tx != nil,
-				matchingBlacklist,
-				err,
-			),
-		)
-	}()
-	matchingBlacklist.Excluded = strings.TrimSpace(matchingBlacklist.Excluded)
-	_, err = s.Exec(
-		s.db,
-		tx,
-		"insert into matching_blacklist(excluded, last_modified_by) select ?, ?",
-		matchingBlacklist.Excluded,
-		s.lfid,
-	)
-	if err != nil {
-		matchingBlacklist = nil
+// InferAffiliationTimeline - sets organizations inferred from given emails' domains (domain step) on timeline segments that no enrollment matched
+// Inferred organizations do not depend on date and uncovered segments are never adjacent, so segments don't need to be merged again
+func (s *service) InferAffiliationTimeline(segments []*models.AffiliationTimelineSegment, emails []string, orgDomains []*models.DomainDataOutput) {
+	orgs, _ := s.InferAffiliationsFromEmails(emails, orgDomains, false)
+	if len(orgs) == 0 {
 		return
 	}
-	if refresh {
-		matchingBlacklist, err = s.FetchMatchingBlacklist(matchingBlacklist.Excluded, true, tx)
-		if err != nil {
-			matchingBlacklist = nil
-			return
+	for _, segment := range segments {
+		if segment.Step != shared.AffStepNone {
+			continue
 		}
+		segment.Org = orgs[0]
+		segment.Orgs = orgs
+		segment.Step = shared.AffStepDomain
+		segment.StepName = shared.AffStepNames[shared.AffStepDomain]
+		segment.Inferred = true
 	}
-	return
 }
 
-func (s *service) EnrichContributors(contributors []*models.ContributorFlatStats, projectSlugs []string, millisSinceEpoch int64, tx *sql.Tx) (err error) {
-	inf := ""
-	n := len(contributors)
-	if n > shared.LogListMax {
-		inf = fmt.Sprintf("%d", n)
-	} else {
-		inf = fmt.Sprintf("%+v", s.ToLocalTopContributorsFlat(contributors))
-	}
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	found := 0
-	orgFound := 0
-	log.Debug(fmt.Sprintf("EnrichContributors: contributors:%s projectSlugs:%+v millisSinceEpoch:%d tx:%v", inf, projectSlugs, millisSinceEpoch, tx != nil))
+// GetAffiliationGaps - returns contributors (from activity) who were active in a given project during periods that no enrollment covers
+// Profiles are sorted by the estimated number of uncovered contributions (descending), contributors without gaps are skipped
+func (s *service) GetAffiliationGaps(pSlug string, activity []*models.ContributorActivity, tx *sql.Tx) (profiles []*models.AffiliationGapsProfile, err error) {
+	n := len(activity)
+	log.Info(fmt.Sprintf("GetAffiliationGaps: pSlug:%s activity:%d tx:%v", pSlug, n, tx != nil))
 	defer func() {
-		log.Debug(
-			fmt.Sprintf(
-				"EnrichContributors(exit): contributors:%s projectSlugs:%+v millisSinceEpoch:%d tx:%v found:%d/%d/%d err:%v",
-				inf,
-				projectSlugs,
-				millisSinceEpoch,
-				tx != nil,
-				orgFound,
-				found,
-				n,
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("GetAffiliationGaps(exit): pSlug:%s activity:%d tx:%v profiles:%d err:%v", pSlug, n, tx != nil, len(profiles), err))
 	}()
-	if len(contributors) == 0 {
+	profiles = []*models.AffiliationGapsProfile{}
+	if n == 0 {
 		return
 	}
-	pSlugs := []string{}
-	fLikes := []string{}
-	for _, projectSlug := range projectSlugs {
-		if strings.HasSuffix(projectSlug, "-f") {
-			fLikes = append(fLikes, projectSlug[:len(projectSlug)-2]+"/%")
-		} else {
-			pSlugs = append(pSlugs, projectSlug)
-		}
-	}
-	//fmt.Printf("pSlugs: %v\nfLikes: %v\n", pSlugs, fLikes)
-	secsSinceEpoch := float64(millisSinceEpoch) / 1000.0
-	sel := "select distinct p.uuid, coalesce(p.name, ''), coalesce(p.email, ''), coalesce(o.name, '') from profiles p left join enrollments e"
-	sel += fmt.Sprintf(
-		" on p.uuid = e.uuid and e.start <= coalesce(from_unixtime(%f), now()) and e.end >= coalesce(from_unixtime(%f), now())",
-		secsSinceEpoch,
-		secsSinceEpoch,
-	)
-	uuids := []interface{}{}
-	sel += " and (e.project_slug is null"
-	if len(pSlugs) > 0 {
-		sel += " or e.project_slug in ("
-		for _, pSlug := range pSlugs {
-			sel += "?,"
-			uuids = append(uuids, pSlug)
+	uuids := []string{}
+	from, to := time.Time(activity[0].First), time.Time(activity[0].Last)
+	for _, contributor := range activity {
+		uuids = append(uuids, contributor.UUID)
+		if time.Time(contributor.First).Before(from) {
+			from = time.Time(contributor.First)
 		}
-		sel = sel[0:len(sel)-1] + ")"
-	}
-	if len(fLikes) > 0 {
-		for _, fLike := range fLikes {
-			sel += " or e.project_slug like ?"
-			uuids = append(uuids, fLike)
+		if time.Time(contributor.Last).After(to) {
+			to = time.Time(contributor.Last)
 		}
 	}
-	sel += ") left join organizations o on e.organization_id = o.id where p.uuid in ("
-	data := make(map[string][3]string)
-	for _, contributor := range contributors {
-		uuid := contributor.UUID
-		uuids = append(uuids, uuid)
-		sel += "?,"
-	}
-	sel = sel[0:len(sel)-1] + ")"
-	sel += " order by e.project_slug is null"
-	var rows *sql.Rows
-	// fmt.Printf("\n%+v\n%s\n\n", uuids, sel)
-	rows, err = s.Query(sdb, tx, sel, uuids...)
+	rols, err := s.GetAffiliationCandidatesMulti(uuids, from, to, tx)
 	if err != nil {
 		return
 	}
-	uuid := ""
-	name := ""
-	email := ""
-	org := ""
-	for rows.Next() {
-		err = rows.Scan(&uuid, &name, &email, &org)
-		if err != nil {
-			return
-		}
-		_, ok := data[uuid]
-		if !ok {
-			data[uuid] = [3]string{name, email, org}
+	for _, contributor := range activity {
+		gaps, uncovered := s.AffiliationGaps(pSlug, contributor, rols[contributor.UUID])
+		if len(gaps) == 0 {
+			continue
 		}
+		profiles = append(
+			profiles,
+			&models.AffiliationGapsProfile{
+				UUID:                   contributor.UUID,
+				ProjectSlug:            pSlug,
+				FirstActivity:          contributor.First,
+				LastActivity:           contributor.Last,
+				Contributions:          contributor.Contributions,
+				UncoveredContributions: uncovered,
+				Gaps:                   gaps,
+			},
+		)
 	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	missUUIDs := []string{}
-	for idx, contributor := range contributors {
-		uuid := contributor.UUID
-		ary, ok := data[uuid]
-		if ok {
-			contributors[idx].Name = ary[0]
-			contributors[idx].Email = ary[1]
-			contributors[idx].Organization = ary[2]
-			found++
-			if ary[2] != "" {
-				orgFound++
-			}
-		} else {
-			missUUIDs = append(missUUIDs, uuid)
-		}
+	byUUID := make(map[string]*models.AffiliationGapsProfile)
+	for _, profile := range profiles {
+		byUUID[profile.UUID] = profile
 	}
-	if len(missUUIDs) > 0 {
-		sel := "select distinct p.uuid, coalesce(p.name, ''), coalesce(p.email, ''), coalesce(o.name, '') from profiles_archive p left join enrollments_archive e"
-		sel += fmt.Sprintf(
-			" on p.archived_at = e.archived_at and p.uuid = e.uuid and e.start <= coalesce(from_unixtime(%f), now()) and e.end >= coalesce(from_unixtime(%f), now())",
-			secsSinceEpoch,
-			secsSinceEpoch,
-		)
-		uuids := []interface{}{}
-		sel += " and (e.project_slug is null"
-		if len(pSlugs) > 0 {
-			sel += " or e.project_slug in ("
-			for _, pSlug := range pSlugs {
-				sel += "?,"
-				uuids = append(uuids, pSlug)
-			}
-			sel = sel[0:len(sel)-1] + ")"
-		}
-		if len(fLikes) > 0 {
-			for _, fLike := range fLikes {
-				sel += " or e.project_slug like ?"
-				uuids = append(uuids, fLike)
-			}
+	nProfiles := len(profiles)
+	for i := 0; i < nProfiles; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > nProfiles {
+			j = nProfiles
 		}
-		sel += ") left join organizations o on e.organization_id = o.id where p.uuid in ("
-		data := make(map[string][3]string)
-		for _, uuid := range missUUIDs {
-			uuids = append(uuids, uuid)
+		sel := "select uuid, coalesce(name, ''), coalesce(email, '') from profiles where uuid in ("
+		args := []interface{}{}
+		for _, profile := range profiles[i:j] {
 			sel += "?,"
+			args = append(args, profile.UUID)
 		}
 		sel = sel[0:len(sel)-1] + ")"
-		sel += " order by e.project_slug is null, p.uuid asc, p.archived_at desc"
 		var rows *sql.Rows
-		rows, err = s.Query(sdb, tx, sel, uuids...)
+		rows, err = s.Query(sdb, tx, sel, args...)
 		if err != nil {
 			return
 		}
-		uuid := ""
-		name := ""
-		email := ""
-		org := ""
+		uuid, name, email := "", "", ""
 		for rows.Next() {
-			err = rows.Scan(&uuid, &name, &email, &org)
+			err = rows.Scan(&uuid, &name, &email)
 			if err != nil {
 				return
 			}
-			_, ok := data[uuid]
-			if !ok {
-				data[uuid] = [3]string{name, email, org}
+			profile, ok := byUUID[uuid]
+			if ok {
+				profile.Name = name
+				profile.Email = email
 			}
 		}
 		err = rows.Err()
@@ -1577,229 +1848,294 @@ func (s *service) EnrichContributors(contributors []*models.ContributorFlatStats
 		if err != nil {
 			return
 		}
-		for idx, contributor := range contributors {
-			uuid := contributor.UUID
-			ary, ok := data[uuid]
-			if ok {
-				contributors[idx].Name = ary[0]
-				contributors[idx].Email = ary[1]
-				contributors[idx].Organization = ary[2]
-				found++
-				if ary[2] != "" {
-					orgFound++
-				}
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].UncoveredContributions > profiles[j].UncoveredContributions
+	})
+	return
+}
+
+// AffiliationGaps - returns periods between contributor's first and last activity in which the 5-step algorithm finds no enrollment
+// Each gap is weighted by the number of contributions made in it: monthly contributions counts are split proportionally
+// to the part of the month's active period that the gap covers. Also returns the sum of all gaps' contributions.
+func (s *service) AffiliationGaps(pSlug string, activity *models.ContributorActivity, rols []*models.AffiliationCandidate) (gaps []*models.AffiliationGap, uncovered float64) {
+	from := s.DayStart(time.Time(activity.First))
+	to := s.DayStart(time.Time(activity.Last)).AddDate(0, 0, 1)
+	overlap := func(st1, en1, st2, en2 time.Time) time.Duration {
+		if st2.After(st1) {
+			st1 = st2
+		}
+		if en2.Before(en1) {
+			en1 = en2
+		}
+		if !st1.Before(en1) {
+			return 0
+		}
+		return en1.Sub(st1)
+	}
+	for _, segment := range s.AffiliationTimeline(pSlug, from, to, rols) {
+		if segment.Step != shared.AffStepNone {
+			continue
+		}
+		gapStart, gapEnd := time.Time(segment.Start), time.Time(segment.End)
+		contributions := 0.0
+		for _, month := range activity.Months {
+			// only the part of the month between first and last activity is active
+			monthStart, monthEnd := time.Time(month.Start), time.Time(month.Start).AddDate(0, 1, 0)
+			if from.After(monthStart) {
+				monthStart = from
 			}
+			if to.Before(monthEnd) {
+				monthEnd = to
+			}
+			if !monthStart.Before(monthEnd) {
+				continue
+			}
+			contributions += float64(month.Contributions) * float64(overlap(gapStart, gapEnd, monthStart, monthEnd)) / float64(monthEnd.Sub(monthStart))
 		}
+		contributions = math.Round(contributions*100.0) / 100.0
+		gaps = append(gaps, &models.AffiliationGap{Start: segment.Start, End: segment.End, Contributions: contributions})
+		uncovered += contributions
 	}
+	uncovered = math.Round(uncovered*100.0) / 100.0
 	return
 }
 
-func (s *service) CheckUnaffiliated(inUnaffiliated []*models.UnaffiliatedDataOutput, projectSlugs []string, tx *sql.Tx) (unaffiliated []*models.UnaffiliatedDataOutput, err error) {
-	inunaff := ""
-	nUnaffiliated := len(inUnaffiliated)
-	if nUnaffiliated > shared.LogListMax {
-		inunaff = fmt.Sprintf("%d", nUnaffiliated)
-	} else {
-		inunaff = fmt.Sprintf("%+v", s.ToLocalUnaffiliated(inUnaffiliated))
+// FilterAffiliationCandidates - returns only enrollments with a given role (all enrollments if role is empty)
+func (s *service) FilterAffiliationCandidates(rols []*models.AffiliationCandidate, role string) (filtered []*models.AffiliationCandidate) {
+	if role == "" {
+		return rols
 	}
-	log.Info(fmt.Sprintf("CheckUnaffiliated: inUnaffiliated:%s projectSlugs:%+v tx:%v", inunaff, projectSlugs, tx != nil))
-	defer func() {
-		unaff := ""
-		nUnaffiliated := len(unaffiliated)
-		if nUnaffiliated > shared.LogListMax {
-			unaff = fmt.Sprintf("%d", nUnaffiliated)
-		} else {
-			unaff = fmt.Sprintf("%+v", s.ToLocalUnaffiliated(unaffiliated))
+	for _, rol := range rols {
+		if strings.EqualFold(rol.Role, role) {
+			filtered = append(filtered, rol)
 		}
-		log.Info(
-			fmt.Sprintf(
-				"CheckUnaffiliated(exit): inUnaffiliated:%+v projectSlugs:%+v tx:%v unaffiliated:%+v err:%v",
-				inunaff,
-				projectSlugs,
-				tx != nil,
-				unaff,
-				err,
-			),
-		)
-	}()
-	if len(inUnaffiliated) == 0 {
-		log.Info("No unaffiliated data to check")
-		return
 	}
+	return
+}
+
+// GetEmployerChanges - returns profiles whose resolved affiliation for any of their projects differs between t1 and t2
+// uuidsProjects maps profiles to check to projects they contribute to (see elastic GetUUIDsProjects)
+// Only profiles having enrollment(s) active on t1 or t2 are checked, if role is set only enrollments with that role are used
+func (s *service) GetEmployerChanges(uuidsProjects map[string][]string, role string, t1, t2 time.Time, tx *sql.Tx) (changes []*models.EmployerChange, err error) {
+	log.Info(fmt.Sprintf("GetEmployerChanges: uuidsProjects:%d role:%s t1:%v t2:%v tx:%v", len(uuidsProjects), role, t1, t2, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("GetEmployerChanges(exit): uuidsProjects:%d role:%s t1:%v t2:%v tx:%v changes:%d err:%v", len(uuidsProjects), role, t1, t2, tx != nil, len(changes), err))
+	}()
 	sdb := s.rodb
 	if tx != nil {
 		sdb = s.db
 	}
-	sel := "select p.uuid, p.name, e.uuid from profiles p left join enrollments e on p.uuid = e.uuid"
-	sel += " where (p.is_bot is null or p.is_bot = 0) and p.uuid in ("
-	uuids := []interface{}{}
-	contribs := make(map[string]int64)
-	for _, unaff := range inUnaffiliated {
-		uuid := unaff.UUID
-		uuids = append(uuids, uuid)
-		sel += "?,"
-		contribs[uuid] = unaff.Contributions
-	}
-	sel = sel[0:len(sel)-1] + ") and (e.project_slug is null or e.project_slug in ("
-	for _, projectSlug := range projectSlugs {
-		sel += "?,"
-		uuids = append(uuids, projectSlug)
-	}
-	sel = sel[0:len(sel)-1] + ")) order by e.project_slug is null"
-	var rows *sql.Rows
-	rows, err = s.Query(sdb, tx, sel, uuids...)
-	if err != nil {
-		return
+	all := []string{}
+	for uuid := range uuidsProjects {
+		all = append(all, uuid)
 	}
-	uuid := ""
-	var (
-		puuid *string
-		pname *string
-	)
-	for rows.Next() {
-		err = rows.Scan(&uuid, &pname, &puuid)
+	sort.Strings(all)
+	uuids := []string{}
+	profs := make(map[string][2]string)
+	n := len(all)
+	for i := 0; i < n; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > n {
+			j = n
+		}
+		sel := "select distinct e.uuid, coalesce(p.name, ''), coalesce(p.email, '') from enrollments e left join profiles p on p.uuid = e.uuid " +
+			"where ((e.start <= ? and e.end > ?) or (e.start <= ? and e.end > ?))"
+		args := []interface{}{t1, t1, t2, t2}
+		if role != "" {
+			sel += " and e.role = ?"
+			args = append(args, role)
+		}
+		sel += " and e.uuid in ("
+		for _, uuid := range all[i:j] {
+			sel += "?,"
+			args = append(args, uuid)
+		}
+		sel = sel[0:len(sel)-1] + ") order by e.uuid"
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, sel, args...)
 		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetEmployerChanges")
 			return
 		}
-		if puuid == nil {
-			name := ""
-			if pname != nil {
-				name = *pname
+		uuid, name, email := "", "", ""
+		for rows.Next() {
+			err = rows.Scan(&uuid, &name, &email)
+			if err != nil {
+				return
 			}
-			unaffiliated = append(unaffiliated, &models.UnaffiliatedDataOutput{UUID: uuid, Name: name, Contributions: contribs[uuid]})
+			uuids = append(uuids, uuid)
+			profs[uuid] = [2]string{name, email}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
 		}
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	from, to := t1, t2
+	if to.Before(from) {
+		from, to = to, from
 	}
-	err = rows.Close()
+	rols, err := s.GetAffiliationCandidatesMulti(uuids, from, to, tx)
 	if err != nil {
 		return
 	}
-	sort.SliceStable(unaffiliated, func(i, j int) bool {
-		return unaffiliated[i].Contributions > unaffiliated[j].Contributions
-	})
-	return
-}
-
-func (s *service) AddOrganization(inOrganization *models.OrganizationDataOutput, refresh bool, tx *sql.Tx) (organization *models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddOrganization: inOrganization:%+v refresh:%v tx:%v", s.ToLocalOrganization(inOrganization), refresh, tx != nil))
-	organization = inOrganization
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"AddOrganization(exit): inOrganization:%+v refresh:%v tx:%v organization:%+v err:%v",
-				s.ToLocalOrganization(inOrganization),
-				refresh,
-				tx != nil,
-				s.ToLocalOrganization(organization),
-				err,
-			),
-		)
-	}()
-	organization.Name = strings.TrimSpace(organization.Name)
-	// s.SetOrigin()
-	_, err = s.Exec(
-		s.db,
-		tx,
-		"insert into organizations(name,last_modified_by) select ?,?",
-		organization.Name,
-		s.lfid,
-	)
-	if err != nil {
-		organization = nil
-		return
+	// Domain step needs emails and domains_organizations entries, they are fetched once for all profiles whose projects use it
+	inferUUIDs := []string{}
+	for _, uuid := range uuids {
+		for _, pSlug := range uuidsProjects[uuid] {
+			if s.AffiliationDomainStep(pSlug, role) {
+				inferUUIDs = append(inferUUIDs, uuid)
+				break
+			}
+		}
 	}
-	if refresh {
-		organization, err = s.GetOrganizationByName(organization.Name, true, tx)
+	var (
+		emails     map[string][]string
+		orgDomains []*models.DomainDataOutput
+	)
+	if len(inferUUIDs) > 0 {
+		emails, err = s.GetAffiliationEmailsMulti(inferUUIDs, tx)
+		if err != nil {
+			return
+		}
+		allEmails := []string{}
+		for _, uuid := range inferUUIDs {
+			allEmails = append(allEmails, emails[uuid]...)
+		}
+		orgDomains, err = s.GetDomainsOrganizations(allEmails, tx)
 		if err != nil {
-			organization = nil
 			return
 		}
 	}
+	changes = s.EmployerChanges(uuidsProjects, role, t1, t2, rols, emails, orgDomains)
+	for _, change := range changes {
+		prof := profs[change.UUID]
+		change.Name = prof[0]
+		change.Email = prof[1]
+	}
 	return
 }
 
-func (s *service) AddUniqueIdentity(inUniqueIdentity *models.UniqueIdentityDataOutput, refresh bool, tx *sql.Tx) (uniqueIdentity *models.UniqueIdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddUniqueIdentity: inUniqueIdentity:%+v refresh:%v tx:%v", s.ToLocalUniqueIdentity(inUniqueIdentity), refresh, tx != nil))
-	uniqueIdentity = inUniqueIdentity
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"AddUniqueIdentity(exit): inUniqueIdentity:%+v refresh:%v tx:%v uniqueIdentity:%+v err:%v",
-				s.ToLocalUniqueIdentity(inUniqueIdentity),
-				refresh,
-				tx != nil,
-				s.ToLocalUniqueIdentity(uniqueIdentity),
-				err,
-			),
-		)
-	}()
-	uniqueIdentity.UUID = strings.TrimSpace(uniqueIdentity.UUID)
-	if uniqueIdentity.LastModified == nil {
-		uniqueIdentity.LastModified, err = s.DBDateTime()
-		if err != nil {
-			return nil, err
-		}
+// EmployerChanges - resolves affiliations on t1 and t2 for all profiles' enrollments and returns those that differ
+// Each profile is only checked for projects it is mapped to in uuidsProjects
+// If no enrollment matched and project's affiliation policy enables domain step, organizations are inferred from profiles' emails
+// domains using given domains_organizations entries (see GetAffiliationEmailsMulti and GetDomainsOrganizations), just like GetAffiliations does
+// Results are sorted by uuid and project slug, enrollment IDs are the ones that were used to resolve given affiliation
+func (s *service) EmployerChanges(uuidsProjects map[string][]string, role string, t1, t2 time.Time, rols map[string][]*models.AffiliationCandidate, emails map[string][]string, orgDomains []*models.DomainDataOutput) (changes []*models.EmployerChange) {
+	changes = []*models.EmployerChange{}
+	uuids := []string{}
+	for uuid := range rols {
+		uuids = append(uuids, uuid)
 	}
-	// s.SetOrigin()
-	_, err = s.Exec(
-		s.db,
-		tx,
-		"insert into uidentities(uuid, last_modified, last_modified_by) select ?, str_to_date(?, ?), ?",
-		uniqueIdentity.UUID,
-		uniqueIdentity.LastModified,
-		DateTimeFormat,
-		s.lfid,
-	)
-	if err != nil {
-		uniqueIdentity = nil
+	sort.Strings(uuids)
+	resolve := func(uuid, pSlug string, dt time.Time, urols []*models.AffiliationCandidate) (orgs []string, ids []int64, inferred bool) {
+		ids = []int64{}
+		orgs, expl := s.ResolveAffiliations(pSlug, dt, false, true, urols)
+		for _, rol := range expl.Matched {
+			ids = append(ids, rol.ID)
+		}
+		if len(orgs) == 0 && s.AffiliationDomainStep(pSlug, role) {
+			orgs, _ = s.InferAffiliationsFromEmails(emails[uuid], orgDomains, false)
+			inferred = len(orgs) > 0
+		}
+		if len(orgs) == 0 {
+			orgs = []string{"Unknown"}
+		}
 		return
 	}
-	if refresh {
-		uniqueIdentity, err = s.GetUniqueIdentity(uniqueIdentity.UUID, true, tx)
-		if err != nil {
-			uniqueIdentity = nil
-			return
+	for _, uuid := range uuids {
+		urols := s.FilterAffiliationCandidates(rols[uuid], role)
+		projectSlugs := append([]string{}, uuidsProjects[uuid]...)
+		sort.Strings(projectSlugs)
+		for _, pSlug := range projectSlugs {
+			oldOrgs, oldIDs, oldInferred := resolve(uuid, pSlug, t1, urols)
+			newOrgs, newIDs, newInferred := resolve(uuid, pSlug, t2, urols)
+			if affSameOrgs(oldOrgs, newOrgs) {
+				continue
+			}
+			changes = append(
+				changes,
+				&models.EmployerChange{
+					UUID:             uuid,
+					ProjectSlug:      pSlug,
+					OldOrg:           oldOrgs[0],
+					OldOrgs:          oldOrgs,
+					OldEnrollmentIds: oldIDs,
+					OldInferred:      oldInferred,
+					NewOrg:           newOrgs[0],
+					NewOrgs:          newOrgs,
+					NewEnrollmentIds: newIDs,
+					NewInferred:      newInferred,
+				},
+			)
 		}
 	}
 	return
 }
 
-func (s *service) FindUniqueIdentityOrganizations(uuid string, missingFatal bool, tx *sql.Tx) (organizations []*models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindUniqueIdentityOrganizations: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
+// DetectEnrollmentConflicts - scans all enrollments profile by profile and returns profiles having any enrollment conflicts, see EnrollmentConflicts
+func (s *service) DetectEnrollmentConflicts(tx *sql.Tx) (profiles []*models.EnrollmentConflictsProfile, err error) {
+	log.Info(fmt.Sprintf("DetectEnrollmentConflicts: tx:%v", tx != nil))
+	nEnrollments := 0
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FindUniqueIdentityOrganizations(exit): uuid:%s missingFatal:%v tx:%v organizations:%+v err:%v",
-				uuid,
-				missingFatal,
-				tx != nil,
-				s.ToLocalOrganizations(organizations),
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("DetectEnrollmentConflicts(exit): tx:%v enrollments:%d profiles:%d err:%v", tx != nil, nEnrollments, len(profiles), err))
 	}()
 	sdb := s.rodb
 	if tx != nil {
 		sdb = s.db
 	}
-	sel := "select distinct o.id, o.name from organizations o, enrollments e where e.organization_id = o.id and e.uuid = ? order by o.name asc"
-	rows, err := s.Query(sdb, tx, sel, uuid)
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select e.id, e.uuid, e.start, e.end, e.project_slug, e.role, e.provenance, e.evidence_url, e.evidence_notes, e.confidence, o.id, o.name from enrollments e, organizations o "+
+			"where e.organization_id = o.id order by e.uuid asc, e.start asc, e.end asc, e.id asc",
+	)
 	if err != nil {
 		return
 	}
+	profiles = []*models.EnrollmentConflictsProfile{}
+	enrollments := []*models.EnrollmentNestedDataOutput{}
+	check := func() {
+		if len(enrollments) == 0 {
+			return
+		}
+		conflicts := s.EnrollmentConflicts(enrollments)
+		if len(conflicts) > 0 {
+			profiles = append(profiles, &models.EnrollmentConflictsProfile{UUID: enrollments[0].UUID, Conflicts: conflicts})
+		}
+		enrollments = []*models.EnrollmentNestedDataOutput{}
+	}
+	oName := ""
 	for rows.Next() {
-		organizationData := &models.OrganizationDataOutput{}
+		enrollmentData := &models.EnrollmentNestedDataOutput{}
 		err = rows.Scan(
-			&organizationData.ID,
-			&organizationData.Name,
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+			&enrollmentData.OrganizationID,
+			&oName,
 		)
 		if err != nil {
 			return
 		}
-		organizations = append(organizations, organizationData)
+		enrollmentData.Organization = &models.OrganizationDataOutput{ID: enrollmentData.OrganizationID, Name: oName}
+		if len(enrollments) > 0 && enrollments[0].UUID != enrollmentData.UUID {
+			check()
+		}
+		enrollments = append(enrollments, enrollmentData)
+		nEnrollments++
 	}
 	err = rows.Err()
 	if err != nil {
@@ -1809,235 +2145,272 @@ func (s *service) FindUniqueIdentityOrganizations(uuid string, missingFatal bool
 	if err != nil {
 		return
 	}
-	if missingFatal && len(organizations) == 0 {
-		err = fmt.Errorf("cannot find organizations for uuid %s", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindUniqueIdenityOrganizations")
-		return
-	}
+	check()
 	return
 }
 
-func (s *service) FindProfiles(columns []string, values []interface{}, missingFatal bool, tx *sql.Tx) (profiles []*models.ProfileDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindProfiles: columns:%+v values:%+v missingFatal:%v tx:%v", columns, values, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FindProfiles(exit): columns:%+v values:%+v missingFatal:%v tx:%v profiles:%+v err:%v",
-				columns,
-				values,
-				missingFatal,
-				tx != nil,
-				s.ToLocalProfiles(profiles),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+// MergeSuggestionScore - scores how likely two profiles are the same person, returns score 0-1 and reasons it was computed from
+// Signals: same email (0.9), same username in any source (0.6), same email local part (0.4), names Jaro-Winkler similarity
+// (names are transliterated using StripUnicode, 0.45 for the same name), shared enrollment organizations (0.2).
+// Score combines all signals: 1 - (1-w1)*(1-w2)*..., so no single weak signal can produce a high score
+func (s *service) MergeSuggestionScore(a, b *models.MergeSuggestionProfile) (score float64, reasons []string) {
+	reasons = []string{}
+	type values struct {
+		names     map[string]struct{}
+		emails    map[string]struct{}
+		locals    map[string]struct{}
+		usernames map[string]map[string]struct{}
+		orgs      map[string]struct{}
+	}
+	normName := func(name string) string {
+		name = s.StripUnicode(strings.ToLower(name))
+		return strings.Join(strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }), " ")
+	}
+	collect := func(prof *models.MergeSuggestionProfile) (v values) {
+		v = values{
+			names:     make(map[string]struct{}),
+			emails:    make(map[string]struct{}),
+			locals:    make(map[string]struct{}),
+			usernames: make(map[string]map[string]struct{}),
+			orgs:      make(map[string]struct{}),
+		}
+		addName := func(name *string) {
+			if name == nil || *name == ErasedName || strings.HasSuffix(*name, "-MISSING-NAME") || strings.HasSuffix(*name, "-REDACTED-EMAIL") {
+				return
+			}
+			n := normName(*name)
+			if n != "" {
+				v.names[n] = struct{}{}
+			}
+		}
+		addEmail := func(email *string) {
+			if email == nil {
+				return
+			}
+			e := strings.ToLower(strings.TrimSpace(*email))
+			ary := strings.Split(e, "@")
+			if len(ary) != 2 || ary[0] == "" || ary[1] == "" {
+				return
+			}
+			v.emails[e] = struct{}{}
+			if len(ary[0]) >= 3 {
+				v.locals[ary[0]] = struct{}{}
+			}
+		}
+		addName(prof.Name)
+		addEmail(prof.Email)
+		for _, identity := range prof.Identities {
+			addName(identity.Name)
+			addEmail(identity.Email)
+			if identity.Username == nil {
+				continue
+			}
+			username := strings.ToLower(strings.TrimSpace(*identity.Username))
+			if username == "" {
+				continue
+			}
+			if _, ok := v.usernames[username]; !ok {
+				v.usernames[username] = make(map[string]struct{})
+			}
+			v.usernames[username][identity.Source] = struct{}{}
+		}
+		for _, org := range prof.Organizations {
+			v.orgs[org] = struct{}{}
+		}
+		return
 	}
-	// sel := "select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles"
-	sel := "select uuid, name, email, is_bot, country_code from profiles"
-	nColumns := len(columns)
-	lastIndex := nColumns - 1
-	if nColumns > 0 {
-		sel += " where"
+	sortedKeys := func(m map[string]struct{}) (keys []string) {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return
 	}
-	for index := range columns {
-		column := columns[index]
-		sel += " " + column + " = ?"
-		if index < lastIndex {
-			sel += " and"
+	va, vb := collect(a), collect(b)
+	rest := 1.0
+	add := func(weight float64, reason string) {
+		rest *= 1.0 - weight
+		reasons = append(reasons, reason)
+	}
+	sameEmail := false
+	for _, email := range sortedKeys(va.emails) {
+		if _, ok := vb.emails[email]; ok {
+			add(0.9, fmt.Sprintf("same email '%s'", email))
+			sameEmail = true
+			break
 		}
 	}
-	sel += " order by uuid asc"
-	rows, err := s.Query(sdb, tx, sel, values...)
-	if err != nil {
-		return
+	usernames := []string{}
+	for username := range va.usernames {
+		if _, ok := vb.usernames[username]; ok {
+			usernames = append(usernames, username)
+		}
 	}
-	for rows.Next() {
-		profileData := &models.ProfileDataOutput{}
-		err = rows.Scan(
-			&profileData.UUID,
-			&profileData.Name,
-			&profileData.Email,
-			//&profileData.Gender,
-			//&profileData.GenderAcc,
-			&profileData.IsBot,
-			&profileData.CountryCode,
-		)
-		if err != nil {
-			return
+	if len(usernames) > 0 {
+		sort.Strings(usernames)
+		sources := make(map[string]struct{})
+		for _, src := range []map[string]struct{}{va.usernames[usernames[0]], vb.usernames[usernames[0]]} {
+			for source := range src {
+				sources[source] = struct{}{}
+			}
 		}
-		profiles = append(profiles, profileData)
+		add(0.6, fmt.Sprintf("same username '%s' (%s)", usernames[0], strings.Join(sortedKeys(sources), ", ")))
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	if !sameEmail {
+		for _, local := range sortedKeys(va.locals) {
+			if _, ok := vb.locals[local]; ok {
+				add(0.4, fmt.Sprintf("same email local part '%s'", local))
+				break
+			}
+		}
 	}
-	err = rows.Close()
-	if err != nil {
-		return
+	sortTokens := func(name string) string {
+		tokens := strings.Fields(name)
+		sort.Strings(tokens)
+		return strings.Join(tokens, " ")
 	}
-	if missingFatal && len(profiles) == 0 {
-		err = fmt.Errorf("cannot find profiles for %+v/%+v", columns, values)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindProfiles")
-		return
+	best, bestA, bestB := 0.0, "", ""
+	for _, na := range sortedKeys(va.names) {
+		for _, nb := range sortedKeys(vb.names) {
+			sim := math.Max(s.JaroWinkler(na, nb), s.JaroWinkler(sortTokens(na), sortTokens(nb)))
+			if sim > best {
+				best, bestA, bestB = sim, na, nb
+			}
+		}
+	}
+	if best >= 0.85 {
+		if best >= 1.0 {
+			add(0.45, fmt.Sprintf("same name '%s'", bestA))
+		} else {
+			add(0.45*best, fmt.Sprintf("similar names '%s' and '%s' (%.2f)", bestA, bestB, best))
+		}
+	}
+	orgs := []string{}
+	for _, org := range sortedKeys(va.orgs) {
+		if _, ok := vb.orgs[org]; ok {
+			orgs = append(orgs, org)
+		}
 	}
+	if len(orgs) > 0 {
+		add(0.2, "shared organizations: "+strings.Join(orgs, ", "))
+	}
+	score = math.Round((1.0-rest)*100.0) / 100.0
 	return
 }
 
-func (s *service) FindOrganizations(columns []string, values []interface{}, missingFatal bool, tx *sql.Tx) (organizations []*models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindOrganizations: columns:%+v values:%+v missingFatal:%v tx:%v", columns, values, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FindOrganizations(exit): columns:%+v values:%+v missingFatal:%v tx:%v organizations:%+v err:%v",
-				columns,
-				values,
-				missingFatal,
-				tx != nil,
-				s.ToLocalOrganizations(organizations),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	sel := "select id, name from organizations"
-	nColumns := len(columns)
-	lastIndex := nColumns - 1
-	if nColumns > 0 {
-		sel += " where"
-	}
-	for index := range columns {
-		column := columns[index]
-		sel += " " + column + " = ?"
-		if index < lastIndex {
-			sel += " and"
-		}
-	}
-	sel += " order by name asc"
-	rows, err := s.Query(sdb, tx, sel, values...)
-	if err != nil {
+// MergeSuggestionNameKeys - returns keys used to block profiles by name in DetectMergeSuggestions: transliterated lower case name
+// tokens sorted (so "Łukasz Nowak" and "nowak lukasz" share a key) and their Soundex codes sorted, prefixed with "~" (so "Jon Smith"
+// and "John Smith" share a key). Names having less than two tokens and missing, redacted or erased names have no keys
+func (s *service) MergeSuggestionNameKeys(name string) (keys []string) {
+	if name == ErasedName || strings.HasSuffix(name, "-MISSING-NAME") || strings.HasSuffix(name, "-REDACTED-EMAIL") {
 		return
 	}
-	for rows.Next() {
-		organizationData := &models.OrganizationDataOutput{}
-		err = rows.Scan(
-			&organizationData.ID,
-			&organizationData.Name,
-		)
-		if err != nil {
-			return
-		}
-		organizations = append(organizations, organizationData)
-	}
-	err = rows.Err()
-	if err != nil {
+	tokens := strings.FieldsFunc(
+		s.StripUnicode(strings.ToLower(name)),
+		func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) },
+	)
+	if len(tokens) < 2 {
 		return
 	}
-	err = rows.Close()
-	if err != nil {
-		return
+	sort.Strings(tokens)
+	keys = append(keys, strings.Join(tokens, " "))
+	codes := []string{}
+	for _, token := range tokens {
+		code := s.Soundex(token)
+		if code != "" {
+			codes = append(codes, code)
+		}
 	}
-	if missingFatal && len(organizations) == 0 {
-		err = fmt.Errorf("cannot find organizations for %+v/%+v", columns, values)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindOrganizations")
+	if len(codes) < 2 {
 		return
 	}
+	sort.Strings(codes)
+	keys = append(keys, "~"+strings.Join(codes, " "))
 	return
 }
 
-func (s *service) FindEnrollmentsNested(columns []string, values []interface{}, isDate []bool, missingFatal bool, projectSlugs []string, tx *sql.Tx) (enrollments []*models.EnrollmentNestedDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindEnrollmentsNested: columns:%+v values:%+v isDate:%+v missingFatal:%v projectSlugs:%v tx:%v", columns, values, isDate, missingFatal, projectSlugs, tx != nil))
-	// s.SetOrigin()
+// DetectMergeSuggestions - finds pairs of profiles sharing an email local part, username (case insensitive) or name key
+// (see MergeSuggestionNameKeys and shared.MergeSuggestionMaxBlock) and returns them scored by MergeSuggestionScore, the most likely first
+func (s *service) DetectMergeSuggestions(tx *sql.Tx) (suggestions []*models.MergeSuggestion, err error) {
+	log.Info(fmt.Sprintf("DetectMergeSuggestions: tx:%v", tx != nil))
+	nPairs := 0
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FindEnrollmentsNested(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v projectSlugs:%+v tx:%v enrollments:%+v err:%v",
-				columns,
-				values,
-				isDate,
-				missingFatal,
-				projectSlugs,
-				tx != nil,
-				s.ToLocalNestedEnrollments(enrollments),
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("DetectMergeSuggestions(exit): tx:%v pairs:%d suggestions:%d err:%v", tx != nil, nPairs, len(suggestions), err))
 	}()
 	sdb := s.rodb
 	if tx != nil {
 		sdb = s.db
 	}
-	sel := "select e.id, e.uuid, e.start, e.end, e.project_slug, e.role, o.id, o.name from enrollments e, organizations o where e.organization_id = o.id"
-	vals := []interface{}{}
-	nColumns := len(columns)
-	lastIndex := nColumns - 1
-	if nColumns > 0 {
-		sel += " and"
+	blocks := []string{
+		"select lower(substring_index(trim(email), '@', 1)) as k, group_concat(distinct uuid) from " +
+			"(select uuid, email from identities union all select uuid, email from profiles) sub " +
+			"where email like '%_@_%' group by k having count(distinct uuid) between 2 and ?",
+		"select lower(trim(username)) as k, group_concat(distinct uuid) from identities " +
+			"where username is not null and trim(username) != '' group by k having count(distinct uuid) between 2 and ?",
 	}
-	for index := range columns {
-		column := columns[index]
-		value := values[index]
-		date := isDate[index]
-		isNil := false
-		if column == "e.project_slug" {
-			v, ok := value.(*string)
-			if ok {
-				isNil = v == nil
+	pairs := make(map[[2]string]struct{})
+	profiles := make(map[string]*models.MergeSuggestionProfile)
+	addBlock := func(ary []string) {
+		sort.Strings(ary)
+		for i, uuid := range ary {
+			profiles[uuid] = &models.MergeSuggestionProfile{UUID: uuid, Identities: []*models.IdentityDataOutput{}, Organizations: []string{}}
+			for _, uuid2 := range ary[i+1:] {
+				pairs[[2]string{uuid, uuid2}] = struct{}{}
 			}
 		}
-		if isNil {
-			sel += " " + column + " is null"
-		} else {
-			if date {
-				sel += " " + column + " = str_to_date(?, ?)"
-				vals = append(vals, value)
-				vals = append(vals, DateTimeFormat)
-			} else {
-				sel += " " + column + " = ?"
-				vals = append(vals, value)
+	}
+	for _, block := range blocks {
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, block, shared.MergeSuggestionMaxBlock)
+		if err != nil {
+			return
+		}
+		key, uuids := "", ""
+		for rows.Next() {
+			err = rows.Scan(&key, &uuids)
+			if err != nil {
+				return
+			}
+			if len(key) < 3 {
+				continue
 			}
+			addBlock(strings.Split(uuids, ","))
 		}
-		if index < lastIndex {
-			sel += " and"
+		err = rows.Err()
+		if err != nil {
+			return
 		}
-	}
-	if len(projectSlugs) > 0 {
-		sel += " and (e.project_slug is null or e.project_slug in ("
-		for _, projectSlug := range projectSlugs {
-			sel += "?,"
-			vals = append(vals, projectSlug)
+		err = rows.Close()
+		if err != nil {
+			return
 		}
-		sel = sel[0:len(sel)-1] + "))"
 	}
-	sel += " order by e.uuid asc, e.start asc, e.end asc"
-	rows, err := s.Query(sdb, tx, sel, vals...)
+	// Names are blocked here, because transliteration and phonetic keys cannot be computed in SQL
+	var rows *sql.Rows
+	rows, err = s.Query(
+		sdb,
+		tx,
+		"select distinct uuid, name from identities where name is not null and uuid is not null union "+
+			"select distinct uuid, name from profiles where name is not null",
+	)
 	if err != nil {
 		return
 	}
-	oName := ""
+	nameBlocks := make(map[string]map[string]struct{})
+	uuid, name := "", ""
 	for rows.Next() {
-		enrollmentData := &models.EnrollmentNestedDataOutput{}
-		err = rows.Scan(
-			&enrollmentData.ID,
-			&enrollmentData.UUID,
-			&enrollmentData.Start,
-			&enrollmentData.End,
-			&enrollmentData.ProjectSlug,
-			&enrollmentData.Role,
-			&enrollmentData.OrganizationID,
-			&oName,
-		)
+		err = rows.Scan(&uuid, &name)
 		if err != nil {
 			return
 		}
-		enrollmentData.Organization = &models.OrganizationDataOutput{ID: enrollmentData.OrganizationID, Name: oName}
-		enrollments = append(enrollments, enrollmentData)
+		for _, key := range s.MergeSuggestionNameKeys(name) {
+			block, ok := nameBlocks[key]
+			if !ok {
+				block = make(map[string]struct{})
+				nameBlocks[key] = block
+			}
+			block[uuid] = struct{}{}
+		}
 	}
 	err = rows.Err()
 	if err != nil {
@@ -2047,2310 +2420,3440 @@ func (s *service) FindEnrollmentsNested(columns []string, values []interface{},
 	if err != nil {
 		return
 	}
-	if missingFatal && len(enrollments) == 0 {
-		err = fmt.Errorf("cannot find enrollments for %+v/%+v (nested)", columns, values)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindOrganizationsNested")
-		return
-	}
-	return
-}
-
-func (s *service) FindEnrollments(columns []string, values []interface{}, isDate []bool, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindEnrollments: columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v", columns, values, isDate, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FindEnrollments(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v enrollments:%+v err:%v",
-				columns,
-				values,
-				isDate,
-				missingFatal,
-				tx != nil,
-				s.ToLocalEnrollments(enrollments),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+	for _, block := range nameBlocks {
+		if len(block) < 2 || len(block) > shared.MergeSuggestionMaxBlock {
+			continue
+		}
+		ary := []string{}
+		for uuid := range block {
+			ary = append(ary, uuid)
+		}
+		addBlock(ary)
 	}
-	sel := "select id, uuid, organization_id, start, end, project_slug, role from enrollments"
-	vals := []interface{}{}
-	nColumns := len(columns)
-	lastIndex := nColumns - 1
-	if nColumns > 0 {
-		sel += " where"
+	nPairs = len(pairs)
+	uuids := []interface{}{}
+	for uuid := range profiles {
+		uuids = append(uuids, uuid)
 	}
-	for index := range columns {
-		column := columns[index]
-		value := values[index]
-		date := isDate[index]
-		isNil := false
-		if column == "project_slug" {
-			v, ok := value.(*string)
-			if ok {
-				isNil = v == nil
+	packSize := 1000
+	for from := 0; from < len(uuids); from += packSize {
+		to := from + packSize
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		pack := uuids[from:to]
+		in := "(" + strings.Repeat("?,", len(pack)-1) + "?)"
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, "select uuid, name, email from profiles where uuid in "+in, pack...)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			prof := &models.MergeSuggestionProfile{}
+			err = rows.Scan(&prof.UUID, &prof.Name, &prof.Email)
+			if err != nil {
+				return
 			}
+			profiles[prof.UUID].Name = prof.Name
+			profiles[prof.UUID].Email = prof.Email
 		}
-		if isNil {
-			sel += " " + column + " is null"
-		} else {
-			if date {
-				sel += " " + column + " = str_to_date(?, ?)"
-				vals = append(vals, value)
-				vals = append(vals, DateTimeFormat)
-			} else {
-				sel += " " + column + " = ?"
-				vals = append(vals, value)
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		rows, err = s.Query(sdb, tx, "select id, uuid, source, name, email, username from identities where uuid in "+in+" order by id", pack...)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			identity := &models.IdentityDataOutput{}
+			err = rows.Scan(&identity.ID, &identity.UUID, &identity.Source, &identity.Name, &identity.Email, &identity.Username)
+			if err != nil {
+				return
 			}
+			prof := profiles[*identity.UUID]
+			prof.Identities = append(prof.Identities, identity)
 		}
-		if index < lastIndex {
-			sel += " and"
+		err = rows.Err()
+		if err != nil {
+			return
 		}
-	}
-	sel += " order by uuid asc, start asc, end asc"
-	rows, err := s.Query(sdb, tx, sel, vals...)
-	if err != nil {
-		return
-	}
-	for rows.Next() {
-		enrollmentData := &models.EnrollmentDataOutput{}
-		err = rows.Scan(
-			&enrollmentData.ID,
-			&enrollmentData.UUID,
-			&enrollmentData.OrganizationID,
-			&enrollmentData.Start,
-			&enrollmentData.End,
-			&enrollmentData.ProjectSlug,
-			&enrollmentData.Role,
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		rows, err = s.Query(
+			sdb,
+			tx,
+			"select distinct e.uuid, o.name from enrollments e, organizations o where e.organization_id = o.id and e.uuid in "+in+" order by o.name",
+			pack...,
 		)
 		if err != nil {
 			return
 		}
-		enrollments = append(enrollments, enrollmentData)
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
+		uuid, org := "", ""
+		for rows.Next() {
+			err = rows.Scan(&uuid, &org)
+			if err != nil {
+				return
+			}
+			prof := profiles[uuid]
+			prof.Organizations = append(prof.Organizations, org)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
 	}
-	if missingFatal && len(enrollments) == 0 {
-		err = fmt.Errorf("cannot find enrollments for %+v/%+v", columns, values)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindEnrollments")
-		return
+	suggestions = []*models.MergeSuggestion{}
+	for pair := range pairs {
+		a, b := profiles[pair[0]], profiles[pair[1]]
+		score, reasons := s.MergeSuggestionScore(a, b)
+		if len(reasons) == 0 {
+			continue
+		}
+		if len(b.Identities) > len(a.Identities) {
+			a, b = b, a
+		}
+		suggestions = append(suggestions, &models.MergeSuggestion{Score: score, Reasons: reasons, Profiles: []*models.MergeSuggestionProfile{a, b}})
 	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		si, sj := suggestions[i], suggestions[j]
+		if si.Score != sj.Score {
+			return si.Score > sj.Score
+		}
+		if si.Profiles[0].UUID != sj.Profiles[0].UUID {
+			return si.Profiles[0].UUID < sj.Profiles[0].UUID
+		}
+		return si.Profiles[1].UUID < sj.Profiles[1].UUID
+	})
 	return
 }
 
-func (s *service) GetArchiveUniqueIdentityIdentities(uuid string, tm time.Time, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetArchiveUniqueIdentityIdentities: uuid:%s tm:%v missingFatal:%v tx:%v", uuid, tm, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetArchiveUniqueIdentityIdentities(exit): uuid:%s tm:%v missingFatal:%v tx:%v identities:%+v err:%v",
-				uuid,
-				tm,
-				missingFatal,
-				tx != nil,
-				s.ToLocalIdentities(identities),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, source, name, email, username from identities_archive where uuid = ? and archived_at = ? order by id asc",
-		uuid,
-		tm,
-	)
-	if err != nil {
+// loadKnownBots - loads known bots list from KnownBotsFile once, missing file means no known bots
+func (s *service) loadKnownBots() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.knownBotsLoaded {
 		return
 	}
-	now := s.Now()
-	for rows.Next() {
-		identityData := &models.IdentityDataOutput{}
-		err = rows.Scan(
-			&identityData.ID,
-			&identityData.UUID,
-			&identityData.Source,
-			&identityData.Name,
-			&identityData.Email,
-			&identityData.Username,
-		)
-		if err != nil {
-			return
-		}
-		identityData.LastModified = now
-		identities = append(identities, identityData)
-	}
-	err = rows.Err()
+	s.knownBotsLoaded = true
+	s.knownBots = make(map[string]struct{})
+	data, err := ioutil.ReadFile(KnownBotsFile)
 	if err != nil {
+		log.Warn(fmt.Sprintf("loadKnownBots: %v", err))
 		return
 	}
-	err = rows.Close()
+	var bots allKnownBots
+	err = yaml.Unmarshal(data, &bots)
 	if err != nil {
+		log.Warn(fmt.Sprintf("loadKnownBots: %v", err))
 		return
 	}
-	if missingFatal && len(identities) == 0 {
-		err = fmt.Errorf("cannot find archived identities for uuid '%s'/%v", uuid, tm)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetArchiveUniqueIdentityIdentities")
-		return
+	for _, bot := range bots.Bots {
+		bot = strings.ToLower(strings.TrimSpace(bot))
+		if bot != "" {
+			s.knownBots[bot] = struct{}{}
+		}
 	}
-	return
 }
 
-func (s *service) GetArchiveUniqueIdentityEnrollments(uuid string, tm time.Time, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetArchiveUniqueIdentityEnrollments: uuid:%s tm:%v missingFatal:%v tx:%v", uuid, tm, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetArchiveUniqueIdentityEnrollments(exit): uuid:%s tm:%v missingFatal:%v tx:%v enrollments:%+v err:%v",
-				uuid,
-				tm,
-				missingFatal,
-				tx != nil,
-				s.ToLocalEnrollments(enrollments),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, organization_id, start, end, project_slug, role from enrollments_archive where uuid = ? and archived_at = ? order by start asc, end asc",
-		uuid,
-		tm,
-	)
-	if err != nil {
-		return
+var (
+	botNameRE    = regexp.MustCompile(`(^|[^a-z0-9])(bot|bots|robot)([^a-z0-9]|$)`)
+	botSuffixRE  = regexp.MustCompile(`[a-z0-9]bot$`)
+	botKeywordRE = regexp.MustCompile(`(^|[^a-z0-9])(ci|jenkins|travis|circleci|buildkite|zuul|prow|dependabot|renovate|greenkeeper|snyk|codecov|mergify|automation|autobuild|github-actions)([^a-z0-9]|$)`)
+	botNoreplyRE = regexp.MustCompile(`^(no-?reply|do-?not-?reply|mailer-daemon)([^a-z0-9]|$)`)
+)
+
+// BotScore - scores how likely a profile is a bot, sets suggestion's score 0-1 and reasons it was computed from
+// Signals: known bots list (0.95), "[bot]" name (0.9), bot/robot name token (0.8), CI/automation keyword (0.7), noreply email (0.5),
+// name ending with "bot" (0.4), and if activity is known: 24/7 cadence (0.5), burst of contributions in a single day (0.4),
+// high number of contributions per active day (0.4). Score combines all signals: 1 - (1-w1)*(1-w2)*...
+func (s *service) BotScore(suggestion *models.BotSuggestion) {
+	s.loadKnownBots()
+	suggestion.Reasons = []string{}
+	names, locals, emails := make(map[string]struct{}), make(map[string]struct{}), make(map[string]struct{})
+	addName := func(name *string) {
+		if name == nil {
+			return
+		}
+		n := strings.ToLower(strings.TrimSpace(*name))
+		if n != "" {
+			names[n] = struct{}{}
+		}
 	}
-	for rows.Next() {
-		enrollmentData := &models.EnrollmentDataOutput{}
-		err = rows.Scan(
-			&enrollmentData.ID,
-			&enrollmentData.UUID,
-			&enrollmentData.OrganizationID,
-			&enrollmentData.Start,
-			&enrollmentData.End,
-			&enrollmentData.ProjectSlug,
-			&enrollmentData.Role,
-		)
-		if err != nil {
+	addEmail := func(email *string) {
+		if email == nil {
 			return
 		}
-		enrollments = append(enrollments, enrollmentData)
+		e := strings.ToLower(strings.TrimSpace(*email))
+		ary := strings.Split(e, "@")
+		if len(ary) != 2 || ary[0] == "" {
+			return
+		}
+		emails[e] = struct{}{}
+		locals[ary[0]] = struct{}{}
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	addName(suggestion.Name)
+	addEmail(suggestion.Email)
+	for _, identity := range suggestion.Identities {
+		addName(identity.Name)
+		addName(identity.Username)
+		addEmail(identity.Email)
 	}
-	err = rows.Close()
-	if err != nil {
+	sortedKeys := func(m map[string]struct{}) (keys []string) {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
 		return
 	}
-	if missingFatal && len(enrollments) == 0 {
-		err = fmt.Errorf("cannot find archive enrollments for uuid '%s'/%v", uuid, tm)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetArchiveUniqueIdentityEnrollments")
-		return
+	rest := 1.0
+	add := func(weight float64, reason string) {
+		rest *= 1.0 - weight
+		suggestion.Reasons = append(suggestion.Reasons, reason)
 	}
-	return
-}
-
-func (s *service) GetUniqueIdentityIdentities(uuid string, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetUniqueIdentityIdentities: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetUniqueIdentityIdentities(exit): uuid:%s missingFatal:%v tx:%v identities:%+v err:%v",
-				uuid,
-				missingFatal,
-				tx != nil,
-				s.ToLocalIdentities(identities),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+	// first - returns the first of values matching a given condition
+	first := func(values []string, cond func(string) bool) string {
+		for _, value := range values {
+			if cond(value) {
+				return value
+			}
+		}
+		return ""
 	}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, source, name, email, username, last_modified from identities where uuid = ? order by id asc",
-		uuid,
-	)
-	if err != nil {
-		return
+	sNames, sEmails, sLocals := sortedKeys(names), sortedKeys(emails), sortedKeys(locals)
+	known := first(append(append([]string{}, sNames...), sEmails...), func(v string) bool {
+		_, ok := s.knownBots[v]
+		return ok
+	})
+	if known != "" {
+		add(0.95, fmt.Sprintf("known bot '%s'", known))
 	}
-	for rows.Next() {
-		identityData := &models.IdentityDataOutput{}
-		err = rows.Scan(
-			&identityData.ID,
-			&identityData.UUID,
-			&identityData.Source,
-			&identityData.Name,
-			&identityData.Email,
-			&identityData.Username,
-			&identityData.LastModified,
-		)
-		if err != nil {
-			return
-		}
-		identities = append(identities, identityData)
+	// local parts like "49699333+dependabot[bot]" are checked together with names
+	nameLike := append(append([]string{}, sNames...), sLocals...)
+	if name := first(nameLike, func(v string) bool { return strings.Contains(v, "[bot]") }); name != "" {
+		add(0.9, fmt.Sprintf("bot name '%s'", name))
+	} else if name := first(nameLike, botNameRE.MatchString); name != "" {
+		add(0.8, fmt.Sprintf("bot name '%s'", name))
+	} else if name := first(nameLike, botSuffixRE.MatchString); name != "" {
+		add(0.4, fmt.Sprintf("name ending with 'bot' '%s'", name))
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	if name := first(nameLike, botKeywordRE.MatchString); name != "" {
+		add(0.7, fmt.Sprintf("automation keyword '%s'", strings.Trim(botKeywordRE.FindString(name), "-_.@[]() ")))
 	}
-	err = rows.Close()
-	if err != nil {
-		return
+	if local := first(sLocals, botNoreplyRE.MatchString); local != "" {
+		add(0.5, fmt.Sprintf("noreply email '%s'", local))
 	}
-	if missingFatal && len(identities) == 0 {
-		err = fmt.Errorf("cannot find identities for uuid '%s'", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentityIdentities")
-		return
+	if act := suggestion.Activity; act != nil {
+		if act.Contributions >= 500 && act.QuietShare >= 0.2 {
+			add(0.5, fmt.Sprintf("24/7 cadence (%.0f%% of contributions in the quietest 8 hours)", act.QuietShare*100.0))
+		}
+		if act.MaxDaily >= 200 {
+			add(0.4, fmt.Sprintf("burst of %d contributions in a single day", act.MaxDaily))
+		}
+		if act.ActiveDays >= 30 && act.Contributions >= 30*act.ActiveDays {
+			add(0.4, fmt.Sprintf("%d contributions per active day", act.Contributions/act.ActiveDays))
+		}
 	}
-	return
+	suggestion.Score = math.Round((1.0-rest)*100.0) / 100.0
 }
 
-func (s *service) GetUniqueIdentityEnrollments(uuid string, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetUniqueIdentityEnrollments: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
+// BotCandidates - returns profiles that are not flagged as bots and were not reviewed yet (see ReviewBotSuggestions) with their
+// identities: given uuids (for example the most active ES authors) and profiles with identity names, usernames or email local parts
+// containing bot/automation keywords or matching known bots list, they are scored using BotScore
+func (s *service) BotCandidates(uuids []string, tx *sql.Tx) (candidates []*models.BotSuggestion, err error) {
+	log.Info(fmt.Sprintf("BotCandidates: uuids:%d tx:%v", len(uuids), tx != nil))
+	candidates = []*models.BotSuggestion{}
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetUniqueIdentityEnrollments(exit): uuid:%s missingFatal:%v tx:%v enrollments:%+v err:%v",
-				uuid,
-				missingFatal,
-				tx != nil,
-				s.ToLocalEnrollments(enrollments),
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("BotCandidates(exit): uuids:%d tx:%v candidates:%d err:%v", len(uuids), tx != nil, len(candidates), err))
 	}()
+	s.loadKnownBots()
 	sdb := s.rodb
 	if tx != nil {
 		sdb = s.db
 	}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, organization_id, start, end, project_slug, role from enrollments where uuid = ? order by start asc, end asc",
-		uuid,
-	)
-	if err != nil {
-		return
-	}
-	for rows.Next() {
-		enrollmentData := &models.EnrollmentDataOutput{}
-		err = rows.Scan(
-			&enrollmentData.ID,
-			&enrollmentData.UUID,
-			&enrollmentData.OrganizationID,
-			&enrollmentData.Start,
-			&enrollmentData.End,
-			&enrollmentData.ProjectSlug,
-			&enrollmentData.Role,
+	keywords := `bot|jenkins|travis|circleci|buildkite|zuul|prow|renovate|greenkeeper|snyk|codecov|mergify|automation|autobuild|github-actions|(^|[^a-z0-9])ci([^a-z0-9]|$)|^no-?reply|^do-?not-?reply|^mailer-daemon`
+	queries := []string{
+		"select distinct uuid from identities where uuid is not null and lower(concat_ws(' ', name, username, substring_index(email, '@', 1))) regexp ?",
+		"select distinct uuid from profiles where lower(concat_ws(' ', name, substring_index(email, '@', 1))) regexp ?",
+	}
+	args := [][]interface{}{{keywords}, {keywords}}
+	if len(s.knownBots) > 0 {
+		known := []interface{}{}
+		for bot := range s.knownBots {
+			known = append(known, bot)
+		}
+		in := "(" + strings.Repeat("?,", len(known)-1) + "?)"
+		queries = append(
+			queries,
+			"select distinct uuid from identities where uuid is not null and (lower(trim(name)) in "+in+" or lower(trim(username)) in "+in+" or lower(trim(email)) in "+in+")",
 		)
+		args = append(args, append(append(append([]interface{}{}, known...), known...), known...))
+	}
+	set := make(map[string]struct{})
+	for _, uuid := range uuids {
+		set[uuid] = struct{}{}
+	}
+	for i, query := range queries {
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, query, args[i]...)
+		if err != nil {
+			return
+		}
+		uuid := ""
+		for rows.Next() {
+			err = rows.Scan(&uuid)
+			if err != nil {
+				return
+			}
+			set[uuid] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
 		if err != nil {
 			return
 		}
-		enrollments = append(enrollments, enrollmentData)
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
 	}
-	if missingFatal && len(enrollments) == 0 {
-		err = fmt.Errorf("cannot find enrollments for uuid '%s'", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentityEnrollments")
-		return
+	all := []interface{}{}
+	for uuid := range set {
+		all = append(all, uuid)
 	}
-	return
-}
-
-func (s *service) GetEnrollment(id int64, missingFatal bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetEnrollment: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetEnrollment(exit): id:%d missingFatal:%v tx:%v enrollmentData:%+v err:%v",
-				id,
-				missingFatal,
-				tx != nil,
-				enrollmentData,
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	enrollmentData = &models.EnrollmentDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, organization_id, start, end, project_slug, role from enrollments where id = ? limit 1",
-		id,
-	)
-	if err != nil {
-		return
-	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&enrollmentData.ID,
-			&enrollmentData.UUID,
-			&enrollmentData.OrganizationID,
-			&enrollmentData.Start,
-			&enrollmentData.End,
-			&enrollmentData.ProjectSlug,
-			&enrollmentData.Role,
+	profiles := make(map[string]*models.BotSuggestion)
+	packSize := 1000
+	for from := 0; from < len(all); from += packSize {
+		to := from + packSize
+		if to > len(all) {
+			to = len(all)
+		}
+		pack := all[from:to]
+		in := "(" + strings.Repeat("?,", len(pack)-1) + "?)"
+		var rows *sql.Rows
+		rows, err = s.Query(
+			sdb,
+			tx,
+			"select p.uuid, p.name, p.email from profiles p where p.uuid in "+in+" and coalesce(p.is_bot, 0) = 0 "+
+				"and not exists (select 1 from profiles_bot_reviews r where r.uuid = p.uuid)",
+			pack...,
 		)
 		if err != nil {
 			return
 		}
-		fetched = true
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
-	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find enrollment id '%d'", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetEnrollment")
-		return
-	}
-	if !fetched {
-		enrollmentData = nil
+		for rows.Next() {
+			prof := &models.BotSuggestion{Identities: []*models.IdentityDataOutput{}, Reasons: []string{}}
+			err = rows.Scan(&prof.UUID, &prof.Name, &prof.Email)
+			if err != nil {
+				return
+			}
+			profiles[prof.UUID] = prof
+			candidates = append(candidates, prof)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		rows, err = s.Query(sdb, tx, "select id, uuid, source, name, email, username from identities where uuid in "+in+" order by id", pack...)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			identity := &models.IdentityDataOutput{}
+			err = rows.Scan(&identity.ID, &identity.UUID, &identity.Source, &identity.Name, &identity.Email, &identity.Username)
+			if err != nil {
+				return
+			}
+			prof, ok := profiles[*identity.UUID]
+			if !ok {
+				continue
+			}
+			prof.Identities = append(prof.Identities, identity)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
 	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].UUID < candidates[j].UUID
+	})
 	return
 }
 
-func (s *service) FetchMatchingBlacklist(email string, missingFatal bool, tx *sql.Tx) (matchingBlacklistData *models.MatchingBlacklistOutput, err error) {
-	log.Info(fmt.Sprintf("FetchMatchingBlacklist: email:%s missingFatal:%v tx:%v", email, missingFatal, tx != nil))
+// ReviewBotSuggestions - flags accepted profiles as bots (is_bot = 1) and records all reviews, so reviewed profiles are no longer
+// suggested, profiles that don't exist are skipped, locked profiles (see locked_by) are skipped when accepted
+func (s *service) ReviewBotSuggestions(review *models.BotSuggestionsReviewInput, tx *sql.Tx) (result *models.BotSuggestionsReviewOutput, err error) {
+	externalTx := tx != nil
+	log.Info(fmt.Sprintf("ReviewBotSuggestions: review:%+v tx:%v/%v", review, tx != nil, externalTx))
+	result = &models.BotSuggestionsReviewOutput{Accepted: []string{}, Rejected: []string{}, Skipped: []string{}}
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"FetchMatchingBlacklist(exit): email:%s missingFatal:%v tx:%v matchingBlacklistData:%+v err:%v",
-				email,
-				missingFatal,
-				tx != nil,
-				matchingBlacklistData,
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("ReviewBotSuggestions(exit): review:%+v tx:%v/%v result:%+v err:%v", review, tx != nil, externalTx, result, err))
 	}()
-	matchingBlacklistData = &models.MatchingBlacklistOutput{}
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select excluded from matching_blacklist where excluded = ? limit 1",
-		email,
-	)
-	if err != nil {
-		return
+	accept := make(map[string]struct{})
+	for _, uuid := range review.Accept {
+		accept[uuid] = struct{}{}
 	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&matchingBlacklistData.Excluded,
-		)
-		if err != nil {
+	for _, uuid := range review.Reject {
+		if _, ok := accept[uuid]; ok {
+			err = errs.Wrap(errs.New(fmt.Errorf("profile '%s' cannot be both accepted and rejected", uuid), errs.ErrBadRequest), "ReviewBotSuggestions")
 			return
 		}
-		fetched = true
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
 	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find matching blacklist email '%s'", email)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FetchMatchingBlacklist")
+	if len(review.Accept)+len(review.Reject) == 0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("no profiles to accept or reject"), errs.ErrBadRequest), "ReviewBotSuggestions")
 		return
 	}
-	if !fetched {
-		matchingBlacklistData = nil
+	if !externalTx {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		// Rollback unless tx was set to nil after successful commit
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
 	}
-	return
-}
-
-func (s *service) GetOrganization(id int64, missingFatal bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetOrganization: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetOrganization(exit): id:%d missingFatal:%v tx:%v organizationData:%+v err:%v",
-				id,
-				missingFatal,
-				tx != nil,
-				s.ToLocalOrganization(organizationData),
-				err,
-			),
+	done := make(map[string]struct{})
+	for i, uuid := range append(append([]string{}, review.Accept...), review.Reject...) {
+		if _, ok := done[uuid]; ok {
+			continue
+		}
+		done[uuid] = struct{}{}
+		isBot := int64(0)
+		if i < len(review.Accept) {
+			isBot = 1
+		}
+		var (
+			rows     *sql.Rows
+			lockedBy string
 		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	organizationData = &models.OrganizationDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, name from organizations where id = ? limit 1",
-		id,
-	)
-	if err != nil {
-		return
-	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&organizationData.ID,
-			&organizationData.Name,
+		rows, err = s.Query(s.db, tx, "select coalesce(locked_by, '') from profiles where uuid = ?", uuid)
+		if err != nil {
+			return
+		}
+		fetched := false
+		for rows.Next() {
+			err = rows.Scan(&lockedBy)
+			if err != nil {
+				return
+			}
+			fetched = true
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if !fetched || (isBot == 1 && strings.TrimSpace(lockedBy) != "") {
+			result.Skipped = append(result.Skipped, uuid)
+			continue
+		}
+		if isBot == 1 {
+			_, err = s.EditProfile(&models.ProfileDataOutput{UUID: uuid, IsBot: &isBot}, false, tx)
+			if err != nil {
+				return
+			}
+			_, err = s.TouchUniqueIdentity(uuid, tx)
+			if err != nil {
+				return
+			}
+			result.Accepted = append(result.Accepted, uuid)
+		} else {
+			result.Rejected = append(result.Rejected, uuid)
+		}
+		_, err = s.Exec(
+			s.db,
+			tx,
+			"insert into profiles_bot_reviews(uuid, is_bot, reviewed_at, reviewed_by) values(?, ?, now(6), ?) "+
+				"on duplicate key update is_bot = ?, reviewed_at = now(6), reviewed_by = ?",
+			uuid,
+			isBot,
+			s.lfid,
+			isBot,
+			s.lfid,
 		)
 		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ReviewBotSuggestions")
 			return
 		}
-		fetched = true
 	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
-	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find organization id %d", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetOrganization")
-		return
-	}
-	if !fetched {
-		organizationData = nil
+	if !externalTx {
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
+		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
 	}
 	return
 }
 
-func (s *service) GetOrganizationByName(orgName string, missingFatal bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetOrganizationByName: orgName:%s missingFatal:%v tx:%v", orgName, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetOrganizationByName(exit): orgName:%s missingFatal:%v tx:%v organizationData:%+v err:%v",
-				orgName,
-				missingFatal,
-				tx != nil,
-				s.ToLocalOrganization(organizationData),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+// EnrollmentConflicts - returns problems found in a single profile's enrollments together with suggested fixes:
+// invalid_range - zero-length or inverted date range
+// out_of_range - start before shared.MinPeriodDate or end after shared.MaxPeriodDate
+// duplicate - identical global enrollments that DedupEnrollments would collapse (it keeps the lowest id)
+// overlap - overlapping date ranges of different organizations for the same project slug and role
+// mergeable - overlapping or adjacent date ranges of the same organization for the same project slug and role (merged using MergeDateRanges)
+func (s *service) EnrollmentConflicts(enrollments []*models.EnrollmentNestedDataOutput) (conflicts []*models.EnrollmentConflict) {
+	orgName := func(enrollment *models.EnrollmentNestedDataOutput) string {
+		if enrollment.Organization != nil {
+			return enrollment.Organization.Name
+		}
+		return strconv.FormatInt(enrollment.OrganizationID, 10)
+	}
+	day := func(dt strfmt.DateTime) string {
+		return time.Time(dt).Format(shared.DateFormat)
+	}
+	sorted := make([]*models.EnrollmentNestedDataOutput, len(enrollments))
+	copy(sorted, enrollments)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, sj := time.Time(sorted[i].Start), time.Time(sorted[j].Start)
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		ei, ej := time.Time(sorted[i].End), time.Time(sorted[j].End)
+		if !ei.Equal(ej) {
+			return ei.Before(ej)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	// Only enrollments with valid date ranges are checked for overlaps
+	valid := []*models.EnrollmentNestedDataOutput{}
+	for _, enrollment := range sorted {
+		start, end := time.Time(enrollment.Start), time.Time(enrollment.End)
+		conflict := &models.EnrollmentConflict{
+			EnrollmentIds: []int64{enrollment.ID},
+			Organizations: []string{orgName(enrollment)},
+			ProjectSlug:   enrollment.ProjectSlug,
+			Role:          enrollment.Role,
+			Start:         enrollment.Start,
+			End:           enrollment.End,
+		}
+		if !start.Before(end) {
+			conflict.Kind = shared.EnrollmentConflictInvalidRange
+			if start.Equal(end) {
+				conflict.Suggestion = fmt.Sprintf("zero-length range, delete enrollment %d", enrollment.ID)
+			} else {
+				conflict.Suggestion = fmt.Sprintf("inverted range, set start of enrollment %d to %s and end to %s", enrollment.ID, day(enrollment.End), day(enrollment.Start))
+			}
+			conflicts = append(conflicts, conflict)
+			continue
+		}
+		if start.Before(shared.MinPeriodDate) || end.After(shared.MaxPeriodDate) {
+			conflict.Kind = shared.EnrollmentConflictOutOfRange
+			if start.Before(shared.MinPeriodDate) {
+				start = shared.MinPeriodDate
+			}
+			if end.After(shared.MaxPeriodDate) {
+				end = shared.MaxPeriodDate
+			}
+			conflict.Suggestion = fmt.Sprintf("set enrollment %d range to %s - %s", enrollment.ID, start.Format(shared.DateFormat), end.Format(shared.DateFormat))
+			conflicts = append(conflicts, conflict)
+		}
+		valid = append(valid, enrollment)
 	}
-	organizationData = &models.OrganizationDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, name from organizations where name = ? limit 1",
-		orgName,
-	)
-	if err != nil {
-		return
+	// Duplicates: the same grouping as DedupEnrollments uses
+	dups := make(map[string][]*models.EnrollmentNestedDataOutput)
+	dupKeys := []string{}
+	for _, enrollment := range sorted {
+		if enrollment.ProjectSlug != nil {
+			continue
+		}
+		key := fmt.Sprintf("%d:%s:%s", enrollment.OrganizationID, time.Time(enrollment.Start).String(), time.Time(enrollment.End).String())
+		_, ok := dups[key]
+		if !ok {
+			dupKeys = append(dupKeys, key)
+		}
+		dups[key] = append(dups[key], enrollment)
 	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&organizationData.ID,
-			&organizationData.Name,
-		)
-		if err != nil {
-			return
+	for _, key := range dupKeys {
+		group := dups[key]
+		if len(group) < 2 {
+			continue
 		}
-		fetched = true
+		conflict := &models.EnrollmentConflict{
+			Kind:          shared.EnrollmentConflictDuplicate,
+			Organizations: []string{orgName(group[0])},
+			Role:          group[0].Role,
+			Start:         group[0].Start,
+			End:           group[0].End,
+		}
+		ids := []string{}
+		for i, enrollment := range group {
+			conflict.EnrollmentIds = append(conflict.EnrollmentIds, enrollment.ID)
+			if i > 0 {
+				ids = append(ids, strconv.FormatInt(enrollment.ID, 10))
+			}
+		}
+		conflict.Suggestion = fmt.Sprintf("delete duplicate enrollment(s) %s, keep %d", strings.Join(ids, ", "), group[0].ID)
+		conflicts = append(conflicts, conflict)
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	// Overlaps and mergeable ranges are only checked within the same project slug and role
+	groups := make(map[string][]*models.EnrollmentNestedDataOutput)
+	groupKeys := []string{}
+	for _, enrollment := range valid {
+		key := enrollment.Role + ":"
+		if enrollment.ProjectSlug != nil {
+			key += *enrollment.ProjectSlug
+		}
+		_, ok := groups[key]
+		if !ok {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], enrollment)
 	}
-	err = rows.Close()
-	if err != nil {
-		return
+	for _, key := range groupKeys {
+		group := groups[key]
+		for i, a := range group {
+			for _, b := range group[i+1:] {
+				if !time.Time(b.Start).Before(time.Time(a.End)) {
+					break
+				}
+				if a.OrganizationID == b.OrganizationID {
+					continue
+				}
+				conflict := &models.EnrollmentConflict{
+					Kind:          shared.EnrollmentConflictOverlap,
+					EnrollmentIds: []int64{a.ID, b.ID},
+					Organizations: []string{orgName(a), orgName(b)},
+					ProjectSlug:   a.ProjectSlug,
+					Role:          a.Role,
+					Start:         b.Start,
+					End:           a.End,
+				}
+				if time.Time(b.End).Before(time.Time(a.End)) {
+					conflict.End = b.End
+				}
+				if time.Time(a.Start).Equal(time.Time(b.Start)) {
+					conflict.Suggestion = fmt.Sprintf("enrollments %d (%s) and %d (%s) start on the same date, delete one of them or change its dates", a.ID, orgName(a), b.ID, orgName(b))
+				} else if time.Time(b.End).Before(time.Time(a.End)) {
+					conflict.Suggestion = fmt.Sprintf("enrollment %d (%s) is inside enrollment %d (%s), split enrollment %d at %s and %s", b.ID, orgName(b), a.ID, orgName(a), a.ID, day(b.Start), day(b.End))
+				} else {
+					conflict.Suggestion = fmt.Sprintf("set end of enrollment %d (%s) to %s", a.ID, orgName(a), day(b.Start))
+				}
+				conflicts = append(conflicts, conflict)
+			}
+		}
+		byOrg := make(map[int64][]*models.EnrollmentNestedDataOutput)
+		orgIDs := []int64{}
+		for _, enrollment := range group {
+			_, ok := byOrg[enrollment.OrganizationID]
+			if !ok {
+				orgIDs = append(orgIDs, enrollment.OrganizationID)
+			}
+			byOrg[enrollment.OrganizationID] = append(byOrg[enrollment.OrganizationID], enrollment)
+		}
+		for _, orgID := range orgIDs {
+			orgGroup := byOrg[orgID]
+			// split into clusters of overlapping or adjacent date ranges
+			clusters := [][]*models.EnrollmentNestedDataOutput{}
+			clusterEnd := time.Time{}
+			for _, enrollment := range orgGroup {
+				n := len(clusters)
+				if n > 0 && !time.Time(enrollment.Start).After(clusterEnd) {
+					clusters[n-1] = append(clusters[n-1], enrollment)
+					if time.Time(enrollment.End).After(clusterEnd) {
+						clusterEnd = time.Time(enrollment.End)
+					}
+					continue
+				}
+				clusters = append(clusters, []*models.EnrollmentNestedDataOutput{enrollment})
+				clusterEnd = time.Time(enrollment.End)
+			}
+			for _, cluster := range clusters {
+				dates := [][]strfmt.DateTime{}
+				ranges := make(map[string]struct{})
+				for _, enrollment := range cluster {
+					dates = append(dates, []strfmt.DateTime{enrollment.Start, enrollment.End})
+					ranges[day(enrollment.Start)+":"+day(enrollment.End)] = struct{}{}
+				}
+				// there is nothing to merge when all ranges are identical (global ones are reported as duplicates)
+				if len(ranges) < 2 {
+					continue
+				}
+				mergedDates, err := s.MergeDateRanges(dates)
+				if err != nil || len(mergedDates) == 0 {
+					continue
+				}
+				conflict := &models.EnrollmentConflict{
+					Kind:          shared.EnrollmentConflictMergeable,
+					Organizations: []string{orgName(cluster[0])},
+					ProjectSlug:   cluster[0].ProjectSlug,
+					Role:          cluster[0].Role,
+					Start:         mergedDates[0][0],
+					End:           mergedDates[len(mergedDates)-1][1],
+				}
+				ids := []string{}
+				for _, enrollment := range cluster {
+					conflict.EnrollmentIds = append(conflict.EnrollmentIds, enrollment.ID)
+					ids = append(ids, strconv.FormatInt(enrollment.ID, 10))
+				}
+				merged := []string{}
+				for _, pair := range mergedDates {
+					merged = append(merged, day(pair[0])+" - "+day(pair[1]))
+				}
+				conflict.Suggestion = fmt.Sprintf("merge enrollments %s into %s", strings.Join(ids, ", "), strings.Join(merged, ", "))
+				conflicts = append(conflicts, conflict)
+			}
+		}
 	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find organization name '%s'", orgName)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetOrganizationByName")
-		return
+	return
+}
+
+// ParseEnrollmentsCSV - parses enrollments CSV (header row is required, column order is not significant)
+// columns: uuid, email, source, username, organization, start, end, project_slug, role
+// each row must identify a profile by uuid, email or (source+)username and must specify an organization
+// missing start/end default to shared.MinPeriodDate/shared.MaxPeriodDate, missing role defaults to shared.DefaultRole
+// rows that cannot be parsed are returned with action shared.EnrollmentImportInvalid and the reason set
+func (s *service) ParseEnrollmentsCSV(r io.Reader) (rows []*models.EnrollmentImportRow, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseEnrollmentsCSV")
+		return
+	}
+	if len(records) == 0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("empty CSV, header row is required"), errs.ErrBadRequest), "ParseEnrollmentsCSV")
+		return
+	}
+	aliases := map[string]string{
+		"uuid":              "uuid",
+		"email":             "email",
+		"source":            "source",
+		"username":          "username",
+		"organization":      "organization",
+		"organization_name": "organization",
+		"org":               "organization",
+		"org_name":          "organization",
+		"start":             "start",
+		"end":               "end",
+		"project_slug":      "project_slug",
+		"project":           "project_slug",
+		"role":              "role",
+	}
+	columns := make(map[string]int)
+	for i, col := range records[0] {
+		name, ok := aliases[strings.ToLower(strings.TrimSpace(col))]
+		if !ok {
+			continue
+		}
+		columns[name] = i
+	}
+	_, okOrg := columns["organization"]
+	_, okUUID := columns["uuid"]
+	_, okEmail := columns["email"]
+	_, okUsername := columns["username"]
+	if !okOrg || (!okUUID && !okEmail && !okUsername) {
+		err = fmt.Errorf("CSV header '%s' must contain organization and at least one of uuid, email, username columns", strings.Join(records[0], ","))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseEnrollmentsCSV")
+		return
+	}
+	for i, record := range records[1:] {
+		value := func(name string) string {
+			idx, ok := columns[name]
+			if !ok || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+		row := &models.EnrollmentImportRow{
+			Row:          int64(i + 2),
+			UUID:         value("uuid"),
+			Email:        value("email"),
+			Source:       value("source"),
+			Username:     value("username"),
+			Organization: value("organization"),
+			ProjectSlug:  value("project_slug"),
+			Start:        strfmt.DateTime(shared.MinPeriodDate),
+			End:          strfmt.DateTime(shared.MaxPeriodDate),
+			Role:         shared.DefaultRole,
+		}
+		rows = append(rows, row)
+		invalid := func(reason string) {
+			row.Action = shared.EnrollmentImportInvalid
+			row.Reason = reason
+		}
+		if row.UUID == "" && row.Email == "" && row.Username == "" {
+			invalid("one of uuid, email, username is required")
+			continue
+		}
+		if row.Organization == "" {
+			invalid("organization is required")
+			continue
+		}
+		if str := value("start"); str != "" {
+			dt, e := s.TimeParseAny(str)
+			if e != nil {
+				invalid(fmt.Sprintf("cannot parse start date '%s'", str))
+				continue
+			}
+			row.Start = strfmt.DateTime(dt)
+		}
+		if str := value("end"); str != "" {
+			dt, e := s.TimeParseAny(str)
+			if e != nil {
+				invalid(fmt.Sprintf("cannot parse end date '%s'", str))
+				continue
+			}
+			row.End = strfmt.DateTime(dt)
+		}
+		if str := value("role"); str != "" {
+			role, e := s.NormalizeRole(str)
+			if e != nil {
+				invalid(fmt.Sprintf("incorrect role '%s', allowed: %+v", str, shared.Roles))
+				continue
+			}
+			row.Role = role
+		}
 	}
-	if !fetched {
-		organizationData = nil
+	return
+}
+
+// EnrollmentImportAction - classifies a new enrollment against profile's existing (and already planned) enrollments
+// only enrollments for the same project slug and role are considered:
+// duplicate - the same organization and date range already exists
+// conflict - date range overlaps a different organization's enrollment
+// merge - date range overlaps or is adjacent to the same organization's enrollment (will be merged using MergeEnrollments)
+// create - otherwise
+func (s *service) EnrollmentImportAction(enrollment *models.EnrollmentDataOutput, enrollments []*models.EnrollmentDataOutput) (action, reason string) {
+	day := func(dt strfmt.DateTime) string {
+		return time.Time(dt).Format(shared.DateFormat)
+	}
+	start, end := time.Time(enrollment.Start), time.Time(enrollment.End)
+	action = shared.EnrollmentImportCreate
+	for _, rol := range enrollments {
+		if rol.Role != enrollment.Role {
+			continue
+		}
+		if (rol.ProjectSlug == nil) != (enrollment.ProjectSlug == nil) || (rol.ProjectSlug != nil && *rol.ProjectSlug != *enrollment.ProjectSlug) {
+			continue
+		}
+		rStart, rEnd := time.Time(rol.Start), time.Time(rol.End)
+		if rol.OrganizationID == enrollment.OrganizationID {
+			if rStart.Equal(start) && rEnd.Equal(end) {
+				return shared.EnrollmentImportDuplicate, fmt.Sprintf("enrollment %s - %s already exists", day(rol.Start), day(rol.End))
+			}
+			if action == shared.EnrollmentImportCreate && !rStart.After(end) && !start.After(rEnd) {
+				action = shared.EnrollmentImportMerge
+				reason = fmt.Sprintf("will be merged with enrollment %s - %s", day(rol.Start), day(rol.End))
+			}
+			continue
+		}
+		if action != shared.EnrollmentImportConflict && rStart.Before(end) && start.Before(rEnd) {
+			action = shared.EnrollmentImportConflict
+			reason = fmt.Sprintf("overlaps organization_id %d enrollment %s - %s", rol.OrganizationID, day(rol.Start), day(rol.End))
+		}
 	}
 	return
 }
 
-func (s *service) GetUniqueIdentity(uuid string, missingFatal bool, tx *sql.Tx) (uniqueIdentityData *models.UniqueIdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetUniqueIdentity: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
+// ImportEnrollments - resolves each CSV row to a profile and organization, validates it and plans its action (see EnrollmentImportAction)
+// rows that already have an action set (for example parse errors) are skipped
+// if dry is not set, all create and merge rows are added in a single transaction and then merged with existing enrollments
+func (s *service) ImportEnrollments(rows []*models.EnrollmentImportRow, dry bool) (applied int64, err error) {
+	log.Info(fmt.Sprintf("ImportEnrollments: rows:%d dry:%v", len(rows), dry))
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetUniqueIdentity(exit): uuid:%s missingFatal:%v tx:%v uniqueIdentityData:%+v err:%v",
-				uuid,
-				missingFatal,
-				tx != nil,
-				s.ToLocalUniqueIdentity(uniqueIdentityData),
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("ImportEnrollments(exit): rows:%d dry:%v applied:%d err:%v", len(rows), dry, applied, err))
 	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+	var tx *sql.Tx
+	if !dry {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
 	}
-	uniqueIdentityData = &models.UniqueIdentityDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select uuid, last_modified from uidentities where uuid = ? limit 1",
-		uuid,
-	)
-	if err != nil {
+	orgs := make(map[string]*models.OrganizationDataOutput)
+	profiles := make(map[string][]*models.EnrollmentDataOutput)
+	planned := []*models.EnrollmentDataOutput{}
+	for _, row := range rows {
+		if row.Action != "" {
+			continue
+		}
+		var uuids []string
+		uuids, err = s.importRowUUIDs(row, tx)
+		if err != nil {
+			return
+		}
+		if len(uuids) == 0 {
+			row.Action = shared.EnrollmentImportUnknownProfile
+			row.Reason = "no profile matches given uuid/email/username"
+			continue
+		}
+		if len(uuids) > 1 {
+			row.Action = shared.EnrollmentImportConflict
+			row.Reason = fmt.Sprintf("matches %d profiles: %s", len(uuids), strings.Join(uuids, ", "))
+			continue
+		}
+		row.UUID = uuids[0]
+		org, ok := orgs[row.Organization]
+		if !ok {
+			org, err = s.GetOrganizationByName(row.Organization, false, tx)
+			if err != nil {
+				return
+			}
+			orgs[row.Organization] = org
+		}
+		if org == nil {
+			row.Action = shared.EnrollmentImportUnknownOrg
+			row.Reason = fmt.Sprintf("organization '%s' not found", row.Organization)
+			continue
+		}
+		row.OrganizationID = org.ID
+		provenance := shared.ProvenanceCompanyRoster
+		enrollment := &models.EnrollmentDataOutput{
+			UUID:           row.UUID,
+			OrganizationID: org.ID,
+			Start:          row.Start,
+			End:            row.End,
+			Role:           row.Role,
+			Provenance:     &provenance,
+		}
+		if row.ProjectSlug != "" {
+			pSlug := row.ProjectSlug
+			enrollment.ProjectSlug = &pSlug
+		}
+		e := s.ValidateEnrollment(enrollment, false)
+		if e != nil {
+			row.Action = shared.EnrollmentImportInvalid
+			row.Reason = e.Error()
+			continue
+		}
+		enrollments, ok := profiles[row.UUID]
+		if !ok {
+			enrollments, err = s.FindEnrollments([]string{"uuid"}, []interface{}{row.UUID}, []bool{false}, false, tx)
+			if err != nil {
+				return
+			}
+		}
+		row.Action, row.Reason = s.EnrollmentImportAction(enrollment, enrollments)
+		if row.Action == shared.EnrollmentImportCreate || row.Action == shared.EnrollmentImportMerge {
+			enrollments = append(enrollments, enrollment)
+			planned = append(planned, enrollment)
+		}
+		profiles[row.UUID] = enrollments
+	}
+	if dry {
 		return
 	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&uniqueIdentityData.UUID,
-			&uniqueIdentityData.LastModified,
+	merges := make(map[string]*models.EnrollmentDataOutput)
+	mergeKeys := []string{}
+	for _, enrollment := range planned {
+		_, err = s.AddEnrollment(enrollment, false, false, tx)
+		if err != nil {
+			return
+		}
+		applied++
+		key := fmt.Sprintf("%s:%d:", enrollment.UUID, enrollment.OrganizationID)
+		if enrollment.ProjectSlug != nil {
+			key += *enrollment.ProjectSlug
+		}
+		_, ok := merges[key]
+		if !ok {
+			mergeKeys = append(mergeKeys, key)
+			merges[key] = enrollment
+		}
+	}
+	for _, key := range mergeKeys {
+		enrollment := merges[key]
+		err = s.MergeEnrollments(
+			&models.UniqueIdentityDataOutput{UUID: enrollment.UUID},
+			&models.OrganizationDataOutput{ID: enrollment.OrganizationID},
+			enrollment.ProjectSlug,
+			false,
+			false,
+			tx,
 		)
 		if err != nil {
 			return
 		}
-		fetched = true
 	}
-	err = rows.Err()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
-	err = rows.Close()
-	if err != nil {
+	tx = nil
+	return
+}
+
+// importRowUUIDs - returns distinct profile UUIDs matching CSV import row: uuid, email, source+username or username (any source)
+func (s *service) importRowUUIDs(row *models.EnrollmentImportRow, tx *sql.Tx) (uuids []string, err error) {
+	if row.UUID != "" {
+		var uid *models.UniqueIdentityDataOutput
+		uid, err = s.GetUniqueIdentity(row.UUID, false, tx)
+		if err != nil || uid == nil {
+			return
+		}
+		uuids = append(uuids, uid.UUID)
 		return
 	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find unique identity uuid '%s'", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentity")
+	var identities []*models.IdentityDataOutput
+	if row.Email != "" {
+		identities, err = s.FindIdentities([]string{"email"}, []interface{}{row.Email}, []bool{false}, false, tx)
+	} else if row.Source != "" {
+		identities, err = s.FindIdentities([]string{"source", "username"}, []interface{}{row.Source, row.Username}, []bool{false, false}, false, tx)
+	} else {
+		identities, err = s.FindIdentities([]string{"username"}, []interface{}{row.Username}, []bool{false}, false, tx)
+	}
+	if err != nil {
 		return
 	}
-	if !fetched {
-		uniqueIdentityData = nil
+	seen := make(map[string]struct{})
+	for _, identity := range identities {
+		if identity.UUID == nil {
+			continue
+		}
+		_, ok := seen[*identity.UUID]
+		if ok {
+			continue
+		}
+		seen[*identity.UUID] = struct{}{}
+		uuids = append(uuids, *identity.UUID)
 	}
+	sort.Strings(uuids)
 	return
 }
 
-func (s *service) GetIdentity(id string, missingFatal bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetIdentity: id:%s missingFatal:%v tx:%v", id, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetIdentity(exit): id:%s missingFatal:%v tx:%v identityData:%+v err:%v",
-				id,
-				missingFatal,
-				tx != nil,
-				s.ToLocalIdentity(identityData),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+// affCacheKey - returns affiliation cache key (within a given uuid), dates are bucketed by day
+func affCacheKey(pSlug, role string, dt time.Time, single bool, steps []int) string {
+	return fmt.Sprintf("%s:%s:%v:%s:%v", pSlug, role, single, dt.UTC().Format(shared.DateFormat), steps)
+}
+
+// affCacheable - checks if affiliation resolved on dt is the same for the entire dt's day
+// this is true when none of the enrollments starts or ends inside that day
+func affCacheable(dt time.Time, rols []*models.AffiliationCandidate) bool {
+	dt = dt.UTC()
+	from := time.Date(dt.Year(), dt.Month(), dt.Day(), 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+	for _, rol := range rols {
+		for _, t := range []time.Time{time.Time(rol.Start), time.Time(rol.End)} {
+			if t.After(from) && t.Before(to) {
+				return false
+			}
+		}
 	}
-	identityData = &models.IdentityDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		"select id, uuid, source, name, username, email, last_modified from identities where id = ? limit 1",
-		id,
-	)
-	if err != nil {
+	return true
+}
+
+// affCacheGet - returns cached affiliation for a given uuid and key, expired entries are removed
+func affCacheGet(uuid, key string) (orgs []string, inferred, ok bool) {
+	shared.GAffCacheMtx.Lock()
+	defer shared.GAffCacheMtx.Unlock()
+	entry, ok := shared.GAffCache[uuid][key]
+	if ok && time.Since(entry.Tm) > shared.AffCacheTTL {
+		delete(shared.GAffCache[uuid], key)
+		if len(shared.GAffCache[uuid]) == 0 {
+			delete(shared.GAffCache, uuid)
+		}
+		shared.GAffCacheN--
+		shared.GAffCacheEvictions++
+		ok = false
+	}
+	if !ok {
+		shared.GAffCacheMisses++
 		return
 	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&identityData.ID,
-			&identityData.UUID,
-			&identityData.Source,
-			&identityData.Name,
-			&identityData.Username,
-			&identityData.Email,
-			&identityData.LastModified,
-		)
-		if err != nil {
-			return
+	shared.GAffCacheHits++
+	orgs = append(orgs, entry.Orgs...)
+	inferred = entry.Inferred
+	return
+}
+
+// affCacheSet - caches affiliation for a given uuid and key, when cache is full random uuids are evicted
+func affCacheSet(uuid, key string, orgs []string, inferred bool) {
+	shared.GAffCacheMtx.Lock()
+	defer shared.GAffCacheMtx.Unlock()
+	if shared.GAffCacheN >= shared.AffCacheMaxEntries {
+		// Map iteration order is random, so this drops random uuids until 10% of cache is free
+		for u, entries := range shared.GAffCache {
+			shared.GAffCacheN -= len(entries)
+			shared.GAffCacheEvictions += int64(len(entries))
+			delete(shared.GAffCache, u)
+			if shared.GAffCacheN < shared.AffCacheMaxEntries*9/10 {
+				break
+			}
 		}
-		fetched = true
 	}
-	err = rows.Err()
-	if err != nil {
+	entries, ok := shared.GAffCache[uuid]
+	if !ok {
+		entries = make(map[string]*shared.AffCacheEntry)
+		shared.GAffCache[uuid] = entries
+	}
+	if _, ok := entries[key]; !ok {
+		shared.GAffCacheN++
+	}
+	entries[key] = &shared.AffCacheEntry{Orgs: append([]string{}, orgs...), Inferred: inferred, Tm: time.Now()}
+}
+
+// InvalidateAffiliationCache - drops cached affiliations of given uuids, if no uuids are given - drops entire cache
+// Must be called whenever enrollments of a given uuid are changed
+func (s *service) InvalidateAffiliationCache(uuids ...string) {
+	shared.GAffCacheMtx.Lock()
+	defer shared.GAffCacheMtx.Unlock()
+	if len(uuids) == 0 {
+		shared.GAffCacheInvalidations += int64(shared.GAffCacheN)
+		shared.GAffCache = map[string]map[string]*shared.AffCacheEntry{}
+		shared.GAffCacheN = 0
 		return
 	}
-	err = rows.Close()
-	if err != nil {
+	for _, uuid := range uuids {
+		n := len(shared.GAffCache[uuid])
+		if n == 0 {
+			continue
+		}
+		shared.GAffCacheN -= n
+		shared.GAffCacheInvalidations += int64(n)
+		delete(shared.GAffCache, uuid)
+	}
+}
+
+// invalidateAffiliationCacheTx - drops cached affiliations of given uuids, if no uuids are given - drops entire cache
+// When called within a transaction they are dropped again once that transaction is finished (see CommitTx),
+// otherwise affiliations resolved by other requests before commit (from not yet changed data) would stay cached
+func (s *service) invalidateAffiliationCacheTx(tx *sql.Tx, uuids ...string) {
+	s.InvalidateAffiliationCache(uuids...)
+	if tx == nil {
 		return
 	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find identity id '%s'", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetIdentity")
+	shared.GAffCacheMtx.Lock()
+	defer shared.GAffCacheMtx.Unlock()
+	pending, ok := shared.GAffCachePending[tx]
+	if !ok {
+		pending = make(map[string]struct{})
+		shared.GAffCachePending[tx] = pending
+	}
+	if len(uuids) == 0 {
+		pending[""] = struct{}{}
 		return
 	}
-	if !fetched {
-		identityData = nil
+	for _, uuid := range uuids {
+		pending[uuid] = struct{}{}
+	}
+}
+
+// flushAffiliationCacheTx - drops cached affiliations invalidated within a given (already finished) transaction
+func (s *service) flushAffiliationCacheTx(tx *sql.Tx) {
+	shared.GAffCacheMtx.Lock()
+	pending, ok := shared.GAffCachePending[tx]
+	delete(shared.GAffCachePending, tx)
+	shared.GAffCacheMtx.Unlock()
+	if !ok {
+		return
+	}
+	_, all := pending[""]
+	if all {
+		s.InvalidateAffiliationCache()
+		return
+	}
+	uuids := []string{}
+	for uuid := range pending {
+		uuids = append(uuids, uuid)
+	}
+	if len(uuids) > 0 {
+		s.InvalidateAffiliationCache(uuids...)
+	}
+}
+
+// GetAffiliationCacheStats - returns affiliation cache size and hit/miss counters
+func (s *service) GetAffiliationCacheStats() (stats *models.AffiliationCacheStats) {
+	shared.GAffCacheMtx.Lock()
+	defer shared.GAffCacheMtx.Unlock()
+	stats = &models.AffiliationCacheStats{
+		Entries:       int64(shared.GAffCacheN),
+		Uuids:         int64(len(shared.GAffCache)),
+		MaxEntries:    int64(shared.AffCacheMaxEntries),
+		TTLSeconds:    int64(shared.AffCacheTTL.Seconds()),
+		Hits:          shared.GAffCacheHits,
+		Misses:        shared.GAffCacheMisses,
+		Invalidations: shared.GAffCacheInvalidations,
+		Evictions:     shared.GAffCacheEvictions,
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
 	}
 	return
 }
 
-func (s *service) GetIdentityByUser(key string, value string, missingFatal bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetIdentityByUser: %s:%s missingFatal:%v tx:%v", key, value, missingFatal, tx != nil))
-	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetIdentityByUser(exit): %s:%s missingFatal:%v tx:%v identityData:%+v err:%v",
-				key,
-				value,
-				missingFatal,
-				tx != nil,
-				s.ToLocalIdentity(identityData),
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
+// affSameOrgs - checks if two organization lists are the same (including order)
+func affSameOrgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
+}
 
-	identityData = &models.IdentityDataOutput{}
-	q := fmt.Sprintf("select id, uuid, source, name, username, email, last_modified from identities where %s = ? limit 1", key)
-	rows, err := s.Query(
-		sdb,
-		tx,
-		q,
-		value,
-	)
-	if err != nil {
-		return
+// affSortByID - returns a copy of enrollments sorted by confidence descending and then by id descending
+// (most confident first, most recent first when confidence is the same), unknown confidence is the lowest
+func affSortByID(rols []*models.AffiliationCandidate) (sorted []*models.AffiliationCandidate) {
+	sorted = make([]*models.AffiliationCandidate, len(rols))
+	copy(sorted, rols)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ci, cj := affConfidence(sorted[i].Confidence), affConfidence(sorted[j].Confidence)
+		if ci != cj {
+			return ci > cj
+		}
+		return sorted[i].ID > sorted[j].ID
+	})
+	return
+}
+
+// affConfidence - enrollment confidence used for sorting, unknown (null) confidence sorts below 0
+func affConfidence(confidence *int64) int64 {
+	if confidence == nil {
+		return -1
 	}
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(
-			&identityData.ID,
-			&identityData.UUID,
-			&identityData.Source,
-			&identityData.Name,
-			&identityData.Username,
-			&identityData.Email,
-			&identityData.LastModified,
-		)
-		if err != nil {
+	return *confidence
+}
+
+// affMostConfident - returns the most confident enrollment fully contained in [st, en] date range
+// (the first one when confidence is the same), returns nil if there is no such enrollment
+func affMostConfident(rols []*models.EnrollmentDataOutput, st, en strfmt.DateTime) (best *models.EnrollmentDataOutput) {
+	for _, rol := range rols {
+		if time.Time(rol.Start).Before(time.Time(st)) || time.Time(rol.End).After(time.Time(en)) {
+			continue
+		}
+		if best == nil || affConfidence(rol.Confidence) > affConfidence(best.Confidence) {
+			best = rol
+		}
+	}
+	return
+}
+
+// affResolve - applies 5-step algorithm on enrollments sorted by affSortByID, returns organizations found and step that matched
+// Only steps enabled by the affiliation policy are tried, in the policy order
+func affResolve(pSlug string, dt time.Time, single bool, sorted []*models.AffiliationCandidate, steps []int) (orgs []string, step int) {
+	step = shared.AffStepNone
+	matched := []*models.AffiliationCandidate{}
+	for _, st := range steps {
+		for _, rol := range sorted {
+			if affActive(rol, dt) && affStepMatches(st, pSlug, rol.ProjectSlug) {
+				matched = append(matched, rol)
+			}
+		}
+		if len(matched) > 0 {
+			step = st
+			break
+		}
+	}
+	seen := map[string]struct{}{}
+	for _, rol := range matched {
+		_, ok := seen[rol.Organization]
+		if ok {
+			continue
+		}
+		seen[rol.Organization] = struct{}{}
+		orgs = append(orgs, rol.Organization)
+		if single {
+			break
+		}
+	}
+	return
+}
+
+// affActive - enrollment covers a given date
+func affActive(rol *models.AffiliationCandidate, dt time.Time) bool {
+	return !time.Time(rol.Start).After(dt) && time.Time(rol.End).After(dt)
+}
+
+// affStepMatches - enrollment project slug qualifies for a given step of the 5-step algorithm
+// Slugs are compared case insensitive, just like MariaDB does using the enrollments table collation
+func affStepMatches(step int, pSlug string, slug *string) bool {
+	foundation := strings.Split(pSlug, "/")[0]
+	switch step {
+	case shared.AffStepProject:
+		return pSlug != "" && slug != nil && strings.EqualFold(*slug, pSlug)
+	case shared.AffStepFoundationF:
+		return pSlug != "" && slug != nil && strings.EqualFold(*slug, foundation+"-f")
+	case shared.AffStepGlobal:
+		return slug == nil
+	case shared.AffStepFoundation:
+		return pSlug != "" && slug != nil && strings.HasPrefix(strings.ToLower(*slug), strings.ToLower(foundation+"/"))
+	case shared.AffStepAny:
+		return true
+	}
+	return false
+}
+
+// affFirstStep - first step enabled by the affiliation policy that a given enrollment project slug qualifies for
+// Returns shared.AffStepNone if there is no such step
+func affFirstStep(pSlug string, slug *string, steps []int) int {
+	for _, st := range steps {
+		if affStepMatches(st, pSlug, slug) {
+			return st
+		}
+	}
+	return shared.AffStepNone
+}
+
+// affPolicyCondition - returns SQL condition selecting enrollments (aliased "e") allowed by affiliation policies of given project slugs
+// and an order by expression putting enrollments from higher priority steps first (higher confidence first within a step), both need their args
+// Steps 4 and 5 (foundation's other projects and any enrollment) are used when enabled, ranked after the other steps, so the same
+// enrollments are considered as by GetAffiliations. Foundation-f step is only used when a policy is defined, without policies project (or foundation's projects) and global
+// enrollments are used, as they always were
+func (s *service) affPolicyCondition(projectSlugs []string) (cond string, condArgs []interface{}, order string, orderArgs []interface{}) {
+	type affCond struct {
+		sql  string
+		arg  interface{}
+		rank int
+	}
+	conds := []affCond{}
+	seen := make(map[string]int)
+	add := func(c affCond) {
+		key := fmt.Sprintf("%s:%v", c.sql, c.arg)
+		i, ok := seen[key]
+		if ok {
+			if c.rank < conds[i].rank {
+				conds[i].rank = c.rank
+			}
 			return
 		}
-		fetched = true
+		seen[key] = len(conds)
+		conds = append(conds, c)
 	}
-	err = rows.Err()
-	if err != nil {
-		return
+	for _, pSlug := range projectSlugs {
+		foundation := affPolicyFoundation(pSlug)
+		defined := s.affPolicyDefined(pSlug)
+		for rank, st := range s.AffiliationPolicySteps(pSlug) {
+			switch st {
+			case shared.AffStepProject:
+				if strings.HasSuffix(pSlug, "-f") {
+					add(affCond{sql: "e.project_slug like ?", arg: pSlug[:len(pSlug)-2] + "/%", rank: rank})
+				} else {
+					add(affCond{sql: "e.project_slug = ?", arg: pSlug, rank: rank})
+				}
+			case shared.AffStepFoundationF:
+				if defined {
+					add(affCond{sql: "e.project_slug = ?", arg: foundation + "-f", rank: rank})
+				}
+			case shared.AffStepGlobal:
+				add(affCond{sql: "e.project_slug is null", rank: rank})
+			case shared.AffStepFoundation:
+				if pSlug != "" {
+					add(affCond{sql: "e.project_slug like ?", arg: strings.Split(pSlug, "/")[0] + "/%", rank: rank})
+				}
+			case shared.AffStepAny:
+				add(affCond{sql: "1 = 1", rank: rank})
+			}
+		}
 	}
-	err = rows.Close()
-	if err != nil {
+	if len(conds) == 0 {
+		cond = "1 = 0"
+		order = "0"
 		return
 	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find identity '%s' : '%s'", key, value)
-		err = errs.Wrap(errs.New(err, errs.ErrNotFound), "GetIdentityByUser")
+	// Enrollment can match more than one condition, CASE must return the highest priority one
+	sort.SliceStable(conds, func(i, j int) bool {
+		return conds[i].rank < conds[j].rank
+	})
+	cond = "("
+	order = "case"
+	for i, c := range conds {
+		if i > 0 {
+			cond += " or "
+		}
+		cond += c.sql
+		order += " when " + c.sql + fmt.Sprintf(" then %d", c.rank)
+		if c.arg != nil {
+			condArgs = append(condArgs, c.arg)
+			orderArgs = append(orderArgs, c.arg)
+		}
+	}
+	cond += ")"
+	order += fmt.Sprintf(" else %d end, e.confidence desc", len(shared.AffStepNames))
+	return
+}
+
+// affPolicyFoundation - returns foundation whose affiliation policy applies to a given project slug
+// for example cncf/prometheus, cncf-f and cncf all use cncf policy
+func affPolicyFoundation(pSlug string) string {
+	foundation := strings.ToLower(strings.TrimSpace(strings.Split(pSlug, "/")[0]))
+	return strings.TrimSuffix(foundation, "-f")
+}
+
+// AffiliationPolicySteps - returns enabled steps of the 5-step algorithm (in order) for a given project slug
+// Uses foundation policy, then default policy, if none is defined all steps are enabled
+func (s *service) AffiliationPolicySteps(pSlug string) []int {
+	shared.GAffPolicyMtx.Lock()
+	defer shared.GAffPolicyMtx.Unlock()
+	foundation := affPolicyFoundation(pSlug)
+	if foundation != "" {
+		steps, ok := shared.GAffPolicies[foundation]
+		if ok {
+			return steps
+		}
+	}
+	steps, ok := shared.GAffPolicies[shared.AffPolicyDefault]
+	if ok {
+		return steps
+	}
+	return shared.AffDefaultSteps
+}
+
+// affPolicyDefined - returns true if foundation or default affiliation policy applies to a given project slug
+func (s *service) affPolicyDefined(pSlug string) bool {
+	shared.GAffPolicyMtx.Lock()
+	defer shared.GAffPolicyMtx.Unlock()
+	_, ok := shared.GAffPolicies[affPolicyFoundation(pSlug)]
+	if !ok {
+		_, ok = shared.GAffPolicies[shared.AffPolicyDefault]
+	}
+	return ok
+}
+
+// ParseAffiliationPolicySteps - parses comma separated list of steps (numbers or names), for example "1,2,3" or "project,global"
+func (s *service) ParseAffiliationPolicySteps(stepsStr string) (steps []int, err error) {
+	seen := make(map[int]struct{})
+	for _, item := range strings.Split(stepsStr, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		step := shared.AffStepNone
+		for st := shared.AffStepProject; st <= shared.AffStepDomain; st++ {
+			if item == strconv.Itoa(st) || item == shared.AffStepNames[st] {
+				step = st
+				break
+			}
+		}
+		if step == shared.AffStepNone {
+			err = fmt.Errorf("unknown step '%s', allowed steps are 1-6 or %v", item, shared.AffStepNames[shared.AffStepProject:])
+			return
+		}
+		_, dup := seen[step]
+		if dup {
+			err = fmt.Errorf("step '%s' specified more than once", item)
+			return
+		}
+		seen[step] = struct{}{}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		err = fmt.Errorf("at least one step must be enabled")
 		return
 	}
-	if !fetched {
-		identityData = nil
+	for i, st := range steps {
+		if st == shared.AffStepDomain && i != len(steps)-1 {
+			err = fmt.Errorf("step '%s' is a fallback and must be the last one", shared.AffStepNames[st])
+			return
+		}
 	}
 	return
 }
 
-func (s *service) GetProfile(uuid string, missingFatal bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
-	log.Info(fmt.Sprintf("GetProfile: uuid:%s missignFatal:%v tx:%v", uuid, missingFatal, tx != nil))
+// GetAffiliationPolicies - loads per-foundation affiliation policies into shared.GAffPolicies
+// if noUpdate is set it only loads them when they are not loaded yet
+func (s *service) GetAffiliationPolicies(noUpdate bool) (err error) {
+	shared.GAffPolicyMtx.Lock()
+	defer shared.GAffPolicyMtx.Unlock()
+	if noUpdate && shared.GAffPolicies != nil {
+		return
+	}
+	policies := make(map[string][]int)
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"GetProfile(exit): uuid:%s missignFatal:%v tx:%v profileData:%+v err:%v",
-				uuid,
-				missingFatal,
-				tx != nil,
-				s.ToLocalProfile(profileData),
-				err,
-			),
-		)
+		// If policies cannot be loaded we fallback to default 5-step algorithm, but leave them unset so the next call retries
+		if err != nil {
+			log.Warn(fmt.Sprintf("GetAffiliationPolicies: cannot load affiliation policies: %v, will retry\n", err))
+			shared.GAffPolicies = nil
+			return
+		}
+		shared.GAffPolicies = policies
 	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	profileData = &models.ProfileDataOutput{}
-	rows, err := s.Query(
-		sdb,
-		tx,
-		//"select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles where uuid = ? limit 1",
-		"select uuid, name, email, is_bot, country_code from profiles where uuid = ? limit 1",
-		uuid,
-	)
+	rows, err := s.Query(s.rodb, nil, "select foundation, steps from affiliation_policies")
 	if err != nil {
 		return
 	}
-	fetched := false
+	var (
+		foundation string
+		stepsStr   string
+		steps      []int
+	)
 	for rows.Next() {
-		err = rows.Scan(
-			&profileData.UUID,
-			&profileData.Name,
-			&profileData.Email,
-			//&profileData.Gender,
-			//&profileData.GenderAcc,
-			&profileData.IsBot,
-			&profileData.CountryCode,
-		)
+		err = rows.Scan(&foundation, &stepsStr)
 		if err != nil {
 			return
 		}
-		fetched = true
+		steps, err = s.ParseAffiliationPolicySteps(stepsStr)
+		if err != nil {
+			log.Warn(fmt.Sprintf("GetAffiliationPolicies: invalid policy for %s: %v, skipping\n", foundation, err))
+			err = nil
+			continue
+		}
+		policies[strings.ToLower(foundation)] = steps
 	}
 	err = rows.Err()
 	if err != nil {
 		return
 	}
 	err = rows.Close()
-	if err != nil {
-		return
-	}
-	if missingFatal && !fetched {
-		err = fmt.Errorf("cannot find profile uuid '%s'", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetProfile")
-		return
-	}
-	if !fetched {
-		profileData = nil
+	return
+}
+
+// affPolicyOutput - returns API representation of a given foundation policy
+func affPolicyOutput(foundation string, steps []int) (policy *models.AffiliationPolicy) {
+	policy = &models.AffiliationPolicy{Foundation: foundation}
+	for _, st := range steps {
+		policy.Steps = append(policy.Steps, int64(st))
+		policy.StepNames = append(policy.StepNames, shared.AffStepNames[st])
 	}
 	return
 }
 
-func (s *service) TouchIdentity(id string, tx *sql.Tx) (affected int64, err error) {
-	log.Info(fmt.Sprintf("TouchIdentity: id:%s tx:%v", id, tx != nil))
+// GetListAffiliationPolicies - returns all affiliation policies stored in the DB
+func (s *service) GetListAffiliationPolicies() (policies *models.ListAffiliationPolicies, err error) {
+	log.Info("GetListAffiliationPolicies")
+	policies = &models.ListAffiliationPolicies{Policies: []*models.AffiliationPolicy{}}
 	defer func() {
-		log.Info(fmt.Sprintf("TouchIdentity(exit): id:%s tx:%v affected:%d err:%v", id, tx != nil, affected, err))
+		log.Info(fmt.Sprintf("GetListAffiliationPolicies(exit): policies:%d err:%v", len(policies.Policies), err))
 	}()
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, "update identities set last_modified = ?, last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')", time.Now(), s.lfid, id)
+	err = s.GetAffiliationPolicies(false)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetListAffiliationPolicies")
 		return
 	}
-	affected, err = res.RowsAffected()
+	shared.GAffPolicyMtx.Lock()
+	for foundation, steps := range shared.GAffPolicies {
+		policies.Policies = append(policies.Policies, affPolicyOutput(foundation, steps))
+	}
+	shared.GAffPolicyMtx.Unlock()
+	sort.Slice(policies.Policies, func(i, j int) bool {
+		return policies.Policies[i].Foundation < policies.Policies[j].Foundation
+	})
 	return
 }
 
-func (s *service) TouchUniqueIdentity(uuid string, tx *sql.Tx) (affected int64, err error) {
-	log.Info(fmt.Sprintf("TouchUniqueIdentity: uuid:%s tx:%v", uuid, tx != nil))
+// SetAffiliationPolicy - adds or updates affiliation policy for a given foundation
+func (s *service) SetAffiliationPolicy(foundation, stepsStr string, tx *sql.Tx) (policy *models.AffiliationPolicy, err error) {
+	log.Info(fmt.Sprintf("SetAffiliationPolicy: foundation:%s steps:%s tx:%v", foundation, stepsStr, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("TouchUniqueIdentity(exit): uuid:%s tx:%v affected:%d err:%v", uuid, tx != nil, affected, err))
+		log.Info(fmt.Sprintf("SetAffiliationPolicy(exit): foundation:%s steps:%s tx:%v policy:%+v err:%v", foundation, stepsStr, tx != nil, policy, err))
 	}()
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, "update uidentities set last_modified = ?, last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')", time.Now(), s.lfid, uuid)
+	foundation = affPolicyFoundation(foundation)
+	if foundation == "" {
+		err = errs.Wrap(errs.New(fmt.Errorf("foundation must be set"), errs.ErrBadRequest), "SetAffiliationPolicy")
+		return
+	}
+	steps, err := s.ParseAffiliationPolicySteps(stepsStr)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "SetAffiliationPolicy")
 		return
 	}
-	affected, err = res.RowsAffected()
+	strs := []string{}
+	for _, st := range steps {
+		strs = append(strs, strconv.Itoa(st))
+	}
+	stepsStr = strings.Join(strs, ",")
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"insert into affiliation_policies(foundation, steps, last_modified, last_modified_by) values(?, ?, now(), ?) "+
+			"on duplicate key update steps = ?, last_modified = now(), last_modified_by = ?",
+		foundation,
+		stepsStr,
+		s.lfid,
+		stepsStr,
+		s.lfid,
+	)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "SetAffiliationPolicy")
+		return
+	}
+	policy = affPolicyOutput(foundation, steps)
+	if tx == nil {
+		err = s.GetAffiliationPolicies(false)
+	}
 	return
 }
 
-func (s *service) DeleteUniqueIdentityArchive(uuid string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteUniqueIdentityArchive: uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", uuid, missingFatal, onlyLast, tm, tx != nil))
+// DropAffiliationPolicy - deletes affiliation policy for a given foundation
+func (s *service) DropAffiliationPolicy(foundation string, missingFatal bool, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DropAffiliationPolicy: foundation:%s missingFatal:%v tx:%v", foundation, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteUniqueIdentityArchive(exit): uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", uuid, missingFatal, onlyLast, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("DropAffiliationPolicy(exit): foundation:%s missingFatal:%v tx:%v err:%v", foundation, missingFatal, tx != nil, err))
 	}()
-	var res sql.Result
-	if tm != nil {
-		del := "delete from uidentities_archive where uuid = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, del, uuid, tm)
-	} else {
-		if onlyLast {
-			del := "delete from uidentities_archive where uuid = ? and archived_at = (" +
-				"select max(archived_at) from uidentities_archive where uuid = ?)"
-			res, err = s.Exec(s.db, tx, del, uuid, uuid)
-		} else {
-			del := "delete from uidentities_archive where uuid = ?"
-			res, err = s.Exec(s.db, tx, del, uuid)
-		}
-	}
+	foundation = affPolicyFoundation(foundation)
+	res, err := s.Exec(s.db, tx, "delete from affiliation_policies where foundation = ?", foundation)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropAffiliationPolicy")
 		return
 	}
 	affected, err := res.RowsAffected()
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropAffiliationPolicy")
 		return
 	}
 	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting archived unique identity uuid '%s' had no effect", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteUniqueIdentityArchive")
-		return
-	}
-	return
-}
-
-func (s *service) UnarchiveUniqueIdentity(uuid string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("UnarchiveUniqueIdentity: uuid:%s replace:%v tm:%v tx:%v", uuid, replace, tm, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("UnarchiveUniqueIdentity(exit): uuid:%s replace:%v tm:%v tx:%v err:%v", uuid, replace, tm, tx != nil, err))
-	}()
-	uuid = strings.TrimSpace(uuid)
-	if replace {
-		err = s.DeleteUniqueIdentity(uuid, false, false, nil, tx)
-		if err != nil {
-			return
-		}
-	}
-	var res sql.Result
-	// s.SetOrigin()
-	if tm != nil {
-		insert := "insert into uidentities(uuid, last_modified, last_modified_by) " +
-			"select uuid, now(), ? from uidentities_archive " +
-			"where uuid = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid, tm)
-	} else {
-		insert := "insert into uidentities(uuid, last_modified, last_modified_by) " +
-			"select uuid, now(), ? from uidentities_archive " +
-			"where uuid = ? order by archived_at desc limit 1"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid)
-	}
-	if err != nil {
+		err = errs.Wrap(errs.New(fmt.Errorf("deleting affiliation policy for foundation '%s' had no effect", foundation), errs.ErrNotFound), "DropAffiliationPolicy")
 		return
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if affected == 0 {
-		err = fmt.Errorf("unachiving unique identity uuid '%s' created no data", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveUniqueIdentity")
-		return
-	}
-	err = s.DeleteUniqueIdentityArchive(uuid, true, tm == nil, tm, tx)
-	if err != nil {
-		return
+	if tx == nil {
+		err = s.GetAffiliationPolicies(false)
 	}
 	return
 }
 
-func (s *service) ArchiveUniqueIdentity(uuid string, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("ArchiveUniqueIdentity: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
+func (s *service) GetCountry(countryCode string, tx *sql.Tx) (countryData *models.CountryDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetCountry: countryCode:%s tx:%v", countryCode, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ArchiveUniqueIdentity(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("GetCountry(exit): countryCode:%s tx:%v countryData:%+v err:%v", countryCode, tx != nil, countryData, err))
 	}()
-	uuid = strings.TrimSpace(uuid)
-	if tm == nil {
-		t := time.Now()
-		tm = &t
-	}
-	insert := "insert into uidentities_archive(uuid, last_modified, archived_at, last_modified_by) " +
-		"select uuid, last_modified, ?, ? from uidentities where uuid = ? limit 1"
-	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, uuid)
-	if err != nil {
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	affected, err := res.RowsAffected()
+	countryData = &models.CountryDataOutput{}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select code, name, alpha3 from countries where code = ? limit 1",
+		countryCode,
+	)
 	if err != nil {
 		return
 	}
-	if affected == 0 {
-		err = fmt.Errorf("archiving unique identity uuid '%s' created no data", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveUniqueIdentity")
-		return
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&countryData.Code,
+			&countryData.Name,
+			&countryData.Alpha3,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
 	}
-	return
-}
-
-func (s *service) DropOrganization(id int64, missingFatal bool, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DropOrganization: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("DropOrganization(exit): id:%d missingFatal:%v tx:%v err:%v", id, missingFatal, tx != nil, err))
-	}()
-	del := "delete from organizations where id = ?"
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, id)
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	affected, err := res.RowsAffected()
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting organization id %d had no effect", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropOrganization")
+	if !fetched {
+		err = fmt.Errorf("cannot find country by code '%s'", countryCode)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetCountry")
 		return
 	}
 	return
 }
 
-func (s *service) DropOrgDomain(organization, domain string, missingFatal bool, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DropOrgDomain: organization:%s domain:%s missingFatal:%v tx:%v", organization, domain, missingFatal, tx != nil))
+func (s *service) MergeDateRanges(dates [][]strfmt.DateTime) (mergedDates [][]strfmt.DateTime, err error) {
+	log.Info(fmt.Sprintf("MergeDateRanges: dates:%+v", dates))
 	defer func() {
-		log.Info(fmt.Sprintf("DropOrgDomain(exit): organization:%s domain:%s missingFatal:%v tx:%v err:%v", organization, domain, missingFatal, tx != nil, err))
+		log.Info(fmt.Sprintf("MergeDateRanges(exit): dates:%+v mergedDates:%+v err:%v", dates, mergedDates, err))
 	}()
-	del := "delete from domains_organizations where organization_id in ("
-	del += "select id from organizations where name = ?) and domain = ?"
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, organization, domain)
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
-	if err != nil {
+	if len(dates) == 0 {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting organization '%s' domain '%s' had no effect", organization, domain)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropOrgDomain")
-		return
+	sortedDates := [][]strfmt.DateTime{}
+	for index, pair := range dates {
+		if len(pair) != 2 {
+			err = fmt.Errorf("datetime start-end pair number #%d doesn't have exactly 2 elements: %+v", index, pair)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
+			return
+		}
+		newPair := []strfmt.DateTime{}
+		if time.Time(pair[0]).Before(time.Time(pair[1])) {
+			newPair = append(newPair, pair[0])
+			newPair = append(newPair, pair[1])
+		} else {
+			newPair = append(newPair, pair[1])
+			newPair = append(newPair, pair[0])
+		}
+		sortedDates = append(sortedDates, newPair)
 	}
-	return
-}
-
-func (s *service) DropMatchingBlacklist(email string, missingFatal bool, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DropMatchingBlacklist: email:%s missingFatal:%v tx:%v", email, missingFatal, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("DropMatchingBlacklist(exit): email:%s missingFatal:%v tx:%v err:%v", email, missingFatal, tx != nil, err))
-	}()
-	del := "delete from matching_blacklist where excluded = ?"
-	res, err := s.Exec(s.db, tx, del, email)
-	if err != nil {
-		return
+	sort.SliceStable(sortedDates, func(i, j int) bool {
+		idx := 0
+		if sortedDates[i][0] == sortedDates[j][0] {
+			idx = 1
+		}
+		return time.Time(sortedDates[i][idx]).Before(time.Time(sortedDates[j][idx]))
+	})
+	saved := []strfmt.DateTime{sortedDates[0][0], sortedDates[0][1]}
+	minRange, maxRange := false, false
+	for _, data := range sortedDates {
+		st := data[0]
+		en := data[1]
+		if time.Time(st).Before(shared.MinPeriodDate) || time.Time(st).After(shared.MaxPeriodDate) {
+			err = fmt.Errorf("start date %v must be between %v and %v", st, shared.MinPeriodDate, shared.MaxPeriodDate)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
+			return
+		}
+		if time.Time(en).Before(shared.MinPeriodDate) || time.Time(en).After(shared.MaxPeriodDate) {
+			err = fmt.Errorf("end date %v must be between %v and %v", en, shared.MinPeriodDate, shared.MaxPeriodDate)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeDateRanges")
+			return
+		}
+		// st <= saved[1]
+		if !time.Time(st).After(time.Time(saved[1])) {
+			// saved[0] == MIN_PERIOD_DATE
+			if !time.Time(saved[0]).After(shared.MinPeriodDate) {
+				saved[0] = st
+				minRange = true
+			}
+			// if MAX_PERIOD_DATE in (en, saved[1]):
+			if !time.Time(saved[1]).Before(shared.MaxPeriodDate) || !time.Time(en).Before(shared.MaxPeriodDate) {
+				// if saved1 > en
+				if time.Time(saved[1]).After(time.Time(en)) {
+					saved[1] = en
+				}
+				maxRange = true
+			} else {
+				// if saved1 < en
+				if time.Time(saved[1]).Before(time.Time(en)) {
+					saved[1] = en
+				}
+			}
+		} else {
+			// st > saved[1]
+			mergedDates = append(mergedDates, []strfmt.DateTime{saved[0], saved[1]})
+			saved[0] = st
+			saved[1] = en
+		}
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
+	mergedDates = append(mergedDates, saved)
+	if minRange {
+		mergedDates[0][0] = strfmt.DateTime(shared.MinPeriodDate)
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting matching blacklist email '%s' had no effect", email)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropMatchingBlacklist")
-		return
+	if maxRange {
+		mergedDates[len(mergedDates)-1][1] = strfmt.DateTime(shared.MaxPeriodDate)
 	}
 	return
 }
 
-func (s *service) DeleteUniqueIdentity(uuid string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteUniqueIdentity: uuid:%s archive:%v missingFatal:%v tm:%v tx:%v", uuid, archive, missingFatal, tm, tx != nil))
+func (s *service) MergeEnrollments(uniqueIdentity *models.UniqueIdentityDataOutput, organization *models.OrganizationDataOutput, projectSlug *string, allProjectSlugs, noMergeFatal bool, tx *sql.Tx) (err error) {
+	pSlug := ""
+	if projectSlug != nil {
+		pSlug = *projectSlug
+	}
+	log.Info(fmt.Sprintf("MergeEnrollments: uniqueIdentity:%+v organization:%+v projectSlug:%v allProjectSlugs:%v noMergeFatal:%v tx:%v", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pSlug, allProjectSlugs, noMergeFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteUniqueIdentity(exit): uuid:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", uuid, archive, missingFatal, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("MergeEnrollments(exit): uniqueIdentity:%+v organization:%+v projectSlug:%v allProjectSlugs:%v noMergeFatal:%v tx:%v err:%v", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pSlug, allProjectSlugs, noMergeFatal, tx != nil, err))
 	}()
-	if archive {
-		err = s.ArchiveUniqueIdentity(uuid, tm, tx)
+	projectSlugs := make(map[*string]struct{})
+	projectSlugsInf := make(map[string]struct{})
+	if allProjectSlugs {
+		var rols []*models.EnrollmentDataOutput
+		rols, err = s.FindEnrollments([]string{"uuid", "organization_id"}, []interface{}{uniqueIdentity.UUID, organization.ID}, []bool{false, false}, false, tx)
 		if err != nil {
 			return
 		}
+		for _, rol := range rols {
+			projectSlugs[rol.ProjectSlug] = struct{}{}
+			ps := rol.ProjectSlug
+			if ps == nil {
+				projectSlugsInf["(null)"] = struct{}{}
+			} else {
+				projectSlugsInf[*ps] = struct{}{}
+			}
+		}
+	} else {
+		projectSlugs[projectSlug] = struct{}{}
+		if projectSlug == nil {
+			projectSlugsInf["(null)"] = struct{}{}
+		} else {
+			projectSlugsInf[*projectSlug] = struct{}{}
+		}
 	}
-	del := "delete from uidentities where uuid = ? and (locked_by is null or trim(locked_by) = '')"
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, uuid)
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting unique identity uuid '%s' had no effect", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteUniqueIdentity")
-		return
+	log.Info(fmt.Sprintf("Merging projects %+v organization %+v uniqueIdentity %+v", projectSlugsInf, organization, s.ToLocalUniqueIdentity(uniqueIdentity)))
+	for slug := range projectSlugs {
+		pS := ""
+		if slug != nil {
+			pS = *slug
+		}
+		merged := 0
+		for _, role := range shared.Roles {
+			var disjoint []*models.EnrollmentDataOutput
+			disjoint, err = s.FindEnrollments([]string{"uuid", "organization_id", "project_slug", "role"}, []interface{}{uniqueIdentity.UUID, organization.ID, slug, role}, []bool{false, false, false, false}, false, tx)
+			if err != nil {
+				return
+			}
+			if len(disjoint) == 0 {
+				continue
+			}
+			dates := [][]strfmt.DateTime{}
+			for _, rol := range disjoint {
+				dates = append(dates, []strfmt.DateTime{rol.Start, rol.End})
+			}
+			var mergedDates [][]strfmt.DateTime
+			mergedDates, err = s.MergeDateRanges(dates)
+			if err != nil {
+				return
+			}
+			for _, data := range mergedDates {
+				st := data[0]
+				en := data[1]
+				isDup := func(x *models.EnrollmentDataOutput, st, en strfmt.DateTime) bool {
+					return x.Start == st && x.End == en
+				}
+				filtered := []*models.EnrollmentDataOutput{}
+				for _, rol := range disjoint {
+					if !isDup(rol, st, en) {
+						filtered = append(filtered, rol)
+					}
+				}
+				if len(filtered) != len(disjoint) {
+					disjoint = filtered
+					continue
+				}
+				newEnrollment := &models.EnrollmentDataOutput{UUID: uniqueIdentity.UUID, OrganizationID: organization.ID, Start: st, End: en, ProjectSlug: slug, Role: role}
+				// Merged enrollment keeps provenance of the most confident enrollment it was merged from
+				src := affMostConfident(disjoint, st, en)
+				if src != nil {
+					newEnrollment.Provenance = src.Provenance
+					newEnrollment.EvidenceURL = src.EvidenceURL
+					newEnrollment.EvidenceNotes = src.EvidenceNotes
+					newEnrollment.Confidence = src.Confidence
+				}
+				_, err = s.AddEnrollment(newEnrollment, false, false, tx)
+				if err != nil {
+					return
+				}
+			}
+			for _, rol := range disjoint {
+				err = s.DeleteEnrollment(rol.ID, shared.GEnrollmentHistory, true, nil, tx)
+				if err != nil {
+					return
+				}
+			}
+			merged++
+		}
+		if merged == 0 && noMergeFatal {
+			err = fmt.Errorf("merge enrollments unique identity '%+v' organization '%+v' projectSlug %v allProjectSlugs %v found no enrollments", s.ToLocalUniqueIdentity(uniqueIdentity), organization, pS, allProjectSlugs)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MergeEnrollments")
+			return
+		}
 	}
 	return
 }
 
-func (s *service) DeleteEnrollmentArchive(id int64, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteEnrollmentArchive: id:%d missingFatal:%v onlyLast:%v tm:%v tx:%v", id, missingFatal, onlyLast, tm, tx != nil))
+// EnrollmentSplitChanges - returns how current enrollments of other organizations overlapping given enrollment must be changed,
+// so the given one is exclusive for its date range. Only enrollments with the same role and project slug (or both global) are considered.
+// truncate - enrollment is shortened, split - enrollment is split into two around the given one, delete - enrollment is fully covered
+// locked maps locked current enrollments ids to their locked_by, if any of them must be changed a conflict error is returned
+func (s *service) EnrollmentSplitChanges(enrollment *models.EnrollmentDataOutput, current []*models.EnrollmentDataOutput, locked map[int64]string) (changes []*models.EnrollmentSplitChange, err error) {
+	slugEq := func(a, b *string) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && strings.EqualFold(*a, *b))
+	}
+	st, en := time.Time(enrollment.Start), time.Time(enrollment.End)
+	piece := func(rol *models.EnrollmentDataOutput, pst, pen time.Time) *models.EnrollmentDataOutput {
+		p := *rol
+		p.ID = 0
+		p.Start = strfmt.DateTime(pst)
+		p.End = strfmt.DateTime(pen)
+		if rol.ProjectSlug != nil {
+			projectSlug := *rol.ProjectSlug
+			p.ProjectSlug = &projectSlug
+		}
+		return &p
+	}
+	for _, rol := range current {
+		if rol.OrganizationID == enrollment.OrganizationID || rol.Role != enrollment.Role || !slugEq(rol.ProjectSlug, enrollment.ProjectSlug) {
+			continue
+		}
+		rst, ren := time.Time(rol.Start), time.Time(rol.End)
+		if !rst.Before(en) || !ren.After(st) {
+			continue
+		}
+		if locked[rol.ID] != "" {
+			changes = nil
+			err = fmt.Errorf(
+				"enrollment %d (organization %d, %s - %s) overlapping added one is locked by %s, cannot change it",
+				rol.ID, rol.OrganizationID, rst.Format(shared.DateFormat), ren.Format(shared.DateFormat), locked[rol.ID],
+			)
+			err = errs.Wrap(errs.New(err, errs.ErrConflict), "EnrollmentSplitChanges")
+			return
+		}
+		change := &models.EnrollmentSplitChange{Original: rol, Pieces: []*models.EnrollmentDataOutput{}}
+		if rst.Before(st) {
+			change.Pieces = append(change.Pieces, piece(rol, rst, st))
+		}
+		if ren.After(en) {
+			change.Pieces = append(change.Pieces, piece(rol, en, ren))
+		}
+		switch len(change.Pieces) {
+		case 0:
+			change.Action = shared.EnrollmentSplitDelete
+		case 1:
+			change.Action = shared.EnrollmentSplitTruncate
+		default:
+			change.Action = shared.EnrollmentSplitSplit
+		}
+		changes = append(changes, change)
+	}
+	return
+}
+
+// AddEnrollmentSplit - adds enrollment truncating or splitting other organizations enrollments overlapping it (see EnrollmentSplitChanges)
+// Changed enrollments are archived (all with the same archived_at), so they can be restored. All changes are made in a single transaction
+func (s *service) AddEnrollmentSplit(enrollment *models.EnrollmentDataOutput) (changes []*models.EnrollmentSplitChange, err error) {
+	log.Info(fmt.Sprintf("AddEnrollmentSplit: enrollment:%+v", enrollment))
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteEnrollmentArchive(exit): id:%d missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", id, missingFatal, onlyLast, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("AddEnrollmentSplit(exit): enrollment:%+v changes:%d err:%v", enrollment, len(changes), err))
 	}()
-	var res sql.Result
-	if tm != nil {
-		del := "delete from enrollments_archive where id = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, del, id, tm)
-	} else {
-		if onlyLast {
-			del := "delete from enrollments_archive where id = ? and archived_at = (" +
-				"select max(archived_at) from enrollments_archive where id = ?)"
-			res, err = s.Exec(s.db, tx, del, id, id)
-		} else {
-			del := "delete from enrollments_archive where id = ?"
-			res, err = s.Exec(s.db, tx, del, id)
-		}
+	if enrollment.Role == "" {
+		enrollment.Role = shared.DefaultRole
 	}
+	err = s.ValidateEnrollment(enrollment, false)
 	if err != nil {
 		return
 	}
-	affected, err := res.RowsAffected()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting archived enrollment id '%d' had no effect", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteEnrollmentArchive")
-		return
-	}
-	return
-}
-
-func (s *service) UnarchiveEnrollment(id int64, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("UnarchiveEnrollment: id:%d replace:%v tm:%v tx:%v", id, replace, tm, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("UnarchiveEnrollment(exit): id:%d replace:%v tm:%v tx:%v err:%v", id, replace, tm, tx != nil, err))
-	}()
-	if replace {
-		err = s.DeleteEnrollment(id, false, false, nil, tx)
-		if err != nil {
-			return
+		if tx != nil {
+			s.RollbackTx(tx)
 		}
+	}()
+	current, err := s.FindEnrollments([]string{"uuid"}, []interface{}{enrollment.UUID}, []bool{false}, false, tx)
+	if err != nil {
+		return
 	}
-	var res sql.Result
-	// s.SetOrigin()
-	if tm != nil {
-		insert := "insert into enrollments(id, uuid, organization_id, start, end, project_slug, role, last_modified_by) " +
-			"select id, uuid, organization_id, start, end, project_slug, role, ? from enrollments_archive " +
-			"where id = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, id, tm)
-	} else {
-		insert := "insert into enrollments(id, uuid, organization_id, start, end, project_slug, role, last_modified_by) " +
-			"select id, uuid, organization_id, start, end, project_slug, role, ? from enrollments_archive " +
-			"where id = ? order by archived_at desc limit 1"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, id)
+	ids := []int64{}
+	for _, rol := range current {
+		ids = append(ids, rol.ID)
 	}
+	locked, err := s.LockedEnrollments(ids, tx)
 	if err != nil {
 		return
 	}
-	affected, err := res.RowsAffected()
+	changes, err = s.EnrollmentSplitChanges(enrollment, current, locked)
 	if err != nil {
 		return
 	}
-	if affected == 0 {
-		err = fmt.Errorf("unachiving enrollment id '%d' created no data", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveEnrollment")
+	now := time.Now()
+	for _, change := range changes {
+		// missingFatal is set, so enrollment locked after the check above cannot be split
+		err = s.DeleteEnrollment(change.Original.ID, true, true, &now, tx)
+		if err != nil {
+			return
+		}
+		for i, piece := range change.Pieces {
+			change.Pieces[i], err = s.AddEnrollment(piece, false, true, tx)
+			if err != nil {
+				return
+			}
+		}
+	}
+	_, err = s.AddEnrollment(enrollment, false, false, tx)
+	if err != nil {
 		return
 	}
-	err = s.DeleteEnrollmentArchive(id, true, tm == nil, tm, tx)
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
+	tx = nil
 	return
 }
 
-func (s *service) ArchiveEnrollment(id int64, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("ArchiveEnrollment: id:%d tm:%v tx:%v", id, tm, tx != nil))
+func (s *service) MoveEnrollmentToUniqueIdentity(enrollment *models.EnrollmentDataOutput, uniqueIdentity *models.UniqueIdentityDataOutput, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("MoveEnrollmentToUniqueIdentity: enrollment:%+v uniqueIdentity:%+v tx:%v", enrollment, s.ToLocalUniqueIdentity(uniqueIdentity), tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ArchiveEnrollment(exit): id:%d tm:%v tx:%v err:%v", id, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("MoveEnrollmentToUniqueIdentity(exit): enrollment:%+v uniqueIdentity:%+v tx:%v err:%v", enrollment, s.ToLocalUniqueIdentity(uniqueIdentity), tx != nil, err))
 	}()
-	if tm == nil {
-		t := time.Now()
-		tm = &t
+	if enrollment.UUID == uniqueIdentity.UUID {
+		return
 	}
-	insert := "insert into enrollments_archive(id, uuid, organization_id, start, end, project_slug, role, archived_at, last_modified_by) " +
-		"select id, uuid, organization_id, start, end, project_slug, role, ?, ? from enrollments where id = ? limit 1"
-	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, id)
+	oldUniqueIdentity, err := s.GetUniqueIdentity(enrollment.UUID, true, tx)
 	if err != nil {
 		return
 	}
-	affected, err := res.RowsAffected()
+	defer s.invalidateAffiliationCacheTx(tx, enrollment.UUID)
+	enrollment.UUID = uniqueIdentity.UUID
+	enrollment, err = s.EditEnrollment(enrollment, true, tx)
 	if err != nil {
 		return
 	}
-	if affected == 0 {
-		err = fmt.Errorf("archiving enrollment id '%d' created no data", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveEnrollment")
+	affected, err := s.TouchUniqueIdentity(oldUniqueIdentity.UUID, tx)
+	if err != nil {
 		return
 	}
-	return
-}
-
-func (s *service) WithdrawEnrollment(enrollment *models.EnrollmentDataOutput, missingFatal bool, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("WithdrawEnrollment: enrollment:%+v missingFatal:%v tx:%v", enrollment, missingFatal, tx != nil))
-	// s.SetOrigin()
-	defer func() {
-		log.Info(fmt.Sprintf("WithdrawEnrollment(exit): enrollment:%+v missingFatal:%v tx:%v err:%v", enrollment, missingFatal, tx != nil, err))
-	}()
-	// s.SetOrigin()
-	var res sql.Result
-	if enrollment.ProjectSlug == nil {
-		del := "delete from enrollments where uuid = ? and organization_id = ? and start >= str_to_date(?, ?) and end <= str_to_date(?, ?) and project_slug is null and role = ? and (locked_by is null or trim(locked_by) = '')"
-		res, err = s.Exec(
-			s.db,
-			tx,
-			del,
-			enrollment.UUID,
-			enrollment.OrganizationID,
-			enrollment.Start,
-			DateTimeFormat,
-			enrollment.End,
-			DateTimeFormat,
-			enrollment.Role,
-		)
-	} else {
-		del := "delete from enrollments where uuid = ? and organization_id = ? and start >= str_to_date(?, ?) and end <= str_to_date(?, ?) and project_slug = ? and role = ? and (locked_by is null or trim(locked_by) = '')"
-		res, err = s.Exec(
-			s.db,
-			tx,
-			del,
-			enrollment.UUID,
-			enrollment.OrganizationID,
-			enrollment.Start,
-			DateTimeFormat,
-			enrollment.End,
-			DateTimeFormat,
-			enrollment.ProjectSlug,
-			enrollment.Role,
-		)
-	}
-	if err != nil {
+	if affected != 1 {
+		err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(oldUniqueIdentity), affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveEnrollmentToUniqueIdentity")
 		return
 	}
-	affected, err := res.RowsAffected()
+	affected, err = s.TouchUniqueIdentity(uniqueIdentity.UUID, tx)
 	if err != nil {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting enrollment id '%+v' had no effect", enrollment)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "WithdrawEnrollment")
+	if affected != 1 {
+		err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(uniqueIdentity), affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveEnrollmentToUniqueIdentity")
 		return
 	}
 	return
 }
 
-func (s *service) DeleteEnrollment(id int64, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteEnrollment: id:%d archive:%v missingFatal:%v tm:%v tx:%v", id, archive, missingFatal, tm, tx != nil))
+func (s *service) MoveIdentityToUniqueIdentity(identity *models.IdentityDataOutput, uniqueIdentity *models.UniqueIdentityDataOutput, unarchive bool, tx *sql.Tx) (err error) {
+	log.Info(
+		fmt.Sprintf(
+			"MoveIdentityToUniqueIdentity: identity:%+v uniqueIdentity:%+v unarchive:%v tx:%v",
+			s.ToLocalIdentity(identity),
+			s.ToLocalUniqueIdentity(uniqueIdentity),
+			unarchive,
+			tx != nil,
+		),
+	)
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteEnrollment(exit): id:%d archive:%v missingFatal:%v tm:%v tx:%v err:%v", id, archive, missingFatal, tm, tx != nil, err))
+		log.Info(
+			fmt.Sprintf(
+				"MoveIdentityToUniqueIdentity(exit): identity:%+v uniqueIdentity:%+v unarchive:%v tx:%v err:%v",
+				s.ToLocalIdentity(identity),
+				s.ToLocalUniqueIdentity(uniqueIdentity),
+				unarchive,
+				tx != nil,
+				err,
+			),
+		)
 	}()
-	if archive {
-		err = s.ArchiveEnrollment(id, tm, tx)
+	if identity.UUID != nil && (*(identity.UUID) == uniqueIdentity.UUID) {
+		return
+	}
+	var oldUniqueIdentity *models.UniqueIdentityDataOutput
+	if identity.UUID != nil {
+		oldUniqueIdentity, err = s.GetUniqueIdentity(*(identity.UUID), true, tx)
 		if err != nil {
 			return
 		}
 	}
-	del := "delete from enrollments where id = ? and (locked_by is null or trim(locked_by) = '')"
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, id)
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
+	identity.UUID = &uniqueIdentity.UUID
+	identity.LastModified = s.Now()
+	identity, err = s.EditIdentity(identity, true, tx)
 	if err != nil {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting enrollment id '%d' had no effect", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteEnrollment")
-		return
-	}
+	if oldUniqueIdentity != nil {
+		affected := int64(0)
+		affected, err = s.TouchUniqueIdentity(oldUniqueIdentity.UUID, tx)
+		if err != nil {
+			return
+		}
+		if affected != 1 {
+			err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(oldUniqueIdentity), affected)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentityToUniqueIdentity")
+			return
+		}
+		affected, err = s.TouchUniqueIdentity(uniqueIdentity.UUID, tx)
+		if err != nil {
+			return
+		}
+		if affected != 1 {
+			err = fmt.Errorf("'%+v' unique identity update affected %d rows", s.ToLocalUniqueIdentity(uniqueIdentity), affected)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentityToUniqueIdentity")
+			return
+		}
+	}
 	return
 }
 
-func (s *service) DeleteIdentityArchive(id string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteIdentityArchive: id:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", id, missingFatal, onlyLast, tm, tx != nil))
+func (s *service) AddMatchingBlacklist(inMatchingBlacklist *models.MatchingBlacklistOutput, refresh bool, tx *sql.Tx) (matchingBlacklist *models.MatchingBlacklistOutput, err error) {
+	log.Info(fmt.Sprintf("AddMatchingBlacklist: inMatchingBlacklist:%+v refresh:%v tx:%v", inMatchingBlacklist, refresh, tx != nil))
+	matchingBlacklist = inMatchingBlacklist
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteIdentityArchive(exit): id:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", id, missingFatal, onlyLast, tm, tx != nil, err))
+		log.Info(
+			fmt.Sprintf(
+				"AddMatchingBlacklist(exit): inMatchingBlacklist:%+v refresh:%v tx:%v matchingBlacklist:%+v err:%v",
+				inMatchingBlacklist,
+				refresh,
+				tx != nil,
+				matchingBlacklist,
+				err,
+			),
+		)
 	}()
-	var res sql.Result
-	if tm != nil {
-		del := "delete from identities_archive where id = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, del, id, tm)
-	} else {
-		if onlyLast {
-			del := "delete from identities_archive where id = ? and archived_at = (" +
-				"select max(archived_at) from identities_archive where id = ?)"
-			res, err = s.Exec(s.db, tx, del, id, id)
-		} else {
-			del := "delete from identities_archive where id = ?"
-			res, err = s.Exec(s.db, tx, del, id)
-		}
-	}
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
+	matchingBlacklist.Excluded = strings.TrimSpace(matchingBlacklist.Excluded)
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"insert into matching_blacklist(excluded, last_modified_by) select ?, ?",
+		matchingBlacklist.Excluded,
+		s.lfid,
+	)
 	if err != nil {
+		matchingBlacklist = nil
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting archived identity id '%s' had no effect", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteIdentityArchive")
-		return
-	}
-	return
-}
-
-func (s *service) UnarchiveIdentity(id string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("UnarchiveIdentity: id:%s replace:%v tm:%v tx:%v", id, replace, tm, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("UnarchiveIdentity(exit): id:%s replace:%v tm:%v tx:%v err:%v", id, replace, tm, tx != nil, err))
-	}()
-	if replace {
-		err = s.DeleteIdentity(id, false, false, nil, tx)
+	if refresh {
+		matchingBlacklist, err = s.FetchMatchingBlacklist(matchingBlacklist.Excluded, true, tx)
 		if err != nil {
+			matchingBlacklist = nil
 			return
 		}
 	}
-	var res sql.Result
-	// s.SetOrigin()
-	if tm != nil {
-		insert := "insert into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) " +
-			"select id, uuid, source, name, email, username, now(), ? from identities_archive " +
-			"where id = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, id, tm)
-	} else {
-		insert := "insert into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) " +
-			"select id, uuid, source, name, email, username, now(), ? from identities_archive " +
-			"where id = ? order by archived_at desc limit 1"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, id)
-	}
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if affected == 0 {
-		err = fmt.Errorf("unachiving identity id '%s' created no data", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveIdentity")
-		return
-	}
-	err = s.DeleteIdentityArchive(id, true, tm == nil, tm, tx)
-	if err != nil {
-		return
-	}
 	return
 }
 
-func (s *service) ArchiveIdentity(id string, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("ArchiveIdentity: id:%s tm:%v tx:%v", id, tm, tx != nil))
+// EnrichContributors - sets name, email and organization for contributors using their enrollments on a given date
+// If role is set (for example Maintainer), only enrollments with that role are used
+func (s *service) EnrichContributors(contributors []*models.ContributorFlatStats, projectSlugs []string, role string, millisSinceEpoch int64, tx *sql.Tx) (err error) {
+	inf := ""
+	n := len(contributors)
+	if n > shared.LogListMax {
+		inf = fmt.Sprintf("%d", n)
+	} else {
+		inf = fmt.Sprintf("%+v", s.ToLocalTopContributorsFlat(contributors))
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	found := 0
+	orgFound := 0
+	log.Debug(fmt.Sprintf("EnrichContributors: contributors:%s projectSlugs:%+v role:%s millisSinceEpoch:%d tx:%v", inf, projectSlugs, role, millisSinceEpoch, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ArchiveIdentity(exit): id:%s tm:%v tx:%v err:%v", id, tm, tx != nil, err))
+		log.Debug(
+			fmt.Sprintf(
+				"EnrichContributors(exit): contributors:%s projectSlugs:%+v role:%s millisSinceEpoch:%d tx:%v found:%d/%d/%d err:%v",
+				inf,
+				projectSlugs,
+				role,
+				millisSinceEpoch,
+				tx != nil,
+				orgFound,
+				found,
+				n,
+				err,
+			),
+		)
 	}()
-	if tm == nil {
-		t := time.Now()
-		tm = &t
-	}
-	insert := "insert into identities_archive(id, uuid, source, name, email, username, last_modified, archived_at, last_modified_by) " +
-		"select id, uuid, source, name, email, username, last_modified, ?, ? from identities where id = ? limit 1"
-	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, id)
-	if err != nil {
+	if len(contributors) == 0 {
 		return
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
+	// Enrollments allowed by the affiliation policies, ordered by policy steps
+	cond, condArgs, order, orderArgs := s.affPolicyCondition(projectSlugs)
+	if role != "" {
+		cond = "e.role = ? and " + cond
+		condArgs = append([]interface{}{role}, condArgs...)
 	}
-	if affected == 0 {
-		err = fmt.Errorf("archiving identity id '%s' created no data", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveIdentity")
+	secsSinceEpoch := float64(millisSinceEpoch) / 1000.0
+	sel := "select distinct p.uuid, coalesce(p.name, ''), coalesce(p.email, ''), coalesce(o.name, '') from profiles p left join enrollments e"
+	sel += fmt.Sprintf(
+		" on p.uuid = e.uuid and e.start <= coalesce(from_unixtime(%f), now()) and e.end >= coalesce(from_unixtime(%f), now())",
+		secsSinceEpoch,
+		secsSinceEpoch,
+	)
+	uuids := []interface{}{}
+	sel += " and " + cond
+	uuids = append(uuids, condArgs...)
+	sel += " left join organizations o on e.organization_id = o.id where p.uuid in ("
+	data := make(map[string][3]string)
+	for _, contributor := range contributors {
+		uuid := contributor.UUID
+		uuids = append(uuids, uuid)
+		sel += "?,"
+	}
+	sel = sel[0:len(sel)-1] + ")"
+	sel += " order by " + order
+	uuids = append(uuids, orderArgs...)
+	var rows *sql.Rows
+	// fmt.Printf("\n%+v\n%s\n\n", uuids, sel)
+	rows, err = s.Query(sdb, tx, sel, uuids...)
+	if err != nil {
 		return
 	}
-	return
-}
-
-func (s *service) DeleteIdentity(id string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteIdentity: id:%s archive:%v missingFatal:%v tm:%v tx:%v", id, archive, missingFatal, tm, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("DeleteIdentity(exit): id:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", id, archive, missingFatal, tm, tx != nil, err))
-	}()
-	if archive {
-		err = s.ArchiveIdentity(id, tm, tx)
+	uuid := ""
+	name := ""
+	email := ""
+	org := ""
+	for rows.Next() {
+		err = rows.Scan(&uuid, &name, &email, &org)
 		if err != nil {
 			return
 		}
+		_, ok := data[uuid]
+		if !ok {
+			data[uuid] = [3]string{name, email, org}
+		}
 	}
-	del := "delete from identities where id = ? and (locked_by is null or trim(locked_by) = '')"
-	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, id)
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	affected, err := res.RowsAffected()
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting identity id '%s' had no effect", id)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteIdentity")
-		return
-	}
-	return
-}
-
-func (s *service) DeleteProfileArchive(uuid string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteProfileArchive: uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", uuid, missingFatal, onlyLast, tm, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("DeleteProfileArchive(exit): uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", uuid, missingFatal, onlyLast, tm, tx != nil, err))
-	}()
-	var res sql.Result
-	if tm != nil {
-		del := "delete from profiles_archive where uuid = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, del, uuid, tm)
-	} else {
-		if onlyLast {
-			del := "delete from profiles_archive where uuid = ? and archived_at = (" +
-				"select max(archived_at) from profiles_archive where uuid = ?)"
-			res, err = s.Exec(s.db, tx, del, uuid, uuid)
+	missUUIDs := []string{}
+	for idx, contributor := range contributors {
+		uuid := contributor.UUID
+		ary, ok := data[uuid]
+		if ok {
+			contributors[idx].Name = ary[0]
+			contributors[idx].Email = ary[1]
+			contributors[idx].Organization = ary[2]
+			found++
+			if ary[2] != "" {
+				orgFound++
+			}
 		} else {
-			del := "delete from profiles_archive where uuid = ?"
-			res, err = s.Exec(s.db, tx, del, uuid)
+			missUUIDs = append(missUUIDs, uuid)
 		}
 	}
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return
-	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting archived profile uuid '%s' had no effect", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteProfileArchive")
-		return
-	}
-	return
-}
-
-func (s *service) UnarchiveProfile(uuid string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("UnarchiveProfile: uuid:%s replace:%v tm:%v tx:%v", uuid, replace, tm, tx != nil))
-	defer func() {
-		log.Info(fmt.Sprintf("UnarchiveProfile(exit): uuid:%s replace:%v tm:%v tx:%v err:%v", uuid, replace, tm, tx != nil, err))
-	}()
-	uuid = strings.TrimSpace(uuid)
-	if replace {
-		err = s.DeleteProfile(uuid, false, false, nil, tx)
+	if len(missUUIDs) > 0 {
+		sel := "select distinct p.uuid, coalesce(p.name, ''), coalesce(p.email, ''), coalesce(o.name, '') from profiles_archive p left join enrollments_archive e"
+		sel += fmt.Sprintf(
+			" on p.archived_at = e.archived_at and p.uuid = e.uuid and e.start <= coalesce(from_unixtime(%f), now()) and e.end >= coalesce(from_unixtime(%f), now())",
+			secsSinceEpoch,
+			secsSinceEpoch,
+		)
+		uuids := []interface{}{}
+		sel += " and " + cond
+		uuids = append(uuids, condArgs...)
+		sel += " left join organizations o on e.organization_id = o.id where p.uuid in ("
+		data := make(map[string][3]string)
+		for _, uuid := range missUUIDs {
+			uuids = append(uuids, uuid)
+			sel += "?,"
+		}
+		sel = sel[0:len(sel)-1] + ")"
+		sel += " order by " + order + ", p.uuid asc, p.archived_at desc"
+		uuids = append(uuids, orderArgs...)
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, sel, uuids...)
+		if err != nil {
+			return
+		}
+		uuid := ""
+		name := ""
+		email := ""
+		org := ""
+		for rows.Next() {
+			err = rows.Scan(&uuid, &name, &email, &org)
+			if err != nil {
+				return
+			}
+			_, ok := data[uuid]
+			if !ok {
+				data[uuid] = [3]string{name, email, org}
+			}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
 		if err != nil {
 			return
 		}
+		for idx, contributor := range contributors {
+			uuid := contributor.UUID
+			ary, ok := data[uuid]
+			if ok {
+				contributors[idx].Name = ary[0]
+				contributors[idx].Email = ary[1]
+				contributors[idx].Organization = ary[2]
+				found++
+				if ary[2] != "" {
+					orgFound++
+				}
+			}
+		}
 	}
-	var res sql.Result
-	// s.SetOrigin()
-	if tm != nil {
-		insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) " +
-			"select uuid, name, email, is_bot, country_code, ? from profiles_archive " +
-			"where uuid = ? and archived_at = ?"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid, tm)
+	return
+}
+
+func (s *service) CheckUnaffiliated(inUnaffiliated []*models.UnaffiliatedDataOutput, projectSlugs []string, tx *sql.Tx) (unaffiliated []*models.UnaffiliatedDataOutput, err error) {
+	inunaff := ""
+	nUnaffiliated := len(inUnaffiliated)
+	if nUnaffiliated > shared.LogListMax {
+		inunaff = fmt.Sprintf("%d", nUnaffiliated)
 	} else {
-		insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) " +
-			"select uuid, name, email, is_bot, country_code, ? from profiles_archive " +
-			"where uuid = ? order by archived_at desc limit 1"
-		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid)
+		inunaff = fmt.Sprintf("%+v", s.ToLocalUnaffiliated(inUnaffiliated))
 	}
-	if err != nil {
+	log.Info(fmt.Sprintf("CheckUnaffiliated: inUnaffiliated:%s projectSlugs:%+v tx:%v", inunaff, projectSlugs, tx != nil))
+	defer func() {
+		unaff := ""
+		nUnaffiliated := len(unaffiliated)
+		if nUnaffiliated > shared.LogListMax {
+			unaff = fmt.Sprintf("%d", nUnaffiliated)
+		} else {
+			unaff = fmt.Sprintf("%+v", s.ToLocalUnaffiliated(unaffiliated))
+		}
+		log.Info(
+			fmt.Sprintf(
+				"CheckUnaffiliated(exit): inUnaffiliated:%+v projectSlugs:%+v tx:%v unaffiliated:%+v err:%v",
+				inunaff,
+				projectSlugs,
+				tx != nil,
+				unaff,
+				err,
+			),
+		)
+	}()
+	if len(inUnaffiliated) == 0 {
+		log.Info("No unaffiliated data to check")
 		return
 	}
-	affected, err := res.RowsAffected()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	// Only enrollments allowed by the affiliation policies are joined, so profiles without any enrollments get a single row without
+	// enrollment - they are unaffiliated. Profiles having only other projects enrollments are unaffiliated only when policy disables steps 4 and 5
+	cond, condArgs, _, _ := s.affPolicyCondition(projectSlugs)
+	sel := "select p.uuid, p.name, e.uuid from profiles p left join enrollments e on p.uuid = e.uuid and " + cond
+	sel += " where (p.is_bot is null or p.is_bot = 0) and p.uuid in ("
+	uuids := []interface{}{}
+	uuids = append(uuids, condArgs...)
+	contribs := make(map[string]int64)
+	for _, unaff := range inUnaffiliated {
+		uuid := unaff.UUID
+		uuids = append(uuids, uuid)
+		sel += "?,"
+		contribs[uuid] = unaff.Contributions
+	}
+	sel = sel[0:len(sel)-1] + ")"
+	var rows *sql.Rows
+	rows, err = s.Query(sdb, tx, sel, uuids...)
 	if err != nil {
 		return
 	}
-	if affected == 0 {
-		err = fmt.Errorf("unachiving profile uuid '%s' created no data", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveProfile")
+	uuid := ""
+	var (
+		puuid *string
+		pname *string
+	)
+	for rows.Next() {
+		err = rows.Scan(&uuid, &pname, &puuid)
+		if err != nil {
+			return
+		}
+		if puuid == nil {
+			name := ""
+			if pname != nil {
+				name = *pname
+			}
+			unaffiliated = append(unaffiliated, &models.UnaffiliatedDataOutput{UUID: uuid, Name: name, Contributions: contribs[uuid]})
+		}
+	}
+	err = rows.Err()
+	if err != nil {
 		return
 	}
-	err = s.DeleteProfileArchive(uuid, true, tm == nil, tm, tx)
+	err = rows.Close()
 	if err != nil {
 		return
 	}
+	sort.SliceStable(unaffiliated, func(i, j int) bool {
+		return unaffiliated[i].Contributions > unaffiliated[j].Contributions
+	})
 	return
 }
 
-func (s *service) ArchiveProfile(uuid string, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("ArchiveProfile: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
+func (s *service) AddOrganization(inOrganization *models.OrganizationDataOutput, refresh bool, tx *sql.Tx) (organization *models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddOrganization: inOrganization:%+v refresh:%v tx:%v", s.ToLocalOrganization(inOrganization), refresh, tx != nil))
+	organization = inOrganization
 	defer func() {
-		log.Info(fmt.Sprintf("ArchiveProfile(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
+		log.Info(
+			fmt.Sprintf(
+				"AddOrganization(exit): inOrganization:%+v refresh:%v tx:%v organization:%+v err:%v",
+				s.ToLocalOrganization(inOrganization),
+				refresh,
+				tx != nil,
+				s.ToLocalOrganization(organization),
+				err,
+			),
+		)
 	}()
-	uuid = strings.TrimSpace(uuid)
-	if tm == nil {
-		t := time.Now()
-		tm = &t
-	}
-	insert := "insert into profiles_archive(uuid, name, email, is_bot, country_code, archived_at, last_modified_by) " +
-		"select uuid, name, email, is_bot, country_code, ?, ? from profiles where uuid = ? limit 1"
-	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, uuid)
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
+	organization.Name = strings.TrimSpace(organization.Name)
+	// s.SetOrigin()
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"insert into organizations(name,last_modified_by) select ?,?",
+		organization.Name,
+		s.lfid,
+	)
 	if err != nil {
+		organization = nil
 		return
 	}
-	if affected == 0 {
-		err = fmt.Errorf("archiving profile uuid '%s' created no data", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveProfile")
-		return
+	if refresh {
+		organization, err = s.GetOrganizationByName(organization.Name, true, tx)
+		if err != nil {
+			organization = nil
+			return
+		}
 	}
 	return
 }
 
-func (s *service) DeleteProfile(uuid string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("DeleteProfile: uuid:%s archive:%v missingFatal:%v tm:%v tx:%v", uuid, archive, missingFatal, tm, tx != nil))
+func (s *service) AddUniqueIdentity(inUniqueIdentity *models.UniqueIdentityDataOutput, refresh bool, tx *sql.Tx) (uniqueIdentity *models.UniqueIdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddUniqueIdentity: inUniqueIdentity:%+v refresh:%v tx:%v", s.ToLocalUniqueIdentity(inUniqueIdentity), refresh, tx != nil))
+	uniqueIdentity = inUniqueIdentity
 	defer func() {
-		log.Info(fmt.Sprintf("DeleteProfile(exit): uuid:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", uuid, archive, missingFatal, tm, tx != nil, err))
+		log.Info(
+			fmt.Sprintf(
+				"AddUniqueIdentity(exit): inUniqueIdentity:%+v refresh:%v tx:%v uniqueIdentity:%+v err:%v",
+				s.ToLocalUniqueIdentity(inUniqueIdentity),
+				refresh,
+				tx != nil,
+				s.ToLocalUniqueIdentity(uniqueIdentity),
+				err,
+			),
+		)
 	}()
-	if archive {
-		err = s.ArchiveProfile(uuid, tm, tx)
+	uniqueIdentity.UUID = strings.TrimSpace(uniqueIdentity.UUID)
+	if uniqueIdentity.LastModified == nil {
+		uniqueIdentity.LastModified, err = s.DBDateTime()
 		if err != nil {
-			return
+			return nil, err
 		}
 	}
-	del := "delete from profiles where uuid = ? and (locked_by is null or trim(locked_by) = '')"
 	// s.SetOrigin()
-	res, err := s.Exec(s.db, tx, del, uuid)
-	if err != nil {
-		return
-	}
-	affected, err := res.RowsAffected()
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"insert into uidentities(uuid, last_modified, last_modified_by) select ?, str_to_date(?, ?), ?",
+		uniqueIdentity.UUID,
+		uniqueIdentity.LastModified,
+		DateTimeFormat,
+		s.lfid,
+	)
 	if err != nil {
+		uniqueIdentity = nil
 		return
 	}
-	if missingFatal && affected == 0 {
-		err = fmt.Errorf("deleting profile uuid '%s' had no effect", uuid)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteProfile")
-		return
+	if refresh {
+		uniqueIdentity, err = s.GetUniqueIdentity(uniqueIdentity.UUID, true, tx)
+		if err != nil {
+			uniqueIdentity = nil
+			return
+		}
 	}
 	return
 }
 
-func (s *service) ValidateProfile(profileData *models.ProfileDataOutput, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("ValidateProfile: profileData:%+v tx:%v", profileData, tx != nil))
+func (s *service) FindUniqueIdentityOrganizations(uuid string, missingFatal bool, tx *sql.Tx) (organizations []*models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindUniqueIdentityOrganizations: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ValidateProfile(exit): profileData:%+v tx:%v err:%v", profileData, tx != nil, err))
+		log.Info(
+			fmt.Sprintf(
+				"FindUniqueIdentityOrganizations(exit): uuid:%s missingFatal:%v tx:%v organizations:%+v err:%v",
+				uuid,
+				missingFatal,
+				tx != nil,
+				s.ToLocalOrganizations(organizations),
+				err,
+			),
+		)
 	}()
-	if profileData.UUID == "" {
-		err = fmt.Errorf("profile '%+v' uuid is empty", s.ToLocalProfile(profileData))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
-		profileData = nil
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	if profileData.IsBot != nil && (*profileData.IsBot != 0 && *profileData.IsBot != 1) {
-		err = fmt.Errorf("profile '%+v' is_bot should be '0' or '1'", s.ToLocalProfile(profileData))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
+	sel := "select distinct o.id, o.name from organizations o, enrollments e where e.organization_id = o.id and e.uuid = ? order by o.name asc"
+	rows, err := s.Query(sdb, tx, sel, uuid)
+	if err != nil {
 		return
 	}
-	if profileData.CountryCode != nil && *profileData.CountryCode != "" {
-		_, err = s.GetCountry(*profileData.CountryCode, tx)
+	for rows.Next() {
+		organizationData := &models.OrganizationDataOutput{}
+		err = rows.Scan(
+			&organizationData.ID,
+			&organizationData.Name,
+		)
 		if err != nil {
 			return
 		}
+		organizations = append(organizations, organizationData)
 	}
-	/*
-		if profileData.Gender != nil {
-			if *profileData.Gender != "male" && *profileData.Gender != "female" {
-				err = fmt.Errorf("profile '%+v' gender should be 'male' or 'female'", s.ToLocalProfile(profileData))
-				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
-				return
-			}
-			if profileData.GenderAcc != nil && (*profileData.GenderAcc < 1 || *profileData.GenderAcc > 100) {
-				err = fmt.Errorf("profile '%+v' gender_acc should be within [1, 100]", s.ToLocalProfile(profileData))
-				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
-				return
-			}
-		}
-		if profileData.Gender == nil && profileData.GenderAcc != nil {
-			err = fmt.Errorf("profile '%+v' gender_acc can only be set when gender is given", s.ToLocalProfile(profileData))
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
-			return
-		}
-	*/
-	return
-}
-
-func (s *service) ValidateOrganization(organizationData *models.OrganizationDataOutput, forUpdate bool) (err error) {
-	log.Info(fmt.Sprintf("ValidateOrganization: organizationData:%+v forUpdate:%v", organizationData, forUpdate))
-	defer func() {
-		log.Info(fmt.Sprintf("ValidateOrganization(exit): organizationData:%+v forUpdate:%v err:%v", organizationData, forUpdate, err))
-	}()
-	if forUpdate && organizationData.ID < 1 {
-		err = fmt.Errorf("organization '%+v' missing id", organizationData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateOrganization")
+	err = rows.Err()
+	if err != nil {
 		return
 	}
-	if organizationData.Name == "" {
-		err = fmt.Errorf("organization '%+v' missing name", organizationData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateOrganization")
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && len(organizations) == 0 {
+		err = fmt.Errorf("cannot find organizations for uuid %s", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindUniqueIdenityOrganizations")
 		return
 	}
 	return
 }
 
-func (s *service) ValidateEnrollment(enrollmentData *models.EnrollmentDataOutput, forUpdate bool) (err error) {
-	log.Info(fmt.Sprintf("ValidateEnrollment: enrollmentData:%+v forUpdate:%v", enrollmentData, forUpdate))
+func (s *service) FindProfiles(columns []string, values []interface{}, missingFatal bool, tx *sql.Tx) (profiles []*models.ProfileDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindProfiles: columns:%+v values:%+v missingFatal:%v tx:%v", columns, values, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ValidateEnrollment(exit): enrollmentData:%+v forUpdate:%v err:%v", enrollmentData, forUpdate, err))
+		log.Info(
+			fmt.Sprintf(
+				"FindProfiles(exit): columns:%+v values:%+v missingFatal:%v tx:%v profiles:%+v err:%v",
+				columns,
+				values,
+				missingFatal,
+				tx != nil,
+				s.ToLocalProfiles(profiles),
+				err,
+			),
+		)
 	}()
-	if enrollmentData.Role == "" {
-		enrollmentData.Role = shared.DefaultRole
-	}
-	correctRole := false
-	for _, role := range shared.Roles {
-		if enrollmentData.Role == role {
-			correctRole = true
-			break
-		}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	if !correctRole {
-		err = fmt.Errorf("enrollment '%+v' incorrect role, allowed: %+v", enrollmentData, shared.Roles)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
-		return
+	// sel := "select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles"
+	sel := "select uuid, name, email, is_bot, country_code from profiles"
+	nColumns := len(columns)
+	lastIndex := nColumns - 1
+	if nColumns > 0 {
+		sel += " where"
 	}
-	if forUpdate && enrollmentData.ID < 1 {
-		err = fmt.Errorf("enrollment '%+v' missing id", enrollmentData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
-		return
+	for index := range columns {
+		column := columns[index]
+		sel += " " + column + " = ?"
+		if index < lastIndex {
+			sel += " and"
+		}
 	}
-	if enrollmentData.ProjectSlug != nil && *(enrollmentData.ProjectSlug) == "" {
-		err = fmt.Errorf("enrollment '%+v' project_slug must be null or non-empty string", enrollmentData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+	sel += " order by uuid asc"
+	rows, err := s.Query(sdb, tx, sel, values...)
+	if err != nil {
 		return
 	}
-	if enrollmentData.UUID == "" || enrollmentData.OrganizationID < 1 {
-		err = fmt.Errorf("enrollment '%+v' missing uuid or organization_id", enrollmentData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
-		return
+	for rows.Next() {
+		profileData := &models.ProfileDataOutput{}
+		err = rows.Scan(
+			&profileData.UUID,
+			&profileData.Name,
+			&profileData.Email,
+			//&profileData.Gender,
+			//&profileData.GenderAcc,
+			&profileData.IsBot,
+			&profileData.CountryCode,
+		)
+		if err != nil {
+			return
+		}
+		profiles = append(profiles, profileData)
 	}
-	if time.Time(enrollmentData.Start).Before(shared.MinPeriodDate) || time.Time(enrollmentData.Start).After(shared.MaxPeriodDate) {
-		err = fmt.Errorf("enrollment '%+v' start date must be between %v and %v", enrollmentData, shared.MinPeriodDate, shared.MaxPeriodDate)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+	err = rows.Err()
+	if err != nil {
 		return
 	}
-	if time.Time(enrollmentData.End).Before(shared.MinPeriodDate) || time.Time(enrollmentData.End).After(shared.MaxPeriodDate) {
-		err = fmt.Errorf("enrollment '%+v' end date must be between %v and %v", enrollmentData, shared.MinPeriodDate, shared.MaxPeriodDate)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+	err = rows.Close()
+	if err != nil {
 		return
 	}
-	if time.Time(enrollmentData.End).Before(time.Time(enrollmentData.Start)) {
-		err = fmt.Errorf("enrollment '%+v' end date must be after start date", enrollmentData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+	if missingFatal && len(profiles) == 0 {
+		err = fmt.Errorf("cannot find profiles for %+v/%+v", columns, values)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindProfiles")
 		return
 	}
 	return
 }
 
-func (s *service) ValidateIdentity(identityData *models.IdentityDataOutput, forUpdate bool) (err error) {
-	log.Info(fmt.Sprintf("ValidateIdentity: identityData:%+v forUpdate:%v", s.ToLocalIdentity(identityData), forUpdate))
+func (s *service) FindOrganizations(columns []string, values []interface{}, missingFatal bool, tx *sql.Tx) (organizations []*models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindOrganizations: columns:%+v values:%+v missingFatal:%v tx:%v", columns, values, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ValidateIdentity(exit): identityData:%+v forUpdate:%v err:%v", s.ToLocalIdentity(identityData), forUpdate, err))
+		log.Info(
+			fmt.Sprintf(
+				"FindOrganizations(exit): columns:%+v values:%+v missingFatal:%v tx:%v organizations:%+v err:%v",
+				columns,
+				values,
+				missingFatal,
+				tx != nil,
+				s.ToLocalOrganizations(organizations),
+				err,
+			),
+		)
 	}()
-	if forUpdate && identityData.ID == "" {
-		err = fmt.Errorf("identity '%+v' missing id", s.ToLocalIdentity(identityData))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	if !forUpdate {
-		if identityData.Source == "" {
-			err = fmt.Errorf("identity '%+v' missing source", s.ToLocalIdentity(identityData))
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
-			return
+	sel := "select id, name from organizations"
+	nColumns := len(columns)
+	lastIndex := nColumns - 1
+	if nColumns > 0 {
+		sel += " where"
+	}
+	for index := range columns {
+		column := columns[index]
+		sel += " " + column + " = ?"
+		if index < lastIndex {
+			sel += " and"
 		}
-		if (identityData.Name == nil || (identityData.Name != nil && *(identityData.Name) == "")) &&
-			(identityData.Email == nil || (identityData.Email != nil && *(identityData.Email) == "")) &&
-			(identityData.Username == nil || (identityData.Username != nil && *(identityData.Username) == "")) {
-			err = fmt.Errorf("identity '%+v' you need to set at least one of (name, email, username)", s.ToLocalIdentity(identityData))
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
+	}
+	sel += " order by name asc"
+	rows, err := s.Query(sdb, tx, sel, values...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		organizationData := &models.OrganizationDataOutput{}
+		err = rows.Scan(
+			&organizationData.ID,
+			&organizationData.Name,
+		)
+		if err != nil {
 			return
 		}
+		organizations = append(organizations, organizationData)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && len(organizations) == 0 {
+		err = fmt.Errorf("cannot find organizations for %+v/%+v", columns, values)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindOrganizations")
 		return
 	}
 	return
 }
 
-func (s *service) ProfileUUIDHash(profile *models.ProfileDataOutput) (idHash string, err error) {
-	log.Info(fmt.Sprintf("ProfileUUIDHash: profile:%+v", s.ToLocalProfile(profile)))
+func (s *service) FindEnrollmentsNested(columns []string, values []interface{}, isDate []bool, missingFatal bool, projectSlugs []string, tx *sql.Tx) (enrollments []*models.EnrollmentNestedDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindEnrollmentsNested: columns:%+v values:%+v isDate:%+v missingFatal:%v projectSlugs:%v tx:%v", columns, values, isDate, missingFatal, projectSlugs, tx != nil))
+	// s.SetOrigin()
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"ProfileUUIDHash(exit): profile:%+v idHash:%s err:%v",
-				s.ToLocalProfile(profile),
-				idHash,
+				"FindEnrollmentsNested(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v projectSlugs:%+v tx:%v enrollments:%+v err:%v",
+				columns,
+				values,
+				isDate,
+				missingFatal,
+				projectSlugs,
+				tx != nil,
+				s.ToLocalNestedEnrollments(enrollments),
 				err,
 			),
 		)
 	}()
-	stripF := func(str string) string {
-		isOk := func(r rune) bool {
-			return r < 32 || r >= 127
-		}
-		t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-		str, _, _ = transform.String(t, str)
-		return str
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	name := ""
-	if profile.Name != nil {
-		name = *(profile.Name)
+	sel := "select e.id, e.uuid, e.start, e.end, e.project_slug, e.role, e.provenance, e.evidence_url, e.evidence_notes, e.confidence, o.id, o.name from enrollments e, organizations o where e.organization_id = o.id"
+	vals := []interface{}{}
+	nColumns := len(columns)
+	lastIndex := nColumns - 1
+	if nColumns > 0 {
+		sel += " and"
 	}
-	email := ""
-	if profile.Email != nil {
-		email = *(profile.Email)
+	for index := range columns {
+		column := columns[index]
+		value := values[index]
+		date := isDate[index]
+		isNil := false
+		if column == "e.project_slug" {
+			v, ok := value.(*string)
+			if ok {
+				isNil = v == nil
+			}
+		}
+		if isNil {
+			sel += " " + column + " is null"
+		} else {
+			if date {
+				sel += " " + column + " = str_to_date(?, ?)"
+				vals = append(vals, value)
+				vals = append(vals, DateTimeFormat)
+			} else {
+				sel += " " + column + " = ?"
+				vals = append(vals, value)
+			}
+		}
+		if index < lastIndex {
+			sel += " and"
+		}
 	}
-	/*
-		gender := ""
-		if profile.Gender != nil {
-			gender = *(profile.Gender)
+	if len(projectSlugs) > 0 {
+		sel += " and (e.project_slug is null or e.project_slug in ("
+		for _, projectSlug := range projectSlugs {
+			sel += "?,"
+			vals = append(vals, projectSlug)
 		}
-		genderAcc := ""
-		if profile.GenderAcc != nil {
-			genderAcc = fmt.Sprintf("%d", *(profile.GenderAcc))
+		sel = sel[0:len(sel)-1] + "))"
+	}
+	sel += " order by e.uuid asc, e.start asc, e.end asc"
+	rows, err := s.Query(sdb, tx, sel, vals...)
+	if err != nil {
+		return
+	}
+	oName := ""
+	for rows.Next() {
+		enrollmentData := &models.EnrollmentNestedDataOutput{}
+		err = rows.Scan(
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+			&enrollmentData.OrganizationID,
+			&oName,
+		)
+		if err != nil {
+			return
 		}
-	*/
-	isBot := ""
-	if profile.IsBot != nil {
-		isBot = fmt.Sprintf("%d", *(profile.IsBot))
+		enrollmentData.Organization = &models.OrganizationDataOutput{ID: enrollmentData.OrganizationID, Name: oName}
+		enrollments = append(enrollments, enrollmentData)
 	}
-	countryCode := ""
-	if profile.CountryCode != nil {
-		countryCode = *(profile.CountryCode)
+	err = rows.Err()
+	if err != nil {
+		return
 	}
-	//arg := stripF(name) + ":" + stripF(email) + ":" + stripF(gender) + ":" + genderAcc + ":" + isBot + ":" + stripF(countryCode)
-	arg := stripF(name) + ":" + stripF(email) + ":" + isBot + ":" + stripF(countryCode)
-	hash := sha1.New()
-	_, err = hash.Write([]byte(arg))
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	idHash = hex.EncodeToString(hash.Sum(nil))
-	return
-}
-
-// ToLowerAndNone takes a string if it is empty it is set to none
-// else it's contents are changed to the lower case
-func ToLowerAndNone(value string) string {
-	if value == "" {
-		return "none"
+	if missingFatal && len(enrollments) == 0 {
+		err = fmt.Errorf("cannot find enrollments for %+v/%+v (nested)", columns, values)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindOrganizationsNested")
+		return
 	}
-	return strings.ToLower(value)
+	return
 }
 
-func (s *service) IdentityIDHash(identity *models.IdentityDataOutput) (idHash string, err error) {
-	log.Info(fmt.Sprintf("IdentityIDHash: identity:%+v", s.ToLocalIdentity(identity)))
+func (s *service) FindEnrollments(columns []string, values []interface{}, isDate []bool, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindEnrollments: columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v", columns, values, isDate, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"IdentityIDHash(exit): identity:%+v idHash:%s err:%v",
-				s.ToLocalIdentity(identity),
-				idHash,
+				"FindEnrollments(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v enrollments:%+v err:%v",
+				columns,
+				values,
+				isDate,
+				missingFatal,
+				tx != nil,
+				s.ToLocalEnrollments(enrollments),
 				err,
 			),
 		)
 	}()
-	stripF := func(str string) string {
-		isOk := func(r rune) bool {
-			return r < 32 || r >= 127
-		}
-		t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
-		str, _, _ = transform.String(t, str)
-		return str
-	}
-	email := ""
-	if identity.Email != nil {
-		email = *(identity.Email)
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	name := ""
-	if identity.Name != nil {
-		name = *(identity.Name)
+	sel := "select id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence from enrollments"
+	vals := []interface{}{}
+	nColumns := len(columns)
+	lastIndex := nColumns - 1
+	if nColumns > 0 {
+		sel += " where"
 	}
-	username := ""
-	if identity.Username != nil {
-		username = *(identity.Username)
+	for index := range columns {
+		column := columns[index]
+		value := values[index]
+		date := isDate[index]
+		isNil := false
+		if column == "project_slug" {
+			v, ok := value.(*string)
+			if ok {
+				isNil = v == nil
+			}
+		}
+		if isNil {
+			sel += " " + column + " is null"
+		} else {
+			if date {
+				sel += " " + column + " = str_to_date(?, ?)"
+				vals = append(vals, value)
+				vals = append(vals, DateTimeFormat)
+			} else {
+				sel += " " + column + " = ?"
+				vals = append(vals, value)
+			}
+		}
+		if index < lastIndex {
+			sel += " and"
+		}
 	}
-	if identity.Source == "" {
-		err = fmt.Errorf("identity without source is not allowed")
+	sel += " order by uuid asc, start asc, end asc"
+	rows, err := s.Query(sdb, tx, sel, vals...)
+	if err != nil {
 		return
 	}
-	if email == "" && name == "" && username == "" {
-		err = fmt.Errorf("identity data(name, email, username) can not be empty")
+	for rows.Next() {
+		enrollmentData := &models.EnrollmentDataOutput{}
+		err = rows.Scan(
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.OrganizationID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+		)
+		if err != nil {
+			return
+		}
+		enrollments = append(enrollments, enrollmentData)
+	}
+	err = rows.Err()
+	if err != nil {
 		return
 	}
-	email = ToLowerAndNone(email)
-	name = ToLowerAndNone(name)
-	username = ToLowerAndNone(username)
-	arg := stripF(identity.Source) + ":" + stripF(email) + ":" + stripF(name) + ":" + stripF(username)
-	hash := sha1.New()
-	_, err = hash.Write([]byte(arg))
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	idHash = hex.EncodeToString(hash.Sum(nil))
+	if missingFatal && len(enrollments) == 0 {
+		err = fmt.Errorf("cannot find enrollments for %+v/%+v", columns, values)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindEnrollments")
+		return
+	}
 	return
 }
 
-func (s *service) AddIdentities(identities []*models.IdentityDataOutput) (status string, err error) {
-	for i, identity := range identities {
-		err = s.ValidateIdentity(identity, false)
+func (s *service) GetArchiveUniqueIdentityIdentities(uuid string, tm time.Time, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetArchiveUniqueIdentityIdentities: uuid:%s tm:%v missingFatal:%v tx:%v", uuid, tm, missingFatal, tx != nil))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetArchiveUniqueIdentityIdentities(exit): uuid:%s tm:%v missingFatal:%v tx:%v identities:%+v err:%v",
+				uuid,
+				tm,
+				missingFatal,
+				tx != nil,
+				s.ToLocalIdentities(identities),
+				err,
+			),
+		)
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, source, name, email, username from identities_archive where uuid = ? and archived_at = ? order by id asc",
+		uuid,
+		tm,
+	)
+	if err != nil {
+		return
+	}
+	now := s.Now()
+	for rows.Next() {
+		identityData := &models.IdentityDataOutput{}
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Email,
+			&identityData.Username,
+		)
 		if err != nil {
-			err = errs.Wrap(err, fmt.Sprintf("validate #%d identity: %v", i, s.ToLocalIdentity(identity)))
 			return
 		}
-		id := identity.ID
-		if id == "" {
-			id, err = s.IdentityIDHash(identity)
-			if err != nil {
-				err = errs.Wrap(err, fmt.Sprintf("generate id for #%d identity: %v", i, s.ToLocalIdentity(identity)))
-				return
-			}
-			identity.ID = id
-			log.Info(fmt.Sprintf("auto generated '%s' id for %v", id, s.ToLocalIdentity(identity)))
-		}
-		uuid := identity.UUID
-		if uuid == nil || (uuid != nil && *uuid == "") {
-			identity.UUID = &identity.ID
-		}
+		identityData.LastModified = now
+		identities = append(identities, identityData)
 	}
-	bulkSize := 166
-	nIdents := len(identities)
-	emailsCache := map[string]string{}
-	emailReplacer := strings.NewReplacer(" at ", "@", " AT ", "@", " At ", "@", " dot ", ".", " DOT ", ".", " Dot ", ".", "<", "", ">", "", "`", "")
-	isValidDomain := func(domain string) (valid bool) {
-		l := len(domain)
-		if l < 4 && l > 254 {
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && len(identities) == 0 {
+		err = fmt.Errorf("cannot find archived identities for uuid '%s'/%v", uuid, tm)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetArchiveUniqueIdentityIdentities")
+		return
+	}
+	return
+}
+
+func (s *service) GetArchiveUniqueIdentityEnrollments(uuid string, tm time.Time, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetArchiveUniqueIdentityEnrollments: uuid:%s tm:%v missingFatal:%v tx:%v", uuid, tm, missingFatal, tx != nil))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetArchiveUniqueIdentityEnrollments(exit): uuid:%s tm:%v missingFatal:%v tx:%v enrollments:%+v err:%v",
+				uuid,
+				tm,
+				missingFatal,
+				tx != nil,
+				s.ToLocalEnrollments(enrollments),
+				err,
+			),
+		)
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence from enrollments_archive where uuid = ? and archived_at = ? order by start asc, end asc",
+		uuid,
+		tm,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		enrollmentData := &models.EnrollmentDataOutput{}
+		err = rows.Scan(
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.OrganizationID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+		)
+		if err != nil {
 			return
 		}
-		dom, ok := emailsCache[domain]
-		valid = dom != ""
-		if ok {
-			// fmt.Printf("domain cache hit: '%s' -> %v\n", domain, valid)
+		enrollments = append(enrollments, enrollmentData)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && len(enrollments) == 0 {
+		err = fmt.Errorf("cannot find archive enrollments for uuid '%s'/%v", uuid, tm)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetArchiveUniqueIdentityEnrollments")
+		return
+	}
+	return
+}
+
+// GetUniqueIdentityNestedAsOf - reconstructs given uuid's profile, identities and enrollments as they were at asOf
+// Profile and identities are taken from the first full profile snapshot archived after asOf (uidentities_archive, saved by merges,
+// deletes and bulk updates) or from current rows if there is no such snapshot, then identities archived one by one (deleted) after asOf
+// and before that snapshot are added back. Enrollments are reconstructed version by version, see AsOfEnrollments.
+// If projectSlugs are given, only global enrollments and enrollments of those projects are returned
+func (s *service) GetUniqueIdentityNestedAsOf(uuid string, asOf time.Time, projectSlugs []string, missingFatal bool, tx *sql.Tx) (uid *models.UniqueIdentityNestedDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetUniqueIdentityNestedAsOf: uuid:%s asOf:%v projectSlugs:%+v missingFatal:%v tx:%v", uuid, asOf, projectSlugs, missingFatal, tx != nil))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"GetUniqueIdentityNestedAsOf(exit): uuid:%s asOf:%v projectSlugs:%+v missingFatal:%v tx:%v uid:%+v err:%v",
+				uuid,
+				asOf,
+				projectSlugs,
+				missingFatal,
+				tx != nil,
+				s.ToLocalNestedUniqueIdentity(uid),
+				err,
+			),
+		)
+	}()
+	// Without enrollment history added and edited enrollments cannot be reverted, so the result would be unreliable
+	if !shared.GEnrollmentHistory {
+		err = fmt.Errorf("as_of is only supported when enrollment history is enabled (ENROLLMENT_HISTORY, sql/add_enrollment_timestamps.sql)")
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentityNestedAsOf")
+		return
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(sdb, tx, "select min(archived_at) from uidentities_archive where uuid = ? and archived_at > ?", uuid, asOf)
+	if err != nil {
+		return
+	}
+	var snapshot *time.Time
+	for rows.Next() {
+		err = rows.Scan(&snapshot)
+		if err != nil {
 			return
 		}
-		defer func() {
-			var dom string
-			if valid {
-				dom = domain
-			}
-			emailsCache[domain] = dom
-		}()
-		for i := 0; i < 10; i++ {
-			mx, err := net.LookupMX(domain)
-			if err == nil && len(mx) > 0 {
-				valid = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	var (
+		profile    *models.ProfileDataOutput
+		identities []*models.IdentityDataOutput
+	)
+	if snapshot != nil {
+		profile, err = s.getArchiveProfile(uuid, *snapshot, tx)
+		if err != nil {
+			return
+		}
+		identities, err = s.GetArchiveUniqueIdentityIdentities(uuid, *snapshot, false, tx)
+		if err != nil {
+			return
+		}
+	} else {
+		var uniqueIdentity *models.UniqueIdentityDataOutput
+		uniqueIdentity, err = s.GetUniqueIdentity(uuid, false, tx)
+		if err != nil {
+			return
+		}
+		if uniqueIdentity != nil {
+			profile, err = s.GetProfile(uuid, false, tx)
+			if err != nil {
 				return
 			}
-		}
-		for i := 1; i <= 3; i++ {
-			mx, err := net.LookupMX(domain)
-			if err == nil && len(mx) > 0 {
-				valid = true
+			identities, err = s.GetUniqueIdentityIdentities(uuid, false, tx)
+			if err != nil {
 				return
 			}
-			time.Sleep(time.Duration(i) * time.Second)
 		}
+	}
+	var archivedIdentities []*models.IdentityDataOutput
+	archivedIdentities, err = s.getArchivedIdentitiesBetween(uuid, asOf, snapshot, tx)
+	if err != nil {
 		return
 	}
-	isValidEmail := func(email string, validateDomain, guess bool) (valid bool, newEmail string) {
-		l := len(email)
-		if l < 6 && l > 254 {
-			return
+	identities = s.MergeAsOfIdentities(identities, archivedIdentities)
+	versions, err := s.getAsOfEnrollmentVersions(uuid, asOf, tx)
+	if err != nil {
+		return
+	}
+	enrollments := s.AsOfEnrollments(uuid, asOf, versions)
+	if profile == nil && len(identities) == 0 && len(enrollments) == 0 {
+		if missingFatal {
+			err = errs.Wrap(errs.New(fmt.Errorf("cannot find profile uuid '%s' as of %v", uuid, asOf), errs.ErrNotFound), "GetUniqueIdentityNestedAsOf")
 		}
-		nEmail, ok := emailsCache[email]
-		if ok {
-			newEmail = nEmail
-			valid = newEmail != ""
+		return
+	}
+	orgNames := make(map[int64]string)
+	for _, enrollment := range enrollments {
+		orgNames[enrollment.OrganizationID] = ""
+	}
+	if len(orgNames) > 0 {
+		sel := "select id, name from organizations where id in ("
+		args := []interface{}{}
+		for orgID := range orgNames {
+			sel += "?,"
+			args = append(args, orgID)
+		}
+		sel = sel[0:len(sel)-1] + ")"
+		rows, err = s.Query(sdb, tx, sel, args...)
+		if err != nil {
 			return
 		}
-		defer func() {
-			emailsCache[email] = newEmail
-		}()
-		if guess {
-			email = shared.WhiteSpace.ReplaceAllString(email, " ")
-			email = strings.TrimSpace(emailReplacer.Replace(email))
-			email = strings.Split(email, " ")[0]
+		var (
+			orgID   int64
+			orgName string
+		)
+		for rows.Next() {
+			err = rows.Scan(&orgID, &orgName)
+			if err != nil {
+				return
+			}
+			orgNames[orgID] = orgName
 		}
-		if !shared.EmailRegex.MatchString(email) {
+		err = rows.Err()
+		if err != nil {
 			return
 		}
-		if validateDomain {
-			parts := strings.Split(email, "@")
-			if len(parts) <= 1 || !isValidDomain(parts[1]) {
-				return
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	projects := make(map[string]struct{})
+	for _, projectSlug := range projectSlugs {
+		projects[projectSlug] = struct{}{}
+	}
+	uid = &models.UniqueIdentityNestedDataOutput{
+		UUID:        uuid,
+		Profile:     profile,
+		Identities:  identities,
+		Enrollments: []*models.EnrollmentNestedDataOutput{},
+	}
+	for _, enrollment := range enrollments {
+		if len(projects) > 0 && enrollment.ProjectSlug != nil {
+			_, ok := projects[*enrollment.ProjectSlug]
+			if !ok {
+				continue
 			}
 		}
-		newEmail = email
-		valid = true
+		uid.Enrollments = append(
+			uid.Enrollments,
+			&models.EnrollmentNestedDataOutput{
+				ID:             enrollment.ID,
+				UUID:           enrollment.UUID,
+				Start:          enrollment.Start,
+				End:            enrollment.End,
+				ProjectSlug:    enrollment.ProjectSlug,
+				Role:           enrollment.Role,
+				Provenance:     enrollment.Provenance,
+				EvidenceURL:    enrollment.EvidenceURL,
+				EvidenceNotes:  enrollment.EvidenceNotes,
+				Confidence:     enrollment.Confidence,
+				OrganizationID: enrollment.OrganizationID,
+				Organization:   &models.OrganizationDataOutput{ID: enrollment.OrganizationID, Name: orgNames[enrollment.OrganizationID]},
+			},
+		)
+	}
+	return
+}
+
+// MergeAsOfIdentities - adds identities archived after some point in time (and not present in base) back to base identities
+// archived must be sorted by archived_at, so the earliest archived copy of each identity is used; result is sorted by id
+func (s *service) MergeAsOfIdentities(base, archived []*models.IdentityDataOutput) (identities []*models.IdentityDataOutput) {
+	seen := make(map[string]struct{})
+	for _, identity := range base {
+		seen[identity.ID] = struct{}{}
+		identities = append(identities, identity)
+	}
+	for _, identity := range archived {
+		_, ok := seen[identity.ID]
+		if ok {
+			continue
+		}
+		seen[identity.ID] = struct{}{}
+		identities = append(identities, identity)
+	}
+	sort.SliceStable(identities, func(i, j int) bool {
+		return identities[i].ID < identities[j].ID
+	})
+	return
+}
+
+// AsOfEnrollments - returns given uuid's enrollments as they were at asOf, from enrollments versions (see getAsOfEnrollmentVersions)
+// With enrollment history enabled every enrollment edit, delete or move archives its previous version first, so the version valid at asOf is the earliest one archived
+// after asOf, or the current one if there is no such archived version. That version is used only if it belonged to uuid and was already
+// created at asOf (unknown creation time means it was created before it was tracked). Result is sorted by start, end
+func (s *service) AsOfEnrollments(uuid string, asOf time.Time, versions []*shared.AsOfEnrollment) (enrollments []*models.EnrollmentDataOutput) {
+	valid := make(map[int64]*shared.AsOfEnrollment)
+	ids := []int64{}
+	for _, version := range versions {
+		if version.ArchivedAt != nil && !version.ArchivedAt.After(asOf) {
+			continue
+		}
+		current, ok := valid[version.ID]
+		if !ok {
+			ids = append(ids, version.ID)
+		}
+		if !ok || current.ArchivedAt == nil || (version.ArchivedAt != nil && version.ArchivedAt.Before(*current.ArchivedAt)) {
+			valid[version.ID] = version
+		}
+	}
+	for _, id := range ids {
+		version := valid[id]
+		if version.UUID != uuid || (version.CreatedAt != nil && version.CreatedAt.After(asOf)) {
+			continue
+		}
+		enrollments = append(enrollments, version.EnrollmentDataOutput)
+	}
+	sort.SliceStable(enrollments, func(i, j int) bool {
+		si, sj := time.Time(enrollments[i].Start), time.Time(enrollments[j].Start)
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		return time.Time(enrollments[i].End).Before(time.Time(enrollments[j].End))
+	})
+	return
+}
+
+// getArchiveProfile - returns given uuid's profile archived at tm (nil if there is none)
+func (s *service) getArchiveProfile(uuid string, tm time.Time, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(sdb, tx, "select uuid, name, email, is_bot, country_code from profiles_archive where uuid = ? and archived_at = ? limit 1", uuid, tm)
+	if err != nil {
 		return
 	}
-	run := func() (err error) {
-		tx, err := s.db.Begin()
+	for rows.Next() {
+		profileData = &models.ProfileDataOutput{}
+		err = rows.Scan(
+			&profileData.UUID,
+			&profileData.Name,
+			&profileData.Email,
+			&profileData.IsBot,
+			&profileData.CountryCode,
+		)
 		if err != nil {
 			return
 		}
-		runOneByOne := func() (err error) {
-			log.Warn(fmt.Sprintf("Bulk add identities: falling back to one-by-one mode for %d items\n", nIdents))
-			var (
-				er  error
-				ers []error
-			)
-			defer func() {
-				nErrs := len(ers)
-				if nErrs == 0 {
-					msg := fmt.Sprintf("Bulk add identities: one-by-one mode for %d items - all succeeded", nIdents)
-					log.Warn(msg)
-					status += msg + "\n"
-					return
-				}
-				s := fmt.Sprintf("%d errors: ", nErrs)
-				for _, er := range ers {
-					s += er.Error() + ", "
-				}
-				s = s[:len(s)-2]
-				err = fmt.Errorf("%s", s)
-				msg := fmt.Sprintf("Bulk add identities: one-by-one mode for %d items: %d errors: %v", nIdents, nErrs, err)
-				log.Warn(msg)
-				status += msg + "\n"
-			}()
-			for i := 0; i < nIdents; i++ {
-				ident := identities[i]
-				queryU := "insert ignore into uidentities(uuid,last_modified,last_modified_by) values"
-				queryI := "insert ignore into identities(id,source,name,email,username,uuid,last_modified,last_modified_by) values"
-				queryP := "insert ignore into profiles(uuid,name,email,last_modified_by) values"
-				argsU := []interface{}{}
-				argsI := []interface{}{}
-				argsP := []interface{}{}
-				id := ident.ID
-				uuid := ident.UUID
-				source := ident.Source
-				name := ident.Name
-				username := ident.Username
-				email := ident.Email
-				if name == nil && email == nil && username == nil {
-					continue
-				}
-				profname := name
-				if email != nil {
-					_, semail := isValidEmail(*email, true, true)
-					email = &semail
-				}
-				if profname == nil && username != nil {
-					profname = username
-				}
-				// if username matches a real email and there is no email set, assume email=username
-				if email == nil && username != nil {
-					valid, em := isValidEmail(*username, true, true)
-					if valid {
-						email = &em
-					}
-				}
-				// if name matches a real email and there is no email set, assume email=name
-				if email == nil && name != nil {
-					valid, em := isValidEmail(*name, true, true)
-					if valid {
-						email = &em
-					}
-				}
-				queryU += fmt.Sprintf("(?,now(),?)")
-				queryI += fmt.Sprintf("(?,?,?,?,?,?,now(),?)")
-				queryP += fmt.Sprintf("(?,?,?,?)")
-				argsU = append(argsU, uuid, s.lfid)
-				argsI = append(argsI, id, source, name, email, username, uuid, s.lfid)
-				argsP = append(argsP, uuid, profname, email, s.lfid)
-				itx, e := s.db.Begin()
-				if e != nil {
-					err = e
-					return
-				}
-				_, er = s.Exec(s.db, itx, queryU, argsU...)
-				if er != nil {
-					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
-					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryU, argsU, er))
-					_ = itx.Rollback()
-					ers = append(ers, er)
-					continue
-				}
-				_, er = s.Exec(s.db, itx, queryP, argsP...)
-				if er != nil {
-					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
-					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryP, argsP, er))
-					_ = itx.Rollback()
-					ers = append(ers, er)
-					continue
-				}
-				_, er = s.Exec(s.db, itx, queryI, argsI...)
-				if er != nil {
-					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
-					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryI, argsI, er))
-					_ = itx.Rollback()
-					ers = append(ers, er)
-					continue
-				}
-				err = itx.Commit()
-				if err != nil {
-					return
-				}
-				itx = nil
-			}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// getArchivedIdentitiesBetween - returns given uuid's identities archived after from (and before to if set), oldest archive first
+func (s *service) getArchivedIdentitiesBetween(uuid string, from time.Time, to *time.Time, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	sel := "select id, uuid, source, name, email, username from identities_archive where uuid = ? and archived_at > ?"
+	args := []interface{}{uuid, from}
+	if to != nil {
+		sel += " and archived_at < ?"
+		args = append(args, *to)
+	}
+	sel += " order by archived_at asc, id asc"
+	rows, err := s.Query(sdb, tx, sel, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		identityData := &models.IdentityDataOutput{}
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Email,
+			&identityData.Username,
+		)
+		if err != nil {
 			return
 		}
-		defer func() {
-			if tx != nil {
-				msg := fmt.Sprintf("Bulk insert identities failed, rolling back %d identities insert", nIdents)
-				log.Warn(msg)
-				status += msg + "\n"
-				tx.Rollback()
-				err = runOneByOne()
-			}
-		}()
-		nPacks := nIdents / bulkSize
-		if nIdents%bulkSize != 0 {
-			nPacks++
-		}
-		for i := 0; i < nPacks; i++ {
-			from := i * bulkSize
-			to := from + bulkSize
-			if to > nIdents {
-				to = nIdents
-			}
-			queryU := "insert ignore into uidentities(uuid,last_modified,last_modified_by) values"
-			queryI := "insert ignore into identities(id,source,name,email,username,uuid,last_modified,last_modified_by) values"
-			queryP := "insert ignore into profiles(uuid,name,email,last_modified_by) values"
-			argsU := []interface{}{}
-			argsI := []interface{}{}
-			argsP := []interface{}{}
-			for j := from; j < to; j++ {
-				ident := identities[j]
-				id := ident.ID
-				uuid := ident.UUID
-				source := ident.Source
-				name := ident.Name
-				username := ident.Username
-				email := ident.Email
-				if name == nil && email == nil && username == nil {
-					continue
-				}
-				profname := name
-				if profname == nil && username != nil {
-					profname = username
-				}
-				if email != nil {
-					_, semail := isValidEmail(*email, true, true)
-					email = &semail
-				}
-				// if username matches a real email and there is no email set, assume email=username
-				//if email == nil && username != nil && isValidEmail(*username) {
-				if email == nil && username != nil {
-					valid, em := isValidEmail(*username, true, true)
-					if valid {
-						email = &em
-					}
-				}
-				// if name matches a real email and there is no email set, assume email=name
-				//if email == nil && name != nil && isValidEmail(*name) {
-				if email == nil && name != nil {
-					valid, em := isValidEmail(*name, true, true)
-					if valid {
-						email = &em
-					}
-				}
-				queryU += fmt.Sprintf("(?,now(),?),")
-				queryI += fmt.Sprintf("(?,?,?,?,?,?,now(),?),")
-				queryP += fmt.Sprintf("(?,?,?,?),")
-				argsU = append(argsU, uuid, s.lfid)
-				argsI = append(argsI, id, source, name, email, username, uuid, s.lfid)
-				argsP = append(argsP, uuid, profname, email, s.lfid)
-			}
-			queryU = queryU[:len(queryU)-1]
-			queryI = queryI[:len(queryI)-1]
-			queryP = queryP[:len(queryP)-1]
-			_, err = s.Exec(s.db, tx, queryU, argsU...)
-			if err != nil {
-				return
-			}
-			_, err = s.Exec(s.db, tx, queryP, argsP...)
-			if err != nil {
-				return
-			}
-			_, err = s.Exec(s.db, tx, queryI, argsI...)
-			if err != nil {
-				return
-			}
-		}
-		// Will not commit in dry-run mode, deferred function will rollback - so we can still test any errors
-		// but the final commit is replaced with rollback
-		err = tx.Commit()
+		identities = append(identities, identityData)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// getAsOfEnrollmentVersions - returns given uuid's current enrollments and all versions archived after asOf of enrollments
+// that are or were given uuid's (including versions archived when they belonged to other uuids), see AsOfEnrollments
+func (s *service) getAsOfEnrollmentVersions(uuid string, asOf time.Time, tx *sql.Tx) (versions []*shared.AsOfEnrollment, err error) {
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	cols := "id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence, created_at"
+	sel := "select null, " + cols + " from enrollments where uuid = ? union all " +
+		"select archived_at, " + cols + " from enrollments_archive where archived_at > ? and id in (" +
+		"select id from enrollments where uuid = ? union select id from enrollments_archive where uuid = ? and archived_at > ?)"
+	rows, err := s.Query(sdb, tx, sel, uuid, asOf, uuid, uuid, asOf)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		version := &shared.AsOfEnrollment{EnrollmentDataOutput: &models.EnrollmentDataOutput{}}
+		err = rows.Scan(
+			&version.ArchivedAt,
+			&version.ID,
+			&version.UUID,
+			&version.OrganizationID,
+			&version.Start,
+			&version.End,
+			&version.ProjectSlug,
+			&version.Role,
+			&version.Provenance,
+			&version.EvidenceURL,
+			&version.EvidenceNotes,
+			&version.Confidence,
+			&version.CreatedAt,
+		)
 		if err != nil {
 			return
 		}
-		tx = nil
-		return
+		versions = append(versions, version)
 	}
-	err = run()
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	status += fmt.Sprintf("Bulk added %d identities\n", nIdents)
+	err = rows.Close()
 	return
 }
 
-func (s *service) AddNestedIdentity(identity *models.IdentityDataOutput) (uid *models.UniqueIdentityNestedDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddNestedIdentity: identity:%+v", s.ToLocalIdentity(identity)))
-	// s.SetOrigin()
-	uid = &models.UniqueIdentityNestedDataOutput{}
+func (s *service) GetUniqueIdentityIdentities(uuid string, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetUniqueIdentityIdentities: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"AddNestedIdentity(exit): identity:%+v uid:%+v err:%v",
-				s.ToLocalIdentity(identity),
-				s.ToLocalNestedUniqueIdentity(uid),
+				"GetUniqueIdentityIdentities(exit): uuid:%s missingFatal:%v tx:%v identities:%+v err:%v",
+				uuid,
+				missingFatal,
+				tx != nil,
+				s.ToLocalIdentities(identities),
 				err,
 			),
 		)
 	}()
-	err = s.ValidateIdentity(identity, false)
-	if err != nil {
-		uid = nil
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	idHash := ""
-	idHash, err = s.IdentityIDHash(identity)
-	if err != nil {
-		uid = nil
-		return
-	}
-	email := ""
-	if identity.Email != nil {
-		email = *(identity.Email)
-	}
-	name := ""
-	if identity.Name != nil {
-		name = *(identity.Name)
-	}
-	username := ""
-	if identity.Username != nil {
-		username = *(identity.Username)
-	}
-	identity.ID = idHash
-	var identities []*models.IdentityDataOutput
-	identities, err = s.FindIdentities(
-		[]string{"source", "email", "name", "username"},
-		[]interface{}{identity.Source, identity.Email, identity.Name, identity.Username},
-		[]bool{false, false, false, false},
-		false,
-		nil,
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, source, name, email, username, last_modified from identities where uuid = ? order by id asc",
+		uuid,
 	)
-	if err != nil {
-		uid = nil
-		return
-	}
-	if len(identities) > 0 {
-		err = fmt.Errorf("Identity (source, email, name, username) = (%s, %s, %s, %s) already exists", identity.Source, email, name, username)
-		err = errs.Wrap(errs.New(err, errs.ErrConflict), "AddNestedIdentity")
-		uid = nil
-		return
-	}
-	tx, err := s.db.Begin()
 	if err != nil {
 		return
 	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
-	}()
-	profile := &models.ProfileDataOutput{}
-	if identity.UUID != nil {
-		_, err = s.GetUniqueIdentity(*(identity.UUID), true, nil)
-		if err != nil {
-			uid = nil
-			return
-		}
-		profile, err = s.GetProfile(*(identity.UUID), false, nil)
-		if err != nil {
-			uid = nil
-			return
-		}
-	} else {
-		_, err = s.AddUniqueIdentity(
-			&models.UniqueIdentityDataOutput{
-				UUID: identity.ID,
-			},
-			false,
-			tx,
-		)
-		if err != nil {
-			return
-		}
-		profile, err = s.AddProfile(
-			&models.ProfileDataOutput{
-				UUID:  identity.ID,
-				Name:  identity.Name,
-				Email: identity.Email,
-			},
-			false,
-			tx,
+	for rows.Next() {
+		identityData := &models.IdentityDataOutput{}
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Email,
+			&identityData.Username,
+			&identityData.LastModified,
 		)
 		if err != nil {
 			return
 		}
-		identity.UUID = &(identity.ID)
+		identities = append(identities, identityData)
 	}
-	_, err = s.AddIdentity(identity, false, false, tx)
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	err = tx.Commit()
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	uid.UUID = *identity.UUID
-	uid.LastModified = s.Now()
-	uid.Profile = profile
-	uid.Identities = append(uid.Identities, identity)
-	tx = nil
+	if missingFatal && len(identities) == 0 {
+		err = fmt.Errorf("cannot find identities for uuid '%s'", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentityIdentities")
+		return
+	}
 	return
 }
 
-func (s *service) AddIdentity(inIdentityData *models.IdentityDataOutput, ignore, refresh bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddIdentity: inIdentityData:%+v ignore:%v refresh:%v tx:%v", s.ToLocalIdentity(inIdentityData), ignore, refresh, tx != nil))
-	identityData = inIdentityData
+func (s *service) GetUniqueIdentityEnrollments(uuid string, missingFatal bool, tx *sql.Tx) (enrollments []*models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetUniqueIdentityEnrollments: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"AddIdentity(exit): inIdentityData:%+v ignore:%v refresh:%v tx:%v identityData:%+v err:%v",
-				s.ToLocalIdentity(inIdentityData),
-				ignore,
-				refresh,
+				"GetUniqueIdentityEnrollments(exit): uuid:%s missingFatal:%v tx:%v enrollments:%+v err:%v",
+				uuid,
+				missingFatal,
 				tx != nil,
-				s.ToLocalIdentity(identityData),
+				s.ToLocalEnrollments(enrollments),
 				err,
 			),
 		)
 	}()
-	s.SanitizeIdentity(identityData)
-	if identityData.LastModified == nil {
-		identityData.LastModified = s.Now()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	err = s.ValidateIdentity(identityData, false)
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence from enrollments where uuid = ? order by start asc, end asc",
+		uuid,
+	)
 	if err != nil {
-		identityData = nil
 		return
 	}
-	root := "insert"
-	if ignore {
-		root += " ignore"
+	for rows.Next() {
+		enrollmentData := &models.EnrollmentDataOutput{}
+		err = rows.Scan(
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.OrganizationID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+		)
+		if err != nil {
+			return
+		}
+		enrollments = append(enrollments, enrollmentData)
 	}
-	insert := root + " into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) select ?, ?, ?, ?, ?, ?, str_to_date(?, ?), ?"
-	var res sql.Result
-	// s.SetOrigin()
-	res, err = s.Exec(
-		s.db,
-		tx,
-		insert,
-		identityData.ID,
-		identityData.UUID,
-		identityData.Source,
-		identityData.Name,
-		identityData.Email,
-		identityData.Username,
-		identityData.LastModified,
-		DateTimeFormat,
-		s.lfid,
-	)
+	err = rows.Err()
 	if err != nil {
-		identityData = nil
 		return
 	}
-	affected := int64(0)
-	affected, err = res.RowsAffected()
+	err = rows.Close()
 	if err != nil {
-		identityData = nil
 		return
 	}
-	if affected > 1 {
-		err = fmt.Errorf("identity '%+v' insert affected %d rows", s.ToLocalIdentity(identityData), affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
-		identityData = nil
+	if missingFatal && len(enrollments) == 0 {
+		err = fmt.Errorf("cannot find enrollments for uuid '%s'", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentityEnrollments")
 		return
-	} else if affected == 1 {
-		affected2 := int64(0)
-		// Mark identity's matching unique identity as modified
-		if identityData.UUID != nil {
-			affected2, err = s.TouchUniqueIdentity(*(identityData.UUID), tx)
-			if err != nil {
-				identityData = nil
-				return
-			}
-			if affected2 != 1 {
-				err = fmt.Errorf("identity '%+v' unique identity update affected %d rows", s.ToLocalIdentity(identityData), affected2)
-				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
-				identityData = nil
-				return
-			}
-		}
-	} else {
-		if !ignore {
-			err = fmt.Errorf("adding identity '%+v' didn't affected any rows", s.ToLocalIdentity(identityData))
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
-			identityData = nil
-			return
-		}
-	}
-	if refresh {
-		identityData, err = s.GetIdentity(identityData.ID, true, tx)
-		if err != nil {
-			identityData = nil
-			return
-		}
 	}
 	return
 }
 
-func (s *service) FindIdentities(columns []string, values []interface{}, isDate []bool, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("FindIdentities: columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v", columns, values, isDate, missingFatal, tx != nil))
+func (s *service) GetEnrollment(id int64, missingFatal bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetEnrollment: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"FindIdentities(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v identities:%+v err:%v",
-				columns,
-				values,
-				isDate,
+				"GetEnrollment(exit): id:%d missingFatal:%v tx:%v enrollmentData:%+v err:%v",
+				id,
 				missingFatal,
 				tx != nil,
-				s.ToLocalIdentities(identities),
+				enrollmentData,
 				err,
 			),
 		)
@@ -4359,58 +5862,92 @@ func (s *service) FindIdentities(columns []string, values []interface{}, isDate
 	if tx != nil {
 		sdb = s.db
 	}
-	sel := "select id, name, email, username, source, uuid, last_modified from identities"
-	vals := []interface{}{}
-	nColumns := len(columns)
-	lastIndex := nColumns - 1
-	if nColumns > 0 {
-		sel += " where"
+	enrollmentData = &models.EnrollmentDataOutput{}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence from enrollments where id = ? limit 1",
+		id,
+	)
+	if err != nil {
+		return
 	}
-	for index := range columns {
-		column := columns[index]
-		value := values[index]
-		date := isDate[index]
-		isNil := false
-		v, ok := value.(*string)
-		if ok {
-			isNil = v == nil
-		}
-		if isNil {
-			sel += " " + column + " is null"
-		} else {
-			if date {
-				sel += " " + column + " = str_to_date(?, ?)"
-				vals = append(vals, value)
-				vals = append(vals, DateTimeFormat)
-			} else {
-				sel += " " + column + " = ?"
-				vals = append(vals, value)
-			}
-		}
-		if index < lastIndex {
-			sel += " and"
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.OrganizationID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+		)
+		if err != nil {
+			return
 		}
+		fetched = true
 	}
-	sel += " order by id"
-	rows, err := s.Query(sdb, tx, sel, vals...)
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find enrollment id '%d'", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetEnrollment")
+		return
+	}
+	if !fetched {
+		enrollmentData = nil
+	}
+	return
+}
+
+func (s *service) FetchMatchingBlacklist(email string, missingFatal bool, tx *sql.Tx) (matchingBlacklistData *models.MatchingBlacklistOutput, err error) {
+	log.Info(fmt.Sprintf("FetchMatchingBlacklist: email:%s missingFatal:%v tx:%v", email, missingFatal, tx != nil))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"FetchMatchingBlacklist(exit): email:%s missingFatal:%v tx:%v matchingBlacklistData:%+v err:%v",
+				email,
+				missingFatal,
+				tx != nil,
+				matchingBlacklistData,
+				err,
+			),
+		)
+	}()
+	matchingBlacklistData = &models.MatchingBlacklistOutput{}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select excluded from matching_blacklist where excluded = ? limit 1",
+		email,
+	)
 	if err != nil {
 		return
 	}
+	fetched := false
 	for rows.Next() {
-		identity := &models.IdentityDataOutput{}
 		err = rows.Scan(
-			&identity.ID,
-			&identity.Name,
-			&identity.Email,
-			&identity.Username,
-			&identity.Source,
-			&identity.UUID,
-			&identity.LastModified,
+			&matchingBlacklistData.Excluded,
 		)
 		if err != nil {
 			return
 		}
-		identities = append(identities, identity)
+		fetched = true
 	}
 	err = rows.Err()
 	if err != nil {
@@ -4420,883 +5957,672 @@ func (s *service) FindIdentities(columns []string, values []interface{}, isDate
 	if err != nil {
 		return
 	}
-	if missingFatal && len(identities) == 0 {
-		err = fmt.Errorf("cannot find identities for %+v/%+v", columns, values)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindIdentities")
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find matching blacklist email '%s'", email)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FetchMatchingBlacklist")
 		return
 	}
+	if !fetched {
+		matchingBlacklistData = nil
+	}
 	return
 }
 
-func (s *service) AddNestedUniqueIdentity(uuid string) (uid *models.UniqueIdentityNestedDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddNestedUniqueIdentity: uuid:%s", uuid))
-	// s.SetOrigin()
-	uid = &models.UniqueIdentityNestedDataOutput{}
+func (s *service) GetOrganization(id int64, missingFatal bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetOrganization: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"AddNestedUniqueIdentity(exit): uuid:%s uid:%+v err:%v",
-				uuid,
-				s.ToLocalNestedUniqueIdentity(uid),
+				"GetOrganization(exit): id:%d missingFatal:%v tx:%v organizationData:%+v err:%v",
+				id,
+				missingFatal,
+				tx != nil,
+				s.ToLocalOrganization(organizationData),
 				err,
 			),
 		)
 	}()
-	tx, err := s.db.Begin()
-	if err != nil {
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
-	}()
-	_, err = s.AddUniqueIdentity(
-		&models.UniqueIdentityDataOutput{
-			UUID: uuid,
-		},
-		false,
+	organizationData = &models.OrganizationDataOutput{}
+	rows, err := s.Query(
+		sdb,
 		tx,
+		"select id, name from organizations where id = ? limit 1",
+		id,
 	)
 	if err != nil {
 		return
 	}
-	profile := &models.ProfileDataOutput{}
-	profile, err = s.AddProfile(
-		&models.ProfileDataOutput{
-			UUID: uuid,
-		},
-		false,
-		tx,
-	)
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&organizationData.ID,
+			&organizationData.Name,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
+	}
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	err = tx.Commit()
+	err = rows.Close()
 	if err != nil {
 		return
 	}
-	tx = nil
-	uid.UUID = uuid
-	uid.LastModified = s.Now()
-	uid.Profile = profile
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find organization id %d", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetOrganization")
+		return
+	}
+	if !fetched {
+		organizationData = nil
+	}
 	return
 }
 
-func (s *service) AddProfile(inProfileData *models.ProfileDataOutput, refresh bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddProfile: inProfileData:%+v refresh:%v tx:%v", s.ToLocalProfile(inProfileData), refresh, tx != nil))
-	profileData = inProfileData
+func (s *service) GetOrganizationByName(orgName string, missingFatal bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetOrganizationByName: orgName:%s missingFatal:%v tx:%v", orgName, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"AddProfile(exit): inProfileData:%+v refresh:%v tx:%v profileData:%+v err:%v",
-				s.ToLocalProfile(inProfileData),
-				refresh,
+				"GetOrganizationByName(exit): orgName:%s missingFatal:%v tx:%v organizationData:%+v err:%v",
+				orgName,
+				missingFatal,
 				tx != nil,
-				s.ToLocalProfile(profileData),
+				s.ToLocalOrganization(organizationData),
 				err,
 			),
 		)
 	}()
-	s.SanitizeProfile(profileData)
-	err = s.ValidateProfile(profileData, tx)
-	if err != nil {
-		profileData = nil
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	//insert := "insert into profiles(uuid, name, email, gender, gender_acc, is_bot, country_code) select ?, ?, ?, ?, ?, ?, ?"
-	insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) select ?, ?, ?, ?, ?, ?"
-	var res sql.Result
-	// s.SetOrigin()
-	res, err = s.Exec(
-		s.db,
+	organizationData = &models.OrganizationDataOutput{}
+	rows, err := s.Query(
+		sdb,
 		tx,
-		insert,
-		profileData.UUID,
-		profileData.Name,
-		profileData.Email,
-		//profileData.Gender,
-		//profileData.GenderAcc,
-		profileData.IsBot,
-		profileData.CountryCode,
-		s.lfid,
+		"select id, name from organizations where name = ? limit 1",
+		orgName,
 	)
 	if err != nil {
-		profileData = nil
 		return
 	}
-	affected := int64(0)
-	affected, err = res.RowsAffected()
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&organizationData.ID,
+			&organizationData.Name,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
+	}
+	err = rows.Err()
 	if err != nil {
-		profileData = nil
 		return
 	}
-	if affected > 1 {
-		err = fmt.Errorf("profile '%+v' insert affected %d rows", s.ToLocalProfile(profileData), affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
-		profileData = nil
+	err = rows.Close()
+	if err != nil {
 		return
-	} else if affected == 1 {
-		affected2 := int64(0)
-		// Mark profile's matching unique identity as modified
-		affected2, err = s.TouchUniqueIdentity(profileData.UUID, tx)
-		if err != nil {
-			profileData = nil
-			return
-		}
-		if affected2 != 1 {
-			err = fmt.Errorf("profile '%+v' unique identity update affected %d rows", s.ToLocalProfile(profileData), affected2)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
-			profileData = nil
-			return
-		}
-	} else {
-		err = fmt.Errorf("adding profile '%+v' didn't affected any rows", s.ToLocalProfile(profileData))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
-		profileData = nil
+	}
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find organization name '%s'", orgName)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetOrganizationByName")
 		return
 	}
-	if refresh {
-		profileData, err = s.GetProfile(profileData.UUID, true, tx)
-		if err != nil {
-			profileData = nil
-			return
-		}
+	if !fetched {
+		organizationData = nil
 	}
 	return
 }
 
-func (s *service) AddEnrollment(inEnrollmentData *models.EnrollmentDataOutput, ignore, refresh bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("AddEnrollment: inEnrollmentData:%+v ignore:%v refresh:%v tx:%v", inEnrollmentData, ignore, refresh, tx != nil))
-	enrollmentData = inEnrollmentData
+func (s *service) GetUniqueIdentity(uuid string, missingFatal bool, tx *sql.Tx) (uniqueIdentityData *models.UniqueIdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetUniqueIdentity: uuid:%s missingFatal:%v tx:%v", uuid, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"AddEnrollment(exit): inEnrollmentData:%+v ignore:%v refresh:%v tx:%v enrollmentData:%+v err:%v",
-				inEnrollmentData,
-				ignore,
-				refresh,
+				"GetUniqueIdentity(exit): uuid:%s missingFatal:%v tx:%v uniqueIdentityData:%+v err:%v",
+				uuid,
+				missingFatal,
 				tx != nil,
-				enrollmentData,
+				s.ToLocalUniqueIdentity(uniqueIdentityData),
 				err,
 			),
 		)
 	}()
-	if enrollmentData.Role == "" {
-		enrollmentData.Role = shared.DefaultRole
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	err = s.ValidateEnrollment(enrollmentData, false)
+	uniqueIdentityData = &models.UniqueIdentityDataOutput{}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select uuid, last_modified from uidentities where uuid = ? limit 1",
+		uuid,
+	)
 	if err != nil {
-		enrollmentData = nil
 		return
 	}
-	root := "insert"
-	if ignore {
-		root += " ignore"
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&uniqueIdentityData.UUID,
+			&uniqueIdentityData.LastModified,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
 	}
-	insert := root + " into enrollments(uuid, organization_id, role, start, end, project_slug, last_modified_by) select ?, ?, ?, str_to_date(?, ?), str_to_date(?, ?), ?, ?"
-	var res sql.Result
-	// s.SetOrigin()
-	res, err = s.Exec(
-		s.db,
-		tx,
-		insert,
-		enrollmentData.UUID,
-		enrollmentData.OrganizationID,
-		enrollmentData.Role,
-		enrollmentData.Start,
-		DateTimeFormat,
-		enrollmentData.End,
-		DateTimeFormat,
-		enrollmentData.ProjectSlug,
-		s.lfid,
-	)
+	err = rows.Err()
 	if err != nil {
-		enrollmentData = nil
 		return
 	}
-	affected := int64(0)
-	affected, err = res.RowsAffected()
+	err = rows.Close()
 	if err != nil {
-		enrollmentData = nil
 		return
 	}
-	if affected > 1 {
-		err = fmt.Errorf("enrollment '%+v' insert affected %d rows", enrollmentData, affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
-		enrollmentData = nil
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find unique identity uuid '%s'", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetUniqueIdentity")
 		return
-	} else if affected == 1 {
-		affected2 := int64(0)
-		// Mark enrollment's matching unique identity as modified
-		affected2, err = s.TouchUniqueIdentity(enrollmentData.UUID, tx)
-		if err != nil {
-			enrollmentData = nil
-			return
-		}
-		if affected2 != 1 {
-			err = fmt.Errorf("enrollment '%+v' unique identity update affected %d rows", enrollmentData, affected2)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
-			enrollmentData = nil
-			return
-		}
-	} else {
-		if !ignore {
-			err = fmt.Errorf("adding enrollment '%+v' didn't affected any rows", enrollmentData)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
-			enrollmentData = nil
-			return
-		}
 	}
-	if refresh {
-		id := int64(0)
-		id, err = res.LastInsertId()
-		if err != nil {
-			enrollmentData = nil
-			return
-		}
-		enrollmentData.ID = id
-		enrollmentData, err = s.GetEnrollment(enrollmentData.ID, true, tx)
-		if err != nil {
-			enrollmentData = nil
-			return
-		}
+	if !fetched {
+		uniqueIdentityData = nil
 	}
 	return
 }
 
-func (s *service) EditOrganization(inOrganizationData *models.OrganizationDataOutput, refresh bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
-	log.Info(fmt.Sprintf("EditOrganization: inOrganizationData:%+v refresh:%v tx:%v", inOrganizationData, refresh, tx != nil))
-	organizationData = inOrganizationData
+func (s *service) GetIdentity(id string, missingFatal bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetIdentity: id:%s missingFatal:%v tx:%v", id, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"EditOrganization(exit): inOrganizationData:%+v refresh:%v tx:%v organizationData:%+v err:%v",
-				inOrganizationData,
-				refresh,
+				"GetIdentity(exit): id:%s missingFatal:%v tx:%v identityData:%+v err:%v",
+				id,
+				missingFatal,
 				tx != nil,
-				organizationData,
+				s.ToLocalIdentity(identityData),
 				err,
 			),
 		)
 	}()
-	organizationData.Name = strings.TrimSpace(organizationData.Name)
-	err = s.ValidateOrganization(organizationData, true)
-	if err != nil {
-		err = fmt.Errorf("organization '%+v' didn't pass update validation", organizationData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditOrganization")
-		organizationData = nil
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	update := "update organizations set name = ?, last_modified_by = ? where id = ?"
-	var res sql.Result
-	// s.SetOrigin()
-	res, err = s.Exec(
-		s.db,
+	identityData = &models.IdentityDataOutput{}
+	rows, err := s.Query(
+		sdb,
 		tx,
-		update,
-		organizationData.Name,
-		s.lfid,
-		organizationData.ID,
+		"select id, uuid, source, name, username, email, last_modified from identities where id = ? limit 1",
+		id,
 	)
 	if err != nil {
-		organizationData = nil
 		return
 	}
-	affected := int64(0)
-	affected, err = res.RowsAffected()
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Username,
+			&identityData.Email,
+			&identityData.LastModified,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
+	}
+	err = rows.Err()
 	if err != nil {
-		organizationData = nil
 		return
 	}
-	if affected == 0 {
-		log.Info(fmt.Sprintf("EditOrganization: organization '%+v' update didn't affected any rows", organizationData))
+	err = rows.Close()
+	if err != nil {
+		return
 	}
-	if refresh {
-		organizationData, err = s.GetOrganization(organizationData.ID, true, tx)
-		if err != nil {
-			organizationData = nil
-			return
-		}
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find identity id '%s'", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetIdentity")
+		return
+	}
+	if !fetched {
+		identityData = nil
 	}
 	return
 }
 
-func (s *service) EditEnrollment(inEnrollmentData *models.EnrollmentDataOutput, refresh bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
-	log.Info(fmt.Sprintf("EditEnrollment: inEnrollmentData:%+v refresh:%v tx:%v", inEnrollmentData, refresh, tx != nil))
-	enrollmentData = inEnrollmentData
+func (s *service) GetIdentityByUser(key string, value string, missingFatal bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetIdentityByUser: %s:%s missingFatal:%v tx:%v", key, value, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"EditEnrollment(exit): inEnrollmentData:%+v refresh:%v tx:%v enrollmentData:%+v err:%v",
-				inEnrollmentData,
-				refresh,
+				"GetIdentityByUser(exit): %s:%s missingFatal:%v tx:%v identityData:%+v err:%v",
+				key,
+				value,
+				missingFatal,
 				tx != nil,
-				enrollmentData,
+				s.ToLocalIdentity(identityData),
 				err,
 			),
 		)
 	}()
-	if enrollmentData.Role == "" {
-		enrollmentData.Role = shared.DefaultRole
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	err = s.ValidateEnrollment(enrollmentData, true)
+
+	identityData = &models.IdentityDataOutput{}
+	q := fmt.Sprintf("select id, uuid, source, name, username, email, last_modified from identities where %s = ? limit 1", key)
+	rows, err := s.Query(
+		sdb,
+		tx,
+		q,
+		value,
+	)
 	if err != nil {
-		err = fmt.Errorf("enrollment '%+v' didn't pass update validation", enrollmentData)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
-		enrollmentData = nil
 		return
 	}
-	update := "update enrollments set uuid = ?, organization_id = ?, start = str_to_date(?, ?), end = str_to_date(?, ?), project_slug = ?, role = ?, last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')"
-	var res sql.Result
-	// s.SetOrigin()
-	res, err = s.Exec(
-		s.db,
-		tx,
-		update,
-		enrollmentData.UUID,
-		enrollmentData.OrganizationID,
-		enrollmentData.Start,
-		DateTimeFormat,
-		enrollmentData.End,
-		DateTimeFormat,
-		enrollmentData.ProjectSlug,
-		enrollmentData.Role,
-		s.lfid,
-		enrollmentData.ID,
-	)
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Username,
+			&identityData.Email,
+			&identityData.LastModified,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
+	}
+	err = rows.Err()
 	if err != nil {
-		enrollmentData = nil
 		return
 	}
-	affected := int64(0)
-	affected, err = res.RowsAffected()
+	err = rows.Close()
 	if err != nil {
-		enrollmentData = nil
 		return
 	}
-	if affected > 1 {
-		err = fmt.Errorf("enrollment '%+v' update affected %d rows", enrollmentData, affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
-		enrollmentData = nil
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find identity '%s' : '%s'", key, value)
+		err = errs.Wrap(errs.New(err, errs.ErrNotFound), "GetIdentityByUser")
 		return
-	} else if affected == 1 {
-		affected2 := int64(0)
-		// Mark enrollment's matching unique identity as modified
-		affected2, err = s.TouchUniqueIdentity(enrollmentData.UUID, tx)
-		if err != nil {
-			enrollmentData = nil
-			return
-		}
-		if affected2 != 1 {
-			err = fmt.Errorf("enrollment '%+v' unique identity update affected %d rows", enrollmentData, affected2)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
-			enrollmentData = nil
-			return
-		}
-	} else {
-		log.Info(fmt.Sprintf("EditEnrollment: enrollment '%+v' update didn't affected any rows", enrollmentData))
 	}
-	if refresh {
-		enrollmentData, err = s.GetEnrollment(enrollmentData.ID, true, tx)
-		if err != nil {
-			enrollmentData = nil
-			return
-		}
+	if !fetched {
+		identityData = nil
 	}
 	return
 }
 
-func (s *service) EditIdentity(inIdentityData *models.IdentityDataOutput, refresh bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
-	log.Info(fmt.Sprintf("EditIdentity: inIdentityData:%+v refresh:%v tx:%v", s.ToLocalIdentity(inIdentityData), refresh, tx != nil))
-	identityData = inIdentityData
+func (s *service) GetProfile(uuid string, missingFatal bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
+	log.Info(fmt.Sprintf("GetProfile: uuid:%s missignFatal:%v tx:%v", uuid, missingFatal, tx != nil))
 	defer func() {
 		log.Info(
 			fmt.Sprintf(
-				"EditIdentity(exit): inIdentityData:%+v refresh:%v tx:%v identityData:%+v err:%v",
-				s.ToLocalIdentity(inIdentityData),
-				refresh,
+				"GetProfile(exit): uuid:%s missignFatal:%v tx:%v profileData:%+v err:%v",
+				uuid,
+				missingFatal,
 				tx != nil,
-				s.ToLocalIdentity(identityData),
+				s.ToLocalProfile(profileData),
 				err,
 			),
 		)
 	}()
-	s.SanitizeIdentity(identityData)
-	if identityData.ID == "" || identityData.Source == "" {
-		err = fmt.Errorf("identity '%+v' missing id or source", s.ToLocalIdentity(identityData))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
-		identityData = nil
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	profileData = &models.ProfileDataOutput{}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		//"select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles where uuid = ? limit 1",
+		"select uuid, name, email, is_bot, country_code from profiles where uuid = ? limit 1",
+		uuid,
+	)
+	if err != nil {
 		return
 	}
-	if identityData.LastModified == nil {
-		identityData.LastModified = s.Now()
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(
+			&profileData.UUID,
+			&profileData.Name,
+			&profileData.Email,
+			//&profileData.Gender,
+			//&profileData.GenderAcc,
+			&profileData.IsBot,
+			&profileData.CountryCode,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
 	}
-	columns := []string{"id", "uuid", "source"}
-	values := []interface{}{identityData.ID, identityData.UUID, identityData.Source}
-	if identityData.Name != nil && *identityData.Name != "" {
-		columns = append(columns, "name")
-		values = append(values, *identityData.Name)
+	err = rows.Err()
+	if err != nil {
+		return
 	}
-	if identityData.Username != nil && *identityData.Username != "" {
-		columns = append(columns, "username")
-		values = append(values, *identityData.Username)
+	err = rows.Close()
+	if err != nil {
+		return
 	}
-	if identityData.Email != nil && *identityData.Email != "" {
-		columns = append(columns, "email")
-		values = append(values, *identityData.Email)
+	if missingFatal && !fetched {
+		err = fmt.Errorf("cannot find profile uuid '%s'", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "GetProfile")
+		return
 	}
-	update := "update identities set "
-	for _, column := range columns {
-		update += fmt.Sprintf("%s = ?, ", column)
+	if !fetched {
+		profileData = nil
 	}
-	update += " last_modified = str_to_date(?, ?), last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')"
-	values = append(values, identityData.LastModified)
-	values = append(values, DateTimeFormat)
-	values = append(values, s.lfid)
-	values = append(values, identityData.ID)
-	var res sql.Result
+	return
+}
+
+func (s *service) TouchIdentity(id string, tx *sql.Tx) (affected int64, err error) {
+	log.Info(fmt.Sprintf("TouchIdentity: id:%s tx:%v", id, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("TouchIdentity(exit): id:%s tx:%v affected:%d err:%v", id, tx != nil, affected, err))
+	}()
 	// s.SetOrigin()
-	res, err = s.Exec(s.db, tx, update, values...)
+	res, err := s.Exec(s.db, tx, "update identities set last_modified = ?, last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')", time.Now(), s.lfid, id)
 	if err != nil {
-		identityData = nil
 		return
 	}
-	affected := int64(0)
 	affected, err = res.RowsAffected()
+	return
+}
+
+func (s *service) TouchUniqueIdentity(uuid string, tx *sql.Tx) (affected int64, err error) {
+	log.Info(fmt.Sprintf("TouchUniqueIdentity: uuid:%s tx:%v", uuid, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("TouchUniqueIdentity(exit): uuid:%s tx:%v affected:%d err:%v", uuid, tx != nil, affected, err))
+	}()
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, "update uidentities set last_modified = ?, last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')", time.Now(), s.lfid, uuid)
 	if err != nil {
-		identityData = nil
 		return
 	}
-	if affected > 1 {
-		err = fmt.Errorf("identity '%+v' update affected %d rows", s.ToLocalIdentity(identityData), affected)
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
-		identityData = nil
-		return
-	} else if affected == 1 {
-		affected2 := int64(0)
-		// Mark identity's matching unique identity as modified
-		if identityData.UUID != nil {
-			affected2, err = s.TouchUniqueIdentity(*(identityData.UUID), tx)
-			if err != nil {
-				identityData = nil
-				return
-			}
-			if affected2 != 1 {
-				err = fmt.Errorf("identity '%+v' unique identity update affected %d rows", s.ToLocalIdentity(identityData), affected2)
-				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
-				identityData = nil
-				return
-			}
-		}
+	affected, err = res.RowsAffected()
+	return
+}
+
+func (s *service) DeleteUniqueIdentityArchive(uuid string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteUniqueIdentityArchive: uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", uuid, missingFatal, onlyLast, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteUniqueIdentityArchive(exit): uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", uuid, missingFatal, onlyLast, tm, tx != nil, err))
+	}()
+	var res sql.Result
+	if tm != nil {
+		del := "delete from uidentities_archive where uuid = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, del, uuid, tm)
 	} else {
-		log.Info(fmt.Sprintf("EditIdentity: identity '%+v' update didn't affected any rows", s.ToLocalIdentity(identityData)))
+		if onlyLast {
+			del := "delete from uidentities_archive where uuid = ? and archived_at = (" +
+				"select max(archived_at) from uidentities_archive where uuid = ?)"
+			res, err = s.Exec(s.db, tx, del, uuid, uuid)
+		} else {
+			del := "delete from uidentities_archive where uuid = ?"
+			res, err = s.Exec(s.db, tx, del, uuid)
+		}
 	}
-	if refresh {
-		identityData, err = s.GetIdentity(identityData.ID, true, tx)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting archived unique identity uuid '%s' had no effect", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteUniqueIdentityArchive")
+		return
+	}
+	return
+}
+
+func (s *service) UnarchiveUniqueIdentity(uuid string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("UnarchiveUniqueIdentity: uuid:%s replace:%v tm:%v tx:%v", uuid, replace, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("UnarchiveUniqueIdentity(exit): uuid:%s replace:%v tm:%v tx:%v err:%v", uuid, replace, tm, tx != nil, err))
+	}()
+	uuid = strings.TrimSpace(uuid)
+	if replace {
+		err = s.DeleteUniqueIdentity(uuid, false, false, nil, tx)
 		if err != nil {
-			identityData = nil
 			return
 		}
 	}
+	var res sql.Result
+	// s.SetOrigin()
+	if tm != nil {
+		insert := "insert into uidentities(uuid, last_modified, last_modified_by) " +
+			"select uuid, now(), ? from uidentities_archive " +
+			"where uuid = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid, tm)
+	} else {
+		insert := "insert into uidentities(uuid, last_modified, last_modified_by) " +
+			"select uuid, now(), ? from uidentities_archive " +
+			"where uuid = ? order by archived_at desc limit 1"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid)
+	}
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("unachiving unique identity uuid '%s' created no data", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveUniqueIdentity")
+		return
+	}
+	err = s.DeleteUniqueIdentityArchive(uuid, true, tm == nil, tm, tx)
+	if err != nil {
+		return
+	}
 	return
 }
 
-func (s *service) EditProfile(inProfileData *models.ProfileDataOutput, refresh bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
-	log.Info(fmt.Sprintf("EditProfile: inProfileData:%+v refresh:%v tx:%v", s.ToLocalProfile(inProfileData), refresh, tx != nil))
-	profileData = inProfileData
+func (s *service) ArchiveUniqueIdentity(uuid string, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("ArchiveUniqueIdentity: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
 	defer func() {
-		log.Info(
-			fmt.Sprintf(
-				"EditProfile(exit): inProfileData:%+v refresh:%v tx:%v profileData:%+v err:%v",
-				s.ToLocalProfile(inProfileData),
-				refresh,
-				tx != nil,
-				s.ToLocalProfile(profileData),
-				err,
-			),
-		)
+		log.Info(fmt.Sprintf("ArchiveUniqueIdentity(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
 	}()
-	s.SanitizeProfile(profileData)
-	err = s.ValidateProfile(profileData, tx)
+	uuid = strings.TrimSpace(uuid)
+	if tm == nil {
+		t := time.Now()
+		tm = &t
+	}
+	insert := "insert into uidentities_archive(uuid, last_modified, archived_at, last_modified_by) " +
+		"select uuid, last_modified, ?, ? from uidentities where uuid = ? limit 1"
+	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, uuid)
 	if err != nil {
-		profileData = nil
 		return
 	}
-	columns := []string{}
-	values := []interface{}{}
-	if profileData.Name != nil && *profileData.Name != "" {
-		columns = append(columns, "name")
-		values = append(values, *profileData.Name)
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
 	}
-	if profileData.Email != nil && *profileData.Email != "" {
-		columns = append(columns, "email")
-		values = append(values, *profileData.Email)
-	}
-	// Database doesn't have null, but we can use to to call EditProfile and skip updating is_bot
-	if profileData.IsBot != nil {
-		columns = append(columns, "is_bot")
-		values = append(values, *profileData.IsBot)
-	}
-	if profileData.CountryCode != nil && *profileData.CountryCode != "" {
-		columns = append(columns, "country_code")
-		values = append(values, *profileData.CountryCode)
-	}
-	/*
-		if profileData.Gender != nil {
-			columns = append(columns, "gender")
-			values = append(values, *profileData.Gender)
-			columns = append(columns, "gender_acc")
-			if profileData.GenderAcc == nil {
-				values = append(values, 100)
-			} else {
-				values = append(values, *profileData.GenderAcc)
-			}
-		}
-	*/
-	nColumns := len(columns)
-	if nColumns > 0 {
-		update := "update profiles set "
-		for _, column := range columns {
-			update += fmt.Sprintf("%s = ?, ", column)
-		}
-		update += "last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')"
-		values = append(values, s.lfid)
-		values = append(values, profileData.UUID)
-		var res sql.Result
-		// s.SetOrigin()
-		res, err = s.Exec(s.db, tx, update, values...)
-		if err != nil {
-			profileData = nil
-			return
-		}
-		affected := int64(0)
-		affected, err = res.RowsAffected()
-		if err != nil {
-			profileData = nil
-			return
-		}
-		if affected > 1 {
-			err = fmt.Errorf("profile '%+v' update affected %d rows", s.ToLocalProfile(profileData), affected)
-			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditProfile")
-			profileData = nil
-			return
-		} else if affected == 1 {
-			affected2 := int64(0)
-			// Mark profile's unique identity as modified
-			affected2, err = s.TouchUniqueIdentity(profileData.UUID, tx)
-			if err != nil {
-				profileData = nil
-				return
-			}
-			if affected2 != 1 {
-				err = fmt.Errorf("profile '%+v' unique identity update affected %d rows", s.ToLocalProfile(profileData), affected2)
-				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditProfile")
-				profileData = nil
-				return
-			}
-		} else {
-			log.Info(fmt.Sprintf("EditProfile: profile '%+v' update didn't affected any rows", s.ToLocalProfile(profileData)))
-		}
-	} else {
-		log.Info(fmt.Sprintf("EditProfile: profile '%+v' nothing to update", s.ToLocalProfile(profileData)))
-	}
-	if refresh {
-		profileData, err = s.GetProfile(profileData.UUID, true, tx)
-		if err != nil {
-			profileData = nil
-			return
-		}
+	if affected == 0 {
+		err = fmt.Errorf("archiving unique identity uuid '%s' created no data", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveUniqueIdentity")
+		return
 	}
 	return
 }
 
-func (s *service) UnarchiveUUID(uuid string, tm time.Time, tx *sql.Tx) (err error) {
-	log.Info(fmt.Sprintf("UnarchiveUUID: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
+func (s *service) DropOrganization(id int64, missingFatal bool, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DropOrganization: id:%d missingFatal:%v tx:%v", id, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("UnarchiveUUID(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
+		log.Info(fmt.Sprintf("DropOrganization(exit): id:%d missingFatal:%v tx:%v err:%v", id, missingFatal, tx != nil, err))
 	}()
-	if uuid == "" {
-		err = fmt.Errorf("cannot unarchive empty uuid")
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveUUID")
+	defer s.invalidateAffiliationCacheTx(tx)
+	del := "delete from organizations where id = ?"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, id)
+	if err != nil {
 		return
 	}
-	err = s.UnarchiveUniqueIdentity(uuid, true, &tm, tx)
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
-	err = s.UnarchiveProfile(uuid, true, &tm, tx)
-	if err != nil {
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting organization id %d had no effect", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropOrganization")
 		return
 	}
-	identities, err := s.GetArchiveUniqueIdentityIdentities(uuid, tm, false, tx)
+	return
+}
+
+func (s *service) DropOrgDomain(organization, domain string, missingFatal bool, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DropOrgDomain: organization:%s domain:%s missingFatal:%v tx:%v", organization, domain, missingFatal, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DropOrgDomain(exit): organization:%s domain:%s missingFatal:%v tx:%v err:%v", organization, domain, missingFatal, tx != nil, err))
+	}()
+	// Domains can be used to infer affiliations
+	defer s.invalidateAffiliationCacheTx(tx)
+	del := "delete from domains_organizations where organization_id in ("
+	del += "select id from organizations where name = ?) and domain = ?"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, organization, domain)
 	if err != nil {
 		return
 	}
-	for _, identity := range identities {
-		err = s.UnarchiveIdentity(identity.ID, true, &tm, tx)
-		if err != nil {
-			return
-		}
-	}
-	enrollments, err := s.GetArchiveUniqueIdentityEnrollments(uuid, tm, false, tx)
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
-	for _, enrollment := range enrollments {
-		err = s.UnarchiveEnrollment(enrollment.ID, true, &tm, tx)
-		if err != nil {
-			if strings.Contains(err.Error(), "Error 1452: Cannot add or update a child row") {
-				log.Warn(fmt.Sprintf("UnarchiveEnrollment: id:%d tm:%v err:%v", enrollment.ID, tm, err))
-			} else {
-				return
-			}
-		}
-	}
-	// Check if profile's name or email is empty
-	// if there is only one email across identities, update profile's email to this email
-	// if there is only one name across identities, update profile's name to this name
-	err = s.SetProfileEmptyDataFromIdentities(uuid, identities, tx)
-	if err != nil {
-		log.Warn(fmt.Sprintf("UnarchiveUUID: SetProfileEmptyDataFromIdentities: uuid:%s err:%v", uuid, err))
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting organization '%s' domain '%s' had no effect", organization, domain)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropOrgDomain")
 		return
 	}
 	return
 }
 
-func (s *service) ArchiveUUID(uuid string, itm *time.Time, tx *sql.Tx) (tm *time.Time, err error) {
-	log.Info(fmt.Sprintf("ArchiveUUID: uuid:%s itm:%v tx:%v", uuid, itm, tx != nil))
+func (s *service) DropMatchingBlacklist(email string, missingFatal bool, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DropMatchingBlacklist: email:%s missingFatal:%v tx:%v", email, missingFatal, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("ArchiveUUID(exit): uuid:%s itm:%v tx:%v tm:%v err:%v", uuid, itm, tx != nil, tm, err))
+		log.Info(fmt.Sprintf("DropMatchingBlacklist(exit): email:%s missingFatal:%v tx:%v err:%v", email, missingFatal, tx != nil, err))
 	}()
-	if uuid == "" {
-		err = fmt.Errorf("cannot archive empty uuid")
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveUUID")
-		return
-	}
-	tm = itm
-	if tm == nil {
-		t := time.Now()
-		tm = &t
-	}
-	err = s.ArchiveUniqueIdentity(uuid, tm, tx)
-	if err != nil {
-		return
-	}
-	identities, err := s.GetUniqueIdentityIdentities(uuid, false, tx)
+	del := "delete from matching_blacklist where excluded = ?"
+	res, err := s.Exec(s.db, tx, del, email)
 	if err != nil {
 		return
 	}
-	// Check if profile's name or email is empty
-	// if there is only one email across identities, update profile's email to this email
-	// if there is only one name across identities, update profile's name to this name
-	err = s.SetProfileEmptyDataFromIdentities(uuid, identities, tx)
+	affected, err := res.RowsAffected()
 	if err != nil {
-		log.Warn(fmt.Sprintf("UnarchiveUUID: SetProfileEmptyDataFromIdentities: uuid:%s err:%v", uuid, err))
 		return
 	}
-	err = s.ArchiveProfile(uuid, tm, tx)
-	if err != nil {
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting matching blacklist email '%s' had no effect", email)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DropMatchingBlacklist")
 		return
 	}
-	for _, identity := range identities {
-		err = s.ArchiveIdentity(identity.ID, tm, tx)
+	return
+}
+
+func (s *service) DeleteUniqueIdentity(uuid string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteUniqueIdentity: uuid:%s archive:%v missingFatal:%v tm:%v tx:%v", uuid, archive, missingFatal, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteUniqueIdentity(exit): uuid:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", uuid, archive, missingFatal, tm, tx != nil, err))
+	}()
+	if archive {
+		err = s.ArchiveUniqueIdentity(uuid, tm, tx)
 		if err != nil {
 			return
 		}
 	}
-	enrollments, err := s.GetUniqueIdentityEnrollments(uuid, false, tx)
+	del := "delete from uidentities where uuid = ? and (locked_by is null or trim(locked_by) = '')"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, uuid)
 	if err != nil {
 		return
 	}
-	for _, enrollment := range enrollments {
-		err = s.ArchiveEnrollment(enrollment.ID, tm, tx)
-		if err != nil {
-			return
-		}
+	s.invalidateAffiliationCacheTx(tx, uuid)
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting unique identity uuid '%s' had no effect", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteUniqueIdentity")
+		return
 	}
 	return
 }
 
-func (s *service) SetProfileEmptyDataFromIdentities(uuid string, identities []*models.IdentityDataOutput, tx *sql.Tx) (err error) {
-	nIdents := len(identities)
-	name, email := "", ""
-	log.Info(fmt.Sprintf("SetProfileEmptyDataFromIdentities: uuid:%s identities:%d tx:%v", uuid, nIdents, tx != nil))
+func (s *service) DeleteEnrollmentArchive(id int64, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteEnrollmentArchive: id:%d missingFatal:%v onlyLast:%v tm:%v tx:%v", id, missingFatal, onlyLast, tm, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("SetProfileEmptyDataFromIdentities(exit): uuid:%s identities:%d tx:%v name:%s email:%s err:%v", uuid, nIdents, tx != nil, name, email, err))
+		log.Info(fmt.Sprintf("DeleteEnrollmentArchive(exit): id:%d missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", id, missingFatal, onlyLast, tm, tx != nil, err))
 	}()
-	if nIdents == 0 {
-		return
-	}
-	nameSet := make(map[string]struct{})
-	emailSet := make(map[string]struct{})
-	for _, identity := range identities {
-		if identity.Name != nil {
-			name = *identity.Name
-			nameSet[name] = struct{}{}
-		}
-		if identity.Email != nil {
-			email = *identity.Email
-			emailSet[email] = struct{}{}
+	var res sql.Result
+	if tm != nil {
+		del := "delete from enrollments_archive where id = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, del, id, tm)
+	} else {
+		if onlyLast {
+			del := "delete from enrollments_archive where id = ? and archived_at = (" +
+				"select max(archived_at) from enrollments_archive where id = ?)"
+			res, err = s.Exec(s.db, tx, del, id, id)
+		} else {
+			del := "delete from enrollments_archive where id = ?"
+			res, err = s.Exec(s.db, tx, del, id)
 		}
 	}
-	// fmt.Printf("nameSet: %+v\nemailSet: %+v\n", nameSet, emailSet)
-	if len(nameSet) > 1 {
-		name = ""
-	}
-	if len(emailSet) > 1 {
-		email = ""
-	}
-	if name == "" && email == "" {
+	if err != nil {
 		return
 	}
-	var (
-		pName  *string
-		pEmail *string
-		rows   *sql.Rows
-	)
-	// This uses RW connection, because this value will be updated soon
-	rows, err = s.Query(s.db, tx, "select name, email from profiles where uuid = ?", uuid)
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
-	for rows.Next() {
-		err = rows.Scan(&pName, &pEmail)
-		if err != nil {
-			return
-		}
-		break
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
-	}
-	if pName != nil && *pName != "" {
-		// fmt.Printf("profile already has a name %s\n", *pName)
-		name = ""
-	}
-	if pEmail != nil && *pEmail != "" {
-		// fmt.Printf("profile already has an email %s\n", *pEmail)
-		email = ""
-	}
-	if name == "" && email == "" {
-		return
-	}
-	args := []interface{}{}
-	q := "update profiles set "
-	if name != "" {
-		q += "name = ?"
-		args = append(args, name)
-		if email != "" {
-			q += ", email = ?"
-			args = append(args, email)
-		}
-	} else {
-		q += "email = ?"
-		args = append(args, email)
-	}
-	q += ", last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')"
-	args = append(args, s.lfid)
-	args = append(args, uuid)
-	// fmt.Printf("%s %+v\n", q, args)
-	_, err = s.Exec(s.db, tx, q, args...)
-	if err != nil {
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting archived enrollment id '%d' had no effect", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteEnrollmentArchive")
 		return
 	}
 	return
 }
 
-func (s *service) DedupEnrollments() (err error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return
-	}
+func (s *service) UnarchiveEnrollment(id int64, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("UnarchiveEnrollment: id:%d replace:%v tm:%v tx:%v", id, replace, tm, tx != nil))
 	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
+		log.Info(fmt.Sprintf("UnarchiveEnrollment(exit): id:%d replace:%v tm:%v tx:%v err:%v", id, replace, tm, tx != nil, err))
 	}()
-	var rows *sql.Rows
-	// This uses RW connection, even for selects - because it will eventually update data
-	rows, err = s.Query(
-		s.db,
-		tx,
-		"select uuid, organization_id, start, end, project_slug, count(id) as cnt "+
-			"from enrollments where project_slug is null "+
-			"group by uuid, organization_id, start, end, project_slug "+
-			"having cnt > 1",
-	)
-	if err != nil {
-		return
-	}
-	var (
-		uuid           string
-		orgID          int64
-		start          strfmt.DateTime
-		end            strfmt.DateTime
-		projectSlug    *string
-		cnt            int
-		uuidAry        []string
-		orgIDAry       []int64
-		startAry       []strfmt.DateTime
-		endAry         []strfmt.DateTime
-		projectSlugAry []*string
-		cntAry         []int
-	)
-	for rows.Next() {
-		err = rows.Scan(&uuid, &orgID, &start, &end, &projectSlug, &cnt)
-		if err != nil {
-			return
-		}
-		uuidAry = append(uuidAry, uuid)
-		orgIDAry = append(orgIDAry, orgID)
-		startAry = append(startAry, start)
-		endAry = append(endAry, end)
-		projectSlugAry = append(projectSlugAry, projectSlug)
-		cntAry = append(cntAry, cnt)
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-	err = rows.Close()
-	if err != nil {
-		return
-	}
-	rids := make(map[int]struct{})
-	for idx := range uuidAry {
-		uuid = uuidAry[idx]
-		orgID = orgIDAry[idx]
-		start = startAry[idx]
-		end = endAry[idx]
-		projectSlug = projectSlugAry[idx]
-		cnt = cntAry[idx]
+	defer s.invalidateAffiliationCacheTx(tx)
+	// Version to restore is selected before anything is changed, without tm it is the most recently archived one
+	if tm == nil {
 		var rows *sql.Rows
-		rows, err = s.Query(
-			s.db,
-			tx,
-			"select id from enrollments where uuid = ? and organization_id = ? "+
-				"and start = ? and end = ? and project_slug is null order by id desc limit ?",
-			uuid,
-			orgID,
-			time.Time(start),
-			time.Time(end),
-			cnt-1,
-		)
+		rows, err = s.Query(s.db, tx, "select max(archived_at) from enrollments_archive where id = ?", id)
 		if err != nil {
 			return
 		}
-		rid := 0
 		for rows.Next() {
-			err = rows.Scan(&rid)
+			err = rows.Scan(&tm)
 			if err != nil {
 				return
 			}
-			rids[rid] = struct{}{}
 		}
 		err = rows.Err()
 		if err != nil {
@@ -5306,1139 +6632,5359 @@ func (s *service) DedupEnrollments() (err error) {
 		if err != nil {
 			return
 		}
-	}
-	ridsAry := []interface{}{}
-	for rid := range rids {
-		ridsAry = append(ridsAry, rid)
-	}
-	packSize := 1000
-	nRids := len(ridsAry)
-	nPacks := nRids / packSize
-	if nRids%packSize != 0 {
-		nPacks++
-	}
-	for i := 0; i < nPacks; i++ {
-		from := packSize * i
-		to := from + packSize
-		if to > nRids {
-			to = nRids
-		}
-		pack := ridsAry[from:to]
-		query := "delete from enrollments where (locked_by is null or trim(locked_by) = '') and id in ("
-		for range pack {
-			query += "?,"
+		if tm == nil {
+			err = fmt.Errorf("enrollment id '%d' has no archived versions", id)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveEnrollment")
+			return
 		}
-		query = query[:len(query)-1] + ")"
-		_, err = s.Exec(s.db, tx, query, pack...)
+	}
+	if replace {
+		err = s.DeleteEnrollment(id, false, false, nil, tx)
 		if err != nil {
-			for _, rid := range pack {
-				_, err = s.Exec(s.db, tx, "delete from enrollments where id = ? and (locked_by is null or trim(locked_by) = '')", rid)
-				if err != nil {
-					log.Info(fmt.Sprintf("failed to delete enrollment id=%d: %+v", rid, err))
-					return
-				}
-			}
 			return
 		}
 	}
-	err = tx.Commit()
+	// s.SetOrigin()
+	// Restored enrollment keeps its creation time when enrollment history is enabled
+	cols := "id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence, "
+	if shared.GEnrollmentHistory {
+		cols += "created_at, "
+	}
+	insert := "insert into enrollments(" + cols + "last_modified_by) select " + cols + "? from enrollments_archive where id = ? and archived_at = ?"
+	res, err := s.Exec(s.db, tx, insert, s.lfid, id, tm)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("unachiving enrollment id '%d' created no data", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveEnrollment")
+		return
+	}
+	err = s.DeleteEnrollmentArchive(id, true, false, tm, tx)
 	if err != nil {
 		return
 	}
-	// set tx to nil to mark success so deferred rollback will not happen
-	tx = nil
 	return
 }
 
-func (s *service) MapOrgNames() (status string, err error) {
-	log.Info("MapOrgNames")
-	dbg := false
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "trace" || logLevel == "debug" {
-		dbg = true
+// enrollmentsArchiveInsert - returns query archiving enrollments matching a given condition, archived_at and last_modified_by are the first two arguments
+// created_at and last_modified are only archived when enrollment history is enabled (they are added by sql/add_enrollment_timestamps.sql)
+func enrollmentsArchiveInsert(cond string) string {
+	cols := "id, uuid, organization_id, start, end, project_slug, role, provenance, evidence_url, evidence_notes, confidence, "
+	if shared.GEnrollmentHistory {
+		cols += "created_at, last_modified, "
+	}
+	return "insert into enrollments_archive(" + cols + "archived_at, last_modified_by) select " + cols + "?, ? from enrollments where " + cond
+}
+
+func (s *service) ArchiveEnrollment(id int64, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("ArchiveEnrollment: id:%d tm:%v tx:%v", id, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("ArchiveEnrollment(exit): id:%d tm:%v tx:%v err:%v", id, tm, tx != nil, err))
+	}()
+	if tm == nil {
+		t := time.Now()
+		tm = &t
+	}
+	res, err := s.Exec(s.db, tx, enrollmentsArchiveInsert("id = ? limit 1"), tm, s.lfid, id)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("archiving enrollment id '%d' created no data", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveEnrollment")
+		return
 	}
+	return
+}
+
+func (s *service) WithdrawEnrollment(enrollment *models.EnrollmentDataOutput, archive, missingFatal bool, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("WithdrawEnrollment: enrollment:%+v archive:%v missingFatal:%v tx:%v", enrollment, archive, missingFatal, tx != nil))
 	// s.SetOrigin()
-	status = ""
 	defer func() {
-		log.Info(fmt.Sprintf("MapOrgNames(exit): status:%s err:%v", status, err))
+		log.Info(fmt.Sprintf("WithdrawEnrollment(exit): enrollment:%+v archive:%v missingFatal:%v tx:%v err:%v", enrollment, archive, missingFatal, tx != nil, err))
 	}()
-	e := s.DedupEnrollments()
-	if e != nil {
-		log.Warn(fmt.Sprintf("dedupEnrollments: %v", e))
+	cond := "uuid = ? and organization_id = ? and start >= str_to_date(?, ?) and end <= str_to_date(?, ?) and role = ? and (locked_by is null or trim(locked_by) = '')"
+	args := []interface{}{
+		enrollment.UUID,
+		enrollment.OrganizationID,
+		enrollment.Start,
+		DateTimeFormat,
+		enrollment.End,
+		DateTimeFormat,
+		enrollment.Role,
 	}
-	if !s.mappingsLoaded {
-		// orgNamesMappings allMappings
-		var data []byte
-		data, err = ioutil.ReadFile(MapOrgNamesFile)
-		if err != nil {
-			return
-		}
-		err = yaml.Unmarshal(data, &s.orgNamesMappings)
+	if enrollment.ProjectSlug == nil {
+		cond += " and project_slug is null"
+	} else {
+		cond += " and project_slug = ?"
+		args = append(args, enrollment.ProjectSlug)
+	}
+	if archive {
+		// All withdrawn enrollments are archived with the same archived_at, so they can be restored together
+		_, err = s.Exec(s.db, tx, enrollmentsArchiveInsert(cond), append([]interface{}{time.Now(), s.lfid}, args...)...)
 		if err != nil {
 			return
 		}
-		s.mappingsLoaded = true
 	}
-	// Entire map org names API uses RW connection only
-	tx, err := s.db.Begin()
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, "delete from enrollments where "+cond, args...)
+	if err != nil {
+		return
+	}
+	s.invalidateAffiliationCacheTx(tx, enrollment.UUID)
+	affected, err := res.RowsAffected()
 	if err != nil {
 		return
 	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting enrollment id '%+v' had no effect", enrollment)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "WithdrawEnrollment")
+		return
+	}
+	return
+}
+
+func (s *service) DeleteEnrollment(id int64, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteEnrollment: id:%d archive:%v missingFatal:%v tm:%v tx:%v", id, archive, missingFatal, tm, tx != nil))
 	defer func() {
-		if tx != nil {
-			tx.Rollback()
-		}
+		log.Info(fmt.Sprintf("DeleteEnrollment(exit): id:%d archive:%v missingFatal:%v tm:%v tx:%v err:%v", id, archive, missingFatal, tm, tx != nil, err))
 	}()
-	nids := []int64{}
-	inf := ""
-	added := 0
-	updated := 0
-	deleted := 0
-	skipped := 0
-	conflicts := 0
-	archivedConflicts := 0
-	rolsUpdated := int64(0)
-	for _, mapping := range s.orgNamesMappings.Mappings {
-		re := mapping[0]
-		to := mapping[1]
-		// fmt.Printf("Processing '%s' -> '%s'\n", re, to)
-		var rows *sql.Rows
-		rows, err = s.Query(s.db, tx, "select id, name from organizations where name = ?", to)
+	if archive {
+		err = s.ArchiveEnrollment(id, tm, tx)
 		if err != nil {
 			return
 		}
-		fetched := false
-		id := int64(0)
-		actualName := ""
-		for rows.Next() {
-			if fetched {
-				err = fmt.Errorf("multiple companies found for name: %s, including %s", to, actualName)
-				return
-			}
-			err = rows.Scan(&id, &actualName)
-			if err != nil {
-				return
-			}
-			fetched = true
+	}
+	enrollment, err := s.GetEnrollment(id, false, tx)
+	if err != nil {
+		return
+	}
+	del := "delete from enrollments where id = ? and (locked_by is null or trim(locked_by) = '')"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, id)
+	if err != nil {
+		return
+	}
+	if enrollment != nil {
+		s.invalidateAffiliationCacheTx(tx, enrollment.UUID)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting enrollment id '%d' had no effect", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteEnrollment")
+		return
+	}
+	return
+}
+
+// GetEnrollmentVersions - returns archived versions of given profile's enrollments (or of a single enrollment if id > 0)
+// grouped by archived_at, the most recent first. If projectSlugs are given, only global and those projects enrollments are returned
+func (s *service) GetEnrollmentVersions(uuid string, id int64, projectSlugs []string, tx *sql.Tx) (versions []*models.EnrollmentVersion, err error) {
+	log.Info(fmt.Sprintf("GetEnrollmentVersions: uuid:%s id:%d projectSlugs:%+v tx:%v", uuid, id, projectSlugs, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("GetEnrollmentVersions(exit): uuid:%s id:%d projectSlugs:%+v tx:%v versions:%d err:%v", uuid, id, projectSlugs, tx != nil, len(versions), err))
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	sel := "select e.archived_at, e.last_modified_by, e.id, e.uuid, e.start, e.end, e.project_slug, e.role, " +
+		"e.provenance, e.evidence_url, e.evidence_notes, e.confidence, e.organization_id, coalesce(o.name, '') " +
+		"from enrollments_archive e left join organizations o on e.organization_id = o.id where e.uuid = ?"
+	args := []interface{}{uuid}
+	if id > 0 {
+		sel += " and e.id = ?"
+		args = append(args, id)
+	}
+	if len(projectSlugs) > 0 {
+		sel += " and (e.project_slug is null or e.project_slug in ("
+		for _, projectSlug := range projectSlugs {
+			sel += "?,"
+			args = append(args, projectSlug)
 		}
-		err = rows.Err()
+		sel = sel[0:len(sel)-1] + "))"
+	}
+	sel += " order by e.archived_at desc, e.start asc, e.end asc, e.id asc"
+	rows, err := s.Query(sdb, tx, sel, args...)
+	if err != nil {
+		return
+	}
+	versions = []*models.EnrollmentVersion{}
+	var (
+		archivedAt time.Time
+		archivedBy *string
+		oName      string
+	)
+	for rows.Next() {
+		enrollmentData := &models.EnrollmentNestedDataOutput{}
+		err = rows.Scan(
+			&archivedAt,
+			&archivedBy,
+			&enrollmentData.ID,
+			&enrollmentData.UUID,
+			&enrollmentData.Start,
+			&enrollmentData.End,
+			&enrollmentData.ProjectSlug,
+			&enrollmentData.Role,
+			&enrollmentData.Provenance,
+			&enrollmentData.EvidenceURL,
+			&enrollmentData.EvidenceNotes,
+			&enrollmentData.Confidence,
+			&enrollmentData.OrganizationID,
+			&oName,
+		)
 		if err != nil {
 			return
 		}
-		err = rows.Close()
+		enrollmentData.Organization = &models.OrganizationDataOutput{ID: enrollmentData.OrganizationID, Name: oName}
+		at := archivedAt.UTC().Format(shared.ArchivedAtFormat)
+		n := len(versions)
+		if n == 0 || versions[n-1].ArchivedAt != at {
+			versions = append(versions, &models.EnrollmentVersion{ArchivedAt: at, ArchivedBy: archivedBy})
+			n++
+		}
+		versions[n-1].Enrollments = append(versions[n-1].Enrollments, enrollmentData)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// EnrollmentRestoreChanges - returns what restoring archived enrollments does to the current enrollments of the same profile
+// add - archived enrollment no longer exists, replace - current enrollment with the same id differs (fields lists what differs),
+// unchanged - current enrollment is the same, conflict - another current enrollment has the same organization, dates and project
+// (enrollments unique key), so restored one cannot be inserted. Current enrollments that are going to be replaced are not conflicts
+// locked maps locked current enrollments ids to their locked_by, they cannot be replaced so restoring them is a conflict too
+func (s *service) EnrollmentRestoreChanges(archived, current []*models.EnrollmentNestedDataOutput, locked map[int64]string) (changes []*models.EnrollmentRestoreChange) {
+	strEq := func(a, b *string) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	slugEq := func(a, b *string) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && strings.EqualFold(*a, *b))
+	}
+	intEq := func(a, b *int64) bool {
+		return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+	}
+	sameKey := func(a, b *models.EnrollmentNestedDataOutput) bool {
+		return a.OrganizationID == b.OrganizationID &&
+			time.Time(a.Start).Equal(time.Time(b.Start)) &&
+			time.Time(a.End).Equal(time.Time(b.End)) &&
+			slugEq(a.ProjectSlug, b.ProjectSlug)
+	}
+	byID := make(map[int64]*models.EnrollmentNestedDataOutput)
+	for _, rol := range current {
+		byID[rol.ID] = rol
+	}
+	restored := make(map[int64]struct{})
+	for _, rol := range archived {
+		restored[rol.ID] = struct{}{}
+	}
+	for _, rol := range archived {
+		change := &models.EnrollmentRestoreChange{Restored: rol, Fields: []string{}}
+		changes = append(changes, change)
+		for _, other := range current {
+			_, replaced := restored[other.ID]
+			// locked enrollment stays as it is, unless it is the one being restored (then it is handled below)
+			if replaced && locked[other.ID] != "" && other.ID != rol.ID {
+				replaced = false
+			}
+			if !replaced && sameKey(rol, other) {
+				change.Action = shared.EnrollmentRestoreConflict
+				change.Current = other
+				change.Reason = fmt.Sprintf("enrollment %d has the same organization, dates and project", other.ID)
+				break
+			}
+		}
+		if change.Action != "" {
+			continue
+		}
+		cur, ok := byID[rol.ID]
+		if !ok {
+			change.Action = shared.EnrollmentRestoreAdd
+			continue
+		}
+		change.Current = cur
+		for _, field := range []struct {
+			name  string
+			equal bool
+		}{
+			{"organization", rol.OrganizationID == cur.OrganizationID},
+			{"start", time.Time(rol.Start).Equal(time.Time(cur.Start))},
+			{"end", time.Time(rol.End).Equal(time.Time(cur.End))},
+			{"project_slug", slugEq(rol.ProjectSlug, cur.ProjectSlug)},
+			{"role", rol.Role == cur.Role},
+			{"provenance", strEq(rol.Provenance, cur.Provenance)},
+			{"evidence_url", strEq(rol.EvidenceURL, cur.EvidenceURL)},
+			{"evidence_notes", strEq(rol.EvidenceNotes, cur.EvidenceNotes)},
+			{"confidence", intEq(rol.Confidence, cur.Confidence)},
+		} {
+			if !field.equal {
+				change.Fields = append(change.Fields, field.name)
+			}
+		}
+		if len(change.Fields) > 0 && locked[cur.ID] != "" {
+			change.Action = shared.EnrollmentRestoreConflict
+			change.Reason = fmt.Sprintf("enrollment %d is locked by %s", cur.ID, locked[cur.ID])
+		} else if len(change.Fields) > 0 {
+			change.Action = shared.EnrollmentRestoreReplace
+		} else {
+			change.Action = shared.EnrollmentRestoreUnchanged
+		}
+	}
+	return
+}
+
+// RestoreEnrollments - restores given profile's enrollments (or a single enrollment if id > 0) archived at archivedAt
+// Enrollments being replaced are archived first, so restore can be undone in the same way, conflicting (or locked) enrollments are skipped
+// In dry mode it only returns what would be changed. If projectSlugs are given, restoring other projects enrollments is forbidden
+func (s *service) RestoreEnrollments(uuid string, archivedAt time.Time, id int64, projectSlugs []string, dry bool) (changes []*models.EnrollmentRestoreChange, err error) {
+	log.Info(fmt.Sprintf("RestoreEnrollments: uuid:%s archivedAt:%v id:%d projectSlugs:%+v dry:%v", uuid, archivedAt, id, projectSlugs, dry))
+	defer func() {
+		log.Info(fmt.Sprintf("RestoreEnrollments(exit): uuid:%s archivedAt:%v id:%d projectSlugs:%+v dry:%v changes:%d err:%v", uuid, archivedAt, id, projectSlugs, dry, len(changes), err))
+	}()
+	var tx *sql.Tx
+	if !dry {
+		tx, err = s.db.Begin()
 		if err != nil {
 			return
 		}
-		if !fetched {
-			var res sql.Result
-			res, err = s.Exec(s.db, tx, "insert into organizations(name, last_modified_by) values(?,?)", to, s.lfid)
-			if err != nil {
-				return
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
 			}
-			id, err = res.LastInsertId()
-			if err != nil {
+		}()
+	}
+	versions, err := s.GetEnrollmentVersions(uuid, id, nil, tx)
+	if err != nil {
+		return
+	}
+	at := archivedAt.UTC().Format(shared.ArchivedAtFormat)
+	var archived []*models.EnrollmentNestedDataOutput
+	for _, version := range versions {
+		if version.ArchivedAt == at {
+			archived = version.Enrollments
+			break
+		}
+	}
+	if len(archived) == 0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("no archived enrollments found for uuid '%s' id %d archived at %s", uuid, id, at), errs.ErrNotFound), "RestoreEnrollments")
+		return
+	}
+	if len(projectSlugs) > 0 {
+		projects := make(map[string]struct{})
+		for _, projectSlug := range projectSlugs {
+			projects[strings.ToLower(projectSlug)] = struct{}{}
+		}
+		for _, rol := range archived {
+			if rol.ProjectSlug == nil {
+				continue
+			}
+			_, ok := projects[strings.ToLower(*rol.ProjectSlug)]
+			if !ok {
+				err = fmt.Errorf("cannot restore '%s' project enrollment %d: current projects are '%+v'", *rol.ProjectSlug, rol.ID, projectSlugs)
+				err = errs.Wrap(errs.New(err, errs.ErrForbidden), "RestoreEnrollments")
 				return
 			}
-			inf = fmt.Sprintf("Added organization '%s' (id=%d)", to, id)
-			status += inf + ", "
-			log.Info(inf)
-			added++
-		} else if actualName != to {
-			_, err = s.Exec(s.db, tx, "update organizations set name = ?, last_modified_by = ? where id = ?", to, s.lfid, id)
+		}
+	}
+	current, err := s.FindEnrollmentsNested([]string{"e.uuid"}, []interface{}{uuid}, []bool{false}, false, nil, tx)
+	if err != nil {
+		return
+	}
+	ids := []int64{}
+	for _, rol := range current {
+		ids = append(ids, rol.ID)
+	}
+	locked, err := s.LockedEnrollments(ids, tx)
+	if err != nil {
+		return
+	}
+	changes = s.EnrollmentRestoreChanges(archived, current, locked)
+	if dry {
+		return
+	}
+	now := time.Now()
+	restored := 0
+	for _, change := range changes {
+		rolID := change.Restored.ID
+		switch change.Action {
+		case shared.EnrollmentRestoreReplace:
+			err = s.ArchiveEnrollment(rolID, &now, tx)
 			if err != nil {
 				return
 			}
-			inf = fmt.Sprintf("Updated organization name '%s' -> '%s' (id=%d)", actualName, to, id)
-			status += inf + ", "
-			log.Info(inf)
-			updated++
-		}
-		// Because sql.Query escapes \ --> \\ and mysql special characters regexp is '\\.'
-		re = strings.Replace(re, "\\\\", "\\", -1)
-		if dbg {
-			fmt.Printf("RE: %s\n", re)
-			log.Debug(fmt.Sprintf("RE: %s", re))
+			err = s.UnarchiveEnrollment(rolID, true, &archivedAt, tx)
+		case shared.EnrollmentRestoreAdd:
+			err = s.UnarchiveEnrollment(rolID, false, &archivedAt, tx)
+		default:
+			continue
 		}
-		rows, err = s.Query(s.db, tx, "select id, name from organizations where name regexp ? and name != ?", re, to)
-		//rows, err = s.Query(s.db, tx, "select id, name from organizations where name = ?", re)
-		//rows, err = s.Query(s.db, tx, `select id, name from organizations where name regexp '` + re + `'`)
 		if err != nil {
 			return
 		}
-		nid := int64(0)
-		name := ""
-		nidAry := []int64{}
-		nameAry := []string{}
-		for rows.Next() {
-			err = rows.Scan(&nid, &name)
-			if err != nil {
-				return
-			}
-			nidAry = append(nidAry, nid)
-			nameAry = append(nameAry, name)
-		}
-		err = rows.Err()
+		restored++
+	}
+	if restored > 0 {
+		_, err = s.TouchUniqueIdentity(uuid, tx)
 		if err != nil {
 			return
 		}
-		err = rows.Close()
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	tx = nil
+	return
+}
+
+func (s *service) DeleteIdentityArchive(id string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteIdentityArchive: id:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", id, missingFatal, onlyLast, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteIdentityArchive(exit): id:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", id, missingFatal, onlyLast, tm, tx != nil, err))
+	}()
+	var res sql.Result
+	if tm != nil {
+		del := "delete from identities_archive where id = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, del, id, tm)
+	} else {
+		if onlyLast {
+			del := "delete from identities_archive where id = ? and archived_at = (" +
+				"select max(archived_at) from identities_archive where id = ?)"
+			res, err = s.Exec(s.db, tx, del, id, id)
+		} else {
+			del := "delete from identities_archive where id = ?"
+			res, err = s.Exec(s.db, tx, del, id)
+		}
+	}
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting archived identity id '%s' had no effect", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteIdentityArchive")
+		return
+	}
+	return
+}
+
+func (s *service) UnarchiveIdentity(id string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("UnarchiveIdentity: id:%s replace:%v tm:%v tx:%v", id, replace, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("UnarchiveIdentity(exit): id:%s replace:%v tm:%v tx:%v err:%v", id, replace, tm, tx != nil, err))
+	}()
+	if replace {
+		err = s.DeleteIdentity(id, false, false, nil, tx)
 		if err != nil {
 			return
 		}
-		for idx, nid := range nidAry {
-			name = nameAry[idx]
-			//fmt.Printf("'%s'(%d)\n", name, nid)
-			if nid == id {
-				inf = fmt.Sprintf("'%s' (id=%d) matching '%s' already maps into '%s' (id=%d), skipping", name, nid, re, to, id)
-				status += inf + ", "
-				log.Info(inf)
-				skipped++
-				continue
-			}
-			var res sql.Result
-			// Update current enrollments
-			affected := int64(0)
-			// Here map org names auto updates changed org ID, we allow this even on locked enrollments, so there is no " and (locked_by is null or trim(locked_by) = '')" condition added
-			res, err = s.Exec(s.db, tx, "update enrollments set organization_id = ?, last_modified_by = ? where organization_id = ?", id, s.lfid, nid)
-			if err != nil {
-				if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
-					log.Warn(fmt.Sprintf("Error: cannot update enrollments organization '%s' (id=%d) to '%s' (id=%d): %v", name, nid, to, id, err))
-					return
-				}
-				var rows *sql.Rows
-				rows, err = s.Query(s.db, tx, "select id from enrollments where organization_id = ?", nid)
-				if err != nil {
-					return
-				}
-				rid := 0
-				// To avoid updates while feching rows - we need to fetch all rws and then update after rows are closed
-				rids := []int{}
-				for rows.Next() {
-					err = rows.Scan(&rid)
-					if err != nil {
-						return
-					}
-					rids = append(rids, rid)
-				}
-				err = rows.Err()
-				if err != nil {
-					return
-				}
-				err = rows.Close()
-				if err != nil {
-					return
-				}
-				for _, rid := range rids {
-					// Here map org names auto updates changed org ID, we allow this even on locked enrollments, so there is no " and (locked_by is null or trim(locked_by) = '')" condition added
-					res, err = s.Exec(s.db, tx, "update enrollments set organization_id = ?, last_modified_by = ? where id = ? and organization_id = ?", id, s.lfid, rid, nid)
-					if err != nil && !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
-						log.Warn(fmt.Sprintf("Error: cannot update enrollment (id=%d) organization '%s' (id=%d) to '%s' (id=%d): %v", rid, name, nid, to, id, err))
-						return
-					}
-					if err != nil {
-						conflicts++
-						continue
-					}
-					affected++
-				}
-			} else {
-				affected, err = res.RowsAffected()
-			}
-			if affected > 0 {
-				rolsUpdated += affected
-				inf = fmt.Sprintf("Updated organization '%s' -> '%s' on %d enrollments", name, to, affected)
-				status += inf + ", "
-				log.Info(inf)
-			}
-			// Update archived enrollments
-			affected = int64(0)
-			res, err = s.Exec(s.db, tx, "update enrollments_archive set organization_id = ?, last_modified_by = ? where organization_id = ?", id, s.lfid, nid)
-			if err != nil {
-				if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
-					log.Warn(fmt.Sprintf("Error: cannot update archived enrollments organization '%s' (id=%d) to '%s' (id=%d): %v", name, nid, to, id, err))
-					return
-				}
-				var rows *sql.Rows
-				rows, err = s.Query(s.db, tx, "select id, archived_at from enrollments_archive where organization_id = ?", nid)
-				if err != nil {
-					return
-				}
-				rid := 0
-				rids := []int{}
-				var archivedAt time.Time
-				archivedAts := []time.Time{}
-				for rows.Next() {
-					err = rows.Scan(&rid, &archivedAt)
-					if err != nil {
-						return
-					}
-					rids = append(rids, rid)
-					archivedAts = append(archivedAts, archivedAt)
-				}
-				err = rows.Err()
-				if err != nil {
-					return
-				}
-				err = rows.Close()
-				if err != nil {
-					return
-				}
-				for i := range rids {
-					rid := rids[i]
-					archivedAt := archivedAts[i]
-					res, err = s.Exec(s.db, tx, "update enrollments_archive set organization_id = ?, last_modified_by = ? where id = ? and archived_at = ? and organization_id = ?", id, s.lfid, rid, archivedAt, nid)
-					if err != nil && !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
-						log.Warn(fmt.Sprintf("Error: cannot update archived enrollment (id=%d, archived_at=%+v) organization '%s' (id=%d) to '%s' (id=%d): %v", rid, archivedAt, name, nid, to, id, err))
-						return
-					}
-					if err != nil {
-						archivedConflicts++
-						continue
-					}
-					affected++
-				}
-			} else {
-				affected, err = res.RowsAffected()
-			}
-			if affected > 0 {
-				rolsUpdated += affected
-				inf = fmt.Sprintf("Updated organization '%s' -> '%s' on %d archived enrollments", name, to, affected)
-				status += inf + ", "
-				log.Info(inf)
-			}
-			res, err = s.Exec(s.db, tx, "delete from organizations where id = ?", nid)
-			if err != nil {
-				log.Warn(fmt.Sprintf("Error: cannot delete organization '%s' (id=%d)", name, nid))
-				nids = append(nids, nid)
-			} else {
-				affected, err = res.RowsAffected()
-				if affected > 0 {
-					inf = fmt.Sprintf("Deleted organization '%s' (id=%d)", name, nid)
-					status += inf + ", "
-					log.Info(inf)
-					deleted++
-				}
-			}
-		}
 	}
-	if status == "" {
-		status = "Nothing to update"
+	var res sql.Result
+	// s.SetOrigin()
+	if tm != nil {
+		insert := "insert into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) " +
+			"select id, uuid, source, name, email, username, now(), ? from identities_archive " +
+			"where id = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, id, tm)
 	} else {
-		status += fmt.Sprintf(
-			"Organizations: added:%d renamed:%d deleted:%d skipped:%d, Enrollments: conflicts:%d archive conflicts:%d updated:%d",
-			added,
-			updated,
-			deleted,
-			skipped,
-			conflicts,
-			archivedConflicts,
-			rolsUpdated,
-		)
+		insert := "insert into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) " +
+			"select id, uuid, source, name, email, username, now(), ? from identities_archive " +
+			"where id = ? order by archived_at desc limit 1"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, id)
 	}
-	err = tx.Commit()
 	if err != nil {
 		return
 	}
-	// Set tx to nil, so deferred rollback will not happen
-	tx = nil
-	if len(nids) > 0 {
-		log.Info(fmt.Sprintf("Deleting %d pending orgs", len(nids)))
-		for _, nid := range nids {
-			var res sql.Result
-			res, err = s.Exec(s.db, nil, "delete from organizations where id = ?", nid)
-			if err != nil {
-				log.Warn(fmt.Sprintf("Error: cannot delete organization id=%d", nid))
-				continue
-			}
-			var affected int64
-			affected, err = res.RowsAffected()
-			if affected > 0 {
-				inf = fmt.Sprintf("Deleted organization id=%d", nid)
-				status += inf + ", "
-				log.Info(inf)
-				deleted++
-			}
-		}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("unachiving identity id '%s' created no data", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveIdentity")
+		return
+	}
+	err = s.DeleteIdentityArchive(id, true, tm == nil, tm, tx)
+	if err != nil {
+		return
 	}
 	return
 }
 
-func (s *service) HideEmails() (status string, err error) {
-	log.Info("HideEmails")
-	// s.SetOrigin()
-	status = ""
+func (s *service) ArchiveIdentity(id string, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("ArchiveIdentity: id:%s tm:%v tx:%v", id, tm, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("HideEmails(exit): status:%s err:%v", status, err))
+		log.Info(fmt.Sprintf("ArchiveIdentity(exit): id:%s tm:%v tx:%v err:%v", id, tm, tx != nil, err))
 	}()
-	updates := [][2]string{
-		{"profiles", "name"},
-		{"identities", "name"},
-		{"identities", "username"},
+	if tm == nil {
+		t := time.Now()
+		tm = &t
 	}
-	thrN := runtime.NumCPU()
-	var mtx *sync.Mutex
-	if thrN > 1 {
-		mtx = &sync.Mutex{}
+	insert := "insert into identities_archive(id, uuid, source, name, email, username, last_modified, archived_at, last_modified_by) " +
+		"select id, uuid, source, name, email, username, last_modified, ?, ? from identities where id = ? limit 1"
+	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, id)
+	if err != nil {
+		return
 	}
-	updateFunc := func(ch chan error, update [2]string) (err error) {
-		defer func() {
-			if ch != nil {
-				ch <- err
-			}
-		}()
-		table := update[0]
-		column := update[1]
-		re := "^[^@]+@[^@]+$"
-		updateSQL := fmt.Sprintf(
-			"update %[1]s set %[2]s = substring_index(%[2]s, '@', 1), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
-			table,
-			column,
-			re,
-		)
-		var res sql.Result
-		conflict := false
-		res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
-		if err != nil {
-			if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
-				return err
-			}
-			updateSQL := fmt.Sprintf(
-				"update ignore %[1]s set %[2]s = substring_index(%[2]s, '@', 1), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
-				table,
-				column,
-				re,
-			)
-			res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
-			if err != nil {
-				return
-			}
-			conflict = true
-		}
-		affected := int64(0)
-		affected, err = res.RowsAffected()
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("archiving identity id '%s' created no data", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveIdentity")
+		return
+	}
+	return
+}
+
+func (s *service) DeleteIdentity(id string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteIdentity: id:%s archive:%v missingFatal:%v tm:%v tx:%v", id, archive, missingFatal, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteIdentity(exit): id:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", id, archive, missingFatal, tm, tx != nil, err))
+	}()
+	if archive {
+		err = s.ArchiveIdentity(id, tm, tx)
 		if err != nil {
 			return
 		}
-		if conflict {
-			updateSQL := fmt.Sprintf(
-				"update %[1]s set %[2]s = concat(substring_index(%[2]s, '@', 1), '-redacted'), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
-				table,
-				column,
-				re,
-			)
-			res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
-			if err != nil {
-				return
-			}
-			affected2 := int64(0)
-			affected2, err = res.RowsAffected()
-			if err != nil {
-				return
-			}
-			if affected2 > 0 {
-				affected += affected2
-				log.Warn(fmt.Sprintf("%d conflicts on column %s table %s, added '-redacted' suffix", affected2, column, table))
-			}
-		}
-		if mtx != nil {
-			mtx.Lock()
-		}
-		if status == "" {
-			status = fmt.Sprintf("Updated %d %s values on %s table, ", affected, column, table)
-		} else {
-			status += fmt.Sprintf("%d %s values on %s table, ", affected, column, table)
-		}
-		if mtx != nil {
-			mtx.Unlock()
-		}
+	}
+	del := "delete from identities where id = ? and (locked_by is null or trim(locked_by) = '')"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, id)
+	if err != nil {
 		return
 	}
-	ch := make(chan error)
-	nThreads := 0
-	if thrN > 0 {
-		for _, update := range updates {
-			go updateFunc(ch, update)
-			nThreads++
-			if nThreads == thrN {
-				err = <-ch
-				nThreads--
-				if err != nil {
-					return
-				}
-			}
-		}
-		for nThreads > 0 {
-			err = <-ch
-			nThreads--
-			if err != nil {
-				return
-			}
-		}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting identity id '%s' had no effect", id)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteIdentity")
+		return
+	}
+	return
+}
+
+func (s *service) DeleteProfileArchive(uuid string, missingFatal, onlyLast bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteProfileArchive: uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v", uuid, missingFatal, onlyLast, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteProfileArchive(exit): uuid:%s missingFatal:%v onlyLast:%v tm:%v tx:%v err:%v", uuid, missingFatal, onlyLast, tm, tx != nil, err))
+	}()
+	var res sql.Result
+	if tm != nil {
+		del := "delete from profiles_archive where uuid = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, del, uuid, tm)
 	} else {
-		for _, update := range updates {
-			err = updateFunc(nil, update)
-			if err != nil {
-				return
-			}
+		if onlyLast {
+			del := "delete from profiles_archive where uuid = ? and archived_at = (" +
+				"select max(archived_at) from profiles_archive where uuid = ?)"
+			res, err = s.Exec(s.db, tx, del, uuid, uuid)
+		} else {
+			del := "delete from profiles_archive where uuid = ?"
+			res, err = s.Exec(s.db, tx, del, uuid)
 		}
 	}
-	if len(status) > 2 {
-		status = status[0 : len(status)-2]
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting archived profile uuid '%s' had no effect", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteProfileArchive")
+		return
 	}
-	log.Warn(status)
 	return
 }
 
-func (s *service) MergeAll(debug int, dry bool, username string, esLog elastic.Service) (status string, err error) {
-	log.Info(fmt.Sprintf("MergeAll: debug:%d dry:%v", debug, dry))
-	// s.SetOrigin()
+func (s *service) UnarchiveProfile(uuid string, replace bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("UnarchiveProfile: uuid:%s replace:%v tm:%v tx:%v", uuid, replace, tm, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("MergeAll(exit): debug:%d dry:%v status:%s err:%v", debug, dry, status, err))
+		log.Info(fmt.Sprintf("UnarchiveProfile(exit): uuid:%s replace:%v tm:%v tx:%v err:%v", uuid, replace, tm, tx != nil, err))
 	}()
-	emailRE := `^[^@]+@[^@]+$`
-	//reVal := `[[:^alpha:]]`
-	reVal := `[]['"“”・·,;!#$%^&*()_+{}:|\/?.,><~£§ -]`
-	reStr := `regexp_replace(lower(concat(trim(email), '@@@', trim(name))), ?, '')`
-	tables := []string{"identities", "profiles"}
-	for _, table := range tables {
-		log.Warn("Merging using " + table + " table.")
-		var rows *sql.Rows
-		query := fmt.Sprintf(
-			"select k, cnt from (select %s as k, count(distinct uuid) as cnt from %s "+
-				"where name is not null and email is not null and email regexp ? "+
-				"and name not like '%%-MISSING-NAME' and name not like '%%-REDACTED-EMAIL' "+
-				"group by k) sub where sub.cnt > 1",
-			reStr,
-			table,
-		)
-		if debug > 0 {
-			log.Info(fmt.Sprintf("main query[%s, %s]: %s\n", reVal, emailRE, query))
-			fmt.Printf("main query[%s, %s]: %s\n", reVal, emailRE, query)
-		}
-		// Only RW connection is used - this API mass updates data
-		// select k, cnt from (select regexp_replace(lower(concat(trim(email), '@@@', trim(name))), '[]["“”・·,;!#$%^&*()_+{}:|\/?.,><~£§ -]', '') as k,
-		// count(distinct uuid) as cnt from identities where name is not null and email is not null and email regexp '^[^@]+@[^@]+$'
-		// group by k) sub where sub.cnt > 1;
-		rows, err = s.Query(s.db, nil, query, reVal, emailRE)
+	uuid = strings.TrimSpace(uuid)
+	if replace {
+		err = s.DeleteProfile(uuid, false, false, nil, tx)
 		if err != nil {
 			return
 		}
-		packSize := 1000
-		rawKey := ""
-		key := ""
-		keysPacks := [][]interface{}{}
-		keys := []interface{}{}
-		n := 0
-		cnt := 0
-		for rows.Next() {
-			err = rows.Scan(&rawKey, &cnt)
-			if err != nil {
-				return
-			}
-			// key = strings.TrimSpace(strings.ToLower(s.StripUnicode(rawKey)))
-			key = s.StripUnicode(rawKey)
-			if strings.HasSuffix(key, "@@@") {
-				key = rawKey
-			}
-			if debug > 0 {
-				log.Info(fmt.Sprintf("%s --> %d\n", key, cnt))
-			}
-			keys = append(keys, key)
-			n++
-			if n == packSize {
-				keysPacks = append(keysPacks, keys)
-				keys = []interface{}{}
-				n = 0
-			}
-			if key != rawKey {
-				if debug > 0 {
-					log.Info(fmt.Sprintf("special %s,%s --> %d\n", rawKey, key, cnt))
-				}
-				keys = append(keys, rawKey)
-				n++
-				if n == packSize {
-					keysPacks = append(keysPacks, keys)
-					keys = []interface{}{}
-					n = 0
-				}
-			}
-		}
-		err = rows.Err()
+	}
+	var res sql.Result
+	// s.SetOrigin()
+	if tm != nil {
+		insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) " +
+			"select uuid, name, email, is_bot, country_code, ? from profiles_archive " +
+			"where uuid = ? and archived_at = ?"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid, tm)
+	} else {
+		insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) " +
+			"select uuid, name, email, is_bot, country_code, ? from profiles_archive " +
+			"where uuid = ? order by archived_at desc limit 1"
+		res, err = s.Exec(s.db, tx, insert, s.lfid, uuid)
+	}
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("unachiving profile uuid '%s' created no data", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveProfile")
+		return
+	}
+	err = s.DeleteProfileArchive(uuid, true, tm == nil, tm, tx)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (s *service) ArchiveProfile(uuid string, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("ArchiveProfile: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("ArchiveProfile(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
+	}()
+	uuid = strings.TrimSpace(uuid)
+	if tm == nil {
+		t := time.Now()
+		tm = &t
+	}
+	insert := "insert into profiles_archive(uuid, name, email, is_bot, country_code, archived_at, last_modified_by) " +
+		"select uuid, name, email, is_bot, country_code, ?, ? from profiles where uuid = ? limit 1"
+	res, err := s.Exec(s.db, tx, insert, tm, s.lfid, uuid)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = fmt.Errorf("archiving profile uuid '%s' created no data", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveProfile")
+		return
+	}
+	return
+}
+
+func (s *service) DeleteProfile(uuid string, archive, missingFatal bool, tm *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("DeleteProfile: uuid:%s archive:%v missingFatal:%v tm:%v tx:%v", uuid, archive, missingFatal, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("DeleteProfile(exit): uuid:%s archive:%v missingFatal:%v tm:%v tx:%v err:%v", uuid, archive, missingFatal, tm, tx != nil, err))
+	}()
+	if archive {
+		err = s.ArchiveProfile(uuid, tm, tx)
 		if err != nil {
 			return
 		}
-		err = rows.Close()
+	}
+	del := "delete from profiles where uuid = ? and (locked_by is null or trim(locked_by) = '')"
+	// s.SetOrigin()
+	res, err := s.Exec(s.db, tx, del, uuid)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if missingFatal && affected == 0 {
+		err = fmt.Errorf("deleting profile uuid '%s' had no effect", uuid)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "DeleteProfile")
+		return
+	}
+	return
+}
+
+func (s *service) ValidateProfile(profileData *models.ProfileDataOutput, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("ValidateProfile: profileData:%+v tx:%v", profileData, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("ValidateProfile(exit): profileData:%+v tx:%v err:%v", profileData, tx != nil, err))
+	}()
+	if profileData.UUID == "" {
+		err = fmt.Errorf("profile '%+v' uuid is empty", s.ToLocalProfile(profileData))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
+		profileData = nil
+		return
+	}
+	if profileData.IsBot != nil && (*profileData.IsBot != 0 && *profileData.IsBot != 1) {
+		err = fmt.Errorf("profile '%+v' is_bot should be '0' or '1'", s.ToLocalProfile(profileData))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
+		return
+	}
+	if profileData.CountryCode != nil && *profileData.CountryCode != "" {
+		_, err = s.GetCountry(*profileData.CountryCode, tx)
 		if err != nil {
 			return
 		}
-		if n > 0 {
-			keysPacks = append(keysPacks, keys)
-		}
-		nKeysPacks := len(keysPacks)
-		log.Warn(fmt.Sprintf("Keys %d-packs to merge: %d\n", packSize, nKeysPacks))
-		nKeys := 0
-		for _, keys := range keysPacks {
-			nKeys += len(keys)
-		}
-		log.Warn(fmt.Sprintf("Profiles to merge: %d\n", nKeys))
-		merges := map[string]map[string]struct{}{}
-		thrN := runtime.NumCPU()
-		runtime.GOMAXPROCS(thrN)
-		var mtx *sync.Mutex
-		if thrN > 1 {
-			mtx = &sync.Mutex{}
-		}
-		processPack := func(ch chan error, i int, keys []interface{}) (err error) {
-			defer func() {
-				if ch != nil {
-					ch <- err
-				}
-			}()
-			query := fmt.Sprintf("select %s, uuid from %s where name is not null and name not like '%%-MISSING-NAME' and name not like '%%-REDACTED-EMAIL' and email is not null and %s in (", reStr, table, reStr)
-			args := []interface{}{reVal, reVal}
-			for _, key := range keys {
-				query += "?,"
-				args = append(args, key)
-			}
-			query = query[0:len(query)-1] + ")"
-			var rows *sql.Rows
-			if debug > 0 {
-				log.Info(fmt.Sprintf("#%d pack query:\n%s\n%+v\n", i, query, args))
-			}
-			rows, err = s.Query(s.db, nil, query, args...)
-			if err != nil {
-				return
-			}
-			uuid := ""
-			key := ""
-			rawKey := ""
-			uuids := make(map[string]map[string]struct{})
-			for rows.Next() {
-				err = rows.Scan(&rawKey, &uuid)
-				if err != nil {
-					return
-				}
-				// key = strings.TrimSpace(strings.ToLower(s.StripUnicode(rawKey)))
-				key = s.StripUnicode(rawKey)
-				if strings.HasSuffix(key, "@@@") {
-					key = rawKey
-				}
-				if debug > 0 {
-					log.Info(fmt.Sprintf("key: %s: uuid: %s\n", key, uuid))
-				}
-				_, ok := uuids[key]
-				if !ok {
-					uuids[key] = make(map[string]struct{})
-				}
-				uuids[key][uuid] = struct{}{}
-				if key != rawKey {
-					if debug > 0 {
-						log.Info(fmt.Sprintf("special rawKey: %s key: %s: uuid: %s\n", rawKey, key, uuid))
-					}
-					_, ok := uuids[rawKey]
-					if !ok {
-						uuids[rawKey] = make(map[string]struct{})
-					}
-				}
-			}
-			err = rows.Err()
-			if err != nil {
+	}
+	/*
+		if profileData.Gender != nil {
+			if *profileData.Gender != "male" && *profileData.Gender != "female" {
+				err = fmt.Errorf("profile '%+v' gender should be 'male' or 'female'", s.ToLocalProfile(profileData))
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
 				return
 			}
-			err = rows.Close()
-			if err != nil {
+			if profileData.GenderAcc != nil && (*profileData.GenderAcc < 1 || *profileData.GenderAcc > 100) {
+				err = fmt.Errorf("profile '%+v' gender_acc should be within [1, 100]", s.ToLocalProfile(profileData))
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
 				return
 			}
-			if mtx != nil {
-				mtx.Lock()
-			}
-			for key, ids := range uuids {
-				merges[key] = make(map[string]struct{})
-				for uuid := range ids {
-					merges[key][uuid] = struct{}{}
-				}
-			}
-			if mtx != nil {
-				mtx.Unlock()
-			}
-			nKeys := len(keys)
-			log.Warn(fmt.Sprintf("%d/%d packs %d keys\n", i+1, nKeysPacks, nKeys))
+		}
+		if profileData.Gender == nil && profileData.GenderAcc != nil {
+			err = fmt.Errorf("profile '%+v' gender_acc can only be set when gender is given", s.ToLocalProfile(profileData))
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateProfile")
 			return
 		}
-		if thrN > 1 {
-			ch := make(chan error)
-			nThreads := 0
-			for i, keys := range keysPacks {
-				go processPack(ch, i, keys)
-				nThreads++
-				if nThreads == thrN {
-					err = <-ch
-					nThreads--
-					if err != nil {
-						return
-					}
-				}
-			}
-			for nThreads > 0 {
-				err = <-ch
-				nThreads--
-				if err != nil {
-					return
-				}
-			}
-		} else {
-			for i, keys := range keysPacks {
-				err = processPack(nil, i, keys)
-				if err != nil {
-					return
-				}
-			}
+	*/
+	return
+}
+
+func (s *service) ValidateOrganization(organizationData *models.OrganizationDataOutput, forUpdate bool) (err error) {
+	log.Info(fmt.Sprintf("ValidateOrganization: organizationData:%+v forUpdate:%v", organizationData, forUpdate))
+	defer func() {
+		log.Info(fmt.Sprintf("ValidateOrganization(exit): organizationData:%+v forUpdate:%v err:%v", organizationData, forUpdate, err))
+	}()
+	if forUpdate && organizationData.ID < 1 {
+		err = fmt.Errorf("organization '%+v' missing id", organizationData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateOrganization")
+		return
+	}
+	if organizationData.Name == "" {
+		err = fmt.Errorf("organization '%+v' missing name", organizationData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateOrganization")
+		return
+	}
+	return
+}
+
+func (s *service) ValidateEnrollment(enrollmentData *models.EnrollmentDataOutput, forUpdate bool) (err error) {
+	log.Info(fmt.Sprintf("ValidateEnrollment: enrollmentData:%+v forUpdate:%v", enrollmentData, forUpdate))
+	defer func() {
+		log.Info(fmt.Sprintf("ValidateEnrollment(exit): enrollmentData:%+v forUpdate:%v err:%v", enrollmentData, forUpdate, err))
+	}()
+	if enrollmentData.Role == "" {
+		enrollmentData.Role = shared.DefaultRole
+	}
+	correctRole := false
+	for _, role := range shared.Roles {
+		if enrollmentData.Role == role {
+			correctRole = true
+			break
 		}
-		for key, uuids := range merges {
-			l := len(uuids)
-			if l <= 1 {
-				log.Warn(fmt.Sprintf("Key %+v deleted - had only %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
-				delete(merges, key)
-				continue
-			}
-			if l > 25 {
-				log.Warn(fmt.Sprintf("Key %+v deleted - had more than 25 uuids (%d): %+v\n", strings.Split(key, "@@@"), l, uuids))
-				delete(merges, key)
-				continue
-			}
-			if debug > 0 || l > 10 {
-				log.Info(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+	}
+	if !correctRole {
+		err = fmt.Errorf("enrollment '%+v' incorrect role, allowed: %+v", enrollmentData, shared.Roles)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if enrollmentData.Provenance != nil {
+		correctProvenance := false
+		for _, provenance := range shared.Provenances {
+			if *enrollmentData.Provenance == provenance {
+				correctProvenance = true
+				break
 			}
 		}
-		nMergeOps := len(merges)
-		nMerges := 0
-		for _, uuids := range merges {
-			nMerges += len(uuids) - 1
+		if !correctProvenance {
+			err = fmt.Errorf("enrollment '%+v' incorrect provenance, allowed: %+v", enrollmentData, shared.Provenances)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+			return
 		}
-		log.Warn(fmt.Sprintf("UUIDs to merge: %d in %d operations (before dedup)\n", nMerges, nMergeOps))
-		if nMergeOps == 0 || nMerges == 0 {
-			if status == "" {
-				status = table + ": Nothing to merge"
-			} else {
-				status += ", " + table + ": Nothing to merge"
-			}
-			continue
+	}
+	if enrollmentData.Confidence != nil && (*enrollmentData.Confidence < 0 || *enrollmentData.Confidence > shared.MaxConfidence) {
+		err = fmt.Errorf("enrollment '%+v' confidence must be between 0 and %d", enrollmentData, shared.MaxConfidence)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if forUpdate && enrollmentData.ID < 1 {
+		err = fmt.Errorf("enrollment '%+v' missing id", enrollmentData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if enrollmentData.ProjectSlug != nil && *(enrollmentData.ProjectSlug) == "" {
+		err = fmt.Errorf("enrollment '%+v' project_slug must be null or non-empty string", enrollmentData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if enrollmentData.UUID == "" || enrollmentData.OrganizationID < 1 {
+		err = fmt.Errorf("enrollment '%+v' missing uuid or organization_id", enrollmentData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if time.Time(enrollmentData.Start).Before(shared.MinPeriodDate) || time.Time(enrollmentData.Start).After(shared.MaxPeriodDate) {
+		err = fmt.Errorf("enrollment '%+v' start date must be between %v and %v", enrollmentData, shared.MinPeriodDate, shared.MaxPeriodDate)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if time.Time(enrollmentData.End).Before(shared.MinPeriodDate) || time.Time(enrollmentData.End).After(shared.MaxPeriodDate) {
+		err = fmt.Errorf("enrollment '%+v' end date must be between %v and %v", enrollmentData, shared.MinPeriodDate, shared.MaxPeriodDate)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	if time.Time(enrollmentData.End).Before(time.Time(enrollmentData.Start)) {
+		err = fmt.Errorf("enrollment '%+v' end date must be after start date", enrollmentData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateEnrollment")
+		return
+	}
+	return
+}
+
+func (s *service) ValidateIdentity(identityData *models.IdentityDataOutput, forUpdate bool) (err error) {
+	log.Info(fmt.Sprintf("ValidateIdentity: identityData:%+v forUpdate:%v", s.ToLocalIdentity(identityData), forUpdate))
+	defer func() {
+		log.Info(fmt.Sprintf("ValidateIdentity(exit): identityData:%+v forUpdate:%v err:%v", s.ToLocalIdentity(identityData), forUpdate, err))
+	}()
+	if forUpdate && identityData.ID == "" {
+		err = fmt.Errorf("identity '%+v' missing id", s.ToLocalIdentity(identityData))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
+		return
+	}
+	if !forUpdate {
+		if identityData.Source == "" {
+			err = fmt.Errorf("identity '%+v' missing source", s.ToLocalIdentity(identityData))
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
+			return
 		}
-		iter := 0
-		allHits := 0
-		processed := make(map[string]struct{})
-		for {
-			iter++
-			hits := 0
-			for key, uuids := range merges {
-				if debug > 0 {
-					log.Info(fmt.Sprintf("merge key:%s\n", key))
-				}
-				for uuid := range uuids {
-					if debug > 0 {
-						log.Info(fmt.Sprintf(">> key:%s,uuid:%s\n", key, uuid))
-					}
-					for key2, uuids2 := range merges {
-						if key2 == key {
-							continue
-						}
-						_, ok := processed[key]
-						if ok {
-							continue
-						}
-						_, ok = merges[key2][uuid]
-						if ok {
-							hits++
-							if debug > 1 {
-								log.Info(fmt.Sprintf("iter #%d (hits %d) %s present in %+v\n", iter, hits, uuid, uuids2))
-							}
-							for uuid2 := range uuids2 {
-								merges[key][uuid2] = struct{}{}
-							}
-							delete(merges, key2)
-						}
-					}
-				}
-				processed[key] = struct{}{}
-			}
-			log.Warn(fmt.Sprintf("Dedup step #%d finished with %d hits\n", iter, hits))
-			if hits == 0 {
-				break
-			}
-			allHits += hits
-			if iter > 50 {
-				log.Warn("Wasn't able to fully dedup in 50 steps, using single-threaded merge to avoid transaction deadlocks\n")
-				thrN = 1
-				break
-			}
+		if (identityData.Name == nil || (identityData.Name != nil && *(identityData.Name) == "")) &&
+			(identityData.Email == nil || (identityData.Email != nil && *(identityData.Email) == "")) &&
+			(identityData.Username == nil || (identityData.Username != nil && *(identityData.Username) == "")) {
+			err = fmt.Errorf("identity '%+v' you need to set at least one of (name, email, username)", s.ToLocalIdentity(identityData))
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ValidateIdentity")
+			return
 		}
-		log.Warn(fmt.Sprintf("Dedup finished with %d hits\n", allHits))
-		for key, uuids := range merges {
-			l := len(uuids)
-			if l <= 1 {
-				log.Warn(fmt.Sprintf("Key %+v deleted - had only %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
-				delete(merges, key)
-				continue
-			}
-			if l > 25 {
-				log.Warn(fmt.Sprintf("Key %+v deleted - had more than 25 uuids (%d): %+v\n", strings.Split(key, "@@@"), l, uuids))
-				delete(merges, key)
-				continue
-			}
-			if debug > 0 {
-				log.Info(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
-			}
-			if debug > 0 || l > 10 {
-				log.Warn(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
-			}
+		return
+	}
+	return
+}
+
+func (s *service) ProfileUUIDHash(profile *models.ProfileDataOutput) (idHash string, err error) {
+	log.Info(fmt.Sprintf("ProfileUUIDHash: profile:%+v", s.ToLocalProfile(profile)))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"ProfileUUIDHash(exit): profile:%+v idHash:%s err:%v",
+				s.ToLocalProfile(profile),
+				idHash,
+				err,
+			),
+		)
+	}()
+	stripF := func(str string) string {
+		isOk := func(r rune) bool {
+			return r < 32 || r >= 127
 		}
-		nMergeOps = len(merges)
-		nMerges = 0
-		for _, uuids := range merges {
-			nMerges += len(uuids) - 1
+		t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
+		str, _, _ = transform.String(t, str)
+		return str
+	}
+	name := ""
+	if profile.Name != nil {
+		name = *(profile.Name)
+	}
+	email := ""
+	if profile.Email != nil {
+		email = *(profile.Email)
+	}
+	/*
+		gender := ""
+		if profile.Gender != nil {
+			gender = *(profile.Gender)
 		}
-		log.Warn(fmt.Sprintf("UUIDs to merge: %d in %d operations (after dedup in %d steps)\n", nMerges, nMergeOps, iter))
-		if nMergeOps == 0 || nMerges == 0 {
-			if status == "" {
-				status = table + ": Nothing to merge"
-			} else {
-				status += ", " + table + ": Nothing to merge"
-			}
-			continue
+		genderAcc := ""
+		if profile.GenderAcc != nil {
+			genderAcc = fmt.Sprintf("%d", *(profile.GenderAcc))
 		}
-		currIndex := 0
-		actualMerges := 0
-		type mergeResult struct {
-			key string
-			err error
+	*/
+	isBot := ""
+	if profile.IsBot != nil {
+		isBot = fmt.Sprintf("%d", *(profile.IsBot))
+	}
+	countryCode := ""
+	if profile.CountryCode != nil {
+		countryCode = *(profile.CountryCode)
+	}
+	//arg := stripF(name) + ":" + stripF(email) + ":" + stripF(gender) + ":" + genderAcc + ":" + isBot + ":" + stripF(countryCode)
+	arg := stripF(name) + ":" + stripF(email) + ":" + isBot + ":" + stripF(countryCode)
+	hash := sha1.New()
+	_, err = hash.Write([]byte(arg))
+	if err != nil {
+		return
+	}
+	idHash = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// ToLowerAndNone takes a string if it is empty it is set to none
+// else it's contents are changed to the lower case
+func ToLowerAndNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.ToLower(value)
+}
+
+func (s *service) IdentityIDHash(identity *models.IdentityDataOutput) (idHash string, err error) {
+	log.Info(fmt.Sprintf("IdentityIDHash: identity:%+v", s.ToLocalIdentity(identity)))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"IdentityIDHash(exit): identity:%+v idHash:%s err:%v",
+				s.ToLocalIdentity(identity),
+				idHash,
+				err,
+			),
+		)
+	}()
+	stripF := func(str string) string {
+		isOk := func(r rune) bool {
+			return r < 32 || r >= 127
 		}
-		mergeFunc := func(ch chan mergeResult, key string, uuids []string) (result mergeResult) {
-			toUUID := uuids[0]
-			var err error
-			defer func() {
-				result = mergeResult{err: err, key: strings.Join(uuids, ",")}
-				if ch != nil {
-					if err != nil {
-						err = errs.Wrap(err, toUUID)
-					}
-					ch <- result
-				}
-			}()
-			query := "select uuid, count(distinct id) as cnt from identities where uuid in ("
-			args := []interface{}{}
-			for _, uuid := range uuids {
-				query += "?,"
-				args = append(args, uuid)
-			}
-			query = query[0:len(query)-1] + ") group by uuid order by cnt desc limit 1"
-			var rows *sql.Rows
-			rows, err = s.Query(s.db, nil, query, args...)
+		t := transform.Chain(norm.NFKD, transform.RemoveFunc(isOk))
+		str, _, _ = transform.String(t, str)
+		return str
+	}
+	email := ""
+	if identity.Email != nil {
+		email = *(identity.Email)
+	}
+	name := ""
+	if identity.Name != nil {
+		name = *(identity.Name)
+	}
+	username := ""
+	if identity.Username != nil {
+		username = *(identity.Username)
+	}
+	if identity.Source == "" {
+		err = fmt.Errorf("identity without source is not allowed")
+		return
+	}
+	if email == "" && name == "" && username == "" {
+		err = fmt.Errorf("identity data(name, email, username) can not be empty")
+		return
+	}
+	email = ToLowerAndNone(email)
+	name = ToLowerAndNone(name)
+	username = ToLowerAndNone(username)
+	arg := stripF(identity.Source) + ":" + stripF(email) + ":" + stripF(name) + ":" + stripF(username)
+	hash := sha1.New()
+	_, err = hash.Write([]byte(arg))
+	if err != nil {
+		return
+	}
+	idHash = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+func (s *service) AddIdentities(identities []*models.IdentityDataOutput) (status string, err error) {
+	for i, identity := range identities {
+		err = s.ValidateIdentity(identity, false)
+		if err != nil {
+			err = errs.Wrap(err, fmt.Sprintf("validate #%d identity: %v", i, s.ToLocalIdentity(identity)))
+			return
+		}
+		id := identity.ID
+		if id == "" {
+			id, err = s.IdentityIDHash(identity)
 			if err != nil {
+				err = errs.Wrap(err, fmt.Sprintf("generate id for #%d identity: %v", i, s.ToLocalIdentity(identity)))
 				return
 			}
-			cnt := 0
-			for rows.Next() {
-				err = rows.Scan(&toUUID, &cnt)
-				if err != nil {
-					return
+			identity.ID = id
+			log.Info(fmt.Sprintf("auto generated '%s' id for %v", id, s.ToLocalIdentity(identity)))
+		}
+		uuid := identity.UUID
+		if uuid == nil || (uuid != nil && *uuid == "") {
+			identity.UUID = &identity.ID
+		}
+	}
+	// Skip identities of persons erased by ForgetProfile
+	emails := []string{}
+	for _, identity := range identities {
+		for _, str := range []*string{identity.Email, identity.Username, identity.Name} {
+			if str != nil {
+				emails = append(emails, *str)
+			}
+		}
+	}
+	suppressed, err := s.suppressedEmails(emails, nil)
+	if err != nil {
+		return
+	}
+	if len(suppressed) > 0 {
+		kept := []*models.IdentityDataOutput{}
+		for _, identity := range identities {
+			skip := false
+			for _, str := range []*string{identity.Email, identity.Username, identity.Name} {
+				if str != nil {
+					if _, ok := suppressed[strings.ToLower(strings.TrimSpace(*str))]; ok {
+						skip = true
+						break
+					}
 				}
 			}
-			err = rows.Err()
-			if err != nil {
-				return
+			if !skip {
+				kept = append(kept, identity)
 			}
-			err = rows.Close()
-			if err != nil {
-				return
+		}
+		msg := fmt.Sprintf("Bulk add identities: skipped %d identities with erased emails", len(identities)-len(kept))
+		log.Info(msg)
+		status += msg + "\n"
+		identities = kept
+	}
+	bulkSize := 166
+	nIdents := len(identities)
+	emailsCache := map[string]string{}
+	emailReplacer := strings.NewReplacer(" at ", "@", " AT ", "@", " At ", "@", " dot ", ".", " DOT ", ".", " Dot ", ".", "<", "", ">", "", "`", "")
+	isValidDomain := func(domain string) (valid bool) {
+		l := len(domain)
+		if l < 4 && l > 254 {
+			return
+		}
+		dom, ok := emailsCache[domain]
+		valid = dom != ""
+		if ok {
+			// fmt.Printf("domain cache hit: '%s' -> %v\n", domain, valid)
+			return
+		}
+		defer func() {
+			var dom string
+			if valid {
+				dom = domain
 			}
-			if dry {
-				log.Info(fmt.Sprintf("dry-run: would merge %+v into %s (which has %d identities)\n", uuids, toUUID, cnt))
+			emailsCache[domain] = dom
+		}()
+		for i := 0; i < 10; i++ {
+			mx, err := net.LookupMX(domain)
+			if err == nil && len(mx) > 0 {
+				valid = true
 				return
 			}
-			if debug > 0 {
-				log.Info(fmt.Sprintf("merging %+v into %s (which has %d identities)\n", uuids, toUUID, cnt))
+		}
+		for i := 1; i <= 3; i++ {
+			mx, err := net.LookupMX(domain)
+			if err == nil && len(mx) > 0 {
+				valid = true
+				return
 			}
-			tx, err := s.db.Begin()
-			if err != nil {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		return
+	}
+	isValidEmail := func(email string, validateDomain, guess bool) (valid bool, newEmail string) {
+		l := len(email)
+		if l < 6 && l > 254 {
+			return
+		}
+		nEmail, ok := emailsCache[email]
+		if ok {
+			newEmail = nEmail
+			valid = newEmail != ""
+			return
+		}
+		defer func() {
+			emailsCache[email] = newEmail
+		}()
+		if guess {
+			email = shared.WhiteSpace.ReplaceAllString(email, " ")
+			email = strings.TrimSpace(emailReplacer.Replace(email))
+			email = strings.Split(email, " ")[0]
+		}
+		if !shared.EmailRegex.MatchString(email) {
+			return
+		}
+		if validateDomain {
+			parts := strings.Split(email, "@")
+			if len(parts) <= 1 || !isValidDomain(parts[1]) {
 				return
 			}
+		}
+		newEmail = email
+		valid = true
+		return
+	}
+	run := func() (err error) {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return
+		}
+		runOneByOne := func() (err error) {
+			log.Warn(fmt.Sprintf("Bulk add identities: falling back to one-by-one mode for %d items\n", nIdents))
+			var (
+				er  error
+				ers []error
+			)
 			defer func() {
-				if tx != nil {
-					tx.Rollback()
+				nErrs := len(ers)
+				if nErrs == 0 {
+					msg := fmt.Sprintf("Bulk add identities: one-by-one mode for %d items - all succeeded", nIdents)
+					log.Warn(msg)
+					status += msg + "\n"
+					return
+				}
+				s := fmt.Sprintf("%d errors: ", nErrs)
+				for _, er := range ers {
+					s += er.Error() + ", "
 				}
+				s = s[:len(s)-2]
+				err = fmt.Errorf("%s", s)
+				msg := fmt.Sprintf("Bulk add identities: one-by-one mode for %d items: %d errors: %v", nIdents, nErrs, err)
+				log.Warn(msg)
+				status += msg + "\n"
 			}()
-			didMerges := 0
-			nUUIDs := len(uuids)
-			froms, tos := []string{}, []string{}
-			for idx, fromUUID := range uuids {
-				if fromUUID == toUUID {
+			for i := 0; i < nIdents; i++ {
+				ident := identities[i]
+				queryU := "insert ignore into uidentities(uuid,last_modified,last_modified_by) values"
+				queryI := "insert ignore into identities(id,source,name,email,username,uuid,last_modified,last_modified_by) values"
+				queryP := "insert ignore into profiles(uuid,name,email,last_modified_by) values"
+				argsU := []interface{}{}
+				argsI := []interface{}{}
+				argsP := []interface{}{}
+				id := ident.ID
+				uuid := ident.UUID
+				source := ident.Source
+				name := ident.Name
+				username := ident.Username
+				email := ident.Email
+				if name == nil && email == nil && username == nil {
 					continue
 				}
-				_, e := s.GetUniqueIdentity(fromUUID, true, nil)
-				if e != nil {
-					err = e
-					return
+				profname := name
+				if email != nil {
+					_, semail := isValidEmail(*email, true, true)
+					email = &semail
 				}
-				toUU, e := s.GetUniqueIdentity(toUUID, true, nil)
-				if e != nil {
-					err = e
-					return
+				if profname == nil && username != nil {
+					profname = username
 				}
-				from, e := s.GetProfile(fromUUID, false, nil)
-				if e != nil {
-					err = e
-					return
+				// if username matches a real email and there is no email set, assume email=username
+				if email == nil && username != nil {
+					valid, em := isValidEmail(*username, true, true)
+					if valid {
+						email = &em
+					}
 				}
-				to, e := s.GetProfile(toUUID, false, nil)
+				// if name matches a real email and there is no email set, assume email=name
+				if email == nil && name != nil {
+					valid, em := isValidEmail(*name, true, true)
+					if valid {
+						email = &em
+					}
+				}
+				queryU += fmt.Sprintf("(?,now(),?)")
+				queryI += fmt.Sprintf("(?,?,?,?,?,?,now(),?)")
+				queryP += fmt.Sprintf("(?,?,?,?)")
+				argsU = append(argsU, uuid, s.lfid)
+				argsI = append(argsI, id, source, name, email, username, uuid, s.lfid)
+				argsP = append(argsP, uuid, profname, email, s.lfid)
+				itx, e := s.db.Begin()
 				if e != nil {
 					err = e
 					return
 				}
-				if from != nil && from.Name != nil && (strings.HasSuffix(*from.Name, "-MISSING-NAME") || strings.HasSuffix(*from.Name, "-REDACTED-EMAIL")) {
+				_, er = s.Exec(s.db, itx, queryU, argsU...)
+				if er != nil {
+					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
+					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryU, argsU, er))
+					_ = s.RollbackTx(itx)
+					ers = append(ers, er)
 					continue
 				}
-				if to != nil && to.Name != nil && (strings.HasSuffix(*to.Name, "-MISSING-NAME") || strings.HasSuffix(*to.Name, "-REDACTED-EMAIL")) {
+				_, er = s.Exec(s.db, itx, queryP, argsP...)
+				if er != nil {
+					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
+					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryP, argsP, er))
+					_ = s.RollbackTx(itx)
+					ers = append(ers, er)
 					continue
 				}
-				archivedDate := time.Now()
-				_, e = s.ArchiveUUID(fromUUID, &archivedDate, tx)
-				if e != nil {
-					err = e
-					return
+				_, er = s.Exec(s.db, itx, queryI, argsI...)
+				if er != nil {
+					er = errs.Wrap(er, fmt.Sprintf("one-by-one #%d identity: %v", i, s.ToLocalIdentity(ident)))
+					log.Warn(fmt.Sprintf("Bulk add identities: one-by-one(%d/%d): %s[%+v]: %v\n", i+1, nIdents, queryI, argsI, er))
+					_ = s.RollbackTx(itx)
+					ers = append(ers, er)
+					continue
 				}
-				_, e = s.ArchiveUUID(toUUID, &archivedDate, tx)
-				if e != nil {
-					err = e
+				err = s.CommitTx(itx)
+				if err != nil {
 					return
 				}
-				if from != nil && to != nil {
-					if to.Name == nil || (to.Name != nil && *to.Name == "") {
-						to.Name = from.Name
-					}
-					if to.Email == nil || (to.Email != nil && *to.Email == "") {
-						to.Email = from.Email
-					}
-					if to.CountryCode == nil || (to.CountryCode != nil && *to.CountryCode == "") {
-						to.CountryCode = from.CountryCode
-					}
-					/*
-						if to.Gender == nil || (to.Gender != nil && *to.Gender == "") {
-							to.Gender = from.Gender
-							to.GenderAcc = from.GenderAcc
-						}
-					*/
-					if from.IsBot != nil && *from.IsBot == 1 {
-						isBot := int64(1)
-						to.IsBot = &isBot
-					}
-					// Update profile and refresh after update
-					to, e = s.EditProfile(to, true, tx)
-					if e != nil {
-						err = e
-						return
-					}
+				itx = nil
+			}
+			return
+		}
+		defer func() {
+			if tx != nil {
+				msg := fmt.Sprintf("Bulk insert identities failed, rolling back %d identities insert", nIdents)
+				log.Warn(msg)
+				status += msg + "\n"
+				s.RollbackTx(tx)
+				err = runOneByOne()
+			}
+		}()
+		nPacks := nIdents / bulkSize
+		if nIdents%bulkSize != 0 {
+			nPacks++
+		}
+		for i := 0; i < nPacks; i++ {
+			from := i * bulkSize
+			to := from + bulkSize
+			if to > nIdents {
+				to = nIdents
+			}
+			queryU := "insert ignore into uidentities(uuid,last_modified,last_modified_by) values"
+			queryI := "insert ignore into identities(id,source,name,email,username,uuid,last_modified,last_modified_by) values"
+			queryP := "insert ignore into profiles(uuid,name,email,last_modified_by) values"
+			argsU := []interface{}{}
+			argsI := []interface{}{}
+			argsP := []interface{}{}
+			for j := from; j < to; j++ {
+				ident := identities[j]
+				id := ident.ID
+				uuid := ident.UUID
+				source := ident.Source
+				name := ident.Name
+				username := ident.Username
+				email := ident.Email
+				if name == nil && email == nil && username == nil {
+					continue
 				}
-				identities, e := s.GetUniqueIdentityIdentities(fromUUID, false, tx)
-				if e != nil {
-					err = e
-					return
-				}
-				for _, identity := range identities {
-					e = s.MoveIdentityToUniqueIdentity(identity, toUU, false, tx)
-					if e != nil {
-						err = e
-						return
-					}
+				profname := name
+				if profname == nil && username != nil {
+					profname = username
 				}
-				enrollments, e := s.GetUniqueIdentityEnrollments(fromUUID, false, tx)
-				if e != nil {
-					err = e
-					return
+				if email != nil {
+					_, semail := isValidEmail(*email, true, true)
+					email = &semail
 				}
-				for _, rol := range enrollments {
-					rols := []*models.EnrollmentDataOutput{}
-					rols, e = s.FindEnrollments(
-						[]string{"uuid", "organization_id", "start", "end", "project_slug", "role"},
-						[]interface{}{toUUID, rol.OrganizationID, rol.Start, rol.End, rol.ProjectSlug, rol.Role},
-						[]bool{false, false, true, true, false, false},
-						false,
-						tx,
-					)
-					if e != nil {
-						err = e
-						return
-					}
-					if len(rols) == 0 {
-						e = s.MoveEnrollmentToUniqueIdentity(rol, toUU, tx)
-						if e != nil {
-							err = e
-							return
-						}
+				// if username matches a real email and there is no email set, assume email=username
+				//if email == nil && username != nil && isValidEmail(*username) {
+				if email == nil && username != nil {
+					valid, em := isValidEmail(*username, true, true)
+					if valid {
+						email = &em
 					}
 				}
-				// Delete unique identity archiving it to uidentities_archive
-				e = s.DeleteUniqueIdentity(fromUUID, false, true, nil, tx)
-				if e != nil {
-					err = e
-					return
-				}
-				orgs, e := s.FindUniqueIdentityOrganizations(toUUID, false, tx)
-				if e != nil {
-					err = e
-					return
-				}
-				for _, org := range orgs {
-					e = s.MergeEnrollments(toUU, org, nil, true, true, tx)
-					if e != nil {
-						err = e
-						return
+				// if name matches a real email and there is no email set, assume email=name
+				//if email == nil && name != nil && isValidEmail(*name) {
+				if email == nil && name != nil {
+					valid, em := isValidEmail(*name, true, true)
+					if valid {
+						email = &em
 					}
 				}
-				didMerges++
-				if debug > 0 {
-					fmt.Printf("merged %d/%d %s --> %s\n", idx+1, nUUIDs, fromUUID, toUUID)
-				}
-				froms = append(froms, fromUUID)
-				tos = append(tos, toUUID)
+				queryU += fmt.Sprintf("(?,now(),?),")
+				queryI += fmt.Sprintf("(?,?,?,?,?,?,now(),?),")
+				queryP += fmt.Sprintf("(?,?,?,?),")
+				argsU = append(argsU, uuid, s.lfid)
+				argsI = append(argsI, id, source, name, email, username, uuid, s.lfid)
+				argsP = append(argsP, uuid, profname, email, s.lfid)
 			}
-			err = tx.Commit()
+			queryU = queryU[:len(queryU)-1]
+			queryI = queryI[:len(queryI)-1]
+			queryP = queryP[:len(queryP)-1]
+			_, err = s.Exec(s.db, tx, queryU, argsU...)
 			if err != nil {
 				return
 			}
-			// Set tx to nil, so deferred rollback will not happen
-			tx = nil
-			if mtx != nil {
-				mtx.Lock()
-			}
-			currIndex++
-			i := currIndex
-			actualMerges += didMerges
-			soFar := actualMerges
-			if mtx != nil {
-				mtx.Unlock()
-			}
-			if debug > 0 {
-				log.Info(fmt.Sprintf("merged %d %+v\n", nUUIDs, uuids))
+			_, err = s.Exec(s.db, tx, queryP, argsP...)
+			if err != nil {
+				return
 			}
-			log.Info(fmt.Sprintf("%d/%d merges (%s, %d profiles, %d merges so far)\n", i, nMergeOps, key, nUUIDs, soFar))
-			for ui := range froms {
-				fromUUID := froms[ui]
-				toUUID := tos[ui]
-				esLog.Log(fmt.Sprintf("User '%s' auto merged profile uuid '%s' into profile uuid '%s' (API: 'MergeAll')", username, fromUUID, toUUID), username, "MergeAll")
+			_, err = s.Exec(s.db, tx, queryI, argsI...)
+			if err != nil {
+				return
 			}
-			return
 		}
-		nErrs := 0
-		errsStr := ""
-		merging := make(map[string]struct{})
-		nProc := 0
-		infoMerging := func() {
-			if debug > 0 && nProc%10 == 0 {
-				log.Info(fmt.Sprintf("currently merging %d (%d/%d finished): %+v\n", len(merging), nProc, nMergeOps, merging))
-			}
+		// Will not commit in dry-run mode, deferred function will rollback - so we can still test any errors
+		// but the final commit is replaced with rollback
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
 		}
-		if thrN > 1 {
-			ch := make(chan mergeResult)
-			nThreads := 0
-			for key, uuidsMap := range merges {
-				uuids := []string{}
-				for uuid := range uuidsMap {
-					uuids = append(uuids, uuid)
-				}
-				merging[strings.Join(uuids, ",")] = struct{}{}
-				go mergeFunc(ch, key, uuids[:])
-				nThreads++
-				if nThreads == thrN {
-					res := <-ch
-					delete(merging, res.key)
-					e := res.err
-					nThreads--
-					if e != nil {
-						log.Warn("Merge error: " + e.Error())
-						errsStr += e.Error() + " "
-						nErrs++
-					}
-					nProc++
-					infoMerging()
-				}
-			}
-			for nThreads > 0 {
-				res := <-ch
-				delete(merging, res.key)
-				e := res.err
-				nThreads--
-				if e != nil {
-					log.Warn("Merge error: " + e.Error())
-					errsStr += e.Error() + " "
-					nErrs++
-				}
-				nProc++
-				infoMerging()
-			}
-		} else {
-			for key, uuidsMap := range merges {
-				uuids := []string{}
-				for uuid := range uuidsMap {
-					uuids = append(uuids, uuid)
-				}
-				merging[strings.Join(uuids, ",")] = struct{}{}
-				res := mergeFunc(nil, key, uuids)
-				delete(merging, res.key)
-				e := res.err
-				if e != nil {
-					log.Warn("Merge error: " + e.Error())
-					errsStr += e.Error() + " "
-					nErrs++
-				}
-				nProc++
-				infoMerging()
-			}
+		tx = nil
+		return
+	}
+	err = run()
+	if err != nil {
+		return
+	}
+	status += fmt.Sprintf("Bulk added %d identities\n", nIdents)
+	return
+}
+
+func (s *service) AddNestedIdentity(identity *models.IdentityDataOutput) (uid *models.UniqueIdentityNestedDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddNestedIdentity: identity:%+v", s.ToLocalIdentity(identity)))
+	// s.SetOrigin()
+	uid = &models.UniqueIdentityNestedDataOutput{}
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"AddNestedIdentity(exit): identity:%+v uid:%+v err:%v",
+				s.ToLocalIdentity(identity),
+				s.ToLocalNestedUniqueIdentity(uid),
+				err,
+			),
+		)
+	}()
+	err = s.ValidateIdentity(identity, false)
+	if err != nil {
+		uid = nil
+		return
+	}
+	idHash := ""
+	idHash, err = s.IdentityIDHash(identity)
+	if err != nil {
+		uid = nil
+		return
+	}
+	email := ""
+	if identity.Email != nil {
+		email = *(identity.Email)
+	}
+	name := ""
+	if identity.Name != nil {
+		name = *(identity.Name)
+	}
+	username := ""
+	if identity.Username != nil {
+		username = *(identity.Username)
+	}
+	identity.ID = idHash
+	var identities []*models.IdentityDataOutput
+	identities, err = s.FindIdentities(
+		[]string{"source", "email", "name", "username"},
+		[]interface{}{identity.Source, identity.Email, identity.Name, identity.Username},
+		[]bool{false, false, false, false},
+		false,
+		nil,
+	)
+	if err != nil {
+		uid = nil
+		return
+	}
+	if len(identities) > 0 {
+		err = fmt.Errorf("Identity (source, email, name, username) = (%s, %s, %s, %s) already exists", identity.Source, email, name, username)
+		err = errs.Wrap(errs.New(err, errs.ErrConflict), "AddNestedIdentity")
+		uid = nil
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if tx != nil {
+			s.RollbackTx(tx)
 		}
-		sep := ""
-		if status == "" {
-			sep = table
-		} else {
-			sep = ", " + table
+	}()
+	profile := &models.ProfileDataOutput{}
+	if identity.UUID != nil {
+		_, err = s.GetUniqueIdentity(*(identity.UUID), true, nil)
+		if err != nil {
+			uid = nil
+			return
+		}
+		profile, err = s.GetProfile(*(identity.UUID), false, nil)
+		if err != nil {
+			uid = nil
+			return
+		}
+	} else {
+		_, err = s.AddUniqueIdentity(
+			&models.UniqueIdentityDataOutput{
+				UUID: identity.ID,
+			},
+			false,
+			tx,
+		)
+		if err != nil {
+			return
+		}
+		profile, err = s.AddProfile(
+			&models.ProfileDataOutput{
+				UUID:  identity.ID,
+				Name:  identity.Name,
+				Email: identity.Email,
+			},
+			false,
+			tx,
+		)
+		if err != nil {
+			return
+		}
+		identity.UUID = &(identity.ID)
+	}
+	_, err = s.AddIdentity(identity, false, false, tx)
+	if err != nil {
+		return
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	uid.UUID = *identity.UUID
+	uid.LastModified = s.Now()
+	uid.Profile = profile
+	uid.Identities = append(uid.Identities, identity)
+	tx = nil
+	return
+}
+
+func (s *service) AddIdentity(inIdentityData *models.IdentityDataOutput, ignore, refresh bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddIdentity: inIdentityData:%+v ignore:%v refresh:%v tx:%v", s.ToLocalIdentity(inIdentityData), ignore, refresh, tx != nil))
+	identityData = inIdentityData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"AddIdentity(exit): inIdentityData:%+v ignore:%v refresh:%v tx:%v identityData:%+v err:%v",
+				s.ToLocalIdentity(inIdentityData),
+				ignore,
+				refresh,
+				tx != nil,
+				s.ToLocalIdentity(identityData),
+				err,
+			),
+		)
+	}()
+	s.SanitizeIdentity(identityData)
+	if identityData.LastModified == nil {
+		identityData.LastModified = s.Now()
+	}
+	err = s.ValidateIdentity(identityData, false)
+	if err != nil {
+		identityData = nil
+		return
+	}
+	root := "insert"
+	if ignore {
+		root += " ignore"
+	}
+	insert := root + " into identities(id, uuid, source, name, email, username, last_modified, last_modified_by) select ?, ?, ?, ?, ?, ?, str_to_date(?, ?), ?"
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(
+		s.db,
+		tx,
+		insert,
+		identityData.ID,
+		identityData.UUID,
+		identityData.Source,
+		identityData.Name,
+		identityData.Email,
+		identityData.Username,
+		identityData.LastModified,
+		DateTimeFormat,
+		s.lfid,
+	)
+	if err != nil {
+		identityData = nil
+		return
+	}
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		identityData = nil
+		return
+	}
+	if affected > 1 {
+		err = fmt.Errorf("identity '%+v' insert affected %d rows", s.ToLocalIdentity(identityData), affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
+		identityData = nil
+		return
+	} else if affected == 1 {
+		affected2 := int64(0)
+		// Mark identity's matching unique identity as modified
+		if identityData.UUID != nil {
+			// Email domains can be used to infer affiliation
+			s.invalidateAffiliationCacheTx(tx, *(identityData.UUID))
+			affected2, err = s.TouchUniqueIdentity(*(identityData.UUID), tx)
+			if err != nil {
+				identityData = nil
+				return
+			}
+			if affected2 != 1 {
+				err = fmt.Errorf("identity '%+v' unique identity update affected %d rows", s.ToLocalIdentity(identityData), affected2)
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
+				identityData = nil
+				return
+			}
+		}
+	} else {
+		if !ignore {
+			err = fmt.Errorf("adding identity '%+v' didn't affected any rows", s.ToLocalIdentity(identityData))
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddIdentity")
+			identityData = nil
+			return
+		}
+	}
+	if refresh {
+		identityData, err = s.GetIdentity(identityData.ID, true, tx)
+		if err != nil {
+			identityData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) FindIdentities(columns []string, values []interface{}, isDate []bool, missingFatal bool, tx *sql.Tx) (identities []*models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("FindIdentities: columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v", columns, values, isDate, missingFatal, tx != nil))
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"FindIdentities(exit): columns:%+v values:%+v isDate:%+v missingFatal:%v tx:%v identities:%+v err:%v",
+				columns,
+				values,
+				isDate,
+				missingFatal,
+				tx != nil,
+				s.ToLocalIdentities(identities),
+				err,
+			),
+		)
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	sel := "select id, name, email, username, source, uuid, last_modified from identities"
+	vals := []interface{}{}
+	nColumns := len(columns)
+	lastIndex := nColumns - 1
+	if nColumns > 0 {
+		sel += " where"
+	}
+	for index := range columns {
+		column := columns[index]
+		value := values[index]
+		date := isDate[index]
+		isNil := false
+		v, ok := value.(*string)
+		if ok {
+			isNil = v == nil
+		}
+		if isNil {
+			sel += " " + column + " is null"
+		} else {
+			if date {
+				sel += " " + column + " = str_to_date(?, ?)"
+				vals = append(vals, value)
+				vals = append(vals, DateTimeFormat)
+			} else {
+				sel += " " + column + " = ?"
+				vals = append(vals, value)
+			}
+		}
+		if index < lastIndex {
+			sel += " and"
+		}
+	}
+	sel += " order by id"
+	rows, err := s.Query(sdb, tx, sel, vals...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		identity := &models.IdentityDataOutput{}
+		err = rows.Scan(
+			&identity.ID,
+			&identity.Name,
+			&identity.Email,
+			&identity.Username,
+			&identity.Source,
+			&identity.UUID,
+			&identity.LastModified,
+		)
+		if err != nil {
+			return
+		}
+		identities = append(identities, identity)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if missingFatal && len(identities) == 0 {
+		err = fmt.Errorf("cannot find identities for %+v/%+v", columns, values)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "FindIdentities")
+		return
+	}
+	return
+}
+
+func (s *service) AddNestedUniqueIdentity(uuid string) (uid *models.UniqueIdentityNestedDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddNestedUniqueIdentity: uuid:%s", uuid))
+	// s.SetOrigin()
+	uid = &models.UniqueIdentityNestedDataOutput{}
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"AddNestedUniqueIdentity(exit): uuid:%s uid:%+v err:%v",
+				uuid,
+				s.ToLocalNestedUniqueIdentity(uid),
+				err,
+			),
+		)
+	}()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if tx != nil {
+			s.RollbackTx(tx)
+		}
+	}()
+	_, err = s.AddUniqueIdentity(
+		&models.UniqueIdentityDataOutput{
+			UUID: uuid,
+		},
+		false,
+		tx,
+	)
+	if err != nil {
+		return
+	}
+	profile := &models.ProfileDataOutput{}
+	profile, err = s.AddProfile(
+		&models.ProfileDataOutput{
+			UUID: uuid,
+		},
+		false,
+		tx,
+	)
+	if err != nil {
+		return
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	tx = nil
+	uid.UUID = uuid
+	uid.LastModified = s.Now()
+	uid.Profile = profile
+	return
+}
+
+func (s *service) AddProfile(inProfileData *models.ProfileDataOutput, refresh bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddProfile: inProfileData:%+v refresh:%v tx:%v", s.ToLocalProfile(inProfileData), refresh, tx != nil))
+	profileData = inProfileData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"AddProfile(exit): inProfileData:%+v refresh:%v tx:%v profileData:%+v err:%v",
+				s.ToLocalProfile(inProfileData),
+				refresh,
+				tx != nil,
+				s.ToLocalProfile(profileData),
+				err,
+			),
+		)
+	}()
+	s.SanitizeProfile(profileData)
+	err = s.ValidateProfile(profileData, tx)
+	if err != nil {
+		profileData = nil
+		return
+	}
+	//insert := "insert into profiles(uuid, name, email, gender, gender_acc, is_bot, country_code) select ?, ?, ?, ?, ?, ?, ?"
+	insert := "insert into profiles(uuid, name, email, is_bot, country_code, last_modified_by) select ?, ?, ?, ?, ?, ?"
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(
+		s.db,
+		tx,
+		insert,
+		profileData.UUID,
+		profileData.Name,
+		profileData.Email,
+		//profileData.Gender,
+		//profileData.GenderAcc,
+		profileData.IsBot,
+		profileData.CountryCode,
+		s.lfid,
+	)
+	if err != nil {
+		profileData = nil
+		return
+	}
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		profileData = nil
+		return
+	}
+	if affected > 1 {
+		err = fmt.Errorf("profile '%+v' insert affected %d rows", s.ToLocalProfile(profileData), affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
+		profileData = nil
+		return
+	} else if affected == 1 {
+		affected2 := int64(0)
+		// Mark profile's matching unique identity as modified
+		affected2, err = s.TouchUniqueIdentity(profileData.UUID, tx)
+		if err != nil {
+			profileData = nil
+			return
+		}
+		if affected2 != 1 {
+			err = fmt.Errorf("profile '%+v' unique identity update affected %d rows", s.ToLocalProfile(profileData), affected2)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
+			profileData = nil
+			return
+		}
+	} else {
+		err = fmt.Errorf("adding profile '%+v' didn't affected any rows", s.ToLocalProfile(profileData))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddProfile")
+		profileData = nil
+		return
+	}
+	if refresh {
+		profileData, err = s.GetProfile(profileData.UUID, true, tx)
+		if err != nil {
+			profileData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) AddEnrollment(inEnrollmentData *models.EnrollmentDataOutput, ignore, refresh bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("AddEnrollment: inEnrollmentData:%+v ignore:%v refresh:%v tx:%v", inEnrollmentData, ignore, refresh, tx != nil))
+	enrollmentData = inEnrollmentData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"AddEnrollment(exit): inEnrollmentData:%+v ignore:%v refresh:%v tx:%v enrollmentData:%+v err:%v",
+				inEnrollmentData,
+				ignore,
+				refresh,
+				tx != nil,
+				enrollmentData,
+				err,
+			),
+		)
+	}()
+	if enrollmentData.Role == "" {
+		enrollmentData.Role = shared.DefaultRole
+	}
+	err = s.ValidateEnrollment(enrollmentData, false)
+	if err != nil {
+		enrollmentData = nil
+		return
+	}
+	root := "insert"
+	if ignore {
+		root += " ignore"
+	}
+	insert := root + " into enrollments(uuid, organization_id, role, start, end, project_slug, provenance, evidence_url, evidence_notes, confidence, last_modified_by) " +
+		"select ?, ?, ?, str_to_date(?, ?), str_to_date(?, ?), ?, ?, ?, ?, ?, ?"
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(
+		s.db,
+		tx,
+		insert,
+		enrollmentData.UUID,
+		enrollmentData.OrganizationID,
+		enrollmentData.Role,
+		enrollmentData.Start,
+		DateTimeFormat,
+		enrollmentData.End,
+		DateTimeFormat,
+		enrollmentData.ProjectSlug,
+		enrollmentData.Provenance,
+		enrollmentData.EvidenceURL,
+		enrollmentData.EvidenceNotes,
+		enrollmentData.Confidence,
+		s.lfid,
+	)
+	if err != nil {
+		enrollmentData = nil
+		return
+	}
+	s.invalidateAffiliationCacheTx(tx, enrollmentData.UUID)
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		enrollmentData = nil
+		return
+	}
+	if affected > 1 {
+		err = fmt.Errorf("enrollment '%+v' insert affected %d rows", enrollmentData, affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
+		enrollmentData = nil
+		return
+	} else if affected == 1 {
+		affected2 := int64(0)
+		// Mark enrollment's matching unique identity as modified
+		affected2, err = s.TouchUniqueIdentity(enrollmentData.UUID, tx)
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+		if affected2 != 1 {
+			err = fmt.Errorf("enrollment '%+v' unique identity update affected %d rows", enrollmentData, affected2)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
+			enrollmentData = nil
+			return
+		}
+	} else {
+		if !ignore {
+			err = fmt.Errorf("adding enrollment '%+v' didn't affected any rows", enrollmentData)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "AddEnrollment")
+			enrollmentData = nil
+			return
+		}
+	}
+	if refresh {
+		id := int64(0)
+		id, err = res.LastInsertId()
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+		enrollmentData.ID = id
+		enrollmentData, err = s.GetEnrollment(enrollmentData.ID, true, tx)
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) EditOrganization(inOrganizationData *models.OrganizationDataOutput, refresh bool, tx *sql.Tx) (organizationData *models.OrganizationDataOutput, err error) {
+	log.Info(fmt.Sprintf("EditOrganization: inOrganizationData:%+v refresh:%v tx:%v", inOrganizationData, refresh, tx != nil))
+	organizationData = inOrganizationData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"EditOrganization(exit): inOrganizationData:%+v refresh:%v tx:%v organizationData:%+v err:%v",
+				inOrganizationData,
+				refresh,
+				tx != nil,
+				organizationData,
+				err,
+			),
+		)
+	}()
+	defer s.invalidateAffiliationCacheTx(tx)
+	organizationData.Name = strings.TrimSpace(organizationData.Name)
+	err = s.ValidateOrganization(organizationData, true)
+	if err != nil {
+		err = fmt.Errorf("organization '%+v' didn't pass update validation", organizationData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditOrganization")
+		organizationData = nil
+		return
+	}
+	update := "update organizations set name = ?, last_modified_by = ? where id = ?"
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(
+		s.db,
+		tx,
+		update,
+		organizationData.Name,
+		s.lfid,
+		organizationData.ID,
+	)
+	if err != nil {
+		organizationData = nil
+		return
+	}
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		organizationData = nil
+		return
+	}
+	if affected == 0 {
+		log.Info(fmt.Sprintf("EditOrganization: organization '%+v' update didn't affected any rows", organizationData))
+	}
+	if refresh {
+		organizationData, err = s.GetOrganization(organizationData.ID, true, tx)
+		if err != nil {
+			organizationData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) EditEnrollment(inEnrollmentData *models.EnrollmentDataOutput, refresh bool, tx *sql.Tx) (enrollmentData *models.EnrollmentDataOutput, err error) {
+	log.Info(fmt.Sprintf("EditEnrollment: inEnrollmentData:%+v refresh:%v tx:%v", inEnrollmentData, refresh, tx != nil))
+	enrollmentData = inEnrollmentData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"EditEnrollment(exit): inEnrollmentData:%+v refresh:%v tx:%v enrollmentData:%+v err:%v",
+				inEnrollmentData,
+				refresh,
+				tx != nil,
+				enrollmentData,
+				err,
+			),
+		)
+	}()
+	if enrollmentData.Role == "" {
+		enrollmentData.Role = shared.DefaultRole
+	}
+	err = s.ValidateEnrollment(enrollmentData, true)
+	if err != nil {
+		err = fmt.Errorf("enrollment '%+v' didn't pass update validation", enrollmentData)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
+		enrollmentData = nil
+		return
+	}
+	// With enrollment history enabled previous version is archived, so enrollments can be reconstructed as of any time (see GetUniqueIdentityNestedAsOf)
+	if shared.GEnrollmentHistory {
+		_, err = s.Exec(s.db, tx, enrollmentsArchiveInsert("id = ? and (locked_by is null or trim(locked_by) = '')"), time.Now(), s.lfid, enrollmentData.ID)
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+	}
+	update := "update enrollments set uuid = ?, organization_id = ?, start = str_to_date(?, ?), end = str_to_date(?, ?), project_slug = ?, role = ?, " +
+		"provenance = ?, evidence_url = ?, evidence_notes = ?, confidence = ?, last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')"
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(
+		s.db,
+		tx,
+		update,
+		enrollmentData.UUID,
+		enrollmentData.OrganizationID,
+		enrollmentData.Start,
+		DateTimeFormat,
+		enrollmentData.End,
+		DateTimeFormat,
+		enrollmentData.ProjectSlug,
+		enrollmentData.Role,
+		enrollmentData.Provenance,
+		enrollmentData.EvidenceURL,
+		enrollmentData.EvidenceNotes,
+		enrollmentData.Confidence,
+		s.lfid,
+		enrollmentData.ID,
+	)
+	if err != nil {
+		enrollmentData = nil
+		return
+	}
+	s.invalidateAffiliationCacheTx(tx, enrollmentData.UUID)
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		enrollmentData = nil
+		return
+	}
+	if affected > 1 {
+		err = fmt.Errorf("enrollment '%+v' update affected %d rows", enrollmentData, affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
+		enrollmentData = nil
+		return
+	} else if affected == 1 {
+		affected2 := int64(0)
+		// Mark enrollment's matching unique identity as modified
+		affected2, err = s.TouchUniqueIdentity(enrollmentData.UUID, tx)
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+		if affected2 != 1 {
+			err = fmt.Errorf("enrollment '%+v' unique identity update affected %d rows", enrollmentData, affected2)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditEnrollment")
+			enrollmentData = nil
+			return
+		}
+	} else {
+		log.Info(fmt.Sprintf("EditEnrollment: enrollment '%+v' update didn't affected any rows", enrollmentData))
+	}
+	if refresh {
+		enrollmentData, err = s.GetEnrollment(enrollmentData.ID, true, tx)
+		if err != nil {
+			enrollmentData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) EditIdentity(inIdentityData *models.IdentityDataOutput, refresh bool, tx *sql.Tx) (identityData *models.IdentityDataOutput, err error) {
+	log.Info(fmt.Sprintf("EditIdentity: inIdentityData:%+v refresh:%v tx:%v", s.ToLocalIdentity(inIdentityData), refresh, tx != nil))
+	identityData = inIdentityData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"EditIdentity(exit): inIdentityData:%+v refresh:%v tx:%v identityData:%+v err:%v",
+				s.ToLocalIdentity(inIdentityData),
+				refresh,
+				tx != nil,
+				s.ToLocalIdentity(identityData),
+				err,
+			),
+		)
+	}()
+	s.SanitizeIdentity(identityData)
+	if identityData.ID == "" || identityData.Source == "" {
+		err = fmt.Errorf("identity '%+v' missing id or source", s.ToLocalIdentity(identityData))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
+		identityData = nil
+		return
+	}
+	if identityData.LastModified == nil {
+		identityData.LastModified = s.Now()
+	}
+	columns := []string{"id", "uuid", "source"}
+	values := []interface{}{identityData.ID, identityData.UUID, identityData.Source}
+	if identityData.Name != nil && *identityData.Name != "" {
+		columns = append(columns, "name")
+		values = append(values, *identityData.Name)
+	}
+	if identityData.Username != nil && *identityData.Username != "" {
+		columns = append(columns, "username")
+		values = append(values, *identityData.Username)
+	}
+	if identityData.Email != nil && *identityData.Email != "" {
+		columns = append(columns, "email")
+		values = append(values, *identityData.Email)
+	}
+	update := "update identities set "
+	for _, column := range columns {
+		update += fmt.Sprintf("%s = ?, ", column)
+	}
+	update += " last_modified = str_to_date(?, ?), last_modified_by = ? where id = ? and (locked_by is null or trim(locked_by) = '')"
+	values = append(values, identityData.LastModified)
+	values = append(values, DateTimeFormat)
+	values = append(values, s.lfid)
+	values = append(values, identityData.ID)
+	var res sql.Result
+	// s.SetOrigin()
+	res, err = s.Exec(s.db, tx, update, values...)
+	if err != nil {
+		identityData = nil
+		return
+	}
+	affected := int64(0)
+	affected, err = res.RowsAffected()
+	if err != nil {
+		identityData = nil
+		return
+	}
+	if affected > 1 {
+		err = fmt.Errorf("identity '%+v' update affected %d rows", s.ToLocalIdentity(identityData), affected)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
+		identityData = nil
+		return
+	} else if affected == 1 {
+		affected2 := int64(0)
+		// Mark identity's matching unique identity as modified
+		if identityData.UUID != nil {
+			// Email domains can be used to infer affiliation
+			s.invalidateAffiliationCacheTx(tx, *(identityData.UUID))
+			affected2, err = s.TouchUniqueIdentity(*(identityData.UUID), tx)
+			if err != nil {
+				identityData = nil
+				return
+			}
+			if affected2 != 1 {
+				err = fmt.Errorf("identity '%+v' unique identity update affected %d rows", s.ToLocalIdentity(identityData), affected2)
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditIdentity")
+				identityData = nil
+				return
+			}
+		}
+	} else {
+		log.Info(fmt.Sprintf("EditIdentity: identity '%+v' update didn't affected any rows", s.ToLocalIdentity(identityData)))
+	}
+	if refresh {
+		identityData, err = s.GetIdentity(identityData.ID, true, tx)
+		if err != nil {
+			identityData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) EditProfile(inProfileData *models.ProfileDataOutput, refresh bool, tx *sql.Tx) (profileData *models.ProfileDataOutput, err error) {
+	log.Info(fmt.Sprintf("EditProfile: inProfileData:%+v refresh:%v tx:%v", s.ToLocalProfile(inProfileData), refresh, tx != nil))
+	profileData = inProfileData
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"EditProfile(exit): inProfileData:%+v refresh:%v tx:%v profileData:%+v err:%v",
+				s.ToLocalProfile(inProfileData),
+				refresh,
+				tx != nil,
+				s.ToLocalProfile(profileData),
+				err,
+			),
+		)
+	}()
+	s.SanitizeProfile(profileData)
+	err = s.ValidateProfile(profileData, tx)
+	if err != nil {
+		profileData = nil
+		return
+	}
+	columns := []string{}
+	values := []interface{}{}
+	if profileData.Name != nil && *profileData.Name != "" {
+		columns = append(columns, "name")
+		values = append(values, *profileData.Name)
+	}
+	if profileData.Email != nil && *profileData.Email != "" {
+		columns = append(columns, "email")
+		values = append(values, *profileData.Email)
+	}
+	// Database doesn't have null, but we can use to to call EditProfile and skip updating is_bot
+	if profileData.IsBot != nil {
+		columns = append(columns, "is_bot")
+		values = append(values, *profileData.IsBot)
+	}
+	if profileData.CountryCode != nil && *profileData.CountryCode != "" {
+		columns = append(columns, "country_code")
+		values = append(values, *profileData.CountryCode)
+	}
+	/*
+		if profileData.Gender != nil {
+			columns = append(columns, "gender")
+			values = append(values, *profileData.Gender)
+			columns = append(columns, "gender_acc")
+			if profileData.GenderAcc == nil {
+				values = append(values, 100)
+			} else {
+				values = append(values, *profileData.GenderAcc)
+			}
+		}
+	*/
+	nColumns := len(columns)
+	if nColumns > 0 {
+		update := "update profiles set "
+		for _, column := range columns {
+			update += fmt.Sprintf("%s = ?, ", column)
+		}
+		update += "last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')"
+		values = append(values, s.lfid)
+		values = append(values, profileData.UUID)
+		var res sql.Result
+		// s.SetOrigin()
+		res, err = s.Exec(s.db, tx, update, values...)
+		if err != nil {
+			profileData = nil
+			return
+		}
+		// Email domains can be used to infer affiliation
+		s.invalidateAffiliationCacheTx(tx, profileData.UUID)
+		affected := int64(0)
+		affected, err = res.RowsAffected()
+		if err != nil {
+			profileData = nil
+			return
+		}
+		if affected > 1 {
+			err = fmt.Errorf("profile '%+v' update affected %d rows", s.ToLocalProfile(profileData), affected)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditProfile")
+			profileData = nil
+			return
+		} else if affected == 1 {
+			affected2 := int64(0)
+			// Mark profile's unique identity as modified
+			affected2, err = s.TouchUniqueIdentity(profileData.UUID, tx)
+			if err != nil {
+				profileData = nil
+				return
+			}
+			if affected2 != 1 {
+				err = fmt.Errorf("profile '%+v' unique identity update affected %d rows", s.ToLocalProfile(profileData), affected2)
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "EditProfile")
+				profileData = nil
+				return
+			}
+		} else {
+			log.Info(fmt.Sprintf("EditProfile: profile '%+v' update didn't affected any rows", s.ToLocalProfile(profileData)))
+		}
+	} else {
+		log.Info(fmt.Sprintf("EditProfile: profile '%+v' nothing to update", s.ToLocalProfile(profileData)))
+	}
+	if refresh {
+		profileData, err = s.GetProfile(profileData.UUID, true, tx)
+		if err != nil {
+			profileData = nil
+			return
+		}
+	}
+	return
+}
+
+func (s *service) UnarchiveUUID(uuid string, tm time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("UnarchiveUUID: uuid:%s tm:%v tx:%v", uuid, tm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("UnarchiveUUID(exit): uuid:%s tm:%v tx:%v err:%v", uuid, tm, tx != nil, err))
+	}()
+	if uuid == "" {
+		err = fmt.Errorf("cannot unarchive empty uuid")
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveUUID")
+		return
+	}
+	defer s.invalidateAffiliationCacheTx(tx, uuid)
+	err = s.UnarchiveUniqueIdentity(uuid, true, &tm, tx)
+	if err != nil {
+		return
+	}
+	err = s.UnarchiveProfile(uuid, true, &tm, tx)
+	if err != nil {
+		return
+	}
+	identities, err := s.GetArchiveUniqueIdentityIdentities(uuid, tm, false, tx)
+	if err != nil {
+		return
+	}
+	for _, identity := range identities {
+		err = s.UnarchiveIdentity(identity.ID, true, &tm, tx)
+		if err != nil {
+			return
+		}
+	}
+	enrollments, err := s.GetArchiveUniqueIdentityEnrollments(uuid, tm, false, tx)
+	if err != nil {
+		return
+	}
+	for _, enrollment := range enrollments {
+		err = s.UnarchiveEnrollment(enrollment.ID, true, &tm, tx)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1452: Cannot add or update a child row") {
+				log.Warn(fmt.Sprintf("UnarchiveEnrollment: id:%d tm:%v err:%v", enrollment.ID, tm, err))
+			} else {
+				return
+			}
+		}
+	}
+	// Check if profile's name or email is empty
+	// if there is only one email across identities, update profile's email to this email
+	// if there is only one name across identities, update profile's name to this name
+	err = s.SetProfileEmptyDataFromIdentities(uuid, identities, tx)
+	if err != nil {
+		log.Warn(fmt.Sprintf("UnarchiveUUID: SetProfileEmptyDataFromIdentities: uuid:%s err:%v", uuid, err))
+		return
+	}
+	return
+}
+
+func (s *service) ArchiveUUID(uuid string, itm *time.Time, tx *sql.Tx) (tm *time.Time, err error) {
+	log.Info(fmt.Sprintf("ArchiveUUID: uuid:%s itm:%v tx:%v", uuid, itm, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("ArchiveUUID(exit): uuid:%s itm:%v tx:%v tm:%v err:%v", uuid, itm, tx != nil, tm, err))
+	}()
+	if uuid == "" {
+		err = fmt.Errorf("cannot archive empty uuid")
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ArchiveUUID")
+		return
+	}
+	tm = itm
+	if tm == nil {
+		t := time.Now()
+		tm = &t
+	}
+	err = s.ArchiveUniqueIdentity(uuid, tm, tx)
+	if err != nil {
+		return
+	}
+	identities, err := s.GetUniqueIdentityIdentities(uuid, false, tx)
+	if err != nil {
+		return
+	}
+	// Check if profile's name or email is empty
+	// if there is only one email across identities, update profile's email to this email
+	// if there is only one name across identities, update profile's name to this name
+	err = s.SetProfileEmptyDataFromIdentities(uuid, identities, tx)
+	if err != nil {
+		log.Warn(fmt.Sprintf("UnarchiveUUID: SetProfileEmptyDataFromIdentities: uuid:%s err:%v", uuid, err))
+		return
+	}
+	err = s.ArchiveProfile(uuid, tm, tx)
+	if err != nil {
+		return
+	}
+	for _, identity := range identities {
+		err = s.ArchiveIdentity(identity.ID, tm, tx)
+		if err != nil {
+			return
+		}
+	}
+	enrollments, err := s.GetUniqueIdentityEnrollments(uuid, false, tx)
+	if err != nil {
+		return
+	}
+	for _, enrollment := range enrollments {
+		err = s.ArchiveEnrollment(enrollment.ID, tm, tx)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *service) SetProfileEmptyDataFromIdentities(uuid string, identities []*models.IdentityDataOutput, tx *sql.Tx) (err error) {
+	nIdents := len(identities)
+	name, email := "", ""
+	log.Info(fmt.Sprintf("SetProfileEmptyDataFromIdentities: uuid:%s identities:%d tx:%v", uuid, nIdents, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("SetProfileEmptyDataFromIdentities(exit): uuid:%s identities:%d tx:%v name:%s email:%s err:%v", uuid, nIdents, tx != nil, name, email, err))
+	}()
+	if nIdents == 0 {
+		return
+	}
+	nameSet := make(map[string]struct{})
+	emailSet := make(map[string]struct{})
+	for _, identity := range identities {
+		if identity.Name != nil {
+			name = *identity.Name
+			nameSet[name] = struct{}{}
+		}
+		if identity.Email != nil {
+			email = *identity.Email
+			emailSet[email] = struct{}{}
+		}
+	}
+	// fmt.Printf("nameSet: %+v\nemailSet: %+v\n", nameSet, emailSet)
+	if len(nameSet) > 1 {
+		name = ""
+	}
+	if len(emailSet) > 1 {
+		email = ""
+	}
+	if name == "" && email == "" {
+		return
+	}
+	var (
+		pName  *string
+		pEmail *string
+		rows   *sql.Rows
+	)
+	// This uses RW connection, because this value will be updated soon
+	rows, err = s.Query(s.db, tx, "select name, email from profiles where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&pName, &pEmail)
+		if err != nil {
+			return
+		}
+		break
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if pName != nil && *pName != "" {
+		// fmt.Printf("profile already has a name %s\n", *pName)
+		name = ""
+	}
+	if pEmail != nil && *pEmail != "" {
+		// fmt.Printf("profile already has an email %s\n", *pEmail)
+		email = ""
+	}
+	if name == "" && email == "" {
+		return
+	}
+	args := []interface{}{}
+	q := "update profiles set "
+	if name != "" {
+		q += "name = ?"
+		args = append(args, name)
+		if email != "" {
+			q += ", email = ?"
+			args = append(args, email)
+		}
+	} else {
+		q += "email = ?"
+		args = append(args, email)
+	}
+	q += ", last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')"
+	args = append(args, s.lfid)
+	args = append(args, uuid)
+	// fmt.Printf("%s %+v\n", q, args)
+	_, err = s.Exec(s.db, tx, q, args...)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (s *service) DedupEnrollments() (err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if tx != nil {
+			s.RollbackTx(tx)
+		}
+	}()
+	defer s.InvalidateAffiliationCache()
+	var rows *sql.Rows
+	// This uses RW connection, even for selects - because it will eventually update data
+	rows, err = s.Query(
+		s.db,
+		tx,
+		"select uuid, organization_id, start, end, project_slug, count(id) as cnt "+
+			"from enrollments where project_slug is null "+
+			"group by uuid, organization_id, start, end, project_slug "+
+			"having cnt > 1",
+	)
+	if err != nil {
+		return
+	}
+	var (
+		uuid           string
+		orgID          int64
+		start          strfmt.DateTime
+		end            strfmt.DateTime
+		projectSlug    *string
+		cnt            int
+		uuidAry        []string
+		orgIDAry       []int64
+		startAry       []strfmt.DateTime
+		endAry         []strfmt.DateTime
+		projectSlugAry []*string
+		cntAry         []int
+	)
+	for rows.Next() {
+		err = rows.Scan(&uuid, &orgID, &start, &end, &projectSlug, &cnt)
+		if err != nil {
+			return
+		}
+		uuidAry = append(uuidAry, uuid)
+		orgIDAry = append(orgIDAry, orgID)
+		startAry = append(startAry, start)
+		endAry = append(endAry, end)
+		projectSlugAry = append(projectSlugAry, projectSlug)
+		cntAry = append(cntAry, cnt)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	rids := make(map[int]struct{})
+	for idx := range uuidAry {
+		uuid = uuidAry[idx]
+		orgID = orgIDAry[idx]
+		start = startAry[idx]
+		end = endAry[idx]
+		projectSlug = projectSlugAry[idx]
+		cnt = cntAry[idx]
+		var rows *sql.Rows
+		rows, err = s.Query(
+			s.db,
+			tx,
+			"select id from enrollments where uuid = ? and organization_id = ? "+
+				"and start = ? and end = ? and project_slug is null order by id desc limit ?",
+			uuid,
+			orgID,
+			time.Time(start),
+			time.Time(end),
+			cnt-1,
+		)
+		if err != nil {
+			return
+		}
+		rid := 0
+		for rows.Next() {
+			err = rows.Scan(&rid)
+			if err != nil {
+				return
+			}
+			rids[rid] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	ridsAry := []interface{}{}
+	for rid := range rids {
+		ridsAry = append(ridsAry, rid)
+	}
+	packSize := 1000
+	nRids := len(ridsAry)
+	nPacks := nRids / packSize
+	if nRids%packSize != 0 {
+		nPacks++
+	}
+	for i := 0; i < nPacks; i++ {
+		from := packSize * i
+		to := from + packSize
+		if to > nRids {
+			to = nRids
+		}
+		pack := ridsAry[from:to]
+		cond := "(locked_by is null or trim(locked_by) = '') and id in ("
+		for range pack {
+			cond += "?,"
+		}
+		cond = cond[:len(cond)-1] + ")"
+		if shared.GEnrollmentHistory {
+			_, err = s.Exec(s.db, tx, enrollmentsArchiveInsert(cond), append([]interface{}{time.Now(), s.lfid}, pack...)...)
+			if err != nil {
+				return
+			}
+		}
+		_, err = s.Exec(s.db, tx, "delete from enrollments where "+cond, pack...)
+		if err != nil {
+			for _, rid := range pack {
+				_, err = s.Exec(s.db, tx, "delete from enrollments where id = ? and (locked_by is null or trim(locked_by) = '')", rid)
+				if err != nil {
+					log.Info(fmt.Sprintf("failed to delete enrollment id=%d: %+v", rid, err))
+					return
+				}
+			}
+			return
+		}
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	// set tx to nil to mark success so deferred rollback will not happen
+	tx = nil
+	return
+}
+
+func (s *service) MapOrgNames() (status string, err error) {
+	log.Info("MapOrgNames")
+	dbg := false
+	logLevel := os.Getenv("LOG_LEVEL")
+	if logLevel == "trace" || logLevel == "debug" {
+		dbg = true
+	}
+	// s.SetOrigin()
+	status = ""
+	defer func() {
+		log.Info(fmt.Sprintf("MapOrgNames(exit): status:%s err:%v", status, err))
+	}()
+	defer s.InvalidateAffiliationCache()
+	e := s.DedupEnrollments()
+	if e != nil {
+		log.Warn(fmt.Sprintf("dedupEnrollments: %v", e))
+	}
+	if !s.mappingsLoaded {
+		// orgNamesMappings allMappings
+		var data []byte
+		data, err = ioutil.ReadFile(MapOrgNamesFile)
+		if err != nil {
+			return
+		}
+		err = yaml.Unmarshal(data, &s.orgNamesMappings)
+		if err != nil {
+			return
+		}
+		s.mappingsLoaded = true
+	}
+	// Entire map org names API uses RW connection only
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if tx != nil {
+			s.RollbackTx(tx)
+		}
+	}()
+	nids := []int64{}
+	inf := ""
+	added := 0
+	updated := 0
+	deleted := 0
+	skipped := 0
+	conflicts := 0
+	archivedConflicts := 0
+	lockedSkipped := 0
+	rolsUpdated := int64(0)
+	for _, mapping := range s.orgNamesMappings.Mappings {
+		re := mapping[0]
+		to := mapping[1]
+		// fmt.Printf("Processing '%s' -> '%s'\n", re, to)
+		var rows *sql.Rows
+		rows, err = s.Query(s.db, tx, "select id, name from organizations where name = ?", to)
+		if err != nil {
+			return
+		}
+		fetched := false
+		id := int64(0)
+		actualName := ""
+		for rows.Next() {
+			if fetched {
+				err = fmt.Errorf("multiple companies found for name: %s, including %s", to, actualName)
+				return
+			}
+			err = rows.Scan(&id, &actualName)
+			if err != nil {
+				return
+			}
+			fetched = true
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if !fetched {
+			var res sql.Result
+			res, err = s.Exec(s.db, tx, "insert into organizations(name, last_modified_by) values(?,?)", to, s.lfid)
+			if err != nil {
+				return
+			}
+			id, err = res.LastInsertId()
+			if err != nil {
+				return
+			}
+			inf = fmt.Sprintf("Added organization '%s' (id=%d)", to, id)
+			status += inf + ", "
+			log.Info(inf)
+			added++
+		} else if actualName != to {
+			_, err = s.Exec(s.db, tx, "update organizations set name = ?, last_modified_by = ? where id = ?", to, s.lfid, id)
+			if err != nil {
+				return
+			}
+			inf = fmt.Sprintf("Updated organization name '%s' -> '%s' (id=%d)", actualName, to, id)
+			status += inf + ", "
+			log.Info(inf)
+			updated++
+		}
+		// Because sql.Query escapes \ --> \\ and mysql special characters regexp is '\\.'
+		re = strings.Replace(re, "\\\\", "\\", -1)
+		if dbg {
+			fmt.Printf("RE: %s\n", re)
+			log.Debug(fmt.Sprintf("RE: %s", re))
+		}
+		rows, err = s.Query(s.db, tx, "select id, name from organizations where name regexp ? and name != ?", re, to)
+		//rows, err = s.Query(s.db, tx, "select id, name from organizations where name = ?", re)
+		//rows, err = s.Query(s.db, tx, `select id, name from organizations where name regexp '` + re + `'`)
+		if err != nil {
+			return
+		}
+		nid := int64(0)
+		name := ""
+		nidAry := []int64{}
+		nameAry := []string{}
+		for rows.Next() {
+			err = rows.Scan(&nid, &name)
+			if err != nil {
+				return
+			}
+			nidAry = append(nidAry, nid)
+			nameAry = append(nameAry, name)
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		for idx, nid := range nidAry {
+			name = nameAry[idx]
+			//fmt.Printf("'%s'(%d)\n", name, nid)
+			if nid == id {
+				inf = fmt.Sprintf("'%s' (id=%d) matching '%s' already maps into '%s' (id=%d), skipping", name, nid, re, to, id)
+				status += inf + ", "
+				log.Info(inf)
+				skipped++
+				continue
+			}
+			var res sql.Result
+			// Update current enrollments
+			affected := int64(0)
+			// Locked enrollments are not remapped, organization they point to is kept (see below)
+			res, err = s.Exec(s.db, tx, "update enrollments set organization_id = ?, last_modified_by = ? where organization_id = ? and (locked_by is null or trim(locked_by) = '')", id, s.lfid, nid)
+			if err != nil {
+				if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
+					log.Warn(fmt.Sprintf("Error: cannot update enrollments organization '%s' (id=%d) to '%s' (id=%d): %v", name, nid, to, id, err))
+					return
+				}
+				var rows *sql.Rows
+				rows, err = s.Query(s.db, tx, "select id from enrollments where organization_id = ? and (locked_by is null or trim(locked_by) = '')", nid)
+				if err != nil {
+					return
+				}
+				rid := 0
+				// To avoid updates while feching rows - we need to fetch all rws and then update after rows are closed
+				rids := []int{}
+				for rows.Next() {
+					err = rows.Scan(&rid)
+					if err != nil {
+						return
+					}
+					rids = append(rids, rid)
+				}
+				err = rows.Err()
+				if err != nil {
+					return
+				}
+				err = rows.Close()
+				if err != nil {
+					return
+				}
+				for _, rid := range rids {
+					res, err = s.Exec(s.db, tx, "update enrollments set organization_id = ?, last_modified_by = ? where id = ? and organization_id = ? and (locked_by is null or trim(locked_by) = '')", id, s.lfid, rid, nid)
+					if err != nil && !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
+						log.Warn(fmt.Sprintf("Error: cannot update enrollment (id=%d) organization '%s' (id=%d) to '%s' (id=%d): %v", rid, name, nid, to, id, err))
+						return
+					}
+					if err != nil {
+						conflicts++
+						continue
+					}
+					affected++
+				}
+			} else {
+				affected, err = res.RowsAffected()
+			}
+			if affected > 0 {
+				rolsUpdated += affected
+				inf = fmt.Sprintf("Updated organization '%s' -> '%s' on %d enrollments", name, to, affected)
+				status += inf + ", "
+				log.Info(inf)
+			}
+			// Update archived enrollments
+			affected = int64(0)
+			res, err = s.Exec(s.db, tx, "update enrollments_archive set organization_id = ?, last_modified_by = ? where organization_id = ?", id, s.lfid, nid)
+			if err != nil {
+				if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
+					log.Warn(fmt.Sprintf("Error: cannot update archived enrollments organization '%s' (id=%d) to '%s' (id=%d): %v", name, nid, to, id, err))
+					return
+				}
+				var rows *sql.Rows
+				rows, err = s.Query(s.db, tx, "select id, archived_at from enrollments_archive where organization_id = ?", nid)
+				if err != nil {
+					return
+				}
+				rid := 0
+				rids := []int{}
+				var archivedAt time.Time
+				archivedAts := []time.Time{}
+				for rows.Next() {
+					err = rows.Scan(&rid, &archivedAt)
+					if err != nil {
+						return
+					}
+					rids = append(rids, rid)
+					archivedAts = append(archivedAts, archivedAt)
+				}
+				err = rows.Err()
+				if err != nil {
+					return
+				}
+				err = rows.Close()
+				if err != nil {
+					return
+				}
+				for i := range rids {
+					rid := rids[i]
+					archivedAt := archivedAts[i]
+					res, err = s.Exec(s.db, tx, "update enrollments_archive set organization_id = ?, last_modified_by = ? where id = ? and archived_at = ? and organization_id = ?", id, s.lfid, rid, archivedAt, nid)
+					if err != nil && !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
+						log.Warn(fmt.Sprintf("Error: cannot update archived enrollment (id=%d, archived_at=%+v) organization '%s' (id=%d) to '%s' (id=%d): %v", rid, archivedAt, name, nid, to, id, err))
+						return
+					}
+					if err != nil {
+						archivedConflicts++
+						continue
+					}
+					affected++
+				}
+			} else {
+				affected, err = res.RowsAffected()
+			}
+			if affected > 0 {
+				rolsUpdated += affected
+				inf = fmt.Sprintf("Updated organization '%s' -> '%s' on %d archived enrollments", name, to, affected)
+				status += inf + ", "
+				log.Info(inf)
+			}
+			// Organization still used by locked enrollments cannot be deleted
+			nLocked := 0
+			nLocked, err = s.countLockedEnrollments(nid, tx)
+			if err != nil {
+				return
+			}
+			if nLocked > 0 {
+				inf = fmt.Sprintf("Kept organization '%s' (id=%d), it has %d locked enrollments", name, nid, nLocked)
+				status += inf + ", "
+				log.Info(inf)
+				lockedSkipped += nLocked
+				continue
+			}
+			res, err = s.Exec(s.db, tx, "delete from organizations where id = ?", nid)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error: cannot delete organization '%s' (id=%d)", name, nid))
+				nids = append(nids, nid)
+			} else {
+				affected, err = res.RowsAffected()
+				if affected > 0 {
+					inf = fmt.Sprintf("Deleted organization '%s' (id=%d)", name, nid)
+					status += inf + ", "
+					log.Info(inf)
+					deleted++
+				}
+			}
+		}
+	}
+	if status == "" {
+		status = "Nothing to update"
+	} else {
+		status += fmt.Sprintf(
+			"Organizations: added:%d renamed:%d deleted:%d skipped:%d, Enrollments: conflicts:%d archive conflicts:%d updated:%d locked skipped:%d",
+			added,
+			updated,
+			deleted,
+			skipped,
+			conflicts,
+			archivedConflicts,
+			rolsUpdated,
+			lockedSkipped,
+		)
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	// Set tx to nil, so deferred rollback will not happen
+	tx = nil
+	if len(nids) > 0 {
+		log.Info(fmt.Sprintf("Deleting %d pending orgs", len(nids)))
+		for _, nid := range nids {
+			var res sql.Result
+			res, err = s.Exec(s.db, nil, "delete from organizations where id = ?", nid)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error: cannot delete organization id=%d", nid))
+				continue
+			}
+			var affected int64
+			affected, err = res.RowsAffected()
+			if affected > 0 {
+				inf = fmt.Sprintf("Deleted organization id=%d", nid)
+				status += inf + ", "
+				log.Info(inf)
+				deleted++
+			}
+		}
+	}
+	return
+}
+
+func (s *service) HideEmails() (status string, err error) {
+	log.Info("HideEmails")
+	// s.SetOrigin()
+	status = ""
+	defer func() {
+		log.Info(fmt.Sprintf("HideEmails(exit): status:%s err:%v", status, err))
+	}()
+	updates := [][2]string{
+		{"profiles", "name"},
+		{"identities", "name"},
+		{"identities", "username"},
+	}
+	thrN := runtime.NumCPU()
+	var mtx *sync.Mutex
+	if thrN > 1 {
+		mtx = &sync.Mutex{}
+	}
+	updateFunc := func(ch chan error, update [2]string) (err error) {
+		defer func() {
+			if ch != nil {
+				ch <- err
+			}
+		}()
+		table := update[0]
+		column := update[1]
+		re := "^[^@]+@[^@]+$"
+		updateSQL := fmt.Sprintf(
+			"update %[1]s set %[2]s = substring_index(%[2]s, '@', 1), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
+			table,
+			column,
+			re,
+		)
+		var res sql.Result
+		conflict := false
+		res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
+		if err != nil {
+			if !strings.Contains(err.Error(), "Error 1062: Duplicate entry") {
+				return err
+			}
+			updateSQL := fmt.Sprintf(
+				"update ignore %[1]s set %[2]s = substring_index(%[2]s, '@', 1), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
+				table,
+				column,
+				re,
+			)
+			res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
+			if err != nil {
+				return
+			}
+			conflict = true
+		}
+		affected := int64(0)
+		affected, err = res.RowsAffected()
+		if err != nil {
+			return
+		}
+		if conflict {
+			updateSQL := fmt.Sprintf(
+				"update %[1]s set %[2]s = concat(substring_index(%[2]s, '@', 1), '-redacted'), last_modified_by = ? where %[2]s regexp '%[3]s' and (locked_by is null or trim(locked_by) = '')",
+				table,
+				column,
+				re,
+			)
+			res, err = s.Exec(s.db, nil, updateSQL, s.lfid)
+			if err != nil {
+				return
+			}
+			affected2 := int64(0)
+			affected2, err = res.RowsAffected()
+			if err != nil {
+				return
+			}
+			if affected2 > 0 {
+				affected += affected2
+				log.Warn(fmt.Sprintf("%d conflicts on column %s table %s, added '-redacted' suffix", affected2, column, table))
+			}
+		}
+		// Report locked rows that still contain emails
+		var rows *sql.Rows
+		rows, err = s.Query(
+			s.db,
+			nil,
+			fmt.Sprintf("select count(*) from %[1]s where %[2]s regexp '%[3]s' and locked_by is not null and trim(locked_by) != ''", table, column, re),
+		)
+		if err != nil {
+			return
+		}
+		locked := 0
+		for rows.Next() {
+			err = rows.Scan(&locked)
+			if err != nil {
+				return
+			}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if mtx != nil {
+			mtx.Lock()
+		}
+		if status == "" {
+			status = fmt.Sprintf("Updated %d %s values on %s table (%d locked skipped), ", affected, column, table, locked)
+		} else {
+			status += fmt.Sprintf("%d %s values on %s table (%d locked skipped), ", affected, column, table, locked)
+		}
+		if mtx != nil {
+			mtx.Unlock()
+		}
+		return
+	}
+	ch := make(chan error)
+	nThreads := 0
+	if thrN > 0 {
+		for _, update := range updates {
+			go updateFunc(ch, update)
+			nThreads++
+			if nThreads == thrN {
+				err = <-ch
+				nThreads--
+				if err != nil {
+					return
+				}
+			}
+		}
+		for nThreads > 0 {
+			err = <-ch
+			nThreads--
+			if err != nil {
+				return
+			}
+		}
+	} else {
+		for _, update := range updates {
+			err = updateFunc(nil, update)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(status) > 2 {
+		status = status[0 : len(status)-2]
+	}
+	log.Warn(status)
+	return
+}
+
+// MergeCluster - returns merge cluster report for given normalized email and name key, survivor uuid and cluster profiles
+// Survivor profile is listed first, then other profiles by uuid. Profiles that MergeAll would not merge because their
+// (or survivor's) name is missing or redacted or because they (or survivor) are locked are listed in skipped
+func (s *service) MergeCluster(key, survivor string, profiles []*models.MergeClusterProfile) (cluster *models.MergeCluster) {
+	cluster = &models.MergeCluster{Key: key, Survivor: survivor, Uuids: []string{}, Skipped: []string{}, Profiles: profiles}
+	ary := strings.SplitN(key, "@@@", 2)
+	cluster.Email = ary[0]
+	if len(ary) > 1 {
+		cluster.Name = ary[1]
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		si, sj := profiles[i].UUID == survivor, profiles[j].UUID == survivor
+		if si != sj {
+			return si
+		}
+		return profiles[i].UUID < profiles[j].UUID
+	})
+	noName := func(prof *models.MergeClusterProfile) bool {
+		return prof.Profile != nil && prof.Profile.Name != nil &&
+			(strings.HasSuffix(*prof.Profile.Name, "-MISSING-NAME") || strings.HasSuffix(*prof.Profile.Name, "-REDACTED-EMAIL"))
+	}
+	locked := func(prof *models.MergeClusterProfile) bool {
+		return strings.TrimSpace(prof.LockedBy) != ""
+	}
+	survivorSkip := false
+	for _, prof := range profiles {
+		if prof.UUID == survivor {
+			survivorSkip = noName(prof) || locked(prof)
+		}
+	}
+	for _, prof := range profiles {
+		cluster.Uuids = append(cluster.Uuids, prof.UUID)
+		if prof.UUID != survivor && (survivorSkip || noName(prof) || locked(prof)) {
+			cluster.Skipped = append(cluster.Skipped, prof.UUID)
+		}
+	}
+	return
+}
+
+// MergeAll - merges profiles having the same normalized email and name (using identities and then profiles table)
+// In dry mode nothing is merged, instead merge clusters found in each table are returned
+func (s *service) MergeAll(debug int, dry bool, username string, esLog elastic.Service) (status string, reports []*models.MergeAllTableReport, err error) {
+	log.Info(fmt.Sprintf("MergeAll: debug:%d dry:%v", debug, dry))
+	// s.SetOrigin()
+	defer func() {
+		log.Info(fmt.Sprintf("MergeAll(exit): debug:%d dry:%v status:%s reports:%d err:%v", debug, dry, status, len(reports), err))
+	}()
+	emailRE := `^[^@]+@[^@]+$`
+	//reVal := `[[:^alpha:]]`
+	reVal := `[]['"“”・·,;!#$%^&*()_+{}:|\/?.,><~£§ -]`
+	reStr := `regexp_replace(lower(concat(trim(email), '@@@', trim(name))), ?, '')`
+	tables := []string{"identities", "profiles"}
+	for _, table := range tables {
+		log.Warn("Merging using " + table + " table.")
+		report := &models.MergeAllTableReport{Table: table, Clusters: []*models.MergeCluster{}}
+		if dry {
+			reports = append(reports, report)
+		}
+		var rows *sql.Rows
+		query := fmt.Sprintf(
+			"select k, cnt from (select %s as k, count(distinct uuid) as cnt from %s "+
+				"where name is not null and email is not null and email regexp ? "+
+				"and name not like '%%-MISSING-NAME' and name not like '%%-REDACTED-EMAIL' "+
+				"group by k) sub where sub.cnt > 1",
+			reStr,
+			table,
+		)
+		if debug > 0 {
+			log.Info(fmt.Sprintf("main query[%s, %s]: %s\n", reVal, emailRE, query))
+			fmt.Printf("main query[%s, %s]: %s\n", reVal, emailRE, query)
+		}
+		// Only RW connection is used - this API mass updates data
+		// select k, cnt from (select regexp_replace(lower(concat(trim(email), '@@@', trim(name))), '[]["“”・·,;!#$%^&*()_+{}:|\/?.,><~£§ -]', '') as k,
+		// count(distinct uuid) as cnt from identities where name is not null and email is not null and email regexp '^[^@]+@[^@]+$'
+		// group by k) sub where sub.cnt > 1;
+		rows, err = s.Query(s.db, nil, query, reVal, emailRE)
+		if err != nil {
+			return
+		}
+		packSize := 1000
+		rawKey := ""
+		key := ""
+		keysPacks := [][]interface{}{}
+		keys := []interface{}{}
+		n := 0
+		cnt := 0
+		for rows.Next() {
+			err = rows.Scan(&rawKey, &cnt)
+			if err != nil {
+				return
+			}
+			// key = strings.TrimSpace(strings.ToLower(s.StripUnicode(rawKey)))
+			key = s.StripUnicode(rawKey)
+			if strings.HasSuffix(key, "@@@") {
+				key = rawKey
+			}
+			if debug > 0 {
+				log.Info(fmt.Sprintf("%s --> %d\n", key, cnt))
+			}
+			keys = append(keys, key)
+			n++
+			if n == packSize {
+				keysPacks = append(keysPacks, keys)
+				keys = []interface{}{}
+				n = 0
+			}
+			if key != rawKey {
+				if debug > 0 {
+					log.Info(fmt.Sprintf("special %s,%s --> %d\n", rawKey, key, cnt))
+				}
+				keys = append(keys, rawKey)
+				n++
+				if n == packSize {
+					keysPacks = append(keysPacks, keys)
+					keys = []interface{}{}
+					n = 0
+				}
+			}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+		if n > 0 {
+			keysPacks = append(keysPacks, keys)
+		}
+		nKeysPacks := len(keysPacks)
+		log.Warn(fmt.Sprintf("Keys %d-packs to merge: %d\n", packSize, nKeysPacks))
+		nKeys := 0
+		for _, keys := range keysPacks {
+			nKeys += len(keys)
+		}
+		log.Warn(fmt.Sprintf("Profiles to merge: %d\n", nKeys))
+		merges := map[string]map[string]struct{}{}
+		thrN := runtime.NumCPU()
+		runtime.GOMAXPROCS(thrN)
+		var mtx *sync.Mutex
+		if thrN > 1 {
+			mtx = &sync.Mutex{}
+		}
+		processPack := func(ch chan error, i int, keys []interface{}) (err error) {
+			defer func() {
+				if ch != nil {
+					ch <- err
+				}
+			}()
+			query := fmt.Sprintf("select %s, uuid from %s where name is not null and name not like '%%-MISSING-NAME' and name not like '%%-REDACTED-EMAIL' and email is not null and %s in (", reStr, table, reStr)
+			args := []interface{}{reVal, reVal}
+			for _, key := range keys {
+				query += "?,"
+				args = append(args, key)
+			}
+			query = query[0:len(query)-1] + ")"
+			var rows *sql.Rows
+			if debug > 0 {
+				log.Info(fmt.Sprintf("#%d pack query:\n%s\n%+v\n", i, query, args))
+			}
+			rows, err = s.Query(s.db, nil, query, args...)
+			if err != nil {
+				return
+			}
+			uuid := ""
+			key := ""
+			rawKey := ""
+			uuids := make(map[string]map[string]struct{})
+			for rows.Next() {
+				err = rows.Scan(&rawKey, &uuid)
+				if err != nil {
+					return
+				}
+				// key = strings.TrimSpace(strings.ToLower(s.StripUnicode(rawKey)))
+				key = s.StripUnicode(rawKey)
+				if strings.HasSuffix(key, "@@@") {
+					key = rawKey
+				}
+				if debug > 0 {
+					log.Info(fmt.Sprintf("key: %s: uuid: %s\n", key, uuid))
+				}
+				_, ok := uuids[key]
+				if !ok {
+					uuids[key] = make(map[string]struct{})
+				}
+				uuids[key][uuid] = struct{}{}
+				if key != rawKey {
+					if debug > 0 {
+						log.Info(fmt.Sprintf("special rawKey: %s key: %s: uuid: %s\n", rawKey, key, uuid))
+					}
+					_, ok := uuids[rawKey]
+					if !ok {
+						uuids[rawKey] = make(map[string]struct{})
+					}
+				}
+			}
+			err = rows.Err()
+			if err != nil {
+				return
+			}
+			err = rows.Close()
+			if err != nil {
+				return
+			}
+			if mtx != nil {
+				mtx.Lock()
+			}
+			for key, ids := range uuids {
+				merges[key] = make(map[string]struct{})
+				for uuid := range ids {
+					merges[key][uuid] = struct{}{}
+				}
+			}
+			if mtx != nil {
+				mtx.Unlock()
+			}
+			nKeys := len(keys)
+			log.Warn(fmt.Sprintf("%d/%d packs %d keys\n", i+1, nKeysPacks, nKeys))
+			return
+		}
+		if thrN > 1 {
+			ch := make(chan error)
+			nThreads := 0
+			for i, keys := range keysPacks {
+				go processPack(ch, i, keys)
+				nThreads++
+				if nThreads == thrN {
+					err = <-ch
+					nThreads--
+					if err != nil {
+						return
+					}
+				}
+			}
+			for nThreads > 0 {
+				err = <-ch
+				nThreads--
+				if err != nil {
+					return
+				}
+			}
+		} else {
+			for i, keys := range keysPacks {
+				err = processPack(nil, i, keys)
+				if err != nil {
+					return
+				}
+			}
+		}
+		for key, uuids := range merges {
+			l := len(uuids)
+			if l <= 1 {
+				log.Warn(fmt.Sprintf("Key %+v deleted - had only %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+				delete(merges, key)
+				continue
+			}
+			if l > 25 {
+				log.Warn(fmt.Sprintf("Key %+v deleted - had more than 25 uuids (%d): %+v\n", strings.Split(key, "@@@"), l, uuids))
+				delete(merges, key)
+				continue
+			}
+			if debug > 0 || l > 10 {
+				log.Info(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+			}
+		}
+		nMergeOps := len(merges)
+		nMerges := 0
+		for _, uuids := range merges {
+			nMerges += len(uuids) - 1
+		}
+		log.Warn(fmt.Sprintf("UUIDs to merge: %d in %d operations (before dedup)\n", nMerges, nMergeOps))
+		if nMergeOps == 0 || nMerges == 0 {
+			if status == "" {
+				status = table + ": Nothing to merge"
+			} else {
+				status += ", " + table + ": Nothing to merge"
+			}
+			continue
+		}
+		iter := 0
+		allHits := 0
+		processed := make(map[string]struct{})
+		for {
+			iter++
+			hits := 0
+			for key, uuids := range merges {
+				if debug > 0 {
+					log.Info(fmt.Sprintf("merge key:%s\n", key))
+				}
+				for uuid := range uuids {
+					if debug > 0 {
+						log.Info(fmt.Sprintf(">> key:%s,uuid:%s\n", key, uuid))
+					}
+					for key2, uuids2 := range merges {
+						if key2 == key {
+							continue
+						}
+						_, ok := processed[key]
+						if ok {
+							continue
+						}
+						_, ok = merges[key2][uuid]
+						if ok {
+							hits++
+							if debug > 1 {
+								log.Info(fmt.Sprintf("iter #%d (hits %d) %s present in %+v\n", iter, hits, uuid, uuids2))
+							}
+							for uuid2 := range uuids2 {
+								merges[key][uuid2] = struct{}{}
+							}
+							delete(merges, key2)
+						}
+					}
+				}
+				processed[key] = struct{}{}
+			}
+			log.Warn(fmt.Sprintf("Dedup step #%d finished with %d hits\n", iter, hits))
+			if hits == 0 {
+				break
+			}
+			allHits += hits
+			if iter > 50 {
+				log.Warn("Wasn't able to fully dedup in 50 steps, using single-threaded merge to avoid transaction deadlocks\n")
+				thrN = 1
+				break
+			}
+		}
+		log.Warn(fmt.Sprintf("Dedup finished with %d hits\n", allHits))
+		for key, uuids := range merges {
+			l := len(uuids)
+			if l <= 1 {
+				log.Warn(fmt.Sprintf("Key %+v deleted - had only %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+				delete(merges, key)
+				continue
+			}
+			if l > 25 {
+				log.Warn(fmt.Sprintf("Key %+v deleted - had more than 25 uuids (%d): %+v\n", strings.Split(key, "@@@"), l, uuids))
+				delete(merges, key)
+				continue
+			}
+			if debug > 0 {
+				log.Info(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+			}
+			if debug > 0 || l > 10 {
+				log.Warn(fmt.Sprintf("Key %+v has %d uuids: %+v\n", strings.Split(key, "@@@"), l, uuids))
+			}
+		}
+		nMergeOps = len(merges)
+		nMerges = 0
+		for _, uuids := range merges {
+			nMerges += len(uuids) - 1
+		}
+		log.Warn(fmt.Sprintf("UUIDs to merge: %d in %d operations (after dedup in %d steps)\n", nMerges, nMergeOps, iter))
+		report.NClusters = int64(nMergeOps)
+		report.NMerges = int64(nMerges)
+		if nMergeOps == 0 || nMerges == 0 {
+			if status == "" {
+				status = table + ": Nothing to merge"
+			} else {
+				status += ", " + table + ": Nothing to merge"
+			}
+			continue
+		}
+		currIndex := 0
+		actualMerges := 0
+		lockedSkipped := []string{}
+		type mergeResult struct {
+			key string
+			err error
+		}
+		mergeFunc := func(ch chan mergeResult, key string, uuids []string) (result mergeResult) {
+			toUUID := uuids[0]
+			var err error
+			defer func() {
+				result = mergeResult{err: err, key: strings.Join(uuids, ",")}
+				if ch != nil {
+					if err != nil {
+						err = errs.Wrap(err, toUUID)
+					}
+					ch <- result
+				}
+			}()
+			query := "select uuid, count(distinct id) as cnt from identities where uuid in ("
+			args := []interface{}{}
+			for _, uuid := range uuids {
+				query += "?,"
+				args = append(args, uuid)
+			}
+			query = query[0:len(query)-1] + ") group by uuid order by cnt desc limit 1"
+			var rows *sql.Rows
+			rows, err = s.Query(s.db, nil, query, args...)
+			if err != nil {
+				return
+			}
+			cnt := 0
+			for rows.Next() {
+				err = rows.Scan(&toUUID, &cnt)
+				if err != nil {
+					return
+				}
+			}
+			err = rows.Err()
+			if err != nil {
+				return
+			}
+			err = rows.Close()
+			if err != nil {
+				return
+			}
+			locked, err := s.LockedProfiles(uuids, nil)
+			if err != nil {
+				return
+			}
+			if dry {
+				log.Info(fmt.Sprintf("dry-run: would merge %+v into %s (which has %d identities)\n", uuids, toUUID, cnt))
+				profiles := []*models.MergeClusterProfile{}
+				for _, uuid := range uuids {
+					prof := &models.MergeClusterProfile{UUID: uuid, LockedBy: locked[uuid]}
+					prof.Profile, err = s.GetProfile(uuid, false, nil)
+					if err != nil {
+						return
+					}
+					prof.Identities, err = s.GetUniqueIdentityIdentities(uuid, false, nil)
+					if err != nil {
+						return
+					}
+					prof.Enrollments, err = s.GetUniqueIdentityEnrollments(uuid, false, nil)
+					if err != nil {
+						return
+					}
+					profiles = append(profiles, prof)
+				}
+				cluster := s.MergeCluster(key, toUUID, profiles)
+				if mtx != nil {
+					mtx.Lock()
+				}
+				report.Clusters = append(report.Clusters, cluster)
+				if mtx != nil {
+					mtx.Unlock()
+				}
+				return
+			}
+			if debug > 0 {
+				log.Info(fmt.Sprintf("merging %+v into %s (which has %d identities)\n", uuids, toUUID, cnt))
+			}
+			tx, err := s.db.Begin()
+			if err != nil {
+				return
+			}
+			defer func() {
+				if tx != nil {
+					s.RollbackTx(tx)
+				}
+			}()
+			didMerges := 0
+			nUUIDs := len(uuids)
+			froms, tos := []string{}, []string{}
+			for idx, fromUUID := range uuids {
+				if fromUUID == toUUID {
+					continue
+				}
+				if locked[fromUUID] != "" || locked[toUUID] != "" {
+					log.Info(fmt.Sprintf("not merging %s into %s: locked profile\n", fromUUID, toUUID))
+					if mtx != nil {
+						mtx.Lock()
+					}
+					lockedSkipped = append(lockedSkipped, fromUUID)
+					if mtx != nil {
+						mtx.Unlock()
+					}
+					continue
+				}
+				_, e := s.GetUniqueIdentity(fromUUID, true, nil)
+				if e != nil {
+					err = e
+					return
+				}
+				toUU, e := s.GetUniqueIdentity(toUUID, true, nil)
+				if e != nil {
+					err = e
+					return
+				}
+				from, e := s.GetProfile(fromUUID, false, nil)
+				if e != nil {
+					err = e
+					return
+				}
+				to, e := s.GetProfile(toUUID, false, nil)
+				if e != nil {
+					err = e
+					return
+				}
+				if from != nil && from.Name != nil && (strings.HasSuffix(*from.Name, "-MISSING-NAME") || strings.HasSuffix(*from.Name, "-REDACTED-EMAIL")) {
+					continue
+				}
+				if to != nil && to.Name != nil && (strings.HasSuffix(*to.Name, "-MISSING-NAME") || strings.HasSuffix(*to.Name, "-REDACTED-EMAIL")) {
+					continue
+				}
+				archivedDate := time.Now()
+				_, e = s.ArchiveUUID(fromUUID, &archivedDate, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				_, e = s.ArchiveUUID(toUUID, &archivedDate, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				if from != nil && to != nil {
+					if to.Name == nil || (to.Name != nil && *to.Name == "") {
+						to.Name = from.Name
+					}
+					if to.Email == nil || (to.Email != nil && *to.Email == "") {
+						to.Email = from.Email
+					}
+					if to.CountryCode == nil || (to.CountryCode != nil && *to.CountryCode == "") {
+						to.CountryCode = from.CountryCode
+					}
+					/*
+						if to.Gender == nil || (to.Gender != nil && *to.Gender == "") {
+							to.Gender = from.Gender
+							to.GenderAcc = from.GenderAcc
+						}
+					*/
+					if from.IsBot != nil && *from.IsBot == 1 {
+						isBot := int64(1)
+						to.IsBot = &isBot
+					}
+					// Update profile and refresh after update
+					to, e = s.EditProfile(to, true, tx)
+					if e != nil {
+						err = e
+						return
+					}
+				}
+				identities, e := s.GetUniqueIdentityIdentities(fromUUID, false, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				for _, identity := range identities {
+					e = s.MoveIdentityToUniqueIdentity(identity, toUU, false, tx)
+					if e != nil {
+						err = e
+						return
+					}
+				}
+				enrollments, e := s.GetUniqueIdentityEnrollments(fromUUID, false, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				for _, rol := range enrollments {
+					rols := []*models.EnrollmentDataOutput{}
+					rols, e = s.FindEnrollments(
+						[]string{"uuid", "organization_id", "start", "end", "project_slug", "role"},
+						[]interface{}{toUUID, rol.OrganizationID, rol.Start, rol.End, rol.ProjectSlug, rol.Role},
+						[]bool{false, false, true, true, false, false},
+						false,
+						tx,
+					)
+					if e != nil {
+						err = e
+						return
+					}
+					if len(rols) == 0 {
+						e = s.MoveEnrollmentToUniqueIdentity(rol, toUU, tx)
+						if e != nil {
+							err = e
+							return
+						}
+					}
+				}
+				// Delete unique identity archiving it to uidentities_archive
+				e = s.DeleteUniqueIdentity(fromUUID, false, true, nil, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				orgs, e := s.FindUniqueIdentityOrganizations(toUUID, false, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				for _, org := range orgs {
+					e = s.MergeEnrollments(toUU, org, nil, true, true, tx)
+					if e != nil {
+						err = e
+						return
+					}
+				}
+				e = s.addLineage(&models.LineageEvent{Action: LineageMerge, Origin: LineageOriginMergeAll, FromUUID: fromUUID, ToUUID: toUUID, CreatedBy: username}, &archivedDate, tx)
+				if e != nil {
+					err = e
+					return
+				}
+				didMerges++
+				if debug > 0 {
+					fmt.Printf("merged %d/%d %s --> %s\n", idx+1, nUUIDs, fromUUID, toUUID)
+				}
+				froms = append(froms, fromUUID)
+				tos = append(tos, toUUID)
+			}
+			err = s.CommitTx(tx)
+			if err != nil {
+				return
+			}
+			// Set tx to nil, so deferred rollback will not happen
+			tx = nil
+			if mtx != nil {
+				mtx.Lock()
+			}
+			currIndex++
+			i := currIndex
+			actualMerges += didMerges
+			soFar := actualMerges
+			if mtx != nil {
+				mtx.Unlock()
+			}
+			if debug > 0 {
+				log.Info(fmt.Sprintf("merged %d %+v\n", nUUIDs, uuids))
+			}
+			log.Info(fmt.Sprintf("%d/%d merges (%s, %d profiles, %d merges so far)\n", i, nMergeOps, key, nUUIDs, soFar))
+			for ui := range froms {
+				fromUUID := froms[ui]
+				toUUID := tos[ui]
+				esLog.Log(fmt.Sprintf("User '%s' auto merged profile uuid '%s' into profile uuid '%s' (API: 'MergeAll')", username, fromUUID, toUUID), username, "MergeAll")
+			}
+			return
+		}
+		nErrs := 0
+		errsStr := ""
+		merging := make(map[string]struct{})
+		nProc := 0
+		infoMerging := func() {
+			if debug > 0 && nProc%10 == 0 {
+				log.Info(fmt.Sprintf("currently merging %d (%d/%d finished): %+v\n", len(merging), nProc, nMergeOps, merging))
+			}
+		}
+		if thrN > 1 {
+			ch := make(chan mergeResult)
+			nThreads := 0
+			for key, uuidsMap := range merges {
+				uuids := []string{}
+				for uuid := range uuidsMap {
+					uuids = append(uuids, uuid)
+				}
+				merging[strings.Join(uuids, ",")] = struct{}{}
+				go mergeFunc(ch, key, uuids[:])
+				nThreads++
+				if nThreads == thrN {
+					res := <-ch
+					delete(merging, res.key)
+					e := res.err
+					nThreads--
+					if e != nil {
+						log.Warn("Merge error: " + e.Error())
+						errsStr += e.Error() + " "
+						nErrs++
+					}
+					nProc++
+					infoMerging()
+				}
+			}
+			for nThreads > 0 {
+				res := <-ch
+				delete(merging, res.key)
+				e := res.err
+				nThreads--
+				if e != nil {
+					log.Warn("Merge error: " + e.Error())
+					errsStr += e.Error() + " "
+					nErrs++
+				}
+				nProc++
+				infoMerging()
+			}
+		} else {
+			for key, uuidsMap := range merges {
+				uuids := []string{}
+				for uuid := range uuidsMap {
+					uuids = append(uuids, uuid)
+				}
+				merging[strings.Join(uuids, ",")] = struct{}{}
+				res := mergeFunc(nil, key, uuids)
+				delete(merging, res.key)
+				e := res.err
+				if e != nil {
+					log.Warn("Merge error: " + e.Error())
+					errsStr += e.Error() + " "
+					nErrs++
+				}
+				nProc++
+				infoMerging()
+			}
+		}
+		sep := ""
+		if status == "" {
+			sep = table
+		} else {
+			sep = ", " + table
+		}
+		sep += ": "
+		if nErrs > 0 {
+			status += fmt.Sprintf("%sMerged %d profiles, %d errors: %s", sep, actualMerges, nErrs, errsStr)
+		} else {
+			status += fmt.Sprintf("%sMerged %d profiles", sep, actualMerges)
+		}
+		if len(lockedSkipped) > 0 {
+			sort.Strings(lockedSkipped)
+			status += fmt.Sprintf(", skipped %d locked profiles: %s", len(lockedSkipped), strings.Join(lockedSkipped, ","))
+		}
+		sort.Slice(report.Clusters, func(i, j int) bool {
+			return report.Clusters[i].Key < report.Clusters[j].Key
+		})
+	}
+	if dry {
+		status = "Dry-run: " + status
+	}
+	return
+}
+
+func (s *service) MergeUniqueIdentities(fromUUID, toUUID string, archive bool, tx *sql.Tx) (string, bool, error) {
+	return s.mergeUniqueIdentities(fromUUID, toUUID, archive, LineageOriginAPI, tx)
+}
+
+// mergeUniqueIdentities - merges fromUUID into toUUID and records the merge in lineage table with a given origin
+func (s *service) mergeUniqueIdentities(fromUUID, toUUID string, archive bool, origin string, tx *sql.Tx) (updateESUUID string, updateESIsBot bool, err error) {
+	externalTx := tx != nil
+	log.Info(fmt.Sprintf("MergeUniqueIdentities: fromUUID:%s toUUID:%s archive:%v origin:%s tx:%v/%v", fromUUID, toUUID, archive, origin, tx != nil, externalTx))
+	// s.SetOrigin()
+	defer func() {
+		log.Info(fmt.Sprintf("MergeUniqueIdentities(exit): fromUUID:%s toUUID:%s archive:%v origin:%s updateESUUID:%s updateESIsBot:%v tx:%v/%v err:%v", fromUUID, toUUID, archive, origin, updateESUUID, updateESIsBot, tx != nil, externalTx, err))
+	}()
+	if fromUUID == toUUID {
+		return
+	}
+	defer s.invalidateAffiliationCacheTx(tx, fromUUID, toUUID)
+	_, err = s.GetUniqueIdentity(fromUUID, true, nil)
+	if err != nil {
+		return
+	}
+	toUU, err := s.GetUniqueIdentity(toUUID, true, nil)
+	if err != nil {
+		return
+	}
+	from, err := s.GetProfile(fromUUID, false, nil)
+	if err != nil {
+		return
+	}
+	to, err := s.GetProfile(toUUID, false, nil)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		// Rollback unless tx was set to nil after successful commit
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
+	}
+	// Archive fromUUID and toUUID objects, all with the same archived_at date
+	var archivedAt *time.Time
+	if archive {
+		archivedDate := time.Now()
+		_, err = s.ArchiveUUID(fromUUID, &archivedDate, tx)
+		if err != nil {
+			return
+		}
+		_, err = s.ArchiveUUID(toUUID, &archivedDate, tx)
+		if err != nil {
+			return
+		}
+		archivedAt = &archivedDate
+	}
+	if from != nil && to != nil {
+		if to.Name == nil || (to.Name != nil && *to.Name == "") {
+			to.Name = from.Name
+		}
+		if to.Email == nil || (to.Email != nil && *to.Email == "") {
+			to.Email = from.Email
+		}
+		if to.CountryCode == nil || (to.CountryCode != nil && *to.CountryCode == "") {
+			to.CountryCode = from.CountryCode
+		}
+		/*
+			if to.Gender == nil || (to.Gender != nil && *to.Gender == "") {
+				to.Gender = from.Gender
+				to.GenderAcc = from.GenderAcc
+			}
+		*/
+		// Do we need to mass update is_bot on all ES indices
+		// on the fromUUID profile that will be merged into toUUID?
+		if from.IsBot != nil && to.IsBot != nil && *from.IsBot != *to.IsBot {
+			updateESUUID = fromUUID
+			if *from.IsBot == 1 {
+				updateESIsBot = true
+			} else {
+				updateESIsBot = false
+			}
+		}
+		if from.IsBot != nil && *from.IsBot == 1 {
+			isBot := int64(1)
+			to.IsBot = &isBot
+		}
+		// Update profile and refresh after update
+		to, err = s.EditProfile(to, true, tx)
+		if err != nil {
+			return
+		}
+	}
+	identities, err := s.GetUniqueIdentityIdentities(fromUUID, false, tx)
+	if err != nil {
+		return
+	}
+	for _, identity := range identities {
+		err = s.MoveIdentityToUniqueIdentity(identity, toUU, false, tx)
+		if err != nil {
+			return
+		}
+	}
+	enrollments, err := s.GetUniqueIdentityEnrollments(fromUUID, false, tx)
+	if err != nil {
+		return
+	}
+	for _, rol := range enrollments {
+		rols := []*models.EnrollmentDataOutput{}
+		rols, err = s.FindEnrollments(
+			[]string{"uuid", "organization_id", "start", "end", "project_slug", "role"},
+			[]interface{}{toUUID, rol.OrganizationID, rol.Start, rol.End, rol.ProjectSlug, rol.Role},
+			[]bool{false, false, true, true, false, false},
+			false,
+			tx,
+		)
+		if err != nil {
+			return
+		}
+		if len(rols) == 0 {
+			err = s.MoveEnrollmentToUniqueIdentity(rol, toUU, tx)
+			if err != nil {
+				return
+			}
+		}
+	}
+	// Delete unique identity archiving it to uidentities_archive
+	err = s.DeleteUniqueIdentity(fromUUID, false, true, nil, tx)
+	if err != nil {
+		return
+	}
+	orgs, err := s.FindUniqueIdentityOrganizations(toUUID, false, tx)
+	if err != nil {
+		return
+	}
+	for _, org := range orgs {
+		err = s.MergeEnrollments(toUU, org, nil, true, true, tx)
+		if err != nil {
+			return
+		}
+	}
+	err = s.addLineage(&models.LineageEvent{Action: LineageMerge, Origin: origin, FromUUID: fromUUID, ToUUID: toUUID}, archivedAt, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
+		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
+	}
+	return
+}
+
+// UnmergeProfile - reverts fields MergeUniqueIdentities copied from the merged (from) profile to the target (to) profile
+// A field is reverted when it was empty on the archived target profile and it still has the value copied from the archived
+// merged profile (so fields edited after the merge are kept), is_bot is reverted when it was only set because of the merged profile
+func (s *service) UnmergeProfile(to, archivedTo, archivedFrom *models.ProfileDataOutput) (fields []string) {
+	fields = []string{}
+	empty := func(str *string) bool {
+		return str == nil || *str == ""
+	}
+	for _, field := range []struct {
+		name    string
+		current **string
+		to      *string
+		from    *string
+	}{
+		{"name", &to.Name, archivedTo.Name, archivedFrom.Name},
+		{"email", &to.Email, archivedTo.Email, archivedFrom.Email},
+		{"country_code", &to.CountryCode, archivedTo.CountryCode, archivedFrom.CountryCode},
+	} {
+		if !empty(field.to) || empty(field.from) || empty(*field.current) || **field.current != *field.from {
+			continue
+		}
+		*field.current = field.to
+		fields = append(fields, field.name)
+	}
+	isBot := func(bot *int64) bool {
+		return bot != nil && *bot == 1
+	}
+	if isBot(to.IsBot) && isBot(archivedFrom.IsBot) && !isBot(archivedTo.IsBot) {
+		notBot := int64(0)
+		to.IsBot = &notBot
+		fields = append(fields, "is_bot")
+	}
+	return
+}
+
+// UnmergeUniqueIdentities - restores fromUUID profile merged into toUUID using the archive MergeUniqueIdentities created (archive=true)
+// toUUID is archived first, fromUUID unique identity and profile are restored as they were merged, fromUUID identities still on toUUID
+// are moved back (identities deleted or moved elsewhere after the merge are skipped), toUUID profile fields copied by the merge are
+// reverted (see UnmergeProfile) and enrollments of organizations fromUUID was enrolled to are restored on both profiles as they were
+// before the merge (current toUUID enrollments of those organizations are removed, they are archived so they can be restored)
+func (s *service) UnmergeUniqueIdentities(fromUUID, toUUID string, tx *sql.Tx) (result *models.UnmergeOutput, err error) {
+	externalTx := tx != nil
+	log.Info(fmt.Sprintf("UnmergeUniqueIdentities: fromUUID:%s toUUID:%s tx:%v/%v", fromUUID, toUUID, tx != nil, externalTx))
+	result = &models.UnmergeOutput{FromUUID: fromUUID, ToUUID: toUUID, IdentitiesMoved: []string{}, IdentitiesSkipped: []string{}, ProfileFields: []string{}}
+	defer func() {
+		log.Info(fmt.Sprintf("UnmergeUniqueIdentities(exit): fromUUID:%s toUUID:%s tx:%v/%v result:%+v err:%v", fromUUID, toUUID, tx != nil, externalTx, result, err))
+	}()
+	if fromUUID == toUUID {
+		err = fmt.Errorf("cannot unmerge unique identity '%s' from itself", fromUUID)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnmergeUniqueIdentities")
+		return
+	}
+	defer s.invalidateAffiliationCacheTx(tx, fromUUID, toUUID)
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	// MergeUniqueIdentities archives both unique identities with the same archived_at date
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select max(a.archived_at) from uidentities_archive a, uidentities_archive b where a.uuid = ? and b.uuid = ? and a.archived_at = b.archived_at",
+		fromUUID,
+		toUUID,
+	)
+	if err != nil {
+		return
+	}
+	var mergedAt *time.Time
+	for rows.Next() {
+		err = rows.Scan(&mergedAt)
+		if err != nil {
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if mergedAt == nil {
+		err = fmt.Errorf("cannot find merge archive of unique identity '%s' merged into '%s' (was it merged with archive=false?)", fromUUID, toUUID)
+		err = errs.Wrap(errs.New(err, errs.ErrNotFound), "UnmergeUniqueIdentities")
+		return
+	}
+	tm := *mergedAt
+	result.MergedAt = tm.UTC().Format(shared.ArchivedAtFormat)
+	fromUU, err := s.GetUniqueIdentity(fromUUID, false, tx)
+	if err != nil {
+		return
+	}
+	if fromUU != nil {
+		err = fmt.Errorf("unique identity '%s' exists, nothing to unmerge", fromUUID)
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnmergeUniqueIdentities")
+		return
+	}
+	_, err = s.GetUniqueIdentity(toUUID, true, tx)
+	if err != nil {
+		return
+	}
+	archivedFrom, err := s.getArchiveProfile(fromUUID, tm, tx)
+	if err != nil {
+		return
+	}
+	archivedTo, err := s.getArchiveProfile(toUUID, tm, tx)
+	if err != nil {
+		return
+	}
+	identities, err := s.GetArchiveUniqueIdentityIdentities(fromUUID, tm, false, tx)
+	if err != nil {
+		return
+	}
+	fromEnrollments, err := s.GetArchiveUniqueIdentityEnrollments(fromUUID, tm, false, tx)
+	if err != nil {
+		return
+	}
+	toEnrollments, err := s.GetArchiveUniqueIdentityEnrollments(toUUID, tm, false, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		// Rollback unless tx was set to nil after successful commit
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
+	}
+	// Archive current toUUID state, so unmerge can be undone too
+	now := time.Now()
+	_, err = s.ArchiveUUID(toUUID, &now, tx)
+	if err != nil {
+		return
+	}
+	err = s.UnarchiveUniqueIdentity(fromUUID, false, &tm, tx)
+	if err != nil {
+		return
+	}
+	if archivedFrom != nil {
+		err = s.UnarchiveProfile(fromUUID, false, &tm, tx)
+		if err != nil {
+			return
+		}
+	}
+	fromUU, err = s.GetUniqueIdentity(fromUUID, true, tx)
+	if err != nil {
+		return
+	}
+	if archivedFrom != nil && archivedTo != nil {
+		var to *models.ProfileDataOutput
+		to, err = s.GetProfile(toUUID, false, tx)
+		if err != nil {
+			return
+		}
+		if to != nil {
+			result.ProfileFields = s.UnmergeProfile(to, archivedTo, archivedFrom)
+			if len(result.ProfileFields) > 0 {
+				// EditProfile never clears fields, reverted fields can be empty
+				if to.IsBot == nil {
+					notBot := int64(0)
+					to.IsBot = &notBot
+				}
+				_, err = s.Exec(
+					s.db,
+					tx,
+					"update profiles set name = ?, email = ?, country_code = ?, is_bot = ?, last_modified_by = ? where uuid = ? and (locked_by is null or trim(locked_by) = '')",
+					to.Name,
+					to.Email,
+					to.CountryCode,
+					to.IsBot,
+					s.lfid,
+					toUUID,
+				)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	for _, identity := range identities {
+		var current *models.IdentityDataOutput
+		current, err = s.GetIdentity(identity.ID, false, tx)
+		if err != nil {
+			return
+		}
+		if current == nil || current.UUID == nil || *current.UUID != toUUID {
+			result.IdentitiesSkipped = append(result.IdentitiesSkipped, identity.ID)
+			continue
+		}
+		err = s.MoveIdentityToUniqueIdentity(current, fromUU, false, tx)
+		if err != nil {
+			return
+		}
+		result.IdentitiesMoved = append(result.IdentitiesMoved, identity.ID)
+	}
+	orgs := make(map[int64]struct{})
+	for _, rol := range fromEnrollments {
+		orgs[rol.OrganizationID] = struct{}{}
+	}
+	current, err := s.GetUniqueIdentityEnrollments(toUUID, false, tx)
+	if err != nil {
+		return
+	}
+	for _, rol := range current {
+		if _, ok := orgs[rol.OrganizationID]; !ok {
+			continue
+		}
+		// Already archived by ArchiveUUID, missingFatal is set, so locked enrollments cannot be removed
+		err = s.DeleteEnrollment(rol.ID, false, true, nil, tx)
+		if err != nil {
+			return
+		}
+		result.NEnrollmentsRemoved++
+	}
+	for _, rol := range append(toEnrollments, fromEnrollments...) {
+		if _, ok := orgs[rol.OrganizationID]; !ok {
+			continue
+		}
+		err = s.UnarchiveEnrollment(rol.ID, false, &tm, tx)
+		if err != nil {
+			if strings.Contains(err.Error(), "Error 1452: Cannot add or update a child row") {
+				log.Warn(fmt.Sprintf("UnmergeUniqueIdentities: UnarchiveEnrollment: id:%d tm:%v err:%v", rol.ID, tm, err))
+				err = nil
+				continue
+			}
+			return
+		}
+		result.NEnrollmentsRestored++
+	}
+	for _, uuid := range []string{fromUUID, toUUID} {
+		_, err = s.TouchUniqueIdentity(uuid, tx)
+		if err != nil {
+			return
+		}
+	}
+	err = s.addLineage(&models.LineageEvent{Action: LineageUnmerge, Origin: LineageOriginAPI, FromUUID: fromUUID, ToUUID: toUUID}, &tm, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
+		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
+	}
+	return
+}
+
+func (s *service) Unarchive(id, uuid string) (bool, error) {
+	return s.unarchive(id, uuid, LineageOriginAPI)
+}
+
+// unarchive - restores both unique identities archived by the most recent merge when moving identity id to uuid, records it in lineage table
+func (s *service) unarchive(id, uuid, origin string) (unarchived bool, err error) {
+	log.Info(fmt.Sprintf("Unarchive: ID:%s UUID:%s origin:%s", id, uuid, origin))
+	defer func() {
+		log.Info(fmt.Sprintf("Unarchive(exit): ID:%s UUID:%s origin:%s unarchived:%v err:%v", id, uuid, origin, unarchived, err))
+	}()
+	// Unarchive uses RW connection, also for selects
+	rows, err := s.Query(s.db, nil, "select max(archived_at) from identities_archive where id = ?", id)
+	if err != nil {
+		return
+	}
+	var archivedAt [2]*time.Time
+	fetched := false
+	for rows.Next() {
+		err = rows.Scan(&archivedAt[0])
+		if err != nil {
+			return
+		}
+		if archivedAt[0] != nil {
+			fetched = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if !fetched {
+		return
+	}
+	rows, err = s.Query(s.db, nil, "select max(archived_at) from uidentities_archive where uuid = ?", uuid)
+	if err != nil {
+		return
+	}
+	fetched = false
+	for rows.Next() {
+		err = rows.Scan(&archivedAt[1])
+		if err != nil {
+			return
+		}
+		if archivedAt[1] != nil {
+			fetched = true
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if !fetched {
+		return
+	}
+	if *archivedAt[0] != *archivedAt[1] {
+		log.Info(fmt.Sprintf("archives exists, but not from the same archiving process: %v differs from %v", *archivedAt[0], *archivedAt[1]))
+		return
+	}
+	tm := *archivedAt[0]
+	rows, err = s.Query(s.db, nil, "select distinct uuid from uidentities_archive where archived_at = ?", tm)
+	if err != nil {
+		return
+	}
+	uuids := []string{}
+	uu := ""
+	for rows.Next() {
+		err = rows.Scan(&uu)
+		if err != nil {
+			return
+		}
+		uuids = append(uuids, uu)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if len(uuids) != 2 {
+		log.Info(fmt.Sprintf("there should be exactly 2 uuids archived at %v, found %+v", tm, uuids))
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	// Rollback unless tx was set to nil after successful commit
+	defer func() {
+		if tx != nil {
+			s.RollbackTx(tx)
+		}
+	}()
+	for _, uu := range uuids {
+		err = s.UnarchiveUUID(uu, tm, tx)
+		if err != nil {
+			return
+		}
+	}
+	// uuid is the restored profile, the other one is the profile it was merged into
+	other := uuids[0]
+	if other == uuid {
+		other = uuids[1]
+	}
+	err = s.addLineage(&models.LineageEvent{Action: LineageUnarchive, Origin: origin, FromUUID: uuid, ToUUID: other, IdentityID: id}, &tm, tx)
+	if err != nil {
+		return
+	}
+	err = s.CommitTx(tx)
+	if err != nil {
+		return
+	}
+	// Set tx to nil, so deferred rollback will not happen
+	tx = nil
+	unarchived = true
+	return
+}
+
+func (s *service) MoveIdentity(fromID, toUUID string, archive bool, tx *sql.Tx) error {
+	return s.moveIdentity(fromID, toUUID, archive, LineageOriginAPI, tx)
+}
+
+// moveIdentity - moves identity fromID to toUUID (creating it when needed) and records the move in lineage table with a given origin
+func (s *service) moveIdentity(fromID, toUUID string, archive bool, origin string, tx *sql.Tx) (err error) {
+	externalTx := tx != nil
+	log.Info(fmt.Sprintf("MoveIdentity: fromID:%s toUUID:%s archive:%v origin:%s tx:%v/%v", fromID, toUUID, archive, origin, tx != nil, externalTx))
+	// s.SetOrigin()
+	defer func() {
+		log.Info(fmt.Sprintf("MoveIdentity(exit): fromID:%s toUUID:%s archive:%v origin:%s tx:%v/%v err:%v", fromID, toUUID, archive, origin, tx != nil, externalTx, err))
+	}()
+	defer s.invalidateAffiliationCacheTx(tx, toUUID)
+	if archive {
+		unarchived := false
+		unarchived, err = s.unarchive(fromID, toUUID, origin)
+		if err != nil {
+			return
+		}
+		if unarchived {
+			return
+		}
+		log.Info(fmt.Sprintf("MoveIdentity: fromID:%s toUUID:%s nothing unarchived", fromID, toUUID))
+	}
+	from, err := s.GetIdentity(fromID, true, nil)
+	if err != nil {
+		return
+	}
+	if from.UUID != nil {
+		defer s.invalidateAffiliationCacheTx(tx, *from.UUID)
+	}
+	to, err := s.GetUniqueIdentity(toUUID, false, nil)
+	if err != nil {
+		return
+	}
+	if to == nil && fromID != toUUID {
+		err = fmt.Errorf("unique identity uuid '%s' is not found and identity id is different: '%+v'", toUUID, s.ToLocalIdentity(from))
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentity")
+		return
+	}
+	if !externalTx {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		// Rollback unless tx was set to nil after successful commit
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
+	}
+	if to == nil {
+		to, err = s.AddUniqueIdentity(
+			&models.UniqueIdentityDataOutput{
+				UUID: toUUID,
+			},
+			false,
+			tx,
+		)
+		if err != nil {
+			return
+		}
+		_, err = s.AddProfile(
+			&models.ProfileDataOutput{
+				UUID:  toUUID,
+				Name:  from.Name,
+				Email: from.Email,
+			},
+			false,
+			tx,
+		)
+		if err != nil {
+			return
+		}
+	}
+	err = s.MoveIdentityToUniqueIdentity(from, to, true, tx)
+	if err != nil {
+		return
+	}
+	fromUUID := ""
+	if from.UUID != nil {
+		fromUUID = *from.UUID
+	}
+	err = s.addLineage(&models.LineageEvent{Action: LineageMove, Origin: origin, FromUUID: fromUUID, ToUUID: toUUID, IdentityID: fromID}, nil, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
+		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
+	}
+	return
+}
+
+// addLineage - records merge, move, unmerge or unarchive in lineage table, created_by defaults to the current LFID
+func (s *service) addLineage(lineage *models.LineageEvent, archivedAt *time.Time, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("addLineage: lineage:%+v archivedAt:%v tx:%v", lineage, archivedAt, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("addLineage(exit): lineage:%+v archivedAt:%v tx:%v err:%v", lineage, archivedAt, tx != nil, err))
+	}()
+	null := func(str string) interface{} {
+		if str == "" {
+			return nil
+		}
+		return str
+	}
+	if lineage.CreatedBy == "" {
+		lineage.CreatedBy = s.lfid
+	}
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"insert into uidentities_lineage(action, origin, from_uuid, to_uuid, identity_id, archived_at, created_at, created_by) values(?, ?, ?, ?, ?, ?, now(6), ?)",
+		lineage.Action,
+		lineage.Origin,
+		null(lineage.FromUUID),
+		null(lineage.ToUUID),
+		null(lineage.IdentityID),
+		archivedAt,
+		null(lineage.CreatedBy),
+	)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "addLineage")
+	}
+	return
+}
+
+// ResolveLineage - replays lineage events (oldest first) and returns the uuid given uuid was (transitively) merged into
+// and uuids (transitively) merged into it, unmerge and unarchive revert the merge between both uuids, moving an identity
+// to a merged uuid recreates it
+func (s *service) ResolveLineage(uuid string, events []*models.LineageEvent) (survivor string, ancestors []string) {
+	into := map[string]string{}
+	for _, ev := range events {
+		switch ev.Action {
+		case LineageMerge:
+			if ev.FromUUID != "" && ev.ToUUID != "" && ev.FromUUID != ev.ToUUID {
+				into[ev.FromUUID] = ev.ToUUID
+			}
+		case LineageUnmerge, LineageUnarchive:
+			if into[ev.FromUUID] == ev.ToUUID {
+				delete(into, ev.FromUUID)
+			}
+			if into[ev.ToUUID] == ev.FromUUID {
+				delete(into, ev.ToUUID)
+			}
+		case LineageMove:
+			delete(into, ev.ToUUID)
+		}
+	}
+	// chain - uuids u was merged into, stops on cycles
+	chain := func(u string) (ary []string) {
+		seen := map[string]struct{}{u: {}}
+		for {
+			next, ok := into[u]
+			if !ok {
+				return
+			}
+			if _, ok := seen[next]; ok {
+				return
+			}
+			seen[next] = struct{}{}
+			ary = append(ary, next)
+			u = next
+		}
+	}
+	survivor = uuid
+	if ary := chain(uuid); len(ary) > 0 {
+		survivor = ary[len(ary)-1]
+	}
+	ancestors = []string{}
+	for u := range into {
+		for _, next := range chain(u) {
+			if next == uuid {
+				ancestors = append(ancestors, u)
+				break
+			}
+		}
+	}
+	sort.Strings(ancestors)
+	return
+}
+
+// GetLineage - returns merge lineage of a given uuid: lineage events of all uuids connected to it via merges, unmerges and
+// unarchives (moves are returned but not followed), the uuid it was merged into and uuids merged into it
+func (s *service) GetLineage(uuid string, tx *sql.Tx) (lineage *models.LineageOutput, err error) {
+	log.Info(fmt.Sprintf("GetLineage: uuid:%s tx:%v", uuid, tx != nil))
+	lineage = &models.LineageOutput{UUID: uuid, Ancestors: []string{}, Events: []*models.LineageEvent{}}
+	defer func() {
+		log.Info(fmt.Sprintf("GetLineage(exit): uuid:%s tx:%v survivor:%s ancestors:%d events:%d err:%v", uuid, tx != nil, lineage.SurvivorUUID, len(lineage.Ancestors), len(lineage.Events), err))
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	uuids := map[string]struct{}{uuid: {}}
+	events := map[int64]*models.LineageEvent{}
+	frontier := []string{uuid}
+	for len(frontier) > 0 {
+		in := "(" + strings.Repeat("?,", len(frontier)-1) + "?)"
+		args := []interface{}{}
+		for i := 0; i < 2; i++ {
+			for _, u := range frontier {
+				args = append(args, u)
+			}
+		}
+		var rows *sql.Rows
+		rows, err = s.Query(
+			sdb,
+			tx,
+			"select id, action, origin, coalesce(from_uuid, ''), coalesce(to_uuid, ''), coalesce(identity_id, ''), archived_at, created_at, coalesce(created_by, '') "+
+				"from uidentities_lineage where from_uuid in "+in+" or to_uuid in "+in,
+			args...,
+		)
+		if err != nil {
+			return
+		}
+		frontier = []string{}
+		for rows.Next() {
+			ev := &models.LineageEvent{}
+			var archivedAt *time.Time
+			createdAt := time.Time{}
+			err = rows.Scan(&ev.ID, &ev.Action, &ev.Origin, &ev.FromUUID, &ev.ToUUID, &ev.IdentityID, &archivedAt, &createdAt, &ev.CreatedBy)
+			if err != nil {
+				return
+			}
+			if archivedAt != nil {
+				ev.ArchivedAt = archivedAt.UTC().Format(shared.ArchivedAtFormat)
+			}
+			ev.CreatedAt = createdAt.UTC().Format(shared.ArchivedAtFormat)
+			events[ev.ID] = ev
+			if ev.Action == LineageMove {
+				continue
+			}
+			for _, u := range []string{ev.FromUUID, ev.ToUUID} {
+				if _, ok := uuids[u]; ok || u == "" {
+					continue
+				}
+				if len(uuids) >= LineageMaxUUIDs {
+					log.Warn(fmt.Sprintf("GetLineage: uuid:%s lineage has more than %d uuids, skipping %s", uuid, LineageMaxUUIDs, u))
+					continue
+				}
+				uuids[u] = struct{}{}
+				frontier = append(frontier, u)
+			}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	for _, ev := range events {
+		lineage.Events = append(lineage.Events, ev)
+	}
+	// Auto increment ID follows the order in which events were recorded
+	sort.Slice(lineage.Events, func(i, j int) bool {
+		return lineage.Events[i].ID < lineage.Events[j].ID
+	})
+	lineage.SurvivorUUID, lineage.Ancestors = s.ResolveLineage(uuid, lineage.Events)
+	uu, err := s.GetUniqueIdentity(uuid, false, tx)
+	if err != nil {
+		return
+	}
+	lineage.Exists = uu != nil
+	if !lineage.Exists && len(lineage.Events) == 0 {
+		err = errs.Wrap(errs.New(fmt.Errorf("unique identity '%s' not found and it has no lineage", uuid), errs.ErrNotFound), "GetLineage")
+		return
+	}
+	lineage.SurvivorExists = lineage.Exists
+	if lineage.SurvivorUUID != uuid {
+		uu, err = s.GetUniqueIdentity(lineage.SurvivorUUID, false, tx)
+		if err != nil {
+			return
+		}
+		lineage.SurvivorExists = uu != nil
+	}
+	return
+}
+
+// erasedIdentityID - returns random identity ID (same format as sha1 based ones) given to identities erased by ForgetProfile
+func erasedIdentityID() (id string, err error) {
+	b := make([]byte, sha1.Size)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	id = hex.EncodeToString(b)
+	return
+}
+
+// EmailHash - returns SHA-256 hash of lowercased and trimmed email, this is how erased emails are stored in suppressed_emails table
+func (s *service) EmailHash(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(hash[:])
+}
+
+// suppressedEmails - returns the subset of given emails (lowercased) that belong to erased persons (see ForgetProfile)
+// Any error (including missing suppressed_emails table, see sql/add_gdpr.sql) is returned, so erased persons are never re-imported
+func (s *service) suppressedEmails(emails []string, tx *sql.Tx) (suppressed map[string]struct{}, err error) {
+	suppressed = make(map[string]struct{})
+	hashes := make(map[string]string)
+	for _, email := range emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" {
+			continue
+		}
+		hashes[s.EmailHash(email)] = email
+	}
+	if len(hashes) == 0 {
+		return
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	ary := []interface{}{}
+	for hash := range hashes {
+		ary = append(ary, hash)
+	}
+	n := len(ary)
+	for i := 0; i < n; i += shared.AffBatchPackSize {
+		j := i + shared.AffBatchPackSize
+		if j > n {
+			j = n
+		}
+		var rows *sql.Rows
+		rows, err = s.Query(sdb, tx, "select email_hash from suppressed_emails where email_hash in ("+strings.Repeat("?,", j-i-1)+"?)", ary[i:j]...)
+		if err != nil {
+			err = errs.Wrap(errs.New(fmt.Errorf("cannot check suppressed emails: %v", err), errs.ErrServerError), "suppressedEmails")
+			return
+		}
+		hash := ""
+		for rows.Next() {
+			err = rows.Scan(&hash)
+			if err != nil {
+				return
+			}
+			suppressed[hashes[hash]] = struct{}{}
+		}
+		err = rows.Err()
+		if err != nil {
+			return
+		}
+		err = rows.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ForgetProfile - GDPR erasure: anonymizes uuid's profile and identities and all archived profiles/identities of uuid and uuids
+// merged into it (from lineage), hashes of all their emails are added to suppressed_emails so re-imports are skipped
+// Identity ID is a sha1 of source, email, name and username, so anonymized identities (also archived and in lineage) get random IDs
+// Returns erasure receipt (stored in erasure_receipts) and map of old to new IDs of anonymized identities, ES is not touched here
+func (s *service) ForgetProfile(uuid string, tx *sql.Tx) (receipt *models.ErasureReceipt, ids map[string]string, err error) {
+	log.Info(fmt.Sprintf("ForgetProfile: uuid:%s tx:%v", uuid, tx != nil))
+	receipt = &models.ErasureReceipt{}
+	defer func() {
+		log.Info(fmt.Sprintf("ForgetProfile(exit): uuid:%s tx:%v receipt:%d ids:%d err:%v", uuid, tx != nil, receipt.ID, len(ids), err))
+	}()
+	externalTx := tx != nil
+	if !externalTx {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+		}()
+	}
+	_, err = s.GetUniqueIdentity(uuid, true, tx)
+	if err != nil {
+		return
+	}
+	lineage, err := s.GetLineage(uuid, tx)
+	if err != nil {
+		return
+	}
+	uuids := append([]string{uuid}, lineage.Ancestors...)
+	uuidsIn := "(" + strings.Repeat("?,", len(uuids)-1) + "?)"
+	uuidsArgs := []interface{}{}
+	for _, u := range uuids {
+		uuidsArgs = append(uuidsArgs, u)
+	}
+	emails := []string{}
+	collect := func(query string, args []interface{}) (e error) {
+		rows, e := s.Query(s.db, tx, query, args...)
+		if e != nil {
+			return
+		}
+		var email, username, name *string
+		for rows.Next() {
+			e = rows.Scan(&email, &username, &name)
+			if e != nil {
+				return
+			}
+			for _, str := range []*string{email, username, name} {
+				if str != nil && shared.EmailRegex.MatchString(strings.TrimSpace(*str)) {
+					emails = append(emails, *str)
+				}
+			}
+		}
+		e = rows.Err()
+		if e != nil {
+			return
+		}
+		e = rows.Close()
+		return
+	}
+	ids = make(map[string]string)
+	collectIDs := func(query string, args []interface{}) (e error) {
+		rows, e := s.Query(s.db, tx, query, args...)
+		if e != nil {
+			return
+		}
+		id := ""
+		for rows.Next() {
+			e = rows.Scan(&id)
+			if e != nil {
+				return
+			}
+			if _, ok := ids[id]; ok {
+				continue
+			}
+			ids[id], e = erasedIdentityID()
+			if e != nil {
+				return
+			}
+		}
+		e = rows.Err()
+		if e != nil {
+			return
+		}
+		e = rows.Close()
+		return
+	}
+	err = collectIDs("select id from identities where uuid = ?", []interface{}{uuid})
+	if err != nil {
+		return
+	}
+	// Archived identities of erased uuids and archived versions of current identities (they could be moved from other uuids)
+	archCond := "uuid in " + uuidsIn
+	archArgs := append([]interface{}{}, uuidsArgs...)
+	if len(ids) > 0 {
+		archCond = "(" + archCond + " or id in (" + strings.Repeat("?,", len(ids)-1) + "?))"
+		for id := range ids {
+			archArgs = append(archArgs, id)
+		}
+	}
+	err = collectIDs("select distinct id from identities_archive where "+archCond, archArgs)
+	if err != nil {
+		return
+	}
+	err = collect("select email, null, name from profiles where uuid = ?", []interface{}{uuid})
+	if err != nil {
+		return
+	}
+	err = collect("select email, username, name from identities where uuid = ?", []interface{}{uuid})
+	if err != nil {
+		return
+	}
+	err = collect("select email, null, name from profiles_archive where uuid in "+uuidsIn, uuidsArgs)
+	if err != nil {
+		return
+	}
+	err = collect("select email, username, name from identities_archive where "+archCond, archArgs)
+	if err != nil {
+		return
+	}
+	update := func(query string, args ...interface{}) (affected int64, e error) {
+		res, e := s.Exec(s.db, tx, query, args...)
+		if e != nil {
+			return
+		}
+		affected, e = res.RowsAffected()
+		return
+	}
+	receipt.Profiles, err = update(
+		"update profiles set name = ?, email = null, country_code = null, last_modified_by = ? where uuid = ?",
+		ErasedName, s.lfid, uuid,
+	)
+	if err != nil {
+		return
+	}
+	receipt.Identities, err = update(
+		"update identities set name = ?, email = null, username = null, last_modified = now(), last_modified_by = ? where uuid = ?",
+		ErasedName, s.lfid, uuid,
+	)
+	if err != nil {
+		return
+	}
+	receipt.ArchivedProfiles, err = update(
+		"update profiles_archive set name = ?, email = null, country_code = null where uuid in "+uuidsIn,
+		append([]interface{}{ErasedName}, uuidsArgs...)...,
+	)
+	if err != nil {
+		return
+	}
+	receipt.ArchivedIdentities, err = update(
+		"update identities_archive set name = ?, email = null, username = null where "+archCond,
+		append([]interface{}{ErasedName}, archArgs...)...,
+	)
+	if err != nil {
+		return
+	}
+	for id, newID := range ids {
+		for _, query := range []string{
+			"update identities set id = ? where id = ?",
+			"update identities_archive set id = ? where id = ?",
+			"update uidentities_lineage set identity_id = ? where identity_id = ?",
+		} {
+			_, err = update(query, newID, id)
+			if err != nil {
+				return
+			}
+		}
+	}
+	_, err = s.TouchUniqueIdentity(uuid, tx)
+	if err != nil {
+		return
+	}
+	res, err := s.Exec(
+		s.db,
+		tx,
+		"insert into erasure_receipts(uuid, uuids, profiles, identities, archived_profiles, archived_identities, erased_at, erased_by) values(?, ?, ?, ?, ?, ?, now(6), ?)",
+		uuid,
+		strings.Join(uuids, ","),
+		receipt.Profiles,
+		receipt.Identities,
+		receipt.ArchivedProfiles,
+		receipt.ArchivedIdentities,
+		s.lfid,
+	)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ForgetProfile")
+		return
+	}
+	receiptID, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	hashes := make(map[string]struct{})
+	for _, email := range emails {
+		hashes[s.EmailHash(email)] = struct{}{}
+	}
+	for hash := range hashes {
+		// Email can already be suppressed by an earlier erasure, it stays assigned to that receipt then
+		_, err = s.Exec(
+			s.db,
+			tx,
+			"insert ignore into suppressed_emails(email_hash, receipt_id, created_at, created_by) values(?, ?, now(6), ?)",
+			hash,
+			receiptID,
+			s.lfid,
+		)
+		if err != nil {
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ForgetProfile")
+			return
+		}
+	}
+	receipt, err = s.GetErasureReceipt(receiptID, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		err = s.CommitTx(tx)
+		if err != nil {
+			return
+		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
+	}
+	return
+}
+
+// GetErasureReceipt - returns GDPR erasure receipt with given ID with hashes of emails suppressed by it
+func (s *service) GetErasureReceipt(id int64, tx *sql.Tx) (receipt *models.ErasureReceipt, err error) {
+	log.Info(fmt.Sprintf("GetErasureReceipt: id:%d tx:%v", id, tx != nil))
+	receipt = &models.ErasureReceipt{}
+	defer func() {
+		log.Info(fmt.Sprintf("GetErasureReceipt(exit): id:%d tx:%v receipt:%+v err:%v", id, tx != nil, receipt, err))
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select id, uuid, coalesce(uuids, ''), profiles, identities, archived_profiles, archived_identities, coalesce(es_status, ''), coalesce(es_error, ''), "+
+			"coalesce(es_indices, ''), coalesce(es_not_covered, ''), erased_at, coalesce(erased_by, '') "+
+			"from erasure_receipts where id = ?",
+		id,
+	)
+	if err != nil {
+		return
+	}
+	fetched := false
+	uuids := ""
+	erasedAt := time.Time{}
+	for rows.Next() {
+		err = rows.Scan(
+			&receipt.ID,
+			&receipt.UUID,
+			&uuids,
+			&receipt.Profiles,
+			&receipt.Identities,
+			&receipt.ArchivedProfiles,
+			&receipt.ArchivedIdentities,
+			&receipt.EsStatus,
+			&receipt.EsError,
+			&receipt.EsIndices,
+			&receipt.EsNotCovered,
+			&erasedAt,
+			&receipt.ErasedBy,
+		)
+		if err != nil {
+			return
+		}
+		fetched = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	if !fetched {
+		err = errs.Wrap(errs.New(fmt.Errorf("cannot find erasure receipt id %d", id), errs.ErrNotFound), "GetErasureReceipt")
+		return
+	}
+	receipt.ErasedAt = strfmt.DateTime(erasedAt)
+	receipt.Uuids = []string{}
+	if uuids != "" {
+		receipt.Uuids = strings.Split(uuids, ",")
+	}
+	receipt.EmailHashes = []string{}
+	rows, err = s.Query(sdb, tx, "select email_hash from suppressed_emails where receipt_id = ? order by email_hash", id)
+	if err != nil {
+		return
+	}
+	hash := ""
+	for rows.Next() {
+		err = rows.Scan(&hash)
+		if err != nil {
+			return
+		}
+		receipt.EmailHashes = append(receipt.EmailHashes, hash)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// SetErasureReceiptESStatus - stores the outcome of rewriting ES author fields for a given erasure receipt (and which ES indices were covered)
+func (s *service) SetErasureReceiptESStatus(receipt *models.ErasureReceipt, tx *sql.Tx) (err error) {
+	log.Info(fmt.Sprintf("SetErasureReceiptESStatus: id:%d status:%s tx:%v", receipt.ID, receipt.EsStatus, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("SetErasureReceiptESStatus(exit): id:%d status:%s tx:%v err:%v", receipt.ID, receipt.EsStatus, tx != nil, err))
+	}()
+	var esError interface{}
+	if receipt.EsError != "" {
+		esError = receipt.EsError
+	}
+	_, err = s.Exec(
+		s.db,
+		tx,
+		"update erasure_receipts set es_status = ?, es_error = ?, es_indices = ?, es_not_covered = ? where id = ?",
+		receipt.EsStatus,
+		esError,
+		receipt.EsIndices,
+		receipt.EsNotCovered,
+		receipt.ID,
+	)
+	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "SetErasureReceiptESStatus")
+	}
+	return
+}
+
+// FindUUIDsByEmail - returns uuids of profiles having given email (case insensitive) in profile or any of its identities
+func (s *service) FindUUIDsByEmail(email string, tx *sql.Tx) (uuids []string, err error) {
+	log.Info(fmt.Sprintf("FindUUIDsByEmail: email:%s tx:%v", email, tx != nil))
+	defer func() {
+		log.Info(fmt.Sprintf("FindUUIDsByEmail(exit): email:%s tx:%v uuids:%+v err:%v", email, tx != nil, uuids, err))
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	email = strings.TrimSpace(email)
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select uuid from identities where lower(email) = lower(?) union select uuid from profiles where lower(email) = lower(?) order by 1",
+		email,
+		email,
+	)
+	if err != nil {
+		return
+	}
+	uuid := ""
+	for rows.Next() {
+		err = rows.Scan(&uuid)
+		if err != nil {
+			return
+		}
+		uuids = append(uuids, uuid)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// getProfileVersions - returns archived versions of given uuids profiles with identities archived together with them
+// (also archived versions of identities with given ids), grouped by uuid and archived_at, the most recent first
+func (s *service) getProfileVersions(uuids, ids []string, tx *sql.Tx) (versions []*models.ProfileVersion, err error) {
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	versions = []*models.ProfileVersion{}
+	if len(uuids) == 0 {
+		return
+	}
+	uuidsIn := "(" + strings.Repeat("?,", len(uuids)-1) + "?)"
+	args := []interface{}{}
+	for _, uuid := range uuids {
+		args = append(args, uuid)
+	}
+	versionsMap := make(map[string]*models.ProfileVersion)
+	version := func(uuid string, archivedAt time.Time, archivedBy *string) *models.ProfileVersion {
+		at := archivedAt.UTC().Format(shared.ArchivedAtFormat)
+		key := uuid + ":" + at
+		ver, ok := versionsMap[key]
+		if !ok {
+			ver = &models.ProfileVersion{ArchivedAt: at, ArchivedBy: archivedBy, Identities: []*models.IdentityDataOutput{}}
+			versionsMap[key] = ver
+			versions = append(versions, ver)
+		}
+		return ver
+	}
+	var (
+		archivedAt time.Time
+		archivedBy *string
+	)
+	rows, err := s.Query(sdb, tx, "select uuid, name, email, is_bot, country_code, archived_at, last_modified_by from profiles_archive where uuid in "+uuidsIn, args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		profileData := &models.ProfileDataOutput{}
+		err = rows.Scan(
+			&profileData.UUID,
+			&profileData.Name,
+			&profileData.Email,
+			&profileData.IsBot,
+			&profileData.CountryCode,
+			&archivedAt,
+			&archivedBy,
+		)
+		if err != nil {
+			return
+		}
+		version(profileData.UUID, archivedAt, archivedBy).Profile = profileData
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	cond := "uuid in " + uuidsIn
+	if len(ids) > 0 {
+		cond += " or id in (" + strings.Repeat("?,", len(ids)-1) + "?)"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	rows, err = s.Query(
+		sdb,
+		tx,
+		"select id, uuid, source, name, email, username, last_modified, archived_at, last_modified_by from identities_archive where "+cond+" order by id",
+		args...,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		identityData := &models.IdentityDataOutput{}
+		err = rows.Scan(
+			&identityData.ID,
+			&identityData.UUID,
+			&identityData.Source,
+			&identityData.Name,
+			&identityData.Email,
+			&identityData.Username,
+			&identityData.LastModified,
+			&archivedAt,
+			&archivedBy,
+		)
+		if err != nil {
+			return
+		}
+		uuid := ""
+		if identityData.UUID != nil {
+			uuid = *identityData.UUID
+		}
+		ver := version(uuid, archivedAt, archivedBy)
+		ver.Identities = append(ver.Identities, identityData)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	if err != nil {
+		return
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].ArchivedAt > versions[j].ArchivedAt
+	})
+	return
+}
+
+// DataExportTerms - returns keys (uuids and identity ids) and values (distinct emails, names and usernames)
+// of everything collected about a person, they are used to find other data mentioning that person
+func (s *service) DataExportTerms(person *models.DataExportPerson) (keys, values []string) {
+	seenKeys := make(map[string]struct{})
+	seenValues := make(map[string]struct{})
+	addKey := func(key string) {
+		if _, ok := seenKeys[key]; ok || key == "" {
+			return
+		}
+		seenKeys[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	addValues := func(strs ...*string) {
+		for _, str := range strs {
+			if str == nil {
+				continue
+			}
+			value := strings.TrimSpace(*str)
+			if _, ok := seenValues[value]; ok || value == "" {
+				continue
+			}
+			seenValues[value] = struct{}{}
+			values = append(values, value)
+		}
+	}
+	addIdentity := func(identity *models.IdentityDataOutput) {
+		addKey(identity.ID)
+		addValues(identity.Email, identity.Name, identity.Username)
+	}
+	addKey(person.UUID)
+	if person.Lineage != nil {
+		for _, uuid := range person.Lineage.Ancestors {
+			addKey(uuid)
+		}
+	}
+	if person.Current != nil {
+		if person.Current.Profile != nil {
+			addValues(person.Current.Profile.Email, person.Current.Profile.Name)
+		}
+		for _, identity := range person.Current.Identities {
+			addIdentity(identity)
+		}
+	}
+	for _, ver := range person.ProfileVersions {
+		if ver.Profile != nil {
+			addValues(ver.Profile.Email, ver.Profile.Name)
+		}
+		for _, identity := range ver.Identities {
+			addIdentity(identity)
+		}
+	}
+	return
+}
+
+// ExportPersonData - GDPR data access export of a person: current profile with identities and enrollments, archived profile, identities
+// and enrollments versions and merge lineage of uuid and uuids merged into it and matching blacklist entries equal to person's data
+// Old uuid that was merged into another one exports the surviving uuid, API log entries are not included (they are in ES)
+func (s *service) ExportPersonData(uuid string, tx *sql.Tx) (person *models.DataExportPerson, err error) {
+	log.Info(fmt.Sprintf("ExportPersonData: uuid:%s tx:%v", uuid, tx != nil))
+	person = &models.DataExportPerson{UUID: uuid}
+	defer func() {
+		log.Info(
+			fmt.Sprintf(
+				"ExportPersonData(exit): uuid:%s tx:%v exported:%s profileVersions:%d enrollmentVersions:%d blacklist:%d err:%v",
+				uuid,
+				tx != nil,
+				person.UUID,
+				len(person.ProfileVersions),
+				len(person.EnrollmentVersions),
+				len(person.MatchingBlacklist),
+				err,
+			),
+		)
+	}()
+	lineage, err := s.GetLineage(uuid, tx)
+	if err != nil {
+		return
+	}
+	if lineage.SurvivorUUID != uuid && lineage.SurvivorExists {
+		lineage, err = s.GetLineage(lineage.SurvivorUUID, tx)
+		if err != nil {
+			return
+		}
+	}
+	person.UUID = lineage.UUID
+	person.Lineage = lineage
+	ary, _, err := s.QueryUniqueIdentitiesNested("uuid="+person.UUID, 1, 1, false, []string{"all-projects"}, tx)
+	if err != nil {
+		return
+	}
+	ids := []string{}
+	if len(ary) > 0 {
+		person.Current = ary[0]
+		for _, identity := range person.Current.Identities {
+			ids = append(ids, identity.ID)
+		}
+	}
+	uuids := append([]string{person.UUID}, lineage.Ancestors...)
+	person.ProfileVersions, err = s.getProfileVersions(uuids, ids, tx)
+	if err != nil {
+		return
+	}
+	person.EnrollmentVersions = []*models.EnrollmentVersion{}
+	for _, u := range uuids {
+		var versions []*models.EnrollmentVersion
+		versions, err = s.GetEnrollmentVersions(u, 0, nil, tx)
+		if err != nil {
+			return
 		}
-		sep += ": "
-		if nErrs > 0 {
-			status += fmt.Sprintf("%sMerged %d profiles, %d errors: %s", sep, actualMerges, nErrs, errsStr)
-		} else {
-			status += fmt.Sprintf("%sMerged %d profiles", sep, actualMerges)
+		person.EnrollmentVersions = append(person.EnrollmentVersions, versions...)
+	}
+	sort.SliceStable(person.EnrollmentVersions, func(i, j int) bool {
+		return person.EnrollmentVersions[i].ArchivedAt > person.EnrollmentVersions[j].ArchivedAt
+	})
+	person.MatchingBlacklist = []*models.MatchingBlacklistOutput{}
+	_, values := s.DataExportTerms(person)
+	if len(values) == 0 {
+		return
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	args := []interface{}{}
+	for _, value := range values {
+		args = append(args, value)
+	}
+	rows, err := s.Query(sdb, tx, "select excluded from matching_blacklist where excluded in ("+strings.Repeat("?,", len(values)-1)+"?) order by excluded", args...)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		entry := &models.MatchingBlacklistOutput{}
+		err = rows.Scan(&entry.Excluded)
+		if err != nil {
+			return
 		}
+		person.MatchingBlacklist = append(person.MatchingBlacklist, entry)
 	}
-	if dry {
-		status = "Dry-run: " + status
+	err = rows.Err()
+	if err != nil {
+		return
 	}
+	err = rows.Close()
 	return
 }
 
-func (s *service) MergeUniqueIdentities(fromUUID, toUUID string, archive bool, tx *sql.Tx) (updateESUUID string, updateESIsBot bool, err error) {
-	externalTx := tx != nil
-	log.Info(fmt.Sprintf("MergeUniqueIdentities: fromUUID:%s toUUID:%s archive:%v tx:%v/%v", fromUUID, toUUID, archive, tx != nil, externalTx))
-	// s.SetOrigin()
+// GetLock - returns lock state of profile (key is uuid), identity (key is id) or enrollment (key is id)
+func (s *service) GetLock(object, key string, tx *sql.Tx) (lock *models.Lock, err error) {
+	log.Info(fmt.Sprintf("GetLock: object:%s key:%s tx:%v", object, key, tx != nil))
 	defer func() {
-		log.Info(fmt.Sprintf("MergeUniqueIdentities(exit): fromUUID:%s toUUID:%s archive:%v updateESUUID:%s updateESIsBot:%v tx:%v/%v err:%v", fromUUID, toUUID, archive, updateESUUID, updateESIsBot, tx != nil, externalTx, err))
+		log.Info(fmt.Sprintf("GetLock(exit): object:%s key:%s tx:%v lock:%+v err:%v", object, key, tx != nil, lock, err))
 	}()
-	if fromUUID == toUUID {
+	def, ok := lockDefs[object]
+	if !ok {
+		err = errs.Wrap(errs.New(fmt.Errorf("unknown lock object '%s', allowed: %s, %s, %s", object, LockProfile, LockIdentity, LockEnrollment), errs.ErrBadRequest), "GetLock")
 		return
 	}
-	_, err = s.GetUniqueIdentity(fromUUID, true, nil)
-	if err != nil {
-		return
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
 	}
-	toUU, err := s.GetUniqueIdentity(toUUID, true, nil)
+	rows, err := s.Query(sdb, tx, def.sel+" where "+def.key+" = ?", key)
 	if err != nil {
 		return
 	}
-	from, err := s.GetProfile(fromUUID, false, nil)
+	for rows.Next() {
+		lock = &models.Lock{}
+		err = rows.Scan(&lock.Object, &lock.Key, &lock.UUID, &lock.LockedBy, &lock.Description)
+		if err != nil {
+			return
+		}
+	}
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	to, err := s.GetProfile(toUUID, false, nil)
+	err = rows.Close()
 	if err != nil {
 		return
 	}
+	if lock == nil {
+		err = errs.Wrap(errs.New(fmt.Errorf("%s '%s' not found", object, key), errs.ErrNotFound), "GetLock")
+	}
+	return
+}
+
+// SetLock - locks (lockedBy set) or unlocks (lockedBy empty) profile, identity or enrollment, see GetLock
+// automated mass-update APIs skip locked objects, returns lock state after the change
+func (s *service) SetLock(object, key, lockedBy string, tx *sql.Tx) (lock *models.Lock, err error) {
+	externalTx := tx != nil
+	log.Info(fmt.Sprintf("SetLock: object:%s key:%s lockedBy:%s tx:%v/%v", object, key, lockedBy, tx != nil, externalTx))
+	defer func() {
+		log.Info(fmt.Sprintf("SetLock(exit): object:%s key:%s lockedBy:%s tx:%v/%v lock:%+v err:%v", object, key, lockedBy, tx != nil, externalTx, lock, err))
+	}()
+	lockedBy = strings.TrimSpace(lockedBy)
 	if !externalTx {
 		tx, err = s.db.Begin()
 		if err != nil {
@@ -6447,191 +11993,449 @@ func (s *service) MergeUniqueIdentities(fromUUID, toUUID string, archive bool, t
 		// Rollback unless tx was set to nil after successful commit
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 	}
-	// Archive fromUUID and toUUID objects, all with the same archived_at date
-	if archive {
-		archivedDate := time.Now()
-		_, err = s.ArchiveUUID(fromUUID, &archivedDate, tx)
+	// Also validates object and checks if it exists
+	_, err = s.GetLock(object, key, tx)
+	if err != nil {
+		return
+	}
+	var value interface{}
+	if lockedBy != "" {
+		value = lockedBy
+	}
+	updates := []string{}
+	switch object {
+	case LockProfile:
+		updates = append(updates, "update uidentities set locked_by = ? where uuid = ?", "update profiles set locked_by = ? where uuid = ?")
+	case LockIdentity:
+		updates = append(updates, "update identities set locked_by = ? where id = ?")
+	case LockEnrollment:
+		updates = append(updates, "update enrollments set locked_by = ? where id = ?")
+	}
+	for _, update := range updates {
+		_, err = s.Exec(s.db, tx, update, value, key)
 		if err != nil {
 			return
 		}
-		_, err = s.ArchiveUUID(toUUID, &archivedDate, tx)
+	}
+	lock, err = s.GetLock(object, key, tx)
+	if err != nil {
+		return
+	}
+	if !externalTx {
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
+		// Set tx to nil, so deferred rollback will not happen
+		tx = nil
 	}
-	if from != nil && to != nil {
-		if to.Name == nil || (to.Name != nil && *to.Name == "") {
-			to.Name = from.Name
-		}
-		if to.Email == nil || (to.Email != nil && *to.Email == "") {
-			to.Email = from.Email
-		}
-		if to.CountryCode == nil || (to.CountryCode != nil && *to.CountryCode == "") {
-			to.CountryCode = from.CountryCode
-		}
-		/*
-			if to.Gender == nil || (to.Gender != nil && *to.Gender == "") {
-				to.Gender = from.Gender
-				to.GenderAcc = from.GenderAcc
-			}
-		*/
-		// Do we need to mass update is_bot on all ES indices
-		// on the fromUUID profile that will be merged into toUUID?
-		if from.IsBot != nil && to.IsBot != nil && *from.IsBot != *to.IsBot {
-			updateESUUID = fromUUID
-			if *from.IsBot == 1 {
-				updateESIsBot = true
-			} else {
-				updateESIsBot = false
-			}
+	return
+}
+
+// GetLocks - returns locked objects (all or of given object type), optionally only those locked by lockedBy
+// locks are sorted by object type and key, rows > 0 and page > 0 enables paging, nRows is the number of all matching locks
+func (s *service) GetLocks(object, lockedBy string, rows, page int64, tx *sql.Tx) (locks []*models.Lock, nRows int64, err error) {
+	log.Info(fmt.Sprintf("GetLocks: object:%s lockedBy:%s rows:%d page:%d tx:%v", object, lockedBy, rows, page, tx != nil))
+	locks = []*models.Lock{}
+	defer func() {
+		log.Info(fmt.Sprintf("GetLocks(exit): object:%s lockedBy:%s rows:%d page:%d tx:%v locks:%d n_rows:%d err:%v", object, lockedBy, rows, page, tx != nil, len(locks), nRows, err))
+	}()
+	objects := []string{LockProfile, LockIdentity, LockEnrollment}
+	if object != "" {
+		_, ok := lockDefs[object]
+		if !ok {
+			err = errs.Wrap(errs.New(fmt.Errorf("unknown lock object '%s', allowed: %s, %s, %s", object, LockProfile, LockIdentity, LockEnrollment), errs.ErrBadRequest), "GetLocks")
+			return
 		}
-		if from.IsBot != nil && *from.IsBot == 1 {
-			isBot := int64(1)
-			to.IsBot = &isBot
+		objects = []string{object}
+	}
+	lockedBy = strings.TrimSpace(lockedBy)
+	parts := []string{}
+	args := []interface{}{}
+	for _, obj := range objects {
+		def := lockDefs[obj]
+		part := def.sel + " where " + def.locked + " != ''"
+		if lockedBy != "" {
+			part += " and " + def.locked + " = ?"
+			args = append(args, lockedBy)
 		}
-		// Update profile and refresh after update
-		to, err = s.EditProfile(to, true, tx)
+		parts = append(parts, part)
+	}
+	union := strings.Join(parts, " union all ")
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	qrows, err := s.Query(sdb, tx, "select count(*) from ("+union+") l", args...)
+	if err != nil {
+		return
+	}
+	for qrows.Next() {
+		err = qrows.Scan(&nRows)
 		if err != nil {
 			return
 		}
 	}
-	identities, err := s.GetUniqueIdentityIdentities(fromUUID, false, tx)
+	err = qrows.Err()
 	if err != nil {
 		return
 	}
-	for _, identity := range identities {
-		err = s.MoveIdentityToUniqueIdentity(identity, toUU, false, tx)
+	err = qrows.Close()
+	if err != nil {
+		return
+	}
+	if nRows == 0 {
+		return
+	}
+	paging := ""
+	if rows > 0 && page > 0 {
+		paging = fmt.Sprintf(" limit %d offset %d", rows, (page-1)*rows)
+	}
+	qrows, err = s.Query(sdb, tx, union+" order by 1, 2"+paging, args...)
+	if err != nil {
+		return
+	}
+	for qrows.Next() {
+		lock := &models.Lock{}
+		err = qrows.Scan(&lock.Object, &lock.Key, &lock.UUID, &lock.LockedBy, &lock.Description)
 		if err != nil {
 			return
 		}
+		locks = append(locks, lock)
 	}
-	enrollments, err := s.GetUniqueIdentityEnrollments(fromUUID, false, tx)
+	err = qrows.Err()
 	if err != nil {
 		return
 	}
-	for _, rol := range enrollments {
-		rols := []*models.EnrollmentDataOutput{}
-		rols, err = s.FindEnrollments(
-			[]string{"uuid", "organization_id", "start", "end", "project_slug", "role"},
-			[]interface{}{toUUID, rol.OrganizationID, rol.Start, rol.End, rol.ProjectSlug, rol.Role},
-			[]bool{false, false, true, true, false, false},
-			false,
-			tx,
-		)
+	err = qrows.Close()
+	return
+}
+
+// LockedProfiles - returns map uuid -> locked_by for those of given uuids that are locked (see lockDefs)
+func (s *service) LockedProfiles(uuids []string, tx *sql.Tx) (locked map[string]string, err error) {
+	locked = make(map[string]string)
+	if len(uuids) == 0 {
+		return
+	}
+	def := lockDefs[LockProfile]
+	args := []interface{}{}
+	for _, uuid := range uuids {
+		args = append(args, uuid)
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select u.uuid, "+def.locked+" from uidentities u left join profiles p on p.uuid = u.uuid where u.uuid in ("+
+			strings.Repeat("?,", len(uuids)-1)+"?) and "+def.locked+" != ''",
+		args...,
+	)
+	if err != nil {
+		return
+	}
+	uuid, lockedBy := "", ""
+	for rows.Next() {
+		err = rows.Scan(&uuid, &lockedBy)
 		if err != nil {
 			return
 		}
-		if len(rols) == 0 {
-			err = s.MoveEnrollmentToUniqueIdentity(rol, toUU, tx)
-			if err != nil {
-				return
-			}
+		locked[uuid] = lockedBy
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	err = rows.Close()
+	return
+}
+
+// LockedEnrollments - returns map id -> locked_by for those of given enrollment ids that are locked (see lockDefs)
+func (s *service) LockedEnrollments(ids []int64, tx *sql.Tx) (locked map[int64]string, err error) {
+	locked = make(map[int64]string)
+	if len(ids) == 0 {
+		return
+	}
+	args := []interface{}{}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(
+		sdb,
+		tx,
+		"select e.id, "+lockDefs[LockEnrollment].locked+" from enrollments e where e.id in ("+
+			strings.Repeat("?,", len(ids)-1)+"?) and "+lockDefs[LockEnrollment].locked+" != ''",
+		args...,
+	)
+	if err != nil {
+		return
+	}
+	var id int64
+	lockedBy := ""
+	for rows.Next() {
+		err = rows.Scan(&id, &lockedBy)
+		if err != nil {
+			return
 		}
+		locked[id] = lockedBy
 	}
-	// Delete unique identity archiving it to uidentities_archive
-	err = s.DeleteUniqueIdentity(fromUUID, false, true, nil, tx)
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	orgs, err := s.FindUniqueIdentityOrganizations(toUUID, false, tx)
+	err = rows.Close()
+	return
+}
+
+// countLockedEnrollments - returns number of locked enrollments using given organization
+func (s *service) countLockedEnrollments(orgID int64, tx *sql.Tx) (cnt int, err error) {
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	rows, err := s.Query(sdb, tx, "select count(*) from enrollments e where e.organization_id = ? and "+lockDefs[LockEnrollment].locked+" != ''", orgID)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		err = rows.Scan(&cnt)
+		if err != nil {
+			return
+		}
+	}
+	err = rows.Err()
 	if err != nil {
 		return
 	}
-	for _, org := range orgs {
-		err = s.MergeEnrollments(toUU, org, nil, true, true, tx)
-		if err != nil {
-			return
-		}
+	err = rows.Close()
+	return
+}
+
+func (s *service) QueryOrganizationsDomains(orgID int64, q string, rows, page int64, tx *sql.Tx) (domains []*models.DomainDataOutput, nRows int64, err error) {
+	log.Info(fmt.Sprintf("QueryOrganizationsDomains: orgID:%d q:%s rows:%d page:%d tx:%v", orgID, q, rows, page, tx != nil))
+	defer func() {
+		list := ""
+		nDoms := len(domains)
+		if nDoms > shared.LogListMax {
+			list = fmt.Sprintf("%d", nDoms)
+		} else {
+			list = fmt.Sprintf("%+v", s.ToLocalDomains(domains))
+		}
+		log.Info(
+			fmt.Sprintf(
+				"QueryOrganizationsDomains(exit): orgID:%d q:%s rows:%d page:%d tx:%v orgs:%s n_rows:%d err:%v",
+				orgID,
+				q,
+				rows,
+				page,
+				tx != nil,
+				list,
+				nRows,
+				err,
+			),
+		)
+	}()
+	sdb := s.rodb
+	if tx != nil {
+		sdb = s.db
+	}
+	args := []interface{}{}
+	selRoot := "select o.id, o.name, do.id, do.domain, do.is_top_domain"
+	sel := " from domains_organizations do, organizations o where do.organization_id = o.id"
+	if q != "" {
+		q = strings.TrimSpace(q)
+		args = append(args, "%"+q+"%")
+		sel += " and do.domain like ?"
 	}
-	if !externalTx {
-		err = tx.Commit()
-		if err != nil {
-			return
-		}
-		// Set tx to nil, so deferred rollback will not happen
-		tx = nil
+	if orgID > 0 {
+		args = append(args, orgID)
+		sel += " and o.id = ?"
 	}
-	return
-}
-
-func (s *service) Unarchive(id, uuid string) (unarchived bool, err error) {
-	log.Info(fmt.Sprintf("Unarchive: ID:%s UUID:%s", id, uuid))
-	defer func() {
-		log.Info(fmt.Sprintf("Unarchive(exit): ID:%s UUID:%s unarchived:%v err:%v", id, uuid, unarchived, err))
-	}()
-	// Unarchive uses RW connection, also for selects
-	rows, err := s.Query(s.db, nil, "select max(archived_at) from identities_archive where id = ?", id)
+	sel += " order by o.name, do.domain"
+	sel += fmt.Sprintf(" limit %d offset %d", rows, (page-1)*rows)
+	var qrows *sql.Rows
+	qrows, err = s.Query(sdb, tx, selRoot+sel, args...)
 	if err != nil {
 		return
 	}
-	var archivedAt [2]*time.Time
-	fetched := false
-	for rows.Next() {
-		err = rows.Scan(&archivedAt[0])
+	var isTopDomain *bool
+	for qrows.Next() {
+		domain := &models.DomainDataOutput{}
+		err = qrows.Scan(&domain.OrganizationID, &domain.OrganizationName, &domain.ID, &domain.Name, &isTopDomain)
 		if err != nil {
 			return
 		}
-		if archivedAt[0] != nil {
-			fetched = true
+		if isTopDomain != nil {
+			domain.IsTopDomain = *isTopDomain
 		}
+		domains = append(domains, domain)
 	}
-	err = rows.Err()
+	err = qrows.Err()
 	if err != nil {
 		return
 	}
-	err = rows.Close()
+	err = qrows.Close()
 	if err != nil {
 		return
 	}
-	if !fetched {
-		return
-	}
-	rows, err = s.Query(s.db, nil, "select max(archived_at) from uidentities_archive where uuid = ?", uuid)
+	qrows, err = s.Query(sdb, tx, "select count(*)"+sel, args...)
 	if err != nil {
 		return
 	}
-	fetched = false
-	for rows.Next() {
-		err = rows.Scan(&archivedAt[1])
+	for qrows.Next() {
+		err = qrows.Scan(&nRows)
 		if err != nil {
 			return
 		}
-		if archivedAt[1] != nil {
-			fetched = true
-		}
 	}
-	err = rows.Err()
+	err = qrows.Err()
 	if err != nil {
 		return
 	}
-	err = rows.Close()
+	err = qrows.Close()
 	if err != nil {
 		return
 	}
-	if !fetched {
-		return
-	}
-	if *archivedAt[0] != *archivedAt[1] {
-		log.Info(fmt.Sprintf("archives exists, but not from the same archiving process: %v differs from %v", *archivedAt[0], *archivedAt[1]))
-		return
-	}
-	tm := *archivedAt[0]
-	rows, err = s.Query(s.db, nil, "select distinct uuid from uidentities_archive where archived_at = ?", tm)
+	return
+}
+
+func (s *service) GetAllAffiliations() (all *models.AllArrayOutput, err error) {
+	all = &models.AllArrayOutput{}
+	s.mtx.RLock()
+	log.Info("GetAllAffiliations")
+	defer func() {
+		s.mtx.RUnlock()
+		log.Info(fmt.Sprintf("GetAllAffiliations(exit): all:%d err:%v", len(all.Profiles), err))
+	}()
+	//sel := "select distinct s.uuid, s.name, s.email, s.gender, s.is_bot, s.country_code, "
+	sel := "select distinct s.uuid, s.name, s.email, s.is_bot, s.country_code, "
+	sel += "i.id, i.name, i.email, i.username, i.source, s.id, s.start, s.end, s.project_slug, s.role, s.oname, "
+	sel += "s.provenance, s.evidence_url, s.evidence_notes, s.confidence "
+	//sel += "from (select distinct u.uuid, p.name, p.email, p.gender, p.is_bot, p.country_code, "
+	sel += "from (select distinct u.uuid, p.name, p.email, p.is_bot, p.country_code, "
+	sel += "e.id, e.start, e.end, e.project_slug, e.role, o.name as oname, e.provenance, e.evidence_url, e.evidence_notes, e.confidence from uidentities u, profiles p "
+	sel += "left join enrollments e on e.uuid = p.uuid left join organizations o on o.id = e.organization_id "
+	sel += "where u.uuid = p.uuid) s left join identities i on s.uuid = i.uuid"
+	var rows *sql.Rows
+	rows, err = s.Query(s.rodb, nil, sel)
 	if err != nil {
 		return
 	}
-	uuids := []string{}
-	uu := ""
+	var (
+		iID             *string
+		iName           *string
+		iEmail          *string
+		iUsername       *string
+		iSource         *string
+		rolID           *int64
+		rolStart        *strfmt.DateTime
+		rolEnd          *strfmt.DateTime
+		rolOrganization *string
+		rolProjectSlug  *string
+		rolRole         *string
+		rolProvenance   *string
+		rolEvidenceURL  *string
+		rolEvidenceNote *string
+		rolConfidence   *int64
+	)
+	uidsMap := make(map[string]*models.AllOutput)
+	idsMap := make(map[string]*models.IdentityShortOutput)
+	rolsMap := make(map[int64]*models.EnrollmentShortOutput)
+	uuid := ""
 	for rows.Next() {
-		err = rows.Scan(&uu)
+		prof := &models.AllOutput{}
+		id := &models.IdentityShortOutput{}
+		rol := &models.EnrollmentShortOutput{}
+		err = rows.Scan(
+			&uuid, &prof.Name, &prof.Email /*, &prof.Gender*/, &prof.IsBot, &prof.CountryCode,
+			&iID, &iName, &iEmail, &iUsername, &iSource,
+			&rolID, &rolStart, &rolEnd, &rolProjectSlug, &rolRole, &rolOrganization,
+			&rolProvenance, &rolEvidenceURL, &rolEvidenceNote, &rolConfidence,
+		)
 		if err != nil {
 			return
 		}
-		uuids = append(uuids, uu)
+		if prof.Name != nil && strings.TrimSpace(*prof.Name) == "" {
+			prof.Name = nil
+		}
+		if prof.Email != nil && strings.TrimSpace(*prof.Email) == "" {
+			prof.Email = nil
+		}
+		if iName != nil && strings.TrimSpace(*iName) == "" {
+			iName = nil
+		}
+		if iEmail != nil && strings.TrimSpace(*iEmail) == "" {
+			iEmail = nil
+		}
+		if iUsername != nil && strings.TrimSpace(*iUsername) == "" {
+			iUsername = nil
+		}
+		if prof.Name != nil {
+			tmp := strings.TrimSpace(*prof.Name)
+			prof.Name = &tmp
+		}
+		if iName != nil {
+			tmp := strings.TrimSpace(*iName)
+			iName = &tmp
+		}
+		if iUsername != nil {
+			tmp := strings.TrimSpace(*iUsername)
+			iUsername = &tmp
+		}
+		if iID != nil && iSource != nil {
+			id = &models.IdentityShortOutput{
+				Name:     iName,
+				Email:    iEmail,
+				Username: iUsername,
+				Source:   *iSource,
+			}
+		}
+		if rolID != nil && rolOrganization != nil {
+			rol = &models.EnrollmentShortOutput{
+				Start:         time.Time(*rolStart).Format(shared.DateFormat),
+				End:           time.Time(*rolEnd).Format(shared.DateFormat),
+				Organization:  *rolOrganization,
+				ProjectSlug:   rolProjectSlug,
+				Role:          *rolRole,
+				Provenance:    rolProvenance,
+				EvidenceURL:   rolEvidenceURL,
+				EvidenceNotes: rolEvidenceNote,
+				Confidence:    rolConfidence,
+			}
+		}
+		existingProf, ok := uidsMap[uuid]
+		if !ok {
+			uidsMap[uuid] = prof
+		} else {
+			prof = existingProf
+		}
+		if iID != nil {
+			_, ok = idsMap[*iID]
+			if !ok {
+				prof.Identities = append(prof.Identities, id)
+				idsMap[*iID] = id
+			}
+		}
+		if rolID != nil {
+			_, ok = rolsMap[*rolID]
+			if !ok {
+				prof.Enrollments = append(prof.Enrollments, rol)
+				rolsMap[*rolID] = rol
+			}
+		}
+		// @ -> ! + trim spaces
+		s.SanitizeShortProfile(prof, true)
+		uidsMap[uuid] = prof
 	}
 	err = rows.Err()
 	if err != nil {
@@ -6641,365 +12445,758 @@ func (s *service) Unarchive(id, uuid string) (unarchived bool, err error) {
 	if err != nil {
 		return
 	}
-	if len(uuids) != 2 {
-		log.Info(fmt.Sprintf("there should be exactly 2 uuids archived at %v, found %+v", tm, uuids))
-		return
+	for _, prof := range uidsMap {
+		if len(prof.Enrollments) > 0 && len(prof.Identities) > 0 {
+			all.Profiles = append(all.Profiles, prof)
+		}
 	}
-	tx, err := s.db.Begin()
-	if err != nil {
-		return
+	for k := range all.Profiles {
+		if len(all.Profiles[k].Enrollments) > 1 {
+			sort.SliceStable(all.Profiles[k].Enrollments, func(i, j int) bool {
+				rols := all.Profiles[k].Enrollments
+				a := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[i]}
+				b := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[j]}
+				return a.SortKey() < b.SortKey()
+			})
+		}
+		if len(all.Profiles[k].Identities) > 1 {
+			sort.SliceStable(all.Profiles[k].Identities, func(i, j int) bool {
+				ids := all.Profiles[k].Identities
+				a := &shared.LocalIdentityShortOutput{IdentityShortOutput: ids[i]}
+				b := &shared.LocalIdentityShortOutput{IdentityShortOutput: ids[j]}
+				return a.SortKey() < b.SortKey()
+			})
+		}
 	}
-	// Rollback unless tx was set to nil after successful commit
-	defer func() {
-		if tx != nil {
-			tx.Rollback()
+	sort.SliceStable(all.Profiles, func(i, j int) bool {
+		a := &shared.LocalAllOutput{AllOutput: all.Profiles[i]}
+		b := &shared.LocalAllOutput{AllOutput: all.Profiles[j]}
+		return a.SortKey(true) < b.SortKey(true)
+	})
+	return
+}
+
+// gitdmGithubUser - single gitdm github_users.json entry (gitdm keeps one entry per login and email, other fields are ignored)
+type gitdmGithubUser struct {
+	Login       string `json:"login"`
+	Email       string `json:"email"`
+	Affiliation string `json:"affiliation"`
+	Name        string `json:"name,omitempty"`
+	CountryID   string `json:"country_id,omitempty"`
+}
+
+// gitdmUnknownOrgs - gitdm company names meaning no affiliation
+var gitdmUnknownOrgs = map[string]struct{}{
+	shared.GitdmNotFound: {},
+	"(Unknown)":          {},
+	"?":                  {},
+	"-":                  {},
+}
+
+// gitdmLogin - returns GitHub login of the profile (lowest username of its github identities)
+func (s *service) gitdmLogin(prof *models.AllOutput) (login string) {
+	for _, identity := range prof.Identities {
+		if identity.Source != "github" || identity.Username == nil || *identity.Username == "" {
+			continue
 		}
-	}()
-	for _, uu := range uuids {
-		err = s.UnarchiveUUID(uu, tm, tx)
-		if err != nil {
+		if login == "" || *identity.Username < login {
+			login = *identity.Username
+		}
+	}
+	return
+}
+
+// gitdmEmails - returns sorted unique profile and identities emails in gitdm format (user!domain)
+func (s *service) gitdmEmails(prof *models.AllOutput) (emails []string) {
+	seen := make(map[string]struct{})
+	add := func(email *string) {
+		if email == nil {
+			return
+		}
+		e := strings.Replace(strings.TrimSpace(*email), "@", "!", -1)
+		if e == "" {
+			return
+		}
+		_, ok := seen[e]
+		if ok {
 			return
 		}
+		seen[e] = struct{}{}
+		emails = append(emails, e)
+	}
+	add(prof.Email)
+	for _, identity := range prof.Identities {
+		add(identity.Email)
+	}
+	sort.Strings(emails)
+	return
+}
+
+// gitdmAffiliations - returns profile's global contributor enrollments as gitdm (company, until) pairs, until is empty for open ended enrollments
+// gaps between enrollments are reported as shared.GitdmNotFound, overlapping enrollments cannot be represented and are written one after another
+func (s *service) gitdmAffiliations(prof *models.AllOutput) (affs [][2]string) {
+	minDate := shared.MinPeriodDate.Format(shared.DateFormat)
+	maxDate := shared.MaxPeriodDate.Format(shared.DateFormat)
+	rols := []*models.EnrollmentShortOutput{}
+	for _, rol := range prof.Enrollments {
+		if rol.ProjectSlug != nil || (rol.Role != "C" && rol.Role != shared.ContributorRole) {
+			continue
+		}
+		rols = append(rols, rol)
+	}
+	sort.SliceStable(rols, func(i, j int) bool {
+		a := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[i]}
+		b := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[j]}
+		return a.SortKey() < b.SortKey()
+	})
+	prev := minDate
+	for _, rol := range rols {
+		if rol.Start > prev {
+			affs = append(affs, [2]string{shared.GitdmNotFound, rol.Start})
+		}
+		until := rol.End
+		if until >= maxDate {
+			until = ""
+		}
+		affs = append(affs, [2]string{rol.Organization, until})
+		prev = rol.End
 	}
-	err = tx.Commit()
-	if err != nil {
-		return
-	}
-	// Set tx to nil, so deferred rollback will not happen
-	tx = nil
-	unarchived = true
 	return
 }
 
-func (s *service) MoveIdentity(fromID, toUUID string, archive bool, tx *sql.Tx) (err error) {
-	externalTx := tx != nil
-	log.Info(fmt.Sprintf("MoveIdentity: fromID:%s toUUID:%s archive:%v tx:%v/%v", fromID, toUUID, archive, tx != nil, externalTx))
-	// s.SetOrigin()
-	defer func() {
-		log.Info(fmt.Sprintf("MoveIdentity(exit): fromID:%s toUUID:%s archive:%v tx:%v/%v err:%v", fromID, toUUID, archive, tx != nil, externalTx, err))
-	}()
-	if archive {
-		unarchived := false
-		unarchived, err = s.Unarchive(fromID, toUUID)
-		if err != nil {
-			return
+// gitdmEnrollments - converts gitdm (company, until) pairs into consecutive global contributor enrollments
+func (s *service) gitdmEnrollments(affs [][2]string) (rols []*models.EnrollmentShortOutput, err error) {
+	prev := shared.MinPeriodDate.Format(shared.DateFormat)
+	for _, aff := range affs {
+		end := shared.MaxPeriodDate.Format(shared.DateFormat)
+		if aff[1] != "" {
+			var dt time.Time
+			dt, err = s.TimeParseAny(aff[1])
+			if err != nil {
+				return
+			}
+			end = dt.Format(shared.DateFormat)
 		}
-		if unarchived {
-			return
+		_, unknown := gitdmUnknownOrgs[aff[0]]
+		if !unknown {
+			rols = append(rols, &models.EnrollmentShortOutput{Organization: aff[0], Start: prev, End: end, Role: "C"})
 		}
-		log.Info(fmt.Sprintf("MoveIdentity: fromID:%s toUUID:%s nothing unarchived", fromID, toUUID))
+		prev = end
 	}
-	from, err := s.GetIdentity(fromID, true, nil)
-	if err != nil {
-		return
+	return
+}
+
+// gitdmProfile - creates profile (in /v1/affiliation/all format) from gitdm data
+func (s *service) gitdmProfile(login string, emails []string, affs [][2]string) (prof *models.AllOutput, err error) {
+	prof = &models.AllOutput{}
+	username := login
+	prof.Identities = append(prof.Identities, &models.IdentityShortOutput{Source: "github", Username: &username})
+	for i := range emails {
+		prof.Identities = append(prof.Identities, &models.IdentityShortOutput{Source: "git", Email: &emails[i]})
 	}
-	to, err := s.GetUniqueIdentity(toUUID, false, nil)
+	prof.Enrollments, err = s.gitdmEnrollments(affs)
+	return
+}
+
+// ParseGitdmDevelopersAffiliations - parses gitdm developers_affiliations*.txt contents (multiple files can be concatenated) into profiles (in /v1/affiliation/all format)
+// login: email1!domain1, email2!domain2
+// <tab>Company1 until YYYY-MM-DD
+// <tab>Company2
+func (s *service) ParseGitdmDevelopersAffiliations(r io.Reader) (profs []*models.AllOutput, err error) {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseGitdmDevelopersAffiliations")
 		return
 	}
-	if to == nil && fromID != toUUID {
-		err = fmt.Errorf("unique identity uuid '%s' is not found and identity id is different: '%+v'", toUUID, s.ToLocalIdentity(from))
-		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "MoveIdentity")
-		return
-	}
-	if !externalTx {
-		tx, err = s.db.Begin()
-		if err != nil {
-			return
+	logins := []string{}
+	emails := make(map[string][]string)
+	affs := make(map[string][][2]string)
+	login := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
 		}
-		// Rollback unless tx was set to nil after successful commit
-		defer func() {
-			if tx != nil {
-				tx.Rollback()
+		if line[0] == ' ' || line[0] == '\t' {
+			if login == "" {
+				err = fmt.Errorf("line %d: company line '%s' without preceding 'login: emails' line", i+1, trimmed)
+				err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseGitdmDevelopersAffiliations")
+				return
 			}
-		}()
-	}
-	if to == nil {
-		to, err = s.AddUniqueIdentity(
-			&models.UniqueIdentityDataOutput{
-				UUID: toUUID,
-			},
-			false,
-			tx,
-		)
-		if err != nil {
+			aff := [2]string{trimmed, ""}
+			idx := strings.LastIndex(trimmed, " until ")
+			if idx > 0 {
+				aff = [2]string{strings.TrimSpace(trimmed[:idx]), strings.TrimSpace(trimmed[idx+7:])}
+			}
+			affs[login] = append(affs[login], aff)
+			continue
+		}
+		idx := strings.Index(trimmed, ":")
+		if idx < 1 {
+			err = fmt.Errorf("line %d: expected 'login: email!domain, ...', got '%s'", i+1, trimmed)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseGitdmDevelopersAffiliations")
 			return
 		}
-		_, err = s.AddProfile(
-			&models.ProfileDataOutput{
-				UUID:  toUUID,
-				Name:  from.Name,
-				Email: from.Email,
-			},
-			false,
-			tx,
-		)
-		if err != nil {
+		login = strings.TrimSpace(trimmed[:idx])
+		_, ok := emails[login]
+		if ok {
+			err = fmt.Errorf("line %d: login '%s' specified more than once", i+1, login)
+			err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseGitdmDevelopersAffiliations")
 			return
 		}
+		logins = append(logins, login)
+		emails[login] = []string{}
+		for _, email := range strings.Split(trimmed[idx+1:], ",") {
+			email = strings.TrimSpace(email)
+			if email != "" {
+				emails[login] = append(emails[login], email)
+			}
+		}
 	}
-	err = s.MoveIdentityToUniqueIdentity(from, to, true, tx)
-	if err != nil {
-		return
-	}
-	if !externalTx {
-		err = tx.Commit()
+	for _, login := range logins {
+		var prof *models.AllOutput
+		prof, err = s.gitdmProfile(login, emails[login], affs[login])
 		if err != nil {
+			err = errs.Wrap(errs.New(fmt.Errorf("login '%s': %v", login, err), errs.ErrBadRequest), "ParseGitdmDevelopersAffiliations")
 			return
 		}
-		// Set tx to nil, so deferred rollback will not happen
-		tx = nil
+		profs = append(profs, prof)
 	}
 	return
 }
 
-func (s *service) QueryOrganizationsDomains(orgID int64, q string, rows, page int64, tx *sql.Tx) (domains []*models.DomainDataOutput, nRows int64, err error) {
-	log.Info(fmt.Sprintf("QueryOrganizationsDomains: orgID:%d q:%s rows:%d page:%d tx:%v", orgID, q, rows, page, tx != nil))
-	defer func() {
-		list := ""
-		nDoms := len(domains)
-		if nDoms > shared.LogListMax {
-			list = fmt.Sprintf("%d", nDoms)
-		} else {
-			list = fmt.Sprintf("%+v", s.ToLocalDomains(domains))
-		}
-		log.Info(
-			fmt.Sprintf(
-				"QueryOrganizationsDomains(exit): orgID:%d q:%s rows:%d page:%d tx:%v orgs:%s n_rows:%d err:%v",
-				orgID,
-				q,
-				rows,
-				page,
-				tx != nil,
-				list,
-				nRows,
-				err,
-			),
-		)
-	}()
-	sdb := s.rodb
-	if tx != nil {
-		sdb = s.db
-	}
-	args := []interface{}{}
-	selRoot := "select o.id, o.name, do.id, do.domain, do.is_top_domain"
-	sel := " from domains_organizations do, organizations o where do.organization_id = o.id"
-	if q != "" {
-		q = strings.TrimSpace(q)
-		args = append(args, "%"+q+"%")
-		sel += " and do.domain like ?"
-	}
-	if orgID > 0 {
-		args = append(args, orgID)
-		sel += " and o.id = ?"
-	}
-	sel += " order by o.name, do.domain"
-	sel += fmt.Sprintf(" limit %d offset %d", rows, (page-1)*rows)
-	var qrows *sql.Rows
-	qrows, err = s.Query(sdb, tx, selRoot+sel, args...)
+// ParseGitdmGithubUsers - parses gitdm github_users.json contents into profiles (in /v1/affiliation/all format)
+// entries are grouped by login, name, country_id and affiliation ("Company1 < YYYY-MM-DD, Company2") are taken from the first entry that has them
+func (s *service) ParseGitdmGithubUsers(r io.Reader) (profs []*models.AllOutput, err error) {
+	var users []gitdmGithubUser
+	err = json.NewDecoder(r).Decode(&users)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "ParseGitdmGithubUsers")
 		return
 	}
-	var isTopDomain *bool
-	for qrows.Next() {
-		domain := &models.DomainDataOutput{}
-		err = qrows.Scan(&domain.OrganizationID, &domain.OrganizationName, &domain.ID, &domain.Name, &isTopDomain)
+	logins := []string{}
+	byLogin := make(map[string][]gitdmGithubUser)
+	for _, user := range users {
+		login := strings.TrimSpace(user.Login)
+		if login == "" {
+			continue
+		}
+		_, ok := byLogin[login]
+		if !ok {
+			logins = append(logins, login)
+		}
+		byLogin[login] = append(byLogin[login], user)
+	}
+	for _, login := range logins {
+		emails := []string{}
+		name, countryID, affiliation := "", "", ""
+		for _, user := range byLogin[login] {
+			email := strings.TrimSpace(user.Email)
+			if email != "" {
+				emails = append(emails, email)
+			}
+			if name == "" {
+				name = strings.TrimSpace(user.Name)
+			}
+			if countryID == "" {
+				countryID = strings.TrimSpace(user.CountryID)
+			}
+			if affiliation == "" {
+				affiliation = strings.TrimSpace(user.Affiliation)
+			}
+		}
+		affs := [][2]string{}
+		for _, item := range strings.Split(affiliation, ", ") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			aff := [2]string{item, ""}
+			idx := strings.LastIndex(item, " < ")
+			if idx > 0 {
+				aff = [2]string{strings.TrimSpace(item[:idx]), strings.TrimSpace(item[idx+3:])}
+			}
+			affs = append(affs, aff)
+		}
+		var prof *models.AllOutput
+		prof, err = s.gitdmProfile(login, emails, affs)
 		if err != nil {
+			err = errs.Wrap(errs.New(fmt.Errorf("login '%s': %v", login, err), errs.ErrBadRequest), "ParseGitdmGithubUsers")
 			return
 		}
-		if isTopDomain != nil {
-			domain.IsTopDomain = *isTopDomain
+		if name != "" {
+			prof.Name = &name
 		}
-		domains = append(domains, domain)
-	}
-	err = qrows.Err()
-	if err != nil {
-		return
+		if countryID != "" {
+			prof.CountryCode = &countryID
+		}
+		profs = append(profs, prof)
 	}
-	err = qrows.Close()
-	if err != nil {
-		return
+	return
+}
+
+// gitdmSortedProfiles - returns profiles having GitHub login sorted by login
+func (s *service) gitdmSortedProfiles(profs []*models.AllOutput) (sorted []*models.AllOutput, logins []string) {
+	for _, prof := range profs {
+		if s.gitdmLogin(prof) != "" {
+			sorted = append(sorted, prof)
+		}
 	}
-	qrows, err = s.Query(sdb, tx, "select count(*)"+sel, args...)
-	if err != nil {
-		return
+	sort.SliceStable(sorted, func(i, j int) bool {
+		li, lj := s.gitdmLogin(sorted[i]), s.gitdmLogin(sorted[j])
+		if !strings.EqualFold(li, lj) {
+			return strings.ToLower(li) < strings.ToLower(lj)
+		}
+		return li < lj
+	})
+	for _, prof := range sorted {
+		logins = append(logins, s.gitdmLogin(prof))
 	}
-	for qrows.Next() {
-		err = qrows.Scan(&nRows)
-		if err != nil {
-			return
+	return
+}
+
+// GitdmDevelopersAffiliations - generates gitdm developers_affiliations.txt from profiles (in /v1/affiliation/all format)
+// only profiles with GitHub login and only their global contributor enrollments can be represented
+func (s *service) GitdmDevelopersAffiliations(profs []*models.AllOutput) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("# Generated by dev-analytics-affiliation, format: 'login: email!domain, ...' followed by '<tab>Company until YYYY-MM-DD' lines\n")
+	sorted, logins := s.gitdmSortedProfiles(profs)
+	for i, prof := range sorted {
+		line := logins[i] + ":"
+		emails := s.gitdmEmails(prof)
+		if len(emails) > 0 {
+			line += " " + strings.Join(emails, ", ")
+		}
+		buffer.WriteString(line + "\n")
+		affs := s.gitdmAffiliations(prof)
+		if len(affs) == 0 {
+			affs = [][2]string{{shared.GitdmNotFound, ""}}
+		}
+		for _, aff := range affs {
+			line := "\t" + aff[0]
+			if aff[1] != "" {
+				line += " until " + aff[1]
+			}
+			buffer.WriteString(line + "\n")
 		}
 	}
-	err = qrows.Err()
-	if err != nil {
-		return
+	return buffer.Bytes()
+}
+
+// GitdmGithubUsers - generates gitdm github_users.json from profiles (in /v1/affiliation/all format), one entry per login and email
+// only profiles with GitHub login and only their global contributor enrollments can be represented
+func (s *service) GitdmGithubUsers(profs []*models.AllOutput) (data []byte, err error) {
+	users := []gitdmGithubUser{}
+	sorted, logins := s.gitdmSortedProfiles(profs)
+	for i, prof := range sorted {
+		items := []string{}
+		for _, aff := range s.gitdmAffiliations(prof) {
+			item := aff[0]
+			if aff[1] != "" {
+				item += " < " + aff[1]
+			}
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			items = append(items, shared.GitdmNotFound)
+		}
+		user := gitdmGithubUser{Login: logins[i], Affiliation: strings.Join(items, ", ")}
+		if prof.Name != nil {
+			user.Name = *prof.Name
+		}
+		if prof.CountryCode != nil {
+			user.CountryID = strings.ToLower(*prof.CountryCode)
+		}
+		emails := s.gitdmEmails(prof)
+		if len(emails) == 0 {
+			emails = []string{""}
+		}
+		for _, email := range emails {
+			user.Email = email
+			users = append(users, user)
+		}
 	}
-	err = qrows.Close()
+	// gitdm affiliation strings use "<", so HTML escaping must be disabled
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(users)
 	if err != nil {
+		err = errs.Wrap(errs.New(err, errs.ErrServerError), "GitdmGithubUsers")
 		return
 	}
+	data = buffer.Bytes()
 	return
 }
 
-func (s *service) GetAllAffiliations() (all *models.AllArrayOutput, err error) {
-	all = &models.AllArrayOutput{}
-	s.mtx.RLock()
-	log.Info("GetAllAffiliations")
+// ImportGitdm - imports gitdm profiles (parsed by ParseGitdmDevelopersAffiliations or ParseGitdmGithubUsers)
+// profile is found by its github identity login or by any of its emails, if not found - new profile is added
+// existing profiles get missing github/git identities added and their global contributor enrollments replaced when different
+// project specific and maintainer enrollments are never touched, profiles matching multiple UUIDs, locked profiles, profiles whose
+// enrollments to be replaced are locked or profiles using unknown organizations are skipped (reported as conflicts)
+// all changes are done in a single transaction, nothing is written in dry mode
+func (s *service) ImportGitdm(profs []*models.AllOutput, dry bool) (out *models.GitdmImportOutput, err error) {
+	out = &models.GitdmImportOutput{Dry: dry, NProfiles: int64(len(profs)), Conflicts: []string{}}
+	log.Info(fmt.Sprintf("ImportGitdm: profiles:%d dry:%v", len(profs), dry))
 	defer func() {
-		s.mtx.RUnlock()
-		log.Info(fmt.Sprintf("GetAllAffiliations(exit): all:%d err:%v", len(all.Profiles), err))
+		log.Info(
+			fmt.Sprintf(
+				"ImportGitdm(exit): profiles:%d dry:%v added:%d updated:%d unchanged:%d conflicts:%d err:%v",
+				len(profs),
+				dry,
+				out.NAdded,
+				out.NUpdated,
+				out.NUnchanged,
+				out.NConflicts,
+				err,
+			),
+		)
 	}()
-	//sel := "select distinct s.uuid, s.name, s.email, s.gender, s.is_bot, s.country_code, "
-	sel := "select distinct s.uuid, s.name, s.email, s.is_bot, s.country_code, "
-	sel += "i.id, i.name, i.email, i.username, i.source, s.id, s.start, s.end, s.project_slug, s.role, s.oname "
-	//sel += "from (select distinct u.uuid, p.name, p.email, p.gender, p.is_bot, p.country_code, "
-	sel += "from (select distinct u.uuid, p.name, p.email, p.is_bot, p.country_code, "
-	sel += "e.id, e.start, e.end, e.project_slug, e.role, o.name as oname from uidentities u, profiles p "
-	sel += "left join enrollments e on e.uuid = p.uuid left join organizations o on o.id = e.organization_id "
-	sel += "where u.uuid = p.uuid) s left join identities i on s.uuid = i.uuid"
-	var rows *sql.Rows
-	rows, err = s.Query(s.rodb, nil, sel)
-	if err != nil {
-		return
+	var tx *sql.Tx
+	if !dry {
+		tx, err = s.db.Begin()
+		if err != nil {
+			return
+		}
+		defer func() {
+			if tx != nil {
+				s.RollbackTx(tx)
+			}
+			// Import can touch enrollments of many profiles (also newly created ones), so entire cache is dropped
+			s.InvalidateAffiliationCache()
+		}()
 	}
-	var (
-		iID             *string
-		iName           *string
-		iEmail          *string
-		iUsername       *string
-		iSource         *string
-		rolID           *int64
-		rolStart        *strfmt.DateTime
-		rolEnd          *strfmt.DateTime
-		rolOrganization *string
-		rolProjectSlug  *string
-		rolRole         *string
-	)
-	uidsMap := make(map[string]*models.AllOutput)
-	idsMap := make(map[string]*models.IdentityShortOutput)
-	rolsMap := make(map[int64]*models.EnrollmentShortOutput)
-	uuid := ""
-	for rows.Next() {
-		prof := &models.AllOutput{}
-		id := &models.IdentityShortOutput{}
-		rol := &models.EnrollmentShortOutput{}
-		err = rows.Scan(
-			&uuid, &prof.Name, &prof.Email /*, &prof.Gender*/, &prof.IsBot, &prof.CountryCode,
-			&iID, &iName, &iEmail, &iUsername, &iSource,
-			&rolID, &rolStart, &rolEnd, &rolProjectSlug, &rolRole, &rolOrganization,
-		)
+	contributor := shared.ContributorRole
+	noSlug := (*string)(nil)
+	orgs := make(map[string]*models.OrganizationDataOutput)
+	archiveDate := time.Now()
+	for _, prof := range profs {
+		login := s.gitdmLogin(prof)
+		conflict := func(reason string) {
+			out.NConflicts++
+			out.Conflicts = append(out.Conflicts, fmt.Sprintf("%s: %s", login, reason))
+		}
+		if login == "" {
+			conflict("missing GitHub login")
+			continue
+		}
+		emails := []string{}
+		for _, email := range s.gitdmEmails(prof) {
+			emails = append(emails, strings.Replace(email, "!", "@", -1))
+		}
+		rols := []*models.EnrollmentDataOutput{}
+		unknownOrg := ""
+		for _, rol := range prof.Enrollments {
+			if rol.ProjectSlug != nil || (rol.Role != "C" && rol.Role != contributor) {
+				continue
+			}
+			org, ok := orgs[rol.Organization]
+			if !ok {
+				org, err = s.GetOrganizationByName(rol.Organization, false, tx)
+				if err != nil {
+					return
+				}
+				orgs[rol.Organization] = org
+			}
+			if org == nil {
+				unknownOrg = rol.Organization
+				break
+			}
+			var start, end time.Time
+			start, err = s.TimeParseAny(rol.Start)
+			if err != nil {
+				return
+			}
+			end, err = s.TimeParseAny(rol.End)
+			if err != nil {
+				return
+			}
+			provenance := shared.ProvenanceGitdm
+			rols = append(rols, &models.EnrollmentDataOutput{OrganizationID: org.ID, Start: strfmt.DateTime(start), End: strfmt.DateTime(end), Role: contributor, Provenance: &provenance})
+		}
+		if unknownOrg != "" {
+			conflict(fmt.Sprintf("organization '%s' not found", unknownOrg))
+			continue
+		}
+		uuids := make(map[string]struct{})
+		var identities []*models.IdentityDataOutput
+		identities, err = s.FindIdentities([]string{"source", "username"}, []interface{}{"github", login}, []bool{false, false}, false, tx)
 		if err != nil {
 			return
 		}
-		if prof.Name != nil && strings.TrimSpace(*prof.Name) == "" {
-			prof.Name = nil
+		for _, email := range emails {
+			var found []*models.IdentityDataOutput
+			found, err = s.FindIdentities([]string{"email"}, []interface{}{email}, []bool{false}, false, tx)
+			if err != nil {
+				return
+			}
+			identities = append(identities, found...)
 		}
-		if prof.Email != nil && strings.TrimSpace(*prof.Email) == "" {
-			prof.Email = nil
+		for _, identity := range identities {
+			if identity.UUID != nil {
+				uuids[*identity.UUID] = struct{}{}
+			}
 		}
-		if iName != nil && strings.TrimSpace(*iName) == "" {
-			iName = nil
+		if len(uuids) > 1 {
+			ary := []string{}
+			for uuid := range uuids {
+				ary = append(ary, uuid)
+			}
+			sort.Strings(ary)
+			conflict(fmt.Sprintf("login and emails match %d profiles: %s", len(ary), strings.Join(ary, ", ")))
+			continue
 		}
-		if iEmail != nil && strings.TrimSpace(*iEmail) == "" {
-			iEmail = nil
+		uuid := ""
+		for u := range uuids {
+			uuid = u
 		}
-		if iUsername != nil && strings.TrimSpace(*iUsername) == "" {
-			iUsername = nil
+		if uuid != "" {
+			var locked map[string]string
+			locked, err = s.LockedProfiles([]string{uuid}, tx)
+			if err != nil {
+				return
+			}
+			if locked[uuid] != "" {
+				conflict(fmt.Sprintf("profile %s is locked by %s", uuid, locked[uuid]))
+				continue
+			}
 		}
-		if prof.Name != nil {
-			tmp := strings.TrimSpace(*prof.Name)
-			prof.Name = &tmp
+		existing := []*models.IdentityDataOutput{}
+		current := []*models.EnrollmentDataOutput{}
+		if uuid != "" {
+			existing, err = s.FindIdentities([]string{"uuid"}, []interface{}{uuid}, []bool{false}, false, tx)
+			if err != nil {
+				return
+			}
+			current, err = s.FindEnrollments([]string{"uuid", "project_slug", "role"}, []interface{}{uuid, noSlug, contributor}, []bool{false, false, false}, false, tx)
+			if err != nil {
+				return
+			}
 		}
-		if iName != nil {
-			tmp := strings.TrimSpace(*iName)
-			iName = &tmp
+		// missing identities
+		missing := []*models.IdentityDataOutput{}
+		hasLogin := false
+		hasEmail := make(map[string]struct{})
+		for _, identity := range existing {
+			if identity.Source == "github" && identity.Username != nil && strings.EqualFold(*identity.Username, login) {
+				hasLogin = true
+			}
+			if identity.Email != nil {
+				hasEmail[strings.ToLower(*identity.Email)] = struct{}{}
+			}
 		}
-		if iUsername != nil {
-			tmp := strings.TrimSpace(*iUsername)
-			iUsername = &tmp
+		if !hasLogin {
+			username := login
+			missing = append(missing, &models.IdentityDataOutput{Source: "github", Username: &username})
 		}
-		if iID != nil && iSource != nil {
-			id = &models.IdentityShortOutput{
-				Name:     iName,
-				Email:    iEmail,
-				Username: iUsername,
-				Source:   *iSource,
+		for i := range emails {
+			_, ok := hasEmail[strings.ToLower(emails[i])]
+			if !ok {
+				missing = append(missing, &models.IdentityDataOutput{Source: "git", Email: &emails[i]})
 			}
 		}
-		if rolID != nil && rolOrganization != nil {
-			rol = &models.EnrollmentShortOutput{
-				Start:        time.Time(*rolStart).Format(shared.DateFormat),
-				End:          time.Time(*rolEnd).Format(shared.DateFormat),
-				Organization: *rolOrganization,
-				ProjectSlug:  rolProjectSlug,
-				Role:         *rolRole,
+		// global contributor enrollments
+		rolKey := func(rol *models.EnrollmentDataOutput) string {
+			return fmt.Sprintf("%d:%s:%s", rol.OrganizationID, time.Time(rol.Start).Format(shared.DateFormat), time.Time(rol.End).Format(shared.DateFormat))
+		}
+		currentKeys, newKeys := []string{}, []string{}
+		for _, rol := range current {
+			currentKeys = append(currentKeys, rolKey(rol))
+		}
+		for _, rol := range rols {
+			newKeys = append(newKeys, rolKey(rol))
+		}
+		sort.Strings(currentKeys)
+		sort.Strings(newKeys)
+		rolsChanged := strings.Join(currentKeys, ",") != strings.Join(newKeys, ",")
+		if rolsChanged && len(current) > 0 {
+			ids := []int64{}
+			for _, rol := range current {
+				ids = append(ids, rol.ID)
+			}
+			var locked map[int64]string
+			locked, err = s.LockedEnrollments(ids, tx)
+			if err != nil {
+				return
+			}
+			if len(locked) > 0 {
+				lockedIDs := []string{}
+				for _, id := range ids {
+					lockedBy, ok := locked[id]
+					if ok {
+						lockedIDs = append(lockedIDs, fmt.Sprintf("%d (by %s)", id, lockedBy))
+					}
+				}
+				conflict(fmt.Sprintf("profile %s has locked enrollments: %s", uuid, strings.Join(lockedIDs, ", ")))
+				continue
 			}
 		}
-		existingProf, ok := uidsMap[uuid]
-		if !ok {
-			uidsMap[uuid] = prof
+		if uuid == "" {
+			out.NAdded++
+		} else if len(missing) > 0 || rolsChanged {
+			out.NUpdated++
 		} else {
-			prof = existingProf
+			out.NUnchanged++
+			continue
 		}
-		if iID != nil {
-			_, ok = idsMap[*iID]
-			if !ok {
-				prof.Identities = append(prof.Identities, id)
-				idsMap[*iID] = id
+		if dry {
+			continue
+		}
+		if uuid == "" {
+			name := login
+			if prof.Name != nil && *prof.Name != "" {
+				name = *prof.Name
+			}
+			profile := &models.ProfileDataOutput{Name: &name}
+			if prof.CountryCode != nil && *prof.CountryCode != "" {
+				countryCode := strings.ToUpper(*prof.CountryCode)
+				profile.CountryCode = &countryCode
+			}
+			if len(emails) > 0 {
+				profile.Email = &emails[0]
+			}
+			uuid, err = s.ProfileUUIDHash(profile)
+			if err != nil {
+				return
+			}
+			profile.UUID = uuid
+			_, err = s.AddUniqueIdentity(&models.UniqueIdentityDataOutput{UUID: uuid}, false, tx)
+			if err != nil {
+				return
+			}
+			_, err = s.AddProfile(profile, false, tx)
+			if err != nil {
+				return
 			}
 		}
-		if rolID != nil {
-			_, ok = rolsMap[*rolID]
-			if !ok {
-				prof.Enrollments = append(prof.Enrollments, rol)
-				rolsMap[*rolID] = rol
+		for _, identity := range missing {
+			identity.UUID = &uuid
+			identity.ID, err = s.IdentityIDHash(identity)
+			if err != nil {
+				return
+			}
+			_, err = s.AddIdentity(identity, true, false, tx)
+			if err != nil {
+				return
+			}
+		}
+		if !rolsChanged {
+			continue
+		}
+		for _, rol := range current {
+			err = s.DeleteEnrollment(rol.ID, true, false, &archiveDate, tx)
+			if err != nil {
+				return
+			}
+		}
+		for _, rol := range rols {
+			rol.UUID = uuid
+			_, err = s.AddEnrollment(rol, false, false, tx)
+			if err != nil {
+				return
 			}
 		}
-		// @ -> ! + trim spaces
-		s.SanitizeShortProfile(prof, true)
-		uidsMap[uuid] = prof
 	}
-	err = rows.Err()
-	if err != nil {
+	if dry {
 		return
 	}
-	err = rows.Close()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
-	for _, prof := range uidsMap {
-		if len(prof.Enrollments) > 0 && len(prof.Identities) > 0 {
-			all.Profiles = append(all.Profiles, prof)
+	tx = nil
+	return
+}
+
+// ProfileFiltersWhere - returns SQL conditions (to be appended to where clause using "uidentities u" and "profiles p" aliases)
+// with their arguments and order by expression for given profile filters, all filters must match
+func (s *service) ProfileFiltersWhere(filters *models.ProfileFilters) (cond string, args []interface{}, order string, err error) {
+	order = "u.uuid"
+	if filters == nil {
+		return
+	}
+	if filters.Source != "" {
+		cond += " and exists (select 1 from identities fi where fi.uuid = u.uuid and fi.source = ?)"
+		args = append(args, filters.Source)
+	}
+	if filters.Organization != "" {
+		dt := time.Now()
+		if filters.OrganizationAt != nil {
+			dt = time.Time(*filters.OrganizationAt)
 		}
+		cond += " and exists (select 1 from enrollments fe, organizations fo where fe.organization_id = fo.id and fe.uuid = u.uuid " +
+			"and lower(fo.name) = lower(?) and fe.start <= ? and fe.end > ?)"
+		args = append(args, filters.Organization, dt, dt)
 	}
-	for k := range all.Profiles {
-		if len(all.Profiles[k].Enrollments) > 1 {
-			sort.SliceStable(all.Profiles[k].Enrollments, func(i, j int) bool {
-				rols := all.Profiles[k].Enrollments
-				a := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[i]}
-				b := &shared.LocalEnrollmentShortOutput{EnrollmentShortOutput: rols[j]}
-				return a.SortKey() < b.SortKey()
-			})
+	if filters.CountryCode != "" {
+		cond += " and p.country_code = ?"
+		args = append(args, strings.ToUpper(filters.CountryCode))
+	}
+	if filters.IsBot != nil {
+		isBot := 0
+		if *filters.IsBot {
+			isBot = 1
 		}
-		if len(all.Profiles[k].Identities) > 1 {
-			sort.SliceStable(all.Profiles[k].Identities, func(i, j int) bool {
-				ids := all.Profiles[k].Identities
-				a := &shared.LocalIdentityShortOutput{IdentityShortOutput: ids[i]}
-				b := &shared.LocalIdentityShortOutput{IdentityShortOutput: ids[j]}
-				return a.SortKey() < b.SortKey()
-			})
+		cond += " and coalesce(p.is_bot, 0) = ?"
+		args = append(args, isBot)
+	}
+	if filters.HasEnrollments != nil {
+		if *filters.HasEnrollments {
+			cond += " and exists (select 1 from enrollments fe where fe.uuid = u.uuid)"
+		} else {
+			cond += " and not exists (select 1 from enrollments fe where fe.uuid = u.uuid)"
+		}
+	}
+	if filters.ProjectSlug != "" {
+		cond += " and exists (select 1 from enrollments fe where fe.uuid = u.uuid and fe.project_slug = ?)"
+		args = append(args, filters.ProjectSlug)
+	}
+	if filters.LastModifiedFrom != nil && filters.LastModifiedTo != nil && !time.Time(*filters.LastModifiedFrom).Before(time.Time(*filters.LastModifiedTo)) {
+		err = errs.Wrap(errs.New(fmt.Errorf("last_modified_from %v must be before last_modified_to %v", *filters.LastModifiedFrom, *filters.LastModifiedTo), errs.ErrBadRequest), "ProfileFiltersWhere")
+		return
+	}
+	if filters.LastModifiedFrom != nil {
+		cond += " and u.last_modified >= ?"
+		args = append(args, time.Time(*filters.LastModifiedFrom))
+	}
+	if filters.LastModifiedTo != nil {
+		cond += " and u.last_modified < ?"
+		args = append(args, time.Time(*filters.LastModifiedTo))
+	}
+	if filters.LastModifiedBy != "" {
+		cond += " and (u.last_modified_by = ? or p.last_modified_by = ?)"
+		args = append(args, filters.LastModifiedBy, filters.LastModifiedBy)
+	}
+	if filters.Sort != "" {
+		col := strings.TrimPrefix(filters.Sort, "-")
+		desc := ""
+		if col != filters.Sort {
+			desc = " desc"
+		}
+		switch col {
+		case "uuid":
+			order = "u.uuid" + desc
+		case "name", "email", "country_code":
+			order = "max(p." + col + ")" + desc + ", u.uuid"
+		case "last_modified":
+			order = "max(u.last_modified)" + desc + ", u.uuid"
+		default:
+			err = errs.Wrap(errs.New(fmt.Errorf("unknown sort '%s', allowed: uuid, name, email, country_code, last_modified (optionally prefixed with '-')", filters.Sort), errs.ErrBadRequest), "ProfileFiltersWhere")
+			return
 		}
 	}
-	sort.SliceStable(all.Profiles, func(i, j int) bool {
-		a := &shared.LocalAllOutput{AllOutput: all.Profiles[i]}
-		b := &shared.LocalAllOutput{AllOutput: all.Profiles[j]}
-		return a.SortKey(true) < b.SortKey(true)
-	})
 	return
 }
 
 func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identityRequired bool, projectSlugs []string, tx *sql.Tx) (uids []*models.UniqueIdentityNestedDataOutput, nRows int64, err error) {
-	log.Info(fmt.Sprintf("QueryUniqueIdentitiesNested: q:%s rows:%d page:%d identityRequired:%v projectSlugs:%+v tx:%v", q, rows, page, identityRequired, projectSlugs, tx != nil))
+	return s.SearchUniqueIdentitiesNested(q, nil, rows, page, identityRequired, projectSlugs, tx)
+}
+
+// SearchUniqueIdentitiesNested - works like QueryUniqueIdentitiesNested but additionally applies structured filters and sorting
+func (s *service) SearchUniqueIdentitiesNested(q string, filters *models.ProfileFilters, rows, page int64, identityRequired bool, projectSlugs []string, tx *sql.Tx) (uids []*models.UniqueIdentityNestedDataOutput, nRows int64, err error) {
+	log.Info(fmt.Sprintf("SearchUniqueIdentitiesNested: q:%s filters:%+v rows:%d page:%d identityRequired:%v projectSlugs:%+v tx:%v", q, filters, rows, page, identityRequired, projectSlugs, tx != nil))
 	defer func() {
 		list := ""
 		nProfs := len(uids)
@@ -7010,8 +13207,9 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 		}
 		log.Info(
 			fmt.Sprintf(
-				"QueryUniqueIdentitiesNested(exit): q:%s rows:%d page:%d identityRequired:%v projectSlugs:%+v tx:%v uids:%s n_rows:%d err:%v",
+				"SearchUniqueIdentitiesNested(exit): q:%s filters:%+v rows:%d page:%d identityRequired:%v projectSlugs:%+v tx:%v uids:%s n_rows:%d err:%v",
 				q,
+				filters,
 				rows,
 				page,
 				identityRequired,
@@ -7045,20 +13243,25 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 			args = []interface{}{qLike, qLike, qLike, qLike, qLike, qLike}
 		}
 	}
+	fWhere, fArgs, order, err := s.ProfileFiltersWhere(filters)
+	if err != nil {
+		return
+	}
+	args = append(args, fArgs...)
 	if identityRequired {
-		sel = "select distinct u.uuid from uidentities u, identities i, profiles p"
+		sel = "select u.uuid from uidentities u, identities i, profiles p"
 		where = "where u.uuid = i.uuid and u.uuid = p.uuid and i.uuid = p.uuid"
 	} else {
-		sel = "select distinct u.uuid from uidentities u, profiles p"
+		sel = "select u.uuid from uidentities u, profiles p"
 		where = "where u.uuid = p.uuid"
 	}
-	where += " " + qWhere + " order by 1"
+	where += " " + qWhere + fWhere
 	paging := ""
 	if rows > 0 && page > 0 {
 		paging = fmt.Sprintf(" limit %d offset %d", rows, (page-1)*rows)
 	}
 	var qrows *sql.Rows
-	query := sel + " " + where + paging
+	query := sel + " " + where + " group by u.uuid order by " + order + paging
 	qrows, err = s.Query(sdb, tx, query, args...)
 	if err != nil {
 		return
@@ -7068,17 +13271,20 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 	if identityRequired {
 		//sel = "select distinct u.uuid, u.last_modified, p.name, p.email, p.gender, p.gender_acc, p.is_bot, p.country_code, "
 		sel = "select distinct u.uuid, u.last_modified, p.name, p.email, p.is_bot, p.country_code, "
-		sel += "i.id, i.name, i.email, i.username, i.source, i.last_modified, e.id, e.start, e.end, e.organization_id, e.project_slug, e.role, o.name "
+		sel += "i.id, i.name, i.email, i.username, i.source, i.last_modified, e.id, e.start, e.end, e.organization_id, e.project_slug, e.role, o.name, "
+		sel += "e.provenance, e.evidence_url, e.evidence_notes, e.confidence "
 		sel += "from uidentities u, identities i, profiles p "
 		sel += "left join enrollments e on e.uuid = p.uuid left join organizations o on o.id = e.organization_id "
 		sel += "where u.uuid = i.uuid and u.uuid = p.uuid and i.uuid = p.uuid and u.uuid in ("
 	} else {
 		//sel = "select distinct s.uuid, s.last_modified, s.name, s.email, s.gender, s.gender_acc, s.is_bot, s.country_code, "
 		sel = "select distinct s.uuid, s.last_modified, s.name, s.email, s.is_bot, s.country_code, "
-		sel += "i.id, i.name, i.email, i.username, i.source, i.last_modified, s.id, s.start, s.end, s.organization_id, s.project_slug, s.role, s.oname "
+		sel += "i.id, i.name, i.email, i.username, i.source, i.last_modified, s.id, s.start, s.end, s.organization_id, s.project_slug, s.role, s.oname, "
+		sel += "s.provenance, s.evidence_url, s.evidence_notes, s.confidence "
 		//sel += "from (select distinct u.uuid, u.last_modified, p.name, p.email, p.gender, p.gender_acc, p.is_bot, p.country_code, "
 		sel += "from (select distinct u.uuid, u.last_modified, p.name, p.email, p.is_bot, p.country_code, "
-		sel += "e.id, e.start, e.end, e.organization_id, e.project_slug, e.role, o.name as oname from uidentities u, profiles p "
+		sel += "e.id, e.start, e.end, e.organization_id, e.project_slug, e.role, o.name as oname, "
+		sel += "e.provenance, e.evidence_url, e.evidence_notes, e.confidence from uidentities u, profiles p "
 		sel += "left join enrollments e on e.uuid = p.uuid left join organizations o on o.id = e.organization_id "
 		sel += "where u.uuid = p.uuid and u.uuid in ("
 	}
@@ -7118,6 +13324,10 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 		rolOrganization   *string
 		rolProjectSlug    *string
 		rolRole           *string
+		rolProvenance     *string
+		rolEvidenceURL    *string
+		rolEvidenceNotes  *string
+		rolConfidence     *int64
 		iID               *string
 		iName             *string
 		iEmail            *string
@@ -7150,6 +13360,7 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 			&prof.Name, &prof.Email /*, &prof.Gender, &prof.GenderAcc*/, &prof.IsBot, &prof.CountryCode,
 			&iID, &iName, &iEmail, &iUsername, &iSource, &iLastModified,
 			&rolID, &rolStart, &rolEnd, &rolOrganizationID, &rolProjectSlug, &rolRole, &rolOrganization,
+			&rolProvenance, &rolEvidenceURL, &rolEvidenceNotes, &rolConfidence,
 		)
 		if err != nil {
 			return
@@ -7171,6 +13382,10 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 					End:            *rolEnd,
 					ProjectSlug:    rolProjectSlug,
 					Role:           *rolRole,
+					Provenance:     rolProvenance,
+					EvidenceURL:    rolEvidenceURL,
+					EvidenceNotes:  rolEvidenceNotes,
+					Confidence:     rolConfidence,
 					OrganizationID: *rolOrganizationID,
 					Organization: &models.OrganizationDataOutput{
 						ID:   *rolOrganizationID,
@@ -7220,13 +13435,11 @@ func (s *service) QueryUniqueIdentitiesNested(q string, rows, page int64, identi
 	if err != nil {
 		return
 	}
-	suuids := []string{}
-	for uuid := range uidsMap {
-		suuids = append(suuids, uuid)
-	}
-	sort.Strings(suuids)
-	for _, uuid := range suuids {
-		uids = append(uids, uidsMap[uuid])
+	for _, uuid := range uuids {
+		uid, ok := uidsMap[uuid.(string)]
+		if ok {
+			uids = append(uids, uid)
+		}
 	}
 	sel = "select count(distinct u.uuid) from uidentities u, identities i, profiles p"
 	query = sel + " " + where
@@ -7613,7 +13826,7 @@ func (s *service) UnarchiveProfileNested(uuid string, projects []string) (uid *m
 	}
 	defer func() {
 		if tx != nil {
-			tx.Rollback()
+			s.RollbackTx(tx)
 		}
 	}()
 	err = s.UnarchiveUUID(uuid, *archivedAt, tx)
@@ -7630,7 +13843,7 @@ func (s *service) UnarchiveProfileNested(uuid string, projects []string) (uid *m
 		err = errs.Wrap(errs.New(err, errs.ErrBadRequest), "UnarchiveProfileNested")
 		return
 	}
-	err = tx.Commit()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
@@ -7662,7 +13875,7 @@ func (s *service) DeleteProfileNested(uuid string, archive bool) (status *models
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		archivedDate := time.Now()
@@ -7676,7 +13889,7 @@ func (s *service) DeleteProfileNested(uuid string, archive bool) (status *models
 		status.Text = fmt.Sprintf("Deleted profile uuid: '%s' (and all dependent objects), archive: %v", uuid, archive)
 	}
 	if tx != nil {
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -7803,8 +14016,8 @@ func (s *service) GetListOrganizations(q string, rows, page int64) (getListOrgan
 	return
 }
 
-func (s *service) GetListProfiles(q string, rows, page int64, projectSlugs []string) (getListProfiles *models.GetListProfilesOutput, err error) {
-	log.Info(fmt.Sprintf("GetListProfiles: q:%s rows:%d page:%d projectSlugs:%+v", q, rows, page, projectSlugs))
+func (s *service) GetListProfiles(q string, filters *models.ProfileFilters, rows, page int64, projectSlugs []string) (getListProfiles *models.GetListProfilesOutput, err error) {
+	log.Info(fmt.Sprintf("GetListProfiles: q:%s filters:%+v rows:%d page:%d projectSlugs:%+v", q, filters, rows, page, projectSlugs))
 	// s.SetOrigin()
 	getListProfiles = &models.GetListProfilesOutput{}
 	defer func() {
@@ -7817,8 +14030,9 @@ func (s *service) GetListProfiles(q string, rows, page int64, projectSlugs []str
 		}
 		log.Info(
 			fmt.Sprintf(
-				"GetListProfiles(exit): q:%s rows:%d page:%d projectSlugs:%+v getListProfiles:%s err:%v",
+				"GetListProfiles(exit): q:%s filters:%+v rows:%d page:%d projectSlugs:%+v getListProfiles:%s err:%v",
 				q,
+				filters,
 				rows,
 				page,
 				projectSlugs,
@@ -7829,11 +14043,12 @@ func (s *service) GetListProfiles(q string, rows, page int64, projectSlugs []str
 	}()
 	nRows := int64(0)
 	var ary []*models.UniqueIdentityNestedDataOutput
-	ary, nRows, err = s.QueryUniqueIdentitiesNested(q, rows, page, true, projectSlugs, nil)
+	ary, nRows, err = s.SearchUniqueIdentitiesNested(q, filters, rows, page, true, projectSlugs, nil)
 	if err != nil {
 		return
 	}
 	getListProfiles.Uids = ary
+	getListProfiles.Filters = filters
 	getListProfiles.Rows = nRows
 	if rows == 0 {
 		getListProfiles.NPages = 1
@@ -7908,6 +14123,7 @@ func (s *service) PutOrgDomain(org, dom string, overwrite, isTopDomain, skipEnro
 	defer func() {
 		log.Info(fmt.Sprintf("PutOrgDomain(exit): org:%s dom:%s overwrite:%v isTopDomain:%v skipEnrollments:%v putOrgDomain:%+v err:%v", org, dom, overwrite, isTopDomain, skipEnrollments, putOrgDomain, err))
 	}()
+	defer s.InvalidateAffiliationCache()
 	// Uses RW connection only
 	rows, err := s.Query(s.db, nil, "select id from organizations where name = ? limit 1", org)
 	if err != nil {
@@ -7966,7 +14182,7 @@ func (s *service) PutOrgDomain(org, dom string, overwrite, isTopDomain, skipEnro
 	// Rollback unless tx was set to nil after successful commit
 	defer func() {
 		if tx != nil {
-			tx.Rollback()
+			s.RollbackTx(tx)
 		}
 	}()
 	dom = strings.TrimSpace(dom)
@@ -7987,16 +14203,17 @@ func (s *service) PutOrgDomain(org, dom string, overwrite, isTopDomain, skipEnro
 		var res sql.Result
 		affected := int64(0)
 		if overwrite {
-			res, err = s.Exec(
-				s.db,
-				tx,
-				"delete from enrollments where (locked_by is null or trim(locked_by) = '') "+
-					"and uuid in (select distinct sub.uuid from ("+
-					"select distinct uuid from profiles where email like ? "+
-					"union select distinct uuid from identities where email like ?) sub)",
-				"%"+dom,
-				"%"+dom,
-			)
+			cond := "(locked_by is null or trim(locked_by) = '') " +
+				"and uuid in (select distinct sub.uuid from (" +
+				"select distinct uuid from profiles where email like ? " +
+				"union select distinct uuid from identities where email like ?) sub)"
+			if shared.GEnrollmentHistory {
+				_, err = s.Exec(s.db, tx, enrollmentsArchiveInsert(cond), time.Now(), s.lfid, "%"+dom, "%"+dom)
+				if err != nil {
+					return
+				}
+			}
+			res, err = s.Exec(s.db, tx, "delete from enrollments where "+cond, "%"+dom, "%"+dom)
 			if err != nil {
 				return
 			}
@@ -8064,7 +14281,7 @@ func (s *service) PutOrgDomain(org, dom string, overwrite, isTopDomain, skipEnro
 			}
 		}
 	}
-	err = tx.Commit()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
@@ -8153,6 +14370,7 @@ func (s *service) UpdateProjectSlugs(uuidsProjs map[string][]string) (status str
 	defer func() {
 		log.Info(fmt.Sprintf("UpdateProjectSlugs(exit): uuids:%d status:%s err:%+v", len(uuidsProjs), status, err))
 	}()
+	defer s.InvalidateAffiliationCache()
 	type updateResult struct {
 		err     error
 		uuid    string
@@ -8173,18 +14391,22 @@ func (s *service) UpdateProjectSlugs(uuidsProjs map[string][]string) (status str
 		rows, err = s.Query(
 			s.db,
 			nil,
-			"select id, organization_id, role, start, end from enrollments where uuid = ? and project_slug is null",
+			"select id, organization_id, role, start, end, provenance, evidence_url, evidence_notes, confidence from enrollments where uuid = ? and project_slug is null",
 			uuid,
 		)
 		if err != nil {
 			return
 		}
 		type rolData struct {
-			id    int64
-			orgID int64
-			role  string
-			start strfmt.DateTime
-			end   strfmt.DateTime
+			id            int64
+			orgID         int64
+			role          string
+			start         strfmt.DateTime
+			end           strfmt.DateTime
+			provenance    *string
+			evidenceURL   *string
+			evidenceNotes *string
+			confidence    *int64
 		}
 		var (
 			rol  rolData
@@ -8192,7 +14414,7 @@ func (s *service) UpdateProjectSlugs(uuidsProjs map[string][]string) (status str
 		)
 		uni := make(map[string]struct{})
 		for rows.Next() {
-			err = rows.Scan(&rol.id, &rol.orgID, &rol.role, &rol.start, &rol.end)
+			err = rows.Scan(&rol.id, &rol.orgID, &rol.role, &rol.start, &rol.end, &rol.provenance, &rol.evidenceURL, &rol.evidenceNotes, &rol.confidence)
 			if err != nil {
 				return
 			}
@@ -8248,13 +14470,13 @@ func (s *service) UpdateProjectSlugs(uuidsProjs map[string][]string) (status str
 		}
 		args := []interface{}{}
 		nRols := 0
-		query := "insert into enrollments(uuid, organization_id, role, start, end, project_slug, last_modified_by) values"
+		query := "insert into enrollments(uuid, organization_id, role, start, end, project_slug, provenance, evidence_url, evidence_notes, confidence, last_modified_by) values"
 		for _, rol := range rols {
 			start := time.Time(rol.start)
 			end := time.Time(rol.end)
 			for _, slug := range slugs {
-				query += "(?,?,?,?,?,?,?),"
-				args = append(args, uuid, rol.orgID, rol.role, start, end, slug, s.lfid)
+				query += "(?,?,?,?,?,?,?,?,?,?,?),"
+				args = append(args, uuid, rol.orgID, rol.role, start, end, slug, rol.provenance, rol.evidenceURL, rol.evidenceNotes, rol.confidence, s.lfid)
 				nRols++
 			}
 		}
@@ -8264,28 +14486,34 @@ func (s *service) UpdateProjectSlugs(uuidsProjs map[string][]string) (status str
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		query = query[0 : len(query)-1]
-		_, err = s.Exec(s.db, nil, query, args...)
+		_, err = s.Exec(s.db, tx, query, args...)
 		if err != nil {
 			return
 		}
 		args = []interface{}{}
-		query = "delete from enrollments where (locked_by is null or trim(locked_by) = '') and id in ("
+		cond := "(locked_by is null or trim(locked_by) = '') and id in ("
 		nDels := 0
 		for _, rol := range rols {
-			query += "?,"
+			cond += "?,"
 			args = append(args, rol.id)
 			nDels++
 		}
-		query = query[0:len(query)-1] + ")"
-		_, err = s.Exec(s.db, nil, query, args...)
+		cond = cond[0:len(cond)-1] + ")"
+		if shared.GEnrollmentHistory {
+			_, err = s.Exec(s.db, tx, enrollmentsArchiveInsert(cond), append([]interface{}{time.Now(), s.lfid}, args...)...)
+			if err != nil {
+				return
+			}
+		}
+		_, err = s.Exec(s.db, tx, "delete from enrollments where "+cond, args...)
 		if err != nil {
 			return
 		}
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -8383,6 +14611,7 @@ func (s *service) UpdateAffRange(updates []*models.EnrollmentProjectRange) (stat
 	defer func() {
 		log.Info(fmt.Sprintf("UpdateAffRange(exit): updates:%d status:%s err:%+v", len(updates), status, err))
 	}()
+	defer s.InvalidateAffiliationCache()
 	thrN := runtime.NumCPU()
 	var mtx *sync.Mutex
 	var umtx map[string]*sync.Mutex
@@ -8399,47 +14628,37 @@ func (s *service) UpdateAffRange(updates []*models.EnrollmentProjectRange) (stat
 		queries := []string{}
 		argss := [][]interface{}{}
 		uuid := update.UUID
+		cond := "(locked_by is null or trim(locked_by) = '') and uuid = ? "
+		condArgs := []interface{}{uuid}
+		if update.ProjectSlug == nil {
+			cond += "and project_slug is null "
+		} else {
+			cond += "and project_slug = ? "
+			condArgs = append(condArgs, *update.ProjectSlug)
+		}
+		changed := []string{}
+		changedArgs := []interface{}{}
 		ts := time.Time(update.Start)
 		if ts.After(shared.MinPeriodDate) && ts.Before(shared.MaxPeriodDate) {
-			query := "update enrollments set start = ?, last_modified_by = ? where (locked_by is null or trim(locked_by) = '') and uuid = ? "
-			args := []interface{}{ts, s.lfid, uuid}
-			if update.ProjectSlug == nil {
-				query += "and project_slug is null "
-			} else {
-				query += "and project_slug = ? "
-				args = append(args, *update.ProjectSlug)
-			}
-			query += "and start < ?"
-			args = append(args, ts)
-			queries = append(queries, query)
-			argss = append(argss, args)
+			queries = append(queries, "update enrollments set start = ?, last_modified_by = ? where "+cond+"and start < ?")
+			argss = append(argss, append(append([]interface{}{ts, s.lfid}, condArgs...), ts))
+			changed = append(changed, "start < ?")
+			changedArgs = append(changedArgs, ts)
 		}
 		te := time.Time(update.End)
 		if te.After(shared.MinPeriodDate) && te.Before(shared.MaxPeriodDate) && !te.Before(ts) {
-			query := "update enrollments set end = ?, last_modified_by = ? where (locked_by is null or trim(locked_by) = '') and uuid = ? "
-			args := []interface{}{te, s.lfid, uuid}
-			if update.ProjectSlug == nil {
-				query += "and project_slug is null "
-			} else {
-				query += "and project_slug = ? "
-				args = append(args, *update.ProjectSlug)
-			}
-			query += "and end > ?"
-			args = append(args, te)
-			queries = append(queries, query)
-			argss = append(argss, args)
-		}
-		query := "delete from enrollments where uuid = ? and (locked_by is null or trim(locked_by) = '') "
-		args := []interface{}{uuid}
-		if update.ProjectSlug == nil {
-			query += "and project_slug is null "
-		} else {
-			query += "and project_slug = ? "
-			args = append(args, *update.ProjectSlug)
-		}
-		query += "and end <= start"
-		queries = append(queries, query)
-		argss = append(argss, args)
+			queries = append(queries, "update enrollments set end = ?, last_modified_by = ? where "+cond+"and end > ?")
+			argss = append(argss, append(append([]interface{}{te, s.lfid}, condArgs...), te))
+			changed = append(changed, "end > ?")
+			changedArgs = append(changedArgs, te)
+		}
+		if shared.GEnrollmentHistory && len(changed) > 0 {
+			// Previous versions of enrollments are archived (once) before they are changed, see GetUniqueIdentityNestedAsOf
+			queries = append([]string{enrollmentsArchiveInsert(cond + "and (" + strings.Join(changed, " or ") + ")")}, queries...)
+			argss = append([][]interface{}{append(append([]interface{}{time.Now(), s.lfid}, condArgs...), changedArgs...)}, argss...)
+		}
+		queries = append(queries, "delete from enrollments where "+cond+"and end <= start")
+		argss = append(argss, condArgs)
 		if mtx != nil {
 			mtx.Lock()
 			m, ok := umtx[uuid]
@@ -8459,7 +14678,7 @@ func (s *service) UpdateAffRange(updates []*models.EnrollmentProjectRange) (stat
 		}
 		defer func() {
 			if tx != nil {
-				tx.Rollback()
+				s.RollbackTx(tx)
 			}
 		}()
 		// fmt.Printf("%s: %+v\n", query, args)
@@ -8470,7 +14689,7 @@ func (s *service) UpdateAffRange(updates []*models.EnrollmentProjectRange) (stat
 				return
 			}
 		}
-		err = tx.Commit()
+		err = s.CommitTx(tx)
 		if err != nil {
 			return
 		}
@@ -8547,7 +14766,7 @@ func (s *service) SetOrigin() {
 	}
 }
 
-func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nUpdated int, err error) {
+func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nUpdated int, skipped []string, err error) {
 	s.mtx.Lock()
 	log.Info(fmt.Sprintf("BulkUpdate: add:%d del:%d", len(add), len(del)))
 	// s.SetOrigin()
@@ -8652,18 +14871,82 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 		delete(mDelProf, k)
 		mUpdProf[k] = [2]*models.AllOutput{a, d}
 	}
+	// Profiles of persons erased by ForgetProfile are not (re)added, updates to them are skipped too
+	allEmails := func(obj *models.AllOutput) (emails []string) {
+		if obj.Email != nil {
+			emails = append(emails, *obj.Email)
+		}
+		for _, iden := range obj.Identities {
+			for _, str := range []*string{iden.Email, iden.Username, iden.Name} {
+				if str != nil {
+					emails = append(emails, *str)
+				}
+			}
+		}
+		return
+	}
+	emails := []string{}
+	for _, prof := range mAddProf {
+		emails = append(emails, allEmails(prof)...)
+	}
+	for _, upd := range mUpdProf {
+		emails = append(emails, allEmails(upd[0])...)
+	}
+	suppressed, err := s.suppressedEmails(emails, nil)
+	if err != nil {
+		return
+	}
+	isSuppressed := func(obj *models.AllOutput) bool {
+		for _, email := range allEmails(obj) {
+			if _, ok := suppressed[strings.ToLower(strings.TrimSpace(email))]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(suppressed) > 0 {
+		for k, prof := range mAddProf {
+			if isSuppressed(prof) {
+				log.Info(fmt.Sprintf("BulkUpdate: add profile '%s' - has erased emails, skipping", k))
+				delete(mAddProf, k)
+			}
+		}
+		for k, upd := range mUpdProf {
+			if isSuppressed(upd[0]) {
+				log.Info(fmt.Sprintf("BulkUpdate: update profile '%s' - has erased emails, skipping", k))
+				delete(mUpdProf, k)
+			}
+		}
+	}
 	tx, err := s.db.Begin()
 	if err != nil {
 		return
 	}
 	defer func() {
 		if tx != nil {
-			tx.Rollback()
+			s.RollbackTx(tx)
 		}
+		// Bulk update can touch enrollments of many profiles (also newly created ones), so entire cache is dropped
+		s.InvalidateAffiliationCache()
 	}()
 	mOrgID := make(map[int64]*models.OrganizationDataOutput)
 	mOrgName := make(map[string]*models.OrganizationDataOutput)
 	archiveDate := time.Now()
+	// Locked profiles are never deleted or updated, their UUIDs are returned in skipped
+	skipped = []string{}
+	isLocked := func(uuid string) (locked bool, err error) {
+		var lockedBy map[string]string
+		lockedBy, err = s.LockedProfiles([]string{uuid}, tx)
+		if err != nil {
+			return
+		}
+		_, locked = lockedBy[uuid]
+		if locked {
+			log.Info(fmt.Sprintf("BulkUpdate: profile '%s' is locked by '%s', skipping", uuid, lockedBy[uuid]))
+			skipped = append(skipped, uuid)
+		}
+		return
+	}
 	for _, prof := range mDelProf {
 		foundProfs := []*models.ProfileDataOutput{}
 		columns := []string{}
@@ -8707,6 +14990,14 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 			log.Info(fmt.Sprintf("BulkUpdate: delete profile '%s' - didn't found matching profiles, continuying", obj.SortKey(true)))
 		case 1:
 			uuid := foundProfs[0].UUID
+			locked := false
+			locked, err = isLocked(uuid)
+			if err != nil {
+				return
+			}
+			if locked {
+				continue
+			}
 			_, err = s.ArchiveUUID(uuid, &archiveDate, tx)
 			if err != nil {
 				return
@@ -8817,6 +15108,14 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 					uuid = k
 					break
 				}
+				locked := false
+				locked, err = isLocked(uuid)
+				if err != nil {
+					return
+				}
+				if locked {
+					continue
+				}
 				_, err = s.ArchiveUUID(uuid, &archiveDate, tx)
 				if err != nil {
 					return
@@ -8875,6 +15174,14 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 			for _, foundProf := range foundProfs {
 				var identities []*models.IdentityDataOutput
 				var enrollments []*models.EnrollmentDataOutput
+				locked := false
+				locked, err = isLocked(foundProf.UUID)
+				if err != nil {
+					return
+				}
+				if locked {
+					continue
+				}
 				identities, err = s.FindIdentities([]string{"uuid"}, []interface{}{foundProf.UUID}, []bool{false}, false, tx)
 				if err != nil {
 					return
@@ -9056,6 +15363,10 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 				OrganizationID: organization.ID,
 				ProjectSlug:    rol.ProjectSlug,
 				Role:           rol.Role,
+				Provenance:     rol.Provenance,
+				EvidenceURL:    rol.EvidenceURL,
+				EvidenceNotes:  rol.EvidenceNotes,
+				Confidence:     rol.Confidence,
 			}
 			_, err = s.AddEnrollment(enrollment, false, false, tx)
 			if err != nil {
@@ -9119,6 +15430,14 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 			log.Info(fmt.Sprintf("BulkUpdate: update profile '%s'/'%s' - didn't found matching profiles, continuying", obj.SortKey(true), delObj.SortKey(true)))
 		case 1:
 			uuid := foundProfs[0].UUID
+			locked := false
+			locked, err = isLocked(uuid)
+			if err != nil {
+				return
+			}
+			if locked {
+				break
+			}
 			_, err = s.ArchiveUUID(uuid, &archiveDate, tx)
 			if err != nil {
 				return
@@ -9212,6 +15531,16 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 					uuids[foundProf.UUID] = struct{}{}
 				}
 			}
+			for uuid := range uuids {
+				locked := false
+				locked, err = isLocked(uuid)
+				if err != nil {
+					return
+				}
+				if locked {
+					delete(uuids, uuid)
+				}
+			}
 			nUUIDs = len(uuids)
 			switch nUUIDs {
 			case 0:
@@ -9381,6 +15710,10 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 					OrganizationID: organization.ID,
 					ProjectSlug:    rol.ProjectSlug,
 					Role:           rol.Role,
+					Provenance:     rol.Provenance,
+					EvidenceURL:    rol.EvidenceURL,
+					EvidenceNotes:  rol.EvidenceNotes,
+					Confidence:     rol.Confidence,
 				}
 				_, err = s.AddEnrollment(enrollment, true, false, tx)
 				if err != nil {
@@ -9389,7 +15722,7 @@ func (s *service) BulkUpdate(add, del []*models.AllOutput) (nAdded, nDeleted, nU
 			}
 		}
 	}
-	err = tx.Commit()
+	err = s.CommitTx(tx)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,12 @@
+-- Adds `affiliation_policies` table: per-foundation enabled steps of the 5-step affiliation algorithm (in order)
+-- `steps` is a comma separated list of step numbers: 1 - project, 2 - foundation-f, 3 - global, 4 - foundation, 5 - any
+-- `foundation` = 'default' applies to all foundations without their own policy, no policy means all steps 1,2,3,4,5
+create table affiliation_policies(
+  foundation varchar(128) not null,
+  steps varchar(32) not null,
+  last_modified datetime(6) not null default now(),
+  last_modified_by varchar(128),
+  primary key(foundation)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci;
+-- Example: never borrow affiliation from other projects in CNCF
+-- insert into affiliation_policies(foundation, steps) values('cncf', '1,2,3');
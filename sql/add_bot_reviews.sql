@@ -0,0 +1,9 @@
+-- Adds `profiles_bot_reviews` table: bot suggestions reviewed using bot_suggestions/review API
+-- `is_bot` is 1 when suggestion was accepted (profile flagged as a bot) and 0 when it was rejected, reviewed profiles are no longer suggested
+create table profiles_bot_reviews(
+  uuid varchar(128) not null,
+  is_bot tinyint(1) not null,
+  reviewed_at datetime(6) not null default now(6),
+  reviewed_by varchar(128),
+  primary key(uuid)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci;
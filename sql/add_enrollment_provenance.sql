@@ -0,0 +1,13 @@
+-- Adds enrollment provenance: why given affiliation exists, evidence supporting it and how confident we are about it
+-- `provenance` is one of: manual, email_domain, company_roster, self_claim, gitdm, inferred
+-- `confidence` is 0-100, null means unknown, resolution prefers higher confidence when multiple enrollments overlap
+alter table enrollments add provenance varchar(32);
+alter table enrollments add evidence_url varchar(512);
+alter table enrollments add evidence_notes text;
+alter table enrollments add confidence tinyint unsigned;
+alter table enrollments_archive add provenance varchar(32);
+alter table enrollments_archive add evidence_url varchar(512);
+alter table enrollments_archive add evidence_notes text;
+alter table enrollments_archive add confidence tinyint unsigned;
+-- Indices
+create index enrollments_provenance_idx on enrollments(provenance);
@@ -0,0 +1,12 @@
+-- Adds enrollment creation and modification time, so enrollments can be reconstructed as they were at any point in time (as_of)
+-- Existing enrollments keep null `created_at` (created before it was tracked), new ones get both columns set by DB defaults
+-- Archived enrollments keep `created_at` and `last_modified` of the version that was archived
+-- API uses these columns (and archives every enrollment edit) only when started with ENROLLMENT_HISTORY set, apply this first
+alter table enrollments add created_at datetime(6);
+alter table enrollments add last_modified datetime(6);
+alter table enrollments modify created_at datetime(6) default current_timestamp(6);
+alter table enrollments modify last_modified datetime(6) default current_timestamp(6) on update current_timestamp(6);
+alter table enrollments_archive add created_at datetime(6);
+alter table enrollments_archive add last_modified datetime(6);
+-- Indices
+create index enrollments_archive_id_archived_at_idx on enrollments_archive(id, archived_at);
@@ -0,0 +1,33 @@
+-- Adds GDPR erasure tables used by forget_profile API
+-- `erasure_receipts` is an auditable receipt of each erasure, it contains no personal data
+-- `uuids` is a "," separated list of erased uuid and uuids merged into it (their archived data was anonymized too)
+-- `es_status` is ok or failed (then `es_error` holds the error), ES author fields are rewritten after DB changes are committed
+-- `es_indices` are ES indices that were anonymized, `es_not_covered` are ES indices that were not (raw indices)
+create table erasure_receipts(
+  id bigint not null auto_increment,
+  uuid varchar(128) not null,
+  uuids text,
+  profiles int not null default 0,
+  identities int not null default 0,
+  archived_profiles int not null default 0,
+  archived_identities int not null default 0,
+  es_status varchar(32),
+  es_error text,
+  es_indices varchar(255),
+  es_not_covered varchar(255),
+  erased_at datetime(6) not null default now(6),
+  erased_by varchar(128),
+  primary key(id)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci;
+-- Adds `suppressed_emails` table: SHA-256 hashes of lowercased emails of erased persons
+-- identities with those emails are skipped by add_identities and bulk_update APIs, so re-imports don't recreate them
+create table suppressed_emails(
+  email_hash char(64) not null,
+  receipt_id bigint not null,
+  created_at datetime(6) not null default now(6),
+  created_by varchar(128),
+  primary key(email_hash)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci;
+-- Indices
+create index erasure_receipts_uuid_idx on erasure_receipts(uuid);
+create index suppressed_emails_receipt_id_idx on suppressed_emails(receipt_id);
@@ -0,0 +1,20 @@
+-- Adds `uidentities_lineage` table: every merge, move, unmerge and unarchive of profiles/identities
+-- `action` is one of: merge, move, unmerge, unarchive
+-- `origin` is what triggered it: api, merge_all, lfx_primary, sf_sync
+-- `archived_at` is the archive created (merge) or used (unmerge, unarchive), `identity_id` is only set for move and unarchive
+create table uidentities_lineage(
+  id bigint not null auto_increment,
+  action varchar(32) not null,
+  origin varchar(32) not null,
+  from_uuid varchar(128),
+  to_uuid varchar(128),
+  identity_id varchar(128),
+  archived_at datetime(6),
+  created_at datetime(6) not null default now(6),
+  created_by varchar(128),
+  primary key(id)
+) engine=InnoDB default charset=utf8mb4 collate=utf8mb4_unicode_520_ci;
+-- Indices
+create index uidentities_lineage_from_uuid_idx on uidentities_lineage(from_uuid);
+create index uidentities_lineage_to_uuid_idx on uidentities_lineage(to_uuid);
+create index uidentities_lineage_created_at_idx on uidentities_lineage(created_at);